@@ -4,13 +4,21 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
+	"text/tabwriter"
+	"time"
 
 	"github.com/al-bashkir/openvpn-keycloak-auth/internal/auth"
 	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
 	"github.com/al-bashkir/openvpn-keycloak-auth/internal/daemon"
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/httpserver"
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/ipc"
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/oidc"
 	"github.com/spf13/cobra"
 )
 
@@ -24,10 +32,36 @@ var (
 // Global flags
 var (
 	configFile string
+	profile    string
 	logLevel   string
 	logFormat  string
 )
 
+// check-config flags
+var sampleToken string
+
+// auth flags
+var (
+	jsonOutput bool
+	authViaEnv bool
+)
+
+// test-auth flags
+var (
+	testAuthListen      string
+	testAuthRedirectURI string
+	testAuthCommonName  string
+	testAuthInstance    string
+)
+
+// validate-token flags
+var (
+	validateTokenRaw        string
+	validateTokenUsername   string
+	validateTokenCommonName string
+	validateTokenInstance   string
+)
+
 // Exit codes
 const (
 	ExitSuccess  = 0
@@ -72,7 +106,7 @@ This mode is typically run as a systemd service.`,
 var overrideExitCode = -1
 
 var authCmd = &cobra.Command{
-	Use:   "auth <credentials-file>",
+	Use:   "auth [credentials-file]",
 	Short: "Auth script mode (called by OpenVPN)",
 	Long: `OpenVPN auth script mode - handles single authentication request.
 
@@ -81,6 +115,10 @@ This command is called by OpenVPN via --auth-user-pass-verify with the
   Line 1: Username
   Line 2: Password (ignored for SSO)
 
+With the 'via-env' option, OpenVPN passes no file and sets the username
+and password environment variables instead. Pass --via-env, or omit the
+credentials file while username is set, to read them from there.
+
 The script:
   1. Reads OpenVPN environment variables
   2. Sends auth request to daemon via Unix socket
@@ -90,8 +128,12 @@ The script:
 Exit codes:
   0 = Authentication success (immediate, not used for SSO)
   1 = Authentication failure
-  2 = Authentication deferred (daemon will complete it)`,
-	Args: cobra.ExactArgs(1),
+  2 = Authentication deferred (daemon will complete it)
+
+With --json-output, a single JSON line summarizing the decision
+(decision, username, session_id, pending_method, reason, exit_code) is
+also written to stdout for log aggregation.`,
+	Args: cobra.MaximumNArgs(1),
 	RunE: runAuth,
 }
 
@@ -112,6 +154,11 @@ Checks for:
   - Required fields present
   - Valid URLs and paths
   - Logical consistency
+  - Claim path syntax (username_claim, role_claim, ...)
+
+With --sample-token, the claim paths are also resolved against the given
+token (a JWT or a JSON object of claims) to show what they extract. The
+token signature is not verified.
 
 Exit codes:
   0 = Configuration is valid
@@ -119,20 +166,130 @@ Exit codes:
 	RunE: runCheckConfig,
 }
 
+var sessionsCmd = &cobra.Command{
+	Use:   "sessions",
+	Short: "List active authentication sessions",
+	Long: `List the daemon's active authentication sessions with username,
+client IP, age and state.
+
+The command talks to the running daemon over its Unix socket. The daemon
+only answers root and the user it runs as, even though the socket is
+accessible to the OpenVPN group.`,
+	Args: cobra.NoArgs,
+	RunE: runSessions,
+}
+
+var sessionsKillCmd = &cobra.Command{
+	Use:   "kill <session-id>",
+	Short: "Fail and delete an authentication session",
+	Long: `Write an auth failure for a pending session, so OpenVPN rejects the
+client immediately, and delete the session. Session IDs are shown by
+'sessions'.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runSessionsKill,
+}
+
+var testAuthCmd = &cobra.Command{
+	Use:   "test-auth <username>",
+	Short: "Simulate an SSO login without OpenVPN",
+	Long: `Run a complete OIDC login for <username> against the configured
+Keycloak, without OpenVPN and without writing any auth_control files.
+
+The command starts the flow like the daemon would for a connecting client,
+prints the authorization URL and waits for the callback. Open the URL in a
+browser and sign in; the callback is then checked exactly like the
+daemon's: auth time (oidc.max_age), authentication context
+(oidc.required_acr), roles and groups, instance roles (with --instance),
+the username match and the common name match. Each check is reported.
+auth.external_authorizer is not consulted.
+
+Keycloak redirects the browser to oidc.redirect_uri, so the callback
+listener must be reachable there. By default it listens on listen.http,
+which requires the daemon to be stopped. Alternatively, register a second
+redirect URI with the Keycloak client and pass it with --redirect-uri and
+a matching --listen address. With tls.enabled and cert_file/key_file, the
+listener serves HTTPS with the daemon's certificate.
+
+Exit codes:
+  0 = Login passed all checks
+  1 = Login failed or a check did not pass
+  3 = Configuration error`,
+	Args: cobra.ExactArgs(1),
+	RunE: runTestAuth,
+}
+
+var validateTokenCmd = &cobra.Command{
+	Use:   "validate-token",
+	Short: "Decode a token and check it against the configuration",
+	Long: `Decode an ID token or access token and show how the configuration
+reads it, to debug claim mapping.
+
+The token is taken from --token or read from stdin. The command prints the
+token's claims, what oidc.role_claim and each oidc.role_claim_fallbacks path
+(or each oidc.role_claims path) resolve to and which roles the role checks
+use, the group and username claims, and then runs the checks the daemon
+runs on a callback, in the same order, reporting each one: auth time
+(oidc.max_age), authentication context (oidc.required_acr), roles and
+groups, instance roles (with --instance), the username match (with
+--username) and the common name match (with --common-name).
+
+The signature and expiry are NOT verified; use a token you obtained
+yourself, e.g. from Keycloak's client scope evaluation.
+
+Exit codes:
+  0 = Token passes the checks
+  1 = A check failed, or the token cannot be decoded
+  3 = Configuration error`,
+	Args: cobra.NoArgs,
+	RunE: runValidateToken,
+}
+
 func init() {
 	// Global flags (available to all commands)
 	rootCmd.PersistentFlags().StringVar(&configFile, "config", "/etc/openvpn/keycloak-sso.yaml",
 		"Path to configuration file")
+	rootCmd.PersistentFlags().StringVar(&profile, "profile", "",
+		"Config profile to overlay from the profiles section (default $"+config.ProfileEnvVar+")")
 	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "",
 		"Log level (debug, info, warn, error) - overrides config file")
 	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "",
-		"Log format (json, text) - overrides config file")
+		"Log format (json, text, syslog) - overrides config file")
 
 	// Add subcommands
 	rootCmd.AddCommand(serveCmd)
 	rootCmd.AddCommand(authCmd)
 	rootCmd.AddCommand(versionCmd)
 	rootCmd.AddCommand(checkConfigCmd)
+	rootCmd.AddCommand(sessionsCmd)
+	sessionsCmd.AddCommand(sessionsKillCmd)
+	rootCmd.AddCommand(testAuthCmd)
+	rootCmd.AddCommand(validateTokenCmd)
+
+	authCmd.Flags().BoolVar(&jsonOutput, "json-output", false,
+		"Also write the auth decision to stdout as a single JSON line")
+	authCmd.Flags().BoolVar(&authViaEnv, "via-env", false,
+		"Read credentials from the username and password environment variables (OpenVPN via-env)")
+
+	checkConfigCmd.Flags().StringVar(&sampleToken, "sample-token", "",
+		"File with a sample token (JWT or JSON claims) to resolve claim paths against")
+
+	testAuthCmd.Flags().StringVar(&testAuthListen, "listen", "",
+		"Address to receive the callback on (default listen.http)")
+	testAuthCmd.Flags().StringVar(&testAuthRedirectURI, "redirect-uri", "",
+		"Redirect URI to use instead of oidc.redirect_uri (must be registered in Keycloak)")
+	testAuthCmd.Flags().StringVar(&testAuthCommonName, "common-name", "",
+		"Certificate common name, for selecting an oidc.providers entry")
+	testAuthCmd.Flags().StringVar(&testAuthInstance, "instance", "",
+		"OpenVPN server instance, for oidc.instance_required_roles")
+
+	validateTokenCmd.Flags().StringVar(&validateTokenRaw, "token", "",
+		"Raw JWT to check (default: read from stdin)")
+	validateTokenCmd.Flags().StringVar(&validateTokenUsername, "username", "",
+		"Expected OpenVPN username, for the username check")
+	validateTokenCmd.Flags().StringVar(&validateTokenCommonName, "common-name", "",
+		"Certificate common name, for selecting an oidc.providers entry and the common name check")
+	validateTokenCmd.Flags().StringVar(&validateTokenInstance, "instance", "",
+		"OpenVPN server instance, for oidc.instance_required_roles")
 }
 
 func main() {
@@ -148,13 +305,26 @@ func main() {
 	}
 }
 
-// runServe starts the daemon
-func runServe(cmd *cobra.Command, args []string) error {
-	// Load configuration
-	cfg, err := config.Load(configFile)
+// activeProfile returns the config profile from --profile, falling back to
+// OVPN_SSO_PROFILE.
+func activeProfile() string {
+	if profile != "" {
+		return profile
+	}
+	return os.Getenv(config.ProfileEnvVar)
+}
+
+// loadConfig loads the config file with the active profile applied.
+func loadConfig() (*config.Config, error) {
+	return config.LoadProfile(configFile, activeProfile())
+}
+
+// loadServeConfig loads the configuration with the log flag overrides
+// applied. It is also used to reload the configuration on SIGHUP.
+func loadServeConfig() (*config.Config, error) {
+	cfg, err := loadConfig()
 	if err != nil {
-		slog.Error("failed to load configuration", "error", err)
-		return fmt.Errorf("failed to load configuration: %w", err)
+		return nil, err
 	}
 
 	// Override log settings from flags if provided
@@ -164,6 +334,17 @@ func runServe(cmd *cobra.Command, args []string) error {
 	if logFormat != "" {
 		cfg.Log.Format = logFormat
 	}
+	return cfg, nil
+}
+
+// runServe starts the daemon
+func runServe(cmd *cobra.Command, args []string) error {
+	// Load configuration
+	cfg, err := loadServeConfig()
+	if err != nil {
+		slog.Error("failed to load configuration", "error", err)
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
 
 	// Initialize structured logging based on config
 	config.SetupLogging(&cfg.Log)
@@ -175,38 +356,132 @@ func runServe(cmd *cobra.Command, args []string) error {
 		"config", configFile,
 	)
 
-	// Create and run daemon
-	d, err := daemon.New(cfg)
+	// Create and run daemon. SIGINT/SIGTERM abort startup, e.g. while OIDC
+	// discovery waits to retry; Run installs its own handlers afterwards.
+	startCtx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	d, err := daemon.NewWithContext(startCtx, cfg)
+	stop()
 	if err != nil {
 		slog.Error("failed to create daemon", "error", err)
 		return fmt.Errorf("failed to create daemon: %w", err)
 	}
+	d.SetConfigLoader(loadServeConfig)
+	d.SetBuildInfo(httpserver.BuildInfo{Version: version, Commit: commit, BuildDate: buildDate})
 
 	return d.Run()
 }
 
 // runAuth handles single auth request from OpenVPN
 func runAuth(cmd *cobra.Command, args []string) error {
-	credentialsFile := args[0]
+	credentialsFile, err := authCredentialsFile(args, authViaEnv)
+	if err != nil {
+		return err
+	}
 
 	// Load config to get socket path
 	// If config file doesn't exist, use default socket path
-	socketPath := "/run/openvpn-keycloak-auth/auth.sock"
+	socketPath := defaultSocketPath
+
+	acceptAuthToken := false
+	dryRun := false
+	enableCRText := false
+	rejectInvalidIP := false
+	usernameSource := ""
 
-	cfg, err := config.Load(configFile)
-	if err == nil {
+	if cfg, err := loadConfig(); err == nil {
 		socketPath = cfg.Listen.Socket
+		acceptAuthToken = cfg.Auth.AcceptAuthToken
+		dryRun = cfg.Daemon.DryRun
+		enableCRText = cfg.Auth.EnableCRText
+		rejectInvalidIP = cfg.Auth.RejectInvalidIP
+		usernameSource = cfg.Auth.UsernameSource
 	}
 	// If config load fails, we still try with the default socket path
 
 	// Create auth handler
 	handler := auth.NewHandler(socketPath)
+	handler.SetAcceptAuthToken(acceptAuthToken)
+	handler.SetDryRun(dryRun)
+	handler.SetEnableCRText(enableCRText)
+	handler.SetRejectInvalidIP(rejectInvalidIP)
+	handler.SetUsernameSource(usernameSource)
+	handler.SetJSONOutput(jsonOutput)
+	handler.SetVersion(version)
 
 	// Run auth -- exit code is applied in main() after cobra finishes
 	overrideExitCode = handler.Run(context.Background(), credentialsFile)
 	return nil
 }
 
+// authCredentialsFile returns the via-file argument of the auth command, or
+// "" to read the credentials from the environment (via-env). via-env is
+// used with --via-env, or when no file is given but username is set.
+func authCredentialsFile(args []string, viaEnv bool) (string, error) {
+	switch {
+	case len(args) == 1 && viaEnv:
+		return "", fmt.Errorf("--via-env does not take a credentials file")
+	case len(args) == 1:
+		return args[0], nil
+	case viaEnv || os.Getenv("username") != "":
+		return "", nil
+	default:
+		return "", fmt.Errorf("credentials file argument is required unless --via-env is set")
+	}
+}
+
+// defaultSocketPath is used when the config file cannot be loaded.
+const defaultSocketPath = "/run/openvpn-keycloak-auth/auth.sock"
+
+// ipcClient returns a client for the daemon's socket from the config file,
+// falling back to defaultSocketPath.
+func ipcClient() *ipc.Client {
+	socketPath := defaultSocketPath
+	if cfg, err := loadConfig(); err == nil {
+		socketPath = cfg.Listen.Socket
+	}
+	client := ipc.NewClient(socketPath)
+	client.SetVersion(version)
+	return client
+}
+
+// runSessions lists the daemon's active sessions
+func runSessions(cmd *cobra.Command, args []string) error {
+	sessions, err := ipcClient().ListSessions(context.Background())
+	if err != nil {
+		return fmt.Errorf("failed to list sessions: %w", err)
+	}
+	printSessions(cmd.OutOrStdout(), sessions, time.Now())
+	return nil
+}
+
+// printSessions writes sessions as a table, ages relative to now.
+func printSessions(w io.Writer, sessions []ipc.SessionInfo, now time.Time) {
+	if len(sessions) == 0 {
+		_, _ = fmt.Fprintln(w, "No active sessions")
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "SESSION ID\tUSERNAME\tIP\tAGE\tSTATE")
+	for _, s := range sessions {
+		age := now.Sub(s.CreatedAt).Truncate(time.Second)
+		if age < 0 {
+			age = 0
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", s.SessionID, s.Username, s.UntrustedIP, age, s.State)
+	}
+	_ = tw.Flush()
+}
+
+// runSessionsKill fails and deletes a session
+func runSessionsKill(cmd *cobra.Command, args []string) error {
+	if err := ipcClient().KillSession(context.Background(), args[0]); err != nil {
+		return fmt.Errorf("failed to kill session: %w", err)
+	}
+	_, _ = fmt.Fprintf(cmd.OutOrStdout(), "Session %s killed\n", args[0])
+	return nil
+}
+
 // runVersion displays version information
 func runVersion(cmd *cobra.Command, args []string) {
 	fmt.Printf("openvpn-keycloak-auth version %s\n", version)
@@ -217,16 +492,55 @@ func runVersion(cmd *cobra.Command, args []string) {
 
 // runCheckConfig validates the configuration
 func runCheckConfig(cmd *cobra.Command, args []string) error {
-	fmt.Printf("Checking configuration: %s\n\n", configFile)
+	fmt.Printf("Checking configuration: %s\n", configFile)
+	if p := activeProfile(); p != "" {
+		fmt.Printf("Using profile: %s\n", p)
+	}
+	fmt.Println()
 
 	// Load configuration
-	cfg, err := config.Load(configFile)
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Configuration validation failed:\n")
+		fmt.Fprintf(os.Stderr, "   %v\n", err)
+		overrideExitCode = ExitConfig
+		return nil // exit code handled via overrideExitCode
+	}
+
+	// Check that the daemon will be able to create the IPC socket
+	warnings, err := config.ValidateSocketPath(cfg.Listen.Socket)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "❌ Configuration validation failed:\n")
 		fmt.Fprintf(os.Stderr, "   %v\n", err)
 		overrideExitCode = ExitConfig
 		return nil // exit code handled via overrideExitCode
 	}
+	warnings = append(warnings, cfg.OIDC.IssuerWarnings()...)
+
+	// Check that every configured claim path is well-formed dot notation
+	claimPaths := oidc.ConfiguredClaimPaths(cfg)
+	for _, cp := range claimPaths {
+		if err := oidc.ValidateClaimPath(cp.Path); err != nil {
+			fmt.Fprintf(os.Stderr, "❌ Configuration validation failed:\n")
+			fmt.Fprintf(os.Stderr, "   %s: %v\n", cp.Key, err)
+			overrideExitCode = ExitConfig
+			return nil // exit code handled via overrideExitCode
+		}
+	}
+
+	var sampleClaims map[string]interface{}
+	if sampleToken != "" {
+		data, err := os.ReadFile(sampleToken) // #nosec G304 -- path supplied by the operator
+		if err == nil {
+			sampleClaims, err = oidc.ParseSampleClaims(data)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "❌ Failed to load sample token %s:\n", sampleToken)
+			fmt.Fprintf(os.Stderr, "   %v\n", err)
+			overrideExitCode = ExitConfig
+			return nil // exit code handled via overrideExitCode
+		}
+	}
 
 	// Print configuration summary (with secrets redacted)
 	fmt.Println("✅ Configuration is valid")
@@ -237,17 +551,59 @@ func runCheckConfig(cmd *cobra.Command, args []string) error {
 	fmt.Printf("  Redirect URI:    %s\n", cfg.OIDC.RedirectURI)
 	fmt.Printf("  Scopes:          %v\n", cfg.OIDC.Scopes)
 	fmt.Printf("  Required Roles:  %v\n", cfg.OIDC.RequiredRoles)
-	fmt.Printf("  HTTP Listen:     %s\n", cfg.Listen.HTTP)
+	if cfg.Listen.HTTPSocket != "" {
+		fmt.Printf("  HTTP Socket:     %s\n", cfg.Listen.HTTPSocket)
+	} else {
+		fmt.Printf("  HTTP Listen:     %s\n", cfg.Listen.HTTP)
+	}
 	fmt.Printf("  Unix Socket:     %s\n", cfg.Listen.Socket)
 	fmt.Printf("  Session Timeout: %d seconds\n", cfg.Auth.SessionTimeout)
 	fmt.Printf("  Log Level:       %s\n", cfg.Log.Level)
 	fmt.Printf("  Log Format:      %s\n", cfg.Log.Format)
 	fmt.Printf("  TLS Enabled:     %v\n", cfg.TLS.Enabled)
 
+	for _, p := range cfg.OIDC.Providers {
+		providerCfg := cfg.OIDC.ForProvider(p)
+		fmt.Printf("\n  Provider %q:\n", p.Name)
+		if p.CommonNameSuffix != "" {
+			fmt.Printf("    CN Suffix:       %s\n", p.CommonNameSuffix)
+		}
+		if p.UsernamePrefix != "" {
+			fmt.Printf("    Username Prefix: %s\n", p.UsernamePrefix)
+		}
+		fmt.Printf("    OIDC Issuer:     %s\n", providerCfg.Issuer)
+		fmt.Printf("    Client ID:       %s\n", providerCfg.ClientID)
+		fmt.Printf("    Client Mode:     %s\n", providerCfg.ClientMode())
+		fmt.Printf("    Required Roles:  %v\n", providerCfg.RequiredRoles)
+	}
+
 	if cfg.OIDC.ClientSecret != "" {
 		fmt.Println("\n  Client Secret:   [SET]")
 	} else {
-		fmt.Println("\n  Client Secret:   [NOT SET] (using public client with PKCE)")
+		fmt.Println("\n  Client Secret:   [NOT SET]")
+	}
+	fmt.Printf("  Client Mode:     %s\n", cfg.OIDC.ClientMode())
+	if cfg.OIDC.ClientAuthMethod != "" {
+		fmt.Printf("  Client Auth:     %s\n", cfg.OIDC.ClientAuthMethod)
+	}
+
+	if sampleClaims != nil {
+		fmt.Printf("\nClaim paths resolved against %s:\n", sampleToken)
+		for _, cp := range claimPaths {
+			value, err := oidc.ResolveClaim(sampleClaims, cp.Path)
+			if err != nil {
+				fmt.Printf("  %s (%s): [NOT FOUND] %v\n", cp.Key, cp.Path, err)
+				continue
+			}
+			fmt.Printf("  %s (%s): %v\n", cp.Key, cp.Path, value)
+		}
+	}
+
+	if len(warnings) > 0 {
+		fmt.Println("\n⚠️  Warnings:")
+		for _, w := range warnings {
+			fmt.Printf("   - %s\n", w)
+		}
 	}
 
 	fmt.Println("\n✅ Ready to start daemon")
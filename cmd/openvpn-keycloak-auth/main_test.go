@@ -2,13 +2,30 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
 	"github.com/al-bashkir/openvpn-keycloak-auth/internal/ipc"
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/oidc"
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/oidc/oidctest"
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/session"
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"github.com/spf13/cobra"
 )
 
 func writeTestConfig(t *testing.T, path string, socketPath string) {
@@ -99,6 +116,32 @@ log:
 	}
 }
 
+func TestRunCheckConfig_SocketParentNotDirectory(t *testing.T) {
+	tmpDir := t.TempDir()
+	notDir := filepath.Join(tmpDir, "file")
+	if err := os.WriteFile(notDir, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfgPath := filepath.Join(tmpDir, "config.yaml")
+	writeTestConfig(t, cfgPath, filepath.Join(notDir, "auth.sock"))
+
+	oldCfg := configFile
+	oldExit := overrideExitCode
+	t.Cleanup(func() {
+		configFile = oldCfg
+		overrideExitCode = oldExit
+	})
+	configFile = cfgPath
+	overrideExitCode = -1
+
+	if err := runCheckConfig(nil, nil); err != nil {
+		t.Fatalf("runCheckConfig returned error: %v", err)
+	}
+	if overrideExitCode != ExitConfig {
+		t.Fatalf("overrideExitCode = %d, want %d", overrideExitCode, ExitConfig)
+	}
+}
+
 func TestRunServe_ConfigLoadFailure(t *testing.T) {
 	old := configFile
 	t.Cleanup(func() { configFile = old })
@@ -180,3 +223,534 @@ func TestRunAuth_Deferred(t *testing.T) {
 		t.Fatalf("overrideExitCode = %d, want %d", overrideExitCode, ExitDeferred)
 	}
 }
+
+func TestAuthCredentialsFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		viaEnv   bool
+		username string
+		want     string
+		wantErr  bool
+	}{
+		{name: "via-file", args: []string{"/tmp/creds"}, want: "/tmp/creds"},
+		{name: "via-file with username env", args: []string{"/tmp/creds"}, username: "testuser", want: "/tmp/creds"},
+		{name: "via-env flag", viaEnv: true, want: ""},
+		{name: "via-env detected", username: "testuser", want: ""},
+		{name: "no file and no username", wantErr: true},
+		{name: "via-env flag with file", args: []string{"/tmp/creds"}, viaEnv: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("username", tt.username)
+
+			got, err := authCredentialsFile(tt.args, tt.viaEnv)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error, got file %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("credentials file = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunCheckConfig_SampleToken(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfgPath := filepath.Join(tmpDir, "config.yaml")
+	writeTestConfig(t, cfgPath, filepath.Join(tmpDir, "auth.sock"))
+
+	claimsPath := filepath.Join(tmpDir, "claims.json")
+	if err := os.WriteFile(claimsPath, []byte(`{"preferred_username":"john"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		wantExit int
+	}{
+		{name: "resolves sample claims", token: claimsPath, wantExit: -1},
+		{name: "missing sample token file", token: filepath.Join(tmpDir, "missing"), wantExit: ExitConfig},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldCfg := configFile
+			oldToken := sampleToken
+			oldExit := overrideExitCode
+			t.Cleanup(func() {
+				configFile = oldCfg
+				sampleToken = oldToken
+				overrideExitCode = oldExit
+			})
+			configFile = cfgPath
+			sampleToken = tt.token
+			overrideExitCode = -1
+
+			if err := runCheckConfig(nil, nil); err != nil {
+				t.Fatalf("runCheckConfig returned error: %v", err)
+			}
+			if overrideExitCode != tt.wantExit {
+				t.Fatalf("overrideExitCode = %d, want %d", overrideExitCode, tt.wantExit)
+			}
+		})
+	}
+}
+
+func TestRunCheckConfig_MalformedClaimPath(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfgPath := filepath.Join(tmpDir, "config.yaml")
+	writeTestConfig(t, cfgPath, filepath.Join(tmpDir, "auth.sock"))
+
+	data, err := os.ReadFile(cfgPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = []byte(strings.Replace(string(data), "oidc:\n", "oidc:\n  role_claim: \"realm_access..roles\"\n", 1))
+	if err := os.WriteFile(cfgPath, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	oldCfg := configFile
+	oldExit := overrideExitCode
+	t.Cleanup(func() {
+		configFile = oldCfg
+		overrideExitCode = oldExit
+	})
+	configFile = cfgPath
+	overrideExitCode = -1
+
+	if err := runCheckConfig(nil, nil); err != nil {
+		t.Fatalf("runCheckConfig returned error: %v", err)
+	}
+	if overrideExitCode != ExitConfig {
+		t.Fatalf("overrideExitCode = %d, want %d", overrideExitCode, ExitConfig)
+	}
+}
+
+func TestPrintSessions(t *testing.T) {
+	now := time.Date(2026, 2, 17, 12, 0, 0, 0, time.UTC)
+
+	var buf strings.Builder
+	printSessions(&buf, nil, now)
+	if got := buf.String(); got != "No active sessions\n" {
+		t.Errorf("printSessions(nil) = %q, want %q", got, "No active sessions\n")
+	}
+
+	buf.Reset()
+	printSessions(&buf, []ipc.SessionInfo{
+		{SessionID: "abc123", Username: "john", UntrustedIP: "192.0.2.1", CreatedAt: now.Add(-90 * time.Second), State: "pending"},
+	}, now)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("printSessions() = %q, want header and one row", buf.String())
+	}
+	if fields := strings.Fields(lines[0]); len(fields) != 6 || fields[0] != "SESSION" {
+		t.Errorf("header = %q", lines[0])
+	}
+	if want := []string{"abc123", "john", "192.0.2.1", "1m30s", "pending"}; strings.Join(strings.Fields(lines[1]), " ") != strings.Join(want, " ") {
+		t.Errorf("row = %q, want fields %v", lines[1], want)
+	}
+}
+
+func TestTestAuthChecks(t *testing.T) {
+	tests := []struct {
+		name       string
+		modify     func(cfg *config.Config)
+		claims     map[string]interface{}
+		instance   string
+		commonName string
+		wantFailed []string
+		wantPassed bool
+	}{
+		{
+			name: "all checks pass",
+			claims: map[string]interface{}{
+				"preferred_username": "alice",
+				"realm_access":       map[string]interface{}{"roles": []interface{}{"vpn-user"}},
+			},
+			wantPassed: true,
+		},
+		{
+			name: "every failing check is reported",
+			claims: map[string]interface{}{
+				"preferred_username": "mallory",
+				"realm_access":       map[string]interface{}{"roles": []interface{}{"guest"}},
+			},
+			wantFailed: []string{"roles and groups", "username"},
+		},
+		{
+			name: "username mismatch allowed",
+			modify: func(cfg *config.Config) {
+				cfg.Auth.AllowUsernameMismatch = true
+			},
+			claims: map[string]interface{}{
+				"preferred_username": "bob",
+				"realm_access":       map[string]interface{}{"roles": []interface{}{"vpn-user"}},
+			},
+			wantPassed: true,
+		},
+		{
+			name: "instance roles",
+			modify: func(cfg *config.Config) {
+				cfg.OIDC.InstanceRequiredRoles = map[string][]string{"admin": {"vpn-admin"}}
+			},
+			claims: map[string]interface{}{
+				"preferred_username": "alice",
+				"realm_access":       map[string]interface{}{"roles": []interface{}{"vpn-user"}},
+			},
+			instance:   "admin",
+			wantFailed: []string{"instance roles (admin)"},
+		},
+		{
+			name: "common name not checked by default",
+			claims: map[string]interface{}{
+				"preferred_username": "alice",
+				"realm_access":       map[string]interface{}{"roles": []interface{}{"vpn-user"}},
+			},
+			commonName: "laptop-42",
+			wantPassed: true,
+		},
+		{
+			name: "common name matches cn_claim",
+			modify: func(cfg *config.Config) {
+				cfg.Auth.UsernameClaim = "email"
+				cfg.Auth.RequireCNMatch = true
+				cfg.Auth.CNClaim = "preferred_username"
+			},
+			claims: map[string]interface{}{
+				"email":              "alice",
+				"preferred_username": "a.smith",
+				"realm_access":       map[string]interface{}{"roles": []interface{}{"vpn-user"}},
+			},
+			commonName: "a.smith",
+			wantPassed: true,
+		},
+		{
+			name: "common name mismatch",
+			modify: func(cfg *config.Config) {
+				cfg.Auth.RequireCNMatch = true
+			},
+			claims: map[string]interface{}{
+				"preferred_username": "alice",
+				"realm_access":       map[string]interface{}{"roles": []interface{}{"vpn-user"}},
+			},
+			commonName: "bob",
+			wantFailed: []string{"common name (auth.require_cn_match)"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.DefaultConfig()
+			cfg.OIDC.RequiredRoles = []string{"vpn-user"}
+			if tt.modify != nil {
+				tt.modify(cfg)
+			}
+
+			result := &testAuthResult{checks: testAuthChecks(cfg, &cfg.OIDC,
+				&session.Session{Username: "alice", CommonName: tt.commonName, Instance: tt.instance},
+				&oidc.TokenData{Claims: tt.claims})}
+
+			var failed []string
+			for _, c := range result.checks {
+				if c.Err != nil {
+					failed = append(failed, c.Name)
+				}
+			}
+			if !slices.Equal(failed, tt.wantFailed) {
+				t.Errorf("failed checks = %v, want %v", failed, tt.wantFailed)
+			}
+
+			var out strings.Builder
+			if got := result.print(&out); got != tt.wantPassed {
+				t.Errorf("print() = %v, want %v; output:\n%s", got, tt.wantPassed, out.String())
+			}
+		})
+	}
+}
+
+// testAuthTokens serves a JWKS and a token endpoint that returns an ID
+// token for username with the nonce stored in nonce.
+func testAuthTokens(t *testing.T, username string, nonce *atomic.Value) oidctest.Hook {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: key},
+		(&jose.SignerOptions{}).WithHeader(jose.HeaderKey("kid"), "test-key"))
+	if err != nil {
+		t.Fatalf("failed to create signer: %v", err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request, issuer string) bool {
+		switch r.URL.Path {
+		case oidctest.KeysPath:
+			_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+				{Key: &key.PublicKey, KeyID: "test-key", Algorithm: "RS256", Use: "sig"},
+			}})
+		case oidctest.TokenPath:
+			now := time.Now()
+			idToken, err := jwt.Signed(signer).Claims(map[string]interface{}{
+				"iss":                issuer,
+				"aud":                "test-client",
+				"sub":                "user-1",
+				"exp":                now.Add(5 * time.Minute).Unix(),
+				"iat":                now.Unix(),
+				"nonce":              nonce.Load(),
+				"preferred_username": username,
+				"realm_access":       map[string]interface{}{"roles": []string{"vpn-user"}},
+			}).Serialize()
+			if err != nil {
+				t.Errorf("failed to sign ID token: %v", err)
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token": "opaque-access-token",
+				"token_type":   "Bearer",
+				"expires_in":   300,
+				"id_token":     idToken,
+			})
+		default:
+			return false
+		}
+		return true
+	}
+}
+
+func TestTestAuthFlow(t *testing.T) {
+	tests := []struct {
+		name          string
+		tokenUsername string
+		query         func(state string) url.Values
+		wantPassed    bool
+		wantOutput    string
+	}{
+		{
+			name:          "accepted",
+			tokenUsername: "alice",
+			query:         func(state string) url.Values { return url.Values{"state": {state}, "code": {"code"}} },
+			wantPassed:    true,
+			wantOutput:    "✅ The daemon would accept this login",
+		},
+		{
+			name:          "username mismatch",
+			tokenUsername: "bob",
+			query:         func(state string) url.Values { return url.Values{"state": {state}, "code": {"code"}} },
+			wantOutput:    "❌ username: username mismatch",
+		},
+		{
+			name: "error from issuer",
+			query: func(state string) url.Values {
+				return url.Values{"state": {state}, "error": {"access_denied"}, "error_description": {"User denied"}}
+			},
+			wantOutput: "login failed at the issuer: access_denied: User denied",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var nonce atomic.Value
+			nonce.Store("")
+
+			cfg := config.DefaultConfig()
+			cfg.OIDC.Issuer = oidctest.NewIssuer(t, testAuthTokens(t, tt.tokenUsername, &nonce))
+			cfg.OIDC.ClientID = "test-client"
+			cfg.OIDC.RedirectURI = "http://localhost:9000/callback"
+			cfg.OIDC.RequiredRoles = []string{"vpn-user"}
+
+			flow, err := startTestAuth(context.Background(), cfg, "alice", "", "")
+			if err != nil {
+				t.Fatalf("startTestAuth failed: %v", err)
+			}
+			defer flow.sessions.Stop()
+
+			authURL, err := url.Parse(flow.authURL)
+			if err != nil {
+				t.Fatalf("invalid auth URL: %v", err)
+			}
+			state := authURL.Query().Get("state")
+			nonce.Store(authURL.Query().Get("nonce"))
+
+			results := make(chan *testAuthResult, 1)
+			handler := flow.callbackHandler(results)
+
+			// A callback for another login does not end the test
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/callback?state=other&code=code", nil))
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("unknown state: status = %d, want %d", rec.Code, http.StatusBadRequest)
+			}
+
+			rec = httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/callback?"+tt.query(state).Encode(), nil))
+			if rec.Code != http.StatusOK {
+				t.Errorf("callback: status = %d, want %d", rec.Code, http.StatusOK)
+			}
+
+			var out strings.Builder
+			if got := (<-results).print(&out); got != tt.wantPassed {
+				t.Errorf("passed = %v, want %v", got, tt.wantPassed)
+			}
+			if !strings.Contains(out.String(), tt.wantOutput) {
+				t.Errorf("output = %q, want it to contain %q", out.String(), tt.wantOutput)
+			}
+
+			// Only the first callback is evaluated
+			rec = httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/callback?"+tt.query(state).Encode(), nil))
+			if rec.Code != http.StatusConflict {
+				t.Errorf("repeated callback: status = %d, want %d", rec.Code, http.StatusConflict)
+			}
+		})
+	}
+}
+
+func TestValidateToken(t *testing.T) {
+	tests := []struct {
+		name       string
+		modify     func(cfg *config.Config)
+		claims     map[string]interface{}
+		username   string
+		commonName string
+		instance   string
+		wantPassed bool
+		wantOutput []string
+	}{
+		{
+			name: "passes",
+			claims: map[string]interface{}{
+				"preferred_username": "alice",
+				"realm_access":       map[string]interface{}{"roles": []interface{}{"vpn-user"}},
+			},
+			username:   "alice",
+			wantPassed: true,
+			wantOutput: []string{"realm_access.roles: [vpn-user] (used)", "✅ roles and groups", "✅ username"},
+		},
+		{
+			name: "role claim misconfigured",
+			claims: map[string]interface{}{
+				"preferred_username": "alice",
+				"resource_access": map[string]interface{}{
+					"openvpn": map[string]interface{}{"roles": []interface{}{"vpn-user"}},
+				},
+			},
+			username:   "alice",
+			wantOutput: []string{"realm_access.roles: claim not found: 'realm_access'", "❌ roles and groups: failed to extract roles"},
+		},
+		{
+			name: "fallback used",
+			modify: func(cfg *config.Config) {
+				cfg.OIDC.RoleClaimFallbacks = []string{"resource_access.openvpn.roles"}
+			},
+			claims: map[string]interface{}{
+				"preferred_username": "alice",
+				"resource_access": map[string]interface{}{
+					"openvpn": map[string]interface{}{"roles": []interface{}{"vpn-user"}},
+				},
+			},
+			wantPassed: true,
+			wantOutput: []string{"resource_access.openvpn.roles: [vpn-user] (used)", "➖ username: skipped (no --username given)"},
+		},
+		{
+			name: "provider selected by common name",
+			modify: func(cfg *config.Config) {
+				cfg.OIDC.Providers = []config.OIDCProviderConfig{{
+					Name:             "contractors",
+					CommonNameSuffix: ".contractors.example.com",
+					Issuer:           "https://keycloak.example.com/realms/contractors",
+					RequiredRoles:    []string{"contractor"},
+				}}
+			},
+			claims: map[string]interface{}{
+				"preferred_username": "alice",
+				"realm_access":       map[string]interface{}{"roles": []interface{}{"vpn-user"}},
+			},
+			username:   "alice",
+			commonName: "alice.contractors.example.com",
+			wantOutput: []string{"Provider: contractors", "❌ roles and groups: user does not have required roles: [contractor]"},
+		},
+		{
+			name: "callback checks beyond roles",
+			modify: func(cfg *config.Config) {
+				cfg.OIDC.MaxAge = 300
+				cfg.OIDC.RequiredACR = []string{"gold"}
+				cfg.OIDC.InstanceRequiredRoles = map[string][]string{"admin": {"vpn-admin"}}
+				cfg.Auth.RequireCNMatch = true
+			},
+			claims: map[string]interface{}{
+				"preferred_username": "alice",
+				"realm_access":       map[string]interface{}{"roles": []interface{}{"vpn-user"}},
+				"acr":                "1",
+			},
+			username: "alice",
+			instance: "admin",
+			wantOutput: []string{
+				"❌ auth time (oidc.max_age): auth_time claim not found",
+				"❌ authentication context (oidc.required_acr)",
+				"❌ instance roles (admin)",
+				"➖ common name (auth.require_cn_match): skipped (no --common-name given)",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.DefaultConfig()
+			cfg.OIDC.Issuer = "https://keycloak.example.com/realms/test"
+			cfg.OIDC.RequiredRoles = []string{"vpn-user"}
+			if tt.modify != nil {
+				tt.modify(cfg)
+			}
+
+			var out strings.Builder
+			if got := validateToken(&out, cfg, tt.claims, tt.username, tt.commonName, tt.instance); got != tt.wantPassed {
+				t.Errorf("validateToken() = %v, want %v", got, tt.wantPassed)
+			}
+			for _, want := range tt.wantOutput {
+				if !strings.Contains(out.String(), want) {
+					t.Errorf("output does not contain %q:\n%s", want, out.String())
+				}
+			}
+		})
+	}
+}
+
+func TestRunValidateToken_Stdin(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfgPath := filepath.Join(tmpDir, "config.yaml")
+	writeTestConfig(t, cfgPath, filepath.Join(tmpDir, "auth.sock"))
+
+	oldCfg, oldExit, oldUsername := configFile, overrideExitCode, validateTokenUsername
+	t.Cleanup(func() {
+		configFile, overrideExitCode, validateTokenUsername = oldCfg, oldExit, oldUsername
+	})
+	configFile = cfgPath
+	overrideExitCode = -1
+	validateTokenUsername = "alice"
+
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"preferred_username":"bob"}`))
+	cmd := &cobra.Command{}
+	cmd.SetIn(strings.NewReader("eyJhbGciOiJSUzI1NiJ9." + payload + ".c2ln\n"))
+	var out strings.Builder
+	cmd.SetOut(&out)
+
+	if err := runValidateToken(cmd, nil); err != nil {
+		t.Fatalf("runValidateToken failed: %v", err)
+	}
+	if overrideExitCode != ExitError {
+		t.Errorf("overrideExitCode = %d, want %d", overrideExitCode, ExitError)
+	}
+	if !strings.Contains(out.String(), "❌ username: username mismatch: expected 'alice', got 'bob'") {
+		t.Errorf("output does not report the username mismatch:\n%s", out.String())
+	}
+}
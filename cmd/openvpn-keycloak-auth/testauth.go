@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/oidc"
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/session"
+	"github.com/spf13/cobra"
+)
+
+// runTestAuth runs a simulated login for the username in args[0]
+func runTestAuth(cmd *cobra.Command, args []string) error {
+	username := args[0]
+	out := cmd.OutOrStdout()
+
+	cfg, err := loadServeConfig()
+	if err == nil && testAuthRedirectURI != "" {
+		cfg.OIDC.RedirectURI = testAuthRedirectURI
+		err = cfg.Validate()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Configuration validation failed:\n")
+		fmt.Fprintf(os.Stderr, "   %v\n", err)
+		overrideExitCode = ExitConfig
+		return nil // exit code handled via overrideExitCode
+	}
+	config.SetupLogging(&cfg.Log)
+
+	listenAddr := testAuthListen
+	if listenAddr == "" {
+		listenAddr = cfg.Listen.HTTP
+	}
+	if listenAddr == "" {
+		return fmt.Errorf("--listen is required when listen.http is not set")
+	}
+	redirect, err := url.Parse(cfg.OIDC.RedirectURI)
+	if err != nil {
+		return fmt.Errorf("invalid redirect URI: %w", err)
+	}
+	callbackPath := redirect.Path
+	if callbackPath == "" {
+		callbackPath = "/"
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	flow, err := startTestAuth(ctx, cfg, username, testAuthCommonName, testAuthInstance)
+	if err != nil {
+		return err
+	}
+	defer flow.sessions.Stop()
+
+	ln, err := net.Listen("tcp", listenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for the callback: %w", err)
+	}
+
+	results := make(chan *testAuthResult, 1)
+	mux := http.NewServeMux()
+	mux.Handle(callbackPath, flow.callbackHandler(results))
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		var err error
+		if cfg.TLS.Enabled && cfg.TLS.CertFile != "" {
+			err = srv.ServeTLS(ln, cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			select {
+			case results <- &testAuthResult{err: fmt.Errorf("callback listener failed: %w", err)}:
+			default:
+			}
+		}
+	}()
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	timeout := time.Duration(cfg.Auth.SessionTimeout) * time.Second
+	_, _ = fmt.Fprintf(out, "Testing login for %q with provider %q (%s)\n\n", username, flow.providerName, flow.provider.Config().Issuer)
+	_, _ = fmt.Fprintf(out, "Open this URL in a browser and sign in:\n\n  %s\n\n", flow.authURL)
+	_, _ = fmt.Fprintf(out, "Waiting up to %s for the callback to %s (listening on %s)...\n\n", timeout, cfg.OIDC.RedirectURI, ln.Addr())
+
+	var result *testAuthResult
+	select {
+	case result = <-results:
+	case <-time.After(timeout):
+		result = &testAuthResult{err: fmt.Errorf("no callback received within auth.session_timeout (%s)", timeout)}
+	case <-ctx.Done():
+		result = &testAuthResult{err: fmt.Errorf("interrupted")}
+	}
+
+	if !result.print(out) {
+		overrideExitCode = ExitError
+	}
+	return nil
+}
+
+// testAuthFlow is a login started by test-auth: a session in its own
+// session.Manager with the OIDC flow data, never tied to OpenVPN.
+type testAuthFlow struct {
+	cfg          *config.Config
+	provider     *oidc.Provider
+	providerName string
+	sessions     *session.Manager
+	authURL      string
+
+	// once ensures only the first callback is evaluated
+	once sync.Once
+}
+
+// startTestAuth selects the provider for username and commonName the way
+// the daemon does and starts an OIDC flow for it.
+func startTestAuth(ctx context.Context, cfg *config.Config, username, commonName, instance string) (*testAuthFlow, error) {
+	providers, err := oidc.NewRegistry(ctx, &cfg.OIDC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize OIDC provider: %w", err)
+	}
+	providerName, provider := providers.Select(username, commonName)
+
+	sessions := session.NewManager(time.Duration(cfg.Auth.SessionTimeout)*time.Second, 0)
+	flow, err := func() (*testAuthFlow, error) {
+		// No auth_control files: the result is only reported
+		sess, err := sessions.Create(username, commonName, "", "", "", "", "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create session: %w", err)
+		}
+		if err := sessions.SetProvider(sess.ID, providerName); err != nil {
+			return nil, fmt.Errorf("failed to update session: %w", err)
+		}
+		if instance != "" {
+			if err := sessions.SetInstance(sess.ID, instance); err != nil {
+				return nil, fmt.Errorf("failed to update session: %w", err)
+			}
+		}
+
+		flowData, err := provider.StartAuthFlow(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to start OIDC flow: %w", err)
+		}
+		if err := sessions.UpdateOIDCFlow(sess.ID, flowData.State, flowData.CodeVerifier, flowData.Nonce, flowData.AuthURL); err != nil {
+			return nil, fmt.Errorf("failed to update session: %w", err)
+		}
+
+		return &testAuthFlow{
+			cfg:          cfg,
+			provider:     provider,
+			providerName: providerName,
+			sessions:     sessions,
+			authURL:      flowData.AuthURL,
+		}, nil
+	}()
+	if err != nil {
+		sessions.Stop()
+		return nil, err
+	}
+	return flow, nil
+}
+
+// callbackHandler handles the OIDC callback: the first callback with the
+// flow's state is evaluated and its result sent to results. Callbacks for
+// other states are rejected without ending the test.
+func (f *testAuthFlow) callbackHandler(results chan<- *testAuthResult) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		sess, err := f.sessions.GetByState(query.Get("state"))
+		if err != nil {
+			http.Error(w, "Unknown or expired state", http.StatusBadRequest)
+			return
+		}
+
+		handled := false
+		f.once.Do(func() {
+			handled = true
+			var result *testAuthResult
+			if errParam := query.Get("error"); errParam != "" {
+				msg := errParam
+				if desc := query.Get("error_description"); desc != "" {
+					msg += ": " + desc
+				}
+				result = &testAuthResult{err: fmt.Errorf("login failed at the issuer: %s", msg)}
+			} else {
+				result = f.verify(r.Context(), sess, query.Get("code"))
+			}
+			results <- result
+
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			if result.passed() {
+				_, _ = io.WriteString(w, "Login test passed. You may close this window.\n")
+			} else {
+				_, _ = io.WriteString(w, "Login test failed; see the test-auth output. You may close this window.\n")
+			}
+		})
+		if !handled {
+			http.Error(w, "Callback already received", http.StatusConflict)
+		}
+	})
+}
+
+// verify exchanges code and runs the daemon's callback checks on the
+// resulting claims.
+func (f *testAuthFlow) verify(ctx context.Context, sess *session.Session, code string) *testAuthResult {
+	if code == "" {
+		return &testAuthResult{err: fmt.Errorf("callback has no authorization code")}
+	}
+
+	tokenData, err := f.provider.ExchangeCode(ctx, code, sess.CodeVerifier, sess.Nonce)
+	if err != nil {
+		return &testAuthResult{err: fmt.Errorf("token exchange failed: %w", err)}
+	}
+
+	var username string
+	if v, err := oidc.ResolveClaim(tokenData.Claims, f.cfg.Auth.UsernameClaim); err == nil {
+		username = fmt.Sprint(v)
+	}
+	return &testAuthResult{
+		username: username,
+		checks:   testAuthChecks(f.cfg, f.provider.Config(), sess, tokenData),
+	}
+}
+
+// testAuthChecks runs the checks of the daemon's callback (see
+// oidc.Validator.Checks) on the claims of tokenData.
+func testAuthChecks(cfg *config.Config, oidcCfg *config.OIDCConfig, sess *session.Session, tokenData *oidc.TokenData) []oidc.Check {
+	return oidc.NewValidator(oidcCfg, &cfg.Auth).Checks(tokenData.Claims, oidc.CheckInput{
+		Username:          sess.Username,
+		CommonName:        sess.CommonName,
+		Instance:          sess.Instance,
+		AccessTokenOpaque: tokenData.AccessTokenOpaque,
+	})
+}
+
+// testAuthResult is the outcome of a test login. err is set if the login
+// did not get as far as the checks.
+type testAuthResult struct {
+	username string
+	checks   []oidc.Check
+	err      error
+}
+
+// passed reports whether the login succeeded and passed every check.
+func (r *testAuthResult) passed() bool {
+	return r.err == nil && checksPassed(r.checks)
+}
+
+// print writes the result to w and reports whether it passed.
+func (r *testAuthResult) print(w io.Writer) bool {
+	if r.err != nil {
+		_, _ = fmt.Fprintf(w, "❌ Login failed: %v\n", r.err)
+		return false
+	}
+
+	_, _ = fmt.Fprintf(w, "Token username: %s\n", r.username)
+	printChecks(w, r.checks)
+
+	if !r.passed() {
+		_, _ = fmt.Fprintln(w, "\n❌ The daemon would reject this login")
+		return false
+	}
+	_, _ = fmt.Fprintln(w, "\n✅ The daemon would accept this login")
+	return true
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/oidc"
+	"github.com/spf13/cobra"
+)
+
+// runValidateToken decodes a token and runs the claim checks against it
+func runValidateToken(cmd *cobra.Command, args []string) error {
+	out := cmd.OutOrStdout()
+
+	cfg, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "❌ Configuration validation failed:\n")
+		fmt.Fprintf(os.Stderr, "   %v\n", err)
+		overrideExitCode = ExitConfig
+		return nil // exit code handled via overrideExitCode
+	}
+
+	token := validateTokenRaw
+	if token == "" {
+		data, err := io.ReadAll(io.LimitReader(cmd.InOrStdin(), maxTokenSize))
+		if err != nil {
+			return fmt.Errorf("failed to read token from stdin: %w", err)
+		}
+		token = string(data)
+	}
+	claims, err := oidc.DecodeJWTClaims(token)
+	if err != nil {
+		return fmt.Errorf("failed to decode token: %w", err)
+	}
+
+	if !validateToken(out, cfg, claims, validateTokenUsername, validateTokenCommonName, validateTokenInstance) {
+		overrideExitCode = ExitError
+	}
+	return nil
+}
+
+// maxTokenSize bounds the token read from stdin.
+const maxTokenSize = 1 << 20 // 1 MiB
+
+// validateToken prints claims and how the configuration resolves them, runs
+// the checks of the daemon's callback (see oidc.Validator.Checks), and
+// reports whether all passed. The username and common name checks are
+// skipped without username and commonName; the provider is selected with
+// them like the daemon does, and instance selects oidc.instance_required_roles.
+func validateToken(w io.Writer, cfg *config.Config, claims map[string]interface{}, username, commonName, instance string) bool {
+	providerName, oidcCfg := selectProviderConfig(cfg, username, commonName)
+	validator := oidc.NewValidator(&oidcCfg, &cfg.Auth)
+
+	tree, err := json.MarshalIndent(claims, "", "  ")
+	if err != nil {
+		tree = []byte(fmt.Sprint(claims))
+	}
+	_, _ = fmt.Fprintf(w, "Claims (signature and expiry NOT verified):\n%s\n\n", tree)
+	_, _ = fmt.Fprintf(w, "Provider: %s (%s)\n\n", providerName, oidcCfg.Issuer)
+
+	if len(oidcCfg.RoleClaims) > 0 {
+		_, _ = fmt.Fprintln(w, "Role claim paths (oidc.role_claims):")
+	} else {
+		_, _ = fmt.Fprintln(w, "Role claim paths (oidc.role_claim, oidc.role_claim_fallbacks):")
+	}
+	for _, rp := range validator.ResolveRolePaths(claims) {
+		switch {
+		case rp.Err != nil:
+			_, _ = fmt.Fprintf(w, "  %s: %v\n", rp.Path, rp.Err)
+		case rp.Used:
+			_, _ = fmt.Fprintf(w, "  %s: %v (used)\n", rp.Path, rp.Roles)
+		default:
+			_, _ = fmt.Fprintf(w, "  %s: %v (not used, an earlier path matched)\n", rp.Path, rp.Roles)
+		}
+	}
+	for _, cp := range []oidc.ClaimPath{
+		{Key: "oidc.group_claim", Path: oidcCfg.GroupClaim},
+		{Key: "auth.username_claim", Path: cfg.Auth.UsernameClaim},
+		{Key: "auth.cn_claim", Path: cfg.Auth.CNClaim},
+	} {
+		if cp.Path == "" {
+			continue
+		}
+		value, err := oidc.ResolveClaim(claims, cp.Path)
+		if err != nil {
+			_, _ = fmt.Fprintf(w, "%s (%s): %v\n", cp.Key, cp.Path, err)
+			continue
+		}
+		_, _ = fmt.Fprintf(w, "%s (%s): %v\n", cp.Key, cp.Path, value)
+	}
+
+	checks := validator.Checks(claims, oidc.CheckInput{Username: username, CommonName: commonName, Instance: instance})
+	for i := range checks {
+		// Without the value to compare, the check says nothing
+		switch {
+		case checks[i].Skipped != "":
+			// Skipped by the configuration already
+		case checks[i].Kind == oidc.CheckUsername && username == "":
+			checks[i] = oidc.Check{Kind: checks[i].Kind, Name: checks[i].Name, Skipped: "no --username given"}
+		case checks[i].Kind == oidc.CheckCommonName && commonName == "":
+			checks[i] = oidc.Check{Kind: checks[i].Kind, Name: checks[i].Name, Skipped: "no --common-name given"}
+		}
+	}
+
+	_, _ = fmt.Fprintln(w, "\nChecks:")
+	printChecks(w, checks)
+	if !checksPassed(checks) {
+		_, _ = fmt.Fprintln(w, "\n❌ The token does not pass the configured checks")
+		return false
+	}
+	_, _ = fmt.Fprintln(w, "\n✅ The token passes the configured checks")
+	return true
+}
+
+// selectProviderConfig returns the name and effective settings of the OIDC
+// provider the daemon would use for username and commonName (see
+// oidc.Registry.Select), without contacting any issuer.
+func selectProviderConfig(cfg *config.Config, username, commonName string) (string, config.OIDCConfig) {
+	for _, p := range cfg.OIDC.Providers {
+		if p.Matches(username, commonName) {
+			return p.Name, cfg.OIDC.ForProvider(p)
+		}
+	}
+	return config.DefaultOIDCProvider, cfg.OIDC.ForProvider(config.OIDCProviderConfig{})
+}
+
+// printChecks writes one line per check to w.
+func printChecks(w io.Writer, checks []oidc.Check) {
+	for _, c := range checks {
+		switch {
+		case c.Skipped != "":
+			_, _ = fmt.Fprintf(w, "  ➖ %s: skipped (%s)\n", c.Name, c.Skipped)
+		case c.Err != nil:
+			_, _ = fmt.Fprintf(w, "  ❌ %s: %v\n", c.Name, c.Err)
+		default:
+			_, _ = fmt.Fprintf(w, "  ✅ %s\n", c.Name)
+		}
+	}
+}
+
+// checksPassed reports whether no check failed. Skipped checks pass.
+func checksPassed(checks []oidc.Check) bool {
+	for _, c := range checks {
+		if c.Err != nil {
+			return false
+		}
+	}
+	return true
+}
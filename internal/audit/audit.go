@@ -0,0 +1,99 @@
+// Package audit writes a structured audit trail of authentication decisions,
+// separate from the daemon's operational logs.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Results recorded in Record.Result.
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+	ResultTimeout = "timeout"
+)
+
+// Record is a single authentication decision.
+type Record struct {
+	Timestamp   time.Time `json:"timestamp"`
+	Username    string    `json:"username"`
+	CommonName  string    `json:"common_name"`
+	UntrustedIP string    `json:"untrusted_ip"`
+	Result      string    `json:"result"`
+	Reason      string    `json:"reason,omitempty"`
+	SessionID   string    `json:"session_id"`
+	Issuer      string    `json:"issuer,omitempty"`
+	// Context holds the auth.context_claims values of the token, keyed by
+	// claim path, for decisions made after the token was verified.
+	Context map[string]string `json:"context,omitempty"`
+}
+
+// Audit records authentication decisions.
+type Audit interface {
+	// Record writes rec. Implementations must be safe for concurrent use
+	// and must not block authentication on write errors.
+	Record(rec Record)
+	// Close releases the underlying resources.
+	Close() error
+}
+
+// FileSink appends records as JSON lines to a file.
+type FileSink struct {
+	mu   sync.Mutex
+	file *os.File
+
+	// now returns the current time; replaceable in tests.
+	now func() time.Time
+}
+
+// NewFileSink opens path for appending, creating it with mode 0600 if it
+// does not exist. An existing file is tightened to 0600, since audit records
+// identify users and their source addresses.
+func NewFileSink(path string) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600) // #nosec G304 -- path from trusted config
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit file: %w", err)
+	}
+	if err := f.Chmod(0600); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("failed to set audit file permissions: %w", err)
+	}
+	return &FileSink{file: f, now: time.Now}, nil
+}
+
+// Record appends rec as one JSON line. A zero Timestamp is set to the
+// current time. Write errors are logged; the decision itself has already
+// been made and is not affected.
+func (s *FileSink) Record(rec Record) {
+	if rec.Timestamp.IsZero() {
+		rec.Timestamp = s.now()
+	}
+	rec.Timestamp = rec.Timestamp.UTC()
+
+	line, err := json.Marshal(rec)
+	if err != nil {
+		slog.Error("failed to encode audit record", "session_id", rec.SessionID, "error", err)
+		return
+	}
+	line = append(line, '\n')
+
+	// A single write per record under the lock keeps lines from
+	// interleaving when callbacks complete concurrently.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.file.Write(line); err != nil {
+		slog.Error("failed to write audit record", "session_id", rec.SessionID, "error", err)
+	}
+}
+
+// Close closes the audit file.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
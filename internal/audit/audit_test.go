@@ -0,0 +1,160 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func readRecords(t *testing.T, path string) []Record {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+
+	var records []Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatalf("invalid audit line %q: %v", scanner.Text(), err)
+		}
+		records = append(records, rec)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestFileSinkRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fixed := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	sink.now = func() time.Time { return fixed }
+
+	sink.Record(Record{
+		Username:    "john",
+		CommonName:  "john-laptop",
+		UntrustedIP: "203.0.113.10",
+		Result:      ResultSuccess,
+		SessionID:   "abc",
+		Issuer:      "https://keycloak.example.com/realms/myrealm",
+		Context:     map[string]string{"department": "IT"},
+	})
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("audit file mode = %o, want 600", perm)
+	}
+
+	records := readRecords(t, path)
+	if len(records) != 1 {
+		t.Fatalf("got %d records, want 1", len(records))
+	}
+	want := Record{
+		Timestamp:   fixed,
+		Username:    "john",
+		CommonName:  "john-laptop",
+		UntrustedIP: "203.0.113.10",
+		Result:      ResultSuccess,
+		SessionID:   "abc",
+		Issuer:      "https://keycloak.example.com/realms/myrealm",
+		Context:     map[string]string{"department": "IT"},
+	}
+	if !reflect.DeepEqual(records[0], want) {
+		t.Errorf("record = %+v, want %+v", records[0], want)
+	}
+}
+
+func TestFileSinkAppends(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := os.WriteFile(path, []byte(`{"result":"failure","session_id":"old"}`+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.Record(Record{Result: ResultTimeout, SessionID: "new"})
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("audit file mode = %o, want 600 after reopening", perm)
+	}
+
+	records := readRecords(t, path)
+	if len(records) != 2 || records[0].SessionID != "old" || records[1].SessionID != "new" {
+		t.Fatalf("records = %+v, want old record followed by new", records)
+	}
+	if records[1].Timestamp.IsZero() {
+		t.Error("expected timestamp to be set")
+	}
+}
+
+func TestFileSinkConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	sink, err := NewFileSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 100
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			sink.Record(Record{Result: ResultFailure, SessionID: fmt.Sprintf("s%d", i), Reason: "denied"})
+		}(i)
+	}
+	wg.Wait()
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	records := readRecords(t, path)
+	if len(records) != n {
+		t.Fatalf("got %d records, want %d", len(records), n)
+	}
+	seen := make(map[string]bool)
+	for _, rec := range records {
+		seen[rec.SessionID] = true
+	}
+	if len(seen) != n {
+		t.Errorf("got %d distinct sessions, want %d", len(seen), n)
+	}
+}
+
+func TestNewFileSinkError(t *testing.T) {
+	if _, err := NewFileSink(filepath.Join(t.TempDir(), "missing", "audit.log")); err == nil {
+		t.Error("expected error for missing directory")
+	}
+}
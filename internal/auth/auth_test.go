@@ -1,13 +1,17 @@
 package auth
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
 	"github.com/al-bashkir/openvpn-keycloak-auth/internal/ipc"
 )
 
@@ -209,7 +213,9 @@ func TestHandlerRun(t *testing.T) {
 	t.Setenv("IV_SSO", "webauth,crtext")
 
 	// Create IPC server
+	var clientVersion string
 	handler := func(ctx context.Context, req *ipc.AuthRequest) (*ipc.AuthResponse, error) {
+		clientVersion = req.ClientVersion
 		return &ipc.AuthResponse{
 			Status:    ipc.StatusDeferred,
 			SessionID: "test-session-123",
@@ -218,6 +224,7 @@ func TestHandlerRun(t *testing.T) {
 	}
 
 	server := ipc.NewServer(socketPath, handler)
+	server.SetVersionCheck("1.4.0", true)
 	if err := server.Start(context.Background()); err != nil {
 		t.Fatalf("failed to start server: %v", err)
 	}
@@ -244,6 +251,7 @@ func TestHandlerRun(t *testing.T) {
 
 	// Create handler
 	authHandler := NewHandler(socketPath)
+	authHandler.SetVersion("1.4.0")
 
 	// Run auth
 	exitCode := authHandler.Run(context.Background(), credsFile.Name())
@@ -251,6 +259,9 @@ func TestHandlerRun(t *testing.T) {
 	if exitCode != ExitDeferred {
 		t.Errorf("expected exit code %d (deferred), got %d", ExitDeferred, exitCode)
 	}
+	if clientVersion != "1.4.0" {
+		t.Errorf("client version = %q, want %q", clientVersion, "1.4.0")
+	}
 }
 
 func TestHandlerRunDaemonError(t *testing.T) {
@@ -334,11 +345,307 @@ func TestHandlerRunNoDaemon(t *testing.T) {
 	}
 }
 
+func TestHandlerRunJSONOutput(t *testing.T) {
+	tmpDir := t.TempDir()
+	socketPath := filepath.Join(tmpDir, "test.sock")
+
+	t.Setenv("auth_control_file", "/tmp/test_acf")
+	t.Setenv("auth_pending_file", "/tmp/test_apf")
+	t.Setenv("auth_failed_reason_file", "/tmp/test_arf")
+
+	var (
+		mu            sync.Mutex
+		correlationID string // of the last request the daemon saw
+	)
+	server := ipc.NewServer(socketPath, func(ctx context.Context, req *ipc.AuthRequest) (*ipc.AuthResponse, error) {
+		mu.Lock()
+		correlationID = req.CorrelationID
+		mu.Unlock()
+		if req.Username == "baduser" {
+			return &ipc.AuthResponse{Status: ipc.StatusError, Error: "daemon not initialized"}, nil
+		}
+		return &ipc.AuthResponse{Status: ipc.StatusDeferred, SessionID: "test-session-123"}, nil
+	})
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer func() {
+		if err := server.Stop(); err != nil {
+			t.Errorf("server.Stop failed: %v", err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	tests := []struct {
+		name       string
+		username   string
+		ivSSO      string
+		jsonOutput bool
+		wantExit   int
+		want       *Decision
+		// wantCorrelationID expects the daemon's correlation ID in want
+		wantCorrelationID bool
+	}{
+		{
+			name:       "deferred",
+			username:   "testuser",
+			ivSSO:      "webauth",
+			jsonOutput: true,
+			wantExit:   ExitDeferred,
+			want: &Decision{Decision: DecisionDeferred, Username: "testuser", SessionID: "test-session-123",
+				PendingMethod: "webauth", ExitCode: ExitDeferred},
+			wantCorrelationID: true,
+		},
+		{
+			name:       "daemon error",
+			username:   "baduser",
+			ivSSO:      "webauth",
+			jsonOutput: true,
+			wantExit:   ExitFailure,
+			want: &Decision{Decision: DecisionFailure, Username: "baduser", Reason: "daemon not initialized",
+				ExitCode: ExitFailure},
+			wantCorrelationID: true,
+		},
+		{
+			name:       "unsupported client",
+			username:   "testuser",
+			ivSSO:      "crtext",
+			jsonOutput: true,
+			wantExit:   ExitFailure,
+			want: &Decision{Decision: DecisionFailure, Username: "testuser",
+				Reason: "client does not support a known SSO method (IV_SSO=[crtext])", ExitCode: ExitFailure},
+		},
+		{
+			name:     "disabled",
+			username: "testuser",
+			ivSSO:    "webauth",
+			wantExit: ExitDeferred,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("IV_SSO", tt.ivSSO)
+
+			credsFile := filepath.Join(tmpDir, "creds")
+			if err := os.WriteFile(credsFile, []byte(tt.username+"\nsso\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			var stdout bytes.Buffer
+			authHandler := NewHandler(socketPath)
+			authHandler.stdout = &stdout
+			authHandler.SetJSONOutput(tt.jsonOutput)
+
+			if exitCode := authHandler.Run(context.Background(), credsFile); exitCode != tt.wantExit {
+				t.Errorf("exit code = %d, want %d", exitCode, tt.wantExit)
+			}
+
+			if tt.want == nil {
+				if stdout.Len() != 0 {
+					t.Fatalf("expected no stdout output, got %q", stdout.String())
+				}
+				return
+			}
+
+			out := stdout.String()
+			if strings.Count(out, "\n") != 1 || !strings.HasSuffix(out, "\n") {
+				t.Fatalf("expected a single JSON line, got %q", out)
+			}
+			var got Decision
+			if err := json.Unmarshal([]byte(out), &got); err != nil {
+				t.Fatalf("stdout is not JSON: %v (%q)", err, out)
+			}
+			want := *tt.want
+			if tt.wantCorrelationID {
+				mu.Lock()
+				want.CorrelationID = correlationID
+				mu.Unlock()
+				if want.CorrelationID == "" {
+					t.Fatal("daemon saw no correlation ID")
+				}
+			}
+			if got != want {
+				t.Errorf("decision = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestHandlerRunViaEnv(t *testing.T) {
+	tmpDir := t.TempDir()
+	socketPath := filepath.Join(tmpDir, "test.sock")
+
+	t.Setenv("auth_control_file", "/tmp/test_acf")
+	t.Setenv("auth_pending_file", "/tmp/test_apf")
+	t.Setenv("auth_failed_reason_file", "/tmp/test_arf")
+	t.Setenv("IV_SSO", "webauth")
+
+	var gotUsername string
+	server := ipc.NewServer(socketPath, func(ctx context.Context, req *ipc.AuthRequest) (*ipc.AuthResponse, error) {
+		gotUsername = req.Username
+		return &ipc.AuthResponse{Status: ipc.StatusDeferred, SessionID: "test-session-123"}, nil
+	})
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer func() {
+		if err := server.Stop(); err != nil {
+			t.Errorf("server.Stop failed: %v", err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	tests := []struct {
+		name         string
+		username     string
+		wantExit     int
+		wantUsername string
+	}{
+		{name: "username set", username: "testuser", wantExit: ExitDeferred, wantUsername: "testuser"},
+		{name: "username with whitespace", username: " testuser\n", wantExit: ExitDeferred, wantUsername: "testuser"},
+		{name: "empty username", username: "", wantExit: ExitFailure},
+		{name: "blank username", username: "  ", wantExit: ExitFailure},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("username", tt.username)
+			t.Setenv("password", "sso")
+			gotUsername = ""
+
+			authHandler := NewHandler(socketPath)
+			if exitCode := authHandler.Run(context.Background(), ""); exitCode != tt.wantExit {
+				t.Errorf("exit code = %d, want %d", exitCode, tt.wantExit)
+			}
+			if gotUsername != tt.wantUsername {
+				t.Errorf("username sent to daemon = %q, want %q", gotUsername, tt.wantUsername)
+			}
+		})
+	}
+}
+
+func TestExpectedUsername(t *testing.T) {
+	tests := []struct {
+		name       string
+		source     string
+		username   string
+		commonName string
+		want       string
+		wantFromCN bool
+	}{
+		{name: "default", source: "", username: "alice", commonName: "alice-laptop", want: "alice"},
+		{name: "username", source: config.UsernameSourceUsername, username: "alice", commonName: "alice-laptop", want: "alice"},
+		{name: "username empty", source: config.UsernameSourceUsername, commonName: "alice", want: ""},
+		{name: "common name", source: config.UsernameSourceCommonName, username: "alice@example.com", commonName: "alice",
+			want: "alice", wantFromCN: true},
+		{name: "common name empty", source: config.UsernameSourceCommonName, username: "alice", want: "", wantFromCN: true},
+		{name: "auto with username", source: config.UsernameSourceAuto, username: "alice", commonName: "alice-laptop", want: "alice"},
+		{name: "auto without username", source: config.UsernameSourceAuto, commonName: "alice", want: "alice", wantFromCN: true},
+		{name: "auto without either", source: config.UsernameSourceAuto, want: "", wantFromCN: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := &OpenVPNEnv{Username: tt.username, CommonName: tt.commonName}
+			got, fromCN := env.ExpectedUsername(tt.source)
+			if got != tt.want || fromCN != tt.wantFromCN {
+				t.Errorf("ExpectedUsername(%q) = %q, %v, want %q, %v", tt.source, got, fromCN, tt.want, tt.wantFromCN)
+			}
+		})
+	}
+}
+
+func TestHandlerRunUsernameSource(t *testing.T) {
+	tmpDir := t.TempDir()
+	socketPath := filepath.Join(tmpDir, "test.sock")
+
+	t.Setenv("auth_control_file", "/tmp/test_acf")
+	t.Setenv("auth_pending_file", "/tmp/test_apf")
+	t.Setenv("auth_failed_reason_file", "/tmp/test_arf")
+	t.Setenv("IV_SSO", "webauth")
+	t.Setenv("username", "")
+
+	var gotReq *ipc.AuthRequest
+	server := ipc.NewServer(socketPath, func(ctx context.Context, req *ipc.AuthRequest) (*ipc.AuthResponse, error) {
+		gotReq = req
+		return &ipc.AuthResponse{Status: ipc.StatusDeferred, SessionID: "test-session-123"}, nil
+	})
+	if err := server.Start(context.Background()); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer func() {
+		if err := server.Stop(); err != nil {
+			t.Errorf("server.Stop failed: %v", err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	tests := []struct {
+		name           string
+		source         string
+		fileUsername   string
+		commonName     string
+		wantExit       int
+		wantUsername   string
+		wantFromSource string
+	}{
+		{name: "username", source: config.UsernameSourceUsername, fileUsername: "alice", commonName: "alice-laptop",
+			wantExit: ExitDeferred, wantUsername: "alice"},
+		{name: "username missing", source: config.UsernameSourceUsername, commonName: "alice",
+			wantExit: ExitFailure},
+		{name: "common name", source: config.UsernameSourceCommonName, fileUsername: "alice@example.com", commonName: "alice",
+			wantExit: ExitDeferred, wantUsername: "alice", wantFromSource: config.UsernameSourceCommonName},
+		{name: "common name missing", source: config.UsernameSourceCommonName, fileUsername: "alice",
+			wantExit: ExitFailure},
+		{name: "auto prefers username", source: config.UsernameSourceAuto, fileUsername: "alice", commonName: "alice-laptop",
+			wantExit: ExitDeferred, wantUsername: "alice"},
+		{name: "auto falls back to common name", source: config.UsernameSourceAuto, commonName: "alice",
+			wantExit: ExitDeferred, wantUsername: "alice", wantFromSource: config.UsernameSourceCommonName},
+		{name: "auto without either", source: config.UsernameSourceAuto,
+			wantExit: ExitFailure},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("common_name", tt.commonName)
+			credsFile := filepath.Join(tmpDir, "creds")
+			if err := os.WriteFile(credsFile, []byte(tt.fileUsername+"\n\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			gotReq = nil
+
+			authHandler := NewHandler(socketPath)
+			authHandler.SetUsernameSource(tt.source)
+			if exitCode := authHandler.Run(context.Background(), credsFile); exitCode != tt.wantExit {
+				t.Fatalf("exit code = %d, want %d", exitCode, tt.wantExit)
+			}
+			if tt.wantExit != ExitDeferred {
+				if gotReq != nil {
+					t.Errorf("unexpected request to daemon: %+v", gotReq)
+				}
+				return
+			}
+			if gotReq == nil {
+				t.Fatal("no request sent to daemon")
+			}
+			if gotReq.Username != tt.wantUsername || gotReq.UsernameSource != tt.wantFromSource {
+				t.Errorf("request username = %q (source %q), want %q (source %q)",
+					gotReq.Username, gotReq.UsernameSource, tt.wantUsername, tt.wantFromSource)
+			}
+		})
+	}
+}
+
 func TestSelectPendingMethod(t *testing.T) {
 	tests := []struct {
-		name    string
-		methods []string
-		want    string
+		name        string
+		methods     []string
+		allowCRText bool
+		want        string
 	}{
 		{
 			name:    "webauth only",
@@ -365,6 +672,18 @@ func TestSelectPendingMethod(t *testing.T) {
 			methods: []string{"crtext"},
 			want:    "",
 		},
+		{
+			name:        "crtext only - enabled",
+			methods:     []string{"crtext"},
+			allowCRText: true,
+			want:        "crtext",
+		},
+		{
+			name:        "webauth and crtext - prefers webauth when crtext enabled",
+			methods:     []string{"crtext", "webauth"},
+			allowCRText: true,
+			want:        "webauth",
+		},
 		{
 			name:    "empty list",
 			methods: []string{},
@@ -379,9 +698,9 @@ func TestSelectPendingMethod(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := selectPendingMethod(tt.methods)
+			got := selectPendingMethod(tt.methods, tt.allowCRText)
 			if got != tt.want {
-				t.Errorf("selectPendingMethod(%v) = %q, want %q", tt.methods, got, tt.want)
+				t.Errorf("selectPendingMethod(%v, %v) = %q, want %q", tt.methods, tt.allowCRText, got, tt.want)
 			}
 		})
 	}
@@ -442,3 +761,203 @@ func TestParseEnvWithIVSSO(t *testing.T) {
 		})
 	}
 }
+
+func TestHandlerRunAuthTokenRenewal(t *testing.T) {
+	tests := []struct {
+		name            string
+		sessionState    string
+		acceptAuthToken bool
+		dryRun          bool
+		wantExit        int
+	}{
+		{
+			name:            "valid token accepted",
+			sessionState:    "Authenticated",
+			acceptAuthToken: true,
+			wantExit:        ExitSuccess,
+		},
+		{
+			// Falls through to the daemon, which is not running
+			name:            "valid token not accepted in dry run",
+			sessionState:    "Authenticated",
+			acceptAuthToken: true,
+			dryRun:          true,
+			wantExit:        ExitFailure,
+		},
+		{
+			// Falls through to the daemon, which is not running
+			name:            "valid token with empty user starts new flow",
+			sessionState:    "AuthenticatedEmptyUser",
+			acceptAuthToken: true,
+			wantExit:        ExitFailure,
+		},
+		{
+			// Falls through to the daemon, which is not running
+			name:            "expired token starts new flow",
+			sessionState:    "Expired",
+			acceptAuthToken: true,
+			wantExit:        ExitFailure,
+		},
+		{
+			name:            "valid token ignored when disabled",
+			sessionState:    "Authenticated",
+			acceptAuthToken: false,
+			wantExit:        ExitFailure,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			controlFile := filepath.Join(tmpDir, "acf")
+
+			t.Setenv("auth_control_file", controlFile)
+			t.Setenv("auth_pending_file", filepath.Join(tmpDir, "apf"))
+			t.Setenv("auth_failed_reason_file", filepath.Join(tmpDir, "arf"))
+			t.Setenv("IV_SSO", "webauth")
+			t.Setenv("session_state", tt.sessionState)
+
+			credsFile := filepath.Join(tmpDir, "creds")
+			if err := os.WriteFile(credsFile, []byte("testuser\nsso\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			authHandler := NewHandler(filepath.Join(tmpDir, "missing.sock"))
+			authHandler.SetAcceptAuthToken(tt.acceptAuthToken)
+			authHandler.SetDryRun(tt.dryRun)
+
+			if exitCode := authHandler.Run(context.Background(), credsFile); exitCode != tt.wantExit {
+				t.Fatalf("exit code = %d, want %d", exitCode, tt.wantExit)
+			}
+
+			// The exit code is the result; the control file is the daemon's
+			if content, err := os.ReadFile(controlFile); err == nil {
+				t.Errorf("expected no auth_control_file, got %q", content)
+			}
+		})
+	}
+}
+
+func TestParseEnvInstance(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{name: "conf file", config: "/etc/openvpn/server/server-a.conf", want: "server-a"},
+		{name: "ovpn file", config: "/etc/openvpn/office.ovpn", want: "office"},
+		{name: "relative path", config: "server-b.conf", want: "server-b"},
+		{name: "no extension", config: "/etc/openvpn/server", want: "server"},
+		{name: "unset", config: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("auth_control_file", "/tmp/acf")
+			t.Setenv("auth_pending_file", "/tmp/apf")
+			t.Setenv("auth_failed_reason_file", "/tmp/arf")
+			t.Setenv("config", tt.config)
+
+			env, err := ParseEnv()
+			if err != nil {
+				t.Fatalf("ParseEnv failed: %v", err)
+			}
+			if env.Instance != tt.want {
+				t.Errorf("Instance = %q, want %q", env.Instance, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseEnvUntrustedIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		ip      string
+		ip6     string
+		want    string
+		wantErr bool
+	}{
+		{name: "IPv4", ip: "192.0.2.1", want: "192.0.2.1"},
+		{name: "IPv6 in untrusted_ip6", ip6: "2001:DB8:0:0::1", want: "2001:db8::1"},
+		{name: "untrusted_ip preferred", ip: "192.0.2.1", ip6: "2001:db8::1", want: "192.0.2.1"},
+		{name: "IPv4-mapped IPv6", ip: "::ffff:192.0.2.1", want: "192.0.2.1"},
+		{name: "missing", want: ""},
+		{name: "invalid keeps raw value", ip: "not-an-ip", want: "not-an-ip", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("auth_control_file", "/tmp/acf")
+			t.Setenv("auth_pending_file", "/tmp/apf")
+			t.Setenv("auth_failed_reason_file", "/tmp/arf")
+			t.Setenv("untrusted_ip", tt.ip)
+			t.Setenv("untrusted_ip6", tt.ip6)
+
+			env, err := ParseEnv()
+			if err != nil {
+				t.Fatalf("ParseEnv failed: %v", err)
+			}
+			if env.UntrustedIP != tt.want {
+				t.Errorf("UntrustedIP = %q, want %q", env.UntrustedIP, tt.want)
+			}
+			if (env.UntrustedIPError != nil) != tt.wantErr {
+				t.Errorf("UntrustedIPError = %v, wantErr %v", env.UntrustedIPError, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHandlerRunRejectInvalidIP(t *testing.T) {
+	t.Setenv("auth_control_file", "/tmp/test_acf")
+	t.Setenv("auth_pending_file", "/tmp/test_apf")
+	t.Setenv("auth_failed_reason_file", "/tmp/test_arf")
+	t.Setenv("untrusted_ip", "not-an-ip")
+	t.Setenv("IV_SSO", "webauth")
+
+	credsFile := filepath.Join(t.TempDir(), "creds")
+	if err := os.WriteFile(credsFile, []byte("testuser\nsso\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Rejected before the daemon is contacted
+	authHandler := NewHandler("/nonexistent/socket.sock")
+	authHandler.SetRejectInvalidIP(true)
+	var out bytes.Buffer
+	authHandler.stdout = &out
+	authHandler.SetJSONOutput(true)
+
+	if exitCode := authHandler.Run(context.Background(), credsFile); exitCode != ExitFailure {
+		t.Errorf("expected exit code %d (failure), got %d", ExitFailure, exitCode)
+	}
+	if !strings.Contains(out.String(), "invalid IP address") {
+		t.Errorf("decision = %s, want invalid IP reason", out.String())
+	}
+}
+
+func TestParseEnvSessionState(t *testing.T) {
+	t.Setenv("auth_control_file", "/tmp/acf")
+	t.Setenv("auth_pending_file", "/tmp/apf")
+	t.Setenv("auth_failed_reason_file", "/tmp/arf")
+	t.Setenv("session_state", "Authenticated")
+
+	env, err := ParseEnv()
+	if err != nil {
+		t.Fatalf("ParseEnv failed: %v", err)
+	}
+	if env.SessionState != "Authenticated" {
+		t.Errorf("SessionState = %q, want %q", env.SessionState, "Authenticated")
+	}
+	if !env.HasValidAuthToken() {
+		t.Error("expected HasValidAuthToken to be true")
+	}
+
+	env.SessionState = "Initial"
+	if env.HasValidAuthToken() {
+		t.Error("expected HasValidAuthToken to be false for initial auth")
+	}
+
+	env.SessionState = "AuthenticatedEmptyUser"
+	if env.HasValidAuthToken() {
+		t.Error("expected HasValidAuthToken to be false without a username")
+	}
+}
@@ -4,12 +4,17 @@ package auth
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/openvpn"
 )
 
 // OpenVPNEnv contains environment variables set by OpenVPN when calling the auth script
 type OpenVPNEnv struct {
-	// User credentials (may be empty when using via-file)
+	// User credentials (set by OpenVPN for via-env; the username may be
+	// empty when using via-file)
 	Username string
 	// Password is intentionally excluded from all IPC messages and logs.
 	// The json tag prevents accidental serialization should this struct ever
@@ -18,9 +23,13 @@ type OpenVPNEnv struct {
 
 	// Client information
 	CommonName    string
-	UntrustedIP   string
+	UntrustedIP   string // Normalized, see openvpn.NormalizeIP
 	UntrustedPort string
 
+	// UntrustedIPError is set when untrusted_ip could not be parsed as an
+	// IP address; UntrustedIP then holds the raw value.
+	UntrustedIPError error
+
 	// Client SSO capabilities reported via IV_SSO peer info.
 	// Comma-separated list, e.g. "webauth,crtext" or "openurl".
 	SSOMethods []string
@@ -33,8 +42,14 @@ type OpenVPNEnv struct {
 	// Script metadata
 	ScriptType string
 
+	// SessionState is set by OpenVPN when auth-gen-token is used with
+	// external-auth: "Initial", "Authenticated", "Expired", "Invalid",
+	// "AuthenticatedEmptyUser" or "ExpiredEmptyUser".
+	SessionState string
+
 	// Additional useful fields
 	Config               string
+	Instance             string // Server instance name derived from Config, see instanceName
 	IfconfigPoolRemoteIP string
 	TimeASCII            string
 	TimeUnix             string
@@ -52,12 +67,24 @@ func ParseEnv() (*OpenVPNEnv, error) {
 		AuthPendingFile:      os.Getenv("auth_pending_file"),
 		AuthFailedReasonFile: os.Getenv("auth_failed_reason_file"),
 		ScriptType:           os.Getenv("script_type"),
+		SessionState:         os.Getenv("session_state"),
 		Config:               os.Getenv("config"),
+		Instance:             instanceName(os.Getenv("config")),
 		IfconfigPoolRemoteIP: os.Getenv("ifconfig_pool_remote_ip"),
 		TimeASCII:            os.Getenv("time_ascii"),
 		TimeUnix:             os.Getenv("time_unix"),
 	}
 
+	// IPv6 clients are reported in untrusted_ip6 instead of untrusted_ip
+	if env.UntrustedIP == "" {
+		env.UntrustedIP = os.Getenv("untrusted_ip6")
+	}
+	if ip, err := openvpn.NormalizeIP(env.UntrustedIP); err != nil {
+		env.UntrustedIPError = err
+	} else {
+		env.UntrustedIP = ip
+	}
+
 	// Parse IV_SSO client capabilities (e.g. "webauth,crtext" or "openurl").
 	// OpenVPN exports peer info IV_* variables to the auth script environment.
 	if ivSSO := os.Getenv("IV_SSO"); ivSSO != "" {
@@ -84,3 +111,40 @@ func ParseEnv() (*OpenVPNEnv, error) {
 
 	return env, nil
 }
+
+// instanceName identifies the OpenVPN server instance by the name of its
+// config file without extension, e.g. "server-a" for
+// /etc/openvpn/server/server-a.conf. It is empty when OpenVPN was started
+// without a config file.
+func instanceName(configPath string) string {
+	if configPath == "" {
+		return ""
+	}
+	base := filepath.Base(configPath)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// ExpectedUsername returns the username the token must match for
+// auth.username_source: Username, CommonName for "common_name", or for
+// "auto" CommonName if Username is empty, as in pure-certificate
+// deployments. fromCN reports whether the common name was used.
+func (e *OpenVPNEnv) ExpectedUsername(source string) (username string, fromCN bool) {
+	switch source {
+	case config.UsernameSourceCommonName:
+		return e.CommonName, true
+	case config.UsernameSourceAuto:
+		if e.Username == "" {
+			return e.CommonName, true
+		}
+	}
+	return e.Username, false
+}
+
+// HasValidAuthToken reports whether the client presented a valid auth token
+// generated by auth-gen-token. This is the case on TLS renegotiation and
+// reconnects of an already authenticated session. "AuthenticatedEmptyUser"
+// does not count: the token is valid, but the client sent no username, so
+// it is not tied to the user that signed in.
+func (e *OpenVPNEnv) HasValidAuthToken() bool {
+	return e.SessionState == "Authenticated"
+}
@@ -2,78 +2,214 @@ package auth
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
 	"github.com/al-bashkir/openvpn-keycloak-auth/internal/ipc"
 )
 
 // Exit codes for the auth script
 const (
-	ExitSuccess  = 0 // Auth success (immediate, not used for SSO)
+	ExitSuccess  = 0 // Auth success (immediate; used for auth token renewal)
 	ExitFailure  = 1 // Auth failure
 	ExitDeferred = 2 // Auth deferred (SSO flow initiated)
 )
 
 // Handler handles authentication requests from OpenVPN
 type Handler struct {
-	socketPath string
+	socketPath      string
+	acceptAuthToken bool
+	dryRun          bool
+	enableCRText    bool
+	rejectInvalidIP bool
+	usernameSource  string
+	jsonOutput      bool
+	version         string
+	stdout          io.Writer
 }
 
 // NewHandler creates a new auth handler
 func NewHandler(socketPath string) *Handler {
 	return &Handler{
 		socketPath: socketPath,
+		stdout:     os.Stdout,
 	}
 }
 
+// Decision values reported in Decision.Decision.
+const (
+	DecisionSuccess  = "success"
+	DecisionDeferred = "deferred"
+	DecisionFailure  = "failure"
+)
+
+// Decision summarizes the outcome of one auth script run. With JSON output
+// enabled it is written to stdout as a single line for log aggregation.
+type Decision struct {
+	Decision      string `json:"decision"`
+	Username      string `json:"username,omitempty"`
+	SessionID     string `json:"session_id,omitempty"`
+	CorrelationID string `json:"correlation_id,omitempty"`
+	PendingMethod string `json:"pending_method,omitempty"`
+	Reason        string `json:"reason,omitempty"`
+	ExitCode      int    `json:"exit_code"`
+}
+
+// SetJSONOutput controls whether Run writes its decision to stdout as a
+// single JSON line, in addition to the human-readable stderr messages.
+func (h *Handler) SetJSONOutput(enable bool) {
+	h.jsonOutput = enable
+}
+
+// SetVersion sets the release version reported to the daemon, which warns
+// about or rejects a version that differs from its own.
+func (h *Handler) SetVersion(version string) {
+	h.version = version
+}
+
+// SetAcceptAuthToken controls whether a valid OpenVPN auth token
+// (session_state=Authenticated) is accepted without a new SSO flow.
+func (h *Handler) SetAcceptAuthToken(accept bool) {
+	h.acceptAuthToken = accept
+}
+
+// SetDryRun mirrors daemon.dry_run: an auth token renewal is only logged
+// and the client goes through the SSO flow instead, for which the daemon
+// writes no result, so no client connects.
+func (h *Handler) SetDryRun(enabled bool) {
+	h.dryRun = enabled
+}
+
+// SetEnableCRText controls whether clients that only support crtext are
+// offered the one-time code challenge instead of being rejected.
+func (h *Handler) SetEnableCRText(enable bool) {
+	h.enableCRText = enable
+}
+
+// SetRejectInvalidIP controls whether a request whose untrusted_ip is not a
+// valid IP address fails instead of only being logged.
+func (h *Handler) SetRejectInvalidIP(reject bool) {
+	h.rejectInvalidIP = reject
+}
+
+// SetUsernameSource sets auth.username_source, which selects whether the
+// username or the certificate common name is the expected username.
+func (h *Handler) SetUsernameSource(source string) {
+	h.usernameSource = source
+}
+
 // Run executes the auth script logic
 // It reads OpenVPN environment, parses credentials, sends request to daemon,
-// and returns the appropriate exit code
-func (h *Handler) Run(ctx context.Context, credentialsFile string) int {
+// and returns the appropriate exit code.
+// credentialsFile is OpenVPN's via-file argument; if it is empty, the
+// credentials are taken from the username and password environment
+// variables (via-env).
+func (h *Handler) Run(ctx context.Context, credentialsFile string) (exitCode int) {
+	dec := Decision{}
+	defer func() {
+		dec.ExitCode = exitCode
+		h.writeDecision(&dec)
+	}()
+
 	// Parse OpenVPN environment variables
 	env, err := ParseEnv()
 	if err != nil {
 		slog.Error("failed to parse OpenVPN environment", "error", err)
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		dec.Reason = err.Error()
 		return ExitFailure
 	}
 
-	// Read credentials from via-file
-	username, password, err := readCredentialsFile(credentialsFile)
-	if err != nil {
-		slog.Error("failed to read credentials file", "error", err, "file", credentialsFile)
-		fmt.Fprintf(os.Stderr, "Error reading credentials: %v\n", err)
-		return ExitFailure
+	if env.UntrustedIPError != nil {
+		slog.Warn("untrusted_ip is not a valid IP address", "error", env.UntrustedIPError)
+		if h.rejectInvalidIP {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", env.UntrustedIPError)
+			dec.Reason = env.UntrustedIPError.Error()
+			return ExitFailure
+		}
 	}
 
-	// Override env username/password if present in file
-	if username != "" {
-		env.Username = username
-	}
-	if password != "" {
-		env.Password = password
+	// Read credentials from via-file; with via-env, ParseEnv already has them
+	if credentialsFile != "" {
+		username, password, err := readCredentialsFile(credentialsFile)
+		if errors.Is(err, errEmptyUsername) && h.usernameSource != "" && h.usernameSource != config.UsernameSourceUsername {
+			// No username in pure-certificate deployments; the common
+			// name may stand in for it below
+			err = nil
+		}
+		if err != nil {
+			slog.Error("failed to read credentials file", "error", err, "file", credentialsFile)
+			fmt.Fprintf(os.Stderr, "Error reading credentials: %v\n", err)
+			dec.Reason = fmt.Sprintf("failed to read credentials: %v", err)
+			return ExitFailure
+		}
+
+		// Override env username/password if present in file
+		if username != "" {
+			env.Username = username
+		}
+		if password != "" {
+			env.Password = password
+		}
+	} else {
+		env.Username = strings.TrimSpace(env.Username)
 	}
 
+	// Pure-certificate deployments may pass only the common name
+	username, fromCN := env.ExpectedUsername(h.usernameSource)
+	env.Username = username
+	dec.Username = env.Username
+
 	// Validate username
 	if env.Username == "" {
-		slog.Error("username is empty")
-		fmt.Fprintf(os.Stderr, "Error: username is required\n")
+		reason := "username is required"
+		if fromCN {
+			reason = "common_name is required (auth.username_source)"
+		}
+		slog.Error("username is empty", "username_source", h.usernameSource)
+		fmt.Fprintf(os.Stderr, "Error: %s\n", reason)
+		dec.Reason = reason
 		return ExitFailure
 	}
 
+	// OpenVPN already verified the auth token it issued after the initial SSO
+	// login; accept renegotiations/reconnects without another browser flow.
+	// The exit code is the result: auth_control_file is left to the daemon,
+	// which applies daemon.dry_run and auth.preserve_existing_result.
+	if h.acceptAuthToken && env.HasValidAuthToken() {
+		if !h.dryRun {
+			slog.Info("auth token renewal accepted",
+				"username", env.Username,
+				"ip", env.UntrustedIP,
+				"session_state", env.SessionState,
+			)
+			dec.Reason = "auth token renewal"
+			return ExitSuccess
+		}
+		slog.Info("dry run: not accepting auth token renewal",
+			"username", env.Username,
+			"ip", env.UntrustedIP,
+			"session_state", env.SessionState,
+		)
+	}
+
 	// Select the auth pending method from the client's SSO capabilities.
 	// The method must match one of the values the client advertised in IV_SSO.
-	pendingMethod := selectPendingMethod(env.SSOMethods)
+	pendingMethod := selectPendingMethod(env.SSOMethods, h.enableCRText)
 	if pendingMethod == "" {
 		slog.Error("client does not support any known SSO method",
 			"username", env.Username,
 			"iv_sso", env.SSOMethods,
 		)
 		fmt.Fprintf(os.Stderr, "Error: client does not support webauth or openurl (IV_SSO=%v)\n", env.SSOMethods)
+		dec.Reason = fmt.Sprintf("client does not support a known SSO method (IV_SSO=%v)", env.SSOMethods)
 		return ExitFailure
 	}
 
@@ -87,6 +223,7 @@ func (h *Handler) Run(ctx context.Context, credentialsFile string) int {
 
 	// Create IPC client
 	client := ipc.NewClient(h.socketPath)
+	client.SetVersion(h.version)
 
 	// Build auth request (password intentionally excluded from IPC)
 	req := &ipc.AuthRequest{
@@ -98,6 +235,10 @@ func (h *Handler) Run(ctx context.Context, credentialsFile string) int {
 		AuthPendingFile:      env.AuthPendingFile,
 		AuthFailedReasonFile: env.AuthFailedReasonFile,
 		PendingAuthMethod:    pendingMethod,
+		Instance:             env.Instance,
+	}
+	if fromCN {
+		req.UsernameSource = config.UsernameSourceCommonName
 	}
 
 	// Send request to daemon
@@ -106,34 +247,66 @@ func (h *Handler) Run(ctx context.Context, credentialsFile string) int {
 		slog.Error("failed to communicate with daemon", "error", err)
 		fmt.Fprintf(os.Stderr, "Error: daemon communication failed: %v\n", err)
 		fmt.Fprintf(os.Stderr, "Is the daemon running? Check: systemctl status openvpn-keycloak-auth\n")
+		dec.Reason = fmt.Sprintf("daemon communication failed: %v", err)
 		return ExitFailure
 	}
+	dec.SessionID = resp.SessionID
+	dec.CorrelationID = resp.CorrelationID
 
 	// Handle response
 	if resp.Status == ipc.StatusError {
-		slog.Error("daemon returned error", "error", resp.Error)
+		slog.Error("daemon returned error", "correlation_id", resp.CorrelationID, "error", resp.Error)
 		fmt.Fprintf(os.Stderr, "Error: %s\n", resp.Error)
+		dec.Reason = resp.Error
 		return ExitFailure
 	}
 
 	if resp.Status == ipc.StatusDeferred {
 		slog.Info("auth deferred",
 			"session_id", resp.SessionID,
+			"correlation_id", resp.CorrelationID,
 			"username", env.Username,
 		)
 		slog.Debug("auth URL generated", "url", resp.AuthURL)
 
 		// Auth is deferred - daemon will handle the SSO flow
 		// and write to auth_control_file when complete
+		dec.PendingMethod = pendingMethod
 		return ExitDeferred
 	}
 
 	// Unknown status
 	slog.Error("unknown response status", "status", resp.Status)
 	fmt.Fprintf(os.Stderr, "Error: unexpected response from daemon\n")
+	dec.Reason = fmt.Sprintf("unexpected response status %q from daemon", resp.Status)
 	return ExitFailure
 }
 
+// writeDecision writes dec as a JSON line to stdout if JSON output is enabled.
+func (h *Handler) writeDecision(dec *Decision) {
+	if !h.jsonOutput {
+		return
+	}
+
+	switch dec.ExitCode {
+	case ExitSuccess:
+		dec.Decision = DecisionSuccess
+	case ExitDeferred:
+		dec.Decision = DecisionDeferred
+	default:
+		dec.Decision = DecisionFailure
+	}
+
+	// Encode appends the trailing newline
+	if err := json.NewEncoder(h.stdout).Encode(dec); err != nil {
+		slog.Error("failed to write JSON decision", "error", err)
+	}
+}
+
+// errEmptyUsername is returned by readCredentialsFile for a file without a
+// username.
+var errEmptyUsername = errors.New("username is empty in credentials file")
+
 // readCredentialsFile reads username and password from OpenVPN's via-file
 // The file contains exactly two lines:
 //
@@ -164,7 +337,7 @@ func readCredentialsFile(path string) (username, password string, err error) {
 
 	// Username is always required
 	if username == "" {
-		return "", "", fmt.Errorf("username is empty in credentials file")
+		return "", "", errEmptyUsername
 	}
 
 	// Password may be empty for SSO flows
@@ -173,8 +346,8 @@ func readCredentialsFile(path string) (username, password string, err error) {
 
 // selectPendingMethod picks the best auth pending method from the client's
 // IV_SSO capabilities. Returns "" if the client supports none of the known
-// methods. Preference order: webauth > openurl.
-func selectPendingMethod(methods []string) string {
+// methods. Preference order: webauth > openurl > crtext (only if allowCRText).
+func selectPendingMethod(methods []string, allowCRText bool) string {
 	has := make(map[string]bool, len(methods))
 	for _, m := range methods {
 		has[m] = true
@@ -188,5 +361,9 @@ func selectPendingMethod(methods []string) string {
 	if has["openurl"] {
 		return "openurl"
 	}
+	// Last resort for CLI clients: a one-time code entered in a browser
+	if allowCRText && has["crtext"] {
+		return "crtext"
+	}
 	return ""
 }
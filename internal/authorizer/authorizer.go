@@ -0,0 +1,162 @@
+// Package authorizer asks an external policy service (e.g. OPA or a custom
+// HTTP service) whether an authenticated user may connect.
+package authorizer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/logsanitize"
+)
+
+// maxResponseSize bounds decision responses read into memory.
+const maxResponseSize = 64 << 10 // 64 KiB
+
+// maxReasonLen bounds the deny reason shown to the user.
+const maxReasonLen = 200
+
+// DefaultDenyReason is used when the authorizer denies without a reason.
+const DefaultDenyReason = "Access denied by policy"
+
+// unavailableReason is the failure reason shown when the authorizer cannot
+// be consulted and auth.external_authorizer.fail_open is false.
+const unavailableReason = "Authorization service unavailable"
+
+// Request is the JSON body POSTed to the decision endpoint.
+type Request struct {
+	// Username is the username claim of the validated ID token
+	Username string `json:"username"`
+	// ExpectedUsername is the username the OpenVPN client sent
+	ExpectedUsername string                 `json:"expected_username"`
+	CommonName       string                 `json:"common_name,omitempty"`
+	UntrustedIP      string                 `json:"untrusted_ip,omitempty"`
+	Instance         string                 `json:"instance,omitempty"`
+	Provider         string                 `json:"provider,omitempty"`
+	SessionID        string                 `json:"session_id"`
+	Claims           map[string]interface{} `json:"claims"`
+	// Builtin is the result of the built-in role/group checks, so a policy
+	// in "override" mode can still take it into account
+	Builtin BuiltinResult `json:"builtin"`
+}
+
+// BuiltinResult is the outcome of the built-in role/group checks.
+type BuiltinResult struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// Decision is the JSON body the decision endpoint answers with.
+type Decision struct {
+	Allow bool `json:"allow"`
+	// Reason is shown to the user on deny; optional
+	Reason string `json:"reason,omitempty"`
+}
+
+// Client calls the decision endpoint of auth.external_authorizer.
+type Client struct {
+	cfg        config.ExternalAuthorizerConfig
+	httpClient *http.Client
+}
+
+// New creates a client for cfg. Requests are bounded by cfg.Timeout.
+func New(cfg config.ExternalAuthorizerConfig) *Client {
+	return &Client{
+		cfg:        cfg,
+		httpClient: &http.Client{Timeout: time.Duration(cfg.Timeout) * time.Second},
+	}
+}
+
+// Authorize POSTs req to the decision endpoint and returns its decision. A
+// transport error, a non-2xx status or a malformed body is an error.
+func (c *Client) Authorize(ctx context.Context, req *Request) (*Decision, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode authorizer request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create authorizer request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "application/json")
+	if c.cfg.BearerToken != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+c.cfg.BearerToken)
+	}
+
+	resp, err := c.httpClient.Do(httpReq) // #nosec G704 -- URL from trusted config
+	if err != nil {
+		return nil, fmt.Errorf("authorizer request failed: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("authorizer returned HTTP %d", resp.StatusCode)
+	}
+
+	var decision Decision
+	dec := json.NewDecoder(io.LimitReader(resp.Body, maxResponseSize))
+	if err := dec.Decode(&decision); err != nil {
+		return nil, fmt.Errorf("failed to decode authorizer response: %w", err)
+	}
+	return &decision, nil
+}
+
+// Decide combines the built-in role/group checks (builtinErr, nil if they
+// passed) with the authorizer's decision according to the configured mode,
+// and returns nil to allow or an error whose message is the failure reason.
+//
+// In "augment" mode the authorizer is only consulted once the built-in
+// checks pass, and both must allow. In "override" mode it is always
+// consulted and its decision replaces the built-in checks. If the
+// authorizer cannot be consulted, fail_open falls back to the built-in
+// checks alone; otherwise the login is denied.
+func (c *Client) Decide(ctx context.Context, req *Request, builtinErr error) error {
+	override := c.cfg.Mode == config.AuthorizerModeOverride
+	if builtinErr != nil && !override {
+		return builtinErr
+	}
+
+	req.Builtin = BuiltinResult{Allowed: builtinErr == nil}
+	if builtinErr != nil {
+		req.Builtin.Reason = builtinErr.Error()
+	}
+
+	decision, err := c.Authorize(ctx, req)
+	if err != nil {
+		if c.cfg.FailOpen {
+			slog.Warn("external authorizer unavailable, using built-in checks only",
+				"session_id", req.SessionID,
+				"error", err,
+			)
+			return builtinErr
+		}
+		slog.Error("external authorizer unavailable, denying",
+			"session_id", req.SessionID,
+			"error", err,
+		)
+		return errors.New(unavailableReason)
+	}
+
+	if !decision.Allow {
+		// The reason ends up in auth_failed_reason_file and the browser
+		reason := logsanitize.Sanitize(decision.Reason)
+		if len(reason) > maxReasonLen {
+			reason = strings.ToValidUTF8(reason[:maxReasonLen], "")
+		}
+		if reason == "" {
+			reason = DefaultDenyReason
+		}
+		return errors.New(reason)
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package authorizer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
+)
+
+// mockAuthorizer answers every request with status and body, recording the
+// last request and the Authorization header.
+func mockAuthorizer(t *testing.T, status int, body string) (*httptest.Server, *Request, *string, *atomic.Int32) {
+	t.Helper()
+	var got Request
+	var auth string
+	var calls atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		auth = r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Errorf("failed to decode request: %v", err)
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(body))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &got, &auth, &calls
+}
+
+func TestAuthorize(t *testing.T) {
+	srv, got, auth, _ := mockAuthorizer(t, http.StatusOK, `{"allow":false,"reason":"Outside business hours"}`)
+	c := New(config.ExternalAuthorizerConfig{URL: srv.URL, Timeout: 5, BearerToken: "secret"})
+
+	decision, err := c.Authorize(context.Background(), &Request{
+		Username:    "alice",
+		UntrustedIP: "203.0.113.7",
+		Instance:    "server-udp",
+		SessionID:   "abc",
+		Claims:      map[string]interface{}{"department": "eng"},
+	})
+	if err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	if decision.Allow || decision.Reason != "Outside business hours" {
+		t.Errorf("decision = %+v, want deny with reason", decision)
+	}
+	if *auth != "Bearer secret" {
+		t.Errorf("Authorization = %q, want %q", *auth, "Bearer secret")
+	}
+	if got.Username != "alice" || got.UntrustedIP != "203.0.113.7" || got.Instance != "server-udp" ||
+		got.Claims["department"] != "eng" {
+		t.Errorf("request = %+v, missing fields", got)
+	}
+}
+
+func TestAuthorizeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		body    string
+		wantErr string
+	}{
+		{name: "server error", status: http.StatusInternalServerError, body: `{"allow":true}`, wantErr: "HTTP 500"},
+		{name: "invalid JSON", status: http.StatusOK, body: `allow`, wantErr: "failed to decode"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _, _, _ := mockAuthorizer(t, tt.status, tt.body)
+			c := New(config.ExternalAuthorizerConfig{URL: srv.URL, Timeout: 5})
+
+			_, err := c.Authorize(context.Background(), &Request{})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAuthorizeTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	c := New(config.ExternalAuthorizerConfig{URL: srv.URL, Timeout: 1})
+	start := time.Now()
+	if _, err := c.Authorize(context.Background(), &Request{}); err == nil {
+		t.Fatal("expected timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Authorize took %v, want about 1s", elapsed)
+	}
+}
+
+func TestDecide(t *testing.T) {
+	builtinDenied := errors.New("user does not have required role")
+
+	tests := []struct {
+		name       string
+		status     int
+		body       string
+		mode       string
+		failOpen   bool
+		builtinErr error
+		wantErr    string // empty means allowed
+		wantCalled bool
+	}{
+		{
+			name:       "augment allow",
+			status:     http.StatusOK,
+			body:       `{"allow":true}`,
+			wantCalled: true,
+		},
+		{
+			name:       "augment deny with reason",
+			status:     http.StatusOK,
+			body:       `{"allow":false,"reason":"Device not compliant"}`,
+			wantErr:    "Device not compliant",
+			wantCalled: true,
+		},
+		{
+			name:       "augment deny without reason",
+			status:     http.StatusOK,
+			body:       `{"allow":false}`,
+			wantErr:    DefaultDenyReason,
+			wantCalled: true,
+		},
+		{
+			name:       "augment skips authorizer when built-in checks fail",
+			status:     http.StatusOK,
+			body:       `{"allow":true}`,
+			builtinErr: builtinDenied,
+			wantErr:    builtinDenied.Error(),
+		},
+		{
+			name:       "override allow despite built-in deny",
+			status:     http.StatusOK,
+			body:       `{"allow":true}`,
+			mode:       config.AuthorizerModeOverride,
+			builtinErr: builtinDenied,
+			wantCalled: true,
+		},
+		{
+			name:       "override deny despite built-in allow",
+			status:     http.StatusOK,
+			body:       `{"allow":false,"reason":"Account under review"}`,
+			mode:       config.AuthorizerModeOverride,
+			wantErr:    "Account under review",
+			wantCalled: true,
+		},
+		{
+			name:       "fail closed",
+			status:     http.StatusServiceUnavailable,
+			wantErr:    unavailableReason,
+			wantCalled: true,
+		},
+		{
+			name:       "fail open falls back to built-in allow",
+			status:     http.StatusServiceUnavailable,
+			failOpen:   true,
+			wantCalled: true,
+		},
+		{
+			name:       "fail open falls back to built-in deny",
+			status:     http.StatusServiceUnavailable,
+			mode:       config.AuthorizerModeOverride,
+			failOpen:   true,
+			builtinErr: builtinDenied,
+			wantErr:    builtinDenied.Error(),
+			wantCalled: true,
+		},
+		{
+			name:       "deny reason is sanitized",
+			status:     http.StatusOK,
+			body:       `{"allow":false,"reason":"line1\nline2"}`,
+			wantErr:    "line1_line2",
+			wantCalled: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, got, _, calls := mockAuthorizer(t, tt.status, tt.body)
+			c := New(config.ExternalAuthorizerConfig{
+				URL:      srv.URL,
+				Timeout:  5,
+				Mode:     tt.mode,
+				FailOpen: tt.failOpen,
+			})
+
+			err := c.Decide(context.Background(), &Request{SessionID: "abc"}, tt.builtinErr)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Decide() = %v, want allow", err)
+			}
+			if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Errorf("Decide() = %v, want %q", err, tt.wantErr)
+			}
+			if called := calls.Load() > 0; called != tt.wantCalled {
+				t.Errorf("authorizer called = %v, want %v", called, tt.wantCalled)
+			}
+			if tt.wantCalled && got.Builtin.Allowed != (tt.builtinErr == nil) {
+				t.Errorf("builtin.allowed = %v, want %v", got.Builtin.Allowed, tt.builtinErr == nil)
+			}
+		})
+	}
+}
@@ -2,10 +2,17 @@
 package config
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log/slog"
+	"log/syslog"
+	"math"
 	"os"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
 	"strings"
 
 	"gopkg.in/yaml.v3"
@@ -13,29 +20,294 @@ import (
 
 // Config represents the complete application configuration
 type Config struct {
-	Listen ListenConfig `yaml:"listen"`
-	OIDC   OIDCConfig   `yaml:"oidc"`
-	Auth   AuthConfig   `yaml:"auth"`
-	TLS    TLSConfig    `yaml:"tls"`
-	Log    LogConfig    `yaml:"log"`
+	Listen        ListenConfig        `yaml:"listen"`
+	OIDC          OIDCConfig          `yaml:"oidc"`
+	Auth          AuthConfig          `yaml:"auth"`
+	TLS           TLSConfig           `yaml:"tls"`
+	Log           LogConfig           `yaml:"log"`
+	HTTPServer    HTTPServerConfig    `yaml:"httpserver"`
+	Observability ObservabilityConfig `yaml:"observability"`
+	Audit         AuditConfig         `yaml:"audit"`
+	Systemd       SystemdConfig       `yaml:"systemd"`
+	Health        HealthConfig        `yaml:"health"`
+	Session       SessionConfig       `yaml:"session"`
+	Shutdown      ShutdownConfig      `yaml:"shutdown"`
+	Daemon        DaemonConfig        `yaml:"daemon"`
 }
 
 // ListenConfig defines where the daemon listens for requests
 type ListenConfig struct {
 	HTTP   string `yaml:"http"`   // HTTP server address (e.g., ":9000")
 	Socket string `yaml:"socket"` // Unix socket path
+	// HTTPSocket serves the HTTP server on a Unix socket instead of a TCP
+	// address, for a reverse proxy on the same host (mutually exclusive
+	// with HTTP)
+	HTTPSocket string `yaml:"http_socket"`
+	// TrustedProxies lists reverse proxy CIDRs whose X-Forwarded-For and
+	// X-Real-IP headers are trusted for the client IP (empty trusts none)
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	// AllowedCIDRs restricts the HTTP server to clients (as determined
+	// with TrustedProxies) in these CIDRs; others get 403 (empty allows all)
+	AllowedCIDRs []string `yaml:"allowed_cidrs"`
+	// HealthAllowedCIDRs restricts /health and /readyz separately, which
+	// AllowedCIDRs does not cover (empty allows all)
+	HealthAllowedCIDRs []string `yaml:"health_allowed_cidrs"`
+	// StrictVersionMatch rejects IPC requests from an auth binary whose
+	// release version differs from the daemon's, instead of only logging
+	// a warning
+	StrictVersionMatch bool `yaml:"strict_version_match"`
+	// SocketAllowedUIDs restricts IPC connections to processes running as
+	// these users, checked via SO_PEERCRED, in addition to the socket's
+	// permissions. Root and the daemon's own user are always allowed
+	// (empty allows everyone who can open the socket). Linux only.
+	SocketAllowedUIDs []int `yaml:"socket_allowed_uids"`
+	// MaxIPCRequestBytes is the largest IPC request the daemon reads;
+	// larger requests are rejected (0 uses the default)
+	MaxIPCRequestBytes int `yaml:"max_ipc_request_bytes"`
+	// IPCTimeout (seconds) is how long an IPC client has to send its
+	// request, and the daemon to write the response (0 uses the default)
+	IPCTimeout int `yaml:"ipc_timeout"`
+	// RateLimit tunes the per-IP rate limiter of the HTTP server
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
 }
 
+// RateLimitConfig defines the per-IP rate limit of the HTTP server. Zero
+// values use the defaults (10 requests/s, burst 50, 300s TTL, 10000 IPs).
+type RateLimitConfig struct {
+	Rate  float64 `yaml:"rate"`  // Sustained requests per second per IP
+	Burst int     `yaml:"burst"` // Requests an idle IP may send at once
+	// TTL (seconds) is how long an IP's limiter is kept after its last
+	// request
+	TTL     int `yaml:"ttl"`
+	MaxSize int `yaml:"max_size"` // Maximum number of tracked IPs
+	// Routes overrides the limit for requests to a path ("/callback") or
+	// a path prefix ending in "/" ("/auth/"). Each route has its own
+	// buckets, separate from the default limit.
+	Routes map[string]RouteRateLimitConfig `yaml:"routes"`
+}
+
+// RouteRateLimitConfig overrides the rate limit for one route. Zero values
+// inherit listen.rate_limit.
+type RouteRateLimitConfig struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+	// PerSession keys the limit by the pending login named in the
+	// request's state instead of the client IP, so users behind one NAT
+	// address do not share a bucket. Requests whose state matches no
+	// pending login are keyed by IP. Only for /auth/ and /callback.
+	PerSession bool `yaml:"per_session"`
+}
+
+// RateLimitPerSessionRoutes are the routes that carry a login state and so
+// support listen.rate_limit.routes.<route>.per_session.
+var RateLimitPerSessionRoutes = []string{"/auth/", "/callback"}
+
 // OIDCConfig defines OIDC/OAuth2 settings for Keycloak
 type OIDCConfig struct {
-	Issuer            string   `yaml:"issuer"`                 // Keycloak issuer URL
-	ClientID          string   `yaml:"client_id"`              // OIDC client ID
-	ClientSecret      string   `yaml:"client_secret" json:"-"` // OIDC client secret (empty for public clients)
-	RedirectURI       string   `yaml:"redirect_uri"`           // Callback URL
-	Scopes            []string `yaml:"scopes"`                 // OIDC scopes
-	RequiredRoles     []string `yaml:"required_roles"`         // Required roles for VPN access
-	RoleClaim         string   `yaml:"role_claim"`             // JSON path to roles in token
-	JWKSCacheDuration int      `yaml:"jwks_cache_duration"`    // JWKS cache duration in seconds
+	Issuer             string   `yaml:"issuer"`                 // Keycloak issuer URL
+	ClientID           string   `yaml:"client_id"`              // OIDC client ID
+	ClientSecret       string   `yaml:"client_secret" json:"-"` // OIDC client secret (empty for public clients)
+	ClientSecretFile   string   `yaml:"client_secret_file"`     // File containing the client secret (alternative to client_secret)
+	RedirectURI        string   `yaml:"redirect_uri"`           // Callback URL
+	Scopes             []string `yaml:"scopes"`                 // OIDC scopes
+	RequiredRoles      []string `yaml:"required_roles"`         // Required roles for VPN access
+	DeniedRoles        []string `yaml:"denied_roles"`           // Roles that block VPN access
+	RoleClaim          string   `yaml:"role_claim"`             // JSON path to roles in token
+	RoleClaimFallbacks []string `yaml:"role_claim_fallbacks"`   // Role claim paths tried when role_claim is absent
+	RoleClaimAggregate bool     `yaml:"role_claim_aggregate"`   // Union roles from all paths instead of first match
+	RoleClaims         []string `yaml:"role_claims"`            // Role claim paths whose roles are combined; folded into the three fields above on load
+	RequiredGroups     []string `yaml:"required_groups"`        // Required groups for VPN access (e.g. "/vpn/users")
+	GroupClaim         string   `yaml:"group_claim"`            // JSON path to groups in token
+	MatchSubgroups     bool     `yaml:"match_subgroups"`        // Let subgroup members satisfy a required parent group
+	JWKSCacheDuration  int      `yaml:"jwks_cache_duration"`    // JWKS cache duration in seconds
+	// ClientAuthMethod is how the client authenticates at the token
+	// endpoint (see the ClientAuthMethod constants); empty sends
+	// client_secret the way the token endpoint accepts it
+	ClientAuthMethod string `yaml:"client_auth_method"`
+	// ClientAssertionKeyFile is the PEM private key (RSA or EC) that signs
+	// the client assertion for private_key_jwt
+	ClientAssertionKeyFile string `yaml:"client_assertion_key_file"`
+	// ClientAssertionKeyID is sent as the kid header of the client
+	// assertion, for Keycloak clients that look up keys in a JWKS
+	ClientAssertionKeyID string `yaml:"client_assertion_key_id"`
+	// DiscoveryRetries is how often startup discovery is retried while an
+	// issuer is unreachable; 0 fails on the first error
+	DiscoveryRetries int `yaml:"discovery_retries"`
+	// DiscoveryBackoff is the wait before the first retry in seconds; it
+	// doubles with every further retry
+	DiscoveryBackoff int `yaml:"discovery_backoff"`
+	// DiscoveryRefreshInterval is how often, in seconds, the discovery
+	// document is fetched again to pick up changed endpoints; 0 disables it
+	DiscoveryRefreshInterval int `yaml:"discovery_refresh_interval"`
+	// ClockSkew, in seconds, is how far the issuer's clock may be off from
+	// ours when checking the ID token's exp and iat
+	ClockSkew int `yaml:"clock_skew"`
+	// TokenExchangeTimeout, in seconds, bounds the token exchange at the
+	// callback, including ID token verification and UserInfo; 0 disables it
+	TokenExchangeTimeout int `yaml:"token_exchange_timeout"`
+	// TokenExchangeRetries is how often a token request failing with a
+	// 502, 503, 504 or a network error is repeated; 0 disables retries
+	TokenExchangeRetries int `yaml:"token_exchange_retries"`
+
+	// FetchUserInfo calls the issuer's UserInfo endpoint after the token
+	// exchange and adds its claims to those of the tokens, for client
+	// scopes that expose roles or groups only there
+	FetchUserInfo bool `yaml:"fetch_userinfo"`
+
+	// MergeAccessTokenClaims copies MergeClaims from a JWT access token
+	// into the ID token's claims when the ID token lacks them (default
+	// true). Disable it when the ID token's claims are authoritative.
+	MergeAccessTokenClaims *bool `yaml:"merge_access_token_claims"`
+	// MergeClaims are the claims copied from the access token (default
+	// DefaultMergeClaims)
+	MergeClaims []string `yaml:"merge_claims"`
+
+	// MaxAge, in seconds, is sent as the max_age authorization parameter
+	// and the ID token's auth_time must be at most this old, so users
+	// re-authenticate instead of riding an old SSO session. 0 disables it.
+	MaxAge int `yaml:"max_age"`
+	// AuthTimeMode decides what happens to tokens without auth_time when
+	// MaxAge is set: "strict" (default) rejects them, "lenient" accepts them.
+	AuthTimeMode string `yaml:"auth_time_mode"`
+
+	// ACRValues are sent as the acr_values authorization parameter to
+	// request an authentication context, e.g. a step with a one-time code
+	ACRValues []string `yaml:"acr_values"`
+	// RequiredACR lists the acceptable values of the ID token's acr claim.
+	// A token whose amr claim lists one of them is accepted as well. Empty
+	// disables the check.
+	RequiredACR []string `yaml:"required_acr"`
+
+	// InstanceRequiredRoles maps an OpenVPN server instance (the name of
+	// its config file without extension, e.g. "server-a" for
+	// /etc/openvpn/server/server-a.conf) to roles of which the user must
+	// have at least one to connect to that instance, in addition to
+	// required_roles. Instances without an entry only use required_roles.
+	InstanceRequiredRoles map[string][]string `yaml:"instance_required_roles"`
+
+	// StateSecret signs the OIDC state as "<instance_id>.<nonce>.<hmac>",
+	// so a fronting proxy can route callbacks back to the instance that
+	// started the flow and tampered states are rejected. Empty uses plain
+	// random states.
+	StateSecret string `yaml:"state_secret" json:"-"`
+	// InstanceID identifies this daemon in signed states (default: the
+	// short host name).
+	InstanceID string `yaml:"instance_id"`
+
+	// AdminAPI enables startup checks against the Keycloak admin REST API.
+	AdminAPI AdminAPIConfig `yaml:"admin_api"`
+
+	// Providers are additional issuers/realms selected per connection.
+	// The settings above form the default provider, used when no entry matches.
+	Providers []OIDCProviderConfig `yaml:"providers"`
+}
+
+// AdminAPIConfig defines credentials for the Keycloak admin REST API.
+// The client must have a service account with the realm-management
+// "view-realm" and "view-clients" roles.
+type AdminAPIConfig struct {
+	Enabled      bool   `yaml:"enabled"`                // Check required_roles exist at startup
+	ClientID     string `yaml:"client_id"`              // Service account client ID
+	ClientSecret string `yaml:"client_secret" json:"-"` // Service account client secret
+}
+
+// DefaultOIDCProvider is the name of the provider built from the top-level
+// oidc settings.
+const DefaultOIDCProvider = "default"
+
+// OIDCProviderConfig defines an additional OIDC issuer and the connections
+// routed to it. Empty fields inherit the top-level oidc settings.
+type OIDCProviderConfig struct {
+	Name             string   `yaml:"name"`                   // Unique provider name (used in logs)
+	CommonNameSuffix string   `yaml:"common_name_suffix"`     // Match clients whose certificate CN ends with this
+	UsernamePrefix   string   `yaml:"username_prefix"`        // Match clients whose username starts with this
+	Issuer           string   `yaml:"issuer"`                 // Keycloak issuer URL
+	ClientID         string   `yaml:"client_id"`              // OIDC client ID
+	ClientSecret     string   `yaml:"client_secret" json:"-"` // OIDC client secret
+	RequiredRoles    []string `yaml:"required_roles"`         // Required roles for VPN access
+	RoleClaim        string   `yaml:"role_claim"`             // JSON path to roles in token
+	RequiredGroups   []string `yaml:"required_groups"`        // Required groups for VPN access
+}
+
+// Matches reports whether a connection should use this provider.
+// All configured criteria must match.
+func (p *OIDCProviderConfig) Matches(username, commonName string) bool {
+	if p.CommonNameSuffix == "" && p.UsernamePrefix == "" {
+		return false
+	}
+	if p.CommonNameSuffix != "" && !strings.HasSuffix(commonName, p.CommonNameSuffix) {
+		return false
+	}
+	if p.UsernamePrefix != "" && !strings.HasPrefix(username, p.UsernamePrefix) {
+		return false
+	}
+	return true
+}
+
+// DefaultMergeClaims are the access token claims merged by default: where
+// Keycloak puts realm and client roles and, with a group mapper, groups.
+var DefaultMergeClaims = []string{"resource_access", "realm_access", "groups"}
+
+// AccessTokenMergeClaims returns the claims to merge from the access token:
+// merge_claims, or DefaultMergeClaims if unset, and none when
+// merge_access_token_claims is false.
+func (c *OIDCConfig) AccessTokenMergeClaims() []string {
+	if c.MergeAccessTokenClaims != nil && !*c.MergeAccessTokenClaims {
+		return nil
+	}
+	if len(c.MergeClaims) > 0 {
+		return slices.Clone(c.MergeClaims)
+	}
+	return slices.Clone(DefaultMergeClaims)
+}
+
+// normalizeRoleClaims folds role_claims into the settings the validator
+// reads: the first path becomes role_claim, the others role_claim_fallbacks,
+// and role_claim_aggregate combines their roles. RoleClaims is kept, so a
+// provider's role_claim can replace all of the paths (see ForProvider) and
+// diagnostics can name the setting.
+func (c *OIDCConfig) normalizeRoleClaims() {
+	if len(c.RoleClaims) == 0 {
+		return
+	}
+	c.RoleClaim = c.RoleClaims[0]
+	c.RoleClaimFallbacks = slices.Clone(c.RoleClaims[1:])
+	c.RoleClaimAggregate = true
+}
+
+// ForProvider returns the effective OIDC settings for p: the top-level
+// settings with p's non-empty fields applied.
+func (c *OIDCConfig) ForProvider(p OIDCProviderConfig) OIDCConfig {
+	merged := *c
+	merged.Providers = nil
+
+	if p.Issuer != "" {
+		merged.Issuer = p.Issuer
+	}
+	if p.ClientID != "" {
+		merged.ClientID = p.ClientID
+	}
+	if p.ClientSecret != "" {
+		merged.ClientSecret = p.ClientSecret
+	}
+	if p.RequiredRoles != nil {
+		merged.RequiredRoles = p.RequiredRoles
+	}
+	if p.RoleClaim != "" {
+		merged.RoleClaim = p.RoleClaim
+		// A provider's single path replaces the inherited role_claims,
+		// which were folded into the fallbacks
+		if len(merged.RoleClaims) > 0 {
+			merged.RoleClaims = nil
+			merged.RoleClaimFallbacks = nil
+			merged.RoleClaimAggregate = false
+		}
+	}
+	if p.RequiredGroups != nil {
+		merged.RequiredGroups = p.RequiredGroups
+	}
+
+	return merged
 }
 
 // AuthConfig defines authentication behavior
@@ -43,23 +315,342 @@ type AuthConfig struct {
 	SessionTimeout        int    `yaml:"session_timeout"`         // Session timeout in seconds
 	UsernameClaim         string `yaml:"username_claim"`          // Claim to use as username
 	AllowUsernameMismatch bool   `yaml:"allow_username_mismatch"` // Allow any authenticated user
+	// CaseInsensitive ignores case when comparing the username and roles,
+	// for identity providers that normalize usernames to lowercase.
+	CaseInsensitive bool `yaml:"case_insensitive"`
+	// UsernameTransform rewrites usernames before the username match.
+	// Ignored when AllowUsernameMismatch is true.
+	UsernameTransform UsernameTransformConfig `yaml:"username_transform"`
+	// UsernameSource selects the expected username: the username OpenVPN
+	// passes, the client certificate common name, or the common name only
+	// when no username was passed ("auto").
+	UsernameSource string `yaml:"username_source"`
+	// RequireCNMatch rejects logins whose client certificate common name
+	// differs from the CNClaim value of the token. Independent of the
+	// username match.
+	RequireCNMatch bool `yaml:"require_cn_match"`
+	// CNClaim is the claim compared with the common name. Empty means
+	// UsernameClaim.
+	CNClaim string `yaml:"cn_claim"`
+	// AuthzMode combines required_roles and required_groups when both are
+	// set: "and" requires both, "or" requires either.
+	AuthzMode string `yaml:"authz_mode"`
+	// AcceptAuthToken lets the auth script accept a valid auth-gen-token
+	// (session_state=Authenticated) without starting a new SSO flow.
+	AcceptAuthToken bool `yaml:"accept_auth_token"`
+	// EnableCRText allows clients that only support crtext (IV_SSO=crtext)
+	// to authenticate by entering a one-time code at the daemon's /code page.
+	EnableCRText bool `yaml:"enable_crtext"`
+	// PreserveExistingResult refuses to overwrite a "0"/"1" already present
+	// in auth_control_file (e.g. written by another script in a chain).
+	PreserveExistingResult bool `yaml:"preserve_existing_result"`
+	// RejectInvalidIP fails auth requests whose untrusted_ip is not a valid
+	// IP address. When false such values are only logged.
+	RejectInvalidIP bool `yaml:"reject_invalid_ip"`
+	// ContextClaims lists claim paths (e.g. "department") whose values are
+	// included in the authentication success log and the audit records to
+	// help helpdesk triage.
+	ContextClaims []string `yaml:"context_claims"`
+	// MaxSessionsPerUser caps the concurrent pending sessions per username
+	// so a reconnecting client cannot pile up logins. 0 means unlimited.
+	MaxSessionsPerUser int `yaml:"max_sessions_per_user"`
+	// SingleIPPerUser rejects an auth request while the same username has
+	// a pending login from a different source IP (credential sharing).
+	SingleIPPerUser bool `yaml:"single_ip_per_user"`
+	// SingleIPMessage is the failure reason shown to rejected clients.
+	SingleIPMessage string `yaml:"single_ip_message"`
+	// SingleIPGracePeriod (seconds) lets a new login from another IP
+	// supersede a pending login at least this old, e.g. after the client
+	// roamed to another network. 0 never supersedes.
+	SingleIPGracePeriod int `yaml:"single_ip_grace_period"`
+	// RejectReusedCodes remembers authorization codes presented to
+	// /callback and rejects a second use with a specific message instead
+	// of a generic token exchange error.
+	RejectReusedCodes bool `yaml:"reject_reused_codes"`
+	// CorrelationCode shows a short per-session code in the crtext
+	// challenge and on the success page, so users with several pending
+	// logins can tell which browser tab belongs to which connection.
+	CorrelationCode bool `yaml:"correlation_code"`
+	// ExternalAuthorizer sends the validated claims and connection context
+	// to a policy service (e.g. OPA) for an allow/deny decision.
+	ExternalAuthorizer ExternalAuthorizerConfig `yaml:"external_authorizer"`
+}
+
+// Modes for auth.external_authorizer.mode.
+const (
+	AuthorizerModeAugment  = "augment"
+	AuthorizerModeOverride = "override"
+)
+
+// ExternalAuthorizerConfig defines the external authorization endpoint
+// consulted after token validation.
+type ExternalAuthorizerConfig struct {
+	URL     string `yaml:"url"`     // Decision endpoint (HTTP POST, JSON); empty disables
+	Timeout int    `yaml:"timeout"` // Request timeout in seconds
+	// Mode is "augment" (the built-in role/group checks and the
+	// authorizer must both allow) or "override" (the authorizer's
+	// decision replaces the built-in checks)
+	Mode string `yaml:"mode"`
+	// FailOpen uses the built-in checks alone when the authorizer cannot
+	// be reached or answers with an error; otherwise the login is denied
+	FailOpen    bool   `yaml:"fail_open"`
+	BearerToken string `yaml:"bearer_token" json:"-"` // Sent as "Authorization: Bearer <token>" (optional)
+}
+
+// DefaultClockSkew is the default of oidc.clock_skew, in seconds, and
+// MaxClockSkew its upper bound.
+const (
+	DefaultClockSkew = 30
+	MaxClockSkew     = 300
+)
+
+// DefaultMaxIPCRequestBytes is the default of listen.max_ipc_request_bytes.
+const DefaultMaxIPCRequestBytes = 64 * 1024
+
+// DefaultIPCTimeout is the default of listen.ipc_timeout, in seconds.
+const DefaultIPCTimeout = 5
+
+// DefaultTokenExchangeTimeout is the default of oidc.token_exchange_timeout,
+// in seconds.
+const DefaultTokenExchangeTimeout = 10
+
+// Values for oidc.client_auth_method.
+const (
+	ClientAuthMethodSecretBasic   = "client_secret_basic"
+	ClientAuthMethodSecretPost    = "client_secret_post"
+	ClientAuthMethodSecretJWT     = "client_secret_jwt"
+	ClientAuthMethodPrivateKeyJWT = "private_key_jwt"
+)
+
+// Values for oidc.auth_time_mode.
+const (
+	AuthTimeModeStrict  = "strict"
+	AuthTimeModeLenient = "lenient"
+)
+
+// Targets for auth.username_transform.apply_to.
+const (
+	UsernameTransformClaim    = "claim"
+	UsernameTransformExpected = "expected"
+	UsernameTransformBoth     = "both"
+)
+
+// UsernameTransformConfig defines a regex rewrite applied before comparing
+// the token's username claim with the OpenVPN username.
+type UsernameTransformConfig struct {
+	Match   string `yaml:"match"`    // Regular expression (RE2 syntax); empty disables the transform
+	Replace string `yaml:"replace"`  // Replacement, may reference groups ($1, ${name})
+	ApplyTo string `yaml:"apply_to"` // claim (default), expected, or both
 }
 
+// Values for auth.username_source.
+const (
+	UsernameSourceUsername   = "username"
+	UsernameSourceCommonName = "common_name"
+	UsernameSourceAuto       = "auto"
+)
+
+// Authorization modes for auth.authz_mode.
+const (
+	AuthzModeAnd = "and"
+	AuthzModeOr  = "or"
+)
+
 // TLSConfig defines TLS settings for the HTTP server
 type TLSConfig struct {
-	Enabled  bool   `yaml:"enabled"`
-	CertFile string `yaml:"cert_file"`
-	KeyFile  string `yaml:"key_file"`
+	Enabled        bool   `yaml:"enabled"`
+	CertFile       string `yaml:"cert_file"`
+	KeyFile        string `yaml:"key_file"`
+	ReloadInterval int    `yaml:"reload_interval"` // Poll cert/key for changes every N seconds (0 = only on SIGHUP)
+	// Watch polls cert/key for changes, e.g. when renewed by cert-manager
+	// or certbot, every ReloadInterval seconds or every 30 seconds when
+	// ReloadInterval is 0
+	Watch bool `yaml:"watch"`
+	// MinVersion is the oldest TLS version accepted: "1.2" (default) or
+	// "1.3"
+	MinVersion string `yaml:"min_version"`
+	// CipherSuites restricts the TLS 1.2 cipher suites, by crypto/tls name
+	// (empty = built-in list of ECDHE AEAD suites)
+	CipherSuites []string `yaml:"cipher_suites"`
+	// ACME obtains and renews the certificate automatically instead of
+	// reading CertFile and KeyFile
+	ACME ACMEConfig `yaml:"acme"`
+}
+
+// ACMEConfig defines automatic certificate management via an ACME CA such
+// as Let's Encrypt
+type ACMEConfig struct {
+	Enabled  bool     `yaml:"enabled"`
+	Domains  []string `yaml:"domains"`   // Host names to obtain certificates for
+	CacheDir string   `yaml:"cache_dir"` // Directory for the account key and certificates
+	Email    string   `yaml:"email"`     // Contact address for expiry notices (optional)
+	// DirectoryURL is the CA's ACME directory (empty = Let's Encrypt
+	// production), e.g. the Let's Encrypt staging directory for testing
+	DirectoryURL string `yaml:"directory_url"`
+	// HTTPChallengeAddr is where HTTP-01 challenges are answered; the CA
+	// always connects to port 80
+	HTTPChallengeAddr string `yaml:"http_challenge_addr"`
+}
+
+// HTTPServerConfig defines optional features of the HTTP callback server
+type HTTPServerConfig struct {
+	EnableAuthAPI bool `yaml:"enable_auth_api"` // Expose POST /api/auth/start for embedded browsers
+	// EnableConfigAPI exposes GET /api/config, the non-sensitive effective
+	// SSO settings for client provisioning tools. Requires ConfigAPIToken.
+	EnableConfigAPI bool   `yaml:"enable_config_api"`
+	ConfigAPIToken  string `yaml:"config_api_token" json:"-"` // Bearer token for GET /api/config
+	// FailureReputation tightens the per-IP rate limit for addresses with
+	// repeated authentication failures
+	FailureReputation FailureReputationConfig `yaml:"failure_reputation"`
+	// TemplatesDir holds page templates (success.html, error.html,
+	// code.html, branding.html) that replace the embedded ones; missing
+	// files fall back to the embedded template
+	TemplatesDir string `yaml:"templates_dir"`
+	// Branding is passed to the page templates
+	Branding BrandingConfig `yaml:"branding"`
+	// DefaultLanguage is the language of the browser pages when the
+	// browser's Accept-Language matches none of PageLanguages
+	DefaultLanguage string `yaml:"default_language"`
+	// SuccessRedirectURL is an HTTP(S) URL the success page redirects to
+	// after a short delay, such as a company portal
+	SuccessRedirectURL string `yaml:"success_redirect_url"`
+	// SuccessAutoClose makes the success page try to close its window
+	// after a short delay
+	SuccessAutoClose bool `yaml:"success_autoclose"`
+}
+
+// DefaultPageLanguage is the default of httpserver.default_language.
+const DefaultPageLanguage = "en"
+
+// PageLanguages are the languages the browser pages are translated into.
+var PageLanguages = []string{"en", "de", "es", "fr"}
+
+// BrandingConfig customizes the success, error and code pages.
+type BrandingConfig struct {
+	CompanyName  string `yaml:"company_name"`  // Shown in page titles and the logo's alt text
+	LogoURL      string `yaml:"logo_url"`      // HTTP(S) URL of a logo shown above each page
+	SupportEmail string `yaml:"support_email"` // Contact shown on the error and code pages
+}
+
+// FailureReputationConfig defines how failed logins tighten the per-IP rate
+// limit. Once an IP has Threshold failures within Window, its limit shrinks
+// with every further failure; it relaxes again as failures age out.
+type FailureReputationConfig struct {
+	Enabled   bool `yaml:"enabled"`
+	Threshold int  `yaml:"threshold"` // Failures within Window before the limit is tightened
+	Window    int  `yaml:"window"`    // Seconds a failure counts against an IP
+}
+
+// Metrics backends for observability.metrics_backend.
+const (
+	MetricsBackendPrometheus = "prometheus"
+	MetricsBackendBuiltin    = "builtin"
+)
+
+// ObservabilityConfig defines monitoring endpoints
+type ObservabilityConfig struct {
+	Metrics            bool `yaml:"metrics"`              // Expose Prometheus metrics at /metrics
+	MetricsRateLimited bool `yaml:"metrics_rate_limited"` // Apply the per-IP rate limiter to /metrics
+
+	// MetricsBackend is "prometheus" (default; the Prometheus client
+	// library) or "builtin" (a lightweight OpenMetrics text encoder over
+	// atomic counters). Both expose the same metrics.
+	MetricsBackend string `yaml:"metrics_backend"`
+}
+
+// AuditConfig defines the authentication audit trail
+type AuditConfig struct {
+	File string `yaml:"file"` // JSON-lines audit file (empty disables auditing)
+}
+
+// SystemdConfig defines integration with the systemd service manager
+type SystemdConfig struct {
+	Notify bool `yaml:"notify"` // Send sd_notify READY=1 and watchdog pings (for Type=notify units)
+}
+
+// Session stores for session.store.
+const (
+	SessionStoreMemory = "memory"
+	SessionStoreFile   = "file"
+	SessionStoreRedis  = "redis"
+)
+
+// SessionConfig defines where pending authentication sessions are kept
+type SessionConfig struct {
+	// Store is "memory" (default; sessions are lost on restart), "file"
+	// (sessions are saved to File and reloaded on startup) or "redis"
+	// (sessions are shared by all daemon instances using the same Redis).
+	Store string             `yaml:"store"`
+	File  string             `yaml:"file"`  // Session file for the file store (mode 0600)
+	Redis SessionRedisConfig `yaml:"redis"` // Redis server for the redis store
+	// CleanupInterval is how often, in seconds, expired sessions are
+	// removed and their timeout failure written; 0 uses half of
+	// auth.session_timeout, at most 60 seconds
+	CleanupInterval int `yaml:"cleanup_interval"`
+}
+
+// SessionRedisConfig defines the Redis server used by the redis session store
+type SessionRedisConfig struct {
+	Addr     string `yaml:"addr"`              // host:port of the Redis server
+	Password string `yaml:"password" json:"-"` // Redis AUTH password (optional)
+	DB       int    `yaml:"db"`                // Redis database number
+}
+
+// HealthConfig defines internal health checking
+type HealthConfig struct {
+	// WatchdogSelftest runs an OIDC discovery/JWKS and session self-test
+	// before each systemd watchdog ping and skips the ping on failure, so
+	// systemd restarts a daemon whose core auth path is broken.
+	WatchdogSelftest bool `yaml:"watchdog_selftest"`
+}
+
+// ShutdownConfig defines how the daemon shuts down
+type ShutdownConfig struct {
+	// DrainTimeout is how long, in seconds, the HTTP server keeps running
+	// after the IPC server has stopped, so callbacks already in flight can
+	// complete (0 shuts down immediately)
+	DrainTimeout int `yaml:"drain_timeout"`
+}
+
+// DaemonConfig defines general daemon behavior
+type DaemonConfig struct {
+	// DryRun runs the full OIDC flow and authorization checks but only logs
+	// what would be written to the OpenVPN control files, e.g. for testing
+	// against a real Keycloak in staging. Clients are never connected.
+	DryRun bool `yaml:"dry_run"`
+	// SnapshotFile is where SIGUSR2 writes a JSON diagnostic snapshot
+	// (sessions, metrics, config hash, IdP health); empty disables it
+	SnapshotFile string `yaml:"snapshot_file"`
 }
 
 // LogConfig defines logging settings
 type LogConfig struct {
-	Level  string `yaml:"level"`  // debug, info, warn, error
-	Format string `yaml:"format"` // json, text
+	Level  string       `yaml:"level"`  // debug, info, warn, error
+	Format string       `yaml:"format"` // json, text, syslog
+	Syslog SyslogConfig `yaml:"syslog"` // Used when format is syslog
 }
 
-// Load reads and parses the configuration file
+// SyslogConfig defines how logs are sent to the local syslog daemon
+type SyslogConfig struct {
+	Facility string `yaml:"facility"` // e.g. daemon, auth, local0
+	Tag      string `yaml:"tag"`      // Program name in syslog messages
+}
+
+// ProfileEnvVar selects a config profile when no profile is passed explicitly.
+const ProfileEnvVar = "OVPN_SSO_PROFILE"
+
+// Load reads and parses the configuration file.
+// The profile named by OVPN_SSO_PROFILE, if set, is applied (see LoadProfile).
 func Load(path string) (*Config, error) {
+	return LoadProfile(path, os.Getenv(ProfileEnvVar))
+}
+
+// LoadProfile reads and parses the configuration file and overlays the named
+// entry of its top-level "profiles" map onto the base settings. Fields set in
+// the profile replace the base values (lists are replaced, not merged);
+// environment variable overrides are applied afterwards. An empty profile
+// uses the base settings only.
+func LoadProfile(path, profile string) (*Config, error) {
 	// Canonicalize the path (resolves ".." components and redundant separators).
 	// The path originates from a trusted source (CLI flag / systemd unit), so
 	// G304 (file inclusion via variable) is not a concern here.
@@ -77,6 +668,18 @@ func Load(path string) (*Config, error) {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
 
+	// Overlay the selected profile
+	if profile != "" {
+		if err := applyProfile(cfg, data, profile); err != nil {
+			return nil, err
+		}
+	}
+
+	// Resolve secrets stored in separate files
+	if err := cfg.loadSecretFiles(); err != nil {
+		return nil, err
+	}
+
 	// Apply environment variable overrides
 	cfg.applyEnvOverrides()
 
@@ -84,33 +687,125 @@ func Load(path string) (*Config, error) {
 	if err := cfg.Validate(); err != nil {
 		return nil, fmt.Errorf("config validation failed: %w", err)
 	}
+	cfg.OIDC.normalizeRoleClaims()
 
 	return cfg, nil
 }
 
+// loadSecretFiles reads oidc.client_secret_file into oidc.client_secret.
+// Trailing whitespace and newlines (as left by most editors and secret
+// stores) are trimmed.
+func (c *Config) loadSecretFiles() error {
+	if c.OIDC.ClientSecretFile == "" {
+		return nil
+	}
+	if c.OIDC.ClientSecret != "" {
+		return fmt.Errorf("oidc.client_secret and oidc.client_secret_file are mutually exclusive")
+	}
+
+	data, err := os.ReadFile(filepath.Clean(c.OIDC.ClientSecretFile)) // #nosec G304 -- path from trusted config file
+	if err != nil {
+		return fmt.Errorf("failed to read oidc.client_secret_file: %w", err)
+	}
+
+	secret := strings.TrimRight(string(data), " \t\r\n")
+	if secret == "" {
+		return fmt.Errorf("oidc.client_secret_file %s is empty", c.OIDC.ClientSecretFile)
+	}
+	c.OIDC.ClientSecret = secret
+	return nil
+}
+
+// applyProfile decodes the named profile from the raw config data onto cfg.
+func applyProfile(cfg *Config, data []byte, profile string) error {
+	var raw struct {
+		Profiles map[string]yaml.Node `yaml:"profiles"`
+	}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("failed to parse config file: %w", err)
+	}
+
+	node, ok := raw.Profiles[profile]
+	if !ok {
+		available := make([]string, 0, len(raw.Profiles))
+		for name := range raw.Profiles {
+			available = append(available, name)
+		}
+		sort.Strings(available)
+		return fmt.Errorf("config profile %q not found (available: %v)", profile, available)
+	}
+
+	if err := node.Decode(cfg); err != nil {
+		return fmt.Errorf("failed to parse config profile %q: %w", profile, err)
+	}
+
+	return nil
+}
+
 // DefaultConfig returns a configuration with sensible defaults
 func DefaultConfig() *Config {
 	return &Config{
 		Listen: ListenConfig{
-			HTTP:   ":9000",
-			Socket: "/run/openvpn-keycloak-auth/auth.sock",
+			HTTP:               ":9000",
+			Socket:             "/run/openvpn-keycloak-auth/auth.sock",
+			MaxIPCRequestBytes: DefaultMaxIPCRequestBytes,
+			IPCTimeout:         DefaultIPCTimeout,
 		},
 		OIDC: OIDCConfig{
 			Scopes:            []string{"openid", "profile", "email"},
 			RoleClaim:         "realm_access.roles",
+			GroupClaim:        "groups",
 			JWKSCacheDuration: 3600, // 1 hour
+			ClockSkew:         DefaultClockSkew,
+			DiscoveryRetries:  5,
+			DiscoveryBackoff:  2,
+			AuthTimeMode:      AuthTimeModeStrict,
+
+			DiscoveryRefreshInterval: 3600, // 1 hour
+			TokenExchangeTimeout:     DefaultTokenExchangeTimeout,
+			TokenExchangeRetries:     2,
 		},
 		Auth: AuthConfig{
 			SessionTimeout:        300, // 5 minutes
 			UsernameClaim:         "preferred_username",
 			AllowUsernameMismatch: false,
+			UsernameSource:        UsernameSourceUsername,
+			AuthzMode:             AuthzModeAnd,
+			ExternalAuthorizer: ExternalAuthorizerConfig{
+				Timeout: 5,
+				Mode:    AuthorizerModeAugment,
+			},
 		},
 		TLS: TLSConfig{
 			Enabled: false,
+			ACME: ACMEConfig{
+				CacheDir:          "/var/lib/openvpn-keycloak-auth/acme",
+				HTTPChallengeAddr: ":80",
+			},
 		},
 		Log: LogConfig{
 			Level:  "info",
 			Format: "json",
+			Syslog: SyslogConfig{
+				Facility: "daemon",
+				Tag:      "openvpn-keycloak-auth",
+			},
+		},
+		Session: SessionConfig{
+			Store: SessionStoreMemory,
+		},
+		HTTPServer: HTTPServerConfig{
+			DefaultLanguage: DefaultPageLanguage,
+			FailureReputation: FailureReputationConfig{
+				Threshold: 3,
+				Window:    900, // 15 minutes
+			},
+		},
+		Observability: ObservabilityConfig{
+			MetricsBackend: MetricsBackendPrometheus,
+		},
+		Shutdown: ShutdownConfig{
+			DrainTimeout: 10,
 		},
 	}
 }
@@ -130,6 +825,22 @@ func (c *Config) applyEnvOverrides() {
 	if v := os.Getenv("OVPN_SSO_OIDC_REDIRECT_URI"); v != "" {
 		c.OIDC.RedirectURI = v
 	}
+	if v := os.Getenv("OVPN_SSO_OIDC_ADMIN_CLIENT_SECRET"); v != "" {
+		c.OIDC.AdminAPI.ClientSecret = v
+	}
+	if v := os.Getenv("OVPN_SSO_OIDC_STATE_SECRET"); v != "" {
+		c.OIDC.StateSecret = v
+	}
+
+	// Auth overrides
+	if v := os.Getenv("OVPN_SSO_AUTH_EXTERNAL_AUTHORIZER_TOKEN"); v != "" {
+		c.Auth.ExternalAuthorizer.BearerToken = v
+	}
+
+	// Session overrides
+	if v := os.Getenv("OVPN_SSO_SESSION_REDIS_PASSWORD"); v != "" {
+		c.Session.Redis.Password = v
+	}
 
 	// Log overrides
 	if v := os.Getenv("OVPN_SSO_LOG_LEVEL"); v != "" {
@@ -146,6 +857,9 @@ func (c *Config) applyEnvOverrides() {
 	if v := os.Getenv("OVPN_SSO_LISTEN_SOCKET"); v != "" {
 		c.Listen.Socket = v
 	}
+	if v := os.Getenv("OVPN_SSO_LISTEN_HTTP_SOCKET"); v != "" {
+		c.Listen.HTTPSocket = v
+	}
 }
 
 // Validate checks that the configuration is valid
@@ -162,6 +876,32 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("oidc.client_id is required")
 	}
 
+	switch c.OIDC.ClientAuthMethod {
+	case "":
+	case ClientAuthMethodSecretBasic, ClientAuthMethodSecretPost:
+		if c.OIDC.ClientSecret == "" {
+			return fmt.Errorf("oidc.client_secret is required for oidc.client_auth_method %s", c.OIDC.ClientAuthMethod)
+		}
+	case ClientAuthMethodSecretJWT:
+		// HS256 needs a key at least as long as its 256-bit hash
+		if len(c.OIDC.ClientSecret) < 32 {
+			return fmt.Errorf("oidc.client_secret of at least 32 bytes is required for oidc.client_auth_method %s", c.OIDC.ClientAuthMethod)
+		}
+	case ClientAuthMethodPrivateKeyJWT:
+		if c.OIDC.ClientAssertionKeyFile == "" {
+			return fmt.Errorf("oidc.client_assertion_key_file is required for oidc.client_auth_method %s", c.OIDC.ClientAuthMethod)
+		}
+		if c.OIDC.ClientSecret != "" {
+			return fmt.Errorf("oidc.client_secret is not used with oidc.client_auth_method %s; remove it", c.OIDC.ClientAuthMethod)
+		}
+	default:
+		return fmt.Errorf("oidc.client_auth_method must be one of: client_secret_basic, client_secret_post, client_secret_jwt, private_key_jwt")
+	}
+	if c.OIDC.ClientAuthMethod != ClientAuthMethodPrivateKeyJWT &&
+		(c.OIDC.ClientAssertionKeyFile != "" || c.OIDC.ClientAssertionKeyID != "") {
+		return fmt.Errorf("oidc.client_assertion_key_file and oidc.client_assertion_key_id require oidc.client_auth_method private_key_jwt")
+	}
+
 	if c.OIDC.RedirectURI == "" {
 		return fmt.Errorf("oidc.redirect_uri is required")
 	}
@@ -183,6 +923,98 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("oidc.scopes must include 'openid'")
 	}
 
+	if err := c.OIDC.validateStateSigning(); err != nil {
+		return err
+	}
+
+	for _, path := range c.OIDC.RoleClaimFallbacks {
+		if strings.TrimSpace(path) == "" {
+			return fmt.Errorf("oidc.role_claim_fallbacks must not contain empty entries")
+		}
+	}
+	for _, path := range c.OIDC.RoleClaims {
+		if strings.TrimSpace(path) == "" {
+			return fmt.Errorf("oidc.role_claims must not contain empty entries")
+		}
+	}
+	// A loaded config already has role_claims folded into the fallbacks
+	if len(c.OIDC.RoleClaims) > 0 && len(c.OIDC.RoleClaimFallbacks) > 0 &&
+		!slices.Equal(c.OIDC.RoleClaimFallbacks, c.OIDC.RoleClaims[1:]) {
+		return fmt.Errorf("oidc.role_claims and oidc.role_claim_fallbacks cannot be combined; list all paths in role_claims")
+	}
+	for _, path := range c.Auth.ContextClaims {
+		if strings.TrimSpace(path) == "" {
+			return fmt.Errorf("auth.context_claims must not contain empty entries")
+		}
+	}
+
+	names := map[string]bool{DefaultOIDCProvider: true}
+	for i, p := range c.OIDC.Providers {
+		if p.Name == "" {
+			return fmt.Errorf("oidc.providers[%d].name is required", i)
+		}
+		if names[p.Name] {
+			return fmt.Errorf("oidc.providers[%d].name %q is reserved or duplicated", i, p.Name)
+		}
+		names[p.Name] = true
+
+		if p.CommonNameSuffix == "" && p.UsernamePrefix == "" {
+			return fmt.Errorf("oidc.providers[%d] (%s) must set common_name_suffix or username_prefix", i, p.Name)
+		}
+		if p.Issuer != "" && !strings.HasPrefix(p.Issuer, "http://") && !strings.HasPrefix(p.Issuer, "https://") {
+			return fmt.Errorf("oidc.providers[%d].issuer must be a valid HTTP(S) URL", i)
+		}
+	}
+
+	if c.OIDC.AdminAPI.Enabled && (c.OIDC.AdminAPI.ClientID == "" || c.OIDC.AdminAPI.ClientSecret == "") {
+		return fmt.Errorf("oidc.admin_api.client_id and oidc.admin_api.client_secret are required when admin_api is enabled")
+	}
+
+	if c.OIDC.JWKSCacheDuration < 0 {
+		return fmt.Errorf("oidc.jwks_cache_duration must not be negative")
+	}
+	if c.OIDC.DiscoveryRetries < 0 {
+		return fmt.Errorf("oidc.discovery_retries must not be negative")
+	}
+	if c.OIDC.DiscoveryRetries > 0 && c.OIDC.DiscoveryBackoff < 1 {
+		return fmt.Errorf("oidc.discovery_backoff must be positive when oidc.discovery_retries is set")
+	}
+	if c.OIDC.DiscoveryRefreshInterval < 0 {
+		return fmt.Errorf("oidc.discovery_refresh_interval must not be negative")
+	}
+	if c.OIDC.ClockSkew < 0 || c.OIDC.ClockSkew > MaxClockSkew {
+		return fmt.Errorf("oidc.clock_skew must be between 0 and %d seconds", MaxClockSkew)
+	}
+	if c.OIDC.TokenExchangeTimeout < 0 {
+		return fmt.Errorf("oidc.token_exchange_timeout must not be negative")
+	}
+	if c.OIDC.TokenExchangeRetries < 0 {
+		return fmt.Errorf("oidc.token_exchange_retries must not be negative")
+	}
+	if c.OIDC.MaxAge < 0 {
+		return fmt.Errorf("oidc.max_age must not be negative")
+	}
+	for i, acr := range c.OIDC.ACRValues {
+		if acr == "" || strings.ContainsAny(acr, " \t\r\n") {
+			return fmt.Errorf("oidc.acr_values[%d] must be a non-empty value without whitespace", i)
+		}
+	}
+	for i, acr := range c.OIDC.RequiredACR {
+		if strings.TrimSpace(acr) == "" {
+			return fmt.Errorf("oidc.required_acr[%d] must not be empty", i)
+		}
+	}
+	for i, claim := range c.OIDC.MergeClaims {
+		if strings.TrimSpace(claim) == "" {
+			return fmt.Errorf("oidc.merge_claims[%d] must not be empty", i)
+		}
+	}
+	switch c.OIDC.AuthTimeMode {
+	case "", AuthTimeModeStrict, AuthTimeModeLenient:
+	default:
+		return fmt.Errorf("oidc.auth_time_mode must be one of: strict, lenient")
+	}
+
 	// Validate auth config
 	if c.Auth.SessionTimeout <= 0 {
 		return fmt.Errorf("auth.session_timeout must be positive")
@@ -190,13 +1022,109 @@ func (c *Config) Validate() error {
 	if c.Auth.SessionTimeout > 3600 {
 		return fmt.Errorf("auth.session_timeout should not exceed 3600 seconds (1 hour)")
 	}
+	if c.Auth.MaxSessionsPerUser < 0 {
+		return fmt.Errorf("auth.max_sessions_per_user must not be negative")
+	}
+	if c.Auth.SingleIPGracePeriod < 0 {
+		return fmt.Errorf("auth.single_ip_grace_period must not be negative")
+	}
+	if c.Shutdown.DrainTimeout < 0 {
+		return fmt.Errorf("shutdown.drain_timeout must not be negative")
+	}
 
 	if c.Auth.UsernameClaim == "" {
 		return fmt.Errorf("auth.username_claim is required")
 	}
 
+	if t := c.Auth.UsernameTransform; t.Match != "" {
+		if _, err := regexp.Compile(t.Match); err != nil {
+			return fmt.Errorf("auth.username_transform.match is not a valid regex: %w", err)
+		}
+		switch t.ApplyTo {
+		case "", UsernameTransformClaim, UsernameTransformExpected, UsernameTransformBoth:
+		default:
+			return fmt.Errorf("auth.username_transform.apply_to must be one of: claim, expected, both")
+		}
+	}
+
+	switch c.Auth.UsernameSource {
+	case "", UsernameSourceUsername, UsernameSourceCommonName, UsernameSourceAuto:
+	default:
+		return fmt.Errorf("auth.username_source must be one of: username, common_name, auto")
+	}
+
+	switch c.Auth.AuthzMode {
+	case "", AuthzModeAnd, AuthzModeOr:
+	default:
+		return fmt.Errorf("auth.authz_mode must be one of: and, or")
+	}
+
+	if a := c.Auth.ExternalAuthorizer; a.URL != "" {
+		if !strings.HasPrefix(a.URL, "http://") && !strings.HasPrefix(a.URL, "https://") {
+			return fmt.Errorf("auth.external_authorizer.url must be a valid HTTP(S) URL")
+		}
+		if a.Timeout <= 0 {
+			return fmt.Errorf("auth.external_authorizer.timeout must be positive")
+		}
+		switch a.Mode {
+		case "", AuthorizerModeAugment, AuthorizerModeOverride:
+		default:
+			return fmt.Errorf("auth.external_authorizer.mode must be one of: augment, override")
+		}
+	}
+
+	for instance, roles := range c.OIDC.InstanceRequiredRoles {
+		if instance == "" {
+			return fmt.Errorf("oidc.instance_required_roles: instance name must not be empty")
+		}
+		if len(roles) == 0 {
+			return fmt.Errorf("oidc.instance_required_roles[%s]: at least one role is required", instance)
+		}
+	}
+
+	if len(c.OIDC.RequiredGroups) > 0 && c.OIDC.GroupClaim == "" {
+		return fmt.Errorf("oidc.group_claim is required when oidc.required_groups is set")
+	}
+
 	// Validate TLS config
-	if c.TLS.Enabled {
+	minVersion, err := ParseTLSMinVersion(c.TLS.MinVersion)
+	if err != nil {
+		return err
+	}
+	if _, err := ParseCipherSuites(c.TLS.CipherSuites); err != nil {
+		return err
+	}
+	if minVersion == tls.VersionTLS13 && len(c.TLS.CipherSuites) > 0 {
+		return fmt.Errorf("tls.cipher_suites has no effect with tls.min_version 1.3")
+	}
+	if c.TLS.ACME.Enabled {
+		if !c.TLS.Enabled {
+			return fmt.Errorf("tls.acme requires tls.enabled")
+		}
+		if c.TLS.CertFile != "" || c.TLS.KeyFile != "" {
+			return fmt.Errorf("tls.cert_file/tls.key_file and tls.acme are mutually exclusive")
+		}
+		if c.TLS.Watch || c.TLS.ReloadInterval != 0 {
+			return fmt.Errorf("tls.watch and tls.reload_interval do not apply to tls.acme, which renews certificates itself")
+		}
+		if len(c.TLS.ACME.Domains) == 0 {
+			return fmt.Errorf("tls.acme.domains is required when tls.acme is enabled")
+		}
+		for _, domain := range c.TLS.ACME.Domains {
+			if domain == "" || strings.ContainsAny(domain, ":/ ") {
+				return fmt.Errorf("tls.acme.domains: invalid host name %q", domain)
+			}
+		}
+		if c.TLS.ACME.CacheDir == "" {
+			return fmt.Errorf("tls.acme.cache_dir is required when tls.acme is enabled")
+		}
+		if c.TLS.ACME.HTTPChallengeAddr == "" {
+			return fmt.Errorf("tls.acme.http_challenge_addr is required when tls.acme is enabled")
+		}
+		if c.TLS.ACME.DirectoryURL != "" && !strings.HasPrefix(c.TLS.ACME.DirectoryURL, "https://") {
+			return fmt.Errorf("tls.acme.directory_url must be an HTTPS URL")
+		}
+	} else if c.TLS.Enabled {
 		if c.TLS.CertFile == "" || c.TLS.KeyFile == "" {
 			return fmt.Errorf("tls.cert_file and tls.key_file are required when TLS is enabled")
 		}
@@ -208,6 +1136,9 @@ func (c *Config) Validate() error {
 		if _, err := os.Stat(c.TLS.KeyFile); err != nil {
 			return fmt.Errorf("tls.key_file not found: %w", err)
 		}
+		if c.TLS.ReloadInterval < 0 {
+			return fmt.Errorf("tls.reload_interval must not be negative")
+		}
 	}
 
 	// Validate log config
@@ -222,25 +1153,147 @@ func (c *Config) Validate() error {
 	}
 
 	validFormats := map[string]bool{
-		"json": true,
-		"text": true,
+		"json":   true,
+		"text":   true,
+		"syslog": true,
 	}
 	if !validFormats[c.Log.Format] {
-		return fmt.Errorf("log.format must be one of: json, text")
+		return fmt.Errorf("log.format must be one of: json, text, syslog")
+	}
+	if c.Log.Format == "syslog" {
+		if err := validateSyslogFacility(c.Log.Syslog.Facility); err != nil {
+			return err
+		}
+		if c.Log.Syslog.Tag == "" {
+			return fmt.Errorf("log.syslog.tag is required when log.format is syslog")
+		}
+	}
+
+	switch c.Session.Store {
+	case "", SessionStoreMemory:
+	case SessionStoreFile:
+		if c.Session.File == "" {
+			return fmt.Errorf("session.file is required when session.store is file")
+		}
+	case SessionStoreRedis:
+		if c.Session.Redis.Addr == "" {
+			return fmt.Errorf("session.redis.addr is required when session.store is redis")
+		}
+		if c.Session.Redis.DB < 0 {
+			return fmt.Errorf("session.redis.db must not be negative")
+		}
+	default:
+		return fmt.Errorf("session.store must be one of: memory, file, redis")
+	}
+	if c.Session.CleanupInterval < 0 {
+		return fmt.Errorf("session.cleanup_interval must not be negative")
+	}
+
+	switch c.Observability.MetricsBackend {
+	case "", MetricsBackendPrometheus, MetricsBackendBuiltin:
+	default:
+		return fmt.Errorf("observability.metrics_backend must be one of: prometheus, builtin")
+	}
+
+	if c.HTTPServer.EnableConfigAPI && c.HTTPServer.ConfigAPIToken == "" {
+		return fmt.Errorf("httpserver.config_api_token is required when httpserver.enable_config_api is true")
+	}
+	if c.Daemon.SnapshotFile != "" && !filepath.IsAbs(c.Daemon.SnapshotFile) {
+		return fmt.Errorf("daemon.snapshot_file must be an absolute path")
+	}
+	if c.HTTPServer.FailureReputation.Enabled {
+		if c.HTTPServer.FailureReputation.Threshold < 1 {
+			return fmt.Errorf("httpserver.failure_reputation.threshold must be at least 1")
+		}
+		if c.HTTPServer.FailureReputation.Window < 1 {
+			return fmt.Errorf("httpserver.failure_reputation.window must be positive")
+		}
+	}
+	if dir := c.HTTPServer.TemplatesDir; dir != "" {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return fmt.Errorf("httpserver.templates_dir not found: %w", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("httpserver.templates_dir must be a directory")
+		}
+	}
+	if l := c.HTTPServer.DefaultLanguage; l != "" && !slices.Contains(PageLanguages, l) {
+		return fmt.Errorf("httpserver.default_language must be one of: %s", strings.Join(PageLanguages, ", "))
+	}
+	if u := c.HTTPServer.SuccessRedirectURL; u != "" && !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+		return fmt.Errorf("httpserver.success_redirect_url must be a valid HTTP(S) URL")
+	}
+	if u := c.HTTPServer.Branding.LogoURL; u != "" && !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+		return fmt.Errorf("httpserver.branding.logo_url must be a valid HTTP(S) URL")
+	}
+	if e := c.HTTPServer.Branding.SupportEmail; e != "" && (!strings.Contains(e, "@") || strings.ContainsAny(e, " <>\"\r\n")) {
+		return fmt.Errorf("httpserver.branding.support_email must be an email address")
 	}
 
 	// Validate listen config
-	if c.Listen.HTTP == "" {
+	if c.Listen.HTTP == "" && c.Listen.HTTPSocket == "" {
 		return fmt.Errorf("listen.http is required")
 	}
+	if c.Listen.HTTP != "" && c.Listen.HTTPSocket != "" {
+		return fmt.Errorf("listen.http and listen.http_socket are mutually exclusive (set listen.http to \"\" to use the socket)")
+	}
 	if c.Listen.Socket == "" {
 		return fmt.Errorf("listen.socket is required")
 	}
+	if c.Listen.HTTPSocket != "" {
+		if !filepath.IsAbs(c.Listen.HTTPSocket) {
+			return fmt.Errorf("listen.http_socket must be an absolute path")
+		}
+		if filepath.Clean(c.Listen.HTTPSocket) == filepath.Clean(c.Listen.Socket) {
+			return fmt.Errorf("listen.http_socket must differ from listen.socket")
+		}
+	}
+	if len(c.Listen.SocketAllowedUIDs) > 0 && runtime.GOOS != "linux" {
+		return fmt.Errorf("listen.socket_allowed_uids is only supported on Linux")
+	}
+	for i, uid := range c.Listen.SocketAllowedUIDs {
+		if uid < 0 || uid > math.MaxUint32 {
+			return fmt.Errorf("listen.socket_allowed_uids[%d]: %d is not a valid user ID", i, uid)
+		}
+	}
+	if c.Listen.MaxIPCRequestBytes < 0 {
+		return fmt.Errorf("listen.max_ipc_request_bytes must not be negative")
+	}
+	if c.Listen.IPCTimeout < 0 {
+		return fmt.Errorf("listen.ipc_timeout must not be negative")
+	}
+	if _, err := ParseTrustedProxies(c.Listen.TrustedProxies); err != nil {
+		return err
+	}
+	if _, err := ParseCIDRs("listen.allowed_cidrs", c.Listen.AllowedCIDRs); err != nil {
+		return err
+	}
+	if _, err := ParseCIDRs("listen.health_allowed_cidrs", c.Listen.HealthAllowedCIDRs); err != nil {
+		return err
+	}
+	if rl := c.Listen.RateLimit; rl.Rate < 0 || rl.Burst < 0 || rl.TTL < 0 || rl.MaxSize < 0 {
+		return fmt.Errorf("listen.rate_limit values must not be negative")
+	}
+	for route, rl := range c.Listen.RateLimit.Routes {
+		if !strings.HasPrefix(route, "/") {
+			return fmt.Errorf("listen.rate_limit.routes: route %q must start with /", route)
+		}
+		if rl.Rate < 0 || rl.Burst < 0 {
+			return fmt.Errorf("listen.rate_limit.routes[%s]: values must not be negative", route)
+		}
+		if rl.PerSession && !slices.Contains(RateLimitPerSessionRoutes, route) {
+			return fmt.Errorf("listen.rate_limit.routes[%s]: per_session is only supported for %s",
+				route, strings.Join(RateLimitPerSessionRoutes, ", "))
+		}
+	}
 
 	return nil
 }
 
 // SetupLogging configures the global slog logger based on the LogConfig.
+// With format syslog it falls back to JSON on stderr if the local syslog
+// daemon cannot be reached.
 func SetupLogging(cfg *LogConfig) {
 	var level slog.Level
 	switch cfg.Level {
@@ -257,14 +1310,29 @@ func SetupLogging(cfg *LogConfig) {
 	opts := &slog.HandlerOptions{Level: level}
 
 	var handler slog.Handler
+	var sysWriter *syslog.Writer
+	var syslogErr error
 	switch cfg.Format {
 	case "text":
 		handler = slog.NewTextHandler(os.Stderr, opts)
+	case "syslog":
+		sysWriter, syslogErr = dialSyslog(&cfg.Syslog)
+		if syslogErr != nil {
+			// Keep logging somewhere rather than losing all output
+			handler = slog.NewJSONHandler(os.Stderr, opts)
+		} else {
+			handler = newSyslogHandler(sysWriter, opts)
+		}
 	default:
 		handler = slog.NewJSONHandler(os.Stderr, opts)
 	}
 
 	slog.SetDefault(slog.New(handler))
+	setActiveSyslog(sysWriter)
+
+	if syslogErr != nil {
+		slog.Warn("syslog unavailable, logging JSON to stderr instead", "error", syslogErr)
+	}
 }
 
 // Redact returns a deep-enough copy of the config with secrets redacted for safe logging
@@ -279,8 +1347,96 @@ func (c *Config) Redact() *Config {
 		redacted.OIDC.RequiredRoles = make([]string, len(c.OIDC.RequiredRoles))
 		copy(redacted.OIDC.RequiredRoles, c.OIDC.RequiredRoles)
 	}
+	if c.OIDC.DeniedRoles != nil {
+		redacted.OIDC.DeniedRoles = make([]string, len(c.OIDC.DeniedRoles))
+		copy(redacted.OIDC.DeniedRoles, c.OIDC.DeniedRoles)
+	}
+	if c.OIDC.RequiredGroups != nil {
+		redacted.OIDC.RequiredGroups = make([]string, len(c.OIDC.RequiredGroups))
+		copy(redacted.OIDC.RequiredGroups, c.OIDC.RequiredGroups)
+	}
+	if c.OIDC.InstanceRequiredRoles != nil {
+		redacted.OIDC.InstanceRequiredRoles = make(map[string][]string, len(c.OIDC.InstanceRequiredRoles))
+		for instance, roles := range c.OIDC.InstanceRequiredRoles {
+			redacted.OIDC.InstanceRequiredRoles[instance] = append([]string(nil), roles...)
+		}
+	}
+	if c.OIDC.ACRValues != nil {
+		redacted.OIDC.ACRValues = make([]string, len(c.OIDC.ACRValues))
+		copy(redacted.OIDC.ACRValues, c.OIDC.ACRValues)
+	}
+	if c.OIDC.RequiredACR != nil {
+		redacted.OIDC.RequiredACR = make([]string, len(c.OIDC.RequiredACR))
+		copy(redacted.OIDC.RequiredACR, c.OIDC.RequiredACR)
+	}
+	if c.OIDC.RoleClaimFallbacks != nil {
+		redacted.OIDC.RoleClaimFallbacks = make([]string, len(c.OIDC.RoleClaimFallbacks))
+		copy(redacted.OIDC.RoleClaimFallbacks, c.OIDC.RoleClaimFallbacks)
+	}
+	if c.OIDC.RoleClaims != nil {
+		redacted.OIDC.RoleClaims = make([]string, len(c.OIDC.RoleClaims))
+		copy(redacted.OIDC.RoleClaims, c.OIDC.RoleClaims)
+	}
+	if c.Listen.TrustedProxies != nil {
+		redacted.Listen.TrustedProxies = make([]string, len(c.Listen.TrustedProxies))
+		copy(redacted.Listen.TrustedProxies, c.Listen.TrustedProxies)
+	}
+	if c.Listen.SocketAllowedUIDs != nil {
+		redacted.Listen.SocketAllowedUIDs = make([]int, len(c.Listen.SocketAllowedUIDs))
+		copy(redacted.Listen.SocketAllowedUIDs, c.Listen.SocketAllowedUIDs)
+	}
+	if c.Listen.AllowedCIDRs != nil {
+		redacted.Listen.AllowedCIDRs = make([]string, len(c.Listen.AllowedCIDRs))
+		copy(redacted.Listen.AllowedCIDRs, c.Listen.AllowedCIDRs)
+	}
+	if c.Listen.HealthAllowedCIDRs != nil {
+		redacted.Listen.HealthAllowedCIDRs = make([]string, len(c.Listen.HealthAllowedCIDRs))
+		copy(redacted.Listen.HealthAllowedCIDRs, c.Listen.HealthAllowedCIDRs)
+	}
+	if c.Listen.RateLimit.Routes != nil {
+		redacted.Listen.RateLimit.Routes = make(map[string]RouteRateLimitConfig, len(c.Listen.RateLimit.Routes))
+		for route, rl := range c.Listen.RateLimit.Routes {
+			redacted.Listen.RateLimit.Routes[route] = rl
+		}
+	}
+	if c.TLS.CipherSuites != nil {
+		redacted.TLS.CipherSuites = make([]string, len(c.TLS.CipherSuites))
+		copy(redacted.TLS.CipherSuites, c.TLS.CipherSuites)
+	}
+	if c.TLS.ACME.Domains != nil {
+		redacted.TLS.ACME.Domains = make([]string, len(c.TLS.ACME.Domains))
+		copy(redacted.TLS.ACME.Domains, c.TLS.ACME.Domains)
+	}
+	if c.Auth.ContextClaims != nil {
+		redacted.Auth.ContextClaims = make([]string, len(c.Auth.ContextClaims))
+		copy(redacted.Auth.ContextClaims, c.Auth.ContextClaims)
+	}
+	if c.OIDC.Providers != nil {
+		redacted.OIDC.Providers = make([]OIDCProviderConfig, len(c.OIDC.Providers))
+		copy(redacted.OIDC.Providers, c.OIDC.Providers)
+		for i := range redacted.OIDC.Providers {
+			if redacted.OIDC.Providers[i].ClientSecret != "" {
+				redacted.OIDC.Providers[i].ClientSecret = "[REDACTED]"
+			}
+		}
+	}
 	if redacted.OIDC.ClientSecret != "" {
 		redacted.OIDC.ClientSecret = "[REDACTED]"
 	}
+	if redacted.OIDC.AdminAPI.ClientSecret != "" {
+		redacted.OIDC.AdminAPI.ClientSecret = "[REDACTED]"
+	}
+	if redacted.OIDC.StateSecret != "" {
+		redacted.OIDC.StateSecret = "[REDACTED]"
+	}
+	if redacted.HTTPServer.ConfigAPIToken != "" {
+		redacted.HTTPServer.ConfigAPIToken = "[REDACTED]"
+	}
+	if redacted.Auth.ExternalAuthorizer.BearerToken != "" {
+		redacted.Auth.ExternalAuthorizer.BearerToken = "[REDACTED]"
+	}
+	if redacted.Session.Redis.Password != "" {
+		redacted.Session.Redis.Password = "[REDACTED]"
+	}
 	return &redacted
 }
@@ -2,8 +2,12 @@ package config
 
 import (
 	"context"
+	"crypto/tls"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
 	"testing"
 )
@@ -18,6 +22,9 @@ func TestDefaultConfig(t *testing.T) {
 	if cfg.OIDC.JWKSCacheDuration != 3600 {
 		t.Errorf("expected JWKS cache 3600, got %d", cfg.OIDC.JWKSCacheDuration)
 	}
+	if cfg.OIDC.ClockSkew != DefaultClockSkew {
+		t.Errorf("expected clock skew %d, got %d", DefaultClockSkew, cfg.OIDC.ClockSkew)
+	}
 
 	if cfg.Auth.SessionTimeout != 300 {
 		t.Errorf("expected session timeout 300, got %d", cfg.Auth.SessionTimeout)
@@ -215,6 +222,218 @@ log:
 	}
 }
 
+func TestLoadClientSecretFile(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	secretFile := filepath.Join(tmpDir, "client_secret")
+	if err := os.WriteFile(secretFile, []byte("file-secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	emptyFile := filepath.Join(tmpDir, "empty")
+	if err := os.WriteFile(emptyFile, []byte("\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		oidcExtra  string
+		wantSecret string
+		wantErr    string
+	}{
+		{
+			name:       "secret read from file and trimmed",
+			oidcExtra:  "  client_secret_file: " + secretFile + "\n",
+			wantSecret: "file-secret",
+		},
+		{
+			name:      "inline secret and file are mutually exclusive",
+			oidcExtra: "  client_secret: \"inline\"\n  client_secret_file: " + secretFile + "\n",
+			wantErr:   "mutually exclusive",
+		},
+		{
+			name:      "unreadable file",
+			oidcExtra: "  client_secret_file: " + filepath.Join(tmpDir, "missing") + "\n",
+			wantErr:   "failed to read oidc.client_secret_file",
+		},
+		{
+			name:      "empty file",
+			oidcExtra: "  client_secret_file: " + emptyFile + "\n",
+			wantErr:   "is empty",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configYAML := `
+oidc:
+  issuer: "https://keycloak.example.com/realms/test"
+  client_id: "openvpn"
+  redirect_uri: "http://localhost:9000/callback"
+  scopes:
+    - openid
+` + tt.oidcExtra
+
+			cfgPath := filepath.Join(tmpDir, "config.yaml")
+			if err := os.WriteFile(cfgPath, []byte(configYAML), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg, err := Load(cfgPath)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Load failed: %v", err)
+			}
+			if cfg.OIDC.ClientSecret != tt.wantSecret {
+				t.Errorf("client_secret = %q, want %q", cfg.OIDC.ClientSecret, tt.wantSecret)
+			}
+
+			redacted := cfg.Redact()
+			if redacted.OIDC.ClientSecret != "[REDACTED]" {
+				t.Errorf("redacted client_secret = %q, want [REDACTED]", redacted.OIDC.ClientSecret)
+			}
+			if redacted.OIDC.ClientSecretFile != secretFile {
+				t.Errorf("redacted client_secret_file = %q, want path preserved", redacted.OIDC.ClientSecretFile)
+			}
+		})
+	}
+}
+
+func TestLoadRoleClaims(t *testing.T) {
+	configYAML := `
+oidc:
+  issuer: "https://keycloak.example.com/realms/test"
+  client_id: "openvpn"
+  redirect_uri: "http://localhost:9000/callback"
+  scopes:
+    - openid
+  role_claims:
+    - "realm_access.roles"
+    - "resource_access.openvpn.roles"
+`
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(configYAML), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if cfg.OIDC.RoleClaim != "realm_access.roles" {
+		t.Errorf("role_claim = %q, want %q", cfg.OIDC.RoleClaim, "realm_access.roles")
+	}
+	if !slices.Equal(cfg.OIDC.RoleClaimFallbacks, []string{"resource_access.openvpn.roles"}) {
+		t.Errorf("role_claim_fallbacks = %v, want [resource_access.openvpn.roles]", cfg.OIDC.RoleClaimFallbacks)
+	}
+	if !cfg.OIDC.RoleClaimAggregate {
+		t.Error("expected role_claims to set role_claim_aggregate")
+	}
+	// The loaded config validates again, e.g. after test-auth overrides
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate on loaded config: %v", err)
+	}
+}
+
+func TestLoadProfile(t *testing.T) {
+	configYAML := `
+oidc:
+  issuer: "https://keycloak.example.com/realms/prod"
+  client_id: "openvpn"
+  redirect_uri: "https://vpn.example.com/callback"
+  scopes:
+    - openid
+  required_roles:
+    - vpn-user
+log:
+  level: "info"
+profiles:
+  dev:
+    oidc:
+      issuer: "http://localhost:8080/realms/dev"
+      required_roles: []
+    log:
+      level: "debug"
+  staging:
+    oidc:
+      redirect_uri: "https://vpn.staging.example.com/callback"
+`
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(configYAML), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("no profile uses base", func(t *testing.T) {
+		cfg, err := LoadProfile(path, "")
+		if err != nil {
+			t.Fatalf("LoadProfile failed: %v", err)
+		}
+		if cfg.OIDC.Issuer != "https://keycloak.example.com/realms/prod" {
+			t.Errorf("issuer = %q, want base issuer", cfg.OIDC.Issuer)
+		}
+		if cfg.Log.Level != "info" {
+			t.Errorf("log level = %q, want %q", cfg.Log.Level, "info")
+		}
+	})
+
+	t.Run("profile overlays base", func(t *testing.T) {
+		cfg, err := LoadProfile(path, "dev")
+		if err != nil {
+			t.Fatalf("LoadProfile failed: %v", err)
+		}
+		if cfg.OIDC.Issuer != "http://localhost:8080/realms/dev" {
+			t.Errorf("issuer = %q, want dev issuer", cfg.OIDC.Issuer)
+		}
+		if len(cfg.OIDC.RequiredRoles) != 0 {
+			t.Errorf("required_roles = %v, want empty (replaced by profile)", cfg.OIDC.RequiredRoles)
+		}
+		if cfg.Log.Level != "debug" {
+			t.Errorf("log level = %q, want %q", cfg.Log.Level, "debug")
+		}
+		// Untouched fields keep base values
+		if cfg.OIDC.ClientID != "openvpn" || cfg.OIDC.RedirectURI != "https://vpn.example.com/callback" {
+			t.Error("expected fields not set in profile to keep base values")
+		}
+	})
+
+	t.Run("profile from environment", func(t *testing.T) {
+		t.Setenv(ProfileEnvVar, "staging")
+		cfg, err := Load(path)
+		if err != nil {
+			t.Fatalf("Load failed: %v", err)
+		}
+		if cfg.OIDC.RedirectURI != "https://vpn.staging.example.com/callback" {
+			t.Errorf("redirect_uri = %q, want staging value", cfg.OIDC.RedirectURI)
+		}
+	})
+
+	t.Run("env overrides win over profile", func(t *testing.T) {
+		t.Setenv("OVPN_SSO_LOG_LEVEL", "warn")
+		cfg, err := LoadProfile(path, "dev")
+		if err != nil {
+			t.Fatalf("LoadProfile failed: %v", err)
+		}
+		if cfg.Log.Level != "warn" {
+			t.Errorf("log level = %q, want %q", cfg.Log.Level, "warn")
+		}
+	})
+
+	t.Run("missing profile", func(t *testing.T) {
+		_, err := LoadProfile(path, "prod")
+		if err == nil {
+			t.Fatal("expected error, got nil")
+		}
+		if !strings.Contains(err.Error(), `config profile "prod" not found (available: [dev staging])`) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	})
+}
+
 func TestValidate(t *testing.T) {
 	tests := []struct {
 		name    string
@@ -252,84 +471,1321 @@ func TestValidate(t *testing.T) {
 			wantErr: true,
 			errMsg:  "are required when TLS is enabled",
 		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			cfg := &Config{
-				Listen: ListenConfig{
-					HTTP:   ":9000",
-					Socket: "/tmp/test.sock",
-				},
-				OIDC: OIDCConfig{
-					Issuer:      "https://keycloak.example.com/realms/test",
-					ClientID:    "openvpn",
-					RedirectURI: "http://localhost:9000/callback",
-					Scopes:      []string{"openid"},
-				},
-				Auth: AuthConfig{
-					SessionTimeout: 300,
-					UsernameClaim:  "preferred_username",
-				},
-				Log: LogConfig{
-					Level:  "info",
-					Format: "json",
-				},
-			}
-
-			tt.modify(cfg)
-
-			err := cfg.Validate()
-			if tt.wantErr {
-				if err == nil {
-					t.Errorf("expected error containing '%s', got nil", tt.errMsg)
-				} else if !strings.Contains(err.Error(), tt.errMsg) {
-					t.Errorf("error = %v, want error containing %v", err, tt.errMsg)
-				}
-			} else {
-				if err != nil {
-					t.Errorf("unexpected error: %v", err)
-				}
-			}
-		})
-	}
-}
-
-func TestRedact(t *testing.T) {
-	cfg := &Config{
-		OIDC: OIDCConfig{
-			ClientSecret: "super-secret",
+		{
+			name: "negative max sessions per user",
+			modify: func(c *Config) {
+				c.Auth.MaxSessionsPerUser = -1
+			},
+			wantErr: true,
+			errMsg:  "auth.max_sessions_per_user must not be negative",
 		},
-	}
-
-	redacted := cfg.Redact()
-
-	if redacted.OIDC.ClientSecret != "[REDACTED]" {
-		t.Errorf("expected [REDACTED], got %s", redacted.OIDC.ClientSecret)
-	}
-
-	// Original should be unchanged
-	if cfg.OIDC.ClientSecret != "super-secret" {
-		t.Errorf("original was modified")
-	}
-}
-
-func TestSetupLogging(t *testing.T) {
-	old := slog.Default()
-	t.Cleanup(func() {
-		slog.SetDefault(old)
-	})
-
-	SetupLogging(&LogConfig{Level: "debug", Format: "json"})
-	if !slog.Default().Enabled(context.Background(), slog.LevelDebug) {
-		t.Error("expected debug logs to be enabled")
-	}
-
-	SetupLogging(&LogConfig{Level: "error", Format: "text"})
-	if slog.Default().Enabled(context.Background(), slog.LevelInfo) {
-		t.Error("expected info logs to be disabled at error level")
-	}
-	if !slog.Default().Enabled(context.Background(), slog.LevelError) {
-		t.Error("expected error logs to be enabled")
+		{
+			name: "negative single IP grace period",
+			modify: func(c *Config) {
+				c.Auth.SingleIPPerUser = true
+				c.Auth.SingleIPGracePeriod = -1
+			},
+			wantErr: true,
+			errMsg:  "auth.single_ip_grace_period must not be negative",
+		},
+		{
+			name: "file session store",
+			modify: func(c *Config) {
+				c.Session = SessionConfig{Store: SessionStoreFile, File: "/var/lib/openvpn-keycloak-auth/sessions.json"}
+			},
+			wantErr: false,
+		},
+		{
+			name: "file session store without file",
+			modify: func(c *Config) {
+				c.Session = SessionConfig{Store: SessionStoreFile}
+			},
+			wantErr: true,
+			errMsg:  "session.file is required",
+		},
+		{
+			name: "redis session store",
+			modify: func(c *Config) {
+				c.Session = SessionConfig{Store: SessionStoreRedis, Redis: SessionRedisConfig{Addr: "redis.example.com:6379", DB: 2}}
+			},
+			wantErr: false,
+		},
+		{
+			name: "redis session store without addr",
+			modify: func(c *Config) {
+				c.Session = SessionConfig{Store: SessionStoreRedis}
+			},
+			wantErr: true,
+			errMsg:  "session.redis.addr is required",
+		},
+		{
+			name: "redis session store with negative db",
+			modify: func(c *Config) {
+				c.Session = SessionConfig{Store: SessionStoreRedis, Redis: SessionRedisConfig{Addr: "redis.example.com:6379", DB: -1}}
+			},
+			wantErr: true,
+			errMsg:  "session.redis.db must not be negative",
+		},
+		{
+			name: "valid state signing",
+			modify: func(c *Config) {
+				c.OIDC.StateSecret = "0123456789abcdef0123456789abcdef"
+				c.OIDC.InstanceID = "vpn-1"
+			},
+			wantErr: false,
+		},
+		{
+			name: "short state secret",
+			modify: func(c *Config) {
+				c.OIDC.StateSecret = "too-short"
+			},
+			wantErr: true,
+			errMsg:  "oidc.state_secret must be at least 32 characters",
+		},
+		{
+			name: "instance ID with dot",
+			modify: func(c *Config) {
+				c.OIDC.InstanceID = "vpn1.example"
+			},
+			wantErr: true,
+			errMsg:  "may only contain letters, digits",
+		},
+		{
+			name: "instance ID too long",
+			modify: func(c *Config) {
+				c.OIDC.InstanceID = strings.Repeat("a", 33)
+			},
+			wantErr: true,
+			errMsg:  "oidc.instance_id must not exceed 32 characters",
+		},
+		{
+			name: "relative snapshot file",
+			modify: func(c *Config) {
+				c.Daemon.SnapshotFile = "snapshot.json"
+			},
+			wantErr: true,
+			errMsg:  "daemon.snapshot_file must be an absolute path",
+		},
+		{
+			name: "failure reputation",
+			modify: func(c *Config) {
+				c.HTTPServer.FailureReputation = FailureReputationConfig{Enabled: true, Threshold: 3, Window: 900}
+			},
+			wantErr: false,
+		},
+		{
+			name: "failure reputation without threshold",
+			modify: func(c *Config) {
+				c.HTTPServer.FailureReputation = FailureReputationConfig{Enabled: true, Window: 900}
+			},
+			wantErr: true,
+			errMsg:  "httpserver.failure_reputation.threshold must be at least 1",
+		},
+		{
+			name: "failure reputation without window",
+			modify: func(c *Config) {
+				c.HTTPServer.FailureReputation = FailureReputationConfig{Enabled: true, Threshold: 3}
+			},
+			wantErr: true,
+			errMsg:  "httpserver.failure_reputation.window must be positive",
+		},
+		{
+			name: "acme",
+			modify: func(c *Config) {
+				c.TLS.Enabled = true
+				c.TLS.ACME.Enabled = true
+				c.TLS.ACME.Domains = []string{"vpn.example.com"}
+				c.TLS.ACME.CacheDir = "/var/lib/openvpn-keycloak-auth/acme"
+				c.TLS.ACME.HTTPChallengeAddr = ":80"
+			},
+			wantErr: false,
+		},
+		{
+			name: "tls 1.3 only",
+			modify: func(c *Config) {
+				c.TLS.MinVersion = "1.3"
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid tls min version",
+			modify: func(c *Config) {
+				c.TLS.MinVersion = "1.0"
+			},
+			wantErr: true,
+			errMsg:  "tls.min_version must be one of: 1.2, 1.3",
+		},
+		{
+			name: "invalid cipher suite",
+			modify: func(c *Config) {
+				c.TLS.CipherSuites = []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "bogus"}
+			},
+			wantErr: true,
+			errMsg:  `tls.cipher_suites[1]: unknown cipher suite "bogus"`,
+		},
+		{
+			name: "cipher suites with tls 1.3 only",
+			modify: func(c *Config) {
+				c.TLS.MinVersion = "1.3"
+				c.TLS.CipherSuites = []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}
+			},
+			wantErr: true,
+			errMsg:  "tls.cipher_suites has no effect with tls.min_version 1.3",
+		},
+		{
+			name: "acme with watch",
+			modify: func(c *Config) {
+				c.TLS.Enabled = true
+				c.TLS.Watch = true
+				c.TLS.ACME.Enabled = true
+				c.TLS.ACME.Domains = []string{"vpn.example.com"}
+			},
+			wantErr: true,
+			errMsg:  "tls.watch and tls.reload_interval do not apply to tls.acme",
+		},
+		{
+			name: "acme without tls enabled",
+			modify: func(c *Config) {
+				c.TLS.ACME.Enabled = true
+				c.TLS.ACME.Domains = []string{"vpn.example.com"}
+			},
+			wantErr: true,
+			errMsg:  "tls.acme requires tls.enabled",
+		},
+		{
+			name: "acme with cert file",
+			modify: func(c *Config) {
+				c.TLS.Enabled = true
+				c.TLS.CertFile = "/etc/openvpn/tls/server.crt"
+				c.TLS.ACME.Enabled = true
+				c.TLS.ACME.Domains = []string{"vpn.example.com"}
+			},
+			wantErr: true,
+			errMsg:  "tls.cert_file/tls.key_file and tls.acme are mutually exclusive",
+		},
+		{
+			name: "acme without domains",
+			modify: func(c *Config) {
+				c.TLS.Enabled = true
+				c.TLS.ACME.Enabled = true
+			},
+			wantErr: true,
+			errMsg:  "tls.acme.domains is required",
+		},
+		{
+			name: "acme domain with port",
+			modify: func(c *Config) {
+				c.TLS.Enabled = true
+				c.TLS.ACME.Enabled = true
+				c.TLS.ACME.Domains = []string{"vpn.example.com:443"}
+			},
+			wantErr: true,
+			errMsg:  "tls.acme.domains: invalid host name",
+		},
+		{
+			name: "acme plain HTTP directory",
+			modify: func(c *Config) {
+				c.TLS.Enabled = true
+				c.TLS.ACME.Enabled = true
+				c.TLS.ACME.Domains = []string{"vpn.example.com"}
+				c.TLS.ACME.DirectoryURL = "http://localhost:14000/dir"
+				c.TLS.ACME.CacheDir = "/var/lib/openvpn-keycloak-auth/acme"
+				c.TLS.ACME.HTTPChallengeAddr = ":80"
+			},
+			wantErr: true,
+			errMsg:  "tls.acme.directory_url must be an HTTPS URL",
+		},
+		{
+			name: "http socket instead of http",
+			modify: func(c *Config) {
+				c.Listen.HTTP = ""
+				c.Listen.HTTPSocket = "/run/openvpn-keycloak-auth/http.sock"
+			},
+			wantErr: false,
+		},
+		{
+			name: "http and http socket",
+			modify: func(c *Config) {
+				c.Listen.HTTPSocket = "/run/openvpn-keycloak-auth/http.sock"
+			},
+			wantErr: true,
+			errMsg:  "listen.http and listen.http_socket are mutually exclusive",
+		},
+		{
+			name: "relative http socket",
+			modify: func(c *Config) {
+				c.Listen.HTTP = ""
+				c.Listen.HTTPSocket = "http.sock"
+			},
+			wantErr: true,
+			errMsg:  "listen.http_socket must be an absolute path",
+		},
+		{
+			name: "http socket same as ipc socket",
+			modify: func(c *Config) {
+				c.Listen.HTTP = ""
+				c.Listen.HTTPSocket = c.Listen.Socket
+			},
+			wantErr: true,
+			errMsg:  "listen.http_socket must differ from listen.socket",
+		},
+		{
+			name: "instance required roles",
+			modify: func(c *Config) {
+				c.OIDC.InstanceRequiredRoles = map[string][]string{"server-a": {"vpn-a"}}
+			},
+			wantErr: false,
+		},
+		{
+			name: "instance required roles without roles",
+			modify: func(c *Config) {
+				c.OIDC.InstanceRequiredRoles = map[string][]string{"server-a": nil}
+			},
+			wantErr: true,
+			errMsg:  "oidc.instance_required_roles[server-a]: at least one role is required",
+		},
+		{
+			name: "negative drain timeout",
+			modify: func(c *Config) {
+				c.Shutdown.DrainTimeout = -1
+			},
+			wantErr: true,
+			errMsg:  "shutdown.drain_timeout must not be negative",
+		},
+		{
+			name: "builtin metrics backend",
+			modify: func(c *Config) {
+				c.Observability.MetricsBackend = MetricsBackendBuiltin
+			},
+			wantErr: false,
+		},
+		{
+			name: "unknown metrics backend",
+			modify: func(c *Config) {
+				c.Observability.MetricsBackend = "statsd"
+			},
+			wantErr: true,
+			errMsg:  "observability.metrics_backend must be one of",
+		},
+		{
+			name: "unknown session store",
+			modify: func(c *Config) {
+				c.Session = SessionConfig{Store: "bolt"}
+			},
+			wantErr: true,
+			errMsg:  "session.store must be one of",
+		},
+		{
+			name: "negative session cleanup interval",
+			modify: func(c *Config) {
+				c.Session.CleanupInterval = -1
+			},
+			wantErr: true,
+			errMsg:  "session.cleanup_interval must not be negative",
+		},
+		{
+			name: "valid trusted proxies",
+			modify: func(c *Config) {
+				c.Listen.TrustedProxies = []string{"10.0.0.0/8", "2001:db8::/32", "192.0.2.10"}
+			},
+			wantErr: false,
+		},
+		{
+			name: "malformed trusted proxy",
+			modify: func(c *Config) {
+				c.Listen.TrustedProxies = []string{"10.0.0.0/8", "10.0.0.0/33"}
+			},
+			wantErr: true,
+			errMsg:  "listen.trusted_proxies[1]: invalid CIDR",
+		},
+		{
+			name: "trusted proxy hostname",
+			modify: func(c *Config) {
+				c.Listen.TrustedProxies = []string{"proxy.example.com"}
+			},
+			wantErr: true,
+			errMsg:  "listen.trusted_proxies[0]: invalid CIDR or address",
+		},
+		{
+			name: "allowed CIDRs",
+			modify: func(c *Config) {
+				c.Listen.AllowedCIDRs = []string{"198.51.100.0/24", "2001:db8::/32"}
+				c.Listen.HealthAllowedCIDRs = []string{"10.0.0.1"}
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid allowed CIDR",
+			modify: func(c *Config) {
+				c.Listen.AllowedCIDRs = []string{"198.51.100.0/33"}
+			},
+			wantErr: true,
+			errMsg:  "listen.allowed_cidrs[0]: invalid CIDR",
+		},
+		{
+			name: "invalid health allowed CIDR",
+			modify: func(c *Config) {
+				c.Listen.HealthAllowedCIDRs = []string{"monitoring"}
+			},
+			wantErr: true,
+			errMsg:  "listen.health_allowed_cidrs[0]: invalid CIDR or address",
+		},
+		{
+			name: "negative socket allowed uid",
+			modify: func(c *Config) {
+				c.Listen.SocketAllowedUIDs = []int{990, -1}
+			},
+			wantErr: true,
+			errMsg:  "listen.socket_allowed_uids[1]: -1 is not a valid user ID",
+		},
+		{
+			name: "negative max IPC request size",
+			modify: func(c *Config) {
+				c.Listen.MaxIPCRequestBytes = -1
+			},
+			wantErr: true,
+			errMsg:  "listen.max_ipc_request_bytes must not be negative",
+		},
+		{
+			name: "empty merge claim",
+			modify: func(c *Config) {
+				c.OIDC.MergeClaims = []string{"groups", " "}
+			},
+			wantErr: true,
+			errMsg:  "oidc.merge_claims[1] must not be empty",
+		},
+		{
+			name: "negative IPC timeout",
+			modify: func(c *Config) {
+				c.Listen.IPCTimeout = -1
+			},
+			wantErr: true,
+			errMsg:  "listen.ipc_timeout must not be negative",
+		},
+		{
+			name: "custom rate limit",
+			modify: func(c *Config) {
+				c.Listen.RateLimit = RateLimitConfig{Rate: 2.5, Burst: 20, TTL: 600, MaxSize: 50000}
+			},
+			wantErr: false,
+		},
+		{
+			name: "negative rate limit",
+			modify: func(c *Config) {
+				c.Listen.RateLimit.Burst = -1
+			},
+			wantErr: true,
+			errMsg:  "listen.rate_limit values must not be negative",
+		},
+		{
+			name: "per-session rate limit route",
+			modify: func(c *Config) {
+				c.Listen.RateLimit.Routes = map[string]RouteRateLimitConfig{
+					"/callback": {Burst: 200, PerSession: true},
+				}
+			},
+			wantErr: false,
+		},
+		{
+			name: "rate limit route without leading slash",
+			modify: func(c *Config) {
+				c.Listen.RateLimit.Routes = map[string]RouteRateLimitConfig{"callback": {Burst: 200}}
+			},
+			wantErr: true,
+			errMsg:  "must start with /",
+		},
+		{
+			name: "per-session rate limit on unsupported route",
+			modify: func(c *Config) {
+				c.Listen.RateLimit.Routes = map[string]RouteRateLimitConfig{"/health": {PerSession: true}}
+			},
+			wantErr: true,
+			errMsg:  "per_session is only supported for /auth/, /callback",
+		},
+		{
+			name: "provider without name",
+			modify: func(c *Config) {
+				c.OIDC.Providers = []OIDCProviderConfig{{UsernamePrefix: "ext-"}}
+			},
+			wantErr: true,
+			errMsg:  "oidc.providers[0].name is required",
+		},
+		{
+			name: "provider with reserved name",
+			modify: func(c *Config) {
+				c.OIDC.Providers = []OIDCProviderConfig{{Name: DefaultOIDCProvider, UsernamePrefix: "ext-"}}
+			},
+			wantErr: true,
+			errMsg:  "is reserved or duplicated",
+		},
+		{
+			name: "provider without match criteria",
+			modify: func(c *Config) {
+				c.OIDC.Providers = []OIDCProviderConfig{{Name: "contractors"}}
+			},
+			wantErr: true,
+			errMsg:  "must set common_name_suffix or username_prefix",
+		},
+		{
+			name: "valid additional provider",
+			modify: func(c *Config) {
+				c.OIDC.Providers = []OIDCProviderConfig{{
+					Name:             "contractors",
+					CommonNameSuffix: ".contractors.example.com",
+					Issuer:           "https://keycloak.example.com/realms/contractors",
+				}}
+			},
+			wantErr: false,
+		},
+		{
+			name: "syslog format",
+			modify: func(c *Config) {
+				c.Log.Format = "syslog"
+				c.Log.Syslog = SyslogConfig{Facility: "local3", Tag: "ovpn-sso"}
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid syslog facility",
+			modify: func(c *Config) {
+				c.Log.Format = "syslog"
+				c.Log.Syslog = SyslogConfig{Facility: "local9", Tag: "ovpn-sso"}
+			},
+			wantErr: true,
+			errMsg:  "log.syslog.facility must be one of",
+		},
+		{
+			name: "syslog without tag",
+			modify: func(c *Config) {
+				c.Log.Format = "syslog"
+				c.Log.Syslog = SyslogConfig{Facility: "daemon"}
+			},
+			wantErr: true,
+			errMsg:  "log.syslog.tag is required",
+		},
+		{
+			name: "config API without token",
+			modify: func(c *Config) {
+				c.HTTPServer.EnableConfigAPI = true
+			},
+			wantErr: true,
+			errMsg:  "httpserver.config_api_token is required",
+		},
+		{
+			name: "username from common name",
+			modify: func(c *Config) {
+				c.Auth.UsernameSource = UsernameSourceCommonName
+			},
+			wantErr: false,
+		},
+		{
+			name: "invalid username source",
+			modify: func(c *Config) {
+				c.Auth.UsernameSource = "email"
+			},
+			wantErr: true,
+			errMsg:  "auth.username_source must be one of",
+		},
+		{
+			name: "role claims",
+			modify: func(c *Config) {
+				c.OIDC.RoleClaims = []string{"realm_access.roles", "resource_access.openvpn.roles"}
+			},
+			wantErr: false,
+		},
+		{
+			name: "role claims with empty entry",
+			modify: func(c *Config) {
+				c.OIDC.RoleClaims = []string{"realm_access.roles", " "}
+			},
+			wantErr: true,
+			errMsg:  "oidc.role_claims must not contain empty entries",
+		},
+		{
+			name: "role claims with fallbacks",
+			modify: func(c *Config) {
+				c.OIDC.RoleClaims = []string{"realm_access.roles"}
+				c.OIDC.RoleClaimFallbacks = []string{"roles"}
+			},
+			wantErr: true,
+			errMsg:  "oidc.role_claims and oidc.role_claim_fallbacks cannot be combined",
+		},
+		{
+			name: "invalid authz mode",
+			modify: func(c *Config) {
+				c.Auth.AuthzMode = "xor"
+			},
+			wantErr: true,
+			errMsg:  "auth.authz_mode must be one of",
+		},
+		{
+			name: "valid external authorizer",
+			modify: func(c *Config) {
+				c.Auth.ExternalAuthorizer = ExternalAuthorizerConfig{
+					URL:     "https://opa.example.com/v1/data/vpn/decision",
+					Timeout: 5,
+					Mode:    AuthorizerModeOverride,
+				}
+			},
+			wantErr: false,
+		},
+		{
+			name: "external authorizer with invalid URL",
+			modify: func(c *Config) {
+				c.Auth.ExternalAuthorizer = ExternalAuthorizerConfig{URL: "opa:8181", Timeout: 5}
+			},
+			wantErr: true,
+			errMsg:  "auth.external_authorizer.url must be a valid HTTP(S) URL",
+		},
+		{
+			name: "external authorizer without timeout",
+			modify: func(c *Config) {
+				c.Auth.ExternalAuthorizer = ExternalAuthorizerConfig{URL: "http://opa:8181/decision"}
+			},
+			wantErr: true,
+			errMsg:  "auth.external_authorizer.timeout must be positive",
+		},
+		{
+			name: "external authorizer with invalid mode",
+			modify: func(c *Config) {
+				c.Auth.ExternalAuthorizer = ExternalAuthorizerConfig{URL: "http://opa:8181/decision", Timeout: 5, Mode: "replace"}
+			},
+			wantErr: true,
+			errMsg:  "auth.external_authorizer.mode must be one of",
+		},
+		{
+			name: "templates dir and branding",
+			modify: func(c *Config) {
+				c.HTTPServer.TemplatesDir = t.TempDir()
+				c.HTTPServer.Branding = BrandingConfig{
+					CompanyName:  "Example Corp",
+					LogoURL:      "https://www.example.com/logo.svg",
+					SupportEmail: "helpdesk@example.com",
+				}
+			},
+			wantErr: false,
+		},
+		{
+			name: "missing templates dir",
+			modify: func(c *Config) {
+				c.HTTPServer.TemplatesDir = "/nonexistent/templates"
+			},
+			wantErr: true,
+			errMsg:  "httpserver.templates_dir not found",
+		},
+		{
+			name: "branding logo URL not HTTP",
+			modify: func(c *Config) {
+				c.HTTPServer.Branding.LogoURL = "javascript:alert(1)"
+			},
+			wantErr: true,
+			errMsg:  "httpserver.branding.logo_url must be a valid HTTP(S) URL",
+		},
+		{
+			name: "branding support email invalid",
+			modify: func(c *Config) {
+				c.HTTPServer.Branding.SupportEmail = "helpdesk"
+			},
+			wantErr: true,
+			errMsg:  "httpserver.branding.support_email must be an email address",
+		},
+		{
+			name: "success redirect URL not HTTP",
+			modify: func(c *Config) {
+				c.HTTPServer.SuccessRedirectURL = "javascript:window.close()"
+			},
+			wantErr: true,
+			errMsg:  "httpserver.success_redirect_url must be a valid HTTP(S) URL",
+		},
+		{
+			name: "unsupported default language",
+			modify: func(c *Config) {
+				c.HTTPServer.DefaultLanguage = "ja"
+			},
+			wantErr: true,
+			errMsg:  "httpserver.default_language must be one of",
+		},
+		{
+			name: "required groups without group claim",
+			modify: func(c *Config) {
+				c.OIDC.RequiredGroups = []string{"/vpn"}
+			},
+			wantErr: true,
+			errMsg:  "oidc.group_claim is required",
+		},
+		{
+			name: "admin API without credentials",
+			modify: func(c *Config) {
+				c.OIDC.AdminAPI = AdminAPIConfig{Enabled: true, ClientID: "admin"}
+			},
+			wantErr: true,
+			errMsg:  "oidc.admin_api.client_id and oidc.admin_api.client_secret are required",
+		},
+		{
+			name: "invalid username transform regex",
+			modify: func(c *Config) {
+				c.Auth.UsernameTransform = UsernameTransformConfig{Match: "(unclosed"}
+			},
+			wantErr: true,
+			errMsg:  "auth.username_transform.match is not a valid regex",
+		},
+		{
+			name: "invalid username transform target",
+			modify: func(c *Config) {
+				c.Auth.UsernameTransform = UsernameTransformConfig{Match: "@.*$", ApplyTo: "token"}
+			},
+			wantErr: true,
+			errMsg:  "auth.username_transform.apply_to must be one of",
+		},
+		{
+			name: "negative JWKS cache duration",
+			modify: func(c *Config) {
+				c.OIDC.JWKSCacheDuration = -1
+			},
+			wantErr: true,
+			errMsg:  "jwks_cache_duration must not be negative",
+		},
+		{
+			name: "negative discovery retries",
+			modify: func(c *Config) {
+				c.OIDC.DiscoveryRetries = -1
+			},
+			wantErr: true,
+			errMsg:  "oidc.discovery_retries must not be negative",
+		},
+		{
+			name: "discovery retries without backoff",
+			modify: func(c *Config) {
+				c.OIDC.DiscoveryRetries = 3
+				c.OIDC.DiscoveryBackoff = 0
+			},
+			wantErr: true,
+			errMsg:  "oidc.discovery_backoff must be positive",
+		},
+		{
+			name: "unknown client auth method",
+			modify: func(c *Config) {
+				c.OIDC.ClientAuthMethod = "tls_client_auth"
+			},
+			wantErr: true,
+			errMsg:  "oidc.client_auth_method must be one of",
+		},
+		{
+			name: "client_secret_post without secret",
+			modify: func(c *Config) {
+				c.OIDC.ClientAuthMethod = ClientAuthMethodSecretPost
+			},
+			wantErr: true,
+			errMsg:  "oidc.client_secret is required for oidc.client_auth_method client_secret_post",
+		},
+		{
+			name: "client_secret_jwt with short secret",
+			modify: func(c *Config) {
+				c.OIDC.ClientAuthMethod = ClientAuthMethodSecretJWT
+				c.OIDC.ClientSecret = "too-short"
+			},
+			wantErr: true,
+			errMsg:  "oidc.client_secret of at least 32 bytes is required",
+		},
+		{
+			name: "private_key_jwt without key file",
+			modify: func(c *Config) {
+				c.OIDC.ClientAuthMethod = ClientAuthMethodPrivateKeyJWT
+			},
+			wantErr: true,
+			errMsg:  "oidc.client_assertion_key_file is required",
+		},
+		{
+			name: "private_key_jwt with client secret",
+			modify: func(c *Config) {
+				c.OIDC.ClientAuthMethod = ClientAuthMethodPrivateKeyJWT
+				c.OIDC.ClientAssertionKeyFile = "/etc/openvpn-keycloak-auth/client.key"
+				c.OIDC.ClientSecret = "s3cret"
+			},
+			wantErr: true,
+			errMsg:  "oidc.client_secret is not used with oidc.client_auth_method private_key_jwt",
+		},
+		{
+			name: "private_key_jwt",
+			modify: func(c *Config) {
+				c.OIDC.ClientAuthMethod = ClientAuthMethodPrivateKeyJWT
+				c.OIDC.ClientAssertionKeyFile = "/etc/openvpn-keycloak-auth/client.key"
+				c.OIDC.ClientAssertionKeyID = "vpn-1"
+			},
+			wantErr: false,
+		},
+		{
+			name: "assertion key without private_key_jwt",
+			modify: func(c *Config) {
+				c.OIDC.ClientAssertionKeyFile = "/etc/openvpn-keycloak-auth/client.key"
+			},
+			wantErr: true,
+			errMsg:  "require oidc.client_auth_method private_key_jwt",
+		},
+		{
+			name: "negative discovery refresh interval",
+			modify: func(c *Config) {
+				c.OIDC.DiscoveryRefreshInterval = -1
+			},
+			wantErr: true,
+			errMsg:  "oidc.discovery_refresh_interval must not be negative",
+		},
+		{
+			name: "negative clock skew",
+			modify: func(c *Config) {
+				c.OIDC.ClockSkew = -1
+			},
+			wantErr: true,
+			errMsg:  "oidc.clock_skew must be between 0 and 300 seconds",
+		},
+		{
+			name: "clock skew too large",
+			modify: func(c *Config) {
+				c.OIDC.ClockSkew = 301
+			},
+			wantErr: true,
+			errMsg:  "oidc.clock_skew must be between 0 and 300 seconds",
+		},
+		{
+			name: "negative token exchange timeout",
+			modify: func(c *Config) {
+				c.OIDC.TokenExchangeTimeout = -1
+			},
+			wantErr: true,
+			errMsg:  "oidc.token_exchange_timeout must not be negative",
+		},
+		{
+			name: "negative token exchange retries",
+			modify: func(c *Config) {
+				c.OIDC.TokenExchangeRetries = -1
+			},
+			wantErr: true,
+			errMsg:  "oidc.token_exchange_retries must not be negative",
+		},
+		{
+			name: "negative max age",
+			modify: func(c *Config) {
+				c.OIDC.MaxAge = -1
+			},
+			wantErr: true,
+			errMsg:  "oidc.max_age must not be negative",
+		},
+		{
+			name: "acr value with whitespace",
+			modify: func(c *Config) {
+				c.OIDC.ACRValues = []string{"gold silver"}
+			},
+			wantErr: true,
+			errMsg:  "oidc.acr_values[0] must be a non-empty value without whitespace",
+		},
+		{
+			name: "empty required acr",
+			modify: func(c *Config) {
+				c.OIDC.RequiredACR = []string{"gold", " "}
+			},
+			wantErr: true,
+			errMsg:  "oidc.required_acr[1] must not be empty",
+		},
+		{
+			name: "invalid auth time mode",
+			modify: func(c *Config) {
+				c.OIDC.MaxAge = 900
+				c.OIDC.AuthTimeMode = "relaxed"
+			},
+			wantErr: true,
+			errMsg:  "oidc.auth_time_mode must be one of: strict, lenient",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{
+				Listen: ListenConfig{
+					HTTP:   ":9000",
+					Socket: "/tmp/test.sock",
+				},
+				OIDC: OIDCConfig{
+					Issuer:      "https://keycloak.example.com/realms/test",
+					ClientID:    "openvpn",
+					RedirectURI: "http://localhost:9000/callback",
+					Scopes:      []string{"openid"},
+				},
+				Auth: AuthConfig{
+					SessionTimeout: 300,
+					UsernameClaim:  "preferred_username",
+				},
+				Log: LogConfig{
+					Level:  "info",
+					Format: "json",
+				},
+			}
+
+			tt.modify(cfg)
+
+			err := cfg.Validate()
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected error containing '%s', got nil", tt.errMsg)
+				} else if !strings.Contains(err.Error(), tt.errMsg) {
+					t.Errorf("error = %v, want error containing %v", err, tt.errMsg)
+				}
+			} else {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestParseTLSMinVersion(t *testing.T) {
+	tests := []struct {
+		version string
+		want    uint16
+		wantErr bool
+	}{
+		{version: "", want: tls.VersionTLS12},
+		{version: "1.2", want: tls.VersionTLS12},
+		{version: "1.3", want: tls.VersionTLS13},
+		{version: "1.1", wantErr: true},
+		{version: "TLS1.3", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.version, func(t *testing.T) {
+			got, err := ParseTLSMinVersion(tt.version)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected error for %q", tt.version)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseTLSMinVersion(%q) = %#x, want %#x", tt.version, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	tests := []struct {
+		name    string
+		names   []string
+		want    []uint16
+		wantErr string
+	}{
+		{name: "empty", names: nil, want: nil},
+		{
+			name:  "valid suites",
+			names: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", " TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256 "},
+			want:  []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256},
+		},
+		{name: "unknown", names: []string{"TLS_FOO"}, wantErr: `unknown cipher suite "TLS_FOO"`},
+		{name: "insecure", names: []string{"TLS_RSA_WITH_RC4_128_SHA"}, wantErr: "tls.cipher_suites[0]: TLS_RSA_WITH_RC4_128_SHA is insecure"},
+		{name: "TLS 1.3 suite", names: []string{"TLS_AES_128_GCM_SHA256"}, wantErr: "is a TLS 1.3 suite"},
+		{name: "without HTTP/2 suite", names: []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}, wantErr: "required by HTTP/2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseCipherSuites(tt.names)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ParseCipherSuites() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedact(t *testing.T) {
+	cfg := &Config{
+		OIDC: OIDCConfig{
+			ClientSecret: "super-secret",
+		},
+		HTTPServer: HTTPServerConfig{ConfigAPIToken: "api-token"},
+		Session:    SessionConfig{Redis: SessionRedisConfig{Password: "redis-password"}},
+		Auth:       AuthConfig{ExternalAuthorizer: ExternalAuthorizerConfig{BearerToken: "authz-token"}},
+	}
+
+	redacted := cfg.Redact()
+
+	if redacted.OIDC.ClientSecret != "[REDACTED]" {
+		t.Errorf("expected [REDACTED], got %s", redacted.OIDC.ClientSecret)
+	}
+	if redacted.HTTPServer.ConfigAPIToken != "[REDACTED]" {
+		t.Errorf("expected config API token [REDACTED], got %s", redacted.HTTPServer.ConfigAPIToken)
+	}
+	if redacted.Session.Redis.Password != "[REDACTED]" {
+		t.Errorf("expected redis password [REDACTED], got %s", redacted.Session.Redis.Password)
+	}
+	if redacted.Auth.ExternalAuthorizer.BearerToken != "[REDACTED]" {
+		t.Errorf("expected authorizer token [REDACTED], got %s", redacted.Auth.ExternalAuthorizer.BearerToken)
+	}
+
+	// Original should be unchanged
+	if cfg.OIDC.ClientSecret != "super-secret" {
+		t.Errorf("original was modified")
+	}
+}
+
+func TestAccessTokenMergeClaims(t *testing.T) {
+	enabled, disabled := true, false
+	tests := []struct {
+		name string
+		cfg  OIDCConfig
+		want []string
+	}{
+		{name: "default", cfg: OIDCConfig{}, want: DefaultMergeClaims},
+		{name: "enabled", cfg: OIDCConfig{MergeAccessTokenClaims: &enabled}, want: DefaultMergeClaims},
+		{name: "disabled", cfg: OIDCConfig{MergeAccessTokenClaims: &disabled, MergeClaims: []string{"groups"}}, want: nil},
+		{name: "custom claims", cfg: OIDCConfig{MergeClaims: []string{"groups", "department"}}, want: []string{"groups", "department"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.AccessTokenMergeClaims(); !slices.Equal(got, tt.want) {
+				t.Errorf("AccessTokenMergeClaims() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOIDCProviderConfig(t *testing.T) {
+	base := OIDCConfig{
+		Issuer:        "https://keycloak.example.com/realms/employees",
+		ClientID:      "openvpn",
+		ClientSecret:  "secret",
+		RedirectURI:   "https://vpn.example.com/callback",
+		Scopes:        []string{"openid"},
+		RequiredRoles: []string{"vpn-user"},
+		RoleClaim:     "realm_access.roles",
+		Providers:     []OIDCProviderConfig{{Name: "contractors"}},
+	}
+
+	merged := base.ForProvider(OIDCProviderConfig{
+		Name:          "contractors",
+		Issuer:        "https://keycloak.example.com/realms/contractors",
+		ClientID:      "openvpn-contractors",
+		RequiredRoles: []string{"contractor-vpn"},
+	})
+
+	if merged.Issuer != "https://keycloak.example.com/realms/contractors" {
+		t.Errorf("Issuer = %q, want provider issuer", merged.Issuer)
+	}
+	if merged.ClientID != "openvpn-contractors" {
+		t.Errorf("ClientID = %q, want provider client ID", merged.ClientID)
+	}
+	if merged.ClientSecret != "secret" || merged.RedirectURI != base.RedirectURI || merged.RoleClaim != base.RoleClaim {
+		t.Error("expected unset provider fields to inherit top-level settings")
+	}
+	if len(merged.RequiredRoles) != 1 || merged.RequiredRoles[0] != "contractor-vpn" {
+		t.Errorf("RequiredRoles = %v, want [contractor-vpn]", merged.RequiredRoles)
+	}
+	if merged.Providers != nil {
+		t.Error("expected merged config to have no nested providers")
+	}
+
+	// A provider's role_claim replaces the inherited role_claims
+	base.RoleClaims = []string{"realm_access.roles", "resource_access.openvpn.roles"}
+	base.normalizeRoleClaims()
+	merged = base.ForProvider(OIDCProviderConfig{Name: "a"})
+	if merged.RoleClaim != "realm_access.roles" || !slices.Equal(merged.RoleClaimFallbacks, []string{"resource_access.openvpn.roles"}) || !merged.RoleClaimAggregate {
+		t.Errorf("inherited role claims = %q %v aggregate=%v, want role_claims folded in",
+			merged.RoleClaim, merged.RoleClaimFallbacks, merged.RoleClaimAggregate)
+	}
+	merged = base.ForProvider(OIDCProviderConfig{Name: "b", RoleClaim: "roles"})
+	if merged.RoleClaim != "roles" || len(merged.RoleClaimFallbacks) != 0 || merged.RoleClaimAggregate {
+		t.Errorf("provider role claims = %q %v aggregate=%v, want only [roles]",
+			merged.RoleClaim, merged.RoleClaimFallbacks, merged.RoleClaimAggregate)
+	}
+
+	tests := []struct {
+		name       string
+		provider   OIDCProviderConfig
+		username   string
+		commonName string
+		want       bool
+	}{
+		{"cn suffix match", OIDCProviderConfig{CommonNameSuffix: ".contractors"}, "alice", "alice.contractors", true},
+		{"cn suffix mismatch", OIDCProviderConfig{CommonNameSuffix: ".contractors"}, "alice", "alice.staff", false},
+		{"username prefix match", OIDCProviderConfig{UsernamePrefix: "ext-"}, "ext-bob", "", true},
+		{"username prefix mismatch", OIDCProviderConfig{UsernamePrefix: "ext-"}, "bob", "", false},
+		{"both must match", OIDCProviderConfig{CommonNameSuffix: ".contractors", UsernamePrefix: "ext-"}, "bob", "bob.contractors", false},
+		{"no criteria never matches", OIDCProviderConfig{}, "bob", "bob", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.provider.Matches(tt.username, tt.commonName); got != tt.want {
+				t.Errorf("Matches(%q, %q) = %v, want %v", tt.username, tt.commonName, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetupLogging(t *testing.T) {
+	old := slog.Default()
+	t.Cleanup(func() {
+		slog.SetDefault(old)
+	})
+
+	SetupLogging(&LogConfig{Level: "debug", Format: "json"})
+	if !slog.Default().Enabled(context.Background(), slog.LevelDebug) {
+		t.Error("expected debug logs to be enabled")
+	}
+
+	SetupLogging(&LogConfig{Level: "error", Format: "text"})
+	if slog.Default().Enabled(context.Background(), slog.LevelInfo) {
+		t.Error("expected info logs to be disabled at error level")
+	}
+	if !slog.Default().Enabled(context.Background(), slog.LevelError) {
+		t.Error("expected error logs to be enabled")
+	}
+}
+
+// fakeSyslog records messages by syslog severity.
+type fakeSyslog struct {
+	lines []string
+}
+
+func (f *fakeSyslog) Debug(m string) error   { f.lines = append(f.lines, "debug: "+m); return nil }
+func (f *fakeSyslog) Info(m string) error    { f.lines = append(f.lines, "info: "+m); return nil }
+func (f *fakeSyslog) Warning(m string) error { f.lines = append(f.lines, "warning: "+m); return nil }
+func (f *fakeSyslog) Err(m string) error     { f.lines = append(f.lines, "err: "+m); return nil }
+
+func TestSyslogHandler(t *testing.T) {
+	w := &fakeSyslog{}
+	logger := slog.New(newSyslogHandler(w, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	logger.Debug("checking", "n", 1)
+	logger.Info("user authenticated", "username", "john")
+	logger.With("session_id", "abc").Warn("session expired")
+	logger.WithGroup("req").Error("failed", "status", 500)
+
+	want := []string{
+		"debug: msg=checking n=1",
+		"info: msg=\"user authenticated\" username=john",
+		"warning: msg=\"session expired\" session_id=abc",
+		"err: msg=failed req.status=500",
+	}
+	if len(w.lines) != len(want) {
+		t.Fatalf("lines = %q, want %q", w.lines, want)
+	}
+	for i := range want {
+		if w.lines[i] != want[i] {
+			t.Errorf("line %d = %q, want %q", i, w.lines[i], want[i])
+		}
+	}
+
+	quiet := slog.New(newSyslogHandler(w, &slog.HandlerOptions{Level: slog.LevelWarn}))
+	if quiet.Enabled(context.Background(), slog.LevelInfo) {
+		t.Error("expected info to be disabled at warn level")
+	}
+}
+
+func TestSetupLoggingSyslogFallback(t *testing.T) {
+	old := slog.Default()
+	t.Cleanup(func() {
+		slog.SetDefault(old)
+	})
+
+	// An unknown facility cannot be dialed; logging must still work
+	SetupLogging(&LogConfig{Level: "info", Format: "syslog", Syslog: SyslogConfig{Facility: "bogus", Tag: "test"}})
+	if _, ok := slog.Default().Handler().(*slog.JSONHandler); !ok {
+		t.Errorf("handler = %T, want JSON fallback", slog.Default().Handler())
+	}
+}
+
+func TestClientMode(t *testing.T) {
+	if got := (&OIDCConfig{ClientSecret: "s3cret"}).ClientMode(); got != ClientModeConfidential {
+		t.Errorf("ClientMode() with secret = %q, want %q", got, ClientModeConfidential)
+	}
+	if got := (&OIDCConfig{}).ClientMode(); got != ClientModePublic {
+		t.Errorf("ClientMode() without secret = %q, want %q", got, ClientModePublic)
+	}
+	if got := (&OIDCConfig{ClientAuthMethod: ClientAuthMethodPrivateKeyJWT}).ClientMode(); got != ClientModePrivateKeyJWT {
+		t.Errorf("ClientMode() with private_key_jwt = %q, want %q", got, ClientModePrivateKeyJWT)
+	}
+}
+
+func TestIssuerWarnings(t *testing.T) {
+	tests := []struct {
+		name      string
+		cfg       OIDCConfig
+		wantCount int
+		wantKey   string
+	}{
+		{
+			name: "Keycloak realm issuer",
+			cfg:  OIDCConfig{Issuer: "https://keycloak.example.com/realms/myrealm"},
+		},
+		{
+			name: "Keycloak with base path and trailing slash",
+			cfg:  OIDCConfig{Issuer: "https://example.com/auth/realms/myrealm/"},
+		},
+		{
+			name:      "Keycloak base URL",
+			cfg:       OIDCConfig{Issuer: "https://keycloak.example.com"},
+			wantCount: 1,
+			wantKey:   "oidc.issuer",
+		},
+		{
+			name:      "realms without realm name",
+			cfg:       OIDCConfig{Issuer: "https://keycloak.example.com/realms/"},
+			wantCount: 1,
+			wantKey:   "oidc.issuer",
+		},
+		{
+			name:      "non-Keycloak issuer",
+			cfg:       OIDCConfig{Issuer: "https://login.example.com/oauth2/default"},
+			wantCount: 1,
+			wantKey:   "oidc.issuer",
+		},
+		{
+			name: "provider issuer checked, inherited issuer skipped",
+			cfg: OIDCConfig{
+				Issuer: "https://keycloak.example.com/realms/staff",
+				Providers: []OIDCProviderConfig{
+					{Name: "partners", Issuer: "https://keycloak.example.com"},
+					{Name: "contractors", ClientID: "contractors"},
+				},
+			},
+			wantCount: 1,
+			wantKey:   "oidc.providers[partners].issuer",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			warnings := tt.cfg.IssuerWarnings()
+			if len(warnings) != tt.wantCount {
+				t.Fatalf("warnings = %v, want %d", warnings, tt.wantCount)
+			}
+			if tt.wantCount > 0 {
+				if !strings.HasPrefix(warnings[0], tt.wantKey+" ") || !strings.Contains(warnings[0], "/realms/<realm>") {
+					t.Errorf("warning = %q, want %s with Keycloak hint", warnings[0], tt.wantKey)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateSocketPath(t *testing.T) {
+	t.Run("valid path in private directory", func(t *testing.T) {
+		dir := t.TempDir()
+		warnings, err := ValidateSocketPath(filepath.Join(dir, "auth.sock"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(warnings) != 0 {
+			t.Errorf("expected no warnings, got %v", warnings)
+		}
+	})
+
+	t.Run("missing parent under writable ancestor", func(t *testing.T) {
+		dir := t.TempDir()
+		warnings, err := ValidateSocketPath(filepath.Join(dir, "run", "sub", "auth.sock"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(warnings) != 0 {
+			t.Errorf("expected no warnings, got %v", warnings)
+		}
+	})
+
+	t.Run("abstract socket", func(t *testing.T) {
+		warnings, err := ValidateSocketPath("@openvpn-keycloak-auth")
+		if runtime.GOOS != "linux" {
+			if err == nil || !strings.Contains(err.Error(), "only supported on Linux") {
+				t.Fatalf("expected 'only supported on Linux' error, got %v", err)
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(warnings) != 1 || !strings.Contains(warnings[0], "no file permissions") {
+			t.Errorf("expected a permissions warning, got %v", warnings)
+		}
+
+		if _, err := ValidateSocketPath("@"); err == nil || !strings.Contains(err.Error(), "name is empty") {
+			t.Errorf("expected 'name is empty' error, got %v", err)
+		}
+	})
+
+	t.Run("parent is a file", func(t *testing.T) {
+		dir := t.TempDir()
+		file := filepath.Join(dir, "not-a-dir")
+		if err := os.WriteFile(file, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := ValidateSocketPath(filepath.Join(file, "auth.sock"))
+		if err == nil || !strings.Contains(err.Error(), "is not a directory") {
+			t.Fatalf("expected 'is not a directory' error, got %v", err)
+		}
+	})
+
+	t.Run("unwritable parent", func(t *testing.T) {
+		if os.Geteuid() == 0 {
+			t.Skip("root bypasses directory permissions")
+		}
+		dir := t.TempDir()
+		readOnly := filepath.Join(dir, "ro")
+		if err := os.Mkdir(readOnly, 0500); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = os.Chmod(readOnly, 0700) })
+
+		_, err := ValidateSocketPath(filepath.Join(readOnly, "auth.sock"))
+		if err == nil || !strings.Contains(err.Error(), "is not writable") {
+			t.Fatalf("expected 'is not writable' error, got %v", err)
+		}
+	})
+
+	t.Run("world-writable directory warns", func(t *testing.T) {
+		dir := t.TempDir()
+		shared := filepath.Join(dir, "shared")
+		if err := os.Mkdir(shared, 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(shared, 0777); err != nil { // #nosec G302 -- test fixture
+			t.Fatal(err)
+		}
+
+		warnings, err := ValidateSocketPath(filepath.Join(shared, "auth.sock"))
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(warnings) != 1 || !strings.Contains(warnings[0], "world-writable") {
+			t.Errorf("expected world-writable warning, got %v", warnings)
+		}
+	})
+
+	t.Run("empty path", func(t *testing.T) {
+		if _, err := ValidateSocketPath(""); err == nil {
+			t.Fatal("expected error for empty path")
+		}
+	})
+}
+
+func TestStateInstanceID(t *testing.T) {
+	cfg := OIDCConfig{InstanceID: "vpn-1"}
+	if got := cfg.StateInstanceID(); got != "vpn-1" {
+		t.Errorf("StateInstanceID() = %q, want vpn-1", got)
+	}
+
+	// The host name default must itself be a valid instance ID
+	cfg.InstanceID = (&OIDCConfig{}).StateInstanceID()
+	if err := cfg.validateStateSigning(); err != nil || cfg.InstanceID == "" {
+		t.Errorf("default instance ID %q is invalid: %v", cfg.InstanceID, err)
 	}
 }
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// minStateSecretLength is the minimum length of oidc.state_secret.
+const minStateSecretLength = 32
+
+// maxInstanceIDLength bounds oidc.instance_id, which is embedded in every
+// signed state and so in the auth URL sent to OpenVPN clients.
+const maxInstanceIDLength = 32
+
+// instanceIDPattern matches valid instance IDs. Dots separate the parts of
+// a signed state and are not allowed.
+var instanceIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// validateStateSigning checks oidc.state_secret and oidc.instance_id.
+func (c *OIDCConfig) validateStateSigning() error {
+	if c.StateSecret != "" && len(c.StateSecret) < minStateSecretLength {
+		return fmt.Errorf("oidc.state_secret must be at least %d characters", minStateSecretLength)
+	}
+	if c.InstanceID == "" {
+		return nil
+	}
+	if len(c.InstanceID) > maxInstanceIDLength {
+		return fmt.Errorf("oidc.instance_id must not exceed %d characters", maxInstanceIDLength)
+	}
+	if !instanceIDPattern.MatchString(c.InstanceID) {
+		return fmt.Errorf("oidc.instance_id %q may only contain letters, digits, '-' and '_'", c.InstanceID)
+	}
+	return nil
+}
+
+// StateInstanceID returns the instance ID embedded in signed states:
+// oidc.instance_id, or the host name up to the first dot with invalid
+// characters replaced by '-'.
+func (c *OIDCConfig) StateInstanceID() string {
+	if c.InstanceID != "" {
+		return c.InstanceID
+	}
+
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		return "openvpn-sso"
+	}
+	host, _, _ = strings.Cut(host, ".")
+	id := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '-'
+	}, host)
+	if len(id) > maxInstanceIDLength {
+		id = id[:maxInstanceIDLength]
+	}
+	return id
+}
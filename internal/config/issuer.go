@@ -0,0 +1,72 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// IssuerWarnings returns warnings for issuer URLs that do not look like a
+// Keycloak realm (https://host[/base]/realms/<realm>). Pointing issuer at
+// the Keycloak base URL is a common mistake that otherwise surfaces as a
+// confusing discovery failure.
+//
+// These are warnings rather than validation errors because other identity
+// providers use different issuer paths. It is called by the daemon at
+// startup and by check-config.
+func (c *OIDCConfig) IssuerWarnings() []string {
+	var warnings []string
+	if w := issuerWarning("oidc.issuer", c.Issuer); w != "" {
+		warnings = append(warnings, w)
+	}
+	for _, p := range c.Providers {
+		if p.Issuer == "" {
+			continue // inherits oidc.issuer
+		}
+		if w := issuerWarning(fmt.Sprintf("oidc.providers[%s].issuer", p.Name), p.Issuer); w != "" {
+			warnings = append(warnings, w)
+		}
+	}
+	return warnings
+}
+
+// issuerWarning returns a warning for key if issuer has no /realms/<realm>
+// path, or "" if it looks like a Keycloak realm issuer.
+func issuerWarning(key, issuer string) string {
+	u, err := url.Parse(issuer)
+	if err != nil {
+		return "" // reported by Validate
+	}
+
+	segments := strings.Split(strings.Trim(u.Path, "/"), "/")
+	for i := 0; i+1 < len(segments); i++ {
+		if segments[i] == "realms" && segments[i+1] != "" {
+			return ""
+		}
+	}
+
+	return fmt.Sprintf("%s %q has no /realms/<realm> path; Keycloak issuers look like "+
+		"https://keycloak.example.com/realms/<realm> (ignore this if not using Keycloak)", key, issuer)
+}
+
+// Client modes reported by ClientMode.
+const (
+	ClientModeConfidential  = "confidential client with secret"
+	ClientModePrivateKeyJWT = "confidential client with private key"
+	ClientModePublic        = "public client with PKCE"
+)
+
+// ClientMode describes how the daemon authenticates to the token endpoint.
+// PKCE is used in both modes; a confidential client additionally sends
+// client_secret, which the Keycloak client must then require (Client
+// authentication ON) and vice versa. With private_key_jwt the client
+// authenticates with a signed assertion instead of the secret.
+func (c *OIDCConfig) ClientMode() string {
+	if c.ClientAuthMethod == ClientAuthMethodPrivateKeyJWT {
+		return ClientModePrivateKeyJWT
+	}
+	if c.ClientSecret != "" {
+		return ClientModeConfidential
+	}
+	return ClientModePublic
+}
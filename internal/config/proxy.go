@@ -0,0 +1,38 @@
+package config
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// ParseTrustedProxies parses listen.trusted_proxies entries into prefixes.
+// Entries are CIDRs ("10.0.0.0/8"); a bare address is treated as a
+// single-host prefix.
+func ParseTrustedProxies(entries []string) ([]netip.Prefix, error) {
+	return ParseCIDRs("listen.trusted_proxies", entries)
+}
+
+// ParseCIDRs parses a list of CIDRs or bare addresses (single-host
+// prefixes) for the config key named in errors.
+func ParseCIDRs(key string, entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for i, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil || addr.Zone() != "" {
+				return nil, fmt.Errorf("%s[%d]: invalid CIDR or address %q", key, i, entry)
+			}
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%s[%d]: invalid CIDR %q", key, i, entry)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
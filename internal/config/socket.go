@@ -0,0 +1,85 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// ValidateSocketPath checks that the IPC socket at path can be created by the
+// current process. It returns an error if the socket's parent directory (or
+// the nearest existing ancestor, if the parent does not exist yet) is not a
+// writable directory, and warnings for locations that undermine the socket's
+// group-only (0660) permissions.
+//
+// A path starting with "@" names a Linux abstract namespace socket, which
+// needs no directory but has no permissions either; it is accepted with a
+// warning on Linux and rejected elsewhere.
+//
+// This is intentionally separate from Validate: the auth script also loads
+// the config but runs as the OpenVPN user, which is not expected to be able
+// to create the socket. It is called by the daemon at startup and by
+// check-config.
+func ValidateSocketPath(path string) (warnings []string, err error) {
+	if path == "" {
+		return nil, fmt.Errorf("listen.socket is required")
+	}
+
+	if name, ok := strings.CutPrefix(path, "@"); ok {
+		if runtime.GOOS != "linux" {
+			return nil, fmt.Errorf("listen.socket: abstract sockets (%s) are only supported on Linux", path)
+		}
+		if name == "" {
+			return nil, fmt.Errorf("listen.socket: abstract socket name is empty")
+		}
+		return []string{fmt.Sprintf(
+			"listen.socket: abstract socket %s has no file permissions; any local user can connect and submit auth requests",
+			path)}, nil
+	}
+
+	parent := filepath.Dir(filepath.Clean(path))
+
+	// Find the nearest existing ancestor; Start creates missing directories.
+	dir := parent
+	for {
+		info, statErr := os.Stat(dir)
+		if statErr == nil {
+			if !info.IsDir() {
+				return nil, fmt.Errorf("listen.socket: %s is not a directory", dir)
+			}
+			break
+		}
+		if !errors.Is(statErr, os.ErrNotExist) {
+			return nil, fmt.Errorf("listen.socket: cannot stat %s: %w", dir, statErr)
+		}
+
+		next := filepath.Dir(dir)
+		if next == dir {
+			return nil, fmt.Errorf("listen.socket: no existing ancestor directory for %s", parent)
+		}
+		dir = next
+	}
+
+	// Need write+search permission to create the socket (or its directories).
+	if err := unix.Access(dir, unix.W_OK|unix.X_OK); err != nil {
+		if dir == parent {
+			return nil, fmt.Errorf("listen.socket: directory %s is not writable: %w", dir, err)
+		}
+		return nil, fmt.Errorf("listen.socket: cannot create directory %s: %s is not writable: %w", parent, dir, err)
+	}
+
+	// The socket itself is restricted to owner+group, but a world-writable
+	// directory lets any local user delete or replace it.
+	if info, statErr := os.Stat(dir); statErr == nil && info.Mode().Perm()&0002 != 0 {
+		warnings = append(warnings, fmt.Sprintf(
+			"listen.socket: directory %s is world-writable; other local users could replace the socket (use a dedicated directory such as /run/openvpn-keycloak-auth)",
+			dir))
+	}
+
+	return warnings, nil
+}
@@ -0,0 +1,154 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"log/syslog"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// syslogFacilities maps the facility names accepted in log.syslog.facility
+// to their syslog priority.
+var syslogFacilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// validateSyslogFacility checks that name is a known syslog facility.
+func validateSyslogFacility(name string) error {
+	if _, ok := syslogFacilities[name]; ok {
+		return nil
+	}
+	names := make([]string, 0, len(syslogFacilities))
+	for n := range syslogFacilities {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("log.syslog.facility must be one of: %s", strings.Join(names, ", "))
+}
+
+// syslogWriter is the subset of *syslog.Writer used by syslogHandler.
+type syslogWriter interface {
+	Debug(m string) error
+	Info(m string) error
+	Warning(m string) error
+	Err(m string) error
+}
+
+// syslogOutput is shared by a syslogHandler and the handlers derived from it
+// with WithAttrs/WithGroup, so records are formatted and sent one at a time.
+type syslogOutput struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+	w   syslogWriter
+}
+
+// syslogHandler is a slog.Handler that sends records to the local syslog
+// daemon. Records are formatted as key=value text without time and level:
+// syslog adds its own timestamp and the level maps to the syslog severity.
+type syslogHandler struct {
+	out  *syslogOutput
+	text slog.Handler
+}
+
+// newSyslogHandler returns a handler writing to w.
+func newSyslogHandler(w syslogWriter, opts *slog.HandlerOptions) *syslogHandler {
+	out := &syslogOutput{w: w}
+	textOpts := &slog.HandlerOptions{
+		Level: opts.Level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey) {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}
+	return &syslogHandler{
+		out:  out,
+		text: slog.NewTextHandler(&out.buf, textOpts),
+	}
+}
+
+func (h *syslogHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.text.Enabled(ctx, level)
+}
+
+func (h *syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.out.mu.Lock()
+	defer h.out.mu.Unlock()
+
+	h.out.buf.Reset()
+	if err := h.text.Handle(ctx, r); err != nil {
+		return err
+	}
+	msg := strings.TrimSuffix(h.out.buf.String(), "\n")
+
+	switch {
+	case r.Level >= slog.LevelError:
+		return h.out.w.Err(msg)
+	case r.Level >= slog.LevelWarn:
+		return h.out.w.Warning(msg)
+	case r.Level >= slog.LevelInfo:
+		return h.out.w.Info(msg)
+	default:
+		return h.out.w.Debug(msg)
+	}
+}
+
+func (h *syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &syslogHandler{out: h.out, text: h.text.WithAttrs(attrs)}
+}
+
+func (h *syslogHandler) WithGroup(name string) slog.Handler {
+	return &syslogHandler{out: h.out, text: h.text.WithGroup(name)}
+}
+
+// activeSyslog is the connection used by the current default logger, closed
+// when SetupLogging replaces it (e.g. on config reload).
+var (
+	activeSyslogMu sync.Mutex
+	activeSyslog   *syslog.Writer
+)
+
+// setActiveSyslog records w as the current syslog connection and closes the
+// previous one. w may be nil when syslog is no longer used.
+func setActiveSyslog(w *syslog.Writer) {
+	activeSyslogMu.Lock()
+	defer activeSyslogMu.Unlock()
+	if activeSyslog != nil && activeSyslog != w {
+		_ = activeSyslog.Close()
+	}
+	activeSyslog = w
+}
+
+// dialSyslog connects to the local syslog daemon with the configured
+// facility and tag.
+func dialSyslog(cfg *SyslogConfig) (*syslog.Writer, error) {
+	facility, ok := syslogFacilities[cfg.Facility]
+	if !ok {
+		return nil, validateSyslogFacility(cfg.Facility)
+	}
+	return syslog.New(facility|syslog.LOG_INFO, cfg.Tag)
+}
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ParseTLSMinVersion parses tls.min_version ("1.2" or "1.3") into a
+// crypto/tls version constant. An empty value means TLS 1.2.
+func ParseTLSMinVersion(version string) (uint16, error) {
+	switch strings.TrimSpace(version) {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("tls.min_version must be one of: 1.2, 1.3 (got %q)", version)
+	}
+}
+
+// ParseCipherSuites parses tls.cipher_suites entries, given by their
+// crypto/tls names (e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"), into
+// suite IDs. Only suites Go considers secure are accepted. TLS 1.3 suites
+// cannot be configured and are rejected. HTTP/2 requires an
+// ECDHE AES-128-GCM suite, so the list must contain one. An empty list
+// returns nil.
+func ParseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for i, name := range names {
+		name = strings.TrimSpace(name)
+		suite := findCipherSuite(tls.CipherSuites(), name)
+		if suite == nil {
+			if findCipherSuite(tls.InsecureCipherSuites(), name) != nil {
+				return nil, fmt.Errorf("tls.cipher_suites[%d]: %s is insecure", i, name)
+			}
+			return nil, fmt.Errorf("tls.cipher_suites[%d]: unknown cipher suite %q", i, name)
+		}
+		if !slices.Contains(suite.SupportedVersions, tls.VersionTLS12) {
+			return nil, fmt.Errorf("tls.cipher_suites[%d]: %s is a TLS 1.3 suite, which cannot be configured", i, name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	if !slices.Contains(ids, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256) &&
+		!slices.Contains(ids, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256) {
+		return nil, fmt.Errorf("tls.cipher_suites must include TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or " +
+			"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 (required by HTTP/2)")
+	}
+	return ids, nil
+}
+
+// findCipherSuite returns the suite in suites with the given name, or nil.
+func findCipherSuite(suites []*tls.CipherSuite, name string) *tls.CipherSuite {
+	for _, suite := range suites {
+		if suite.Name == name {
+			return suite
+		}
+	}
+	return nil
+}
@@ -3,85 +3,424 @@ package daemon
 
 import (
 	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
 	"path"
+	"reflect"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"net/url"
 
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/audit"
 	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
 	"github.com/al-bashkir/openvpn-keycloak-auth/internal/httpserver"
 	"github.com/al-bashkir/openvpn-keycloak-auth/internal/ipc"
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/metrics"
 	"github.com/al-bashkir/openvpn-keycloak-auth/internal/oidc"
 	"github.com/al-bashkir/openvpn-keycloak-auth/internal/openvpn"
 	"github.com/al-bashkir/openvpn-keycloak-auth/internal/session"
+	"github.com/redis/go-redis/v9"
 )
 
 // Daemon represents the main daemon process that coordinates all components.
 type Daemon struct {
-	cfg          *config.Config
-	oidcProvider *oidc.Provider
-	sessionMgr   *session.Manager
-	httpServer   *httpserver.Server
-	ipcServer    *ipc.Server
+	sessionMgr *session.Manager
+	httpServer *httpserver.Server
+	ipcServer  *ipc.Server
+	metrics    *metrics.Metrics
+	readiness  *httpserver.Readiness
+	audit      audit.Audit // nil when audit.file is not set
+
+	// mu guards cfg and providers, which are replaced by ReloadConfig.
+	mu        sync.RWMutex
+	cfg       *config.Config
+	providers *oidc.Registry
+
+	// loadConfig re-reads the configuration on SIGHUP (nil disables reload).
+	loadConfig func() (*config.Config, error)
+
+	version      string      // release version, reported in snapshots
+	snapshotting atomic.Bool // a SIGUSR2 snapshot is being written
+	snapshotKey  [32]byte    // keys the pseudonyms of users in snapshots
 }
 
 // New creates a new daemon with all components initialized.
 func New(cfg *config.Config) (*Daemon, error) {
-	// Initialize OIDC provider
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+	return NewWithContext(context.Background(), cfg)
+}
+
+// NewWithContext is New with a context that aborts startup, e.g. while
+// OIDC discovery is waiting to retry.
+func NewWithContext(ctx context.Context, cfg *config.Config) (*Daemon, error) {
+	// Fail early if the IPC socket cannot be created
+	socketWarnings, err := config.ValidateSocketPath(cfg.Listen.Socket)
+	if err != nil {
+		return nil, err
+	}
+	for _, w := range socketWarnings {
+		slog.Warn("socket path check", "warning", w)
+	}
+
+	// Log likely issuer mistakes before discovery fails on them
+	for _, w := range cfg.OIDC.IssuerWarnings() {
+		slog.Warn("issuer check", "warning", w)
+	}
 
-	oidcProvider, err := oidc.NewProvider(ctx, &cfg.OIDC)
+	// Initialize OIDC provider, retrying while the issuer is unreachable
+	providers, err := discoverProviders(ctx, &cfg.OIDC, cfg.OIDC.DiscoveryRetries,
+		time.Duration(cfg.OIDC.DiscoveryBackoff)*time.Second)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialize OIDC provider: %w", err)
 	}
 
+	readiness := httpserver.NewReadiness()
+	readiness.SetOIDCReady()
+
 	slog.Info("OIDC provider initialized",
 		"issuer", cfg.OIDC.Issuer,
 		"client_id", cfg.OIDC.ClientID,
+		"client_mode", cfg.OIDC.ClientMode(),
 	)
+	for _, p := range cfg.OIDC.Providers {
+		providerCfg := cfg.OIDC.ForProvider(p)
+		slog.Info("additional OIDC provider initialized",
+			"provider", p.Name,
+			"issuer", providerCfg.Issuer,
+			"client_id", providerCfg.ClientID,
+			"client_mode", providerCfg.ClientMode(),
+		)
+	}
+	logClientModeWarnings(cfg, providers)
+
+	if cfg.OIDC.AdminAPI.Enabled {
+		adminCtx, cancel := context.WithTimeout(ctx, discoveryAttemptTimeout)
+		checkRequiredRoles(adminCtx, cfg, providers)
+		cancel()
+	}
+
+	if cfg.Daemon.DryRun {
+		slog.Warn("dry run enabled: OpenVPN control files are not written, clients will not be connected")
+	}
 
 	// Initialize session manager
 	sessionTimeout := time.Duration(cfg.Auth.SessionTimeout) * time.Second
-	sessionMgr := session.NewManager(sessionTimeout)
+	sessionMgr := session.NewManager(sessionTimeout, time.Duration(cfg.Session.CleanupInterval)*time.Second)
+	sessionMgr.SetMaxSessionsPerUser(cfg.Auth.MaxSessionsPerUser)
+	sessionMgr.SetSingleIPPerUser(cfg.Auth.SingleIPPerUser, time.Duration(cfg.Auth.SingleIPGracePeriod)*time.Second)
+	switch cfg.Session.Store {
+	case config.SessionStoreFile:
+		loaded, err := sessionMgr.SetStore(session.NewFileStore(cfg.Session.File))
+		if err != nil {
+			sessionMgr.Stop()
+			return nil, fmt.Errorf("failed to load sessions: %w", err)
+		}
+		slog.Info("session store loaded", "file", cfg.Session.File, "sessions", loaded)
+	case config.SessionStoreRedis:
+		store, err := newRedisStore(ctx, cfg.Session.Redis)
+		if err != nil {
+			sessionMgr.Stop()
+			return nil, err
+		}
+		if _, err := sessionMgr.SetStore(store); err != nil {
+			_ = store.Close()
+			sessionMgr.Stop()
+			return nil, fmt.Errorf("failed to attach session store: %w", err)
+		}
+		slog.Info("session store connected", "redis", cfg.Session.Redis.Addr, "db", cfg.Session.Redis.DB)
+	}
 
 	slog.Info("session manager initialized",
 		"timeout", sessionTimeout,
+		"max_sessions_per_user", cfg.Auth.MaxSessionsPerUser,
 	)
 
+	// Initialize metrics (registry is per-daemon, not the global default)
+	var m *metrics.Metrics
+	if cfg.Observability.MetricsBackend == config.MetricsBackendBuiltin {
+		m = metrics.NewBuiltin(sessionMgr)
+	} else {
+		m = metrics.New(sessionMgr)
+	}
+
 	// Initialize HTTP server
-	httpServer, err := httpserver.NewServer(cfg, oidcProvider, sessionMgr)
+	httpServer, err := httpserver.NewServer(cfg, providers, sessionMgr, m, readiness)
 	if err != nil {
 		sessionMgr.Stop()
 		return nil, fmt.Errorf("failed to initialize HTTP server: %w", err)
 	}
 
+	// Initialize audit trail
+	var auditor audit.Audit
+	if cfg.Audit.File != "" {
+		sink, err := audit.NewFileSink(cfg.Audit.File)
+		if err != nil {
+			sessionMgr.Stop()
+			return nil, err
+		}
+		auditor = sink
+		httpServer.SetAudit(auditor)
+
+		slog.Info("audit trail enabled", "file", cfg.Audit.File)
+	}
+
+	if a := cfg.Auth.ExternalAuthorizer; a.URL != "" {
+		slog.Info("external authorizer enabled",
+			"url", a.URL,
+			"mode", a.Mode,
+			"fail_open", a.FailOpen,
+		)
+	}
+
+	httpListen := cfg.Listen.HTTP
+	if cfg.Listen.HTTPSocket != "" {
+		httpListen = "unix:" + cfg.Listen.HTTPSocket
+	}
 	slog.Info("HTTP server initialized",
-		"listen", cfg.Listen.HTTP,
+		"listen", httpListen,
 		"tls", cfg.TLS.Enabled,
 	)
 
-	// Initialize IPC server with auth handler
-	ipcServer := ipc.NewServer(cfg.Listen.Socket, func(ctx context.Context, req *ipc.AuthRequest) (*ipc.AuthResponse, error) {
-		return handleAuthRequest(ctx, cfg, oidcProvider, sessionMgr, req)
+	d := &Daemon{
+		cfg:        cfg,
+		providers:  providers,
+		sessionMgr: sessionMgr,
+		httpServer: httpServer,
+		metrics:    m,
+		readiness:  readiness,
+		audit:      auditor,
+	}
+	// crypto/rand.Read never fails
+	_, _ = rand.Read(d.snapshotKey[:])
+
+	sessionMgr.SetWriter(controlFileWriter(cfg))
+	httpServer.SetWriter(controlFileWriter(cfg))
+
+	sessionMgr.OnFailure(func(sess *session.Session, reason string) {
+		outcome := metrics.OutcomeFailure
+		if reason == session.TimeoutReason {
+			outcome = metrics.OutcomeTimeout
+		}
+		m.AuthFinished(outcome, sess.PendingAuthMethod, sess.CreatedAt)
+		d.recordFailure(sess, reason)
 	})
 
+	// Initialize IPC server with auth handler
+	d.ipcServer = ipc.NewServer(cfg.Listen.Socket, d.handleAuthRequest)
+	d.ipcServer.SetStatusHandler(d.handleStatusQuery)
+	d.ipcServer.SetSessionHandlers(d.handleListSessions, d.handleKillSession)
+	d.ipcServer.SetCancelHandler(d.handleCancel)
+	d.ipcServer.SetMaxRequestSize(int64(cfg.Listen.MaxIPCRequestBytes))
+	d.ipcServer.SetTimeout(time.Duration(cfg.Listen.IPCTimeout) * time.Second)
+	if len(cfg.Listen.SocketAllowedUIDs) > 0 {
+		uids := make([]uint32, len(cfg.Listen.SocketAllowedUIDs))
+		for i, uid := range cfg.Listen.SocketAllowedUIDs {
+			uids[i] = uint32(uid) // #nosec G115 -- range checked by config validation
+		}
+		d.ipcServer.SetAllowedUIDs(uids)
+	}
+
 	slog.Info("IPC server initialized",
 		"socket", cfg.Listen.Socket,
+		"allowed_uids", cfg.Listen.SocketAllowedUIDs,
 	)
 
-	return &Daemon{
-		cfg:          cfg,
-		oidcProvider: oidcProvider,
-		sessionMgr:   sessionMgr,
-		httpServer:   httpServer,
-		ipcServer:    ipcServer,
-	}, nil
+	return d, nil
+}
+
+// SetBuildInfo sets the daemon's build, which /health reports. IPC clients
+// reporting a different release version are logged, or rejected with
+// listen.strict_version_match. Call it before Run.
+func (d *Daemon) SetBuildInfo(info httpserver.BuildInfo) {
+	d.version = info.Version
+	cfg, _ := d.current()
+	d.ipcServer.SetVersionCheck(info.Version, cfg.Listen.StrictVersionMatch)
+	d.httpServer.SetBuildInfo(info)
+}
+
+// SetConfigLoader sets the function used to re-read the configuration on
+// SIGHUP. Without a loader, SIGHUP only reloads the TLS certificate.
+func (d *Daemon) SetConfigLoader(load func() (*config.Config, error)) {
+	d.loadConfig = load
+}
+
+// controlFileWriter returns the writer for OpenVPN's control files under
+// cfg: it guards against overwriting results written by other processes
+// and writes nothing in dry-run mode.
+func controlFileWriter(cfg *config.Config) openvpn.Writer {
+	return openvpn.FileWriter{
+		PreserveExistingResult: cfg.Auth.PreserveExistingResult,
+		DryRun:                 cfg.Daemon.DryRun,
+	}
+}
+
+// current returns the configuration and OIDC providers to use for a request.
+func (d *Daemon) current() (*config.Config, *oidc.Registry) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.cfg, d.providers
+}
+
+// ReloadConfig re-reads the configuration and applies it without dropping
+// in-flight sessions. Logging, session timeout, authorization settings
+// (required/denied roles and groups, claims, username handling), the
+// shutdown drain timeout, dry-run mode, the HTTP rate limits
+// (listen.rate_limit) and OIDC providers are swapped;
+// providers are only rediscovered when their issuer or client settings
+// changed. Settings that cannot change at runtime (listen addresses, TLS,
+// HTTP server and observability options, crtext route) keep their current
+// values and a restart is requested in the log.
+//
+// On error the current configuration stays in effect.
+func (d *Daemon) ReloadConfig(ctx context.Context) error {
+	if d.loadConfig == nil {
+		return fmt.Errorf("config reload not supported")
+	}
+
+	newCfg, err := d.loadConfig()
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %w", err)
+	}
+
+	oldCfg, oldProviders := d.current()
+
+	for _, key := range restartRequired(oldCfg, newCfg) {
+		slog.Warn("config change requires a restart to take effect; keeping current value", "setting", key)
+	}
+	rateLimit := newCfg.Listen.RateLimit
+	newCfg.Listen = oldCfg.Listen
+	newCfg.Listen.RateLimit = rateLimit
+	newCfg.TLS = oldCfg.TLS
+	newCfg.HTTPServer = oldCfg.HTTPServer
+	newCfg.Observability = oldCfg.Observability
+	newCfg.Auth.EnableCRText = oldCfg.Auth.EnableCRText
+	newCfg.Audit = oldCfg.Audit
+	newCfg.Systemd = oldCfg.Systemd
+	newCfg.Health = oldCfg.Health
+	newCfg.Session = oldCfg.Session
+	newCfg.OIDC.DiscoveryRefreshInterval = oldCfg.OIDC.DiscoveryRefreshInterval
+
+	providers, err := oidc.ReloadRegistry(ctx, oldProviders, &newCfg.OIDC)
+	if err != nil {
+		return fmt.Errorf("failed to initialize OIDC provider: %w", err)
+	}
+
+	config.SetupLogging(&newCfg.Log)
+	d.sessionMgr.SetWriter(controlFileWriter(newCfg))
+	d.httpServer.SetWriter(controlFileWriter(newCfg))
+	d.sessionMgr.SetTimeout(time.Duration(newCfg.Auth.SessionTimeout) * time.Second)
+	d.sessionMgr.SetMaxSessionsPerUser(newCfg.Auth.MaxSessionsPerUser)
+	d.sessionMgr.SetSingleIPPerUser(newCfg.Auth.SingleIPPerUser, time.Duration(newCfg.Auth.SingleIPGracePeriod)*time.Second)
+
+	d.mu.Lock()
+	d.cfg = newCfg
+	d.providers = providers
+	d.mu.Unlock()
+	d.httpServer.Reconfigure(newCfg, providers)
+
+	slog.Info("configuration reloaded",
+		"issuer", newCfg.OIDC.Issuer,
+		"client_id", newCfg.OIDC.ClientID,
+		"session_timeout", newCfg.Auth.SessionTimeout,
+		"log_level", newCfg.Log.Level,
+	)
+
+	if newCfg.OIDC.AdminAPI.Enabled {
+		checkRequiredRoles(ctx, newCfg, providers)
+	}
+
+	return nil
+}
+
+// drain keeps the HTTP server running until its in-flight callbacks have
+// finished or shutdown.drain_timeout has passed.
+func (d *Daemon) drain() {
+	cfg, _ := d.current()
+	timeout := time.Duration(cfg.Shutdown.DrainTimeout) * time.Second
+	if timeout <= 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if remaining := d.httpServer.Drain(ctx); remaining > 0 {
+		slog.Warn("drain timeout reached, shutting down with callbacks in flight",
+			"remaining", remaining, "drain_timeout", timeout)
+		return
+	}
+	slog.Info("no callbacks in flight")
+}
+
+// restartRequired returns the config keys that differ between oldCfg and
+// newCfg but can only be applied by restarting the daemon.
+func restartRequired(oldCfg, newCfg *config.Config) []string {
+	var keys []string
+	if oldCfg.Listen.HTTP != newCfg.Listen.HTTP {
+		keys = append(keys, "listen.http")
+	}
+	if oldCfg.Listen.Socket != newCfg.Listen.Socket {
+		keys = append(keys, "listen.socket")
+	}
+	if oldCfg.Listen.HTTPSocket != newCfg.Listen.HTTPSocket {
+		keys = append(keys, "listen.http_socket")
+	}
+	if !slices.Equal(oldCfg.Listen.TrustedProxies, newCfg.Listen.TrustedProxies) {
+		keys = append(keys, "listen.trusted_proxies")
+	}
+	if !slices.Equal(oldCfg.Listen.AllowedCIDRs, newCfg.Listen.AllowedCIDRs) {
+		keys = append(keys, "listen.allowed_cidrs")
+	}
+	if !slices.Equal(oldCfg.Listen.HealthAllowedCIDRs, newCfg.Listen.HealthAllowedCIDRs) {
+		keys = append(keys, "listen.health_allowed_cidrs")
+	}
+	if !slices.Equal(oldCfg.Listen.SocketAllowedUIDs, newCfg.Listen.SocketAllowedUIDs) {
+		keys = append(keys, "listen.socket_allowed_uids")
+	}
+	if oldCfg.Listen.MaxIPCRequestBytes != newCfg.Listen.MaxIPCRequestBytes {
+		keys = append(keys, "listen.max_ipc_request_bytes")
+	}
+	if oldCfg.Listen.IPCTimeout != newCfg.Listen.IPCTimeout {
+		keys = append(keys, "listen.ipc_timeout")
+	}
+	if oldCfg.Listen.StrictVersionMatch != newCfg.Listen.StrictVersionMatch {
+		keys = append(keys, "listen.strict_version_match")
+	}
+	if !reflect.DeepEqual(oldCfg.TLS, newCfg.TLS) {
+		keys = append(keys, "tls")
+	}
+	if oldCfg.HTTPServer != newCfg.HTTPServer {
+		keys = append(keys, "httpserver")
+	}
+	if oldCfg.Observability != newCfg.Observability {
+		keys = append(keys, "observability")
+	}
+	if oldCfg.Auth.EnableCRText != newCfg.Auth.EnableCRText {
+		keys = append(keys, "auth.enable_crtext")
+	}
+	if oldCfg.Audit != newCfg.Audit {
+		keys = append(keys, "audit")
+	}
+	if oldCfg.Systemd != newCfg.Systemd {
+		keys = append(keys, "systemd")
+	}
+	if oldCfg.Health != newCfg.Health {
+		keys = append(keys, "health")
+	}
+	if oldCfg.Session != newCfg.Session {
+		keys = append(keys, "session")
+	}
+	if oldCfg.OIDC.DiscoveryRefreshInterval != newCfg.OIDC.DiscoveryRefreshInterval {
+		keys = append(keys, "oidc.discovery_refresh_interval")
+	}
+	return keys
 }
 
 // Run starts all daemon components and blocks until shutdown signal is received.
@@ -93,8 +432,20 @@ func (d *Daemon) Run() error {
 	if err := d.ipcServer.Start(ctx); err != nil {
 		return fmt.Errorf("failed to start IPC server: %w", err)
 	}
+	d.readiness.SetIPCReady()
+
+	// Bind the HTTP port synchronously so readiness is only reported once
+	// both listeners are open
+	if err := d.httpServer.Listen(); err != nil {
+		slog.Error("HTTP server failed to start", "error", err)
+		if stopErr := d.ipcServer.Stop(); stopErr != nil {
+			slog.Error("error stopping IPC server after HTTP server startup failure", "error", stopErr)
+		}
+		d.sessionMgr.Stop()
+		return fmt.Errorf("HTTP server failed: %w", err)
+	}
 
-	// Start HTTP server in a goroutine (it blocks on ListenAndServe)
+	// Start HTTP server in a goroutine (it blocks on Serve)
 	httpErrCh := make(chan error, 1)
 	go func() {
 		if err := d.httpServer.Start(); err != nil && err.Error() != "http: Server closed" {
@@ -103,34 +454,97 @@ func (d *Daemon) Run() error {
 		close(httpErrCh)
 	}()
 
-	// Wait for shutdown signal or startup error
+	// Wait for shutdown signal or startup error.
+	// SIGHUP reloads the configuration and TLS certificate and keeps running.
+	// SIGUSR2 writes a diagnostic snapshot (daemon.snapshot_file).
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR2)
+	defer signal.Stop(sigCh)
 
-	select {
-	case sig := <-sigCh:
-		slog.Info("shutdown signal received", "signal", sig.String())
-	case err := <-httpErrCh:
-		if err != nil {
-			slog.Error("HTTP server failed to start", "error", err)
-			// Clean up IPC server before returning
-			if stopErr := d.ipcServer.Stop(); stopErr != nil {
-				slog.Error("error stopping IPC server after HTTP server startup failure", "error", stopErr)
+	// OIDC discovery ran in New, and both listeners are open
+	cfg, _ := d.current()
+	watchdogStop := make(chan struct{})
+	defer close(watchdogStop)
+	if cfg.Systemd.Notify {
+		var check func() error
+		if cfg.Health.WatchdogSelftest {
+			check = d.watchdogSelfTest
+		}
+		notifyReady(watchdogStop, check)
+	} else {
+		if cfg.Health.WatchdogSelftest {
+			slog.Warn("health.watchdog_selftest has no effect without systemd.notify")
+		}
+		// systemd only sets NOTIFY_SOCKET for units expecting notifications
+		if os.Getenv("NOTIFY_SOCKET") != "" {
+			slog.Warn("NOTIFY_SOCKET is set but systemd.notify is disabled; " +
+				"a Type=notify unit will time out waiting for readiness")
+		}
+	}
+
+	refreshStop := make(chan struct{})
+	defer close(refreshStop)
+	if interval := cfg.OIDC.DiscoveryRefreshInterval; interval > 0 {
+		go d.refreshDiscovery(refreshStop, time.Duration(interval)*time.Second)
+	}
+
+wait:
+	for {
+		select {
+		case sig := <-sigCh:
+			if sig == syscall.SIGUSR2 {
+				d.handleSnapshotSignal()
+				continue
+			}
+			if sig == syscall.SIGHUP {
+				if d.loadConfig != nil {
+					reloadCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+					if err := d.ReloadConfig(reloadCtx); err != nil {
+						slog.Error("configuration reload failed, keeping current configuration", "error", err)
+					}
+					cancel()
+				}
+				if err := d.httpServer.ReloadTLS(); err != nil {
+					slog.Error("TLS certificate reload failed, keeping current certificate", "error", err)
+				}
+				continue
+			}
+			slog.Info("shutdown signal received", "signal", sig.String())
+			break wait
+		case err := <-httpErrCh:
+			if err != nil {
+				slog.Error("HTTP server failed to start", "error", err)
+				// Clean up IPC server before returning
+				if stopErr := d.ipcServer.Stop(); stopErr != nil {
+					slog.Error("error stopping IPC server after HTTP server startup failure", "error", stopErr)
+				}
+				d.sessionMgr.Stop()
+				return fmt.Errorf("HTTP server failed: %w", err)
 			}
-			d.sessionMgr.Stop()
-			return fmt.Errorf("HTTP server failed: %w", err)
+			break wait
 		}
 	}
 
-	// Shutdown gracefully
-	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+	// Report not ready first so load balancers stop routing new logins here
+	d.readiness.SetShuttingDown()
+	if cfg.Systemd.Notify {
+		if _, err := sdNotify("STOPPING=1"); err != nil {
+			slog.Warn("systemd stopping notification failed", "error", err)
+		}
+	}
 
-	// Stop IPC server
+	// Stop IPC server, so no new logins start
 	if err := d.ipcServer.Stop(); err != nil {
 		slog.Error("error stopping IPC server", "error", err)
 	}
 
+	// Let callbacks already in progress write their result
+	d.drain()
+
+	// Shutdown gracefully
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
 	// Stop HTTP server
 	if err := d.httpServer.Shutdown(shutdownCtx); err != nil {
 		slog.Error("error stopping HTTP server", "error", err)
@@ -139,99 +553,475 @@ func (d *Daemon) Run() error {
 	// Stop session manager
 	d.sessionMgr.Stop()
 
+	if d.audit != nil {
+		if err := d.audit.Close(); err != nil {
+			slog.Error("error closing audit file", "error", err)
+		}
+	}
+
 	slog.Info("daemon shutdown complete")
 	return nil
 }
 
+// logClientModeWarnings logs conflicts between each provider's client mode
+// and its issuer's discovery document.
+func logClientModeWarnings(cfg *config.Config, providers *oidc.Registry) {
+	names := []string{config.DefaultOIDCProvider}
+	for _, p := range cfg.OIDC.Providers {
+		names = append(names, p.Name)
+	}
+
+	for _, name := range names {
+		p, ok := providers.Get(name)
+		if !ok {
+			continue
+		}
+		for _, w := range p.ClientModeWarnings() {
+			slog.Warn("OIDC client mode check", "provider", name, "warning", w)
+		}
+	}
+}
+
+// handleStatusQuery reports the state of a session to an IPC client.
+func (d *Daemon) handleStatusQuery(ctx context.Context, req *ipc.StatusQuery) (*ipc.StatusResponse, error) {
+	resp := &ipc.StatusResponse{SessionID: req.SessionID}
+
+	status, err := d.sessionMgr.Status(req.SessionID)
+	if err != nil {
+		resp.State = ipc.SessionStateUnknown
+		resp.Error = err.Error()
+		return resp, nil
+	}
+
+	switch status {
+	case session.StatusSuccess:
+		resp.State = ipc.SessionStateSuccess
+	case session.StatusFailure:
+		resp.State = ipc.SessionStateFailure
+	default:
+		resp.State = ipc.SessionStatePending
+	}
+	return resp, nil
+}
+
+// killedSessionReason is written as the failure reason for sessions killed
+// with the sessions kill command.
+const killedSessionReason = "Login cancelled by an administrator"
+
+// handleListSessions handles list_sessions requests from the sessions command.
+func (d *Daemon) handleListSessions(ctx context.Context, req *ipc.ListSessionsRequest) (*ipc.ListSessionsResponse, error) {
+	sessions := d.sessionMgr.List()
+	resp := &ipc.ListSessionsResponse{Sessions: make([]ipc.SessionInfo, 0, len(sessions))}
+	for _, sess := range sessions {
+		state := ipc.SessionStatePending
+		switch sess.Result {
+		case session.StatusSuccess:
+			state = ipc.SessionStateSuccess
+		case session.StatusFailure:
+			state = ipc.SessionStateFailure
+		}
+		resp.Sessions = append(resp.Sessions, ipc.SessionInfo{
+			SessionID:   sess.ID,
+			Username:    sess.Username,
+			CommonName:  sess.CommonName,
+			UntrustedIP: sess.UntrustedIP,
+			Provider:    sess.Provider,
+			CreatedAt:   sess.CreatedAt,
+			ExpiresAt:   sess.ExpiresAt,
+			State:       state,
+		})
+	}
+	return resp, nil
+}
+
+// handleKillSession handles kill_session requests from the sessions command.
+// A pending session's auth failure is written and recorded like any other
+// failure.
+func (d *Daemon) handleKillSession(ctx context.Context, req *ipc.KillSessionRequest) (*ipc.KillSessionResponse, error) {
+	sess, failed, err := d.sessionMgr.Kill(req.SessionID, killedSessionReason)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Warn("session killed by administrator",
+		"session_id", sess.ID,
+		"username", sess.Username,
+		"ip", sess.UntrustedIP,
+		"pending", failed,
+	)
+	if !failed {
+		return &ipc.KillSessionResponse{SessionID: sess.ID}, nil
+	}
+
+	d.metrics.AuthFailed()
+	if d.audit != nil {
+		_, providers := d.current()
+		d.audit.Record(audit.Record{
+			Username:    sess.Username,
+			CommonName:  sess.CommonName,
+			UntrustedIP: sess.UntrustedIP,
+			Result:      audit.ResultFailure,
+			Reason:      killedSessionReason,
+			SessionID:   sess.ID,
+			Issuer:      providers.Issuer(sess.Provider),
+		})
+	}
+
+	return &ipc.KillSessionResponse{SessionID: sess.ID}, nil
+}
+
+// handleCancel handles cancel requests: the pending sessions of the client
+// are deleted without writing a result, so a login the client abandoned
+// cannot time out or complete into a spurious result later.
+func (d *Daemon) handleCancel(ctx context.Context, req *ipc.CancelRequest) (*ipc.CancelResponse, error) {
+	ip := req.UntrustedIP
+	if normalized, err := openvpn.NormalizeIP(ip); err == nil {
+		ip = normalized
+	}
+
+	cancelled := d.sessionMgr.Cancel(req.Username, req.CommonName, ip, "", "")
+	for _, sess := range cancelled {
+		slog.Info("cancelled pending session",
+			"session_id", sess.ID,
+			"username", sess.Username,
+			"ip", sess.UntrustedIP,
+		)
+	}
+	return &ipc.CancelResponse{Cancelled: len(cancelled)}, nil
+}
+
+// cancelPending deletes the pending sessions of the client sending req
+// except the one of req's own connection attempt, so a login the client
+// abandoned by reconnecting cannot time out or complete into a spurious
+// result later.
+func (d *Daemon) cancelPending(req *ipc.AuthRequest) {
+	cancelled := d.sessionMgr.Cancel(req.Username, req.CommonName, req.UntrustedIP,
+		req.UntrustedPort, req.AuthControlFile)
+	for _, sess := range cancelled {
+		slog.Info("cancelled pending session of reconnecting client",
+			"correlation_id", req.CorrelationID,
+			"session_correlation_id", sess.CorrelationID,
+			"session_id", sess.ID,
+			"username", sess.Username,
+			"ip", sess.UntrustedIP,
+		)
+	}
+}
+
+// recordFailure writes an audit record for a session the session manager
+// failed by itself: one that expired without a result, or was superseded
+// by a login from another IP.
+func (d *Daemon) recordFailure(sess *session.Session, reason string) {
+	if d.audit == nil {
+		return
+	}
+	result := audit.ResultFailure
+	if reason == session.TimeoutReason {
+		result = audit.ResultTimeout
+	}
+	_, providers := d.current()
+	d.audit.Record(audit.Record{
+		Username:    sess.Username,
+		CommonName:  sess.CommonName,
+		UntrustedIP: sess.UntrustedIP,
+		Result:      result,
+		Reason:      reason,
+		SessionID:   sess.ID,
+		Issuer:      providers.Issuer(sess.Provider),
+	})
+}
+
+// newRedisStore connects to the Redis server for the redis session store and
+// checks that it is reachable.
+func newRedisStore(ctx context.Context, cfg config.SessionRedisConfig) (*session.RedisStore, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.Addr,
+		Password: cfg.Password,
+		DB:       cfg.DB,
+	})
+	if err := client.Ping(ctx).Err(); err != nil {
+		_ = client.Close()
+		return nil, fmt.Errorf("failed to connect to redis at %s: %w", cfg.Addr, err)
+	}
+	return session.NewRedisStore(client), nil
+}
+
+// checkRequiredRoles warns about required roles that do not exist in
+// Keycloak. Failures to query the admin API are logged, never fatal.
+func checkRequiredRoles(ctx context.Context, cfg *config.Config, providers *oidc.Registry) {
+	names := []string{config.DefaultOIDCProvider}
+	for _, p := range cfg.OIDC.Providers {
+		names = append(names, p.Name)
+	}
+
+	for _, name := range names {
+		p, ok := providers.Get(name)
+		if !ok {
+			continue
+		}
+
+		missing, err := p.MissingRequiredRoles(ctx)
+		if err != nil {
+			slog.Warn("could not verify required roles via admin API",
+				"provider", name,
+				"error", err,
+			)
+			continue
+		}
+		if len(missing) > 0 {
+			slog.Warn("required roles do not exist in Keycloak; users cannot satisfy them",
+				"provider", name,
+				"missing_roles", missing,
+				"role_claim", p.Config().RoleClaim,
+			)
+			continue
+		}
+
+		slog.Debug("required roles verified via admin API", "provider", name)
+	}
+}
+
+// tooManySessionsReason is shown to users who hit auth.max_sessions_per_user.
+const tooManySessionsReason = "Too many pending logins for this user; complete or wait for the pending login"
+
+// defaultSingleIPMessage is shown to users rejected by auth.single_ip_per_user
+// when auth.single_ip_message is not set.
+const defaultSingleIPMessage = "Another login for this account is pending from a different address"
+
 // handleAuthRequest handles authentication requests from the IPC server.
 // It creates a session, starts the OIDC flow, and writes the auth_pending_file.
-func handleAuthRequest(ctx context.Context, cfg *config.Config, oidcProvider *oidc.Provider,
-	sessionMgr *session.Manager, req *ipc.AuthRequest) (*ipc.AuthResponse, error) {
+func (d *Daemon) handleAuthRequest(ctx context.Context, req *ipc.AuthRequest) (*ipc.AuthResponse, error) {
+	// Snapshot the config so a concurrent reload cannot mix old and new settings
+	cfg, providers := d.current()
+	sessionMgr := d.sessionMgr
+	files := controlFileWriter(cfg)
+
+	d.metrics.AuthRequestReceived()
+
+	// The auth script normalizes untrusted_ip, but don't trust it
+	if ip, err := openvpn.NormalizeIP(req.UntrustedIP); err != nil {
+		if cfg.Auth.RejectInvalidIP {
+			return nil, err
+		}
+		slog.Warn("untrusted_ip is not a valid IP address",
+			"correlation_id", req.CorrelationID,
+			"error", err,
+		)
+	} else {
+		req.UntrustedIP = ip
+	}
 
 	slog.Info("auth request received",
+		"correlation_id", req.CorrelationID,
 		"username", req.Username,
+		"username_source", req.UsernameSource,
 		"ip", req.UntrustedIP,
 		"port", req.UntrustedPort,
 	)
 
-	// Create session
-	sess, err := sessionMgr.Create(
-		req.Username,
-		req.CommonName,
-		req.UntrustedIP,
-		req.UntrustedPort,
-		req.AuthControlFile,
-		req.AuthPendingFile,
-		req.AuthFailedReasonFile,
-	)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create session: %w", err)
+	// The auth script only offers crtext when enabled, but don't trust it
+	if req.PendingAuthMethod == "crtext" && !cfg.Auth.EnableCRText {
+		return nil, fmt.Errorf("crtext pending auth method is not enabled (auth.enable_crtext)")
 	}
 
-	slog.Debug("session created", "session_id", sess.ID)
+	// Fail fast if the result can never be written: a deferred client would
+	// wait for it until OpenVPN's hand-window expires
+	if err := files.CheckWritable(req.AuthControlFile); err != nil {
+		slog.Error("cannot write auth_control_file, rejecting auth request",
+			"correlation_id", req.CorrelationID,
+			"username", req.Username,
+			"path", req.AuthControlFile,
+			"error", err,
+		)
+		return nil, fmt.Errorf("cannot write auth_control_file: %w", err)
+	}
 
-	// Start OIDC flow
+	// Pick the issuer for this connection and start its OIDC flow before
+	// creating the session, so a concurrent request from the same client
+	// never finds a session without a login URL
+	providerName, oidcProvider := providers.Select(req.Username, req.CommonName)
 	flowData, err := oidcProvider.StartAuthFlow(ctx)
 	if err != nil {
-		sessionMgr.Delete(sess.ID)
 		return nil, fmt.Errorf("failed to start OIDC flow: %w", err)
 	}
 
-	// Update session with OIDC flow data
-	err = sessionMgr.UpdateOIDCFlow(sess.ID, flowData.State, flowData.CodeVerifier, flowData.AuthURL)
+	var correlationCode string
+	if cfg.Auth.CorrelationCode {
+		correlationCode, err = session.NewCorrelationCode()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// A client that reconnects before completing the browser flow leaves
+	// its previous session pending; drop it before creating the new one
+	d.cancelPending(req)
+
+	// A repeated request of the same connection attempt, e.g. a retried
+	// auth script, gets its pending session back, with the same URL,
+	// instead of a second login
+	sess, reused, err := sessionMgr.CreateOrReuse(&session.Session{
+		Username:             req.Username,
+		CommonName:           req.CommonName,
+		UntrustedIP:          req.UntrustedIP,
+		UntrustedPort:        req.UntrustedPort,
+		AuthControlFile:      req.AuthControlFile,
+		AuthPendingFile:      req.AuthPendingFile,
+		AuthFailedReasonFile: req.AuthFailedReasonFile,
+		PendingAuthMethod:    req.PendingAuthMethod,
+		Provider:             providerName,
+		Instance:             req.Instance,
+		State:                flowData.State,
+		CodeVerifier:         flowData.CodeVerifier,
+		Nonce:                flowData.Nonce,
+		AuthURL:              flowData.AuthURL,
+		CorrelationCode:      correlationCode,
+		CorrelationID:        req.CorrelationID,
+	})
+	if errors.Is(err, session.ErrTooManySessions) {
+		slog.Warn("rejecting auth request: too many concurrent sessions",
+			"correlation_id", req.CorrelationID,
+			"username", req.Username,
+			"ip", req.UntrustedIP,
+			"limit", cfg.Auth.MaxSessionsPerUser,
+		)
+		d.metrics.AuthFailed()
+		d.httpServer.RecordAuthFailure(req.UntrustedIP)
+		if wErr := files.WriteAuthFailure(
+			req.AuthControlFile,
+			req.AuthFailedReasonFile,
+			tooManySessionsReason,
+		); wErr != nil {
+			slog.Error("failed to write auth failure for session limit",
+				"correlation_id", req.CorrelationID,
+				"error", wErr,
+			)
+		}
+		return nil, fmt.Errorf("%s: %w", tooManySessionsReason, err)
+	}
+	if errors.Is(err, session.ErrOtherIPSession) {
+		slog.Warn("rejecting auth request: pending session from a different IP",
+			"correlation_id", req.CorrelationID,
+			"username", req.Username,
+			"ip", req.UntrustedIP,
+			"error", err,
+		)
+		reason := cfg.Auth.SingleIPMessage
+		if reason == "" {
+			reason = defaultSingleIPMessage
+		}
+		d.metrics.AuthFailed()
+		d.httpServer.RecordAuthFailure(req.UntrustedIP)
+		if wErr := files.WriteAuthFailure(
+			req.AuthControlFile,
+			req.AuthFailedReasonFile,
+			reason,
+		); wErr != nil {
+			slog.Error("failed to write auth failure for single IP policy",
+				"correlation_id", req.CorrelationID,
+				"error", wErr,
+			)
+		}
+		return nil, fmt.Errorf("%s: %w", reason, err)
+	}
 	if err != nil {
-		sessionMgr.Delete(sess.ID)
-		return nil, fmt.Errorf("failed to update session: %w", err)
+		return nil, fmt.Errorf("failed to create session: %w", err)
 	}
 
-	slog.Debug("OIDC flow started",
-		"session_id", sess.ID,
-		"state", flowData.State,
-	)
+	// Error paths below only delete a session this request created; a
+	// reused one still serves the earlier request
+	discard := func() {
+		if !reused {
+			sessionMgr.Delete(sess.ID)
+		}
+	}
+
+	if reused {
+		slog.Info("reusing pending session of the same connection attempt",
+			"correlation_id", req.CorrelationID,
+			"session_correlation_id", sess.CorrelationID,
+			"session_id", sess.ID,
+			"username", req.Username,
+			"ip", req.UntrustedIP,
+		)
+		correlationCode = sess.CorrelationCode
+	} else {
+		slog.Debug("session created",
+			"correlation_id", req.CorrelationID,
+			"session_id", sess.ID,
+			"provider", sess.Provider,
+			"state", sess.State,
+		)
+	}
 
 	// Build a short redirect URL for the auth_pending_file.
 	// OpenVPN's OPTION_LINE_SIZE is 256 chars, and full OIDC auth URLs with PKCE
 	// parameters easily exceed this. We use /auth/<state> which 302-redirects to
 	// the full Keycloak auth URL.
-	shortAuthURL, err := buildShortAuthURL(cfg.OIDC.RedirectURI, flowData.State)
+	shortAuthURL, err := buildShortAuthURL(cfg.OIDC.RedirectURI, sess.State, req.PendingAuthMethod)
 	if err != nil {
-		sessionMgr.Delete(sess.ID)
+		discard()
 		return nil, fmt.Errorf("failed to build short auth URL: %w", err)
 	}
 
 	slog.Debug("short auth URL built",
+		"correlation_id", req.CorrelationID,
 		"session_id", sess.ID,
 		"short_url", shortAuthURL,
-		"full_url_length", len(flowData.AuthURL),
+		"full_url_length", len(sess.AuthURL),
 	)
 
+	// crtext clients cannot open a browser; show a one-time code the user
+	// enters at /code in any browser to continue to the same auth URL.
+	pendingText := shortAuthURL
+	if req.PendingAuthMethod == "crtext" {
+		userCode, err := sessionMgr.AssignUserCode(sess.ID)
+		if err != nil {
+			discard()
+			return nil, fmt.Errorf("failed to assign user code: %w", err)
+		}
+		pendingText, err = buildCRTextChallenge(cfg.OIDC.RedirectURI, userCode, correlationCode)
+		if err != nil {
+			discard()
+			return nil, fmt.Errorf("failed to build crtext challenge: %w", err)
+		}
+	}
+
 	// Write auth_pending_file to trigger browser opening.
-	// The method must match the client's IV_SSO capability.
-	err = openvpn.WriteAuthPending(
+	// The method must match the client's IV_SSO capability. A reused
+	// session's expiry was extended, so the full timeout applies.
+	err = files.WriteAuthPending(
 		req.AuthPendingFile,
 		cfg.Auth.SessionTimeout,
 		req.PendingAuthMethod,
-		shortAuthURL,
+		pendingText,
 	)
 	if err != nil {
-		sessionMgr.Delete(sess.ID)
+		discard()
 		// Also write auth failure since we can't proceed
-		if wErr := openvpn.WriteAuthFailure(
+		if wErr := files.WriteAuthFailure(
 			req.AuthControlFile,
 			req.AuthFailedReasonFile,
 			"Failed to start authentication flow",
 		); wErr != nil {
-			slog.Error("failed to write auth failure after pending write failure", "error", wErr)
+			slog.Error("failed to write auth failure after pending write failure",
+				"correlation_id", req.CorrelationID,
+				"error", wErr,
+			)
 		}
 		return nil, fmt.Errorf("failed to write auth_pending_file: %w", err)
 	}
 
 	slog.Info("auth flow initiated",
+		"correlation_id", req.CorrelationID,
 		"session_id", sess.ID,
 		"username", req.Username,
 		"ip", req.UntrustedIP,
+		"correlation_code", correlationCode,
 	)
 
+	d.metrics.AuthDeferred()
+
 	// Return response to auth script
 	return &ipc.AuthResponse{
 		Type:      ipc.MessageTypeAuthResponse,
@@ -241,23 +1031,71 @@ func handleAuthRequest(ctx context.Context, cfg *config.Config, oidcProvider *oi
 	}, nil
 }
 
-// maxWebAuthLineLen is OpenVPN's OPTION_LINE_SIZE limit for a single line in
-// the auth_pending_file. The third line is "WEB_AUTH::<url>\n".
-const maxWebAuthLineLen = 256
-
-// webAuthPrefix is the prefix OpenVPN expects on the auth URL line.
-const webAuthPrefix = "WEB_AUTH::"
+// maxAuthURLLineLen is OpenVPN's OPTION_LINE_SIZE limit for a single line in
+// the auth_pending_file. The third line is "<prefix><url>\n", where the prefix
+// is "WEB_AUTH::" or "OPEN_URL::" depending on the pending auth method.
+// openvpn.WriteAuthPending enforces the same limit on every line it writes;
+// checking here as well gives a clearer error before a session is created.
+const maxAuthURLLineLen = openvpn.OptionLineSize
 
 // buildShortAuthURL constructs a short auth redirect URL from the redirect URI config.
 // Given a redirect_uri like "https://vpn.example.com:9000/callback" and a state,
 // it returns "https://vpn.example.com:9000/auth/<state>".
 // If redirect_uri contains a base path (e.g. "https://host/vpn/callback"), the base
 // path is preserved and the short URL becomes "https://host/vpn/auth/<state>".
-// This keeps the WEB_AUTH:: line well under OpenVPN's 256-char OPTION_LINE_SIZE limit.
+// This keeps the URL line well under OpenVPN's 256-char OPTION_LINE_SIZE limit.
 //
-// It validates that the resulting "WEB_AUTH::<url>\n" line does not exceed the limit
-// to prevent truncated/invalid URLs from reaching the client.
-func buildShortAuthURL(redirectURI, state string) (string, error) {
+// It validates that the resulting "<prefix><url>\n" line for the given pending
+// auth method does not exceed the limit to prevent truncated/invalid URLs from
+// reaching the client.
+func buildShortAuthURL(redirectURI, state, method string) (string, error) {
+	shortURL, err := serviceURL(redirectURI, "auth", state)
+	if err != nil {
+		return "", err
+	}
+
+	// Validate that "<prefix><url>\n" fits within OPTION_LINE_SIZE.
+	// len(prefix) + len(url) + len("\n") must be <= 256.
+	prefix := openvpn.AuthPendingPrefix(method)
+	lineLen := len(prefix) + len(shortURL) + 1 // +1 for trailing newline
+	if lineLen > maxAuthURLLineLen {
+		return "", fmt.Errorf("short auth URL too long (%d chars); %s line would be %d bytes, exceeding OpenVPN's %d-byte OPTION_LINE_SIZE limit",
+			len(shortURL), prefix, lineLen, maxAuthURLLineLen)
+	}
+
+	return shortURL, nil
+}
+
+// buildCRTextChallenge builds the crtext challenge text telling the user
+// where to enter their one-time code, e.g.
+// "Open https://vpn.example.com:9000/code and enter code ABCD-EFGH". A
+// non-empty correlationCode is appended as " (login KXRM)".
+// Like buildShortAuthURL, it rejects challenges whose line would exceed
+// OpenVPN's OPTION_LINE_SIZE limit.
+func buildCRTextChallenge(redirectURI, userCode, correlationCode string) (string, error) {
+	codeURL, err := serviceURL(redirectURI, "code")
+	if err != nil {
+		return "", err
+	}
+
+	challenge := fmt.Sprintf("Open %s and enter code %s", codeURL, userCode)
+	if correlationCode != "" {
+		challenge += fmt.Sprintf(" (login %s)", correlationCode)
+	}
+
+	lineLen := len(openvpn.CRTextPrefix) + len(challenge) + 1 // +1 for trailing newline
+	if lineLen > maxAuthURLLineLen {
+		return "", fmt.Errorf("crtext challenge too long; %s line would be %d bytes, exceeding OpenVPN's %d-byte OPTION_LINE_SIZE limit",
+			openvpn.CRTextPrefix, lineLen, maxAuthURLLineLen)
+	}
+
+	return challenge, nil
+}
+
+// serviceURL returns the URL of a daemon endpoint next to the callback:
+// the redirect_uri with its last path element replaced by elem (any base
+// path is preserved) and the query and fragment removed.
+func serviceURL(redirectURI string, elem ...string) (string, error) {
 	u, err := url.Parse(redirectURI)
 	if err != nil {
 		return "", fmt.Errorf("failed to parse redirect_uri: %w", err)
@@ -273,19 +1111,9 @@ func buildShortAuthURL(redirectURI, state string) (string, error) {
 		basePath = "/"
 	}
 
-	u.Path = path.Join(basePath, "auth", state)
+	u.Path = path.Join(append([]string{basePath}, elem...)...)
 	u.RawQuery = ""
 	u.Fragment = ""
 
-	shortURL := u.String()
-
-	// Validate that "WEB_AUTH::<url>\n" fits within OPTION_LINE_SIZE.
-	// len("WEB_AUTH::") + len(url) + len("\n") must be <= 256.
-	lineLen := len(webAuthPrefix) + len(shortURL) + 1 // +1 for trailing newline
-	if lineLen > maxWebAuthLineLen {
-		return "", fmt.Errorf("short auth URL too long (%d chars); WEB_AUTH:: line would be %d bytes, exceeding OpenVPN's %d-byte OPTION_LINE_SIZE limit",
-			len(shortURL), lineLen, maxWebAuthLineLen)
-	}
-
-	return shortURL, nil
+	return u.String(), nil
 }
@@ -1,44 +1,105 @@
 package daemon
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/httpserver"
 	"github.com/al-bashkir/openvpn-keycloak-auth/internal/ipc"
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/oidc/oidctest"
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/openvpn"
 )
 
-func newTestOIDCIssuer(t *testing.T) string {
+// newTestConfig returns a config for a test daemon with the IPC socket in
+// a temporary directory, after mutate (which may be nil) adjusted it. An
+// issuer mutate leaves empty is served by oidctest.NewIssuer.
+func newTestConfig(t *testing.T, mutate func(cfg *config.Config)) *config.Config {
 	t.Helper()
 
-	var baseURL string
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		issuer := baseURL + "/realms/test"
-
-		switch r.URL.Path {
-		case "/realms/test/.well-known/openid-configuration":
-			w.Header().Set("Content-Type", "application/json")
-			_ = json.NewEncoder(w).Encode(map[string]string{
-				"issuer":                 issuer,
-				"authorization_endpoint": issuer + "/auth",
-				"token_endpoint":         issuer + "/token",
-				"jwks_uri":               issuer + "/keys",
-			})
-		default:
-			http.NotFound(w, r)
+	cfg := &config.Config{
+		Listen: config.ListenConfig{
+			HTTP:   "127.0.0.1:0",
+			Socket: filepath.Join(t.TempDir(), "auth.sock"),
+		},
+		OIDC: config.OIDCConfig{
+			ClientID:    "test-client",
+			RedirectURI: "http://127.0.0.1:9000/callback",
+			Scopes:      []string{"openid"},
+		},
+		Auth: config.AuthConfig{
+			SessionTimeout: 300,
+			UsernameClaim:  "preferred_username",
+		},
+	}
+	if mutate != nil {
+		mutate(cfg)
+	}
+	if cfg.OIDC.Issuer == "" {
+		cfg.OIDC.Issuer = oidctest.NewIssuer(t, nil)
+	}
+	return cfg
+}
+
+// newTestDaemon creates a daemon from newTestConfig(t, mutate) whose
+// session manager is stopped when the test ends. Tests of Run, which stops
+// it itself, use newTestConfig and New instead.
+func newTestDaemon(t *testing.T, mutate func(cfg *config.Config)) *Daemon {
+	t.Helper()
+
+	d, err := New(newTestConfig(t, mutate))
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	t.Cleanup(d.sessionMgr.Stop)
+	return d
+}
+
+// brokenKeys serves a JWKS, which fails with 500 while broken is set.
+func brokenKeys(broken *atomic.Bool) oidctest.Hook {
+	return func(w http.ResponseWriter, r *http.Request, _ string) bool {
+		if r.URL.Path != oidctest.KeysPath {
+			return false
 		}
-	}))
-	baseURL = ts.URL
-	t.Cleanup(ts.Close)
+		if broken.Load() {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return true
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{"kty": "RSA", "kid": "test-key", "n": "AQAB", "e": "AQAB"}},
+		})
+		return true
+	}
+}
 
-	return baseURL + "/realms/test"
+// flakyDiscovery fails the first failures discovery requests with 500.
+// requests counts discovery requests.
+func flakyDiscovery(failures int32, requests *atomic.Int32) oidctest.Hook {
+	return func(w http.ResponseWriter, r *http.Request, _ string) bool {
+		if r.URL.Path != oidctest.DiscoveryPath {
+			return false
+		}
+		if requests.Add(1) <= failures {
+			http.Error(w, "starting up", http.StatusInternalServerError)
+			return true
+		}
+		return false
+	}
 }
 
 func TestBuildShortAuthURL(t *testing.T) {
@@ -101,7 +162,7 @@ func TestBuildShortAuthURL(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := buildShortAuthURL(tt.redirectURI, tt.state)
+			got, err := buildShortAuthURL(tt.redirectURI, tt.state, "webauth")
 			if tt.wantErr {
 				if err == nil {
 					t.Error("expected error, got nil")
@@ -125,36 +186,48 @@ func TestBuildShortAuthURL(t *testing.T) {
 	}
 }
 
-func TestNewAndHandleAuthRequest_Success(t *testing.T) {
-	issuer := newTestOIDCIssuer(t)
-	tmpDir := t.TempDir()
+func TestBuildShortAuthURL_LineLengthByMethod(t *testing.T) {
+	// A host long enough that the URL line is exactly 256 bytes with the
+	// 10-char prefix; both prefixes are the same length, so both must pass,
+	// and one more byte must fail for both.
+	state := "abc"
+	base := "https://"
+	suffix := "/auth/" + state
+	hostLen := 256 - 10 - 1 - len(base) - len(suffix)
+	fits := base + strings.Repeat("a", hostLen) + "/callback"
+	tooLong := base + strings.Repeat("a", hostLen+1) + "/callback"
 
-	cfg := &config.Config{
-		Listen: config.ListenConfig{
-			HTTP:   "127.0.0.1:0",
-			Socket: filepath.Join(tmpDir, "auth.sock"),
-		},
-		OIDC: config.OIDCConfig{
-			Issuer:      issuer,
-			ClientID:    "test-client",
-			RedirectURI: "http://127.0.0.1:9000/callback",
-			Scopes:      []string{"openid"},
-		},
-		Auth: config.AuthConfig{
-			SessionTimeout: 300,
-			UsernameClaim:  "preferred_username",
-		},
-		Log: config.LogConfig{
-			Level:  "info",
-			Format: "json",
-		},
+	tests := []struct {
+		name        string
+		method      string
+		redirectURI string
+		wantErr     string
+	}{
+		{name: "webauth fits", method: "webauth", redirectURI: fits},
+		{name: "openurl fits", method: "openurl", redirectURI: fits},
+		{name: "webauth too long", method: "webauth", redirectURI: tooLong, wantErr: "WEB_AUTH:: line"},
+		{name: "openurl too long", method: "openurl", redirectURI: tooLong, wantErr: "OPEN_URL:: line"},
 	}
 
-	d, err := New(cfg)
-	if err != nil {
-		t.Fatalf("New failed: %v", err)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := buildShortAuthURL(tt.redirectURI, state, tt.method)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
 	}
-	defer d.sessionMgr.Stop()
+}
+
+func TestNewAndHandleAuthRequest_Success(t *testing.T) {
+	tmpDir := t.TempDir()
+	d := newTestDaemon(t, nil)
 
 	req := &ipc.AuthRequest{
 		Username:             "testuser",
@@ -165,9 +238,10 @@ func TestNewAndHandleAuthRequest_Success(t *testing.T) {
 		AuthPendingFile:      filepath.Join(tmpDir, "auth_pending"),
 		AuthFailedReasonFile: filepath.Join(tmpDir, "auth_failed"),
 		PendingAuthMethod:    "webauth",
+		Instance:             "server-a",
 	}
 
-	resp, err := handleAuthRequest(context.Background(), cfg, d.oidcProvider, d.sessionMgr, req)
+	resp, err := d.handleAuthRequest(context.Background(), req)
 	if err != nil {
 		t.Fatalf("handleAuthRequest failed: %v", err)
 	}
@@ -188,6 +262,12 @@ func TestNewAndHandleAuthRequest_Success(t *testing.T) {
 	if sess.CodeVerifier == "" {
 		t.Fatal("expected code verifier to be set")
 	}
+	if sess.Nonce == "" {
+		t.Fatal("expected nonce to be set")
+	}
+	if sess.Instance != "server-a" {
+		t.Fatalf("session instance = %q, want %q", sess.Instance, "server-a")
+	}
 	if sess.AuthURL == "" {
 		t.Fatal("expected full auth URL to be set")
 	}
@@ -222,35 +302,206 @@ func TestNewAndHandleAuthRequest_Success(t *testing.T) {
 	if lines[2] != "WEB_AUTH::"+resp.AuthURL {
 		t.Fatalf("WEB_AUTH line = %q, want %q", lines[2], "WEB_AUTH::"+resp.AuthURL)
 	}
+
+	status, err := d.handleStatusQuery(context.Background(), &ipc.StatusQuery{SessionID: resp.SessionID})
+	if err != nil {
+		t.Fatalf("handleStatusQuery failed: %v", err)
+	}
+	if status.State != ipc.SessionStatePending || status.Error != "" {
+		t.Fatalf("status = %+v, want pending", status)
+	}
+
+	status, err = d.handleStatusQuery(context.Background(), &ipc.StatusQuery{SessionID: "no-such-session"})
+	if err != nil {
+		t.Fatalf("handleStatusQuery failed: %v", err)
+	}
+	if status.State != ipc.SessionStateUnknown || status.Error == "" || status.SessionID != "no-such-session" {
+		t.Fatalf("status = %+v, want unknown with error", status)
+	}
 }
 
-func TestHandleAuthRequest_PendingWriteFailureWritesAuthFailure(t *testing.T) {
-	issuer := newTestOIDCIssuer(t)
+func TestHandleAuthRequest_CorrelationID(t *testing.T) {
 	tmpDir := t.TempDir()
+	d := newTestDaemon(t, nil)
 
-	cfg := &config.Config{
-		Listen: config.ListenConfig{
-			HTTP:   "127.0.0.1:0",
-			Socket: filepath.Join(tmpDir, "auth.sock"),
-		},
-		OIDC: config.OIDCConfig{
-			Issuer:      issuer,
-			ClientID:    "test-client",
-			RedirectURI: "http://127.0.0.1:9000/callback",
-			Scopes:      []string{"openid"},
-		},
-		Auth: config.AuthConfig{
-			SessionTimeout: 300,
-			UsernameClaim:  "preferred_username",
-		},
-		Log: config.LogConfig{Level: "info", Format: "json"},
+	var buf bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(old) })
+
+	resp, err := d.handleAuthRequest(context.Background(), &ipc.AuthRequest{
+		Username:             "testuser",
+		UntrustedIP:          "192.0.2.1",
+		UntrustedPort:        "12345",
+		AuthControlFile:      filepath.Join(tmpDir, "auth_control"),
+		AuthPendingFile:      filepath.Join(tmpDir, "auth_pending"),
+		AuthFailedReasonFile: filepath.Join(tmpDir, "auth_failed"),
+		PendingAuthMethod:    "webauth",
+		CorrelationID:        "corr-1",
+	})
+	if err != nil {
+		t.Fatalf("handleAuthRequest failed: %v", err)
 	}
 
-	d, err := New(cfg)
+	// The callback logs the ID stored on the session
+	sess, err := d.sessionMgr.Get(resp.SessionID)
 	if err != nil {
-		t.Fatalf("New failed: %v", err)
+		t.Fatalf("failed to retrieve session: %v", err)
 	}
-	defer d.sessionMgr.Stop()
+	if sess.CorrelationID != "corr-1" {
+		t.Errorf("session correlation ID = %q, want %q", sess.CorrelationID, "corr-1")
+	}
+
+	logged := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var rec map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("log line is not JSON: %v (%q)", err, line)
+		}
+		id, _ := rec["correlation_id"].(string)
+		logged[rec["msg"].(string)] = id
+	}
+	for _, msg := range []string{"auth request received", "auth flow initiated"} {
+		if id, ok := logged[msg]; !ok || id != "corr-1" {
+			t.Errorf("%q logged with correlation_id %q (logged: %v), want %q", msg, id, ok, "corr-1")
+		}
+	}
+}
+
+func TestHandleAuthRequest_UntrustedIP(t *testing.T) {
+	d := newTestDaemon(t, nil)
+
+	newRequest := func(ip string) *ipc.AuthRequest {
+		dir := t.TempDir()
+		return &ipc.AuthRequest{
+			Username:             "testuser",
+			UntrustedIP:          ip,
+			UntrustedPort:        "12345",
+			AuthControlFile:      filepath.Join(dir, "auth_control"),
+			AuthPendingFile:      filepath.Join(dir, "auth_pending"),
+			AuthFailedReasonFile: filepath.Join(dir, "auth_failed"),
+			PendingAuthMethod:    "webauth",
+		}
+	}
+
+	t.Run("IPv6 normalized", func(t *testing.T) {
+		resp, err := d.handleAuthRequest(context.Background(), newRequest("2001:DB8:0::1"))
+		if err != nil {
+			t.Fatalf("handleAuthRequest failed: %v", err)
+		}
+		sess, err := d.sessionMgr.Get(resp.SessionID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sess.UntrustedIP != "2001:db8::1" {
+			t.Errorf("UntrustedIP = %q, want %q", sess.UntrustedIP, "2001:db8::1")
+		}
+	})
+
+	t.Run("invalid IP logged by default", func(t *testing.T) {
+		resp, err := d.handleAuthRequest(context.Background(), newRequest("bogus"))
+		if err != nil {
+			t.Fatalf("handleAuthRequest failed: %v", err)
+		}
+		if resp.Status != ipc.StatusDeferred {
+			t.Errorf("status = %q, want %q", resp.Status, ipc.StatusDeferred)
+		}
+	})
+
+	t.Run("invalid IP rejected when configured", func(t *testing.T) {
+		d.cfg.Auth.RejectInvalidIP = true
+		defer func() { d.cfg.Auth.RejectInvalidIP = false }()
+
+		if _, err := d.handleAuthRequest(context.Background(), newRequest("bogus")); err == nil {
+			t.Fatal("expected invalid IP to be rejected")
+		}
+	})
+}
+
+func TestHandleAuthRequest_CRText(t *testing.T) {
+	tests := []struct {
+		name            string
+		enableCRText    bool
+		correlationCode bool
+		wantErr         bool
+	}{
+		{name: "enabled writes one-time code challenge", enableCRText: true},
+		{name: "correlation code in challenge", enableCRText: true, correlationCode: true},
+		{name: "disabled rejects crtext", enableCRText: false, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			d := newTestDaemon(t, func(cfg *config.Config) {
+				cfg.OIDC.RedirectURI = "http://127.0.0.1:9000/vpn/callback"
+				cfg.Auth.EnableCRText = tt.enableCRText
+				cfg.Auth.CorrelationCode = tt.correlationCode
+			})
+
+			req := &ipc.AuthRequest{
+				Username:             "testuser",
+				AuthControlFile:      filepath.Join(tmpDir, "auth_control"),
+				AuthPendingFile:      filepath.Join(tmpDir, "auth_pending"),
+				AuthFailedReasonFile: filepath.Join(tmpDir, "auth_failed"),
+				PendingAuthMethod:    "crtext",
+			}
+
+			resp, err := d.handleAuthRequest(context.Background(), req)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				if d.sessionMgr.Count() != 0 {
+					t.Fatalf("expected no sessions, got %d", d.sessionMgr.Count())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("handleAuthRequest failed: %v", err)
+			}
+
+			content, err := os.ReadFile(req.AuthPendingFile)
+			if err != nil {
+				t.Fatalf("failed to read auth_pending_file: %v", err)
+			}
+			lines := strings.Split(string(content), "\n")
+			if len(lines) != 4 || lines[1] != "crtext" {
+				t.Fatalf("unexpected auth_pending_file content: %q", content)
+			}
+
+			prefix := "CR_TEXT:E:Open http://127.0.0.1:9000/vpn/code and enter code "
+			if !strings.HasPrefix(lines[2], prefix) {
+				t.Fatalf("challenge line = %q, want prefix %q", lines[2], prefix)
+			}
+
+			challenge := strings.TrimPrefix(lines[2], prefix)
+			userCode, correlation, hasCorrelation := strings.Cut(challenge, " (login ")
+			if hasCorrelation != tt.correlationCode {
+				t.Fatalf("challenge %q: correlation code present = %v, want %v", lines[2], hasCorrelation, tt.correlationCode)
+			}
+
+			sess, err := d.sessionMgr.RedeemUserCode(userCode)
+			if err != nil {
+				t.Fatalf("RedeemUserCode failed: %v", err)
+			}
+			if sess.ID != resp.SessionID {
+				t.Fatalf("redeemed session = %s, want %s", sess.ID, resp.SessionID)
+			}
+			if tt.correlationCode {
+				if sess.CorrelationCode == "" || correlation != sess.CorrelationCode+")" {
+					t.Errorf("challenge correlation code = %q, session has %q", correlation, sess.CorrelationCode)
+				}
+			} else if sess.CorrelationCode != "" {
+				t.Errorf("CorrelationCode = %q, want none when disabled", sess.CorrelationCode)
+			}
+		})
+	}
+}
+
+func TestHandleAuthRequest_PendingWriteFailureWritesAuthFailure(t *testing.T) {
+	tmpDir := t.TempDir()
+	d := newTestDaemon(t, nil)
 
 	authControl := filepath.Join(tmpDir, "auth_control")
 	authReason := filepath.Join(tmpDir, "auth_failed")
@@ -263,7 +514,7 @@ func TestHandleAuthRequest_PendingWriteFailureWritesAuthFailure(t *testing.T) {
 		PendingAuthMethod:    "webauth",
 	}
 
-	resp, err := handleAuthRequest(context.Background(), cfg, d.oidcProvider, d.sessionMgr, req)
+	resp, err := d.handleAuthRequest(context.Background(), req)
 	if err == nil {
 		t.Fatal("expected error, got nil")
 	}
@@ -289,47 +540,908 @@ func TestHandleAuthRequest_PendingWriteFailureWritesAuthFailure(t *testing.T) {
 	}
 }
 
-func TestRun_HTTPServerStartFailureStopsAndReturnsError(t *testing.T) {
-	issuer := newTestOIDCIssuer(t)
+func TestHandleAuthRequest_UnwritableControlFile(t *testing.T) {
 	tmpDir := t.TempDir()
+	d := newTestDaemon(t, nil)
 
-	cfg := &config.Config{
-		Listen: config.ListenConfig{
-			HTTP:   "127.0.0.1:-1", // invalid port -> ListenAndServe fails immediately
-			Socket: filepath.Join(tmpDir, "auth.sock"),
-		},
-		OIDC: config.OIDCConfig{
-			Issuer:      issuer,
-			ClientID:    "test-client",
-			RedirectURI: "http://127.0.0.1:9000/callback",
-			Scopes:      []string{"openid"},
-		},
-		Auth: config.AuthConfig{
-			SessionTimeout: 300,
-			UsernameClaim:  "preferred_username",
-		},
-		Log: config.LogConfig{Level: "info", Format: "json"},
+	authPending := filepath.Join(tmpDir, "auth_pending")
+	req := &ipc.AuthRequest{
+		Username:             "testuser",
+		AuthControlFile:      filepath.Join(tmpDir, "missing", "auth_control"),
+		AuthPendingFile:      authPending,
+		AuthFailedReasonFile: filepath.Join(tmpDir, "missing", "auth_failed"),
+		PendingAuthMethod:    "webauth",
 	}
 
-	d, err := New(cfg)
+	resp, err := d.handleAuthRequest(context.Background(), req)
+	if !errors.Is(err, openvpn.ErrNotWritable) {
+		t.Fatalf("error = %v, want ErrNotWritable", err)
+	}
+	if resp != nil {
+		t.Fatalf("expected nil response on error, got: %#v", resp)
+	}
+	if n := d.sessionMgr.Count(); n != 0 {
+		t.Errorf("session count = %d, want 0", n)
+	}
+	if _, err := os.Stat(authPending); !os.IsNotExist(err) {
+		t.Errorf("auth_pending_file should not be written, stat error: %v", err)
+	}
+}
+
+func TestHandleAuthRequest_MaxSessionsPerUser(t *testing.T) {
+	tmpDir := t.TempDir()
+	d := newTestDaemon(t, func(cfg *config.Config) {
+		cfg.Auth.MaxSessionsPerUser = 1
+	})
+
+	newRequest := func(name string) *ipc.AuthRequest {
+		return &ipc.AuthRequest{
+			Username:             "testuser",
+			CommonName:           name + "-device",
+			AuthControlFile:      filepath.Join(tmpDir, name+"_control"),
+			AuthPendingFile:      filepath.Join(tmpDir, name+"_pending"),
+			AuthFailedReasonFile: filepath.Join(tmpDir, name+"_reason"),
+			PendingAuthMethod:    "webauth",
+		}
+	}
+
+	if _, err := d.handleAuthRequest(context.Background(), newRequest("first")); err != nil {
+		t.Fatalf("first handleAuthRequest failed: %v", err)
+	}
+
+	req := newRequest("second")
+	resp, err := d.handleAuthRequest(context.Background(), req)
+	if err == nil || !strings.Contains(err.Error(), "Too many pending logins") {
+		t.Fatalf("second handleAuthRequest error = %v, want session limit error", err)
+	}
+	if resp != nil {
+		t.Fatalf("expected nil response on error, got: %#v", resp)
+	}
+	if got := d.sessionMgr.Count(); got != 1 {
+		t.Errorf("session count = %d, want 1", got)
+	}
+
+	controlContent, err := os.ReadFile(req.AuthControlFile)
 	if err != nil {
-		t.Fatalf("New failed: %v", err)
+		t.Fatalf("failed to read auth_control_file: %v", err)
 	}
+	if string(controlContent) != "0" {
+		t.Errorf("auth_control_file = %q, want %q", string(controlContent), "0")
+	}
+	reasonContent, err := os.ReadFile(req.AuthFailedReasonFile)
+	if err != nil {
+		t.Fatalf("failed to read auth_failed_reason_file: %v", err)
+	}
+	if string(reasonContent) != tooManySessionsReason {
+		t.Errorf("auth_failed_reason_file = %q, want %q", string(reasonContent), tooManySessionsReason)
+	}
+}
 
-	done := make(chan error, 1)
-	go func() {
-		done <- d.Run()
-	}()
+func TestHandleAuthRequest_CancelsReconnectingClient(t *testing.T) {
+	tmpDir := t.TempDir()
+	d := newTestDaemon(t, nil)
 
-	select {
-	case err := <-done:
-		if err == nil {
-			t.Fatal("expected Run to fail, got nil")
+	newRequest := func(name, port string) *ipc.AuthRequest {
+		return &ipc.AuthRequest{
+			Username:             "testuser",
+			CommonName:           "testuser-laptop",
+			UntrustedIP:          "192.0.2.1",
+			UntrustedPort:        port,
+			AuthControlFile:      filepath.Join(tmpDir, name+"_control"),
+			AuthPendingFile:      filepath.Join(tmpDir, name+"_pending"),
+			AuthFailedReasonFile: filepath.Join(tmpDir, name+"_reason"),
+			PendingAuthMethod:    "webauth",
+		}
+	}
+
+	first := newRequest("first", "40000")
+	stale, err := d.handleAuthRequest(context.Background(), first)
+	if err != nil {
+		t.Fatalf("first handleAuthRequest failed: %v", err)
+	}
+
+	// The client reconnects from a new port before completing the login
+	second := newRequest("second", "40001")
+	current, err := d.handleAuthRequest(context.Background(), second)
+	if err != nil {
+		t.Fatalf("second handleAuthRequest failed: %v", err)
+	}
+
+	if _, err := d.sessionMgr.Get(stale.SessionID); err == nil {
+		t.Error("stale session should be deleted")
+	}
+	if _, err := d.sessionMgr.Get(current.SessionID); err != nil {
+		t.Errorf("new session missing: %v", err)
+	}
+	if got := d.sessionMgr.Count(); got != 1 {
+		t.Errorf("session count = %d, want 1", got)
+	}
+	if _, err := os.Stat(first.AuthControlFile); !os.IsNotExist(err) {
+		t.Errorf("stale auth_control_file written (stat error %v)", err)
+	}
+
+	// An explicit cancel request drops the new session the same way
+	resp, err := d.handleCancel(context.Background(), &ipc.CancelRequest{
+		Username:    "testuser",
+		CommonName:  "testuser-laptop",
+		UntrustedIP: "192.0.2.1",
+	})
+	if err != nil || resp.Cancelled != 1 {
+		t.Fatalf("handleCancel = %+v, %v, want 1 cancelled", resp, err)
+	}
+	if got := d.sessionMgr.Count(); got != 0 {
+		t.Errorf("session count = %d, want 0", got)
+	}
+	for _, req := range []*ipc.AuthRequest{first, second} {
+		if _, err := os.Stat(req.AuthControlFile); !os.IsNotExist(err) {
+			t.Errorf("%s written for a cancelled session (stat error %v)", req.AuthControlFile, err)
+		}
+	}
+}
+
+func TestHandleAuthRequest_ReusesPendingSession(t *testing.T) {
+	tmpDir := t.TempDir()
+	d := newTestDaemon(t, nil)
+
+	newRequest := func(name string) *ipc.AuthRequest {
+		return &ipc.AuthRequest{
+			Username:             "testuser",
+			CommonName:           "testuser-" + name,
+			UntrustedIP:          "192.0.2.1",
+			UntrustedPort:        "40000",
+			AuthControlFile:      filepath.Join(tmpDir, name+"_control"),
+			AuthPendingFile:      filepath.Join(tmpDir, name+"_pending"),
+			AuthFailedReasonFile: filepath.Join(tmpDir, name+"_reason"),
+			PendingAuthMethod:    "webauth",
+		}
+	}
+
+	req := newRequest("laptop")
+	first, err := d.handleAuthRequest(context.Background(), req)
+	if err != nil {
+		t.Fatalf("first handleAuthRequest failed: %v", err)
+	}
+	sess, err := d.sessionMgr.Get(first.SessionID)
+	if err != nil {
+		t.Fatalf("session missing: %v", err)
+	}
+	expiresAt := sess.ExpiresAt
+
+	// The auth script retries the same connection attempt
+	time.Sleep(10 * time.Millisecond)
+	again, err := d.handleAuthRequest(context.Background(), newRequest("laptop"))
+	if err != nil {
+		t.Fatalf("repeated handleAuthRequest failed: %v", err)
+	}
+	if again.SessionID != first.SessionID || again.AuthURL != first.AuthURL {
+		t.Errorf("repeated request got session %s (%s), want the pending session %s (%s)",
+			again.SessionID, again.AuthURL, first.SessionID, first.AuthURL)
+	}
+	sess, err = d.sessionMgr.Get(first.SessionID)
+	if err != nil {
+		t.Fatalf("session missing: %v", err)
+	}
+	if !sess.ExpiresAt.After(expiresAt) {
+		t.Errorf("reused session expires at %v, want later than %v", sess.ExpiresAt, expiresAt)
+	}
+	pending, err := os.ReadFile(req.AuthPendingFile)
+	if err != nil || !strings.HasPrefix(string(pending), "300\n") || !strings.Contains(string(pending), again.AuthURL) {
+		t.Errorf("auth_pending_file = %q (err %v), want the full timeout and the session's URL", pending, err)
+	}
+
+	// Near-simultaneous requests of another attempt share one session
+	var wg sync.WaitGroup
+	responses := make([]*ipc.AuthResponse, 2)
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := d.handleAuthRequest(context.Background(), newRequest("phone"))
+			if err != nil {
+				t.Errorf("concurrent handleAuthRequest failed: %v", err)
+				return
+			}
+			responses[i] = resp
+		}(i)
+	}
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+	if responses[0].SessionID != responses[1].SessionID || responses[0].AuthURL != responses[1].AuthURL {
+		t.Errorf("concurrent requests got %+v and %+v, want one session with one URL", responses[0], responses[1])
+	}
+	if got := d.sessionMgr.Count(); got != 2 {
+		t.Errorf("session count = %d, want 2", got)
+	}
+}
+
+func TestHandleAuthRequest_SingleIPPerUser(t *testing.T) {
+	tmpDir := t.TempDir()
+	d := newTestDaemon(t, func(cfg *config.Config) {
+		cfg.Auth.SingleIPPerUser = true
+		cfg.Auth.SingleIPMessage = "Account already logging in elsewhere"
+	})
+
+	newRequest := func(name, ip string) *ipc.AuthRequest {
+		return &ipc.AuthRequest{
+			Username:             "testuser",
+			CommonName:           name + "-device",
+			UntrustedIP:          ip,
+			AuthControlFile:      filepath.Join(tmpDir, name+"_control"),
+			AuthPendingFile:      filepath.Join(tmpDir, name+"_pending"),
+			AuthFailedReasonFile: filepath.Join(tmpDir, name+"_reason"),
+			PendingAuthMethod:    "webauth",
+		}
+	}
+
+	if _, err := d.handleAuthRequest(context.Background(), newRequest("first", "192.0.2.1")); err != nil {
+		t.Fatalf("first handleAuthRequest failed: %v", err)
+	}
+
+	// A concurrent login from another device at the same IP is allowed
+	if _, err := d.handleAuthRequest(context.Background(), newRequest("same", "192.0.2.1")); err != nil {
+		t.Fatalf("handleAuthRequest from same IP failed: %v", err)
+	}
+
+	// A concurrent login from a different IP is denied
+	req := newRequest("other", "198.51.100.7")
+	resp, err := d.handleAuthRequest(context.Background(), req)
+	if err == nil || !strings.Contains(err.Error(), d.cfg.Auth.SingleIPMessage) {
+		t.Fatalf("handleAuthRequest from other IP error = %v, want single IP error", err)
+	}
+	if resp != nil {
+		t.Fatalf("expected nil response on error, got: %#v", resp)
+	}
+	if got := d.sessionMgr.Count(); got != 2 {
+		t.Errorf("session count = %d, want 2", got)
+	}
+
+	controlContent, err := os.ReadFile(req.AuthControlFile)
+	if err != nil {
+		t.Fatalf("failed to read auth_control_file: %v", err)
+	}
+	if string(controlContent) != "0" {
+		t.Errorf("auth_control_file = %q, want %q", string(controlContent), "0")
+	}
+	reasonContent, err := os.ReadFile(req.AuthFailedReasonFile)
+	if err != nil {
+		t.Fatalf("failed to read auth_failed_reason_file: %v", err)
+	}
+	if string(reasonContent) != d.cfg.Auth.SingleIPMessage {
+		t.Errorf("auth_failed_reason_file = %q, want %q", string(reasonContent), d.cfg.Auth.SingleIPMessage)
+	}
+}
+
+func TestNew_BuiltinMetrics(t *testing.T) {
+	tmpDir := t.TempDir()
+	d := newTestDaemon(t, func(cfg *config.Config) {
+		cfg.Observability.Metrics = true
+		cfg.Observability.MetricsBackend = config.MetricsBackendBuiltin
+	})
+
+	if d.metrics.Registry() != nil {
+		t.Fatal("expected builtin metrics without a Prometheus registry")
+	}
+
+	var sessionIDs []string
+	for _, name := range []string{"first", "second"} {
+		resp, err := d.handleAuthRequest(context.Background(), &ipc.AuthRequest{
+			Username:             "testuser",
+			CommonName:           name + "-device",
+			UntrustedIP:          "192.0.2.1",
+			UntrustedPort:        "12345",
+			AuthControlFile:      filepath.Join(tmpDir, name+"_acf"),
+			AuthPendingFile:      filepath.Join(tmpDir, name+"_apf"),
+			AuthFailedReasonFile: filepath.Join(tmpDir, name+"_arf"),
+			PendingAuthMethod:    "webauth",
+		})
+		if err != nil || resp.Status != ipc.StatusDeferred {
+			t.Fatalf("handleAuthRequest = %+v, %v, want deferred", resp, err)
+		}
+		sessionIDs = append(sessionIDs, resp.SessionID)
+	}
+
+	list, err := d.handleListSessions(context.Background(), &ipc.ListSessionsRequest{})
+	if err != nil || len(list.Sessions) != 2 || list.Sessions[0].State != ipc.SessionStatePending {
+		t.Fatalf("handleListSessions = %+v, %v, want 2 pending sessions", list, err)
+	}
+
+	if _, err := d.handleKillSession(context.Background(), &ipc.KillSessionRequest{SessionID: sessionIDs[0]}); err != nil {
+		t.Fatalf("handleKillSession failed: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	d.metrics.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := w.Body.String()
+	for _, want := range []string{
+		"openvpn_keycloak_auth_auth_requests_total 2\n",
+		"openvpn_keycloak_auth_auth_deferred_total 2\n",
+		"openvpn_keycloak_auth_auth_failed_total 1\n",
+		"openvpn_keycloak_auth_active_sessions 1\n",
+		"# EOF\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %q in metrics output:\n%s", want, body)
+		}
+	}
+}
+
+func TestHandleAuthRequest_DryRun(t *testing.T) {
+	tmpDir := t.TempDir()
+	d := newTestDaemon(t, func(cfg *config.Config) {
+		cfg.Daemon.DryRun = true
+	})
+
+	filesDir := filepath.Join(tmpDir, "openvpn")
+	if err := os.Mkdir(filesDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := d.handleAuthRequest(context.Background(), &ipc.AuthRequest{
+		Username:             "testuser",
+		UntrustedIP:          "192.0.2.1",
+		UntrustedPort:        "12345",
+		AuthControlFile:      filepath.Join(filesDir, "auth_control"),
+		AuthPendingFile:      filepath.Join(filesDir, "auth_pending"),
+		AuthFailedReasonFile: filepath.Join(filesDir, "auth_failed"),
+		PendingAuthMethod:    "webauth",
+	})
+	if err != nil || resp.Status != ipc.StatusDeferred {
+		t.Fatalf("handleAuthRequest = %+v, %v, want deferred", resp, err)
+	}
+
+	if _, _, err := d.sessionMgr.Kill(resp.SessionID, killedSessionReason); err != nil {
+		t.Fatalf("Kill failed: %v", err)
+	}
+
+	entries, err := os.ReadDir(filesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected no control files written in dry run, found %d", len(entries))
+	}
+}
+
+func TestRun_HTTPServerStartFailureStopsAndReturnsError(t *testing.T) {
+	cfg := newTestConfig(t, func(cfg *config.Config) {
+		cfg.Listen.HTTP = "127.0.0.1:-1" // invalid port -> ListenAndServe fails immediately
+	})
+
+	d, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- d.Run()
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected Run to fail, got nil")
+		}
+	case <-time.After(5 * time.Second):
+		// Best-effort cleanup to avoid leaking goroutines/sockets on failure.
+		_ = d.ipcServer.Stop()
+		d.sessionMgr.Stop()
+		t.Fatal("timeout waiting for Run to return")
+	}
+}
+
+// listenNotifySocket creates a datagram socket standing in for systemd's
+// notification socket and points NOTIFY_SOCKET at it.
+func listenNotifySocket(t *testing.T) *net.UnixConn {
+	t.Helper()
+	socketPath := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		t.Skipf("unixgram sockets not available: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	t.Setenv("NOTIFY_SOCKET", socketPath)
+	return conn
+}
+
+// readNotify returns the next notification received on conn.
+func readNotify(t *testing.T, conn *net.UnixConn) string {
+	t.Helper()
+	buf := make([]byte, 256)
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatalf("no systemd notification received: %v", err)
+	}
+	return string(buf[:n])
+}
+
+func TestSdNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	sent, err := sdNotify("READY=1")
+	if sent || err != nil {
+		t.Fatalf("sdNotify without NOTIFY_SOCKET = (%v, %v), want (false, nil)", sent, err)
+	}
+
+	conn := listenNotifySocket(t)
+	sent, err = sdNotify("READY=1")
+	if !sent || err != nil {
+		t.Fatalf("sdNotify = (%v, %v), want (true, nil)", sent, err)
+	}
+	if got := readNotify(t, conn); got != "READY=1" {
+		t.Errorf("notification = %q, want READY=1", got)
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	tests := []struct {
+		name string
+		usec string
+		pid  string
+		want time.Duration
+	}{
+		{name: "unset", want: 0},
+		{name: "set", usec: "30000000", want: 30 * time.Second},
+		{name: "own pid", usec: "1000000", pid: fmt.Sprint(os.Getpid()), want: time.Second},
+		{name: "other pid", usec: "1000000", pid: "1", want: 0},
+		{name: "invalid", usec: "soon", want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("WATCHDOG_USEC", tt.usec)
+			t.Setenv("WATCHDOG_PID", tt.pid)
+			if got := watchdogInterval(); got != tt.want {
+				t.Errorf("watchdogInterval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRun_NotifiesSystemd(t *testing.T) {
+	conn := listenNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "100000")
+	t.Setenv("WATCHDOG_PID", "")
+
+	cfg := newTestConfig(t, func(cfg *config.Config) {
+		cfg.Systemd.Notify = true
+	})
+
+	d, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- d.Run()
+	}()
+
+	if got := readNotify(t, conn); got != "READY=1" {
+		t.Fatalf("first notification = %q, want READY=1", got)
+	}
+	if got := readNotify(t, conn); got != "WATCHDOG=1" {
+		t.Fatalf("second notification = %q, want WATCHDOG=1", got)
+	}
+
+	// READY=1 is sent after the signal handler is installed
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Run returned error: %v", err)
+		}
+	case <-time.After(35 * time.Second):
+		t.Fatal("timeout waiting for Run to return")
+	}
+
+	// Drain watchdog pings sent before shutdown
+	for {
+		if got := readNotify(t, conn); got != "WATCHDOG=1" {
+			if got != "STOPPING=1" {
+				t.Errorf("final notification = %q, want STOPPING=1", got)
+			}
+			break
+		}
+	}
+}
+
+func TestDiscoverProvidersRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		retries      int
+		wantErr      bool
+		wantRequests int32
+	}{
+		{name: "succeeds after failures", retries: 5, wantRequests: 4},
+		{name: "exactly enough retries", retries: 3, wantRequests: 4},
+		{name: "gives up", retries: 2, wantErr: true, wantRequests: 3},
+		{name: "no retries", retries: 0, wantErr: true, wantRequests: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			cfg := &config.OIDCConfig{
+				Issuer:      oidctest.NewIssuer(t, flakyDiscovery(3, &requests)),
+				ClientID:    "test-client",
+				RedirectURI: "http://localhost/callback",
+				Scopes:      []string{"openid"},
+			}
+
+			providers, err := discoverProviders(context.Background(), cfg, tt.retries, time.Millisecond)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected discovery to fail")
+				}
+			} else if err != nil || providers == nil {
+				t.Fatalf("discoverProviders failed: %v", err)
+			}
+			if got := requests.Load(); got != tt.wantRequests {
+				t.Errorf("discovery requests = %d, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestDiscoverProvidersCancel(t *testing.T) {
+	var requests atomic.Int32
+	cfg := &config.OIDCConfig{
+		Issuer:      oidctest.NewIssuer(t, flakyDiscovery(1000, &requests)),
+		ClientID:    "test-client",
+		RedirectURI: "http://localhost/callback",
+		Scopes:      []string{"openid"},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := discoverProviders(ctx, cfg, 10, time.Hour)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("error = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("cancel took %s to abort retrying", elapsed)
+	}
+	if got := requests.Load(); got != 1 {
+		t.Errorf("discovery requests = %d, want 1", got)
+	}
+}
+
+func TestSelfTest(t *testing.T) {
+	var broken atomic.Bool
+	d := newTestDaemon(t, func(cfg *config.Config) {
+		cfg.OIDC.Issuer = oidctest.NewIssuer(t, brokenKeys(&broken))
+	})
+
+	if err := d.selfTest(context.Background()); err != nil {
+		t.Fatalf("selfTest on healthy daemon failed: %v", err)
+	}
+	if got := d.sessionMgr.Count(); got != 0 {
+		t.Errorf("session count after selfTest = %d, want 0", got)
+	}
+
+	broken.Store(true)
+	err := d.selfTest(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "OIDC self-test failed") {
+		t.Fatalf("selfTest with broken JWKS error = %v, want OIDC self-test failure", err)
+	}
+
+	// The watchdog withholds pings while the self-test fails
+	conn := listenNotifySocket(t)
+	t.Setenv("WATCHDOG_USEC", "100000")
+	t.Setenv("WATCHDOG_PID", "")
+
+	stop := make(chan struct{})
+	defer close(stop)
+	notifyReady(stop, d.watchdogSelfTest)
+
+	if got := readNotify(t, conn); got != "READY=1" {
+		t.Fatalf("first notification = %q, want READY=1", got)
+	}
+	buf := make([]byte, 256)
+	if err := conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := conn.Read(buf); err == nil {
+		t.Fatalf("unexpected notification while unhealthy: %q", buf[:n])
+	}
+
+	broken.Store(false)
+	if got := readNotify(t, conn); got != "WATCHDOG=1" {
+		t.Fatalf("notification after recovery = %q, want WATCHDOG=1", got)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	var broken atomic.Bool
+	tmpDir := t.TempDir()
+	snapshotFile := filepath.Join(tmpDir, "snapshot.json")
+	d := newTestDaemon(t, func(cfg *config.Config) {
+		cfg.OIDC.Issuer = oidctest.NewIssuer(t, brokenKeys(&broken))
+		cfg.OIDC.ClientSecret = "snapshot-secret"
+		cfg.Observability.Metrics = true
+		cfg.Daemon.SnapshotFile = snapshotFile
+	})
+	d.SetBuildInfo(httpserver.BuildInfo{Version: "v1.2.3"})
+
+	filesDir := filepath.Join(tmpDir, "openvpn")
+	if err := os.Mkdir(filesDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := d.handleAuthRequest(context.Background(), &ipc.AuthRequest{
+		Username:             "testuser",
+		UntrustedIP:          "192.0.2.1",
+		UntrustedPort:        "12345",
+		AuthControlFile:      filepath.Join(filesDir, "auth_control"),
+		AuthPendingFile:      filepath.Join(filesDir, "auth_pending"),
+		AuthFailedReasonFile: filepath.Join(filesDir, "auth_failed"),
+		PendingAuthMethod:    "webauth",
+	})
+	if err != nil {
+		t.Fatalf("handleAuthRequest failed: %v", err)
+	}
+	sess, err := d.sessionMgr.Get(resp.SessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The IdP stops serving keys after startup
+	broken.Store(true)
+
+	d.handleSnapshotSignal()
+	deadline := time.Now().Add(5 * time.Second)
+	for d.snapshotting.Load() && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	data, err := os.ReadFile(snapshotFile)
+	if err != nil {
+		t.Fatalf("snapshot not written: %v", err)
+	}
+	info, err := os.Stat(snapshotFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("snapshot permissions = %o, want 600", perm)
+	}
+	for _, secret := range []string{sess.State, sess.CodeVerifier, sess.Nonce, "snapshot-secret", "testuser", "192.0.2.1"} {
+		if strings.Contains(string(data), secret) {
+			t.Errorf("snapshot contains %q", secret)
+		}
+	}
+
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		t.Fatalf("invalid snapshot JSON: %v", err)
+	}
+	if snap.SnapshotVersion != snapshotVersion || snap.Version != "v1.2.3" {
+		t.Errorf("snapshot_version, version = %d, %q, want %d, %q", snap.SnapshotVersion, snap.Version, snapshotVersion, "v1.2.3")
+	}
+	if len(snap.ConfigHash) != 64 {
+		t.Errorf("config_hash = %q, want SHA-256 hex", snap.ConfigHash)
+	}
+	if len(snap.Sessions) != 1 || snap.Sessions[0].SessionID != sess.ID ||
+		snap.Sessions[0].User != d.pseudonym("testuser") || snap.Sessions[0].ClientNetwork != "192.0.2.0/24" {
+		t.Errorf("sessions = %+v, want the pending testuser session", snap.Sessions)
+	}
+	if snap.Stats.Total != 1 || snap.Stats.Pending != 1 {
+		t.Errorf("session_stats = %+v, want 1 pending", snap.Stats)
+	}
+	if got := snap.Metrics["openvpn_keycloak_auth_auth_requests_total"]; got != 1 {
+		t.Errorf("auth_requests_total = %v, want 1", got)
+	}
+	if len(snap.IdP) != 1 || snap.IdP[0].Healthy || !strings.Contains(snap.IdP[0].Error, "JWKS") {
+		t.Errorf("idp = %+v, want one unhealthy provider with a JWKS error", snap.IdP)
+	}
+
+	// The config hash only changes with the configuration
+	again, err := d.buildSnapshot(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ConfigHash != snap.ConfigHash {
+		t.Errorf("config hash changed without a config change: %s != %s", again.ConfigHash, snap.ConfigHash)
+	}
+
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if strings.Contains(e.Name(), ".tmp-") {
+			t.Errorf("temporary file %s left behind", e.Name())
+		}
+	}
+}
+
+func TestSnapshotPseudonyms(t *testing.T) {
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{"198.51.100.23", "198.51.100.0/24"},
+		{"::ffff:198.51.100.23", "198.51.100.0/24"},
+		{"2001:db8:1234:5678::1", "2001:db8:1234::/48"},
+		{"not-an-ip", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := clientNetwork(tt.ip); got != tt.want {
+			t.Errorf("clientNetwork(%q) = %q, want %q", tt.ip, got, tt.want)
+		}
+	}
+
+	d := &Daemon{}
+	d.snapshotKey[0] = 1
+	if d.pseudonym("alice") != d.pseudonym("alice") || d.pseudonym("alice") == d.pseudonym("bob") {
+		t.Error("pseudonyms must be stable per value and differ between values")
+	}
+	if got := d.pseudonym(""); got != "" {
+		t.Errorf("pseudonym of empty value = %q, want empty", got)
+	}
+	other := &Daemon{}
+	other.snapshotKey[0] = 2
+	if d.pseudonym("alice") == other.pseudonym("alice") {
+		t.Error("pseudonyms must depend on the daemon's key")
+	}
+}
+
+func TestHandleAuthRequest_SelectsProvider(t *testing.T) {
+	employees := oidctest.NewIssuer(t, nil)
+	contractors := oidctest.NewIssuer(t, nil)
+	tmpDir := t.TempDir()
+	d := newTestDaemon(t, func(cfg *config.Config) {
+		cfg.OIDC.Issuer = employees
+		cfg.OIDC.Providers = []config.OIDCProviderConfig{{
+			Name:             "contractors",
+			CommonNameSuffix: ".contractors",
+			Issuer:           contractors,
+		}}
+	})
+
+	tests := []struct {
+		name         string
+		commonName   string
+		wantProvider string
+		wantIssuer   string
+	}{
+		{"matching common name", "alice.contractors", "contractors", contractors},
+		{"no match uses default", "bob.staff", config.DefaultOIDCProvider, employees},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := &ipc.AuthRequest{
+				Username:             "user",
+				CommonName:           tt.commonName,
+				AuthControlFile:      filepath.Join(tmpDir, fmt.Sprintf("auth_control_%d", i)),
+				AuthPendingFile:      filepath.Join(tmpDir, fmt.Sprintf("auth_pending_%d", i)),
+				AuthFailedReasonFile: filepath.Join(tmpDir, fmt.Sprintf("auth_failed_%d", i)),
+				PendingAuthMethod:    "webauth",
+			}
+
+			resp, err := d.handleAuthRequest(context.Background(), req)
+			if err != nil {
+				t.Fatalf("handleAuthRequest failed: %v", err)
+			}
+
+			sess, err := d.sessionMgr.Get(resp.SessionID)
+			if err != nil {
+				t.Fatalf("failed to retrieve session: %v", err)
+			}
+			if sess.Provider != tt.wantProvider {
+				t.Errorf("session provider = %q, want %q", sess.Provider, tt.wantProvider)
+			}
+			if !strings.HasPrefix(sess.AuthURL, tt.wantIssuer+"/auth") {
+				t.Errorf("auth URL = %q, want prefix %q", sess.AuthURL, tt.wantIssuer+"/auth")
+			}
+		})
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	issuer := oidctest.NewIssuer(t, nil)
+	newConfig := func() *config.Config {
+		return newTestConfig(t, func(cfg *config.Config) {
+			cfg.OIDC.Issuer = issuer
+			cfg.OIDC.RequiredRoles = []string{"vpn-user"}
+		})
+	}
+
+	d, err := New(newConfig())
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+	defer d.sessionMgr.Stop()
+
+	if err := d.ReloadConfig(context.Background()); err == nil {
+		t.Fatal("expected error without a config loader")
+	}
+
+	t.Run("load failure keeps current config", func(t *testing.T) {
+		d.SetConfigLoader(func() (*config.Config, error) {
+			return nil, fmt.Errorf("broken yaml")
+		})
+		if err := d.ReloadConfig(context.Background()); err == nil {
+			t.Fatal("expected error, got nil")
+		}
+		cfg, _ := d.current()
+		if cfg.OIDC.RequiredRoles[0] != "vpn-user" {
+			t.Fatalf("required roles = %v, want unchanged", cfg.OIDC.RequiredRoles)
+		}
+	})
+
+	t.Run("swaps runtime settings and keeps listen addresses", func(t *testing.T) {
+		d.SetConfigLoader(func() (*config.Config, error) {
+			cfg := newConfig()
+			cfg.OIDC.RequiredRoles = []string{"vpn-admin"}
+			cfg.Auth.SessionTimeout = 60
+			cfg.Listen.HTTP = "127.0.0.1:1"
+			return cfg, nil
+		})
+		if err := d.ReloadConfig(context.Background()); err != nil {
+			t.Fatalf("ReloadConfig failed: %v", err)
+		}
+
+		cfg, providers := d.current()
+		if cfg.Listen.HTTP != "127.0.0.1:0" {
+			t.Errorf("listen.http = %q, want unchanged", cfg.Listen.HTTP)
+		}
+		p, ok := providers.Get("")
+		if !ok || p.Config().RequiredRoles[0] != "vpn-admin" {
+			t.Errorf("provider required roles not reloaded")
+		}
+
+		sess, err := d.sessionMgr.Create("user", "", "", "", "", "", "")
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		if got := sess.ExpiresAt.Sub(sess.CreatedAt); got != 60*time.Second {
+			t.Errorf("new session timeout = %v, want 60s", got)
+		}
+	})
+}
+
+func TestReloadConfigConcurrentWithAuthRequests(t *testing.T) {
+	tmpDir := t.TempDir()
+	d := newTestDaemon(t, nil)
+	cfg := d.cfg
+
+	d.SetConfigLoader(func() (*config.Config, error) {
+		next := *cfg
+		return &next, nil
+	})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			if err := d.ReloadConfig(context.Background()); err != nil {
+				t.Errorf("ReloadConfig failed: %v", err)
+				return
+			}
+		}
+	}()
+
+	for i := 0; i < 20; i++ {
+		req := &ipc.AuthRequest{
+			Username:             "testuser",
+			AuthControlFile:      filepath.Join(tmpDir, fmt.Sprintf("auth_control_%d", i)),
+			AuthPendingFile:      filepath.Join(tmpDir, fmt.Sprintf("auth_pending_%d", i)),
+			AuthFailedReasonFile: filepath.Join(tmpDir, fmt.Sprintf("auth_failed_%d", i)),
+			PendingAuthMethod:    "webauth",
+		}
+		if _, err := d.handleAuthRequest(context.Background(), req); err != nil {
+			t.Fatalf("handleAuthRequest failed: %v", err)
 		}
-	case <-time.After(5 * time.Second):
-		// Best-effort cleanup to avoid leaking goroutines/sockets on failure.
-		_ = d.ipcServer.Stop()
-		d.sessionMgr.Stop()
-		t.Fatal("timeout waiting for Run to return")
 	}
+	<-done
 }
@@ -0,0 +1,80 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/oidc"
+)
+
+const (
+	// discoveryAttemptTimeout bounds a single round of OIDC discovery.
+	discoveryAttemptTimeout = 30 * time.Second
+
+	// discoveryDeadline bounds startup discovery including all retries.
+	discoveryDeadline = 5 * time.Minute
+
+	// maxDiscoveryBackoff caps the wait between two discovery attempts.
+	maxDiscoveryBackoff = 30 * time.Second
+)
+
+// discoverProviders runs OIDC discovery for every provider, retrying up to
+// retries times while an issuer is unreachable, e.g. because Keycloak
+// restarts at the same time as the daemon. The wait starts at backoff and
+// doubles after each attempt, up to maxDiscoveryBackoff. Retrying stops at
+// discoveryDeadline or when ctx is cancelled.
+func discoverProviders(ctx context.Context, cfg *config.OIDCConfig, retries int, backoff time.Duration) (*oidc.Registry, error) {
+	ctx, cancel := context.WithTimeout(ctx, discoveryDeadline)
+	defer cancel()
+
+	delay := backoff
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancelAttempt := context.WithTimeout(ctx, discoveryAttemptTimeout)
+		providers, err := oidc.NewRegistry(attemptCtx, cfg)
+		cancelAttempt()
+		if err == nil {
+			return providers, nil
+		}
+		if attempt >= retries {
+			return nil, err
+		}
+
+		slog.Warn("OIDC discovery failed, retrying",
+			"attempt", attempt+1,
+			"retries", retries,
+			"retry_in", delay.String(),
+			"error", err,
+		)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("OIDC discovery aborted after %d attempts: %w (last error: %w)", attempt+1, ctx.Err(), err)
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxDiscoveryBackoff)
+	}
+}
+
+// refreshDiscovery fetches the discovery document of every current OIDC
+// provider again every interval until stop is closed. Providers that fail to
+// refresh keep their previous endpoints.
+func (d *Daemon) refreshDiscovery(stop <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		_, providers := d.current()
+		ctx, cancel := context.WithTimeout(context.Background(), discoveryAttemptTimeout)
+		if err := providers.Refresh(ctx); err != nil {
+			slog.Warn("OIDC discovery refresh failed; keeping previous endpoints", "error", err)
+		}
+		cancel()
+	}
+}
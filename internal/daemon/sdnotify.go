@@ -0,0 +1,94 @@
+package daemon
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state string (e.g. "READY=1") to the systemd notification
+// socket named by $NOTIFY_SOCKET. It returns false without an error when the
+// variable is unset, i.e. when not running as a Type=notify service.
+func sdNotify(state string) (bool, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return false, nil
+	}
+	// A leading '@' denotes a socket in the abstract namespace
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("failed to connect to systemd notify socket: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("failed to send systemd notification: %w", err)
+	}
+	return true, nil
+}
+
+// watchdogInterval returns the systemd watchdog timeout from $WATCHDOG_USEC
+// (set when the unit has WatchdogSec=). It returns 0 when the watchdog is
+// disabled or meant for another process ($WATCHDOG_PID).
+func watchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// notifyReady tells systemd the daemon has finished starting and, when a
+// watchdog is configured, sends WATCHDOG=1 at half the timeout until stop is
+// closed. If check is not nil, a ping is only sent while check succeeds, so
+// systemd restarts the daemon once it keeps failing. It is a no-op outside
+// systemd.
+func notifyReady(stop <-chan struct{}, check func() error) {
+	sent, err := sdNotify("READY=1")
+	if err != nil {
+		slog.Warn("systemd readiness notification failed", "error", err)
+		return
+	}
+	if !sent {
+		slog.Debug("NOTIFY_SOCKET not set, skipping systemd readiness notification")
+		return
+	}
+	slog.Info("notified systemd of readiness")
+
+	timeout := watchdogInterval()
+	if timeout == 0 {
+		return
+	}
+	slog.Info("systemd watchdog enabled", "timeout", timeout)
+
+	go func() {
+		ticker := time.NewTicker(timeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if check != nil {
+					if err := check(); err != nil {
+						slog.Error("watchdog self-test failed, withholding watchdog ping", "error", err)
+						continue
+					}
+				}
+				if _, err := sdNotify("WATCHDOG=1"); err != nil {
+					slog.Warn("systemd watchdog notification failed", "error", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,32 @@
+package daemon
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// selfTestTimeout bounds a single watchdog self-test.
+const selfTestTimeout = 10 * time.Second
+
+// selfTest checks the core auth path: every OIDC issuer must serve its
+// discovery document and JWKS, and the session manager must be able to add
+// and remove a session (see session.Manager.SelfTest).
+func (d *Daemon) selfTest(ctx context.Context) error {
+	_, providers := d.current()
+	if err := providers.SelfTest(ctx); err != nil {
+		return fmt.Errorf("OIDC self-test failed: %w", err)
+	}
+
+	if err := d.sessionMgr.SelfTest(); err != nil {
+		return fmt.Errorf("session self-test failed: %w", err)
+	}
+	return nil
+}
+
+// watchdogSelfTest runs selfTest with selfTestTimeout for the watchdog loop.
+func (d *Daemon) watchdogSelfTest() error {
+	ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+	defer cancel()
+	return d.selfTest(ctx)
+}
@@ -0,0 +1,233 @@
+package daemon
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/ipc"
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/session"
+)
+
+// snapshotVersion is the format version of the diagnostic snapshot.
+const snapshotVersion = 2
+
+// Prefix lengths client addresses are truncated to in a snapshot.
+const (
+	snapshotIPv4Bits = 24
+	snapshotIPv6Bits = 48
+)
+
+// snapshot is the JSON document written on SIGUSR2 for offline analysis.
+// Sessions carry no OIDC state, PKCE verifier or auth URL, usernames and
+// common names are pseudonymized and client addresses truncated to their
+// network, and the config is only identified by its hash, so the file can
+// be attached to a support ticket.
+type snapshot struct {
+	SnapshotVersion int       `json:"snapshot_version"`
+	Version         string    `json:"version,omitempty"`
+	GeneratedAt     time.Time `json:"generated_at"`
+	// ConfigHash is the SHA-256 of the effective configuration without
+	// secrets, to tell whether two snapshots ran with the same settings
+	ConfigHash string             `json:"config_hash"`
+	Ready      bool               `json:"ready"`
+	NotReady   string             `json:"not_ready_reason,omitempty"`
+	IdP        []snapshotIdP      `json:"idp"`
+	Stats      snapshotStats      `json:"session_stats"`
+	Sessions   []snapshotSession  `json:"sessions"`
+	Metrics    map[string]float64 `json:"metrics,omitempty"`
+}
+
+// snapshotSession is a tracked session without personal data. User and
+// CommonName are keyed hashes that stay the same for the lifetime of the
+// daemon, so the sessions of one user can be told apart from others'
+// across snapshots without naming the user.
+type snapshotSession struct {
+	SessionID     string    `json:"session_id"`
+	User          string    `json:"user"`
+	CommonName    string    `json:"common_name,omitempty"`
+	ClientNetwork string    `json:"client_network,omitempty"` // /24 (IPv4) or /48 (IPv6)
+	Provider      string    `json:"provider,omitempty"`
+	CreatedAt     time.Time `json:"created_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	State         string    `json:"state"`
+}
+
+// snapshotIdP is the self-test result of one OIDC provider.
+type snapshotIdP struct {
+	Provider string `json:"provider"`
+	Healthy  bool   `json:"healthy"`
+	Error    string `json:"error,omitempty"`
+}
+
+// snapshotStats is session.Stats with durations in seconds.
+type snapshotStats struct {
+	Total             int     `json:"total"`
+	Pending           int     `json:"pending"`
+	Completed         int     `json:"completed"`
+	OldestAgeSeconds  float64 `json:"oldest_age_seconds"`
+	AverageAgeSeconds float64 `json:"average_age_seconds"`
+}
+
+// handleSnapshotSignal writes a snapshot to daemon.snapshot_file in the
+// background, so a slow IdP self-test never holds up the signal loop. A
+// signal received while a snapshot is still being written is ignored.
+func (d *Daemon) handleSnapshotSignal() {
+	cfg, _ := d.current()
+	path := cfg.Daemon.SnapshotFile
+	if path == "" {
+		slog.Warn("SIGUSR2 received but daemon.snapshot_file is not set, ignoring")
+		return
+	}
+	if !d.snapshotting.CompareAndSwap(false, true) {
+		slog.Warn("SIGUSR2 received while a snapshot is being written, ignoring")
+		return
+	}
+
+	go func() {
+		defer d.snapshotting.Store(false)
+
+		ctx, cancel := context.WithTimeout(context.Background(), selfTestTimeout)
+		defer cancel()
+		if err := d.writeSnapshot(ctx, path); err != nil {
+			slog.Error("failed to write diagnostic snapshot", "file", path, "error", err)
+			return
+		}
+		slog.Info("diagnostic snapshot written", "file", path)
+	}()
+}
+
+// buildSnapshot collects the current state. ctx bounds the IdP self-tests.
+func (d *Daemon) buildSnapshot(ctx context.Context) (*snapshot, error) {
+	cfg, providers := d.current()
+
+	cfgJSON, err := json.Marshal(cfg.Redact())
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode config: %w", err)
+	}
+	hash := sha256.Sum256(cfgJSON)
+
+	sessions, err := d.handleListSessions(ctx, &ipc.ListSessionsRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &snapshot{
+		SnapshotVersion: snapshotVersion,
+		Version:         d.version,
+		GeneratedAt:     time.Now().UTC(),
+		ConfigHash:      hex.EncodeToString(hash[:]),
+		Stats:           toSnapshotStats(d.sessionMgr.Stats()),
+		Sessions:        make([]snapshotSession, 0, len(sessions.Sessions)),
+		Metrics:         d.metrics.Counters(),
+	}
+	for _, s := range sessions.Sessions {
+		snap.Sessions = append(snap.Sessions, snapshotSession{
+			SessionID:     s.SessionID,
+			User:          d.pseudonym(s.Username),
+			CommonName:    d.pseudonym(s.CommonName),
+			ClientNetwork: clientNetwork(s.UntrustedIP),
+			Provider:      s.Provider,
+			CreatedAt:     s.CreatedAt,
+			ExpiresAt:     s.ExpiresAt,
+			State:         s.State,
+		})
+	}
+	snap.Ready, snap.NotReady = d.readiness.Ready()
+
+	for name, err := range providers.SelfTestEach(ctx) {
+		idp := snapshotIdP{Provider: name, Healthy: err == nil}
+		if err != nil {
+			idp.Error = err.Error()
+		}
+		snap.IdP = append(snap.IdP, idp)
+	}
+	slices.SortFunc(snap.IdP, func(a, b snapshotIdP) int {
+		return strings.Compare(a.Provider, b.Provider)
+	})
+	return snap, nil
+}
+
+// pseudonym returns the keyed hash of value written to snapshots in its
+// place, or "" for an empty value. The key is random per daemon process, so
+// the hashes cannot be reversed by hashing candidate usernames.
+func (d *Daemon) pseudonym(value string) string {
+	if value == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, d.snapshotKey[:])
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// clientNetwork truncates a client address to its /24 (IPv4) or /48
+// (IPv6) network, or returns "" if it is not an IP address.
+func clientNetwork(ip string) string {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return ""
+	}
+	bits := snapshotIPv6Bits
+	if addr.Unmap().Is4() {
+		addr, bits = addr.Unmap(), snapshotIPv4Bits
+	}
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return ""
+	}
+	return prefix.String()
+}
+
+// toSnapshotStats converts session statistics for the snapshot.
+func toSnapshotStats(s session.Stats) snapshotStats {
+	return snapshotStats{
+		Total:             s.Total,
+		Pending:           s.Pending,
+		Completed:         s.Completed,
+		OldestAgeSeconds:  s.OldestAge.Seconds(),
+		AverageAgeSeconds: s.AverageAge.Seconds(),
+	}
+}
+
+// writeSnapshot builds a snapshot and atomically replaces path with it.
+// It is written with mode 0600, as session IDs and client networks are
+// still operational details.
+func (d *Daemon) writeSnapshot(ctx context.Context, path string) error {
+	snap, err := d.buildSnapshot(ctx)
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(snap, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+
+	// os.CreateTemp creates the file with mode 0600
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot file: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write snapshot file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write snapshot file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace snapshot file: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package httpserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
+)
+
+// newACMEManager creates an autocert manager for tls.acme. Certificates are
+// obtained on the first TLS handshake for one of the configured domains and
+// renewed before they expire; the account key and certificates are kept in
+// the cache directory so restarts do not hit the CA's rate limits.
+func newACMEManager(cfg config.ACMEConfig) (*autocert.Manager, error) {
+	// The cache holds the account and certificate private keys
+	if err := os.MkdirAll(cfg.CacheDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create ACME cache directory: %w", err)
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cfg.CacheDir),
+		HostPolicy: autocert.HostWhitelist(cfg.Domains...),
+		Email:      cfg.Email,
+	}
+	if cfg.DirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: cfg.DirectoryURL}
+	}
+	return m, nil
+}
+
+// newChallengeServer creates the plain HTTP server that answers the CA's
+// HTTP-01 challenges on tls.acme.http_challenge_addr. Other requests are
+// redirected to HTTPS.
+func newChallengeServer(addr string, m *autocert.Manager) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           m.HTTPHandler(nil),
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		IdleTimeout:       60 * time.Second,
+	}
+}
+
+// listenChallenge binds the HTTP-01 challenge address, if ACME is enabled.
+func (s *Server) listenChallenge() error {
+	if s.challengeServer == nil || s.challengeListener != nil {
+		return nil
+	}
+	ln, err := net.Listen("tcp", s.challengeServer.Addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen for ACME HTTP-01 challenges: %w", err)
+	}
+	s.challengeListener = ln
+	return nil
+}
+
+// serveChallenge serves HTTP-01 challenges until Shutdown. A failure only
+// affects certificate issuance, so it is logged rather than stopping the
+// daemon.
+func (s *Server) serveChallenge() {
+	slog.Info("serving ACME HTTP-01 challenges", "addr", s.challengeListener.Addr().String())
+	if err := s.challengeServer.Serve(s.challengeListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("ACME challenge server failed", "error", err)
+	}
+}
+
+// shutdownChallenge stops the HTTP-01 challenge server, if any.
+func (s *Server) shutdownChallenge(ctx context.Context) error {
+	if s.challengeServer == nil {
+		return nil
+	}
+	return s.challengeServer.Shutdown(ctx)
+}
@@ -0,0 +1,193 @@
+package httpserver
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// APIVersion is the version of the JSON API exposed under /api/.
+// It is returned in every API response and in the X-API-Version header so
+// clients can detect incompatible daemons.
+const APIVersion = "1"
+
+// AuthStartResponse is the JSON response for POST /api/auth/start.
+//
+// Embedded-browser clients that cannot follow the 302 from /auth/<state>
+// call this endpoint with the session token (the state from the WEB_AUTH
+// URL) and load AuthURL in their webview. The existing /callback endpoint
+// completes the flow.
+type AuthStartResponse struct {
+	APIVersion string    `json:"api_version"`
+	AuthURL    string    `json:"auth_url"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+// APIErrorResponse is the JSON body returned by API endpoints on failure.
+type APIErrorResponse struct {
+	APIVersion string `json:"api_version"`
+	Error      string `json:"error"`
+}
+
+// handleAPIAuthStart handles POST /api/auth/start.
+// The session token must be supplied as "Authorization: Bearer <token>".
+func (s *Server) handleAPIAuthStart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		s.writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	token, ok := bearerToken(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="openvpn-keycloak-auth"`)
+		s.writeAPIError(w, http.StatusUnauthorized, "missing or malformed bearer token")
+		return
+	}
+
+	if s.sessionMgr == nil {
+		s.writeAPIError(w, http.StatusServiceUnavailable, "session manager unavailable")
+		return
+	}
+
+	sess, err := s.sessionMgr.GetByState(token)
+	if err != nil {
+		slog.Warn("api auth start: session not found", // #nosec G706 -- values sanitized via sanitizeLog
+			"state", sanitizeLog(token),
+			"error", err,
+		)
+		s.writeAPIError(w, http.StatusNotFound, "session not found or expired")
+		return
+	}
+
+	if sess.AuthURL == "" {
+		s.writeAPIError(w, http.StatusConflict, "authentication flow not initialized")
+		return
+	}
+
+	slog.Debug("api auth start", "session_id", sess.ID, "correlation_id", sess.CorrelationID)
+
+	s.writeAPIResponse(w, http.StatusOK, AuthStartResponse{
+		APIVersion: APIVersion,
+		AuthURL:    sess.AuthURL,
+		ExpiresAt:  sess.ExpiresAt,
+	})
+}
+
+// ConfigResponse is the JSON response for GET /api/config.
+//
+// Client provisioning tools use it to configure VPN clients consistently
+// with the daemon. It only contains settings that are safe to share with
+// clients; secrets and authorization rules are never included.
+type ConfigResponse struct {
+	APIVersion     string               `json:"api_version"`
+	SSOMethods     []string             `json:"sso_methods"`
+	Issuer         string               `json:"issuer"`
+	ClientID       string               `json:"client_id"`
+	ClientMode     string               `json:"client_mode"`
+	RedirectURI    string               `json:"redirect_uri"`
+	Scopes         []string             `json:"scopes"`
+	SessionTimeout int                  `json:"session_timeout"`
+	Providers      []ProviderConfigInfo `json:"providers,omitempty"`
+}
+
+// ProviderConfigInfo describes an additional OIDC provider in ConfigResponse.
+type ProviderConfigInfo struct {
+	Name             string   `json:"name"`
+	CommonNameSuffix string   `json:"common_name_suffix,omitempty"`
+	UsernamePrefix   string   `json:"username_prefix,omitempty"`
+	Issuer           string   `json:"issuer"`
+	ClientID         string   `json:"client_id"`
+	Scopes           []string `json:"scopes"`
+}
+
+// handleAPIConfig handles GET /api/config.
+// The configured token must be supplied as "Authorization: Bearer <token>".
+func (s *Server) handleAPIConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		s.writeAPIError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	cfg, _ := s.current()
+
+	token, ok := bearerToken(r)
+	want := cfg.HTTPServer.ConfigAPIToken
+	if !ok || want == "" || subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="openvpn-keycloak-auth"`)
+		s.writeAPIError(w, http.StatusUnauthorized, "missing or invalid bearer token")
+		return
+	}
+
+	// Build the response from the redacted copy so a secret can never leak
+	cfg = cfg.Redact()
+
+	// Same preference order as the auth script
+	methods := []string{"webauth", "openurl"}
+	if cfg.Auth.EnableCRText {
+		methods = append(methods, "crtext")
+	}
+
+	resp := ConfigResponse{
+		APIVersion:     APIVersion,
+		SSOMethods:     methods,
+		Issuer:         cfg.OIDC.Issuer,
+		ClientID:       cfg.OIDC.ClientID,
+		ClientMode:     cfg.OIDC.ClientMode(),
+		RedirectURI:    cfg.OIDC.RedirectURI,
+		Scopes:         cfg.OIDC.Scopes,
+		SessionTimeout: cfg.Auth.SessionTimeout,
+	}
+	for _, p := range cfg.OIDC.Providers {
+		providerCfg := cfg.OIDC.ForProvider(p)
+		resp.Providers = append(resp.Providers, ProviderConfigInfo{
+			Name:             p.Name,
+			CommonNameSuffix: p.CommonNameSuffix,
+			UsernamePrefix:   p.UsernamePrefix,
+			Issuer:           providerCfg.Issuer,
+			ClientID:         providerCfg.ClientID,
+			Scopes:           providerCfg.Scopes,
+		})
+	}
+
+	s.writeAPIResponse(w, http.StatusOK, resp)
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer <token>" header.
+func bearerToken(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	scheme, token, found := strings.Cut(header, " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return "", false
+	}
+	return token, true
+}
+
+// writeAPIError writes a JSON error response.
+func (s *Server) writeAPIError(w http.ResponseWriter, status int, msg string) {
+	s.writeAPIResponse(w, status, APIErrorResponse{
+		APIVersion: APIVersion,
+		Error:      msg,
+	})
+}
+
+// writeAPIResponse writes a JSON API response with the API version header.
+func (s *Server) writeAPIResponse(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-API-Version", APIVersion)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		// Best-effort: headers/status may already be written.
+		slog.Error("failed to encode API response", "error", err)
+	}
+}
@@ -1,16 +1,69 @@
 package httpserver
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"strings"
 
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/audit"
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/authorizer"
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/metrics"
 	"github.com/al-bashkir/openvpn-keycloak-auth/internal/oidc"
 	"github.com/al-bashkir/openvpn-keycloak-auth/internal/openvpn"
 	"github.com/al-bashkir/openvpn-keycloak-auth/internal/session"
 )
 
+// Reasons written to auth_failed_reason_file. OpenVPN passes them on to the
+// client, so they only name the failure category; the details are logged.
+const (
+	reasonIdPError          = "Login failed at the identity provider"
+	reasonUnknownProvider   = "Unknown identity provider"
+	reasonTokenExchange     = "Token exchange failed"
+	reasonTokenTimeout      = "Identity provider did not respond in time"
+	reasonCodeExpired       = "Login took too long, please reconnect and try again"
+	reasonTokenVerification = "Token verification failed"
+	reasonAuthTooOld        = "Sign-in too old, please sign in again"
+	reasonACRNotMet         = "Required sign-in method not used"
+	reasonDeniedRole        = "Access denied for this account"
+	reasonRolesUnavailable  = "VPN group membership not available"
+	reasonNotAuthorized     = "Not a member of required VPN group"
+	reasonUsernameMismatch  = "Username mismatch"
+	reasonCNMismatch        = "Certificate does not match account"
+)
+
+// failureReason returns the auth_failed_reason_file text for err, a failed
+// token exchange or claim check, or fallback if err has no category of its
+// own.
+func failureReason(err error, fallback string) string {
+	switch {
+	case errors.Is(err, oidc.ErrTokenExchangeTimeout):
+		return reasonTokenTimeout
+	case errors.Is(err, oidc.ErrCodeExpired):
+		return reasonCodeExpired
+	case errors.Is(err, oidc.ErrTokenVerification), errors.Is(err, oidc.ErrNonceMismatch):
+		return reasonTokenVerification
+	case errors.Is(err, oidc.ErrAuthTooOld):
+		return reasonAuthTooOld
+	case errors.Is(err, oidc.ErrACRNotMet):
+		return reasonACRNotMet
+	case errors.Is(err, oidc.ErrDeniedRole):
+		return reasonDeniedRole
+	case errors.As(err, new(*oidc.RolesUnavailableError)):
+		return reasonRolesUnavailable
+	case errors.Is(err, oidc.ErrMissingRole), errors.Is(err, oidc.ErrMissingGroup):
+		return reasonNotAuthorized
+	case errors.Is(err, oidc.ErrUsernameMismatch):
+		return reasonUsernameMismatch
+	case errors.Is(err, oidc.ErrCNMismatch):
+		return reasonCNMismatch
+	}
+	return fallback
+}
+
 // handleAuthRedirect handles short auth redirect URLs.
 // OpenVPN's auth_pending_file has a 256-char line limit (OPTION_LINE_SIZE).
 // Full OIDC auth URLs with PKCE parameters exceed this limit.
@@ -20,7 +73,11 @@ func (s *Server) handleAuthRedirect(w http.ResponseWriter, r *http.Request) {
 	// Extract state from URL path: /auth/{state}
 	state := strings.TrimPrefix(r.URL.Path, "/auth/")
 	if state == "" {
-		s.renderError(w, "Invalid auth URL")
+		s.renderError(w, r, "error.invalid_auth_url")
+		return
+	}
+	if !s.verifyState(r, state) {
+		s.renderError(w, r, "error.invalid_auth_url")
 		return
 	}
 
@@ -31,7 +88,7 @@ func (s *Server) handleAuthRedirect(w http.ResponseWriter, r *http.Request) {
 			"state", sanitizeLog(state),
 			"error", err,
 		)
-		s.renderError(w, "Session not found or expired. Please try connecting again.")
+		s.renderError(w, r, "error.session_not_found")
 		return
 	}
 
@@ -39,14 +96,16 @@ func (s *Server) handleAuthRedirect(w http.ResponseWriter, r *http.Request) {
 		slog.Error("auth redirect: no auth URL in session", // #nosec G706 -- values sanitized via sanitizeLog
 			"state", sanitizeLog(state),
 			"session_id", sess.ID,
+			"correlation_id", sess.CorrelationID,
 		)
-		s.renderError(w, "Authentication flow not initialized. Please try connecting again.")
+		s.renderError(w, r, "error.flow_not_initialized")
 		return
 	}
 
 	slog.Debug("auth redirect", // #nosec G706 -- values sanitized via sanitizeLog
 		"state", sanitizeLog(state),
 		"session_id", sess.ID,
+		"correlation_id", sess.CorrelationID,
 	)
 
 	http.Redirect(w, r, sess.AuthURL, http.StatusFound)
@@ -61,6 +120,9 @@ func (s *Server) handleAuthRedirect(w http.ResponseWriter, r *http.Request) {
 // 5. Validate username (if required)
 // 6. Write success/failure to OpenVPN control file
 func (s *Server) handleCallback(w http.ResponseWriter, r *http.Request) {
+	s.callbacks.Add(1)
+	defer s.callbacks.Add(-1)
+
 	// Extract callback parameters
 	code := r.URL.Query().Get("code")
 	state := r.URL.Query().Get("state")
@@ -79,23 +141,29 @@ func (s *Server) handleCallback(w http.ResponseWriter, r *http.Request) {
 			"error", sanitizeLog(errorParam),
 			"description", sanitizeLog(errorDesc),
 		)
-		msg := fmt.Sprintf("Authentication failed: %s", errorDesc)
-		if errorDesc == "" {
-			msg = fmt.Sprintf("Authentication failed: %s", errorParam)
+		// The page shows a filtered, truncated copy: both values come
+		// from the callback URL, which anyone can craft
+		desc := displayErrorDescription(errorDesc)
+		if desc == "" {
+			desc = displayErrorDescription(errorParam)
 		}
-
 		// Write auth failure immediately so OpenVPN doesn't hang until timeout
-		if state != "" && s.sessionMgr != nil {
+		if state != "" && s.sessionMgr != nil && s.verifyState(r, state) {
 			if sess, err := s.sessionMgr.GetByState(state); err == nil {
 				slog.Info("writing auth failure for OIDC error", // #nosec G706 -- values sanitized via sanitizeLog
 					"session_id", sess.ID,
+					"correlation_id", sess.CorrelationID,
 					"error", sanitizeLog(errorParam),
 				)
-				s.writeAuthFailure(sess, msg)
+				s.writeAuthFailure(sess, reasonIdPError, nil)
 			}
 		}
 
-		s.renderError(w, msg)
+		if desc != "" {
+			s.renderError(w, r, "error.auth_failed_detail", desc)
+		} else {
+			s.renderError(w, r, "error.auth_failed")
+		}
 		return
 	}
 
@@ -105,7 +173,22 @@ func (s *Server) handleCallback(w http.ResponseWriter, r *http.Request) {
 			"code_present", code != "",
 			"state_present", state != "",
 		)
-		s.renderError(w, "Invalid callback parameters")
+		s.renderError(w, r, "error.invalid_callback")
+		return
+	}
+	if !s.verifyState(r, state) {
+		s.renderError(w, r, "error.invalid_callback")
+		return
+	}
+
+	// Reject replayed authorization codes before the session lookup and
+	// token exchange, with a clearer message than the exchange would give
+	if cfg, _ := s.current(); cfg.Auth.RejectReusedCodes && s.usedCodes.markUsed(code) {
+		slog.Warn("authorization code reuse rejected", // #nosec G706 -- values sanitized via sanitizeLog
+			"state", sanitizeLog(state),
+			"ip", extractIP(r, s.trustedProxies),
+		)
+		s.renderError(w, r, "error.code_already_used")
 		return
 	}
 
@@ -116,7 +199,7 @@ func (s *Server) handleCallback(w http.ResponseWriter, r *http.Request) {
 			"state", sanitizeLog(state),
 			"error", err,
 		)
-		s.renderError(w, "Session not found or expired. Please try connecting again.")
+		s.renderError(w, r, "error.session_not_found")
 		return
 	}
 
@@ -134,87 +217,281 @@ func (s *Server) handleCallback(w http.ResponseWriter, r *http.Request) {
 
 		slog.Error("callback completed without writing result, writing failure",
 			"session_id", session.ID,
+			"correlation_id", session.CorrelationID,
 		)
 
-		if err := openvpn.WriteAuthFailure(
+		if err := s.controlFiles().WriteAuthFailure(
 			session.AuthControlFile,
 			session.AuthFailedReasonFile,
 			"Internal error",
-		); err != nil {
+		); err != nil && !errors.Is(err, openvpn.ErrResultExists) {
 			slog.Error("failed to write safety-net auth failure",
 				"session_id", session.ID,
+				"correlation_id", session.CorrelationID,
 				"error", err,
 			)
 			// Keep session for cleanup/retry attempts.
 			return
 		}
 
-		_ = s.sessionMgr.MarkResultWritten(session.ID)
+		s.recordAudit(session, audit.ResultFailure, "Internal error", nil)
+		_ = s.sessionMgr.SetResult(session.ID, false)
 		s.sessionMgr.Delete(session.ID)
 	}()
 
-	// Exchange code for tokens
-	tokenData, err := s.oidcProvider.ExchangeCode(r.Context(), code, session.CodeVerifier)
-	if err != nil {
-		slog.Error("token exchange failed", // #nosec G706 -- session.ID is crypto/rand hex; err is from OIDC library
+	// Snapshot the config so a concurrent reload cannot mix old and new settings
+	cfg, providers := s.current()
+
+	// Use the provider that started this session's flow
+	provider, ok := providers.Get(session.Provider)
+	if !ok {
+		slog.Error("OIDC provider not found for session", // #nosec G706 -- values sanitized via sanitizeLog
 			"session_id", session.ID,
-			"error", err,
+			"correlation_id", session.CorrelationID,
+			"provider", sanitizeLog(session.Provider),
 		)
-		s.writeAuthFailure(session, "Token exchange failed")
-		s.renderError(w, "Authentication failed. Please try again.")
+		s.writeAuthFailure(session, reasonUnknownProvider, nil)
+		s.renderError(w, r, "error.auth_failed_retry")
 		return
 	}
 
-	// Validate token claims
-	validator := oidc.NewValidator(&s.cfg.OIDC, &s.cfg.Auth)
-
-	// Always validate roles (even when username mismatch is allowed)
-	if err := validator.ValidateRoles(tokenData.Claims); err != nil {
-		slog.Error("role validation failed", // #nosec G706 -- values sanitized via sanitizeLog
+	// Exchange code for tokens
+	tokenData, err := provider.ExchangeCode(r.Context(), code, session.CodeVerifier, session.Nonce)
+	if err != nil {
+		slog.Error("token exchange failed", // #nosec G706 -- session.ID is crypto/rand hex; err is from OIDC library
 			"session_id", session.ID,
-			"username", sanitizeLog(session.Username),
+			"correlation_id", session.CorrelationID,
 			"error", err,
 		)
-		s.writeAuthFailure(session, err.Error())
-		s.renderError(w, "Authentication failed: "+err.Error())
+		s.metrics.TokenExchangeFailed()
+		s.writeAuthFailure(session, failureReason(err, reasonTokenExchange), nil)
+		if errors.Is(err, oidc.ErrCodeExpired) {
+			s.renderError(w, r, "error.login_too_slow")
+		} else {
+			s.renderError(w, r, "error.auth_failed_retry")
+		}
 		return
 	}
 
-	// Validate username match unless explicitly allowed to differ
-	if !s.cfg.Auth.AllowUsernameMismatch {
-		if err := validator.ValidateToken(tokenData.Claims, session.Username); err != nil {
-			slog.Error("token validation failed", // #nosec G706 -- values sanitized via sanitizeLog
-				"session_id", session.ID,
-				"username", sanitizeLog(session.Username),
-				"error", err,
-			)
-			s.writeAuthFailure(session, err.Error())
-			s.renderError(w, "Authentication failed: "+err.Error())
+	// Validate token claims
+	validator := oidc.NewValidator(provider.Config(), &cfg.Auth)
+
+	// Recorded with every decision from here on to help helpdesk triage
+	auditContext := oidc.ContextClaims(tokenData.Claims, cfg.Auth.ContextClaims)
+
+	// Run the claim checks in the order of oidc.Validator.Checks and reject
+	// the login at the first failure. Roles and groups are always checked,
+	// even when username mismatch is allowed; together with the instance
+	// roles they form one authorization step that auth.external_authorizer
+	// decides on.
+	checks := validator.Checks(tokenData.Claims, oidc.CheckInput{
+		Username:          session.Username,
+		CommonName:        session.CommonName,
+		Instance:          session.Instance,
+		AccessTokenOpaque: tokenData.AccessTokenOpaque,
+	})
+	var authzErr error
+	for i, check := range checks {
+		if check.Kind != oidc.CheckAuthorization {
+			if check.Err != nil {
+				s.rejectCheck(w, r, session, check, auditContext)
+				return
+			}
+			continue
+		}
+		if authzErr == nil {
+			authzErr = check.Err
+		}
+		if i+1 < len(checks) && checks[i+1].Kind == oidc.CheckAuthorization {
+			continue
+		}
+		if !s.authorize(w, r, cfg, session, tokenData.Claims, authzErr, auditContext) {
 			return
 		}
 	}
 
 	// Extract username for logging (already validated by validator if AllowUsernameMismatch is false)
-	username, _ := tokenData.Claims[s.cfg.Auth.UsernameClaim].(string)
+	username, _ := tokenData.Claims[cfg.Auth.UsernameClaim].(string)
 
 	slog.Info("user authenticated successfully", // #nosec G706 -- values sanitized via sanitizeLog
 		"session_id", session.ID,
+		"correlation_id", session.CorrelationID,
 		"username", sanitizeLog(username),
 		"expected_username", sanitizeLog(session.Username),
 		"ip", sanitizeLog(session.UntrustedIP),
+		contextClaimsAttr(tokenData.Claims, cfg.Auth.ContextClaims),
 	)
 
 	// Authentication successful!
-	if err := s.writeAuthSuccess(session); err != nil {
-		s.renderError(w, "Authentication succeeded, but the VPN server could not be notified. Please try connecting again.")
+	if err := s.writeAuthSuccess(session, auditContext); err != nil {
+		s.renderError(w, r, "error.notify_failed")
 		return
 	}
 
-	s.renderSuccess(w, "You are now connected to the VPN. You may close this window.")
+	s.renderSuccess(w, r, "success.connected", session.CorrelationCode)
+}
+
+// rejectCheck fails the login for a failed claim check other than the
+// authorization step (see authorize).
+func (s *Server) rejectCheck(w http.ResponseWriter, r *http.Request, session *session.Session, check oidc.Check, contextClaims map[string]string) {
+	err := check.Err
+	switch check.Kind {
+	case oidc.CheckAuthTime:
+		// A login older than oidc.max_age must be repeated, whatever the roles
+		slog.Warn("authentication too old or without auth_time", // #nosec G706 -- values sanitized via sanitizeLog
+			"session_id", session.ID,
+			"correlation_id", session.CorrelationID,
+			"username", sanitizeLog(session.Username),
+			"error", err,
+		)
+		s.writeAuthFailure(session, failureReason(err, reasonTokenVerification), contextClaims)
+		if errors.Is(err, oidc.ErrAuthTooOld) {
+			s.renderError(w, r, "error.auth_too_old")
+		} else {
+			s.renderError(w, r, "error.auth_failed_detail", err.Error())
+		}
+	case oidc.CheckACR:
+		// The login must have used the authentication context
+		// oidc.required_acr asks for (e.g. a one-time code)
+		slog.Warn("authentication context not sufficient", // #nosec G706 -- values sanitized via sanitizeLog
+			"session_id", session.ID,
+			"correlation_id", session.CorrelationID,
+			"username", sanitizeLog(session.Username),
+			"error", err,
+		)
+		s.writeAuthFailure(session, failureReason(err, reasonACRNotMet), contextClaims)
+		s.renderError(w, r, "error.acr_not_met")
+	case oidc.CheckCommonName:
+		slog.Error("common name validation failed", // #nosec G706 -- values sanitized via sanitizeLog
+			"session_id", session.ID,
+			"correlation_id", session.CorrelationID,
+			"username", sanitizeLog(session.Username),
+			"common_name", sanitizeLog(session.CommonName),
+			"error", err,
+		)
+		s.writeAuthFailure(session, failureReason(err, reasonCNMismatch), contextClaims)
+		s.renderError(w, r, "error.auth_failed_detail", err.Error())
+	default:
+		slog.Error("token validation failed", // #nosec G706 -- values sanitized via sanitizeLog
+			"session_id", session.ID,
+			"correlation_id", session.CorrelationID,
+			"username", sanitizeLog(session.Username),
+			"check", check.Name,
+			"error", err,
+		)
+		s.writeAuthFailure(session, failureReason(err, reasonUsernameMismatch), contextClaims)
+		s.renderError(w, r, "error.auth_failed_detail", err.Error())
+	}
+}
+
+// authorize completes the authorization step: builtinErr is the first
+// failure of the roles, groups and instance roles checks, which
+// auth.external_authorizer, if set, decides on. It fails the login and
+// returns false if the user is not authorized.
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, cfg *config.Config, session *session.Session,
+	claims map[string]interface{}, builtinErr error, contextClaims map[string]string) bool {
+	// Roles missing altogether because the access token is opaque get
+	// their own error
+	if rolesErr := (*oidc.RolesUnavailableError)(nil); errors.As(builtinErr, &rolesErr) {
+		slog.Warn("role claims unavailable: the access token is opaque and the ID token carries no roles; "+
+			"enable \"Add to ID token\" on the role/group mappers of the client scope, or set oidc.fetch_userinfo",
+			"session_id", session.ID,
+			"correlation_id", session.CorrelationID,
+			"claims", strings.Join(rolesErr.Paths, ","),
+		)
+	}
+	err := builtinErr
+	var authorizerReason string
+	if authz := s.externalAuthorizer(); authz != nil {
+		err = externalAuthorize(r.Context(), authz, cfg, session, claims, builtinErr)
+		if err != nil && err != builtinErr {
+			// The authorizer's reason is sanitized and meant for the user
+			authorizerReason = err.Error()
+		}
+	}
+	if err == nil {
+		return true
+	}
+
+	slog.Error("authorization failed", // #nosec G706 -- values sanitized via sanitizeLog
+		"session_id", session.ID,
+		"correlation_id", session.CorrelationID,
+		"username", sanitizeLog(session.Username),
+		"error", err,
+	)
+	s.metrics.RoleValidationFailed()
+	reason := authorizerReason
+	if reason == "" {
+		reason = failureReason(err, reasonNotAuthorized)
+	}
+	s.writeAuthFailure(session, reason, contextClaims)
+	s.renderError(w, r, "error.auth_failed_detail", err.Error())
+	return false
 }
 
-// writeAuthSuccess writes success to the OpenVPN control file and deletes the session.
-func (s *Server) writeAuthSuccess(sess *session.Session) error {
+// externalAuthorize consults auth.external_authorizer through authz with
+// the validated claims and the connection context. builtinErr is the
+// result of the built-in role/group checks; the returned error, if any, is
+// the failure reason.
+func externalAuthorize(ctx context.Context, authz *authorizer.Client, cfg *config.Config, sess *session.Session,
+	claims map[string]interface{}, builtinErr error) error {
+	username, _ := claims[cfg.Auth.UsernameClaim].(string)
+	return authz.Decide(ctx, &authorizer.Request{
+		Username:         username,
+		ExpectedUsername: sess.Username,
+		CommonName:       sess.CommonName,
+		UntrustedIP:      sess.UntrustedIP,
+		Instance:         sess.Instance,
+		Provider:         sess.Provider,
+		SessionID:        sess.ID,
+		Claims:           claims,
+	}, builtinErr)
+}
+
+// verifyState checks the signature of state when oidc.state_secret is set,
+// so tampered states are rejected before the session lookup. A valid state
+// issued by another instance is accepted (a shared session store may still
+// know it) but logged, as it points at a proxy routing problem.
+func (s *Server) verifyState(r *http.Request, state string) bool {
+	cfg, _ := s.current()
+	if cfg.OIDC.StateSecret == "" {
+		return true
+	}
+
+	instanceID, err := oidc.VerifyState(state, cfg.OIDC.StateSecret)
+	if err != nil {
+		slog.Warn("rejecting state with invalid signature", // #nosec G706 -- values sanitized via sanitizeLog
+			"state", sanitizeLog(state),
+			"ip", extractIP(r, s.trustedProxies),
+		)
+		return false
+	}
+	if own := cfg.OIDC.StateInstanceID(); instanceID != own {
+		slog.Warn("state issued by another instance, check proxy routing", // #nosec G706 -- values sanitized via sanitizeLog
+			"state_instance", sanitizeLog(instanceID),
+			"instance", own,
+		)
+	}
+	return true
+}
+
+// contextClaimsAttr returns the configured auth.context_claims as a sanitized
+// "context" log group. Absent claims are left out; slog drops an empty group.
+func contextClaimsAttr(claims map[string]interface{}, paths []string) slog.Attr {
+	values := oidc.ContextClaims(claims, paths)
+	attrs := make([]any, 0, len(values))
+	for _, path := range paths {
+		if v, ok := values[path]; ok {
+			attrs = append(attrs, slog.String(sanitizeLog(path), sanitizeLog(v)))
+		}
+	}
+	return slog.Group("context", attrs...)
+}
+
+// writeAuthSuccess writes success to the OpenVPN control file and deletes the
+// session. contextClaims holds the auth.context_claims values for the audit
+// record.
+func (s *Server) writeAuthSuccess(sess *session.Session, contextClaims map[string]string) error {
 	if s.sessionMgr == nil {
 		return fmt.Errorf("session manager is nil")
 	}
@@ -226,13 +503,21 @@ func (s *Server) writeAuthSuccess(sess *session.Session) error {
 	if written {
 		slog.Warn("session already completed, skipping auth success write",
 			"session_id", sess.ID,
+			"correlation_id", sess.CorrelationID,
 		)
 		return nil
 	}
 
-	if err := openvpn.WriteAuthSuccess(sess.AuthControlFile); err != nil {
+	if err := s.controlFiles().WriteAuthSuccess(sess.AuthControlFile); err != nil {
+		if errors.Is(err, openvpn.ErrResultExists) {
+			// Another writer already decided; this session is finished.
+			_ = s.sessionMgr.MarkResultWritten(sess.ID)
+			s.sessionMgr.Delete(sess.ID)
+			return err
+		}
 		slog.Error("failed to write auth success",
 			"session_id", sess.ID,
+			"correlation_id", sess.CorrelationID,
 			"error", err,
 		)
 		return err
@@ -240,20 +525,27 @@ func (s *Server) writeAuthSuccess(sess *session.Session) error {
 
 	slog.Info("auth success written",
 		"session_id", sess.ID,
+		"correlation_id", sess.CorrelationID,
 		"username", sanitizeLog(sess.Username),
 		"ip", sanitizeLog(sess.UntrustedIP),
 	)
 
-	_ = s.sessionMgr.MarkResultWritten(sess.ID)
+	s.metrics.AuthSucceeded()
+	s.metrics.AuthFinished(metrics.OutcomeSuccess, sess.PendingAuthMethod, sess.CreatedAt)
+	s.recordAudit(sess, audit.ResultSuccess, "", contextClaims)
+	_ = s.sessionMgr.SetResult(sess.ID, true)
 	s.sessionMgr.Delete(sess.ID)
 	return nil
 }
 
-// writeAuthFailure writes failure to the OpenVPN control file and deletes the session.
-func (s *Server) writeAuthFailure(sess *session.Session, reason string) {
+// writeAuthFailure writes failure to the OpenVPN control file and deletes the
+// session. contextClaims holds the auth.context_claims values for the audit
+// record; it is nil for failures before the token was verified.
+func (s *Server) writeAuthFailure(sess *session.Session, reason string, contextClaims map[string]string) {
 	if s.sessionMgr == nil {
 		slog.Error("session manager is nil, cannot write auth failure", // #nosec G706 -- values sanitized via sanitizeLog
 			"session_id", sess.ID,
+			"correlation_id", sess.CorrelationID,
 			"reason", sanitizeLog(reason),
 		)
 		return
@@ -263,6 +555,7 @@ func (s *Server) writeAuthFailure(sess *session.Session, reason string) {
 	if !ok {
 		slog.Error("session not found, cannot write auth failure", // #nosec G706 -- values sanitized via sanitizeLog
 			"session_id", sess.ID,
+			"correlation_id", sess.CorrelationID,
 			"reason", sanitizeLog(reason),
 		)
 		return
@@ -270,17 +563,27 @@ func (s *Server) writeAuthFailure(sess *session.Session, reason string) {
 	if written {
 		slog.Warn("session already completed, skipping auth failure write", // #nosec G706 -- session.ID is crypto/rand hex
 			"session_id", sess.ID,
+			"correlation_id", sess.CorrelationID,
 		)
 		return
 	}
 
-	if err := openvpn.WriteAuthFailure(
+	s.reputation.recordFailure(sess.UntrustedIP)
+
+	if err := s.controlFiles().WriteAuthFailure(
 		sess.AuthControlFile,
 		sess.AuthFailedReasonFile,
 		reason,
 	); err != nil {
+		if errors.Is(err, openvpn.ErrResultExists) {
+			// Another writer already decided; this session is finished.
+			_ = s.sessionMgr.MarkResultWritten(sess.ID)
+			s.sessionMgr.Delete(sess.ID)
+			return
+		}
 		slog.Error("failed to write auth failure", // #nosec G706 -- session.ID is crypto/rand hex; err is internal
 			"session_id", sess.ID,
+			"correlation_id", sess.CorrelationID,
 			"error", err,
 		)
 		// Keep session for cleanup/retry attempts.
@@ -289,10 +592,33 @@ func (s *Server) writeAuthFailure(sess *session.Session, reason string) {
 
 	slog.Info("auth failure written", // #nosec G706 -- values sanitized via sanitizeLog
 		"session_id", sess.ID,
+		"correlation_id", sess.CorrelationID,
 		"username", sanitizeLog(sess.Username),
 		"reason", sanitizeLog(reason),
 	)
 
-	_ = s.sessionMgr.MarkResultWritten(sess.ID)
+	s.metrics.AuthFailed()
+	s.metrics.AuthFinished(metrics.OutcomeFailure, sess.PendingAuthMethod, sess.CreatedAt)
+	s.recordAudit(sess, audit.ResultFailure, reason, contextClaims)
+	_ = s.sessionMgr.SetResult(sess.ID, false)
 	s.sessionMgr.Delete(sess.ID)
 }
+
+// recordAudit writes an audit record for a decision written for sess, with
+// the auth.context_claims values in contextClaims.
+func (s *Server) recordAudit(sess *session.Session, result, reason string, contextClaims map[string]string) {
+	if s.audit == nil {
+		return
+	}
+	_, providers := s.current()
+	s.audit.Record(audit.Record{
+		Username:    sess.Username,
+		CommonName:  sess.CommonName,
+		UntrustedIP: sess.UntrustedIP,
+		Result:      result,
+		Reason:      reason,
+		SessionID:   sess.ID,
+		Issuer:      providers.Issuer(sess.Provider),
+		Context:     contextClaims,
+	})
+}
@@ -0,0 +1,134 @@
+package httpserver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
+)
+
+// defaultCertWatchInterval is how often tls.watch polls the certificate
+// files when tls.reload_interval is not set.
+const defaultCertWatchInterval = 30 * time.Second
+
+// certWatchInterval returns how often to poll the certificate files for
+// changes, or 0 to reload only on SIGHUP.
+func certWatchInterval(cfg config.TLSConfig) time.Duration {
+	if cfg.ReloadInterval > 0 {
+		return time.Duration(cfg.ReloadInterval) * time.Second
+	}
+	if cfg.Watch {
+		return defaultCertWatchInterval
+	}
+	return 0
+}
+
+// certReloader serves a TLS certificate that can be replaced at runtime.
+// Certificates renewed by an external tool (e.g. certbot) are picked up by
+// Reload, triggered on SIGHUP or by polling the files for changes, without
+// restarting the daemon.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+
+	// mu serializes reloads and guards the modification times.
+	mu          sync.Mutex
+	certModTime time.Time
+	keyModTime  time.Time
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// newCertReloader loads the initial certificate from certFile and keyFile.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		stop:     make(chan struct{}),
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the certificate and key from disk and swaps them in.
+// On error the previously loaded certificate stays in use.
+func (r *certReloader) Reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	certModTime, keyModTime := r.modTimes()
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+
+	r.cert.Store(&cert)
+	r.certModTime = certModTime
+	r.keyModTime = keyModTime
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.cert.Load(), nil
+}
+
+// watch polls the certificate and key files every interval and reloads them
+// when either modification time changes. It returns when Stop is called.
+func (r *certReloader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !r.changed() {
+				continue
+			}
+			if err := r.Reload(); err != nil {
+				// Files may be mid-rotation; retry on the next tick.
+				slog.Warn("TLS certificate reload failed", "error", err)
+				continue
+			}
+			slog.Info("TLS certificate reloaded", "cert_file", r.certFile)
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// Stop stops the watch goroutine, if running.
+func (r *certReloader) Stop() {
+	r.stopOnce.Do(func() { close(r.stop) })
+}
+
+// changed reports whether the files were modified since the last reload.
+func (r *certReloader) changed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	certModTime, keyModTime := r.modTimes()
+	return !certModTime.Equal(r.certModTime) || !keyModTime.Equal(r.keyModTime)
+}
+
+// modTimes returns the current modification times of the files
+// (zero if a file cannot be stat'ed).
+func (r *certReloader) modTimes() (certModTime, keyModTime time.Time) {
+	if info, err := os.Stat(r.certFile); err == nil {
+		certModTime = info.ModTime()
+	}
+	if info, err := os.Stat(r.keyFile); err == nil {
+		keyModTime = info.ModTime()
+	}
+	return certModTime, keyModTime
+}
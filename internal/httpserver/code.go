@@ -0,0 +1,79 @@
+package httpserver
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/session"
+)
+
+// maxUserCodeLength bounds the submitted code; real codes are 9 characters
+// (XXXX-XXXX) but users may add spaces.
+const maxUserCodeLength = 32
+
+// handleCode handles the one-time code page for crtext clients.
+// Clients that can only display text (IV_SSO=crtext) show the user a code
+// and this page's URL. GET renders a form; POST redeems the code and
+// redirects to the Keycloak authorization URL of the matching session.
+// The existing /callback endpoint completes the flow.
+func (s *Server) handleCode(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.renderCodeForm(w, r, http.StatusOK, "")
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, 1024)
+	if err := r.ParseForm(); err != nil {
+		s.renderCodeForm(w, r, http.StatusBadRequest, "code.invalid_request")
+		return
+	}
+
+	code := r.PostForm.Get("code")
+	if code == "" || len(code) > maxUserCodeLength {
+		s.renderCodeForm(w, r, http.StatusBadRequest, "code.missing")
+		return
+	}
+
+	sess, err := s.sessionMgr.RedeemUserCode(code)
+	if err != nil {
+		slog.Warn("code entry: session not found", // #nosec G706 -- values sanitized via sanitizeLog
+			"code", sanitizeLog(session.NormalizeUserCode(code)),
+			"ip", extractIP(r, s.trustedProxies),
+			"error", err,
+		)
+		s.renderCodeForm(w, r, http.StatusBadRequest, "code.not_found")
+		return
+	}
+
+	if sess.AuthURL == "" {
+		s.renderError(w, r, "error.flow_not_initialized")
+		return
+	}
+
+	slog.Debug("code entry: redirecting to auth URL", "session_id", sess.ID, "correlation_id", sess.CorrelationID)
+
+	http.Redirect(w, r, sess.AuthURL, http.StatusSeeOther)
+}
+
+// renderCodeForm renders the one-time code entry page with message errID
+// (see translations), if it is not empty
+func (s *Server) renderCodeForm(w http.ResponseWriter, r *http.Request, status int, errID string) {
+	lang := s.pageLanguage(r)
+	data := pageData(lang, s.branding, map[string]string{
+		"Error": translate(lang, errID),
+	})
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+
+	if err := s.templates.ExecuteTemplate(w, "code.html", data); err != nil {
+		slog.Error("failed to render code template", "error", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	}
+}
@@ -6,17 +6,35 @@ import (
 	"net/http"
 )
 
+// BuildInfo identifies the daemon build, as set at build time via ldflags
+type BuildInfo struct {
+	Version   string
+	Commit    string
+	BuildDate string
+}
+
 // HealthResponse is the JSON response for the health check endpoint
 type HealthResponse struct {
-	Status  string `json:"status"`
-	Version string `json:"version,omitempty"`
+	Status    string `json:"status"`
+	Version   string `json:"version,omitempty"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
 }
 
-// handleHealth handles health check requests
+// SetBuildInfo sets the build reported by /health, so monitoring can
+// confirm which build is deployed. Call it before Start.
+func (s *Server) SetBuildInfo(info BuildInfo) {
+	s.buildInfo = info
+}
+
+// handleHealth handles liveness check requests. It reports ok as long as
+// the HTTP server is running; see handleReady for readiness.
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 	resp := HealthResponse{
-		Status:  "ok",
-		Version: "dev", // This will be set from build-time ldflags in production
+		Status:    "ok",
+		Version:   s.buildInfo.Version,
+		Commit:    s.buildInfo.Commit,
+		BuildDate: s.buildInfo.BuildDate,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -26,3 +44,35 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 		slog.Error("failed to encode health response", "error", err)
 	}
 }
+
+// ReadyResponse is the JSON response for the readiness endpoint
+type ReadyResponse struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// handleReady handles readiness requests. Unlike /health (liveness), it
+// returns 503 until the OIDC provider and IPC socket are up and again once
+// graceful shutdown has started.
+func (s *Server) handleReady(w http.ResponseWriter, r *http.Request) {
+	ready, reason := s.readiness.Ready()
+
+	status := http.StatusOK
+	resp := ReadyResponse{Status: "ready"}
+	if !ready {
+		status = http.StatusServiceUnavailable
+		resp = ReadyResponse{Status: "not_ready", Reason: reason}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		// Best-effort: headers/status may already be written.
+		slog.Error("failed to encode readiness response", "error", err)
+	}
+}
+
+// handleMetrics serves Prometheus metrics from the daemon's registry
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	s.metrics.Handler().ServeHTTP(w, r)
+}
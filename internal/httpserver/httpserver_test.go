@@ -1,17 +1,50 @@
 package httpserver
 
 import (
+	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
 	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"golang.org/x/time/rate"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/audit"
 	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/metrics"
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/oidc"
 	"github.com/al-bashkir/openvpn-keycloak-auth/internal/session"
 )
 
@@ -25,7 +58,7 @@ func TestNewServer(t *testing.T) {
 		},
 	}
 
-	server, err := NewServer(cfg, nil, nil)
+	server, err := NewServer(cfg, nil, nil, nil, nil)
 	if err != nil {
 		t.Fatalf("NewServer failed: %v", err)
 	}
@@ -44,7 +77,7 @@ func TestHealthEndpoint(t *testing.T) {
 		Listen: config.ListenConfig{HTTP: ":9000"},
 	}
 
-	server, err := NewServer(cfg, nil, nil)
+	server, err := NewServer(cfg, nil, nil, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -75,15 +108,98 @@ func TestHealthEndpoint(t *testing.T) {
 	}
 }
 
+func TestHealthEndpointBuildInfo(t *testing.T) {
+	cfg := &config.Config{
+		Listen: config.ListenConfig{HTTP: ":9000"},
+	}
+
+	server, err := NewServer(cfg, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.SetBuildInfo(BuildInfo{Version: "v1.4.0", Commit: "895062d", BuildDate: "2026-10-01T12:00:00Z"})
+
+	w := httptest.NewRecorder()
+	server.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+
+	var got map[string]string
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	want := map[string]string{
+		"status":     "ok",
+		"version":    "v1.4.0",
+		"commit":     "895062d",
+		"build_date": "2026-10-01T12:00:00Z",
+	}
+	for key, value := range want {
+		if got[key] != value {
+			t.Errorf("%s = %q, want %q", key, got[key], value)
+		}
+	}
+}
+
+func TestReadyEndpoint(t *testing.T) {
+	cfg := &config.Config{
+		Listen: config.ListenConfig{HTTP: ":9000"},
+	}
+
+	readiness := NewReadiness()
+	server, err := NewServer(cfg, nil, nil, nil, readiness)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		update     func()
+		wantStatus int
+		wantReason string
+	}{
+		{name: "starting", update: func() {}, wantStatus: http.StatusServiceUnavailable, wantReason: "OIDC provider not initialized"},
+		{name: "OIDC ready", update: readiness.SetOIDCReady, wantStatus: http.StatusServiceUnavailable, wantReason: "IPC socket not listening"},
+		{name: "IPC ready", update: readiness.SetIPCReady, wantStatus: http.StatusOK},
+		{name: "shutting down", update: readiness.SetShuttingDown, wantStatus: http.StatusServiceUnavailable, wantReason: "shutting down"},
+	}
+
+	// Steps build on each other, in order
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.update()
+
+			w := httptest.NewRecorder()
+			server.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			var resp ReadyResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if resp.Reason != tt.wantReason {
+				t.Errorf("reason = %q, want %q", resp.Reason, tt.wantReason)
+			}
+
+			// Liveness is unaffected by readiness
+			w = httptest.NewRecorder()
+			server.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+			if w.Code != http.StatusOK {
+				t.Errorf("/health status = %d, want 200", w.Code)
+			}
+		})
+	}
+}
+
 func TestAuthRedirectEndpoint(t *testing.T) {
 	cfg := &config.Config{
 		Listen: config.ListenConfig{HTTP: ":9000"},
 	}
 
-	sessionMgr := session.NewManager(5 * time.Minute)
+	sessionMgr := session.NewManager(5*time.Minute, 0)
 	defer sessionMgr.Stop()
 
-	server, err := NewServer(cfg, nil, sessionMgr)
+	server, err := NewServer(cfg, nil, sessionMgr, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -97,7 +213,7 @@ func TestAuthRedirectEndpoint(t *testing.T) {
 
 	testState := "abc123def456"
 	testAuthURL := "https://keycloak.example.com/realms/test/protocol/openid-connect/auth?client_id=openvpn&very_long_param=value"
-	err = sessionMgr.UpdateOIDCFlow(sess.ID, testState, "verifier", testAuthURL)
+	err = sessionMgr.UpdateOIDCFlow(sess.ID, testState, "verifier", "nonce", testAuthURL)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -160,6 +276,65 @@ func TestAuthRedirectEndpoint(t *testing.T) {
 	})
 }
 
+func TestSignedState(t *testing.T) {
+	const secret = "0123456789abcdef0123456789abcdef"
+	cfg := &config.Config{
+		Listen: config.ListenConfig{HTTP: ":9000"},
+		OIDC:   config.OIDCConfig{StateSecret: secret, InstanceID: "vpn1"},
+	}
+
+	sessionMgr := session.NewManager(5*time.Minute, 0)
+	defer sessionMgr.Stop()
+
+	server, err := NewServer(cfg, nil, sessionMgr, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sign := func(payload string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(payload))
+		return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+	}
+	validState := sign("vpn1.00112233445566778899aabbccddeeff")
+	tamperedState := "vpn2" + strings.TrimPrefix(validState, "vpn1")
+
+	for _, state := range []string{validState, tamperedState} {
+		sess, err := sessionMgr.Create("testuser", "", "192.0.2.1", "12345", "/tmp/acf", "/tmp/apf", "/tmp/arf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sessionMgr.UpdateOIDCFlow(sess.ID, state, "verifier", "nonce", "https://keycloak.example.com/auth"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{name: "valid state redirects", path: "/auth/" + validState, wantStatus: http.StatusFound},
+		{name: "tampered state on auth URL", path: "/auth/" + tamperedState, wantStatus: http.StatusBadRequest, wantBody: "Invalid auth URL"},
+		{name: "unsigned state on auth URL", path: "/auth/00112233445566778899aabbccddeeff", wantStatus: http.StatusBadRequest, wantBody: "Invalid auth URL"},
+		{name: "tampered state on callback", path: "/callback?code=abc&state=" + tamperedState, wantStatus: http.StatusBadRequest, wantBody: "Invalid callback parameters"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			server.mux.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("body does not contain %q", tt.wantBody)
+			}
+		})
+	}
+}
+
 // TestCallbackEndpointValidParams is skipped because it requires a full OIDC setup.
 // TODO: Create integration tests with mock OIDC provider and session manager.
 func TestCallbackEndpointValidParams(t *testing.T) {
@@ -171,7 +346,7 @@ func TestCallbackEndpointMissingCode(t *testing.T) {
 		Listen: config.ListenConfig{HTTP: ":9000"},
 	}
 
-	server, err := NewServer(cfg, nil, nil)
+	server, err := NewServer(cfg, nil, nil, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -199,7 +374,7 @@ func TestCallbackEndpointOIDCError(t *testing.T) {
 		Listen: config.ListenConfig{HTTP: ":9000"},
 	}
 
-	server, err := NewServer(cfg, nil, nil)
+	server, err := NewServer(cfg, nil, nil, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -222,214 +397,2564 @@ func TestCallbackEndpointOIDCError(t *testing.T) {
 	}
 }
 
-func TestRenderSuccess(t *testing.T) {
+func TestCallbackEndpointHostileOIDCError(t *testing.T) {
 	cfg := &config.Config{
 		Listen: config.ListenConfig{HTTP: ":9000"},
 	}
 
-	server, err := NewServer(cfg, nil, nil)
+	server, err := NewServer(cfg, nil, nil, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
+	desc := "<script>alert(1)</script>Call+1-555-0100 now\n" + strings.Repeat("A", 5000)
+	req := httptest.NewRequest("GET", "/callback?error=access_denied&error_description="+url.QueryEscape(desc), nil)
 	w := httptest.NewRecorder()
-	server.renderSuccess(w, "Test success message")
+
+	server.mux.ServeHTTP(w, req)
 
 	resp := w.Result()
 	defer func() { _ = resp.Body.Close() }()
 
-	if resp.StatusCode != http.StatusOK {
-		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", resp.StatusCode)
 	}
 
 	body, _ := io.ReadAll(resp.Body)
-	bodyStr := string(body)
+	for _, bad := range []string{"<script>", "alert(1)</script>", strings.Repeat("A", maxErrorDescriptionLen+1)} {
+		if strings.Contains(string(body), bad) {
+			t.Errorf("response contains %q", bad)
+		}
+	}
+	if !strings.Contains(string(body), "scriptalert(1)scriptCall1-555-0100 now") {
+		t.Errorf("expected filtered error description in response, got:\n%s", body)
+	}
+}
 
-	if !strings.Contains(bodyStr, "Test success message") {
-		t.Error("expected success message in rendered HTML")
+func TestDisplayErrorDescription(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "User denied access", "User denied access"},
+		{"punctuation", "Invalid scopes: openid, profile (requested)!", "Invalid scopes: openid, profile (requested)!"},
+		{"empty", "", ""},
+		{"html", `<a href="https://evil.example">Click</a>`, "a hrefhttps:evil.exampleClicka"},
+		{"whitespace", "line one\nline two\r\n\ttabbed  spaced", "line one line two tabbed spaced"},
+		{"control characters", "bad\x00\x1b[31mred", "bad31mred"},
+		{"non-ascii", "Zugriff verweigert – überprüfen \u202egnp.exe", "Zugriff verweigert berprfen gnp.exe"},
+		{"only disallowed", "<<>>", ""},
+		{"exact limit", strings.Repeat("a", maxErrorDescriptionLen), strings.Repeat("a", maxErrorDescriptionLen)},
+		{"overlong", strings.Repeat("a", maxErrorDescriptionLen+1), strings.Repeat("a", maxErrorDescriptionLen) + "..."},
+		{"overlong with trailing space", strings.Repeat("a", maxErrorDescriptionLen-1) + " b" + strings.Repeat("c", 10000), strings.Repeat("a", maxErrorDescriptionLen-1) + "..."},
 	}
 
-	if !strings.Contains(bodyStr, "Authentication Successful") {
-		t.Error("expected success title in rendered HTML")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := displayErrorDescription(tt.in); got != tt.want {
+				t.Errorf("displayErrorDescription(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
 	}
 }
 
-func TestRenderError(t *testing.T) {
+func TestCallbackOIDCErrorWritesReason(t *testing.T) {
 	cfg := &config.Config{
 		Listen: config.ListenConfig{HTTP: ":9000"},
 	}
 
-	server, err := NewServer(cfg, nil, nil)
+	sessionMgr := session.NewManager(5*time.Minute, 0)
+	defer sessionMgr.Stop()
+
+	server, err := NewServer(cfg, nil, sessionMgr, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	w := httptest.NewRecorder()
-	server.renderError(w, "Test error message")
-
-	resp := w.Result()
-	defer func() { _ = resp.Body.Close() }()
-
-	if resp.StatusCode != http.StatusBadRequest {
-		t.Errorf("expected status 400, got %d", resp.StatusCode)
+	dir := t.TempDir()
+	arf := filepath.Join(dir, "arf")
+	sess, err := sessionMgr.Create("alice", "alice-cn", "192.0.2.1", "12345",
+		filepath.Join(dir, "acf"), filepath.Join(dir, "apf"), arf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sessionMgr.UpdateOIDCFlow(sess.ID, "state-1", "verifier", "nonce", "https://idp/auth"); err != nil {
+		t.Fatal(err)
 	}
 
-	body, _ := io.ReadAll(resp.Body)
-	bodyStr := string(body)
+	// The description comes from the browser and must not reach the file
+	req := httptest.NewRequest("GET", "/callback?state=state-1&error=access_denied&error_description=internal+detail", nil)
+	server.mux.ServeHTTP(httptest.NewRecorder(), req)
 
-	if !strings.Contains(bodyStr, "Test error message") {
-		t.Error("expected error message in rendered HTML")
+	got, err := os.ReadFile(arf)
+	if err != nil {
+		t.Fatalf("auth_failed_reason_file not written: %v", err)
 	}
-
-	if !strings.Contains(bodyStr, "Authentication Failed") {
-		t.Error("expected error title in rendered HTML")
+	if string(got) != reasonIdPError {
+		t.Errorf("auth_failed_reason_file = %q, want %q", got, reasonIdPError)
 	}
 }
 
-func TestSecurityHeaders(t *testing.T) {
+func TestCallbackLogsCorrelationID(t *testing.T) {
 	cfg := &config.Config{
 		Listen: config.ListenConfig{HTTP: ":9000"},
 	}
 
-	server, err := NewServer(cfg, nil, nil)
+	sessionMgr := session.NewManager(5*time.Minute, 0)
+	defer sessionMgr.Stop()
+
+	server, err := NewServer(cfg, nil, sessionMgr, nil, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	req := httptest.NewRequest("GET", "/health", nil)
-	w := httptest.NewRecorder()
-
-	server.httpServer.Handler.ServeHTTP(w, req)
+	dir := t.TempDir()
+	if _, _, err := sessionMgr.CreateOrReuse(&session.Session{
+		Username:             "alice",
+		UntrustedIP:          "192.0.2.1",
+		AuthControlFile:      filepath.Join(dir, "acf"),
+		AuthPendingFile:      filepath.Join(dir, "apf"),
+		AuthFailedReasonFile: filepath.Join(dir, "arf"),
+		State:                "state-1",
+		CorrelationID:        "corr-1",
+	}); err != nil {
+		t.Fatal(err)
+	}
 
-	resp := w.Result()
+	var buf bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(old) })
 
-	expectedHeaders := map[string]string{
-		"X-Frame-Options":        "DENY",
-		"X-Content-Type-Options": "nosniff",
-		"X-XSS-Protection":       "1; mode=block",
-		"Referrer-Policy":        "no-referrer",
-	}
+	req := httptest.NewRequest("GET", "/callback?state=state-1&error=access_denied", nil)
+	server.mux.ServeHTTP(httptest.NewRecorder(), req)
 
-	for header, expectedValue := range expectedHeaders {
-		actualValue := resp.Header.Get(header)
-		if actualValue != expectedValue {
-			t.Errorf("expected %s='%s', got '%s'", header, expectedValue, actualValue)
+	// Every record about the session carries the auth request's ID
+	var sessionRecords int
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var rec map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("log line is not JSON: %v (%q)", err, line)
+		}
+		if _, ok := rec["session_id"]; !ok {
+			continue
 		}
+		sessionRecords++
+		if rec["correlation_id"] != "corr-1" {
+			t.Errorf("%q logged with correlation_id %v, want %q", rec["msg"], rec["correlation_id"], "corr-1")
+		}
+	}
+	if sessionRecords < 2 {
+		t.Errorf("logged %d records about the session, want at least 2:\n%s", sessionRecords, buf.String())
 	}
 }
 
-func TestRateLimiting(t *testing.T) {
-	cfg := &config.Config{
-		Listen: config.ListenConfig{HTTP: ":9000"},
+func TestFailureReason(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		fallback string
+		want     string
+	}{
+		{name: "token exchange", err: errors.New("failed to exchange code: 400 Bad Request"),
+			fallback: reasonTokenExchange, want: reasonTokenExchange},
+		{name: "token exchange timeout", err: fmt.Errorf("%w after 10s (oidc.token_exchange_timeout): context deadline exceeded", oidc.ErrTokenExchangeTimeout),
+			fallback: reasonTokenExchange, want: reasonTokenTimeout},
+		{name: "expired code", err: fmt.Errorf("failed to exchange code: %w: invalid_grant", oidc.ErrCodeExpired),
+			fallback: reasonTokenExchange, want: reasonCodeExpired},
+		{name: "token verification", err: fmt.Errorf("%w: token is expired", oidc.ErrTokenVerification),
+			fallback: reasonTokenExchange, want: reasonTokenVerification},
+		{name: "nonce mismatch", err: oidc.ErrNonceMismatch,
+			fallback: reasonTokenExchange, want: reasonTokenVerification},
+		{name: "sign-in too old", err: fmt.Errorf("%w (authenticated 2h ago)", oidc.ErrAuthTooOld),
+			fallback: reasonTokenVerification, want: reasonAuthTooOld},
+		{name: "auth_time missing", err: fmt.Errorf("auth_time %w (required by oidc.max_age)", oidc.ErrClaimNotFound),
+			fallback: reasonTokenVerification, want: reasonTokenVerification},
+		{name: "acr not met", err: fmt.Errorf("%w: required one of [mfa]", oidc.ErrACRNotMet),
+			fallback: reasonACRNotMet, want: reasonACRNotMet},
+		{name: "denied role", err: fmt.Errorf("%w: suspended", oidc.ErrDeniedRole),
+			fallback: reasonNotAuthorized, want: reasonDeniedRole},
+		{name: "roles unavailable", err: &oidc.RolesUnavailableError{Paths: []string{"realm_access.roles"}},
+			fallback: reasonNotAuthorized, want: reasonRolesUnavailable},
+		{name: "missing required role", err: fmt.Errorf("%w: [vpn-users] (user roles: [])", oidc.ErrMissingRole),
+			fallback: reasonTokenExchange, want: reasonNotAuthorized},
+		{name: "missing required group", err: fmt.Errorf("%w: [/vpn] (user groups: [])", oidc.ErrMissingGroup),
+			fallback: reasonTokenExchange, want: reasonNotAuthorized},
+		{name: "role claim missing", err: fmt.Errorf("failed to extract roles: %w", oidc.ErrClaimNotFound),
+			fallback: reasonNotAuthorized, want: reasonNotAuthorized},
+		{name: "username mismatch", err: fmt.Errorf("%w: expected 'alice', got 'bob'", oidc.ErrUsernameMismatch),
+			fallback: reasonTokenExchange, want: reasonUsernameMismatch},
+		{name: "common name mismatch", err: fmt.Errorf("%w: certificate has 'bob', token has 'alice'", oidc.ErrCNMismatch),
+			fallback: reasonTokenExchange, want: reasonCNMismatch},
 	}
 
-	server, err := NewServer(cfg, nil, nil)
-	if err != nil {
-		t.Fatal(err)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := failureReason(tt.err, tt.fallback); got != tt.want {
+				t.Errorf("failureReason(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
 	}
+}
 
-	// Make many requests quickly
-	successCount := 0
-	rateLimitCount := 0
+func TestCallbackRejectsReusedCode(t *testing.T) {
+	tests := []struct {
+		name       string
+		reject     bool
+		wantSecond string
+	}{
+		{name: "enabled", reject: true, wantSecond: "Authorization code already used"},
+		{name: "disabled", reject: false, wantSecond: "Session not found"},
+	}
 
-	for i := 0; i < 100; i++ {
-		req := httptest.NewRequest("GET", "/health", nil)
-		req.RemoteAddr = "192.0.2.1:12345" // Same IP
-		w := httptest.NewRecorder()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				Listen: config.ListenConfig{HTTP: ":9000"},
+				Auth:   config.AuthConfig{RejectReusedCodes: tt.reject},
+			}
 
-		server.httpServer.Handler.ServeHTTP(w, req)
+			sessionMgr := session.NewManager(5*time.Minute, 0)
+			defer sessionMgr.Stop()
 
-		if w.Result().StatusCode == http.StatusOK {
-			successCount++
-		} else if w.Result().StatusCode == http.StatusTooManyRequests {
-			rateLimitCount++
-		}
-	}
+			server, err := NewServer(cfg, nil, sessionMgr, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
 
-	// Should have some rate limited requests
-	if rateLimitCount == 0 {
-		t.Error("expected some requests to be rate limited")
-	}
+			callback := func(code string) string {
+				w := httptest.NewRecorder()
+				server.mux.ServeHTTP(w, httptest.NewRequest("GET", "/callback?code="+code+"&state=unknown", nil))
+				if w.Code != http.StatusBadRequest {
+					t.Errorf("status = %d, want 400", w.Code)
+				}
+				return w.Body.String()
+			}
 
-	// Should have some successful requests
-	if successCount == 0 {
-		t.Error("expected some requests to succeed")
+			if body := callback("code-1"); !strings.Contains(body, "Session not found") {
+				t.Errorf("first use: expected session not found, got %q", body)
+			}
+			if body := callback("code-1"); !strings.Contains(body, tt.wantSecond) {
+				t.Errorf("second use: expected %q in response, got %q", tt.wantSecond, body)
+			}
+			if body := callback("code-2"); !strings.Contains(body, "Session not found") {
+				t.Errorf("other code: expected session not found, got %q", body)
+			}
+		})
 	}
 }
 
-func TestGracefulShutdown(t *testing.T) {
-	cfg := &config.Config{
-		Listen: config.ListenConfig{HTTP: "127.0.0.1:0"}, // Random port
-	}
+func TestCodeTracker(t *testing.T) {
+	tracker := newCodeTracker(time.Minute)
+	now := time.Now()
+	tracker.now = func() time.Time { return now }
 
-	server, err := NewServer(cfg, nil, nil)
-	if err != nil {
-		t.Fatal(err)
+	if tracker.markUsed("abc") {
+		t.Error("first use reported as reused")
+	}
+	if !tracker.markUsed("abc") {
+		t.Error("second use not reported as reused")
+	}
+	if tracker.markUsed("def") {
+		t.Error("different code reported as reused")
 	}
 
-	// Start server in background
-	startErrCh := make(chan error, 1)
-	go func() {
-		startErrCh <- server.Start()
-	}()
-
-	// Give it time to start
-	time.Sleep(100 * time.Millisecond)
-
-	// Shutdown
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	if err := server.Shutdown(ctx); err != nil {
-		t.Errorf("Shutdown failed: %v", err)
+	// Codes are forgotten after the TTL
+	now = now.Add(time.Minute)
+	if tracker.markUsed("abc") {
+		t.Error("code reported as reused after TTL")
 	}
 
-	select {
-	case err := <-startErrCh:
-		if err != nil && !errors.Is(err, http.ErrServerClosed) {
-			t.Errorf("Start failed: %v", err)
+	// Only hashes are stored
+	for key := range tracker.seen {
+		if strings.Contains(string(key[:]), "abc") {
+			t.Error("tracker stores the plain code")
 		}
-	case <-time.After(5 * time.Second):
-		t.Fatal("timeout waiting for server to stop")
 	}
 }
 
-func TestExtractIP(t *testing.T) {
+func TestContextClaimsAttr(t *testing.T) {
+	claims := map[string]interface{}{
+		"department": "Engineering",
+		"org":        map[string]interface{}{"office": "Berlin\nfake log line"},
+	}
+
 	tests := []struct {
-		name       string
-		remoteAddr string
-		expectedIP string
+		name  string
+		paths []string
+		want  string
 	}{
 		{
-			name:       "direct connection",
-			remoteAddr: "192.0.2.1:12345",
-			expectedIP: "192.0.2.1",
+			name:  "present claims",
+			paths: []string{"department", "org.office"},
+			want:  `"context":{"department":"Engineering","org.office":"Berlin_fake log line"}`,
 		},
 		{
-			name:       "ignores X-Forwarded-For (anti-spoofing)",
-			remoteAddr: "127.0.0.1:12345",
-			expectedIP: "127.0.0.1",
+			name:  "absent claim skipped",
+			paths: []string{"title", "department"},
+			want:  `"context":{"department":"Engineering"}`,
 		},
 		{
-			name:       "IPv6 address",
-			remoteAddr: "[::1]:12345",
-			expectedIP: "::1",
+			name:  "nothing configured",
+			paths: nil,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			req := httptest.NewRequest("GET", "/", nil)
-			req.RemoteAddr = tt.remoteAddr
-
-			// Set spoofable headers to verify they're ignored
-			req.Header.Set("X-Forwarded-For", "203.0.113.42")
-			req.Header.Set("X-Real-IP", "203.0.113.42")
-
-			ip := extractIP(req)
-			if ip != tt.expectedIP {
-				t.Errorf("expected IP '%s', got '%s'", tt.expectedIP, ip)
+			var buf bytes.Buffer
+			logger := slog.New(slog.NewJSONHandler(&buf, nil))
+			logger.Info("user authenticated successfully", contextClaimsAttr(claims, tt.paths))
+
+			out := buf.String()
+			if tt.want == "" {
+				if strings.Contains(out, "context") {
+					t.Errorf("expected no context group, got %s", out)
+				}
+				return
+			}
+			if !strings.Contains(out, tt.want) {
+				t.Errorf("log = %s, want it to contain %s", out, tt.want)
 			}
 		})
 	}
 }
+
+// recordingAudit collects audit records in memory.
+type recordingAudit struct {
+	mu      sync.Mutex
+	records []audit.Record
+}
+
+func (a *recordingAudit) Record(rec audit.Record) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.records = append(a.records, rec)
+}
+
+func (a *recordingAudit) Close() error { return nil }
+
+func TestAuditRecords(t *testing.T) {
+	cfg := &config.Config{
+		Listen: config.ListenConfig{HTTP: ":9000"},
+	}
+
+	sessionMgr := session.NewManager(5*time.Minute, 0)
+	defer sessionMgr.Stop()
+
+	server, err := NewServer(cfg, nil, sessionMgr, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := &recordingAudit{}
+	server.SetAudit(recorder)
+
+	newSession := func(username string) *session.Session {
+		dir := t.TempDir()
+		sess, err := sessionMgr.Create(username, username+"-cn", "192.0.2.1", "12345",
+			filepath.Join(dir, "acf"), filepath.Join(dir, "apf"), filepath.Join(dir, "arf"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return sess
+	}
+
+	ok := newSession("alice")
+	if err := server.writeAuthSuccess(ok, map[string]string{"department": "IT"}); err != nil {
+		t.Fatal(err)
+	}
+	denied := newSession("bob")
+	server.writeAuthFailure(denied, "user does not have required role", nil)
+
+	// A second decision for the same session is not recorded again
+	server.writeAuthFailure(denied, "duplicate", nil)
+
+	want := []audit.Record{
+		{Username: "alice", CommonName: "alice-cn", UntrustedIP: "192.0.2.1", Result: audit.ResultSuccess, SessionID: ok.ID,
+			Context: map[string]string{"department": "IT"}},
+		{Username: "bob", CommonName: "bob-cn", UntrustedIP: "192.0.2.1", Result: audit.ResultFailure,
+			Reason: "user does not have required role", SessionID: denied.ID},
+	}
+	if len(recorder.records) != len(want) {
+		t.Fatalf("got %d audit records, want %d: %+v", len(recorder.records), len(want), recorder.records)
+	}
+	for i := range want {
+		if !reflect.DeepEqual(recorder.records[i], want[i]) {
+			t.Errorf("record %d = %+v, want %+v", i, recorder.records[i], want[i])
+		}
+	}
+}
+
+func TestRenderSuccess(t *testing.T) {
+	cfg := &config.Config{
+		Listen: config.ListenConfig{HTTP: ":9000"},
+	}
+
+	server, err := NewServer(cfg, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	server.renderSuccess(w, httptest.NewRequest("GET", "/callback", nil), "Test success message", "")
+
+	resp := w.Result()
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected status 200, got %d", resp.StatusCode)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	bodyStr := string(body)
+
+	if !strings.Contains(bodyStr, "Test success message") {
+		t.Error("expected success message in rendered HTML")
+	}
+
+	if !strings.Contains(bodyStr, "Authentication Successful") {
+		t.Error("expected success title in rendered HTML")
+	}
+	if strings.Contains(bodyStr, "Login code") {
+		t.Error("expected no correlation code without one")
+	}
+
+	w = httptest.NewRecorder()
+	server.renderSuccess(w, httptest.NewRequest("GET", "/callback", nil), "Test success message", "KXRM")
+	if body := w.Body.String(); !strings.Contains(body, "Login code: <strong>KXRM</strong>") {
+		t.Error("expected correlation code in rendered HTML")
+	}
+}
+
+func TestSuccessRedirectAndAutoClose(t *testing.T) {
+	tests := []struct {
+		name        string
+		redirectURL string
+		autoClose   bool
+		want        []string
+		notWant     []string
+	}{
+		{
+			name:    "neither configured",
+			notWant: []string{"http-equiv=\"refresh\"", "<script", autoCloseScriptPath},
+		},
+		{
+			name:        "redirect",
+			redirectURL: "https://portal.example.com/welcome?from=vpn&lang=en",
+			want: []string{
+				`<meta http-equiv="refresh" content="3;url=https://portal.example.com/welcome?from=vpn&amp;lang=en">`,
+				`<a href="https://portal.example.com/welcome?from=vpn&amp;lang=en">Continue</a>`,
+			},
+			notWant: []string{"<script"},
+		},
+		{
+			name:        "redirect URL is escaped",
+			redirectURL: `https://portal.example.com/"><script>alert(1)</script>`,
+			want:        []string{"&#34;&gt;&lt;script&gt;"},
+			notWant:     []string{"<script"},
+		},
+		{
+			name:      "autoclose",
+			autoClose: true,
+			want: []string{
+				`<script src="/success-autoclose.js" defer></script>`,
+				"This window will close automatically.",
+				`<meta http-equiv="refresh" content="4;url=about:blank">`,
+			},
+		},
+		{
+			name:        "autoclose with redirect fallback",
+			redirectURL: "https://portal.example.com/",
+			autoClose:   true,
+			want: []string{
+				`<script src="/success-autoclose.js" defer></script>`,
+				`<meta http-equiv="refresh" content="3;url=https://portal.example.com/">`,
+			},
+			notWant: []string{"about:blank"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				Listen: config.ListenConfig{HTTP: ":9000"},
+				HTTPServer: config.HTTPServerConfig{
+					SuccessRedirectURL: tt.redirectURL,
+					SuccessAutoClose:   tt.autoClose,
+				},
+			}
+			server, err := NewServer(cfg, nil, nil, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			server.renderSuccess(w, httptest.NewRequest("GET", "/callback", nil), "Test success message", "")
+			body := w.Body.String()
+			for _, want := range tt.want {
+				if !strings.Contains(body, want) {
+					t.Errorf("page missing %q", want)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(body, notWant) {
+					t.Errorf("page unexpectedly contains %q", notWant)
+				}
+			}
+
+			// The script is only served when the page refers to it
+			w = httptest.NewRecorder()
+			server.httpServer.Handler.ServeHTTP(w, httptest.NewRequest("GET", autoCloseScriptPath, nil))
+			if tt.autoClose {
+				if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "window.close()") {
+					t.Errorf("script: status %d, body %q", w.Code, w.Body.String())
+				}
+				if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/javascript") {
+					t.Errorf("script Content-Type = %q", ct)
+				}
+			} else if w.Code != http.StatusNotFound {
+				t.Errorf("script without success_autoclose: status %d, want 404", w.Code)
+			}
+		})
+	}
+}
+
+func TestRenderError(t *testing.T) {
+	cfg := &config.Config{
+		Listen: config.ListenConfig{HTTP: ":9000"},
+	}
+
+	server, err := NewServer(cfg, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	server.renderError(w, httptest.NewRequest("GET", "/callback", nil), "Test error message")
+
+	resp := w.Result()
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected status 400, got %d", resp.StatusCode)
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+	bodyStr := string(body)
+
+	if !strings.Contains(bodyStr, "Test error message") {
+		t.Error("expected error message in rendered HTML")
+	}
+
+	if !strings.Contains(bodyStr, "Authentication Failed") {
+		t.Error("expected error title in rendered HTML")
+	}
+}
+
+func TestCustomTemplates(t *testing.T) {
+	dir := t.TempDir()
+	custom := `<html><head><title>{{.CompanyName}} VPN</title></head>` +
+		`<body>{{template "logo" .}}<p class="custom">{{.Message}}</p></body></html>`
+	if err := os.WriteFile(filepath.Join(dir, "success.html"), []byte(custom), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		Listen: config.ListenConfig{HTTP: ":9000"},
+		HTTPServer: config.HTTPServerConfig{
+			TemplatesDir: dir,
+			Branding: config.BrandingConfig{
+				CompanyName:  "Example Corp",
+				LogoURL:      "https://cdn.example.com/logo.svg",
+				SupportEmail: "helpdesk@example.com",
+			},
+		},
+	}
+	server, err := NewServer(cfg, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// success.html comes from the directory
+	w := httptest.NewRecorder()
+	server.renderSuccess(w, httptest.NewRequest("GET", "/callback", nil), "Connected <now>", "")
+	body := w.Body.String()
+	for _, want := range []string{
+		"<title>Example Corp VPN</title>",
+		`<p class="custom">Connected &lt;now&gt;</p>`,
+		`src="https://cdn.example.com/logo.svg"`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("success page missing %q:\n%s", want, body)
+		}
+	}
+
+	// error.html is missing from the directory, so the embedded one is used
+	w = httptest.NewRecorder()
+	server.renderError(w, httptest.NewRequest("GET", "/callback", nil), "Token exchange failed")
+	body = w.Body.String()
+	for _, want := range []string{
+		"Authentication Failed - Example Corp",
+		"Token exchange failed",
+		`<a href="mailto:helpdesk@example.com">helpdesk@example.com</a>`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("error page missing %q", want)
+		}
+	}
+
+	// The logo's origin is allowed by the Content-Security-Policy
+	req := httptest.NewRequest("GET", "/health", nil)
+	w = httptest.NewRecorder()
+	server.httpServer.Handler.ServeHTTP(w, req)
+	if csp := w.Header().Get("Content-Security-Policy"); !strings.Contains(csp, "img-src 'self' https://cdn.example.com") {
+		t.Errorf("Content-Security-Policy = %q, want logo origin in img-src", csp)
+	}
+
+	// A broken template fails at startup, not on first render
+	if err := os.WriteFile(filepath.Join(dir, "error.html"), []byte("{{.Error"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewServer(cfg, nil, nil, nil, nil); err == nil || !strings.Contains(err.Error(), "error.html") {
+		t.Errorf("NewServer() error = %v, want parse error naming error.html", err)
+	}
+}
+
+func TestNegotiateLanguage(t *testing.T) {
+	tests := []struct {
+		header   string
+		fallback string
+		want     string
+	}{
+		{header: "", fallback: "en", want: "en"},
+		{header: "de-DE,de;q=0.9,en;q=0.8", fallback: "en", want: "de"},
+		{header: "fr-CH, fr;q=0.9, en;q=0.8", fallback: "en", want: "fr"},
+		{header: "en;q=0.5, es;q=0.8", fallback: "de", want: "es"},
+		{header: "ja, zh;q=0.9", fallback: "en", want: "en"},
+		{header: "ja, zh;q=0.9", fallback: "fr", want: "fr"},
+		{header: "ja, DE;q=0.1", fallback: "en", want: "de"},
+		{header: "de;q=0, fr;q=invalid", fallback: "en", want: "en"},
+	}
+	for _, tt := range tests {
+		if got := negotiateLanguage(tt.header, tt.fallback); got != tt.want {
+			t.Errorf("negotiateLanguage(%q, %q) = %q, want %q", tt.header, tt.fallback, got, tt.want)
+		}
+	}
+}
+
+func TestTranslationsComplete(t *testing.T) {
+	langs := slices.Sorted(maps.Keys(translations))
+	want := slices.Sorted(slices.Values(config.PageLanguages))
+	if !slices.Equal(langs, want) {
+		t.Errorf("translated languages = %v, config.PageLanguages = %v", langs, want)
+	}
+
+	for lang, catalog := range translations {
+		for other, otherCatalog := range translations {
+			for key := range otherCatalog {
+				if _, ok := catalog[key]; !ok {
+					t.Errorf("%s is missing %q (translated in %s)", lang, key, other)
+				}
+			}
+		}
+	}
+}
+
+// TestMessageIDsTranslated checks that every message ID the handlers and
+// the built-in templates use is in the catalog of every language.
+func TestMessageIDsTranslated(t *testing.T) {
+	// The position of the message ID among the arguments of each renderer
+	idArg := map[string]int{"renderError": 2, "renderCodeForm": 3, "renderSuccess": 2}
+
+	var ids []string
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, file, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok {
+				return true
+			}
+			i, ok := idArg[sel.Sel.Name]
+			if !ok || len(call.Args) <= i {
+				return true
+			}
+			lit, ok := call.Args[i].(*ast.BasicLit)
+			if !ok || lit.Kind != token.STRING {
+				t.Errorf("%s: %s takes a message ID literal", fset.Position(call.Pos()), sel.Sel.Name)
+				return true
+			}
+			if id, _ := strconv.Unquote(lit.Value); id != "" {
+				ids = append(ids, id)
+			}
+			return true
+		})
+	}
+
+	templateID := regexp.MustCompile(`\{\{t \$?\.Lang "([^"]+)"\}\}`)
+	pages, err := fs.Glob(templatesFS, "templates/*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, page := range pages {
+		content, err := fs.ReadFile(templatesFS, page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range templateID.FindAllStringSubmatch(string(content), -1) {
+			ids = append(ids, m[1])
+		}
+	}
+
+	if len(ids) == 0 {
+		t.Fatal("no message IDs found")
+	}
+	for _, id := range ids {
+		for _, lang := range config.PageLanguages {
+			if _, ok := translations[lang][id]; !ok {
+				t.Errorf("%s has no text for %q", lang, id)
+			}
+		}
+	}
+}
+
+func TestLocalizedPages(t *testing.T) {
+	tests := []struct {
+		name            string
+		defaultLanguage string
+		acceptLanguage  string
+		render          func(s *Server, w http.ResponseWriter, r *http.Request)
+		want            []string
+	}{
+		{
+			name:           "German success page",
+			acceptLanguage: "de-AT,de;q=0.9,en;q=0.5",
+			render: func(s *Server, w http.ResponseWriter, r *http.Request) {
+				s.renderSuccess(w, r, "success.connected", "KXRM")
+			},
+			want: []string{
+				`<html lang="de">`,
+				"<title>Authentifizierung erfolgreich</title>",
+				"Sie sind jetzt mit dem VPN verbunden.",
+				"Anmeldecode: <strong>KXRM</strong>",
+			},
+		},
+		{
+			name:           "French error page",
+			acceptLanguage: "fr",
+			render: func(s *Server, w http.ResponseWriter, r *http.Request) {
+				s.renderError(w, r, "error.session_not_found")
+			},
+			want: []string{
+				`<html lang="fr">`,
+				"Échec de l&#39;authentification",
+				"Session introuvable ou expirée.",
+			},
+		},
+		{
+			name:           "detail is filled in untranslated",
+			acceptLanguage: "es",
+			render: func(s *Server, w http.ResponseWriter, r *http.Request) {
+				s.renderError(w, r, "error.auth_failed_detail", "access_denied")
+			},
+			want: []string{"<h1>Error de autenticación</h1>", "Error de autenticación: access_denied"},
+		},
+		{
+			name:           "unsupported language falls back to English",
+			acceptLanguage: "ja",
+			render: func(s *Server, w http.ResponseWriter, r *http.Request) {
+				s.renderCodeForm(w, r, http.StatusOK, "")
+			},
+			want: []string{`<html lang="en">`, "<h1>Enter VPN Code</h1>"},
+		},
+		{
+			name:            "configured default language",
+			defaultLanguage: "es",
+			render: func(s *Server, w http.ResponseWriter, r *http.Request) {
+				s.renderCodeForm(w, r, http.StatusOK, "")
+			},
+			want: []string{`<html lang="es">`, "<h1>Introducir código VPN</h1>"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				Listen:     config.ListenConfig{HTTP: ":9000"},
+				HTTPServer: config.HTTPServerConfig{DefaultLanguage: tt.defaultLanguage},
+			}
+			server, err := NewServer(cfg, nil, nil, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest("GET", "/callback", nil)
+			if tt.acceptLanguage != "" {
+				req.Header.Set("Accept-Language", tt.acceptLanguage)
+			}
+			w := httptest.NewRecorder()
+			tt.render(server, w, req)
+
+			body := w.Body.String()
+			for _, want := range tt.want {
+				if !strings.Contains(body, want) {
+					t.Errorf("page missing %q", want)
+				}
+			}
+		})
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	cfg := &config.Config{
+		Listen: config.ListenConfig{HTTP: ":9000"},
+	}
+
+	server, err := NewServer(cfg, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/health", nil)
+	w := httptest.NewRecorder()
+
+	server.httpServer.Handler.ServeHTTP(w, req)
+
+	resp := w.Result()
+
+	expectedHeaders := map[string]string{
+		"X-Frame-Options":        "DENY",
+		"X-Content-Type-Options": "nosniff",
+		"X-XSS-Protection":       "1; mode=block",
+		"Referrer-Policy":        "no-referrer",
+	}
+
+	for header, expectedValue := range expectedHeaders {
+		actualValue := resp.Header.Get(header)
+		if actualValue != expectedValue {
+			t.Errorf("expected %s='%s', got '%s'", header, expectedValue, actualValue)
+		}
+	}
+}
+
+func TestRateLimiting(t *testing.T) {
+	cfg := &config.Config{
+		Listen: config.ListenConfig{HTTP: ":9000"},
+	}
+
+	server, err := NewServer(cfg, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Make many requests quickly
+	successCount := 0
+	rateLimitCount := 0
+
+	for i := 0; i < 100; i++ {
+		req := httptest.NewRequest("GET", "/health", nil)
+		req.RemoteAddr = "192.0.2.1:12345" // Same IP
+		w := httptest.NewRecorder()
+
+		server.httpServer.Handler.ServeHTTP(w, req)
+
+		if w.Result().StatusCode == http.StatusOK {
+			successCount++
+		} else if w.Result().StatusCode == http.StatusTooManyRequests {
+			rateLimitCount++
+		}
+	}
+
+	// Should have some rate limited requests
+	if rateLimitCount == 0 {
+		t.Error("expected some requests to be rate limited")
+	}
+
+	// Should have some successful requests
+	if successCount == 0 {
+		t.Error("expected some requests to succeed")
+	}
+}
+
+func TestRateLimitConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		rateLimit config.RateLimitConfig
+		wantOK    int
+	}{
+		{name: "defaults", wantOK: defaultRateLimitBurst},
+		{name: "custom burst", rateLimit: config.RateLimitConfig{Rate: 0.001, Burst: 5}, wantOK: 5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				Listen: config.ListenConfig{HTTP: ":9000", RateLimit: tt.rateLimit},
+			}
+			server, err := NewServer(cfg, nil, nil, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.limits.Stop()
+
+			// Each server has its own limiter, so the count is exact
+			ok := 0
+			for range 60 {
+				req := httptest.NewRequest("GET", "/health", nil)
+				req.RemoteAddr = "192.0.2.1:12345"
+				w := httptest.NewRecorder()
+				server.httpServer.Handler.ServeHTTP(w, req)
+				if w.Code == http.StatusOK {
+					ok++
+				}
+			}
+			// The default rate may refill a token during the loop
+			if ok < tt.wantOK || ok > tt.wantOK+1 {
+				t.Errorf("%d of 60 requests allowed, want %d", ok, tt.wantOK)
+			}
+		})
+	}
+
+	limiter := newIPRateLimiter(config.RateLimitConfig{TTL: 60, MaxSize: 2})
+	defer limiter.Stop()
+	if limiter.ttl != time.Minute || limiter.maxSize != 2 {
+		t.Errorf("ttl = %v, maxSize = %d, want 1m0s, 2", limiter.ttl, limiter.maxSize)
+	}
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		limiter.getLimiter(ip, 0)
+	}
+	if n := len(limiter.limiters); n != 2 {
+		t.Errorf("tracked %d IPs, want max_size 2", n)
+	}
+}
+
+func TestRateLimitRoutes(t *testing.T) {
+	tests := []struct {
+		name       string
+		perSession bool
+		wantUserB  int // status of user B's second request
+	}{
+		{name: "per IP", perSession: false, wantUserB: http.StatusTooManyRequests},
+		{name: "per session", perSession: true, wantUserB: http.StatusFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				Listen: config.ListenConfig{
+					HTTP: ":9000",
+					RateLimit: config.RateLimitConfig{
+						Routes: map[string]config.RouteRateLimitConfig{
+							"/auth/": {Rate: 0.001, Burst: 3, PerSession: tt.perSession},
+						},
+					},
+				},
+			}
+
+			sessionMgr := session.NewManager(5*time.Minute, 0)
+			defer sessionMgr.Stop()
+
+			server, err := NewServer(cfg, nil, sessionMgr, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.limits.Stop()
+
+			// Two users behind the same NAT address
+			var states []string
+			for _, user := range []string{"alice", "bob"} {
+				sess, err := sessionMgr.Create(user, "", "198.51.100.1", "1194", "/tmp/acf", "/tmp/apf", "/tmp/arf")
+				if err != nil {
+					t.Fatal(err)
+				}
+				state := "state-" + user
+				if err := sessionMgr.UpdateOIDCFlow(sess.ID, state, "verifier", "nonce", "https://keycloak.example.com/auth"); err != nil {
+					t.Fatal(err)
+				}
+				states = append(states, state)
+			}
+
+			get := func(path string) int {
+				req := httptest.NewRequest("GET", path, nil)
+				req.RemoteAddr = "203.0.113.50:40000"
+				w := httptest.NewRecorder()
+				server.httpServer.Handler.ServeHTTP(w, req)
+				return w.Code
+			}
+
+			// User A opens the link twice (e.g. a retried page load)
+			for range 2 {
+				if code := get("/auth/" + states[0]); code != http.StatusFound {
+					t.Fatalf("user A: status %d, want 302", code)
+				}
+			}
+			if code := get("/auth/" + states[1]); code != http.StatusFound {
+				t.Fatalf("user B first request: status %d, want 302", code)
+			}
+			if code := get("/auth/" + states[1]); code != tt.wantUserB {
+				t.Errorf("user B second request: status %d, want %d", code, tt.wantUserB)
+			}
+
+			// Unknown states share the IP bucket of the route, not a
+			// fresh one per state
+			limited := false
+			for i := range 5 {
+				if get("/auth/unknown-"+strconv.Itoa(i)) == http.StatusTooManyRequests {
+					limited = true
+				}
+			}
+			if !limited {
+				t.Error("expected requests with unknown states to be rate limited by IP")
+			}
+
+			// Other routes keep the default limit
+			if code := get("/health"); code != http.StatusOK {
+				t.Errorf("/health: status %d, want 200", code)
+			}
+		})
+	}
+}
+
+func TestAllowList(t *testing.T) {
+	cfg := &config.Config{
+		Listen: config.ListenConfig{
+			HTTP:               ":9000",
+			TrustedProxies:     []string{"127.0.0.1"},
+			AllowedCIDRs:       []string{"198.51.100.0/24", "2001:db8:1::/48"},
+			HealthAllowedCIDRs: []string{"10.0.0.0/8"},
+		},
+	}
+	server, err := NewServer(cfg, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.limits.Stop()
+
+	tests := []struct {
+		name       string
+		path       string
+		remoteAddr string
+		xff        string
+		wantStatus int
+	}{
+		{name: "allowed IPv4", path: "/callback", remoteAddr: "198.51.100.7:40000", wantStatus: http.StatusBadRequest},
+		{name: "denied IPv4", path: "/callback", remoteAddr: "203.0.113.7:40000", wantStatus: http.StatusForbidden},
+		{name: "allowed IPv6", path: "/callback", remoteAddr: "[2001:db8:1::7]:40000", wantStatus: http.StatusBadRequest},
+		{name: "denied IPv6", path: "/callback", remoteAddr: "[2001:db8:2::7]:40000", wantStatus: http.StatusForbidden},
+		{name: "IPv4-mapped IPv6", path: "/callback", remoteAddr: "[::ffff:198.51.100.7]:40000", wantStatus: http.StatusBadRequest},
+		{name: "allowed behind proxy", path: "/callback", remoteAddr: "127.0.0.1:40000", xff: "198.51.100.7", wantStatus: http.StatusBadRequest},
+		{name: "denied behind proxy", path: "/callback", remoteAddr: "127.0.0.1:40000", xff: "203.0.113.7", wantStatus: http.StatusForbidden},
+		{name: "health from health range", path: "/health", remoteAddr: "10.1.2.3:40000", wantStatus: http.StatusOK},
+		{name: "health from allowed range", path: "/health", remoteAddr: "198.51.100.7:40000", wantStatus: http.StatusForbidden},
+		{name: "callback from health range", path: "/callback", remoteAddr: "10.1.2.3:40000", wantStatus: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.xff != "" {
+				req.Header.Set("X-Forwarded-For", tt.xff)
+			}
+			w := httptest.NewRecorder()
+			server.httpServer.Handler.ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+
+	// Without health_allowed_cidrs, /health is reachable from everywhere
+	cfg.Listen.HealthAllowedCIDRs = nil
+	unrestricted, err := NewServer(cfg, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unrestricted.limits.Stop()
+	req := httptest.NewRequest("GET", "/health", nil)
+	req.RemoteAddr = "203.0.113.7:40000"
+	w := httptest.NewRecorder()
+	unrestricted.httpServer.Handler.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("/health without health_allowed_cidrs: status = %d, want 200", w.Code)
+	}
+}
+
+func TestReputation(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	rep := newReputation(3, 10*time.Minute)
+	rep.now = func() time.Time { return now }
+
+	const ip = "198.51.100.7"
+	wantLevels := []int{0, 0, 1, 2, 3, 4, 4, 4}
+	for i, want := range wantLevels {
+		rep.recordFailure(ip)
+		if got := rep.level(ip); got != want {
+			t.Errorf("after %d failures: level = %d, want %d", i+1, got, want)
+		}
+		now = now.Add(time.Second)
+	}
+	if got := rep.level("198.51.100.8"); got != 0 {
+		t.Errorf("level of other IP = %d, want 0", got)
+	}
+
+	// Failures age out one by one, relaxing the penalty
+	now = now.Add(10*time.Minute - 5*time.Second)
+	if got := rep.level(ip); got != 2 {
+		t.Errorf("after oldest failures expired: level = %d, want 2", got)
+	}
+	now = now.Add(10 * time.Minute)
+	if got := rep.level(ip); got != 0 {
+		t.Errorf("after window: level = %d, want 0", got)
+	}
+	if _, ok := rep.failures[ip]; ok {
+		t.Error("expected expired IP to be forgotten")
+	}
+
+	// Disabled reputation
+	var disabled *reputation
+	disabled.recordFailure(ip)
+	if got := disabled.level(ip); got != 0 {
+		t.Errorf("nil reputation level = %d, want 0", got)
+	}
+}
+
+func TestPenalize(t *testing.T) {
+	tests := []struct {
+		level     int
+		wantRate  rate.Limit
+		wantBurst int
+	}{
+		{level: 0, wantRate: 10, wantBurst: 50},
+		{level: 1, wantRate: 2.5, wantBurst: 12},
+		{level: 2, wantRate: 0.625, wantBurst: 3},
+		{level: 4, wantRate: 10.0 / 256, wantBurst: 1},
+	}
+	for _, tt := range tests {
+		r, b := penalize(10, 50, tt.level)
+		if r != tt.wantRate || b != tt.wantBurst {
+			t.Errorf("penalize(level %d) = %v, %d, want %v, %d", tt.level, r, b, tt.wantRate, tt.wantBurst)
+		}
+	}
+}
+
+func TestRateLimitingReputation(t *testing.T) {
+	cfg := &config.Config{
+		Listen: config.ListenConfig{HTTP: ":9000"},
+		HTTPServer: config.HTTPServerConfig{
+			FailureReputation: config.FailureReputationConfig{Enabled: true, Threshold: 2, Window: 600},
+		},
+	}
+
+	server, err := NewServer(cfg, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const badIP, goodIP = "198.51.100.77", "198.51.100.78"
+	for range 5 {
+		server.RecordAuthFailure(badIP)
+	}
+
+	allowed := func(ip string) int {
+		count := 0
+		for range 20 {
+			req := httptest.NewRequest("GET", "/health", nil)
+			req.RemoteAddr = ip + ":12345"
+			w := httptest.NewRecorder()
+			server.httpServer.Handler.ServeHTTP(w, req)
+			if w.Code == http.StatusOK {
+				count++
+			}
+		}
+		return count
+	}
+
+	if got := allowed(goodIP); got != 20 {
+		t.Errorf("well-behaved IP: %d of 20 requests allowed, want 20", got)
+	}
+	if got := allowed(badIP); got != 1 {
+		t.Errorf("failing IP: %d of 20 requests allowed, want 1 (burst at maximum penalty)", got)
+	}
+
+	// The limit relaxes once the failures age out
+	server.reputation.now = func() time.Time { return time.Now().Add(time.Hour) }
+	allowed(badIP)
+	if limit := server.limits.base.getLimiter(badIP, 0).Limit(); limit != 10 {
+		t.Errorf("relaxed limit = %v, want 10", limit)
+	}
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	cfg := &config.Config{
+		Listen: config.ListenConfig{HTTP: "127.0.0.1:0"}, // Random port
+	}
+
+	server, err := NewServer(cfg, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Start server in background
+	startErrCh := make(chan error, 1)
+	go func() {
+		startErrCh <- server.Start()
+	}()
+
+	// Give it time to start
+	time.Sleep(100 * time.Millisecond)
+
+	// Shutdown
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+
+	select {
+	case err := <-startErrCh:
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			t.Errorf("Start failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for server to stop")
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "run", "http.sock")
+	cfg := &config.Config{
+		Listen: config.ListenConfig{HTTPSocket: socketPath},
+	}
+
+	server, err := NewServer(cfg, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.mux.HandleFunc("/client-ip", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, extractIP(r, server.trustedProxies))
+	})
+
+	// A stale socket from a previous run must not prevent startup
+	if err := os.MkdirAll(filepath.Dir(socketPath), 0750); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(socketPath, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := server.Listen(); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	startErrCh := make(chan error, 1)
+	go func() {
+		startErrCh <- server.Start()
+	}()
+
+	info, err := os.Stat(socketPath)
+	if err != nil {
+		t.Fatalf("stat socket: %v", err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		t.Errorf("%s is not a socket", socketPath)
+	}
+	if perm := info.Mode().Perm(); perm != 0660 {
+		t.Errorf("socket permissions = %o, want 660", perm)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+		Timeout: 5 * time.Second,
+	}
+	defer client.CloseIdleConnections()
+
+	resp, err := client.Get("http://vpn.example.com/health")
+	if err != nil {
+		t.Fatalf("GET /health over unix socket: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("/health status = %d, want 200", resp.StatusCode)
+	}
+
+	// The peer is always the local reverse proxy, so its forwarded client
+	// address is used
+	req, err := http.NewRequest("GET", "http://vpn.example.com/client-ip", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Forwarded-For", "203.0.113.42")
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("GET /client-ip over unix socket: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(body) != "203.0.113.42" {
+		t.Errorf("client IP = %q, want %q", body, "203.0.113.42")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+	if err := <-startErrCh; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("Start failed: %v", err)
+	}
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Errorf("socket not removed on shutdown: %v", err)
+	}
+}
+
+func TestACME(t *testing.T) {
+	cacheDir := filepath.Join(t.TempDir(), "acme")
+	cfg := &config.Config{
+		Listen: config.ListenConfig{HTTP: "127.0.0.1:0"},
+		TLS: config.TLSConfig{
+			Enabled: true,
+			ACME: config.ACMEConfig{
+				Enabled:           true,
+				Domains:           []string{"vpn.example.com"},
+				CacheDir:          cacheDir,
+				DirectoryURL:      "https://acme-staging-v02.api.letsencrypt.org/directory",
+				HTTPChallengeAddr: "127.0.0.1:0",
+			},
+		},
+	}
+
+	server, err := NewServer(cfg, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	info, err := os.Stat(cacheDir)
+	if err != nil {
+		t.Fatalf("cache directory not created: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0700 {
+		t.Errorf("cache directory permissions = %o, want 700", perm)
+	}
+
+	tlsConfig := server.httpServer.TLSConfig
+	if tlsConfig == nil || tlsConfig.GetCertificate == nil {
+		t.Fatal("expected TLS config with GetCertificate")
+	}
+	if !slices.Contains(tlsConfig.NextProtos, "acme-tls/1") {
+		t.Errorf("NextProtos = %v, want acme-tls/1 for TLS-ALPN-01", tlsConfig.NextProtos)
+	}
+	if server.certs != nil {
+		t.Error("expected no file-based certificate with ACME")
+	}
+
+	// Host names outside tls.acme.domains are refused without contacting the CA
+	if _, err := tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: "other.example.com"}); err == nil {
+		t.Error("expected certificate for unlisted host to be refused")
+	}
+
+	if err := server.Listen(); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	if server.challengeListener == nil {
+		t.Fatal("expected challenge listener to be bound")
+	}
+	challengeAddr := server.challengeListener.Addr().String()
+
+	startErrCh := make(chan error, 1)
+	go func() {
+		startErrCh <- server.Start()
+	}()
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantHeader string
+	}{
+		{name: "unknown challenge token", path: "/.well-known/acme-challenge/unknown", wantStatus: http.StatusNotFound},
+		{name: "other paths redirect to HTTPS", path: "/callback?state=x", wantStatus: http.StatusFound,
+			wantHeader: "https://vpn.example.com/callback?state=x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", "http://"+challengeAddr+tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Host = "vpn.example.com"
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("GET %s: %v", tt.path, err)
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantHeader != "" && resp.Header.Get("Location") != tt.wantHeader {
+				t.Errorf("Location = %q, want %q", resp.Header.Get("Location"), tt.wantHeader)
+			}
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+	if err := <-startErrCh; err != nil && !errors.Is(err, http.ErrServerClosed) {
+		t.Errorf("Start failed: %v", err)
+	}
+	if _, err := net.DialTimeout("tcp", challengeAddr, time.Second); err == nil {
+		t.Error("challenge server still accepting connections after Shutdown")
+	}
+}
+
+// slowStore is a session.SharedStore whose GetByState blocks until release
+// is closed, simulating a slow session lookup during a callback.
+type slowStore struct {
+	release chan struct{}
+}
+
+func (s *slowStore) Load() ([]*session.Session, error) { return nil, nil }
+func (s *slowStore) Save(*session.Session) error       { return nil }
+func (s *slowStore) Delete(*session.Session) error     { return nil }
+func (s *slowStore) Get(string) (*session.Session, error) {
+	return nil, nil
+}
+func (s *slowStore) GetByState(string) (*session.Session, error) {
+	<-s.release
+	return nil, nil
+}
+func (s *slowStore) MarkResultWritten(*session.Session) (bool, error) { return true, nil }
+
+func TestDrainWaitsForSlowCallback(t *testing.T) {
+	cfg := &config.Config{
+		Listen: config.ListenConfig{HTTP: "127.0.0.1:0"},
+	}
+
+	store := &slowStore{release: make(chan struct{})}
+	sessionMgr := session.NewManager(5*time.Minute, 0)
+	defer sessionMgr.Stop()
+	if _, err := sessionMgr.SetStore(store); err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewServer(cfg, nil, sessionMgr, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.Start() }()
+
+	callbackDone := make(chan int, 1)
+	go func() {
+		resp, err := http.Get("http://" + server.listener.Addr().String() + "/callback?code=c&state=s")
+		if err != nil {
+			callbackDone <- 0
+			return
+		}
+		_ = resp.Body.Close()
+		callbackDone <- resp.StatusCode
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for server.InFlightCallbacks() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("callback never became in flight")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A drain that times out reports the callback still in flight
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	if remaining := server.Drain(ctx); remaining != 1 {
+		t.Errorf("Drain() after timeout = %d, want 1", remaining)
+	}
+	cancel()
+
+	drained := make(chan int64, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		drained <- server.Drain(ctx)
+	}()
+
+	select {
+	case <-drained:
+		t.Fatal("Drain returned while a callback was in flight")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(store.release)
+	select {
+	case remaining := <-drained:
+		if remaining != 0 {
+			t.Errorf("Drain() = %d, want 0", remaining)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Drain did not return after the callback finished")
+	}
+
+	if status := <-callbackDone; status != http.StatusBadRequest {
+		t.Errorf("callback status = %d, want 400 (session not found)", status)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+}
+
+func TestExtractIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		expectedIP string
+	}{
+		{
+			name:       "direct connection",
+			remoteAddr: "192.0.2.1:12345",
+			expectedIP: "192.0.2.1",
+		},
+		{
+			name:       "ignores X-Forwarded-For (anti-spoofing)",
+			remoteAddr: "127.0.0.1:12345",
+			expectedIP: "127.0.0.1",
+		},
+		{
+			name:       "IPv6 address",
+			remoteAddr: "[::1]:12345",
+			expectedIP: "::1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+
+			// Set spoofable headers to verify they're ignored
+			req.Header.Set("X-Forwarded-For", "203.0.113.42")
+			req.Header.Set("X-Real-IP", "203.0.113.42")
+
+			ip := extractIP(req, nil)
+			if ip != tt.expectedIP {
+				t.Errorf("expected IP '%s', got '%s'", tt.expectedIP, ip)
+			}
+		})
+	}
+}
+
+func TestExtractIPTrustedProxies(t *testing.T) {
+	trusted, err := config.ParseTrustedProxies([]string{"10.0.0.0/8", "2001:db8::/32", "192.0.2.10"})
+	if err != nil {
+		t.Fatalf("ParseTrustedProxies failed: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		xff        []string
+		realIP     string
+		expectedIP string
+	}{
+		{
+			name:       "untrusted source ignores X-Forwarded-For",
+			remoteAddr: "198.51.100.7:12345",
+			xff:        []string{"203.0.113.42"},
+			expectedIP: "198.51.100.7",
+		},
+		{
+			name:       "untrusted source ignores X-Real-IP",
+			remoteAddr: "198.51.100.7:12345",
+			realIP:     "203.0.113.42",
+			expectedIP: "198.51.100.7",
+		},
+		{
+			name:       "trusted proxy X-Forwarded-For",
+			remoteAddr: "10.1.2.3:12345",
+			xff:        []string{"203.0.113.42"},
+			expectedIP: "203.0.113.42",
+		},
+		{
+			name:       "trusted single-host proxy",
+			remoteAddr: "192.0.2.10:12345",
+			xff:        []string{"203.0.113.42"},
+			expectedIP: "203.0.113.42",
+		},
+		{
+			name:       "spoofed leftmost entry is skipped",
+			remoteAddr: "10.1.2.3:12345",
+			xff:        []string{"1.2.3.4, 203.0.113.42"},
+			expectedIP: "203.0.113.42",
+		},
+		{
+			name:       "chained trusted proxies",
+			remoteAddr: "10.1.2.3:12345",
+			xff:        []string{"203.0.113.42, 10.9.9.9"},
+			expectedIP: "203.0.113.42",
+		},
+		{
+			name:       "multiple X-Forwarded-For headers",
+			remoteAddr: "10.1.2.3:12345",
+			xff:        []string{"1.2.3.4", "203.0.113.42"},
+			expectedIP: "203.0.113.42",
+		},
+		{
+			name:       "all hops trusted",
+			remoteAddr: "10.1.2.3:12345",
+			xff:        []string{"10.5.5.5, 10.9.9.9"},
+			expectedIP: "10.5.5.5",
+		},
+		{
+			name:       "malformed X-Forwarded-For falls back to proxy",
+			remoteAddr: "10.1.2.3:12345",
+			xff:        []string{"not-an-ip"},
+			expectedIP: "10.1.2.3",
+		},
+		{
+			name:       "trusted proxy X-Real-IP",
+			remoteAddr: "10.1.2.3:12345",
+			realIP:     "203.0.113.42",
+			expectedIP: "203.0.113.42",
+		},
+		{
+			name:       "X-Forwarded-For preferred over X-Real-IP",
+			remoteAddr: "10.1.2.3:12345",
+			xff:        []string{"203.0.113.42"},
+			realIP:     "198.51.100.1",
+			expectedIP: "203.0.113.42",
+		},
+		{
+			name:       "trusted IPv6 proxy",
+			remoteAddr: "[2001:db8::1]:12345",
+			xff:        []string{"2001:db9::42"},
+			expectedIP: "2001:db9::42",
+		},
+		{
+			name:       "trusted proxy without headers",
+			remoteAddr: "10.1.2.3:12345",
+			expectedIP: "10.1.2.3",
+		},
+		{
+			name:       "unix socket peer X-Forwarded-For",
+			remoteAddr: "@",
+			xff:        []string{"1.2.3.4, 203.0.113.42"},
+			expectedIP: "203.0.113.42",
+		},
+		{
+			name:       "unix socket peer X-Real-IP",
+			remoteAddr: "",
+			realIP:     "203.0.113.42",
+			expectedIP: "203.0.113.42",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, v := range tt.xff {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+
+			if ip := extractIP(req, trusted); ip != tt.expectedIP {
+				t.Errorf("expected IP '%s', got '%s'", tt.expectedIP, ip)
+			}
+		})
+	}
+}
+
+func TestAuthStartAPI(t *testing.T) {
+	cfg := &config.Config{
+		Listen:     config.ListenConfig{HTTP: ":9000"},
+		HTTPServer: config.HTTPServerConfig{EnableAuthAPI: true},
+	}
+
+	sessionMgr := session.NewManager(5*time.Minute, 0)
+	defer sessionMgr.Stop()
+
+	server, err := NewServer(cfg, nil, sessionMgr, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sess, err := sessionMgr.Create("testuser", "", "192.0.2.1", "12345",
+		"/tmp/acf", "/tmp/apf", "/tmp/arf")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testState := "apistate123"
+	testAuthURL := "https://keycloak.example.com/realms/test/protocol/openid-connect/auth?client_id=openvpn"
+	if err := sessionMgr.UpdateOIDCFlow(sess.ID, testState, "verifier", "nonce", testAuthURL); err != nil {
+		t.Fatal(err)
+	}
+
+	// Session without an initialized flow
+	uninit, err := sessionMgr.Create("other", "", "192.0.2.2", "12345",
+		"/tmp/acf2", "/tmp/apf2", "/tmp/arf2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sessionMgr.UpdateOIDCFlow(uninit.ID, "uninitstate", "verifier", "nonce", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		authHeader string
+		wantStatus int
+		wantError  string
+	}{
+		{
+			name:       "valid token returns auth URL",
+			method:     http.MethodPost,
+			authHeader: "Bearer " + testState,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "scheme is case-insensitive",
+			method:     http.MethodPost,
+			authHeader: "bearer " + testState,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "GET not allowed",
+			method:     http.MethodGet,
+			authHeader: "Bearer " + testState,
+			wantStatus: http.StatusMethodNotAllowed,
+			wantError:  "method not allowed",
+		},
+		{
+			name:       "missing token",
+			method:     http.MethodPost,
+			wantStatus: http.StatusUnauthorized,
+			wantError:  "missing or malformed bearer token",
+		},
+		{
+			name:       "wrong scheme",
+			method:     http.MethodPost,
+			authHeader: "Basic " + testState,
+			wantStatus: http.StatusUnauthorized,
+			wantError:  "missing or malformed bearer token",
+		},
+		{
+			name:       "unknown token",
+			method:     http.MethodPost,
+			authHeader: "Bearer unknownstate",
+			wantStatus: http.StatusNotFound,
+			wantError:  "session not found or expired",
+		},
+		{
+			name:       "flow not initialized",
+			method:     http.MethodPost,
+			authHeader: "Bearer uninitstate",
+			wantStatus: http.StatusConflict,
+			wantError:  "authentication flow not initialized",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/api/auth/start", nil)
+			if tt.authHeader != "" {
+				req.Header.Set("Authorization", tt.authHeader)
+			}
+			w := httptest.NewRecorder()
+
+			server.mux.ServeHTTP(w, req)
+
+			resp := w.Result()
+			defer func() { _ = resp.Body.Close() }()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("expected status %d, got %d", tt.wantStatus, resp.StatusCode)
+			}
+			if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+				t.Errorf("expected Content-Type application/json, got %s", ct)
+			}
+			if v := resp.Header.Get("X-API-Version"); v != APIVersion {
+				t.Errorf("expected X-API-Version %s, got %s", APIVersion, v)
+			}
+
+			if tt.wantError != "" {
+				var apiErr APIErrorResponse
+				if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil {
+					t.Fatalf("failed to decode error response: %v", err)
+				}
+				if apiErr.Error != tt.wantError {
+					t.Errorf("expected error %q, got %q", tt.wantError, apiErr.Error)
+				}
+				if apiErr.APIVersion != APIVersion {
+					t.Errorf("expected api_version %s, got %s", APIVersion, apiErr.APIVersion)
+				}
+				return
+			}
+
+			var startResp AuthStartResponse
+			if err := json.NewDecoder(resp.Body).Decode(&startResp); err != nil {
+				t.Fatalf("failed to decode response: %v", err)
+			}
+			if startResp.AuthURL != testAuthURL {
+				t.Errorf("expected auth_url %s, got %s", testAuthURL, startResp.AuthURL)
+			}
+			if startResp.APIVersion != APIVersion {
+				t.Errorf("expected api_version %s, got %s", APIVersion, startResp.APIVersion)
+			}
+			if !startResp.ExpiresAt.Equal(sess.ExpiresAt) {
+				t.Errorf("expected expires_at %v, got %v", sess.ExpiresAt, startResp.ExpiresAt)
+			}
+		})
+	}
+}
+
+func TestCodeEndpoint(t *testing.T) {
+	cfg := &config.Config{
+		Listen: config.ListenConfig{HTTP: ":9000"},
+		Auth:   config.AuthConfig{EnableCRText: true},
+	}
+
+	sessionMgr := session.NewManager(5*time.Minute, 0)
+	defer sessionMgr.Stop()
+
+	server, err := NewServer(cfg, nil, sessionMgr, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sess, err := sessionMgr.Create("testuser", "", "192.0.2.1", "12345",
+		"/tmp/acf", "/tmp/apf", "/tmp/arf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testAuthURL := "https://keycloak.example.com/realms/test/protocol/openid-connect/auth?client_id=openvpn"
+	if err := sessionMgr.UpdateOIDCFlow(sess.ID, "codestate", "verifier", "nonce", testAuthURL); err != nil {
+		t.Fatal(err)
+	}
+	code, err := sessionMgr.AssignUserCode(sess.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	postCode := func(code string) *http.Response {
+		form := "code=" + code
+		req := httptest.NewRequest(http.MethodPost, "/code", strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		server.mux.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	tests := []struct {
+		name         string
+		method       string
+		code         string
+		wantStatus   int
+		wantLocation string
+		wantBody     string
+	}{
+		{name: "GET renders form", method: http.MethodGet, wantStatus: http.StatusOK, wantBody: "Enter VPN Code"},
+		{name: "unknown code", method: http.MethodPost, code: "AAAA-AAAA", wantStatus: http.StatusBadRequest, wantBody: "Code not found"},
+		{name: "empty code", method: http.MethodPost, code: "", wantStatus: http.StatusBadRequest, wantBody: "Please enter the code"},
+		{name: "valid code redirects", method: http.MethodPost, code: strings.ToLower(code), wantStatus: http.StatusSeeOther, wantLocation: testAuthURL},
+		{name: "code is single use", method: http.MethodPost, code: code, wantStatus: http.StatusBadRequest, wantBody: "Code not found"},
+		{name: "other methods rejected", method: http.MethodPut, wantStatus: http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resp *http.Response
+			if tt.method == http.MethodPost {
+				resp = postCode(tt.code)
+			} else {
+				w := httptest.NewRecorder()
+				server.mux.ServeHTTP(w, httptest.NewRequest(tt.method, "/code", nil))
+				resp = w.Result()
+			}
+			defer func() { _ = resp.Body.Close() }()
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantLocation != "" && resp.Header.Get("Location") != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", resp.Header.Get("Location"), tt.wantLocation)
+			}
+			if tt.wantBody != "" {
+				body, _ := io.ReadAll(resp.Body)
+				if !strings.Contains(string(body), tt.wantBody) {
+					t.Errorf("body does not contain %q", tt.wantBody)
+				}
+			}
+		})
+	}
+}
+
+func TestCodeEndpointDisabledByDefault(t *testing.T) {
+	cfg := &config.Config{
+		Listen: config.ListenConfig{HTTP: ":9000"},
+	}
+
+	server, err := NewServer(cfg, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	server.mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/code", nil))
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 when crtext disabled, got %d", w.Code)
+	}
+}
+
+func TestAuthStartAPIDisabledByDefault(t *testing.T) {
+	cfg := &config.Config{
+		Listen: config.ListenConfig{HTTP: ":9000"},
+	}
+
+	server, err := NewServer(cfg, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/auth/start", nil)
+	req.Header.Set("Authorization", "Bearer somestate")
+	w := httptest.NewRecorder()
+
+	server.mux.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 when API disabled, got %d", w.Code)
+	}
+}
+
+func TestConfigAPI(t *testing.T) {
+	cfg := &config.Config{
+		Listen: config.ListenConfig{HTTP: ":9000"},
+		OIDC: config.OIDCConfig{
+			Issuer:        "https://keycloak.example.com/realms/myrealm",
+			ClientID:      "openvpn",
+			ClientSecret:  "oidc-secret",
+			RedirectURI:   "https://vpn.example.com:9000/callback",
+			Scopes:        []string{"openid", "profile"},
+			RequiredRoles: []string{"vpn-user"},
+			AdminAPI:      config.AdminAPIConfig{ClientSecret: "admin-secret"},
+			Providers: []config.OIDCProviderConfig{{
+				Name:             "partners",
+				CommonNameSuffix: ".partners.example.com",
+				Issuer:           "https://keycloak.example.com/realms/partners",
+				ClientSecret:     "partner-secret",
+			}},
+		},
+		Auth: config.AuthConfig{SessionTimeout: 300, EnableCRText: true},
+		HTTPServer: config.HTTPServerConfig{
+			EnableConfigAPI: true,
+			ConfigAPIToken:  "provisioning-token",
+		},
+	}
+
+	server, err := NewServer(cfg, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(authHeader string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/api/config", nil)
+		if authHeader != "" {
+			req.Header.Set("Authorization", authHeader)
+		}
+		w := httptest.NewRecorder()
+		server.mux.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, header := range []string{"", "Bearer wrong-token", "Basic provisioning-token"} {
+		if w := get(header); w.Code != http.StatusUnauthorized {
+			t.Errorf("Authorization %q: status = %d, want 401", header, w.Code)
+		}
+	}
+
+	w := get("Bearer provisioning-token")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+
+	body := w.Body.String()
+	for _, secret := range []string{"oidc-secret", "admin-secret", "partner-secret", "provisioning-token", "REDACTED", "vpn-user"} {
+		if strings.Contains(body, secret) {
+			t.Errorf("response contains %q: %s", secret, body)
+		}
+	}
+
+	var resp ConfigResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.APIVersion != APIVersion {
+		t.Errorf("api_version = %q, want %q", resp.APIVersion, APIVersion)
+	}
+	if strings.Join(resp.SSOMethods, ",") != "webauth,openurl,crtext" {
+		t.Errorf("sso_methods = %v", resp.SSOMethods)
+	}
+	if resp.Issuer != cfg.OIDC.Issuer || resp.ClientID != "openvpn" || resp.RedirectURI != cfg.OIDC.RedirectURI {
+		t.Errorf("unexpected OIDC settings: %+v", resp)
+	}
+	if resp.ClientMode != config.ClientModeConfidential {
+		t.Errorf("client_mode = %q, want %q", resp.ClientMode, config.ClientModeConfidential)
+	}
+	if strings.Join(resp.Scopes, " ") != "openid profile" || resp.SessionTimeout != 300 {
+		t.Errorf("scopes = %v, session_timeout = %d", resp.Scopes, resp.SessionTimeout)
+	}
+	if len(resp.Providers) != 1 || resp.Providers[0].Name != "partners" ||
+		resp.Providers[0].Issuer != "https://keycloak.example.com/realms/partners" ||
+		resp.Providers[0].ClientID != "openvpn" || resp.Providers[0].CommonNameSuffix != ".partners.example.com" {
+		t.Errorf("providers = %+v", resp.Providers)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/config", nil)
+	req.Header.Set("Authorization", "Bearer provisioning-token")
+	w = httptest.NewRecorder()
+	server.mux.ServeHTTP(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %d, want 405", w.Code)
+	}
+}
+
+func TestConfigAPIDisabledByDefault(t *testing.T) {
+	cfg := &config.Config{
+		Listen: config.ListenConfig{HTTP: ":9000"},
+	}
+
+	server, err := NewServer(cfg, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/config", nil)
+	w := httptest.NewRecorder()
+	server.mux.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 when API disabled, got %d", w.Code)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	cfg := &config.Config{
+		Listen:        config.ListenConfig{HTTP: ":9000"},
+		Observability: config.ObservabilityConfig{Metrics: true},
+	}
+
+	sessionMgr := session.NewManager(5*time.Minute, 0)
+	defer sessionMgr.Stop()
+
+	if _, err := sessionMgr.Create("testuser", "", "192.0.2.1", "12345",
+		"/tmp/acf", "/tmp/apf", "/tmp/arf"); err != nil {
+		t.Fatal(err)
+	}
+
+	m := metrics.New(sessionMgr)
+	m.AuthRequestReceived()
+
+	server, err := NewServer(cfg, nil, sessionMgr, m, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Scrapes from a single IP must not be rate limited by default
+	for i := 0; i < 100; i++ {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.RemoteAddr = "192.0.2.50:12345"
+		w := httptest.NewRecorder()
+
+		server.httpServer.Handler.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("scrape %d: expected status 200, got %d", i, w.Code)
+		}
+		if i == 0 {
+			body := w.Body.String()
+			for _, want := range []string{
+				"openvpn_keycloak_auth_auth_requests_total 1",
+				"openvpn_keycloak_auth_active_sessions 1",
+			} {
+				if !strings.Contains(body, want) {
+					t.Errorf("expected %q in metrics output", want)
+				}
+			}
+		}
+	}
+}
+
+func TestMetricsEndpointRateLimitedWhenConfigured(t *testing.T) {
+	cfg := &config.Config{
+		Listen: config.ListenConfig{HTTP: ":9000"},
+		Observability: config.ObservabilityConfig{
+			Metrics:            true,
+			MetricsRateLimited: true,
+		},
+	}
+
+	server, err := NewServer(cfg, nil, nil, metrics.New(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	limited := false
+	for i := 0; i < 100; i++ {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.RemoteAddr = "192.0.2.51:12345"
+		w := httptest.NewRecorder()
+
+		server.httpServer.Handler.ServeHTTP(w, req)
+
+		if w.Code == http.StatusTooManyRequests {
+			limited = true
+			break
+		}
+	}
+
+	if !limited {
+		t.Error("expected /metrics to be rate limited when metrics_rate_limited is set")
+	}
+}
+
+func TestMetricsEndpointDisabledByDefault(t *testing.T) {
+	cfg := &config.Config{
+		Listen: config.ListenConfig{HTTP: ":9000"},
+	}
+
+	server, err := NewServer(cfg, nil, nil, metrics.New(nil), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	w := httptest.NewRecorder()
+	server.mux.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 when metrics disabled, got %d", w.Code)
+	}
+}
+
+// writeTestCert writes a self-signed certificate and key for commonName to
+// certFile and keyFile.
+func writeTestCert(t *testing.T, certFile, keyFile, commonName string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// servedCommonName connects to addr and returns the CN of the served certificate.
+func servedCommonName(t *testing.T, addr string) string {
+	t.Helper()
+
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true}) // #nosec G402 -- test against self-signed cert
+	if err != nil {
+		t.Fatalf("TLS dial failed: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+}
+
+func TestReloadTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	writeTestCert(t, certFile, keyFile, "original")
+
+	cfg := &config.Config{
+		Listen: config.ListenConfig{HTTP: "127.0.0.1:0"},
+		TLS: config.TLSConfig{
+			Enabled:  true,
+			CertFile: certFile,
+			KeyFile:  keyFile,
+		},
+	}
+
+	server, err := NewServer(cfg, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.httpServer.ServeTLS(ln, "", "") }()
+	t.Cleanup(func() { _ = server.Shutdown(context.Background()) })
+
+	addr := ln.Addr().String()
+	if cn := servedCommonName(t, addr); cn != "original" {
+		t.Fatalf("served CN = %q, want %q", cn, "original")
+	}
+
+	// Renew the certificate on disk; it is not served until reloaded
+	writeTestCert(t, certFile, keyFile, "renewed")
+	if cn := servedCommonName(t, addr); cn != "original" {
+		t.Fatalf("served CN before reload = %q, want %q", cn, "original")
+	}
+
+	if err := server.ReloadTLS(); err != nil {
+		t.Fatalf("ReloadTLS failed: %v", err)
+	}
+	if cn := servedCommonName(t, addr); cn != "renewed" {
+		t.Fatalf("served CN after reload = %q, want %q", cn, "renewed")
+	}
+
+	// A broken key pair keeps the current certificate
+	if err := os.WriteFile(keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.ReloadTLS(); err == nil {
+		t.Fatal("expected ReloadTLS to fail with invalid key")
+	}
+	if cn := servedCommonName(t, addr); cn != "renewed" {
+		t.Fatalf("served CN after failed reload = %q, want %q", cn, "renewed")
+	}
+}
+
+func TestTLSVersionAndCipherSuites(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	writeTestCert(t, certFile, keyFile, "test")
+	customSuites := []string{"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}
+
+	tests := []struct {
+		name          string
+		minVersion    string
+		cipherSuites  []string
+		clientVersion uint16
+		clientSuites  []uint16
+		wantHandshake bool
+	}{
+		{name: "default accepts TLS 1.2", clientVersion: tls.VersionTLS12, wantHandshake: true},
+		{name: "1.3 only rejects TLS 1.2", minVersion: "1.3", clientVersion: tls.VersionTLS12},
+		{name: "1.3 only accepts TLS 1.3", minVersion: "1.3", clientVersion: tls.VersionTLS13, wantHandshake: true},
+		// The test certificate is ECDSA, so the RSA suite (listed for HTTP/2)
+		// is never negotiated
+		{name: "configured suite accepted", cipherSuites: customSuites,
+			clientVersion: tls.VersionTLS12, clientSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}, wantHandshake: true},
+		{name: "unlisted suite rejected", cipherSuites: customSuites,
+			clientVersion: tls.VersionTLS12, clientSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.Config{
+				Listen: config.ListenConfig{HTTP: "127.0.0.1:0"},
+				TLS: config.TLSConfig{
+					Enabled:      true,
+					CertFile:     certFile,
+					KeyFile:      keyFile,
+					MinVersion:   tt.minVersion,
+					CipherSuites: tt.cipherSuites,
+				},
+			}
+			server, err := NewServer(cfg, nil, nil, nil, nil)
+			if err != nil {
+				t.Fatalf("NewServer failed: %v", err)
+			}
+			if err := server.Listen(); err != nil {
+				t.Fatalf("Listen failed: %v", err)
+			}
+			go func() { _ = server.Start() }()
+			t.Cleanup(func() { _ = server.Shutdown(context.Background()) })
+
+			dialer := &net.Dialer{Timeout: 5 * time.Second, Deadline: time.Now().Add(5 * time.Second)}
+			conn, err := tls.DialWithDialer(dialer, "tcp", server.listener.Addr().String(), &tls.Config{
+				InsecureSkipVerify: true, // #nosec G402 -- test against self-signed cert
+				MinVersion:         tt.clientVersion,
+				MaxVersion:         tt.clientVersion,
+				CipherSuites:       tt.clientSuites,
+			})
+			if err == nil {
+				_ = conn.Close()
+			}
+			if tt.wantHandshake && err != nil {
+				t.Fatalf("handshake failed: %v", err)
+			}
+			if !tt.wantHandshake && err == nil {
+				t.Fatal("expected handshake to fail")
+			}
+		})
+	}
+}
+
+func TestCertWatchInterval(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  config.TLSConfig
+		want time.Duration
+	}{
+		{name: "disabled", cfg: config.TLSConfig{}, want: 0},
+		{name: "watch default", cfg: config.TLSConfig{Watch: true}, want: defaultCertWatchInterval},
+		{name: "watch with interval", cfg: config.TLSConfig{Watch: true, ReloadInterval: 5}, want: 5 * time.Second},
+		{name: "interval without watch", cfg: config.TLSConfig{ReloadInterval: 60}, want: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := certWatchInterval(tt.cfg); got != tt.want {
+				t.Errorf("certWatchInterval() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatchSwapsCertificateMidFlight(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	writeTestCert(t, certFile, keyFile, "original")
+
+	cfg := &config.Config{
+		Listen: config.ListenConfig{HTTP: "127.0.0.1:0"},
+		TLS: config.TLSConfig{
+			Enabled:        true,
+			CertFile:       certFile,
+			KeyFile:        keyFile,
+			Watch:          true,
+			ReloadInterval: 1,
+		},
+	}
+
+	server, err := NewServer(cfg, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatalf("NewServer failed: %v", err)
+	}
+	if err := server.Listen(); err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	go func() { _ = server.Start() }()
+	t.Cleanup(func() { _ = server.Shutdown(context.Background()) })
+	addr := server.listener.Addr().String()
+
+	// A keep-alive client whose connection stays open across the swap
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // #nosec G402 -- test against self-signed cert
+		},
+	}
+	defer client.CloseIdleConnections()
+	get := func() string {
+		t.Helper()
+		resp, err := client.Get("https://" + addr + "/health")
+		if err != nil {
+			t.Fatalf("GET /health: %v", err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		return resp.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	if cn := get(); cn != "original" {
+		t.Fatalf("served CN = %q, want %q", cn, "original")
+	}
+
+	// Rotate with a broken key first: the current certificate stays in use
+	if err := os.WriteFile(keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if cn := servedCommonName(t, addr); cn != "original" {
+		t.Fatalf("served CN after broken rotation = %q, want %q", cn, "original")
+	}
+
+	writeTestCert(t, certFile, keyFile, "renewed")
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(keyFile, future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for servedCommonName(t, addr) != "renewed" {
+		if time.Now().After(deadline) {
+			t.Fatal("watcher did not pick up the renewed certificate")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// The connection opened before the swap keeps working
+	if cn := get(); cn != "original" {
+		t.Errorf("existing connection CN = %q, want %q", cn, "original")
+	}
+}
+
+func TestCertReloaderWatch(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "server.crt")
+	keyFile := filepath.Join(dir, "server.key")
+	writeTestCert(t, certFile, keyFile, "original")
+
+	certs, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newCertReloader failed: %v", err)
+	}
+	go certs.watch(10 * time.Millisecond)
+	defer certs.Stop()
+
+	writeTestCert(t, certFile, keyFile, "renewed")
+	// Ensure the modification time differs even on coarse-grained filesystems
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(certFile, future, future); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		cert, _ := certs.GetCertificate(nil)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leaf.Subject.CommonName == "renewed" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("watcher did not reload the renewed certificate")
+}
+
+func TestReconfigureRateLimit(t *testing.T) {
+	cfg := &config.Config{
+		Listen: config.ListenConfig{
+			HTTP:      ":9000",
+			RateLimit: config.RateLimitConfig{Rate: 1, Burst: 1},
+		},
+	}
+	server, err := NewServer(cfg, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { server.rateLimiters().Stop() }()
+
+	get := func() int {
+		req := httptest.NewRequest("GET", "/health", nil)
+		req.RemoteAddr = "198.51.100.7:40000"
+		w := httptest.NewRecorder()
+		server.httpServer.Handler.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	get()
+	if code := get(); code != http.StatusTooManyRequests {
+		t.Fatalf("second request: status = %d, want 429", code)
+	}
+
+	// An unchanged rate limit keeps the buckets
+	same := *cfg
+	server.Reconfigure(&same, nil)
+	if code := get(); code != http.StatusTooManyRequests {
+		t.Errorf("after unchanged reload: status = %d, want 429", code)
+	}
+
+	raised := *cfg
+	raised.Listen.RateLimit = config.RateLimitConfig{Rate: 1, Burst: 5}
+	server.Reconfigure(&raised, nil)
+	for i := 0; i < 5; i++ {
+		if code := get(); code != http.StatusOK {
+			t.Fatalf("request %d after reload: status = %d, want 200", i+1, code)
+		}
+	}
+	if code := get(); code != http.StatusTooManyRequests {
+		t.Errorf("request 6 after reload: status = %d, want 429", code)
+	}
+}
+
+func TestReconfigureExternalAuthorizer(t *testing.T) {
+	cfg := &config.Config{Listen: config.ListenConfig{HTTP: ":9000"}}
+	server, err := NewServer(cfg, nil, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.limits.Stop()
+	if server.externalAuthorizer() != nil {
+		t.Fatal("authorizer set without auth.external_authorizer.url")
+	}
+
+	enabled := *cfg
+	enabled.Auth.ExternalAuthorizer = config.ExternalAuthorizerConfig{URL: "https://authz.example.com/decide", Timeout: 5}
+	server.Reconfigure(&enabled, nil)
+	authz := server.externalAuthorizer()
+	if authz == nil {
+		t.Fatal("authorizer not created on reload")
+	}
+
+	// Other changes keep the client and its connections
+	other := enabled
+	other.Auth.SessionTimeout = 600
+	server.Reconfigure(&other, nil)
+	if server.externalAuthorizer() != authz {
+		t.Error("authorizer replaced although its settings did not change")
+	}
+
+	server.Reconfigure(cfg, nil)
+	if server.externalAuthorizer() != nil {
+		t.Error("authorizer kept after auth.external_authorizer.url was removed")
+	}
+}
@@ -0,0 +1,203 @@
+package httpserver
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
+)
+
+// translations maps a language to the texts of the browser pages, keyed by
+// a stable message ID such as "error.session_not_found". English is the
+// fallback for IDs a language lacks. Page templates translate with
+// {{t .Lang "message.id"}}; texts with a %s verb take a detail, such as an
+// error from the identity provider, which is shown untranslated.
+var translations = map[string]map[string]string{
+	"en": {
+		"success.title":              "Authentication Successful",
+		"success.heading":            "Authentication Successful!",
+		"success.establishing":       "Your VPN connection is now being established.",
+		"success.login_code":         "Login code:",
+		"success.close_hint":         "You can close this window and return to your VPN client.",
+		"success.redirecting":        "You will be redirected shortly.",
+		"success.autoclose":          "This window will close automatically.",
+		"success.connected":          "You are now connected to the VPN. You may close this window.",
+		"error.title":                "Authentication Failed",
+		"error.intro":                "We couldn't authenticate your VPN connection.",
+		"error.details":              "Error Details:",
+		"error.close_button":         "Close Window",
+		"error.close_hint":           "Please close this window and try connecting again.",
+		"code.title":                 "Enter VPN Code",
+		"code.intro":                 "Enter the code shown by your VPN client to continue signing in.",
+		"page.continue":              "Continue",
+		"page.support":               "Need help? Contact support:",
+		"error.session_not_found":    "Session not found or expired. Please try connecting again.",
+		"error.invalid_callback":     "Invalid callback parameters",
+		"error.invalid_auth_url":     "Invalid auth URL",
+		"error.flow_not_initialized": "Authentication flow not initialized. Please try connecting again.",
+		"error.auth_failed_retry":    "Authentication failed. Please try again.",
+		"error.code_already_used":    "Authorization code already used. Please try connecting again.",
+		"error.notify_failed":        "Authentication succeeded, but the VPN server could not be notified. Please try connecting again.",
+		"code.invalid_request":       "Invalid request.",
+		"error.acr_not_met":          "Your sign-in did not use the required verification method (such as a one-time code). Please reconnect and complete all sign-in steps.",
+		"error.auth_too_old":         "Your sign-in is too old. Please sign in again and reconnect.",
+		"error.login_too_slow":       "Your login took too long. Please reconnect the VPN and try again.",
+		"code.missing":               "Please enter the code shown by your VPN client.",
+		"code.not_found":             "Code not found or expired. Please check the code or try connecting again.",
+		"error.auth_failed":          "Authentication failed",
+		"error.auth_failed_detail":   "Authentication failed: %s",
+	},
+	"de": {
+		"success.title":              "Authentifizierung erfolgreich",
+		"success.heading":            "Authentifizierung erfolgreich!",
+		"success.establishing":       "Ihre VPN-Verbindung wird jetzt hergestellt.",
+		"success.login_code":         "Anmeldecode:",
+		"success.close_hint":         "Sie können dieses Fenster schließen und zu Ihrem VPN-Client zurückkehren.",
+		"success.redirecting":        "Sie werden in Kürze weitergeleitet.",
+		"success.autoclose":          "Dieses Fenster wird automatisch geschlossen.",
+		"success.connected":          "Sie sind jetzt mit dem VPN verbunden. Sie können dieses Fenster schließen.",
+		"error.title":                "Authentifizierung fehlgeschlagen",
+		"error.intro":                "Ihre VPN-Verbindung konnte nicht authentifiziert werden.",
+		"error.details":              "Fehlerdetails:",
+		"error.close_button":         "Fenster schließen",
+		"error.close_hint":           "Bitte schließen Sie dieses Fenster und versuchen Sie erneut, eine Verbindung herzustellen.",
+		"code.title":                 "VPN-Code eingeben",
+		"code.intro":                 "Geben Sie den von Ihrem VPN-Client angezeigten Code ein, um mit der Anmeldung fortzufahren.",
+		"page.continue":              "Weiter",
+		"page.support":               "Benötigen Sie Hilfe? Kontaktieren Sie den Support:",
+		"error.session_not_found":    "Sitzung nicht gefunden oder abgelaufen. Bitte versuchen Sie erneut, eine Verbindung herzustellen.",
+		"error.invalid_callback":     "Ungültige Callback-Parameter",
+		"error.invalid_auth_url":     "Ungültige Anmelde-URL",
+		"error.flow_not_initialized": "Anmeldevorgang nicht initialisiert. Bitte versuchen Sie erneut, eine Verbindung herzustellen.",
+		"error.auth_failed_retry":    "Authentifizierung fehlgeschlagen. Bitte versuchen Sie es erneut.",
+		"error.code_already_used":    "Autorisierungscode bereits verwendet. Bitte versuchen Sie erneut, eine Verbindung herzustellen.",
+		"error.notify_failed":        "Authentifizierung erfolgreich, aber der VPN-Server konnte nicht benachrichtigt werden. Bitte versuchen Sie erneut, eine Verbindung herzustellen.",
+		"code.invalid_request":       "Ungültige Anfrage.",
+		"error.acr_not_met":          "Bei Ihrer Anmeldung wurde nicht die erforderliche Bestätigungsmethode (z. B. ein Einmalcode) verwendet. Bitte verbinden Sie sich erneut und schließen Sie alle Anmeldeschritte ab.",
+		"error.auth_too_old":         "Ihre Anmeldung ist zu alt. Bitte melden Sie sich erneut an und verbinden Sie sich neu.",
+		"error.login_too_slow":       "Ihre Anmeldung hat zu lange gedauert. Bitte verbinden Sie das VPN erneut und versuchen Sie es noch einmal.",
+		"code.missing":               "Bitte geben Sie den von Ihrem VPN-Client angezeigten Code ein.",
+		"code.not_found":             "Code nicht gefunden oder abgelaufen. Bitte prüfen Sie den Code oder versuchen Sie erneut, eine Verbindung herzustellen.",
+		"error.auth_failed":          "Authentifizierung fehlgeschlagen",
+		"error.auth_failed_detail":   "Authentifizierung fehlgeschlagen: %s",
+	},
+	"es": {
+		"success.title":              "Autenticación correcta",
+		"success.heading":            "¡Autenticación correcta!",
+		"success.establishing":       "Se está estableciendo su conexión VPN.",
+		"success.login_code":         "Código de inicio de sesión:",
+		"success.close_hint":         "Puede cerrar esta ventana y volver a su cliente VPN.",
+		"success.redirecting":        "Será redirigido en breve.",
+		"success.autoclose":          "Esta ventana se cerrará automáticamente.",
+		"success.connected":          "Ya está conectado a la VPN. Puede cerrar esta ventana.",
+		"error.title":                "Error de autenticación",
+		"error.intro":                "No hemos podido autenticar su conexión VPN.",
+		"error.details":              "Detalles del error:",
+		"error.close_button":         "Cerrar ventana",
+		"error.close_hint":           "Cierre esta ventana e intente conectarse de nuevo.",
+		"code.title":                 "Introducir código VPN",
+		"code.intro":                 "Introduzca el código que muestra su cliente VPN para continuar con el inicio de sesión.",
+		"page.continue":              "Continuar",
+		"page.support":               "¿Necesita ayuda? Contacte con soporte:",
+		"error.session_not_found":    "Sesión no encontrada o caducada. Intente conectarse de nuevo.",
+		"error.invalid_callback":     "Parámetros de retorno no válidos",
+		"error.invalid_auth_url":     "URL de autenticación no válida",
+		"error.flow_not_initialized": "Flujo de autenticación no inicializado. Intente conectarse de nuevo.",
+		"error.auth_failed_retry":    "Error de autenticación. Inténtelo de nuevo.",
+		"error.code_already_used":    "El código de autorización ya se ha utilizado. Intente conectarse de nuevo.",
+		"error.notify_failed":        "La autenticación se ha completado, pero no se ha podido notificar al servidor VPN. Intente conectarse de nuevo.",
+		"code.invalid_request":       "Solicitud no válida.",
+		"error.acr_not_met":          "Su inicio de sesión no utilizó el método de verificación requerido (como un código de un solo uso). Vuelva a conectarse y complete todos los pasos de inicio de sesión.",
+		"error.auth_too_old":         "Su inicio de sesión es demasiado antiguo. Inicie sesión de nuevo y vuelva a conectarse.",
+		"error.login_too_slow":       "Su inicio de sesión ha tardado demasiado. Vuelva a conectar la VPN e inténtelo de nuevo.",
+		"code.missing":               "Introduzca el código que muestra su cliente VPN.",
+		"code.not_found":             "Código no encontrado o caducado. Compruebe el código o intente conectarse de nuevo.",
+		"error.auth_failed":          "Error de autenticación",
+		"error.auth_failed_detail":   "Error de autenticación: %s",
+	},
+	"fr": {
+		"success.title":              "Authentification réussie",
+		"success.heading":            "Authentification réussie !",
+		"success.establishing":       "Votre connexion VPN est en cours d'établissement.",
+		"success.login_code":         "Code de connexion :",
+		"success.close_hint":         "Vous pouvez fermer cette fenêtre et revenir à votre client VPN.",
+		"success.redirecting":        "Vous allez être redirigé dans un instant.",
+		"success.autoclose":          "Cette fenêtre va se fermer automatiquement.",
+		"success.connected":          "Vous êtes maintenant connecté au VPN. Vous pouvez fermer cette fenêtre.",
+		"error.title":                "Échec de l'authentification",
+		"error.intro":                "Nous n'avons pas pu authentifier votre connexion VPN.",
+		"error.details":              "Détails de l'erreur :",
+		"error.close_button":         "Fermer la fenêtre",
+		"error.close_hint":           "Veuillez fermer cette fenêtre et réessayer de vous connecter.",
+		"code.title":                 "Saisir le code VPN",
+		"code.intro":                 "Saisissez le code affiché par votre client VPN pour poursuivre la connexion.",
+		"page.continue":              "Continuer",
+		"page.support":               "Besoin d'aide ? Contactez le support :",
+		"error.session_not_found":    "Session introuvable ou expirée. Veuillez réessayer de vous connecter.",
+		"error.invalid_callback":     "Paramètres de rappel non valides",
+		"error.invalid_auth_url":     "URL d'authentification non valide",
+		"error.flow_not_initialized": "Processus d'authentification non initialisé. Veuillez réessayer de vous connecter.",
+		"error.auth_failed_retry":    "Échec de l'authentification. Veuillez réessayer.",
+		"error.code_already_used":    "Code d'autorisation déjà utilisé. Veuillez réessayer de vous connecter.",
+		"error.notify_failed":        "Authentification réussie, mais le serveur VPN n'a pas pu être notifié. Veuillez réessayer de vous connecter.",
+		"code.invalid_request":       "Requête non valide.",
+		"error.acr_not_met":          "Votre connexion n'a pas utilisé la méthode de vérification requise (comme un code à usage unique). Veuillez vous reconnecter et effectuer toutes les étapes de connexion.",
+		"error.auth_too_old":         "Votre connexion est trop ancienne. Veuillez vous reconnecter puis relancer la connexion VPN.",
+		"error.login_too_slow":       "Votre connexion a pris trop de temps. Veuillez reconnecter le VPN et réessayer.",
+		"code.missing":               "Veuillez saisir le code affiché par votre client VPN.",
+		"code.not_found":             "Code introuvable ou expiré. Veuillez vérifier le code ou réessayer de vous connecter.",
+		"error.auth_failed":          "Échec de l'authentification",
+		"error.auth_failed_detail":   "Échec de l'authentification : %s",
+	},
+}
+
+// translate returns the text of message id in lang, falling back to
+// English and then to id itself, so custom templates can pass their own
+// text. args, if any, fill in the text's format verbs.
+func translate(lang, id string, args ...any) string {
+	text, ok := translations[lang][id]
+	if !ok {
+		text, ok = translations[config.DefaultPageLanguage][id]
+	}
+	if !ok {
+		text = id
+	}
+	if len(args) > 0 {
+		return fmt.Sprintf(text, args...)
+	}
+	return text
+}
+
+// pageLanguage returns the page language for r: the most preferred
+// language of its Accept-Language header that has translations, or
+// httpserver.default_language.
+func (s *Server) pageLanguage(r *http.Request) string {
+	return negotiateLanguage(r.Header.Get("Accept-Language"), s.defaultLanguage)
+}
+
+// negotiateLanguage picks the supported language with the highest quality
+// in an Accept-Language header such as "fr-CH, fr;q=0.9, en;q=0.8". Only
+// the primary subtag is matched, so "de-AT" selects "de". fallback is
+// returned when nothing matches.
+func negotiateLanguage(header, fallback string) string {
+	best, bestQ := fallback, 0.0
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		primary, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		if q > bestQ && slices.Contains(config.PageLanguages, primary) {
+			best, bestQ = primary, q
+		}
+	}
+	return best
+}
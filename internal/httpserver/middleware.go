@@ -4,15 +4,20 @@ import (
 	"log/slog"
 	"net"
 	"net/http"
+	"net/netip"
 	"runtime/debug"
+	"strings"
 	"sync"
 	"time"
 
 	"golang.org/x/time/rate"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
 )
 
-// loggingMiddleware logs HTTP requests
-func loggingMiddleware(next http.Handler) http.Handler {
+// loggingMiddleware logs HTTP requests. client_ip differs from remote_addr
+// when the request came through one of trustedProxies.
+func loggingMiddleware(next http.Handler, trustedProxies []netip.Prefix) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
 
@@ -20,6 +25,7 @@ func loggingMiddleware(next http.Handler) http.Handler {
 			"method", sanitizeLog(r.Method),
 			"path", sanitizeLog(r.URL.Path),
 			"remote_addr", sanitizeLog(r.RemoteAddr),
+			"client_ip", sanitizeLog(extractIP(r, trustedProxies)),
 			"user_agent", sanitizeLog(r.Header.Get("User-Agent")),
 		)
 
@@ -54,8 +60,17 @@ func recoveryMiddleware(next http.Handler) http.Handler {
 type ipEntry struct {
 	limiter  *rate.Limiter
 	lastSeen time.Time
+	level    int // reputation penalty the limiter is set to
 }
 
+// Rate limiter defaults, used for zero values in listen.rate_limit.
+const (
+	defaultRateLimit        rate.Limit = 10
+	defaultRateLimitBurst              = 50
+	defaultRateLimitTTL                = 5 * time.Minute
+	defaultRateLimitMaxSize            = 10000
+)
+
 // IPRateLimiter implements per-IP rate limiting with TTL-based eviction.
 type IPRateLimiter struct {
 	mu       sync.Mutex
@@ -64,30 +79,61 @@ type IPRateLimiter struct {
 	burst    int
 	ttl      time.Duration // entries are evicted after this duration of inactivity
 	maxSize  int           // maximum number of tracked IPs
+	stop     chan struct{}
+	evicting sync.Once // starts evictLoop on first use
+	stopOnce sync.Once
 }
 
-func newIPRateLimiter(r rate.Limit, b int) *IPRateLimiter {
+// newIPRateLimiter creates a limiter from listen.rate_limit, using the
+// defaults for zero values. Stale entries are evicted in the background
+// from the first request on; call Stop to end that goroutine.
+func newIPRateLimiter(cfg config.RateLimitConfig) *IPRateLimiter {
 	rl := &IPRateLimiter{
 		limiters: make(map[string]*ipEntry),
-		rate:     r,
-		burst:    b,
-		ttl:      5 * time.Minute,
-		maxSize:  10000,
+		rate:     rate.Limit(cfg.Rate),
+		burst:    cfg.Burst,
+		ttl:      time.Duration(cfg.TTL) * time.Second,
+		maxSize:  cfg.MaxSize,
+		stop:     make(chan struct{}),
+	}
+	if rl.rate == 0 {
+		rl.rate = defaultRateLimit
+	}
+	if rl.burst == 0 {
+		rl.burst = defaultRateLimitBurst
+	}
+	if rl.ttl == 0 {
+		rl.ttl = defaultRateLimitTTL
+	}
+	if rl.maxSize == 0 {
+		rl.maxSize = defaultRateLimitMaxSize
 	}
-
-	// Start background eviction goroutine
-	go rl.evictLoop()
 
 	return rl
 }
 
-func (i *IPRateLimiter) getLimiter(ip string) *rate.Limiter {
+// Stop ends the background eviction. It is safe to call more than once.
+func (i *IPRateLimiter) Stop() {
+	i.stopOnce.Do(func() { close(i.stop) })
+}
+
+// getLimiter returns the limiter for ip, tightened for the given reputation
+// penalty level (0 for the base rate and burst).
+func (i *IPRateLimiter) getLimiter(ip string, level int) *rate.Limiter {
+	i.evicting.Do(func() { go i.evictLoop() })
+
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
 	entry, exists := i.limiters[ip]
 	if exists {
 		entry.lastSeen = time.Now()
+		if entry.level != level {
+			r, b := penalize(i.rate, i.burst, level)
+			entry.limiter.SetLimit(r)
+			entry.limiter.SetBurst(b)
+			entry.level = level
+		}
 		return entry.limiter
 	}
 
@@ -96,10 +142,11 @@ func (i *IPRateLimiter) getLimiter(ip string) *rate.Limiter {
 		i.evictOldest()
 	}
 
-	limiter := rate.NewLimiter(i.rate, i.burst)
+	limiter := rate.NewLimiter(penalize(i.rate, i.burst, level))
 	i.limiters[ip] = &ipEntry{
 		limiter:  limiter,
 		lastSeen: time.Now(),
+		level:    level,
 	}
 
 	return limiter
@@ -110,7 +157,13 @@ func (i *IPRateLimiter) evictLoop() {
 	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
 
-	for range ticker.C {
+	for {
+		select {
+		case <-i.stop:
+			return
+		case <-ticker.C:
+		}
+
 		i.mu.Lock()
 		now := time.Now()
 		for ip, entry := range i.limiters {
@@ -139,16 +192,27 @@ func (i *IPRateLimiter) evictOldest() {
 	}
 }
 
-// Global rate limiter: 10 requests per second per IP, burst of 50
-var globalLimiter = newIPRateLimiter(10, 50)
+// rateLimitMiddleware implements rate limiting keyed by client IP (see
+// extractIP for how trustedProxies are used), or by login session on
+// per_session routes of the rate limits returned by limits, which are looked
+// up for each request so a reload can replace them. IPs with recent
+// authentication failures in rep get a tighter limit; rep may be nil.
+// Requests whose path exactly matches one of exemptPaths bypass the limiter.
+func rateLimitMiddleware(next http.Handler, limits func() *rateLimits, trustedProxies []netip.Prefix, rep *reputation, exemptPaths ...string) http.Handler {
+	exempt := make(map[string]bool, len(exemptPaths))
+	for _, p := range exemptPaths {
+		exempt[p] = true
+	}
 
-// rateLimitMiddleware implements rate limiting
-func rateLimitMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ip := extractIP(r)
-		limiter := globalLimiter.getLimiter(ip)
+		if exempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
 
-		if !limiter.Allow() {
+		ip := extractIP(r, trustedProxies)
+		limiter, key := limits().limiterFor(r, ip)
+		if !limiter.getLimiter(key, rep.level(ip)).Allow() {
 			slog.Warn("rate limit exceeded", // #nosec G706 -- values sanitized via sanitizeLog
 				"ip", sanitizeLog(ip),
 				"path", sanitizeLog(r.URL.Path),
@@ -161,17 +225,97 @@ func rateLimitMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// allowListMiddleware rejects with 403 requests whose client IP (see
+// extractIP) is outside allowed, or outside healthAllowed for /health and
+// /readyz. An empty list allows every client.
+func allowListMiddleware(next http.Handler, allowed, healthAllowed, trustedProxies []netip.Prefix) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		prefixes := allowed
+		if r.URL.Path == "/health" || r.URL.Path == "/readyz" {
+			prefixes = healthAllowed
+		}
+		if len(prefixes) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ip := extractIP(r, trustedProxies)
+		if !containsIP(prefixes, ip) {
+			slog.Warn("client IP not allowed", // #nosec G706 -- values sanitized via sanitizeLog
+				"ip", sanitizeLog(ip),
+				"path", sanitizeLog(r.URL.Path),
+			)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
 // extractIP extracts the client IP from the request.
-// Only uses RemoteAddr by default to prevent spoofing via X-Forwarded-For.
-// If this service is behind a trusted reverse proxy, configure the proxy
-// to set X-Real-IP and update this function accordingly.
-func extractIP(r *http.Request) string {
+// Uses RemoteAddr unless it is one of trustedProxies or a
+// listen.http_socket peer, so clients cannot spoof their address via
+// X-Forwarded-For. Behind a trusted proxy it takes the rightmost
+// X-Forwarded-For entry that is not itself a trusted proxy, or X-Real-IP if
+// X-Forwarded-For is absent.
+func extractIP(r *http.Request, trustedProxies []netip.Prefix) string {
 	ip, _, _ := net.SplitHostPort(r.RemoteAddr)
+	if !isUnixPeer(r.RemoteAddr) && (len(trustedProxies) == 0 || !containsIP(trustedProxies, ip)) {
+		return ip
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				// Malformed entry: everything to its left is untrustworthy
+				return ip
+			}
+			ip = addr.Unmap().String()
+			if !containsIP(trustedProxies, ip) {
+				return ip
+			}
+		}
+		// All hops are trusted proxies; the leftmost is the best guess
+		return ip
+	}
+
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIP != "" {
+		if addr, err := netip.ParseAddr(realIP); err == nil {
+			return addr.Unmap().String()
+		}
+	}
 	return ip
 }
 
-// securityHeadersMiddleware adds security headers to responses
-func securityHeadersMiddleware(next http.Handler) http.Handler {
+// isUnixPeer reports whether remoteAddr belongs to a connection on
+// listen.http_socket. Such peers have no address and are always the local
+// reverse proxy, so their forwarded headers are trusted like those of a
+// trusted proxy.
+func isUnixPeer(remoteAddr string) bool {
+	return remoteAddr == "" || remoteAddr == "@"
+}
+
+// containsIP reports whether ip is within one of prefixes.
+func containsIP(prefixes []netip.Prefix, ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// securityHeadersMiddleware adds security headers to responses, with csp
+// as the Content-Security-Policy
+func securityHeadersMiddleware(next http.Handler, csp string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Prevent clickjacking
 		w.Header().Set("X-Frame-Options", "DENY")
@@ -186,7 +330,7 @@ func securityHeadersMiddleware(next http.Handler) http.Handler {
 		w.Header().Set("Referrer-Policy", "no-referrer")
 
 		// Content Security Policy
-		w.Header().Set("Content-Security-Policy", "default-src 'self'; style-src 'self' 'unsafe-inline'")
+		w.Header().Set("Content-Security-Policy", csp)
 
 		// HTTPS strict transport security (if using TLS)
 		if r.TLS != nil {
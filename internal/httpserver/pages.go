@@ -1,14 +1,119 @@
 package httpserver
 
 import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
 )
 
-// renderSuccess renders the success page
-func (s *Server) renderSuccess(w http.ResponseWriter, message string) {
-	data := map[string]string{
-		"Message": message,
+// pageTemplates are the templates httpserver.templates_dir may replace.
+// branding.html defines the "logo" and "support" blocks the pages include.
+var pageTemplates = []string{"success.html", "error.html", "code.html", "branding.html"}
+
+// loadTemplates parses the embedded page templates and replaces each one
+// that has a file of the same name in dir. Missing files keep the embedded
+// template. An empty dir uses only the embedded templates.
+func loadTemplates(dir string) (*template.Template, error) {
+	templates, err := template.New("pages").Funcs(template.FuncMap{"t": translate}).ParseFS(templatesFS, "templates/*.html")
+	if err != nil {
+		return nil, err
+	}
+	if dir == "" {
+		return templates, nil
+	}
+
+	for _, name := range pageTemplates {
+		path := filepath.Join(dir, name)
+		data, err := os.ReadFile(path) // #nosec G304 -- path from trusted config
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read template: %w", err)
+		}
+		if _, err := templates.New(name).Parse(string(data)); err != nil {
+			return nil, fmt.Errorf("failed to parse template %s: %w", path, err)
+		}
+		slog.Info("using custom page template", "file", path)
+	}
+	return templates, nil
+}
+
+// successPageDelay is how long the success page stays up before it
+// redirects to httpserver.success_redirect_url or closes itself, so the
+// user can read it.
+const successPageDelay = 3 * time.Second
+
+// autoCloseScriptPath serves the script that closes the success page when
+// httpserver.success_autoclose is set. It is served rather than inlined so
+// the Content-Security-Policy does not have to allow inline scripts.
+const autoCloseScriptPath = "/success-autoclose.js"
+
+// autoCloseFallbackDelay is how long the success page waits before the
+// meta refresh that stands in for a window.close() the browser refused.
+// It is longer than successPageDelay so the script gets to run first.
+const autoCloseFallbackDelay = successPageDelay + time.Second
+
+// autoCloseScript closes the success page after successPageDelay. Browsers
+// only let a script close a window that a script opened, so it may do
+// nothing; without httpserver.success_redirect_url the page then refreshes
+// to a blank page after autoCloseFallbackDelay instead.
+var autoCloseScript = fmt.Sprintf("setTimeout(function () { window.close(); }, %d);\n", successPageDelay.Milliseconds())
+
+// handleAutoCloseScript serves autoCloseScript.
+func handleAutoCloseScript(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	_, _ = io.WriteString(w, autoCloseScript)
+}
+
+// contentSecurityPolicy returns the Content-Security-Policy for the pages,
+// allowing images from the origin of httpserver.branding.logo_url.
+func contentSecurityPolicy(logoURL string) string {
+	csp := "default-src 'self'; style-src 'self' 'unsafe-inline'"
+	if u, err := url.Parse(logoURL); err == nil && u.Scheme != "" && u.Host != "" {
+		csp += "; img-src 'self' " + u.Scheme + "://" + u.Host
+	}
+	return csp
+}
+
+// pageData adds the page language and the httpserver.branding fields to
+// the data of a page.
+func pageData(lang string, branding config.BrandingConfig, data map[string]string) map[string]string {
+	data["Lang"] = lang
+	data["CompanyName"] = branding.CompanyName
+	data["LogoURL"] = branding.LogoURL
+	data["SupportEmail"] = branding.SupportEmail
+	return data
+}
+
+// renderSuccess renders the success page in the language r asks for. A
+// non-empty correlationCode is shown so the user can match the page to the
+// login in their VPN client. The page redirects or closes itself if
+// httpserver.success_redirect_url or success_autoclose is set. message is
+// a message ID (see translations).
+func (s *Server) renderSuccess(w http.ResponseWriter, r *http.Request, message, correlationCode string) {
+	lang := s.pageLanguage(r)
+	data := pageData(lang, s.branding, map[string]string{
+		"Message":         translate(lang, message),
+		"CorrelationCode": correlationCode,
+		"RedirectURL":     s.successRedirectURL,
+		"RedirectDelay":   strconv.Itoa(int(successPageDelay.Seconds())),
+	})
+	if s.successAutoClose {
+		data["AutoClose"] = "true"
+		data["AutoCloseScript"] = autoCloseScriptPath
+		data["AutoCloseFallbackDelay"] = strconv.Itoa(int(autoCloseFallbackDelay.Seconds()))
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -20,11 +125,13 @@ func (s *Server) renderSuccess(w http.ResponseWriter, message string) {
 	}
 }
 
-// renderError renders the error page
-func (s *Server) renderError(w http.ResponseWriter, errMsg string) {
-	data := map[string]string{
-		"Error": errMsg,
-	}
+// renderError renders the error page in the language r asks for, showing
+// message errID (see translations) filled in with args
+func (s *Server) renderError(w http.ResponseWriter, r *http.Request, errID string, args ...any) {
+	lang := s.pageLanguage(r)
+	data := pageData(lang, s.branding, map[string]string{
+		"Error": translate(lang, errID, args...),
+	})
 
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(http.StatusBadRequest)
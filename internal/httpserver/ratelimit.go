@@ -0,0 +1,98 @@
+package httpserver
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
+)
+
+// rateLimits is the per-IP rate limit of listen.rate_limit together with
+// its per-route overrides.
+type rateLimits struct {
+	base   *IPRateLimiter
+	routes []routeLimit // longest pattern first
+
+	// sessionKey returns the ID of the pending login named in r's state,
+	// or "" if there is none; used by per_session routes
+	sessionKey func(r *http.Request) string
+}
+
+// routeLimit is a rate limit override for the requests matching pattern.
+type routeLimit struct {
+	pattern    string
+	limiter    *IPRateLimiter
+	perSession bool
+}
+
+// newRateLimits creates the limiters for cfg. Route overrides inherit the
+// rate and burst they leave at zero, and the TTL and size of the default
+// limit.
+func newRateLimits(cfg config.RateLimitConfig) *rateLimits {
+	l := &rateLimits{base: newIPRateLimiter(cfg)}
+	for pattern, rt := range cfg.Routes {
+		routeCfg := config.RateLimitConfig{Rate: cfg.Rate, Burst: cfg.Burst, TTL: cfg.TTL, MaxSize: cfg.MaxSize}
+		if rt.Rate != 0 {
+			routeCfg.Rate = rt.Rate
+		}
+		if rt.Burst != 0 {
+			routeCfg.Burst = rt.Burst
+		}
+		l.routes = append(l.routes, routeLimit{
+			pattern:    pattern,
+			limiter:    newIPRateLimiter(routeCfg),
+			perSession: rt.PerSession,
+		})
+	}
+	slices.SortFunc(l.routes, func(a, b routeLimit) int {
+		return len(b.pattern) - len(a.pattern)
+	})
+	return l
+}
+
+// limiterFor returns the limiter and bucket key for r, sent from ip. A
+// pattern ending in "/" matches every path below it; any other
+// pattern matches only itself.
+func (l *rateLimits) limiterFor(r *http.Request, ip string) (*IPRateLimiter, string) {
+	for _, rt := range l.routes {
+		if r.URL.Path != rt.pattern && !(strings.HasSuffix(rt.pattern, "/") && strings.HasPrefix(r.URL.Path, rt.pattern)) {
+			continue
+		}
+		if rt.perSession && l.sessionKey != nil {
+			if id := l.sessionKey(r); id != "" {
+				return rt.limiter, "session:" + id
+			}
+		}
+		return rt.limiter, ip
+	}
+	return l.base, ip
+}
+
+// Stop ends the background eviction of all limiters.
+func (l *rateLimits) Stop() {
+	l.base.Stop()
+	for _, rt := range l.routes {
+		rt.limiter.Stop()
+	}
+}
+
+// rateLimitSessionKey returns the ID of the pending login whose state is
+// in the /auth/<state> path or the /callback query, or "" if none matches.
+// Only states of sessions held by this instance count, so clients cannot
+// mint new buckets by inventing states and the limiter never waits on the
+// shared store; logins of other instances fall back to the per-IP bucket.
+func (s *Server) rateLimitSessionKey(r *http.Request) string {
+	if s.sessionMgr == nil {
+		return ""
+	}
+	state := r.URL.Query().Get("state")
+	if strings.HasPrefix(r.URL.Path, "/auth/") {
+		state = strings.TrimPrefix(r.URL.Path, "/auth/")
+	}
+	if state == "" {
+		return ""
+	}
+	id, _ := s.sessionMgr.LocalIDByState(state)
+	return id
+}
@@ -0,0 +1,51 @@
+package httpserver
+
+import "sync/atomic"
+
+// Readiness tracks whether the daemon can serve authentication requests.
+// The daemon marks each dependency ready as it comes up and marks the
+// daemon as shutting down before it starts draining, so /readyz lets load
+// balancers stop routing traffic before connections are closed.
+//
+// A nil *Readiness is never ready.
+type Readiness struct {
+	oidc         atomic.Bool
+	ipc          atomic.Bool
+	shuttingDown atomic.Bool
+}
+
+// NewReadiness creates a readiness state with nothing ready yet.
+func NewReadiness() *Readiness {
+	return &Readiness{}
+}
+
+// SetOIDCReady records that OIDC provider discovery succeeded.
+func (r *Readiness) SetOIDCReady() {
+	r.oidc.Store(true)
+}
+
+// SetIPCReady records that the IPC socket is listening.
+func (r *Readiness) SetIPCReady() {
+	r.ipc.Store(true)
+}
+
+// SetShuttingDown records that graceful shutdown has started.
+func (r *Readiness) SetShuttingDown() {
+	r.shuttingDown.Store(true)
+}
+
+// Ready reports whether the daemon is ready and, if not, why.
+func (r *Readiness) Ready() (bool, string) {
+	switch {
+	case r == nil:
+		return false, "readiness not tracked"
+	case r.shuttingDown.Load():
+		return false, "shutting down"
+	case !r.oidc.Load():
+		return false, "OIDC provider not initialized"
+	case !r.ipc.Load():
+		return false, "IPC socket not listening"
+	default:
+		return true, ""
+	}
+}
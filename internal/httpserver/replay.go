@@ -0,0 +1,72 @@
+package httpserver
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// usedCodeTTL is how long a redeemed authorization code is remembered.
+// Keycloak codes are valid for about a minute, so this comfortably covers
+// any replay the identity provider would still accept.
+const usedCodeTTL = 10 * time.Minute
+
+// maxUsedCodes bounds the number of remembered codes.
+const maxUsedCodes = 10000
+
+// codeTracker remembers hashes of recently presented authorization codes so
+// a replayed code can be rejected with a clear message before it reaches
+// the token endpoint. Only SHA-256 hashes are stored.
+type codeTracker struct {
+	mu   sync.Mutex
+	seen map[[sha256.Size]byte]time.Time // code hash -> expiry
+	ttl  time.Duration
+	now  func() time.Time
+}
+
+func newCodeTracker(ttl time.Duration) *codeTracker {
+	return &codeTracker{
+		seen: make(map[[sha256.Size]byte]time.Time),
+		ttl:  ttl,
+		now:  time.Now,
+	}
+}
+
+// markUsed records code and reports whether it was already presented within
+// the TTL.
+func (c *codeTracker) markUsed(code string) bool {
+	key := sha256.Sum256([]byte(code))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if expiresAt, ok := c.seen[key]; ok && now.Before(expiresAt) {
+		return true
+	}
+
+	if len(c.seen) >= maxUsedCodes {
+		c.prune(now)
+	}
+	c.seen[key] = now.Add(c.ttl)
+	return false
+}
+
+// prune removes expired codes and, if still at capacity, the code closest
+// to expiry. Must be called with mu held.
+func (c *codeTracker) prune(now time.Time) {
+	var oldestKey [sha256.Size]byte
+	var oldest time.Time
+	for key, expiresAt := range c.seen {
+		if !now.Before(expiresAt) {
+			delete(c.seen, key)
+			continue
+		}
+		if oldest.IsZero() || expiresAt.Before(oldest) {
+			oldestKey, oldest = key, expiresAt
+		}
+	}
+	if len(c.seen) >= maxUsedCodes {
+		delete(c.seen, oldestKey)
+	}
+}
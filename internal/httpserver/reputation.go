@@ -0,0 +1,129 @@
+package httpserver
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// reputationFactor is how much each penalty level divides an IP's
+	// rate and burst by.
+	reputationFactor = 4
+
+	// maxReputationLevel caps the penalty: 10/s divided by 4^4 is about
+	// two requests per minute.
+	maxReputationLevel = 4
+
+	// maxReputationIPs bounds the number of IPs with recorded failures.
+	maxReputationIPs = 10000
+)
+
+// reputation tracks recent authentication failures per IP and turns them
+// into a penalty level for the rate limiter. Failures expire after window,
+// so the penalty relaxes on its own once an IP stops failing.
+type reputation struct {
+	threshold int
+	window    time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	failures map[string][]time.Time // oldest first
+}
+
+// newReputation creates a reputation that starts penalizing an IP once it
+// has threshold failures within window.
+func newReputation(threshold int, window time.Duration) *reputation {
+	return &reputation{
+		threshold: threshold,
+		window:    window,
+		now:       time.Now,
+		failures:  make(map[string][]time.Time),
+	}
+}
+
+// recordFailure counts an authentication failure against ip. It is a no-op
+// on a nil reputation or an empty ip.
+func (r *reputation) recordFailure(ip string) {
+	if r == nil || ip == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	times := r.prune(ip, now)
+	if times == nil && len(r.failures) >= maxReputationIPs {
+		r.evict(now)
+	}
+
+	// Failures beyond the maximum penalty add nothing
+	if len(times) >= r.threshold+maxReputationLevel-1 {
+		times = times[1:]
+	}
+	r.failures[ip] = append(times, now)
+}
+
+// level returns the penalty level of ip: 0 below threshold recent
+// failures, then one more per failure up to maxReputationLevel.
+func (r *reputation) level(ip string) int {
+	if r == nil {
+		return 0
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := len(r.prune(ip, r.now()))
+	if n < r.threshold {
+		return 0
+	}
+	return min(n-r.threshold+1, maxReputationLevel)
+}
+
+// prune drops the expired failures of ip and returns the rest. Must be
+// called with mu held.
+func (r *reputation) prune(ip string, now time.Time) []time.Time {
+	times := r.failures[ip]
+	i := 0
+	for i < len(times) && now.Sub(times[i]) >= r.window {
+		i++
+	}
+	if i == len(times) {
+		delete(r.failures, ip)
+		return nil
+	}
+	times = times[i:]
+	r.failures[ip] = times
+	return times
+}
+
+// evict makes room for a new IP by dropping expired entries, or the IP
+// whose latest failure is oldest if none have expired. Must be called with
+// mu held.
+func (r *reputation) evict(now time.Time) {
+	var oldestIP string
+	var oldest time.Time
+	for ip := range r.failures {
+		times := r.prune(ip, now)
+		if times == nil {
+			continue
+		}
+		if latest := times[len(times)-1]; oldestIP == "" || latest.Before(oldest) {
+			oldestIP = ip
+			oldest = latest
+		}
+	}
+	if len(r.failures) >= maxReputationIPs {
+		delete(r.failures, oldestIP)
+	}
+}
+
+// penalize returns the rate and burst for an IP at the given penalty level.
+func penalize(r rate.Limit, burst, level int) (rate.Limit, int) {
+	for range level {
+		r /= reputationFactor
+		burst /= reputationFactor
+	}
+	return r, max(burst, 1)
+}
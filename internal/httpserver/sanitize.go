@@ -1,9 +1,48 @@
 package httpserver
 
-import "github.com/al-bashkir/openvpn-keycloak-auth/internal/logsanitize"
+import (
+	"strings"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/logsanitize"
+)
 
 // sanitizeLog sanitizes a string for safe inclusion in structured log output
 // before logging external HTTP input.
 func sanitizeLog(s string) string {
 	return logsanitize.Sanitize(s)
 }
+
+// maxErrorDescriptionLen bounds the OIDC error description shown on the
+// error page.
+const maxErrorDescriptionLen = 200
+
+// errorDescriptionPunctuation is the punctuation kept by
+// displayErrorDescription besides ASCII letters, digits and spaces.
+const errorDescriptionPunctuation = ".,:;'-_()!?"
+
+// displayErrorDescription prepares the error or error_description of an
+// OIDC error response for the error page. Both come from the callback URL,
+// which anyone can craft, so only ASCII letters, digits, spaces and common
+// punctuation are kept, other whitespace becomes a space, and the text is
+// truncated to maxErrorDescriptionLen.
+func displayErrorDescription(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == ' ',
+			strings.ContainsRune(errorDescriptionPunctuation, r):
+			b.WriteRune(r)
+		case r == '\t' || r == '\n' || r == '\r':
+			b.WriteByte(' ')
+		}
+		if b.Len() > maxErrorDescriptionLen {
+			break
+		}
+	}
+
+	desc := strings.Join(strings.Fields(b.String()), " ")
+	if len(desc) > maxErrorDescriptionLen {
+		desc = strings.TrimSpace(desc[:maxErrorDescriptionLen]) + "..."
+	}
+	return desc
+}
@@ -5,13 +5,27 @@ import (
 	"context"
 	"crypto/tls"
 	"embed"
+	"fmt"
 	"html/template"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"golang.org/x/crypto/acme"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/audit"
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/authorizer"
 	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/metrics"
 	"github.com/al-bashkir/openvpn-keycloak-auth/internal/oidc"
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/openvpn"
 	"github.com/al-bashkir/openvpn-keycloak-auth/internal/session"
 )
 
@@ -20,40 +34,146 @@ var templatesFS embed.FS
 
 // Server is the HTTP server for handling OIDC callbacks and health checks
 type Server struct {
-	cfg          *config.Config
-	httpServer   *http.Server
-	mux          *http.ServeMux
-	templates    *template.Template
-	oidcProvider *oidc.Provider
-	sessionMgr   *session.Manager
+	httpServer *http.Server
+	mux        *http.ServeMux
+	templates  *template.Template
+	branding   config.BrandingConfig
+	// defaultLanguage is the page language when Accept-Language matches
+	// no translation
+	defaultLanguage string
+	// successRedirectURL and successAutoClose control what the success
+	// page does once it has been shown
+	successRedirectURL string
+	successAutoClose   bool
+	sessionMgr         *session.Manager
+	metrics            *metrics.Metrics
+	readiness          *Readiness
+	certs              *certReloader
+	audit              audit.Audit
+	listener           net.Listener // set by Listen; Start binds its own when nil
+	buildInfo          BuildInfo    // reported by /health
+
+	// challengeServer answers ACME HTTP-01 challenges when tls.acme is
+	// enabled; challengeListener is bound by Listen
+	challengeServer   *http.Server
+	challengeListener net.Listener
+
+	// trustedProxies is parsed from listen.trusted_proxies at NewServer
+	trustedProxies []netip.Prefix
+	usedCodes      *codeTracker
+
+	// callbacks counts /callback requests being handled, for Drain
+	callbacks atomic.Int64
+
+	// reputation tightens the rate limit for IPs with repeated
+	// authentication failures; nil when disabled
+	reputation *reputation
+
+	// mu guards cfg, providers, limits and authz, which are replaced by
+	// Reconfigure, and writer, which is replaced by SetWriter.
+	mu        sync.RWMutex
+	cfg       *config.Config
+	providers *oidc.Registry
+	writer    openvpn.Writer
+	limits    *rateLimits        // per-IP rate limits (listen.rate_limit)
+	authz     *authorizer.Client // auth.external_authorizer; nil when unset
 }
 
-// NewServer creates a new HTTP server
-func NewServer(cfg *config.Config, oidcProvider *oidc.Provider, sessionMgr *session.Manager) (*Server, error) {
+// defaultCipherSuites are the TLS 1.2 cipher suites used when
+// tls.cipher_suites is not set. TLS 1.3 suites are not configurable.
+var defaultCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+}
+
+// NewServer creates a new HTTP server.
+// m may be nil, in which case metrics are not recorded. readiness backs
+// /readyz; if nil, /readyz always reports not ready.
+func NewServer(cfg *config.Config, providers *oidc.Registry, sessionMgr *session.Manager, m *metrics.Metrics, readiness *Readiness) (*Server, error) {
 	// Parse templates
-	templates, err := template.ParseFS(templatesFS, "templates/*.html")
+	templates, err := loadTemplates(cfg.HTTPServer.TemplatesDir)
+	if err != nil {
+		return nil, err
+	}
+
+	trustedProxies, err := config.ParseTrustedProxies(cfg.Listen.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	allowedCIDRs, err := config.ParseCIDRs("listen.allowed_cidrs", cfg.Listen.AllowedCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	healthAllowedCIDRs, err := config.ParseCIDRs("listen.health_allowed_cidrs", cfg.Listen.HealthAllowedCIDRs)
 	if err != nil {
 		return nil, err
 	}
 
 	s := &Server{
-		cfg:          cfg,
-		mux:          http.NewServeMux(),
-		templates:    templates,
-		oidcProvider: oidcProvider,
-		sessionMgr:   sessionMgr,
+		cfg:       cfg,
+		mux:       http.NewServeMux(),
+		templates: templates,
+		branding:  cfg.HTTPServer.Branding,
+
+		defaultLanguage:    cfg.HTTPServer.DefaultLanguage,
+		successRedirectURL: cfg.HTTPServer.SuccessRedirectURL,
+		successAutoClose:   cfg.HTTPServer.SuccessAutoClose,
+		providers:          providers,
+		writer:             openvpn.FileWriter{},
+		sessionMgr:         sessionMgr,
+		metrics:            m,
+		readiness:          readiness,
+
+		trustedProxies: trustedProxies,
+		usedCodes:      newCodeTracker(usedCodeTTL),
+		limits:         newRateLimits(cfg.Listen.RateLimit),
+		authz:          newAuthorizer(cfg.Auth.ExternalAuthorizer),
+	}
+	s.limits.sessionKey = s.rateLimitSessionKey
+	if s.defaultLanguage == "" {
+		s.defaultLanguage = config.DefaultPageLanguage
+	}
+	if rep := cfg.HTTPServer.FailureReputation; rep.Enabled {
+		s.reputation = newReputation(rep.Threshold, time.Duration(rep.Window)*time.Second)
 	}
 
 	// Register routes
 	s.mux.HandleFunc("/callback", s.handleCallback)
 	s.mux.HandleFunc("/auth/", s.handleAuthRedirect)
 	s.mux.HandleFunc("/health", s.handleHealth)
+	s.mux.HandleFunc("/readyz", s.handleReady)
+	if cfg.Auth.EnableCRText {
+		s.mux.HandleFunc("/code", s.handleCode)
+	}
+	if cfg.HTTPServer.SuccessAutoClose {
+		s.mux.HandleFunc(autoCloseScriptPath, handleAutoCloseScript)
+	}
+	if cfg.HTTPServer.EnableAuthAPI {
+		s.mux.HandleFunc("/api/auth/start", s.handleAPIAuthStart)
+	}
+	if cfg.HTTPServer.EnableConfigAPI {
+		s.mux.HandleFunc("/api/config", s.handleAPIConfig)
+	}
+	if cfg.Observability.Metrics {
+		s.mux.HandleFunc("/metrics", s.handleMetrics)
+	}
+
+	// Scrapers poll /metrics frequently from a single IP; keep them out of
+	// the per-IP limiter unless explicitly configured otherwise.
+	var rateLimitExempt []string
+	if cfg.Observability.Metrics && !cfg.Observability.MetricsRateLimited {
+		rateLimitExempt = append(rateLimitExempt, "/metrics")
+	}
 
 	// Wrap with middleware
-	handler := loggingMiddleware(s.mux)
+	handler := loggingMiddleware(s.mux, trustedProxies)
 	handler = recoveryMiddleware(handler)
-	handler = rateLimitMiddleware(handler)
-	handler = securityHeadersMiddleware(handler)
+	handler = rateLimitMiddleware(handler, s.rateLimiters, trustedProxies, s.reputation, rateLimitExempt...)
+	// Disallowed clients are turned away before they use up a rate limit
+	handler = allowListMiddleware(handler, allowedCIDRs, healthAllowedCIDRs, trustedProxies)
+	handler = securityHeadersMiddleware(handler, contentSecurityPolicy(cfg.HTTPServer.Branding.LogoURL))
 
 	// Create HTTP server
 	s.httpServer = &http.Server{
@@ -66,39 +186,273 @@ func NewServer(cfg *config.Config, oidcProvider *oidc.Provider, sessionMgr *sess
 
 	// Configure TLS if enabled
 	if cfg.TLS.Enabled {
+		minVersion, err := config.ParseTLSMinVersion(cfg.TLS.MinVersion)
+		if err != nil {
+			return nil, err
+		}
+		cipherSuites, err := config.ParseCipherSuites(cfg.TLS.CipherSuites)
+		if err != nil {
+			return nil, err
+		}
+		if cipherSuites == nil {
+			cipherSuites = defaultCipherSuites
+		}
+
 		tlsConfig := &tls.Config{
-			MinVersion: tls.VersionTLS12,
-			CipherSuites: []uint16{
-				tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
-				tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
-				tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
-			},
+			MinVersion:   minVersion,
+			CipherSuites: cipherSuites,
 			// Note: PreferServerCipherSuites is deprecated since Go 1.21.
 			// The Go TLS stack handles cipher suite ordering automatically.
 		}
+
+		if cfg.TLS.ACME.Enabled {
+			m, err := newACMEManager(cfg.TLS.ACME)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.GetCertificate = m.GetCertificate
+			// Also answer TLS-ALPN-01 challenges on the TLS port
+			tlsConfig.NextProtos = []string{"h2", "http/1.1", acme.ALPNProto}
+			s.challengeServer = newChallengeServer(cfg.TLS.ACME.HTTPChallengeAddr, m)
+		} else {
+			// Serve the certificate through GetCertificate so it can be
+			// swapped at runtime (see ReloadTLS).
+			certs, err := newCertReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsConfig.GetCertificate = certs.GetCertificate
+			s.certs = certs
+		}
+
 		s.httpServer.TLSConfig = tlsConfig
 	}
 
 	return s, nil
 }
 
+// Reconfigure swaps the configuration and OIDC providers used by request
+// handlers. Requests already in flight finish with the previous values.
+// A changed listen.rate_limit replaces the rate limiters, which starts
+// every client with a full bucket. Listen address, TLS, routes and the
+// rest of the middleware are fixed at NewServer and are not affected.
+func (s *Server) Reconfigure(cfg *config.Config, providers *oidc.Registry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !reflect.DeepEqual(s.cfg.Listen.RateLimit, cfg.Listen.RateLimit) {
+		limits := newRateLimits(cfg.Listen.RateLimit)
+		limits.sessionKey = s.rateLimitSessionKey
+		s.limits.Stop()
+		s.limits = limits
+	}
+	if s.cfg.Auth.ExternalAuthorizer != cfg.Auth.ExternalAuthorizer {
+		s.authz = newAuthorizer(cfg.Auth.ExternalAuthorizer)
+	}
+	s.cfg = cfg
+	s.providers = providers
+}
+
+// newAuthorizer returns the client of auth.external_authorizer, or nil if
+// no decision endpoint is configured. The client is kept until the setting
+// changes, so its connections are reused across callbacks.
+func newAuthorizer(cfg config.ExternalAuthorizerConfig) *authorizer.Client {
+	if cfg.URL == "" {
+		return nil
+	}
+	return authorizer.New(cfg)
+}
+
+// externalAuthorizer returns the client of auth.external_authorizer, or
+// nil if it is not configured.
+func (s *Server) externalAuthorizer() *authorizer.Client {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.authz
+}
+
+// rateLimiters returns the rate limits to apply to a request.
+func (s *Server) rateLimiters() *rateLimits {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.limits
+}
+
+// SetWriter sets the writer of the results of callbacks to OpenVPN's
+// control files. The default writes the files and overwrites existing
+// results. It can be called at any time, e.g. on a configuration reload.
+func (s *Server) SetWriter(w openvpn.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writer = w
+}
+
+// controlFiles returns the writer for OpenVPN's control files.
+func (s *Server) controlFiles() openvpn.Writer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.writer
+}
+
+// SetAudit sets the audit trail that records each authentication decision.
+// A nil audit (the default) disables audit records. Call it before Start.
+func (s *Server) SetAudit(a audit.Audit) {
+	s.audit = a
+}
+
+// RecordAuthFailure counts a failed authentication against ip for
+// httpserver.failure_reputation. It is a no-op when that is disabled.
+func (s *Server) RecordAuthFailure(ip string) {
+	s.reputation.recordFailure(ip)
+}
+
+// current returns the configuration and OIDC providers to use for a request.
+func (s *Server) current() (*config.Config, *oidc.Registry) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cfg, s.providers
+}
+
 // Start starts the HTTP server
 func (s *Server) Start() error {
+	cfg, _ := s.current()
+
+	if s.listener == nil {
+		if err := s.Listen(); err != nil {
+			return err
+		}
+	}
+	if s.challengeListener != nil {
+		go s.serveChallenge()
+	}
+
 	slog.Info("starting HTTP server",
-		"addr", s.cfg.Listen.HTTP,
-		"tls", s.cfg.TLS.Enabled,
+		"addr", s.listener.Addr().String(),
+		"tls", cfg.TLS.Enabled,
 	)
 
-	if s.cfg.TLS.Enabled {
-		return s.httpServer.ListenAndServeTLS(s.cfg.TLS.CertFile, s.cfg.TLS.KeyFile)
+	if cfg.TLS.Enabled {
+		if interval := certWatchInterval(cfg.TLS); interval > 0 && s.certs != nil {
+			go s.certs.watch(interval)
+		}
+		// Certificate is provided by TLSConfig.GetCertificate
+		return s.httpServer.ServeTLS(s.listener, "", "")
+	}
+
+	return s.httpServer.Serve(s.listener)
+}
+
+// Listen binds the HTTP listen address without serving requests yet, so
+// callers can report readiness only once the port is open. Start serves on
+// the bound listener. With listen.http_socket it binds that Unix socket
+// instead of a TCP address. With tls.acme it also binds the HTTP-01
+// challenge address.
+func (s *Server) Listen() error {
+	cfg, _ := s.current()
+
+	var ln net.Listener
+	var err error
+	if cfg.Listen.HTTPSocket != "" {
+		ln, err = listenUnix(cfg.Listen.HTTPSocket)
+	} else {
+		addr := s.httpServer.Addr
+		if addr == "" {
+			// Same default as http.Server.ListenAndServe
+			addr = ":http"
+		}
+		ln, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return err
 	}
 
-	return s.httpServer.ListenAndServe()
+	if err := s.listenChallenge(); err != nil {
+		_ = ln.Close()
+		return err
+	}
+	s.listener = ln
+	return nil
+}
+
+// listenUnix binds a Unix socket at path for a reverse proxy on the same
+// host, replacing a stale socket left by a previous run. Like the IPC
+// socket it is restricted to owner and group (0660); the proxy must run in
+// the daemon's group.
+func listenUnix(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, fmt.Errorf("failed to create HTTP socket directory: %w", err)
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove old HTTP socket: %w", err)
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0660); err != nil { // #nosec G302 -- 0660 intentional: owner+group (reverse proxy) need socket access
+		_ = ln.Close()
+		return nil, fmt.Errorf("failed to set HTTP socket permissions: %w", err)
+	}
+	return ln, nil
+}
+
+// ReloadTLS reloads the TLS certificate and key from disk.
+// New connections use the new certificate; existing connections are not
+// affected. It is a no-op when TLS is disabled.
+func (s *Server) ReloadTLS() error {
+	if s.certs == nil {
+		return nil
+	}
+	if err := s.certs.Reload(); err != nil {
+		return err
+	}
+	slog.Info("TLS certificate reloaded", "cert_file", s.certs.certFile)
+	return nil
+}
+
+// drainLogInterval is how often Drain logs the remaining callbacks.
+const drainLogInterval = time.Second
+
+// InFlightCallbacks returns the number of /callback requests being handled.
+func (s *Server) InFlightCallbacks() int64 {
+	return s.callbacks.Load()
+}
+
+// Drain waits until no callbacks are in flight or ctx is done, logging the
+// remaining count every second. The server keeps serving new requests
+// meanwhile. It returns the number of callbacks still in flight.
+func (s *Server) Drain(ctx context.Context) int64 {
+	poll := time.NewTicker(50 * time.Millisecond)
+	defer poll.Stop()
+	lastLog := time.Now()
+
+	for {
+		remaining := s.callbacks.Load()
+		if remaining == 0 {
+			return 0
+		}
+		if time.Since(lastLog) >= drainLogInterval {
+			slog.Info("draining in-flight callbacks", "remaining", remaining)
+			lastLog = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return s.callbacks.Load()
+		case <-poll.C:
+		}
+	}
 }
 
 // Shutdown gracefully shuts down the HTTP server
 func (s *Server) Shutdown(ctx context.Context) error {
 	slog.Info("shutting down HTTP server")
+	s.rateLimiters().Stop()
+	if s.certs != nil {
+		s.certs.Stop()
+	}
+	if err := s.shutdownChallenge(ctx); err != nil {
+		slog.Warn("error shutting down ACME challenge server", "error", err)
+	}
 	return s.httpServer.Shutdown(ctx)
 }
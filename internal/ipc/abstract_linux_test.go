@@ -0,0 +1,57 @@
+//go:build linux
+
+package ipc
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestAbstractSocket(t *testing.T) {
+	socketPath := fmt.Sprintf("@openvpn-keycloak-auth-test-%d", os.Getpid())
+	if !IsAbstractSocket(socketPath) {
+		t.Fatalf("IsAbstractSocket(%q) = false, want true", socketPath)
+	}
+
+	// Nothing may be created or removed in the working directory
+	wd := t.TempDir()
+	t.Chdir(wd)
+
+	handler := func(ctx context.Context, req *AuthRequest) (*AuthResponse, error) {
+		return &AuthResponse{Status: StatusDeferred, SessionID: "test-session-123"}, nil
+	}
+	server := NewServer(socketPath, handler)
+	ctx := context.Background()
+	if err := server.Start(ctx); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := NewClient(socketPath).SendAuthRequest(ctx, &AuthRequest{Username: "testuser"})
+	if err != nil {
+		t.Fatalf("SendAuthRequest failed: %v", err)
+	}
+	if resp.SessionID != "test-session-123" {
+		t.Errorf("expected session_id test-session-123, got %s", resp.SessionID)
+	}
+
+	if err := server.Stop(); err != nil {
+		t.Errorf("server.Stop failed: %v", err)
+	}
+	if entries, err := os.ReadDir(wd); err != nil || len(entries) != 0 {
+		t.Errorf("working directory entries = %v (err %v), want none", entries, err)
+	}
+
+	// The name is free again once the server stopped
+	again := NewServer(socketPath, handler)
+	if err := again.Start(ctx); err != nil {
+		t.Fatalf("failed to restart server: %v", err)
+	}
+	if err := again.Stop(); err != nil {
+		t.Errorf("server.Stop failed: %v", err)
+	}
+}
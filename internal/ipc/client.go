@@ -12,6 +12,7 @@ import (
 type Client struct {
 	socketPath string
 	timeout    time.Duration
+	version    string // release version sent as client_version
 }
 
 // NewClient creates a new IPC client
@@ -22,15 +23,153 @@ func NewClient(socketPath string) *Client {
 	}
 }
 
+// SetVersion sets the release version of the client binary, sent with
+// every request so the daemon can detect a half-upgraded deployment.
+func (c *Client) SetVersion(version string) {
+	c.version = version
+}
+
 // SendAuthRequest sends an authentication request to the daemon and waits for response
 func (c *Client) SendAuthRequest(ctx context.Context, req *AuthRequest) (*AuthResponse, error) {
-	// Set request type
+	// Set request type and version
 	req.Type = MessageTypeAuthRequest
+	req.ProtocolVersion = ProtocolVersion
+	req.ClientVersion = c.version
+
+	var resp AuthResponse
+	if err := c.roundTrip(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+
+	// Validate response type
+	if resp.Type != MessageTypeAuthResponse {
+		return nil, fmt.Errorf("invalid response type: %s", resp.Type)
+	}
+
+	return &resp, nil
+}
+
+// QueryStatus asks the daemon for the current state of a session.
+// Unknown or expired sessions are reported as SessionStateUnknown with
+// Error set, not as a Go error.
+func (c *Client) QueryStatus(ctx context.Context, sessionID string) (*StatusResponse, error) {
+	req := &StatusQuery{
+		Type:            MessageTypeStatusQuery,
+		ProtocolVersion: ProtocolVersion,
+		ClientVersion:   c.version,
+		SessionID:       sessionID,
+	}
+
+	var resp StatusResponse
+	if err := c.roundTrip(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+
+	// Validate response type
+	if resp.Type != MessageTypeStatusResponse {
+		return nil, responseTypeError(resp.Type, resp.Error)
+	}
+
+	return &resp, nil
+}
+
+// ListSessions asks the daemon for all active sessions. The daemon only
+// answers privileged clients; a refusal is returned as an error.
+func (c *Client) ListSessions(ctx context.Context) ([]SessionInfo, error) {
+	req := &ListSessionsRequest{
+		Type:            MessageTypeListSessions,
+		ProtocolVersion: ProtocolVersion,
+		ClientVersion:   c.version,
+	}
+
+	var resp ListSessionsResponse
+	if err := c.roundTrip(ctx, req, &resp); err != nil {
+		return nil, err
+	}
+
+	// Validate response type
+	if resp.Type != MessageTypeListSessionsResponse {
+		return nil, responseTypeError(resp.Type, resp.Error)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("daemon error: %s", resp.Error)
+	}
 
+	return resp.Sessions, nil
+}
+
+// KillSession asks the daemon to write an auth failure for a session and
+// delete it.
+func (c *Client) KillSession(ctx context.Context, sessionID string) error {
+	req := &KillSessionRequest{
+		Type:            MessageTypeKillSession,
+		ProtocolVersion: ProtocolVersion,
+		ClientVersion:   c.version,
+		SessionID:       sessionID,
+	}
+
+	var resp KillSessionResponse
+	if err := c.roundTrip(ctx, req, &resp); err != nil {
+		return err
+	}
+
+	// Validate response type
+	if resp.Type != MessageTypeKillSessionResponse {
+		return responseTypeError(resp.Type, resp.Error)
+	}
+	if resp.Error != "" {
+		return fmt.Errorf("daemon error: %s", resp.Error)
+	}
+
+	return nil
+}
+
+// Cancel asks the daemon to delete the pending sessions of the client
+// identified by username, commonName and untrustedIP without writing a
+// result. It returns the number of sessions deleted.
+func (c *Client) Cancel(ctx context.Context, username, commonName, untrustedIP string) (int, error) {
+	req := &CancelRequest{
+		Type:            MessageTypeCancel,
+		ProtocolVersion: ProtocolVersion,
+		ClientVersion:   c.version,
+		Username:        username,
+		CommonName:      commonName,
+		UntrustedIP:     untrustedIP,
+	}
+
+	var resp CancelResponse
+	if err := c.roundTrip(ctx, req, &resp); err != nil {
+		return 0, err
+	}
+
+	// Validate response type
+	if resp.Type != MessageTypeCancelResponse {
+		return 0, responseTypeError(resp.Type, resp.Error)
+	}
+	if resp.Error != "" {
+		return 0, fmt.Errorf("daemon error: %s", resp.Error)
+	}
+
+	return resp.Cancelled, nil
+}
+
+// responseTypeError reports a reply of type got to a request expecting
+// another type. The daemon refuses unauthorized clients with an
+// auth_response error before reading their request, whatever its type, so
+// that error is returned as the daemon's.
+func responseTypeError(got MessageType, errMsg string) error {
+	if got == MessageTypeAuthResponse && errMsg != "" {
+		return fmt.Errorf("daemon error: %s", errMsg)
+	}
+	return fmt.Errorf("invalid response type: %s", got)
+}
+
+// roundTrip sends req to the daemon and decodes its reply into resp.
+func (c *Client) roundTrip(ctx context.Context, req, resp interface{}) error {
 	// Connect to Unix socket with timeout
 	conn, err := net.DialTimeout("unix", c.socketPath, c.timeout)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to daemon: %w", err)
+		return fmt.Errorf("failed to connect to daemon: %w", err)
 	}
 	defer func() { _ = conn.Close() }()
 
@@ -40,28 +179,22 @@ func (c *Client) SendAuthRequest(ctx context.Context, req *AuthRequest) (*AuthRe
 		deadline = time.Now().Add(c.timeout)
 	}
 	if err := conn.SetDeadline(deadline); err != nil {
-		return nil, fmt.Errorf("failed to set connection deadline: %w", err)
+		return fmt.Errorf("failed to set connection deadline: %w", err)
 	}
 
 	// Send request
 	enc := json.NewEncoder(conn)
 	if err := enc.Encode(req); err != nil {
-		return nil, fmt.Errorf("failed to send request: %w", err)
+		return fmt.Errorf("failed to send request: %w", err)
 	}
 
 	// Read response
-	var resp AuthResponse
 	dec := json.NewDecoder(conn)
-	if err := dec.Decode(&resp); err != nil {
-		return nil, fmt.Errorf("failed to read response: %w", err)
+	if err := dec.Decode(resp); err != nil {
+		return fmt.Errorf("failed to read response: %w", err)
 	}
 
-	// Validate response type
-	if resp.Type != MessageTypeAuthResponse {
-		return nil, fmt.Errorf("invalid response type: %s", resp.Type)
-	}
-
-	return &resp, nil
+	return nil
 }
 
 // SetTimeout sets the connection timeout
@@ -2,8 +2,14 @@ package ipc
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -129,6 +135,518 @@ func TestServerHandlerError(t *testing.T) {
 	}
 }
 
+func TestCorrelationID(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "test.sock")
+
+	seen := make(chan string, 2)
+	handler := func(ctx context.Context, req *AuthRequest) (*AuthResponse, error) {
+		seen <- req.CorrelationID
+		if req.Username == "baduser" {
+			return nil, fmt.Errorf("failed to start OIDC flow")
+		}
+		return &AuthResponse{Status: StatusDeferred, SessionID: "test-session-123"}, nil
+	}
+
+	server := NewServer(socketPath, handler)
+	ctx := context.Background()
+	if err := server.Start(ctx); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer func() {
+		if err := server.Stop(); err != nil {
+			t.Errorf("server.Stop failed: %v", err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := NewClient(socketPath)
+
+	var ids []string
+	for _, username := range []string{"testuser", "baduser"} {
+		// A correlation ID set by the client is not sent
+		resp, err := client.SendAuthRequest(ctx, &AuthRequest{Username: username, CorrelationID: "from-client"})
+		if err != nil {
+			t.Fatalf("SendAuthRequest failed: %v", err)
+		}
+		id := <-seen
+		if id == "" || id == "from-client" {
+			t.Fatalf("handler saw correlation ID %q, want one generated by the server", id)
+		}
+		if resp.CorrelationID != id {
+			t.Errorf("%s: response correlation ID = %q, want %q", username, resp.CorrelationID, id)
+		}
+		ids = append(ids, id)
+	}
+	if ids[0] == ids[1] {
+		t.Errorf("two requests got the same correlation ID %q", ids[0])
+	}
+}
+
+func TestStatusQuery(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "ipc-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	socketPath := filepath.Join(tmpDir, "test.sock")
+
+	handler := func(ctx context.Context, req *AuthRequest) (*AuthResponse, error) {
+		return &AuthResponse{Status: StatusDeferred, SessionID: "known-session"}, nil
+	}
+	statusHandler := func(ctx context.Context, req *StatusQuery) (*StatusResponse, error) {
+		if req.SessionID == "known-session" {
+			return &StatusResponse{SessionID: req.SessionID, State: SessionStatePending}, nil
+		}
+		return &StatusResponse{SessionID: req.SessionID, State: SessionStateUnknown, Error: "session not found"}, nil
+	}
+
+	server := NewServer(socketPath, handler)
+	server.SetStatusHandler(statusHandler)
+	ctx := context.Background()
+
+	if err := server.Start(ctx); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer func() {
+		if err := server.Stop(); err != nil {
+			t.Errorf("server.Stop failed: %v", err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := NewClient(socketPath)
+
+	t.Run("known session", func(t *testing.T) {
+		resp, err := client.QueryStatus(ctx, "known-session")
+		if err != nil {
+			t.Fatalf("QueryStatus failed: %v", err)
+		}
+		if resp.Type != MessageTypeStatusResponse {
+			t.Errorf("expected type %s, got %s", MessageTypeStatusResponse, resp.Type)
+		}
+		if resp.State != SessionStatePending || resp.SessionID != "known-session" || resp.Error != "" {
+			t.Errorf("unexpected response: %+v", resp)
+		}
+	})
+
+	t.Run("unknown session", func(t *testing.T) {
+		resp, err := client.QueryStatus(ctx, "no-such-session")
+		if err != nil {
+			t.Fatalf("QueryStatus failed: %v", err)
+		}
+		if resp.State != SessionStateUnknown || resp.Error == "" {
+			t.Errorf("expected unknown state with error, got %+v", resp)
+		}
+	})
+
+	t.Run("auth requests still dispatched", func(t *testing.T) {
+		resp, err := client.SendAuthRequest(ctx, &AuthRequest{Username: "testuser"})
+		if err != nil {
+			t.Fatalf("SendAuthRequest failed: %v", err)
+		}
+		if resp.Status != StatusDeferred || resp.SessionID != "known-session" {
+			t.Errorf("unexpected auth response: %+v", resp)
+		}
+	})
+}
+
+func TestStatusQueryWithoutHandler(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "ipc-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	socketPath := filepath.Join(tmpDir, "test.sock")
+
+	handler := func(ctx context.Context, req *AuthRequest) (*AuthResponse, error) {
+		return &AuthResponse{Status: StatusDeferred}, nil
+	}
+
+	server := NewServer(socketPath, handler)
+	ctx := context.Background()
+
+	if err := server.Start(ctx); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer func() {
+		if err := server.Stop(); err != nil {
+			t.Errorf("server.Stop failed: %v", err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	resp, err := NewClient(socketPath).QueryStatus(ctx, "some-session")
+	if err != nil {
+		t.Fatalf("QueryStatus failed: %v", err)
+	}
+	if resp.State != SessionStateUnknown || resp.Error == "" {
+		t.Errorf("expected unknown state with error, got %+v", resp)
+	}
+}
+
+func TestSessionManagement(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "ipc-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	socketPath := filepath.Join(tmpDir, "test.sock")
+
+	handler := func(ctx context.Context, req *AuthRequest) (*AuthResponse, error) {
+		return &AuthResponse{Status: StatusDeferred}, nil
+	}
+	created := time.Now().Add(-time.Minute).Truncate(time.Second)
+	list := func(ctx context.Context, req *ListSessionsRequest) (*ListSessionsResponse, error) {
+		return &ListSessionsResponse{Sessions: []SessionInfo{{
+			SessionID:   "session-1",
+			Username:    "testuser",
+			UntrustedIP: "192.0.2.1",
+			CreatedAt:   created,
+			State:       SessionStatePending,
+		}}}, nil
+	}
+	var killed string
+	kill := func(ctx context.Context, req *KillSessionRequest) (*KillSessionResponse, error) {
+		if req.SessionID != "session-1" {
+			return nil, fmt.Errorf("session not found")
+		}
+		killed = req.SessionID
+		return &KillSessionResponse{SessionID: req.SessionID}, nil
+	}
+
+	server := NewServer(socketPath, handler)
+	server.SetSessionHandlers(list, kill)
+	ctx := context.Background()
+
+	if err := server.Start(ctx); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer func() {
+		if err := server.Stop(); err != nil {
+			t.Errorf("server.Stop failed: %v", err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := NewClient(socketPath)
+
+	// The test runs as the daemon's user, so it is privileged
+	sessions, err := client.ListSessions(ctx)
+	if err != nil {
+		t.Fatalf("ListSessions failed: %v", err)
+	}
+	if len(sessions) != 1 || sessions[0].Username != "testuser" || !sessions[0].CreatedAt.Equal(created) {
+		t.Errorf("ListSessions() = %+v, want one testuser session", sessions)
+	}
+
+	if err := client.KillSession(ctx, "session-1"); err != nil {
+		t.Fatalf("KillSession failed: %v", err)
+	}
+	if killed != "session-1" {
+		t.Errorf("killed = %q, want session-1", killed)
+	}
+	if err := client.KillSession(ctx, "unknown"); err == nil || !strings.Contains(err.Error(), "session not found") {
+		t.Errorf("KillSession(unknown) error = %v, want session not found", err)
+	}
+
+	// Other members of the socket's group are refused
+	killed = ""
+	unprivSocket := filepath.Join(tmpDir, "unpriv.sock")
+	unpriv := NewServer(unprivSocket, handler)
+	unpriv.SetSessionHandlers(list, kill)
+	unpriv.privileged = func(uint32) bool { return false }
+	if err := unpriv.Start(ctx); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer func() {
+		if err := unpriv.Stop(); err != nil {
+			t.Errorf("server.Stop failed: %v", err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client = NewClient(unprivSocket)
+	if _, err := client.ListSessions(ctx); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("unprivileged ListSessions error = %v, want permission denied", err)
+	}
+	if err := client.KillSession(ctx, "session-1"); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("unprivileged KillSession error = %v, want permission denied", err)
+	}
+	if killed != "" {
+		t.Error("kill handler must not run for unprivileged clients")
+	}
+}
+
+func TestCancel(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "ipc-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	socketPath := filepath.Join(tmpDir, "test.sock")
+
+	handler := func(ctx context.Context, req *AuthRequest) (*AuthResponse, error) {
+		return &AuthResponse{Status: StatusDeferred}, nil
+	}
+	var got CancelRequest
+	cancel := func(ctx context.Context, req *CancelRequest) (*CancelResponse, error) {
+		got = *req
+		return &CancelResponse{Cancelled: 1}, nil
+	}
+
+	server := NewServer(socketPath, handler)
+	server.SetCancelHandler(cancel)
+	ctx := context.Background()
+
+	if err := server.Start(ctx); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer func() {
+		if err := server.Stop(); err != nil {
+			t.Errorf("server.Stop failed: %v", err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	client := NewClient(socketPath)
+
+	n, err := client.Cancel(ctx, "testuser", "testuser-cn", "192.0.2.1")
+	if err != nil {
+		t.Fatalf("Cancel failed: %v", err)
+	}
+	if n != 1 {
+		t.Errorf("Cancel() = %d, want 1", n)
+	}
+	if got.Username != "testuser" || got.CommonName != "testuser-cn" || got.UntrustedIP != "192.0.2.1" {
+		t.Errorf("handler got %+v, want the client's username, common name and IP", got)
+	}
+}
+
+func TestProtocolVersionMismatch(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "ipc-test-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = os.RemoveAll(tmpDir) }()
+
+	socketPath := filepath.Join(tmpDir, "test.sock")
+
+	handlerCalled := false
+	handler := func(ctx context.Context, req *AuthRequest) (*AuthResponse, error) {
+		handlerCalled = true
+		return &AuthResponse{Status: StatusDeferred}, nil
+	}
+
+	server := NewServer(socketPath, handler)
+	server.SetMinProtocolVersion(ProtocolVersion)
+	ctx := context.Background()
+
+	if err := server.Start(ctx); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer func() {
+		if err := server.Stop(); err != nil {
+			t.Errorf("server.Stop failed: %v", err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	// rawRequest sends a request the way an older auth binary would,
+	// without a protocol_version field.
+	rawRequest := func(t *testing.T, msg map[string]string) map[string]interface{} {
+		t.Helper()
+		conn, err := net.Dial("unix", socketPath)
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		defer func() { _ = conn.Close() }()
+
+		if err := json.NewEncoder(conn).Encode(msg); err != nil {
+			t.Fatalf("failed to send request: %v", err)
+		}
+		var resp map[string]interface{}
+		if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+			t.Fatalf("failed to read response: %v", err)
+		}
+		return resp
+	}
+
+	tests := []struct {
+		name     string
+		msg      map[string]string
+		wantType string
+	}{
+		{
+			name:     "auth request",
+			msg:      map[string]string{"type": string(MessageTypeAuthRequest), "username": "john", "session_id": "s1"},
+			wantType: string(MessageTypeAuthResponse),
+		},
+		{
+			name:     "status query",
+			msg:      map[string]string{"type": string(MessageTypeStatusQuery), "session_id": "s1"},
+			wantType: string(MessageTypeStatusResponse),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := rawRequest(t, tt.msg)
+			if resp["type"] != tt.wantType {
+				t.Errorf("type = %v, want %s", resp["type"], tt.wantType)
+			}
+			if tt.wantType == string(MessageTypeAuthResponse) && resp["status"] != string(StatusError) {
+				t.Errorf("status = %v, want %s", resp["status"], StatusError)
+			}
+			errMsg, _ := resp["error"].(string)
+			if !strings.Contains(errMsg, "upgrade the auth binary") {
+				t.Errorf("error = %q, want upgrade hint", errMsg)
+			}
+			if resp["protocol_version"] != float64(ProtocolVersion) {
+				t.Errorf("protocol_version = %v, want %d", resp["protocol_version"], ProtocolVersion)
+			}
+		})
+	}
+
+	if handlerCalled {
+		t.Error("handler should not be called for outdated clients")
+	}
+
+	// A current client is accepted
+	resp, err := NewClient(socketPath).SendAuthRequest(ctx, &AuthRequest{Username: "john", CommonName: "john"})
+	if err != nil {
+		t.Fatalf("SendAuthRequest failed: %v", err)
+	}
+	if resp.Status != StatusDeferred {
+		t.Errorf("status = %s, want %s (error %q)", resp.Status, StatusDeferred, resp.Error)
+	}
+	if resp.ProtocolVersion != ProtocolVersion {
+		t.Errorf("response protocol_version = %d, want %d", resp.ProtocolVersion, ProtocolVersion)
+	}
+}
+
+func TestMaxRequestSize(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "test.sock")
+
+	handlerCalled := false
+	handler := func(ctx context.Context, req *AuthRequest) (*AuthResponse, error) {
+		handlerCalled = true
+		return &AuthResponse{Status: StatusDeferred}, nil
+	}
+
+	server := NewServer(socketPath, handler)
+	server.SetMaxRequestSize(1024)
+	ctx := context.Background()
+
+	if err := server.Start(ctx); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer func() {
+		if err := server.Stop(); err != nil {
+			t.Errorf("server.Stop failed: %v", err)
+		}
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	// A username far beyond the limit; the server stops reading, so the
+	// write may fail once the socket buffer is full
+	go func() {
+		_ = json.NewEncoder(conn).Encode(map[string]string{
+			"type":     string(MessageTypeAuthRequest),
+			"username": strings.Repeat("a", 1<<20),
+		})
+	}()
+
+	var resp AuthResponse
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		t.Fatalf("failed to read response: %v", err)
+	}
+	if resp.Status != StatusError || !strings.Contains(resp.Error, "exceeds the maximum size of 1024 bytes") {
+		t.Errorf("response = %+v, want size error", resp)
+	}
+	if handlerCalled {
+		t.Error("handler should not be called for oversized requests")
+	}
+
+	// Requests within the limit are served
+	resp2, err := NewClient(socketPath).SendAuthRequest(ctx, &AuthRequest{Username: "john", CommonName: "john"})
+	if err != nil {
+		t.Fatalf("SendAuthRequest failed: %v", err)
+	}
+	if resp2.Status != StatusDeferred {
+		t.Errorf("status = %s, want %s (error %q)", resp2.Status, StatusDeferred, resp2.Error)
+	}
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "test.sock")
+
+	handler := func(ctx context.Context, req *AuthRequest) (*AuthResponse, error) {
+		return &AuthResponse{Status: StatusDeferred}, nil
+	}
+
+	server := NewServer(socketPath, handler)
+	server.SetTimeout(200 * time.Millisecond)
+	ctx := context.Background()
+
+	if err := server.Start(ctx); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	// A client that connects and sends nothing
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	start := time.Now()
+	if err := conn.SetReadDeadline(start.Add(5 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read error = %v, want EOF (connection closed by server)", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("server closed idle connection after %v, want about 200ms", elapsed)
+	}
+
+	// Stop does not wait for another stalled client beyond the timeout
+	stalled, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer func() { _ = stalled.Close() }()
+	time.Sleep(50 * time.Millisecond)
+
+	start = time.Now()
+	if err := server.Stop(); err != nil {
+		t.Errorf("server.Stop failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Stop took %v with a stalled client, want about 200ms", elapsed)
+	}
+}
+
 func TestClientConnectionFailure(t *testing.T) {
 	// Try to connect to non-existent socket
 	client := NewClient("/nonexistent/path/test.sock")
@@ -328,3 +846,82 @@ func TestClientTimeout(t *testing.T) {
 		t.Error("expected timeout error")
 	}
 }
+
+func TestVersionCheck(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	tests := []struct {
+		name          string
+		strict        bool
+		clientVersion string
+		wantErr       bool
+	}{
+		{name: "lenient, matching version", clientVersion: "1.4.0"},
+		{name: "lenient, mismatched version", clientVersion: "1.3.2"},
+		{name: "lenient, no client version", clientVersion: ""},
+		{name: "strict, matching version", strict: true, clientVersion: "1.4.0"},
+		{name: "strict, mismatched version", strict: true, clientVersion: "1.3.2", wantErr: true},
+		{name: "strict, no client version", strict: true, clientVersion: "", wantErr: true},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			socketPath := filepath.Join(tmpDir, fmt.Sprintf("test%d.sock", i))
+
+			var handlerCalled atomic.Bool
+			handler := func(ctx context.Context, req *AuthRequest) (*AuthResponse, error) {
+				handlerCalled.Store(true)
+				if req.ClientVersion != tt.clientVersion {
+					t.Errorf("ClientVersion = %q, want %q", req.ClientVersion, tt.clientVersion)
+				}
+				return &AuthResponse{Status: StatusDeferred, SessionID: "s1"}, nil
+			}
+
+			server := NewServer(socketPath, handler)
+			server.SetVersionCheck("1.4.0", tt.strict)
+			server.SetStatusHandler(func(ctx context.Context, req *StatusQuery) (*StatusResponse, error) {
+				return &StatusResponse{SessionID: req.SessionID, State: SessionStatePending}, nil
+			})
+			ctx := context.Background()
+			if err := server.Start(ctx); err != nil {
+				t.Fatalf("failed to start server: %v", err)
+			}
+			defer func() {
+				if err := server.Stop(); err != nil {
+					t.Errorf("server.Stop failed: %v", err)
+				}
+			}()
+
+			client := NewClient(socketPath)
+			client.SetVersion(tt.clientVersion)
+
+			resp, err := client.SendAuthRequest(ctx, &AuthRequest{Username: "john"})
+			if err != nil {
+				t.Fatalf("SendAuthRequest failed: %v", err)
+			}
+			status, err := client.QueryStatus(ctx, "s1")
+			if err != nil {
+				t.Fatalf("QueryStatus failed: %v", err)
+			}
+
+			if tt.wantErr {
+				if resp.Status != StatusError || !strings.Contains(resp.Error, "does not match daemon version 1.4.0") {
+					t.Errorf("auth response = %+v, want version mismatch error", resp)
+				}
+				if status.Error == "" || status.State != SessionStateUnknown {
+					t.Errorf("status response = %+v, want version mismatch error", status)
+				}
+				if handlerCalled.Load() {
+					t.Error("handler must not run for a rejected client")
+				}
+				return
+			}
+			if resp.Status != StatusDeferred || !handlerCalled.Load() {
+				t.Errorf("auth response = %+v, handler called = %v, want deferred", resp, handlerCalled.Load())
+			}
+			if status.State != SessionStatePending {
+				t.Errorf("status response = %+v, want pending", status)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+//go:build linux
+
+package ipc
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAllowedUIDs(t *testing.T) {
+	uid := uint32(os.Getuid()) // #nosec G115 -- uids are non-negative
+
+	called := false
+	handler := func(ctx context.Context, req *AuthRequest) (*AuthResponse, error) {
+		called = true
+		return &AuthResponse{Status: StatusDeferred, SessionID: "test-session-123"}, nil
+	}
+
+	tests := []struct {
+		name       string
+		allowed    []uint32
+		privileged bool
+		wantErr    string
+	}{
+		{name: "no list", allowed: nil},
+		{name: "uid listed", allowed: []uint32{uid + 1, uid}},
+		{name: "uid not listed", allowed: []uint32{uid + 1}, wantErr: "permission denied"},
+		{name: "privileged uid not listed", allowed: []uint32{uid + 1}, privileged: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called = false
+			socketPath := filepath.Join(t.TempDir(), "test.sock")
+			server := NewServer(socketPath, handler)
+			server.SetAllowedUIDs(tt.allowed)
+			server.privileged = func(uint32) bool { return tt.privileged }
+
+			ctx := context.Background()
+			if err := server.Start(ctx); err != nil {
+				t.Fatalf("failed to start server: %v", err)
+			}
+			defer func() {
+				if err := server.Stop(); err != nil {
+					t.Errorf("server.Stop failed: %v", err)
+				}
+			}()
+
+			time.Sleep(100 * time.Millisecond)
+
+			client := NewClient(socketPath)
+			resp, err := client.SendAuthRequest(ctx, &AuthRequest{Username: "testuser"})
+			if tt.wantErr != "" {
+				// Refused before the request is read, the client sees the
+				// error response or, at worst, a closed connection
+				if err == nil && (resp.Status != StatusError || !strings.Contains(resp.Error, tt.wantErr)) {
+					t.Errorf("response = %+v, want error containing %q", resp, tt.wantErr)
+				}
+				if called {
+					t.Error("auth handler must not run for rejected clients")
+				}
+				if _, err := client.ListSessions(ctx); err == nil {
+					t.Error("ListSessions should fail for rejected clients")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("SendAuthRequest failed: %v", err)
+			}
+			if resp.SessionID != "test-session-123" {
+				t.Errorf("response = %+v, want session test-session-123", resp)
+			}
+		})
+	}
+}
@@ -1,5 +1,17 @@
 package ipc
 
+import "time"
+
+// ProtocolVersion is the IPC protocol version spoken by this build. Bump it
+// when a change requires the auth binary and the daemon to be upgraded
+// together.
+const ProtocolVersion = 1
+
+// MinProtocolVersion is the oldest client protocol version the server
+// accepts by default. Clients that predate versioning send no version and
+// are treated as version 0.
+const MinProtocolVersion = 1
+
 // MessageType represents the type of IPC message
 type MessageType string
 
@@ -8,14 +20,40 @@ const (
 	MessageTypeAuthRequest MessageType = "auth_request"
 	// MessageTypeAuthResponse is sent from daemon to auth script
 	MessageTypeAuthResponse MessageType = "auth_response"
+	// MessageTypeStatusQuery asks the daemon for the state of a session
+	MessageTypeStatusQuery MessageType = "status_query"
+	// MessageTypeStatusResponse answers a status query
+	MessageTypeStatusResponse MessageType = "status_response"
+	// MessageTypeListSessions asks the daemon for all active sessions
+	MessageTypeListSessions MessageType = "list_sessions"
+	// MessageTypeListSessionsResponse answers a list_sessions request
+	MessageTypeListSessionsResponse MessageType = "list_sessions_response"
+	// MessageTypeKillSession asks the daemon to fail and delete a session
+	MessageTypeKillSession MessageType = "kill_session"
+	// MessageTypeKillSessionResponse answers a kill_session request
+	MessageTypeKillSessionResponse MessageType = "kill_session_response"
+	// MessageTypeCancel asks the daemon to drop a client's pending sessions
+	MessageTypeCancel MessageType = "cancel"
+	// MessageTypeCancelResponse answers a cancel request
+	MessageTypeCancelResponse MessageType = "cancel_response"
 )
 
+// request is used to read the type of an incoming message before decoding
+// it into the matching request struct.
+type request struct {
+	Type            MessageType `json:"type"`
+	ProtocolVersion int         `json:"protocol_version"`
+	ClientVersion   string      `json:"client_version,omitempty"`
+}
+
 // AuthRequest is sent from the auth script to the daemon when OpenVPN
 // initiates an authentication request.
 // Note: Password is intentionally excluded from IPC to avoid transmitting
 // secrets unnecessarily. For SSO, the password field is not used.
 type AuthRequest struct {
 	Type                 MessageType `json:"type"`
+	ProtocolVersion      int         `json:"protocol_version"`
+	ClientVersion        string      `json:"client_version,omitempty"` // Release version of the client binary
 	Username             string      `json:"username"`
 	CommonName           string      `json:"common_name"`
 	UntrustedIP          string      `json:"untrusted_ip"`
@@ -26,15 +64,29 @@ type AuthRequest struct {
 	// PendingAuthMethod is the auth pending method the client supports
 	// (e.g. "webauth" or "openurl"), selected from the client's IV_SSO capabilities.
 	PendingAuthMethod string `json:"pending_auth_method"`
+	// Instance names the OpenVPN server instance (its config file name
+	// without extension), for oidc.instance_required_roles.
+	Instance string `json:"instance,omitempty"`
+	// UsernameSource is "common_name" when Username is the certificate
+	// common name (auth.username_source) rather than the username the
+	// client sent.
+	UsernameSource string `json:"username_source,omitempty"`
+	// CorrelationID is set by the server for each request and logged with
+	// every message about it, from the request through the callback. It is
+	// never read from the client.
+	CorrelationID string `json:"-"`
 }
 
 // AuthResponse is sent from the daemon back to the auth script
 type AuthResponse struct {
-	Type      MessageType `json:"type"`
-	Status    string      `json:"status"` // "deferred" or "error"
-	SessionID string      `json:"session_id,omitempty"`
-	AuthURL   string      `json:"auth_url,omitempty"`
-	Error     string      `json:"error,omitempty"`
+	Type            MessageType `json:"type"`
+	ProtocolVersion int         `json:"protocol_version"`
+	Status          string      `json:"status"` // "deferred" or "error"
+	SessionID       string      `json:"session_id,omitempty"`
+	AuthURL         string      `json:"auth_url,omitempty"`
+	Error           string      `json:"error,omitempty"`
+	// CorrelationID identifies the request in the daemon's logs
+	CorrelationID string `json:"correlation_id,omitempty"`
 }
 
 // ResponseStatus constants
@@ -42,3 +94,96 @@ const (
 	StatusDeferred = "deferred"
 	StatusError    = "error"
 )
+
+// StatusQuery asks the daemon for the current state of a session, e.g. to
+// debug a pending login or when a client re-invokes the auth script.
+type StatusQuery struct {
+	Type            MessageType `json:"type"`
+	ProtocolVersion int         `json:"protocol_version"`
+	ClientVersion   string      `json:"client_version,omitempty"`
+	SessionID       string      `json:"session_id"`
+}
+
+// StatusResponse is the daemon's answer to a StatusQuery
+type StatusResponse struct {
+	Type            MessageType `json:"type"`
+	ProtocolVersion int         `json:"protocol_version"`
+	SessionID       string      `json:"session_id"`
+	State           string      `json:"state"` // see SessionState constants
+	Error           string      `json:"error,omitempty"`
+}
+
+// ListSessionsRequest asks the daemon for all active sessions. It is only
+// answered for privileged clients (root or the daemon's own user).
+type ListSessionsRequest struct {
+	Type            MessageType `json:"type"`
+	ProtocolVersion int         `json:"protocol_version"`
+	ClientVersion   string      `json:"client_version,omitempty"`
+}
+
+// SessionInfo describes an active session in a ListSessionsResponse
+type SessionInfo struct {
+	SessionID   string    `json:"session_id"`
+	Username    string    `json:"username"`
+	CommonName  string    `json:"common_name,omitempty"`
+	UntrustedIP string    `json:"untrusted_ip,omitempty"`
+	Provider    string    `json:"provider,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	State       string    `json:"state"` // see SessionState constants
+}
+
+// ListSessionsResponse is the daemon's answer to a ListSessionsRequest
+type ListSessionsResponse struct {
+	Type            MessageType   `json:"type"`
+	ProtocolVersion int           `json:"protocol_version"`
+	Sessions        []SessionInfo `json:"sessions"`
+	Error           string        `json:"error,omitempty"`
+}
+
+// KillSessionRequest asks the daemon to write an auth failure for a session
+// and delete it. Like ListSessionsRequest it requires a privileged client.
+type KillSessionRequest struct {
+	Type            MessageType `json:"type"`
+	ProtocolVersion int         `json:"protocol_version"`
+	ClientVersion   string      `json:"client_version,omitempty"`
+	SessionID       string      `json:"session_id"`
+}
+
+// KillSessionResponse is the daemon's answer to a KillSessionRequest.
+// Error is empty when the session was killed.
+type KillSessionResponse struct {
+	Type            MessageType `json:"type"`
+	ProtocolVersion int         `json:"protocol_version"`
+	SessionID       string      `json:"session_id"`
+	Error           string      `json:"error,omitempty"`
+}
+
+// CancelRequest asks the daemon to delete the pending sessions of a client,
+// identified by username, common name and IP, without writing a result,
+// e.g. because the client reconnected before completing the browser flow.
+type CancelRequest struct {
+	Type            MessageType `json:"type"`
+	ProtocolVersion int         `json:"protocol_version"`
+	ClientVersion   string      `json:"client_version,omitempty"`
+	Username        string      `json:"username"`
+	CommonName      string      `json:"common_name"`
+	UntrustedIP     string      `json:"untrusted_ip"`
+}
+
+// CancelResponse is the daemon's answer to a CancelRequest. Cancelled is
+// the number of sessions deleted.
+type CancelResponse struct {
+	Type            MessageType `json:"type"`
+	ProtocolVersion int         `json:"protocol_version"`
+	Cancelled       int         `json:"cancelled"`
+	Error           string      `json:"error,omitempty"`
+}
+
+// SessionState constants
+const (
+	SessionStatePending = "pending"
+	SessionStateSuccess = "success"
+	SessionStateFailure = "failure"
+	SessionStateUnknown = "unknown" // Not found, expired or never existed
+)
@@ -3,23 +3,63 @@ package ipc
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
+	"time"
+)
+
+const (
+	// DefaultMaxRequestSize is the default limit on the size of a request.
+	DefaultMaxRequestSize = 64 * 1024
+
+	// DefaultTimeout is the default time a client has to send its request,
+	// and the server to write the response. It matches the client's
+	// default timeout.
+	DefaultTimeout = 5 * time.Second
 )
 
 // AuthRequestHandler is the function type for handling auth requests
 type AuthRequestHandler func(ctx context.Context, req *AuthRequest) (*AuthResponse, error)
 
+// StatusQueryHandler is the function type for handling status queries
+type StatusQueryHandler func(ctx context.Context, req *StatusQuery) (*StatusResponse, error)
+
+// ListSessionsHandler is the function type for handling list_sessions requests
+type ListSessionsHandler func(ctx context.Context, req *ListSessionsRequest) (*ListSessionsResponse, error)
+
+// KillSessionHandler is the function type for handling kill_session requests
+type KillSessionHandler func(ctx context.Context, req *KillSessionRequest) (*KillSessionResponse, error)
+
+// CancelHandler is the function type for handling cancel requests
+type CancelHandler func(ctx context.Context, req *CancelRequest) (*CancelResponse, error)
+
 // Server is the IPC server that listens on a Unix socket for auth requests
 type Server struct {
 	socketPath string
 	listener   net.Listener
 	handler    AuthRequestHandler
+	status     StatusQueryHandler
+	list       ListSessionsHandler
+	kill       KillSessionHandler
+	cancel     CancelHandler
+	minVersion int
+	maxRequest int64 // bytes
+	timeout    time.Duration
+	version    string                // daemon release version; empty disables the check
+	strict     bool                  // reject clients whose version differs from version
+	privileged func(uid uint32) bool // may list and kill sessions
+	allowed    map[uint32]bool       // may connect besides privileged users; nil allows all
 	wg         sync.WaitGroup
 	stopChan   chan struct{}
 	mu         sync.Mutex
@@ -30,23 +70,119 @@ func NewServer(socketPath string, handler AuthRequestHandler) *Server {
 	return &Server{
 		socketPath: socketPath,
 		handler:    handler,
+		minVersion: MinProtocolVersion,
+		maxRequest: DefaultMaxRequestSize,
+		timeout:    DefaultTimeout,
+		privileged: isPrivilegedUID,
 		stopChan:   make(chan struct{}),
 	}
 }
 
+// isPrivilegedUID reports whether uid is root or the daemon's own user.
+// The socket is group-accessible for the auth script, so group membership
+// alone must not allow session management.
+func isPrivilegedUID(uid uint32) bool {
+	return uid == 0 || int64(uid) == int64(os.Getuid())
+}
+
+// SetStatusHandler sets the handler for status queries. Without one, status
+// queries are answered with an error. Call it before Start.
+func (s *Server) SetStatusHandler(handler StatusQueryHandler) {
+	s.status = handler
+}
+
+// SetSessionHandlers sets the handlers for listing and killing sessions.
+// Without them, such requests are answered with an error. Call it before
+// Start.
+func (s *Server) SetSessionHandlers(list ListSessionsHandler, kill KillSessionHandler) {
+	s.list = list
+	s.kill = kill
+}
+
+// SetCancelHandler sets the handler for cancel requests. Without one, they
+// are answered with an error. Call it before Start.
+func (s *Server) SetCancelHandler(handler CancelHandler) {
+	s.cancel = handler
+}
+
+// SetAllowedUIDs restricts connections to clients running as one of uids,
+// as reported by the kernel for the connecting process (SO_PEERCRED), or as
+// root or the daemon's own user. Other clients get an error before their
+// request is read, even if the socket permissions let them connect. An
+// empty list allows all clients. There is no list of group IDs:
+// SO_PEERCRED only reports the client's primary group, so restrict groups
+// with the socket's group ownership and mode instead. Call it before Start.
+func (s *Server) SetAllowedUIDs(uids []uint32) {
+	if len(uids) == 0 {
+		s.allowed = nil
+		return
+	}
+	s.allowed = make(map[uint32]bool, len(uids))
+	for _, uid := range uids {
+		s.allowed[uid] = true
+	}
+}
+
+// SetMaxRequestSize sets the largest request, in bytes, the server reads
+// (default DefaultMaxRequestSize). Larger requests are answered with an
+// error. A size of 0 or less keeps the default. Call it before Start.
+func (s *Server) SetMaxRequestSize(size int64) {
+	if size <= 0 {
+		size = DefaultMaxRequestSize
+	}
+	s.maxRequest = size
+}
+
+// SetTimeout sets how long a client has to send its request, and how long
+// writing the response may take (default DefaultTimeout). Clients that
+// stall are disconnected, so they cannot hold a connection or delay Stop.
+// A timeout of 0 or less keeps the default. Call it before Start.
+func (s *Server) SetTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	s.timeout = timeout
+}
+
+// SetMinProtocolVersion sets the oldest client protocol version the server
+// accepts (default MinProtocolVersion). Call it before Start.
+func (s *Server) SetMinProtocolVersion(version int) {
+	s.minVersion = version
+}
+
+// SetVersionCheck makes the server compare each client's release version
+// with the daemon's. A mismatch, e.g. after a partial upgrade, is logged as
+// a warning, or rejected when strict is true. Clients that send no version
+// count as a mismatch. Call it before Start.
+func (s *Server) SetVersionCheck(version string, strict bool) {
+	s.version = version
+	s.strict = strict
+}
+
+// IsAbstractSocket reports whether path names a Linux abstract namespace
+// socket ("@name"). Such sockets have no file, so nothing is left behind
+// after an unclean shutdown, but also no file permissions: any local process
+// in the same network namespace can connect.
+func IsAbstractSocket(path string) bool {
+	return runtime.GOOS == "linux" && strings.HasPrefix(path, "@")
+}
+
 // Start starts the IPC server
 func (s *Server) Start(ctx context.Context) error {
-	// Ensure the directory exists.
-	// Use 0750 so owner and group can traverse. Access control is
-	// enforced at the socket level (0660 for owner+group only).
-	dir := filepath.Dir(s.socketPath)
-	if err := os.MkdirAll(dir, 0750); err != nil {
-		return fmt.Errorf("failed to create socket directory: %w", err)
-	}
+	abstract := IsAbstractSocket(s.socketPath)
+	if !abstract {
+		// Ensure the directory exists.
+		// Use 0750 so owner and group can traverse. Access control is
+		// enforced at the socket level (0660 for owner+group only).
+		dir := filepath.Dir(s.socketPath)
+		if err := os.MkdirAll(dir, 0750); err != nil {
+			return fmt.Errorf("failed to create socket directory: %w", err)
+		}
 
-	// Remove old socket if it exists
-	if err := os.Remove(s.socketPath); err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("failed to remove old socket: %w", err)
+		// Remove old socket if it exists
+		if err := os.Remove(s.socketPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove old socket: %w", err)
+		}
 	}
 
 	// Create Unix listener
@@ -59,9 +195,12 @@ func (s *Server) Start(ctx context.Context) error {
 	// The daemon should run in the same group as OpenVPN (e.g., openvpn)
 	// so that the auth script can connect. World access is denied to
 	// prevent untrusted local users from submitting forged auth requests.
-	if err := os.Chmod(s.socketPath, 0660); err != nil { // #nosec G302 -- 0660 intentional: owner+group (openvpn) need socket access
-		_ = listener.Close()
-		return fmt.Errorf("failed to set socket permissions: %w", err)
+	// Abstract sockets have no permissions to set.
+	if !abstract {
+		if err := os.Chmod(s.socketPath, 0660); err != nil { // #nosec G302 -- 0660 intentional: owner+group (openvpn) need socket access
+			_ = listener.Close()
+			return fmt.Errorf("failed to set socket permissions: %w", err)
+		}
 	}
 
 	s.mu.Lock()
@@ -111,25 +250,142 @@ func (s *Server) handleConnection(ctx context.Context, conn net.Conn) {
 	defer s.wg.Done()
 	defer func() { _ = conn.Close() }()
 
-	// Decode request
-	var req AuthRequest
-	dec := json.NewDecoder(conn)
-	if err := dec.Decode(&req); err != nil {
+	// Refuse unauthorized clients before reading anything from them
+	if err := s.authorizeClient(conn); err != nil {
+		s.refuse(conn, err.Error())
+		return
+	}
+
+	// Decode request, then dispatch on its type. The size and read time
+	// are bounded so a local client cannot exhaust memory or connections.
+	if err := conn.SetReadDeadline(time.Now().Add(s.timeout)); err != nil {
+		slog.Error("failed to set read deadline", "error", err)
+		return
+	}
+	var raw json.RawMessage
+	var msg request
+	body := &io.LimitedReader{R: conn, N: s.maxRequest}
+	dec := json.NewDecoder(body)
+	if err := dec.Decode(&raw); err != nil {
+		if body.N <= 0 {
+			slog.Error("rejected oversized IPC request", "max_bytes", s.maxRequest)
+			s.sendErrorResponse(conn, fmt.Sprintf("request exceeds the maximum size of %d bytes", s.maxRequest))
+			return
+		}
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			slog.Warn("closing IPC connection: no request received in time", "timeout", s.timeout.String())
+			return
+		}
 		slog.Error("failed to decode request", "error", err)
 		s.sendErrorResponse(conn, "invalid request format")
 		return
 	}
+	if err := json.Unmarshal(raw, &msg); err != nil {
+		slog.Error("failed to decode request", "error", err)
+		s.sendErrorResponse(conn, "invalid request format")
+		return
+	}
+
+	// Reject outdated clients with a clear message instead of letting them
+	// misinterpret a newer protocol
+	if msg.ProtocolVersion < s.minVersion {
+		errMsg := fmt.Sprintf("auth binary speaks IPC protocol version %d but the daemon requires at least %d; "+
+			"upgrade the auth binary to match the daemon", msg.ProtocolVersion, s.minVersion)
+		slog.Error("rejected IPC client with outdated protocol version",
+			"type", sanitizeIPCValue(string(msg.Type)),
+			"protocol_version", msg.ProtocolVersion,
+			"min_protocol_version", s.minVersion,
+		)
+		s.reject(conn, msg.Type, errMsg)
+		return
+	}
 
-	// Validate request type
-	if req.Type != MessageTypeAuthRequest {
-		slog.Error("invalid request type", "type", req.Type)
+	if s.version != "" && msg.ClientVersion != s.version {
+		clientVersion := sanitizeIPCValue(msg.ClientVersion)
+		if clientVersion == "" {
+			clientVersion = "unknown"
+		}
+		if s.strict {
+			errMsg := fmt.Sprintf("auth binary version %s does not match daemon version %s; "+
+				"upgrade both to the same release", clientVersion, s.version)
+			slog.Error("rejected IPC client with mismatched version",
+				"type", sanitizeIPCValue(string(msg.Type)),
+				"client_version", clientVersion,
+				"daemon_version", s.version,
+			)
+			s.reject(conn, msg.Type, errMsg)
+			return
+		}
+		slog.Warn("IPC client version differs from daemon version",
+			"type", sanitizeIPCValue(string(msg.Type)),
+			"client_version", clientVersion,
+			"daemon_version", s.version,
+		)
+	}
+
+	switch msg.Type {
+	case MessageTypeAuthRequest:
+		s.handleAuthRequest(ctx, conn, raw)
+	case MessageTypeStatusQuery:
+		s.handleStatusQuery(ctx, conn, raw)
+	case MessageTypeListSessions:
+		s.handleListSessions(ctx, conn, raw)
+	case MessageTypeKillSession:
+		s.handleKillSession(ctx, conn, raw)
+	case MessageTypeCancel:
+		s.handleCancel(ctx, conn, raw)
+	default:
+		slog.Error("invalid request type", "type", sanitizeIPCValue(string(msg.Type)))
 		s.sendErrorResponse(conn, "invalid request type")
+	}
+}
+
+// reject answers a request of type msgType with errMsg, in the response
+// shape the client expects for that type.
+func (s *Server) reject(conn net.Conn, msgType MessageType, errMsg string) {
+	switch msgType {
+	case MessageTypeStatusQuery:
+		s.sendStatusError(conn, "", errMsg)
+	case MessageTypeListSessions:
+		s.sendResponse(conn, &ListSessionsResponse{Type: MessageTypeListSessionsResponse, ProtocolVersion: ProtocolVersion, Error: errMsg})
+	case MessageTypeKillSession:
+		s.sendResponse(conn, &KillSessionResponse{Type: MessageTypeKillSessionResponse, ProtocolVersion: ProtocolVersion, Error: errMsg})
+	case MessageTypeCancel:
+		s.sendResponse(conn, &CancelResponse{Type: MessageTypeCancelResponse, ProtocolVersion: ProtocolVersion, Error: errMsg})
+	default:
+		s.sendErrorResponse(conn, errMsg)
+	}
+}
+
+// refuse answers a client refused before its request was read with an
+// auth_response error, which every client accepts as the daemon's error
+// whatever it asked. The unread request is then discarded, bounded by the
+// request size and read deadline, so closing the connection does not break
+// the client's pipe before it has read the error.
+func (s *Server) refuse(conn net.Conn, errMsg string) {
+	s.sendErrorResponse(conn, errMsg)
+	if err := conn.SetReadDeadline(time.Now().Add(s.timeout)); err != nil {
+		return
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(conn, s.maxRequest))
+}
+
+// handleAuthRequest handles an auth_request message
+func (s *Server) handleAuthRequest(ctx context.Context, conn net.Conn, raw json.RawMessage) {
+	var req AuthRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		slog.Error("failed to decode request", "error", err)
+		s.sendErrorResponse(conn, "invalid request format")
 		return
 	}
 
+	req.CorrelationID = newCorrelationID()
+
 	// Username, IP and CommonName originate from the VPN client and client
 	// certificate, both of which are external inputs. Sanitize before logging.
 	slog.Info("auth request received",
+		"correlation_id", req.CorrelationID,
 		"username", sanitizeIPCValue(req.Username),
 		"ip", sanitizeIPCValue(req.UntrustedIP),
 		"common_name", sanitizeIPCValue(req.CommonName),
@@ -138,32 +394,256 @@ func (s *Server) handleConnection(ctx context.Context, conn net.Conn) {
 	// Call handler
 	resp, err := s.handler(ctx, &req)
 	if err != nil {
-		slog.Error("handler error", "error", err)
-		s.sendErrorResponse(conn, err.Error())
+		slog.Error("handler error", "correlation_id", req.CorrelationID, "error", err)
+		s.sendAuthError(conn, req.CorrelationID, err.Error())
 		return
 	}
 
 	// Send response
 	resp.Type = MessageTypeAuthResponse
-	enc := json.NewEncoder(conn)
-	if err := enc.Encode(resp); err != nil {
-		slog.Error("failed to send response", "error", err)
+	resp.ProtocolVersion = ProtocolVersion
+	resp.CorrelationID = req.CorrelationID
+	if err := s.encode(conn, resp); err != nil {
+		slog.Error("failed to send response", "correlation_id", req.CorrelationID, "error", err)
 		return
 	}
 
-	slog.Debug("auth response sent", "status", resp.Status, "session_id", resp.SessionID)
+	slog.Debug("auth response sent",
+		"correlation_id", req.CorrelationID,
+		"status", resp.Status,
+		"session_id", resp.SessionID,
+	)
+}
+
+// newCorrelationID returns a random ID for an auth request, or "" if none
+// can be generated; it only serves to correlate log lines.
+func newCorrelationID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
+
+// handleStatusQuery handles a status_query message
+func (s *Server) handleStatusQuery(ctx context.Context, conn net.Conn, raw json.RawMessage) {
+	var req StatusQuery
+	if err := json.Unmarshal(raw, &req); err != nil {
+		slog.Error("failed to decode status query", "error", err)
+		s.sendStatusError(conn, "", "invalid request format")
+		return
+	}
+
+	slog.Debug("status query received", "session_id", sanitizeIPCValue(req.SessionID))
+
+	if s.status == nil {
+		s.sendStatusError(conn, req.SessionID, "status queries not supported")
+		return
+	}
+
+	resp, err := s.status(ctx, &req)
+	if err != nil {
+		slog.Error("status handler error", "error", err)
+		s.sendStatusError(conn, req.SessionID, err.Error())
+		return
+	}
+
+	resp.Type = MessageTypeStatusResponse
+	resp.ProtocolVersion = ProtocolVersion
+	if err := s.encode(conn, resp); err != nil {
+		slog.Error("failed to send status response", "error", err)
+	}
+}
+
+// authorizeClient checks that the client on conn may use the socket at all
+// (see SetAllowedUIDs).
+func (s *Server) authorizeClient(conn net.Conn) error {
+	if s.allowed == nil {
+		return nil
+	}
+	uid, err := peerUID(conn)
+	if err != nil {
+		slog.Warn("rejected IPC client with unknown credentials", "error", err)
+		return fmt.Errorf("cannot verify client credentials: %w", err)
+	}
+	if !s.allowed[uid] && !s.privileged(uid) {
+		slog.Warn("rejected IPC client not in listen.socket_allowed_uids", "uid", uid)
+		return fmt.Errorf("permission denied: user %d may not use the daemon socket", uid)
+	}
+	return nil
+}
+
+// authorizePrivileged checks that the client on conn may list and kill
+// sessions.
+func (s *Server) authorizePrivileged(conn net.Conn) error {
+	uid, err := peerUID(conn)
+	if err != nil {
+		return fmt.Errorf("cannot verify client credentials: %w", err)
+	}
+	if !s.privileged(uid) {
+		slog.Warn("rejected session management request from unprivileged user", "uid", uid)
+		return fmt.Errorf("permission denied: session management requires root or the daemon user")
+	}
+	return nil
+}
+
+// handleListSessions handles a list_sessions message
+func (s *Server) handleListSessions(ctx context.Context, conn net.Conn, raw json.RawMessage) {
+	errResp := &ListSessionsResponse{Type: MessageTypeListSessionsResponse, ProtocolVersion: ProtocolVersion}
+
+	var req ListSessionsRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		slog.Error("failed to decode list_sessions request", "error", err)
+		errResp.Error = "invalid request format"
+		s.sendResponse(conn, errResp)
+		return
+	}
+	if err := s.authorizePrivileged(conn); err != nil {
+		errResp.Error = err.Error()
+		s.sendResponse(conn, errResp)
+		return
+	}
+	if s.list == nil {
+		errResp.Error = "session listing not supported"
+		s.sendResponse(conn, errResp)
+		return
+	}
+
+	resp, err := s.list(ctx, &req)
+	if err != nil {
+		slog.Error("list_sessions handler error", "error", err)
+		errResp.Error = err.Error()
+		s.sendResponse(conn, errResp)
+		return
+	}
+
+	resp.Type = MessageTypeListSessionsResponse
+	resp.ProtocolVersion = ProtocolVersion
+	s.sendResponse(conn, resp)
+}
+
+// handleKillSession handles a kill_session message
+func (s *Server) handleKillSession(ctx context.Context, conn net.Conn, raw json.RawMessage) {
+	errResp := &KillSessionResponse{Type: MessageTypeKillSessionResponse, ProtocolVersion: ProtocolVersion}
+
+	var req KillSessionRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		slog.Error("failed to decode kill_session request", "error", err)
+		errResp.Error = "invalid request format"
+		s.sendResponse(conn, errResp)
+		return
+	}
+	errResp.SessionID = req.SessionID
+	if err := s.authorizePrivileged(conn); err != nil {
+		errResp.Error = err.Error()
+		s.sendResponse(conn, errResp)
+		return
+	}
+	if s.kill == nil {
+		errResp.Error = "killing sessions not supported"
+		s.sendResponse(conn, errResp)
+		return
+	}
+
+	slog.Info("kill_session request received", "session_id", sanitizeIPCValue(req.SessionID))
+
+	resp, err := s.kill(ctx, &req)
+	if err != nil {
+		slog.Error("kill_session handler error", "error", err)
+		errResp.Error = err.Error()
+		s.sendResponse(conn, errResp)
+		return
+	}
+
+	resp.Type = MessageTypeKillSessionResponse
+	resp.ProtocolVersion = ProtocolVersion
+	s.sendResponse(conn, resp)
+}
+
+// handleCancel handles a cancel message. Like auth requests, it is accepted
+// from the auth script, so it is not restricted to privileged clients.
+func (s *Server) handleCancel(ctx context.Context, conn net.Conn, raw json.RawMessage) {
+	errResp := &CancelResponse{Type: MessageTypeCancelResponse, ProtocolVersion: ProtocolVersion}
+
+	var req CancelRequest
+	if err := json.Unmarshal(raw, &req); err != nil {
+		slog.Error("failed to decode cancel request", "error", err)
+		errResp.Error = "invalid request format"
+		s.sendResponse(conn, errResp)
+		return
+	}
+	if s.cancel == nil {
+		errResp.Error = "cancel requests not supported"
+		s.sendResponse(conn, errResp)
+		return
+	}
+
+	slog.Info("cancel request received",
+		"username", sanitizeIPCValue(req.Username),
+		"ip", sanitizeIPCValue(req.UntrustedIP),
+		"common_name", sanitizeIPCValue(req.CommonName),
+	)
+
+	resp, err := s.cancel(ctx, &req)
+	if err != nil {
+		slog.Error("cancel handler error", "error", err)
+		errResp.Error = err.Error()
+		s.sendResponse(conn, errResp)
+		return
+	}
+
+	resp.Type = MessageTypeCancelResponse
+	resp.ProtocolVersion = ProtocolVersion
+	s.sendResponse(conn, resp)
+}
+
+// encode writes v to the client, giving up after the server's timeout
+func (s *Server) encode(conn net.Conn, v interface{}) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(s.timeout)); err != nil {
+		return err
+	}
+	return json.NewEncoder(conn).Encode(v)
+}
+
+// sendResponse sends resp to the client
+func (s *Server) sendResponse(conn net.Conn, resp interface{}) {
+	if err := s.encode(conn, resp); err != nil {
+		slog.Error("failed to send response", "error", err)
+	}
+}
+
+// sendStatusError answers a status query with an error
+func (s *Server) sendStatusError(conn net.Conn, sessionID, errMsg string) {
+	resp := &StatusResponse{
+		Type:            MessageTypeStatusResponse,
+		ProtocolVersion: ProtocolVersion,
+		SessionID:       sessionID,
+		State:           SessionStateUnknown,
+		Error:           errMsg,
+	}
+
+	if err := s.encode(conn, resp); err != nil {
+		slog.Error("failed to send status error response", "error", err)
+	}
 }
 
 // sendErrorResponse sends an error response to the client
 func (s *Server) sendErrorResponse(conn net.Conn, errMsg string) {
+	s.sendAuthError(conn, "", errMsg)
+}
+
+// sendAuthError sends an error response for the auth request with
+// correlationID to the client
+func (s *Server) sendAuthError(conn net.Conn, correlationID, errMsg string) {
 	resp := &AuthResponse{
-		Type:   MessageTypeAuthResponse,
-		Status: StatusError,
-		Error:  errMsg,
+		Type:            MessageTypeAuthResponse,
+		ProtocolVersion: ProtocolVersion,
+		Status:          StatusError,
+		Error:           errMsg,
+		CorrelationID:   correlationID,
 	}
 
-	enc := json.NewEncoder(conn)
-	if err := enc.Encode(resp); err != nil {
+	if err := s.encode(conn, resp); err != nil {
 		slog.Error("failed to send error response", "error", err)
 	}
 }
@@ -188,8 +668,10 @@ func (s *Server) Stop() error {
 	s.wg.Wait()
 
 	// Remove socket file
-	if err := os.Remove(s.socketPath); err != nil && !os.IsNotExist(err) {
-		slog.Warn("failed to remove socket file", "error", err)
+	if !IsAbstractSocket(s.socketPath) {
+		if err := os.Remove(s.socketPath); err != nil && !os.IsNotExist(err) {
+			slog.Warn("failed to remove socket file", "error", err)
+		}
 	}
 
 	slog.Info("IPC server stopped")
@@ -0,0 +1,212 @@
+package metrics
+
+import (
+	"bufio"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// openMetricsContentType is the media type of the builtin backend's output.
+const openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// NewBuiltin creates a new Metrics instance that keeps its values in atomic
+// counters and serves them in the OpenMetrics text format, without going
+// through the Prometheus client library. It exposes the same metrics as New.
+// sessions may be nil if no session manager is available.
+func NewBuiltin(sessions SessionSource) *Metrics {
+	return newMetrics(&builtinBackend{}, sessions)
+}
+
+// builtinBackend keeps metrics in memory and encodes them itself.
+type builtinBackend struct {
+	counters   []*builtinCounter
+	histograms []*builtinHistogram
+	sessions   SessionSource
+}
+
+func (b *builtinBackend) counter(name, help string) counter {
+	c := &builtinCounter{name: namespace + "_" + strings.TrimSuffix(name, "_total"), help: help}
+	b.counters = append(b.counters, c)
+	return c
+}
+
+func (b *builtinBackend) histogram(name, help string, buckets []float64) histogram {
+	h := &builtinHistogram{
+		name:    namespace + "_" + name,
+		help:    help,
+		buckets: buckets,
+		series:  make(map[[2]string]*histogramSeries),
+	}
+	b.histograms = append(b.histograms, h)
+	return h
+}
+
+func (b *builtinBackend) sessionGauges(sessions SessionSource) {
+	b.sessions = sessions
+}
+
+func (b *builtinBackend) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", openMetricsContentType)
+		bw := bufio.NewWriter(w)
+		b.write(bw)
+		_ = bw.Flush()
+	})
+}
+
+// write encodes all metrics in the OpenMetrics text format.
+func (b *builtinBackend) write(w *bufio.Writer) {
+	for _, c := range b.counters {
+		writeHeader(w, c.name, "counter", c.help)
+		writeSample(w, c.name+"_total", "", float64(c.value.Load()))
+	}
+
+	if b.sessions != nil {
+		// One snapshot per scrape keeps the gauges consistent
+		stats := b.sessions.Stats()
+		for _, g := range sessionGauges {
+			name := namespace + "_" + g.name
+			writeHeader(w, name, "gauge", g.help)
+			writeSample(w, name, "", g.value(stats))
+		}
+	}
+
+	for _, h := range b.histograms {
+		writeHeader(w, h.name, "histogram", h.help)
+		h.write(w)
+	}
+
+	_, _ = w.WriteString("# EOF\n")
+}
+
+// builtinCounter is a counter backed by an atomic integer.
+type builtinCounter struct {
+	name  string // metric family name, without the _total suffix
+	help  string
+	value atomic.Uint64
+}
+
+func (c *builtinCounter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *builtinCounter) Value() float64 {
+	return float64(c.value.Load())
+}
+
+// builtinHistogram is a histogram with one series per outcome and method.
+type builtinHistogram struct {
+	name    string
+	help    string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[[2]string]*histogramSeries
+}
+
+// histogramSeries holds the observations of one label combination. counts
+// are per bucket (not cumulative), with a final entry for +Inf.
+type histogramSeries struct {
+	counts []uint64
+	sum    float64
+}
+
+func (h *builtinHistogram) Observe(outcome, method string, value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	key := [2]string{outcome, method}
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets)+1)}
+		h.series[key] = s
+	}
+
+	i, _ := slices.BinarySearch(h.buckets, value)
+	s.counts[i]++
+	s.sum += value
+}
+
+// write encodes the histogram's samples, with series in label order.
+func (h *builtinHistogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	keys := make([][2]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b [2]string) int {
+		if c := strings.Compare(a[0], b[0]); c != 0 {
+			return c
+		}
+		return strings.Compare(a[1], b[1])
+	})
+
+	for _, key := range keys {
+		s := h.series[key]
+		labels := `outcome="` + escapeLabelValue(key[0]) + `",method="` + escapeLabelValue(key[1]) + `"`
+
+		var cumulative uint64
+		for i, count := range s.counts {
+			cumulative += count
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			writeSample(w, h.name+"_bucket", labels+`,le="`+formatBound(le)+`"`, float64(cumulative))
+		}
+		writeSample(w, h.name+"_sum", labels, s.sum)
+		writeSample(w, h.name+"_count", labels, float64(cumulative))
+	}
+}
+
+// writeHeader writes the TYPE and HELP lines of a metric family.
+func writeHeader(w *bufio.Writer, name, typ, help string) {
+	_, _ = w.WriteString("# TYPE " + name + " " + typ + "\n")
+	_, _ = w.WriteString("# HELP " + name + " " + escapeHelp(help) + "\n")
+}
+
+// writeSample writes one sample line. labels is the already encoded label
+// set without braces, or empty.
+func writeSample(w *bufio.Writer, name, labels string, value float64) {
+	_, _ = w.WriteString(name)
+	if labels != "" {
+		_, _ = w.WriteString("{" + labels + "}")
+	}
+	_, _ = w.WriteString(" " + formatValue(value) + "\n")
+}
+
+// formatValue formats a sample value.
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// formatBound formats a bucket bound the way OpenMetrics expects for le
+// labels: with a decimal point, so "1" and "1.0" name the same bucket.
+func formatBound(v float64) string {
+	s := formatValue(v)
+	if strings.ContainsAny(s, ".eIN") {
+		return s
+	}
+	return s + ".0"
+}
+
+// openMetricsEscaper escapes label values and HELP text.
+var openMetricsEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string { return openMetricsEscaper.Replace(v) }
+func escapeHelp(v string) string       { return openMetricsEscaper.Replace(v) }
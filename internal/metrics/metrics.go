@@ -0,0 +1,327 @@
+// Package metrics exposes Prometheus metrics for the OpenVPN SSO daemon.
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/session"
+)
+
+// namespace is the common prefix for all metric names.
+const namespace = "openvpn_keycloak_auth"
+
+// Outcome labels for the auth duration histogram.
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	OutcomeTimeout = "timeout"
+)
+
+// authDurationBuckets covers a user completing the browser flow in a few
+// seconds up to the maximum session timeout (1 hour).
+var authDurationBuckets = []float64{1, 2, 5, 10, 15, 30, 60, 120, 300, 600, 1800, 3600}
+
+// Metrics holds the daemon's counters and histograms. With the Prometheus
+// backend (New) they live on a dedicated registry; a custom registry (instead
+// of the global default) keeps metrics hermetic per daemon instance, so tests
+// can create and inspect their own. The builtin backend (NewBuiltin) keeps
+// them in atomic counters instead.
+//
+// All methods are safe to call on a nil *Metrics, which makes metrics
+// optional for callers and tests.
+type Metrics struct {
+	registry *prometheus.Registry
+	handler  http.Handler
+
+	authRequests         counter
+	authDeferred         counter
+	authSucceeded        counter
+	authFailed           counter
+	roleValidationFailed counter
+	tokenExchangeFailed  counter
+	authDuration         histogram
+
+	// counters maps each counter's full metric name to it, for Counters
+	counters map[string]counter
+
+	// now returns the current time; replaceable in tests.
+	now func() time.Time
+}
+
+// SessionSource provides session statistics for the session gauges.
+// It is satisfied by *session.Manager.
+type SessionSource interface {
+	Stats() session.Stats
+}
+
+// counter is a monotonically increasing metric.
+type counter interface {
+	Inc()
+	Value() float64
+}
+
+// histogram is a metric observing values by outcome and method label.
+type histogram interface {
+	Observe(outcome, method string, value float64)
+}
+
+// backend creates the metrics of a Metrics instance and serves them.
+type backend interface {
+	counter(name, help string) counter
+	histogram(name, help string, buckets []float64) histogram
+	sessionGauges(sessions SessionSource)
+	handler() http.Handler
+}
+
+// New creates a new Metrics instance backed by the Prometheus client library.
+// sessions is sampled on every scrape to report the session gauges;
+// it may be nil if no session manager is available.
+func New(sessions SessionSource) *Metrics {
+	b := &prometheusBackend{registry: prometheus.NewRegistry()}
+	m := newMetrics(b, sessions)
+	m.registry = b.registry
+	return m
+}
+
+// newMetrics creates the daemon's metrics on b.
+func newMetrics(b backend, sessions SessionSource) *Metrics {
+	counters := make(map[string]counter)
+	newCounter := func(name, help string) counter {
+		c := b.counter(name, help)
+		counters[namespace+"_"+name] = c
+		return c
+	}
+
+	m := &Metrics{
+		authRequests: newCounter("auth_requests_total",
+			"Total number of auth requests received from the auth script."),
+		authDeferred: newCounter("auth_deferred_total",
+			"Total number of auth requests deferred to the browser flow."),
+		authSucceeded: newCounter("auth_succeeded_total",
+			"Total number of successful authentications."),
+		authFailed: newCounter("auth_failed_total",
+			"Total number of failed authentications."),
+		roleValidationFailed: newCounter("role_validation_failures_total",
+			"Total number of authentications rejected by role validation."),
+		tokenExchangeFailed: newCounter("token_exchange_failures_total",
+			"Total number of failed authorization code exchanges."),
+		authDuration: b.histogram("auth_duration_seconds",
+			"Time from the auth request to its final result, by outcome and pending auth method.",
+			authDurationBuckets),
+		counters: counters,
+		now:      time.Now,
+	}
+
+	if sessions != nil {
+		b.sessionGauges(sessions)
+	}
+	m.handler = b.handler()
+
+	return m
+}
+
+// Registry returns the underlying Prometheus registry, or nil when the
+// builtin backend is used.
+func (m *Metrics) Registry() *prometheus.Registry {
+	if m == nil {
+		return nil
+	}
+	return m.registry
+}
+
+// Handler returns an http.Handler that serves the metrics in the
+// Prometheus or OpenMetrics text format.
+func (m *Metrics) Handler() http.Handler {
+	if m == nil {
+		return http.NotFoundHandler()
+	}
+	return m.handler
+}
+
+// Counters returns the current value of every counter by its full metric
+// name (e.g. "openvpn_keycloak_auth_auth_failed_total"), or nil on a nil
+// *Metrics.
+func (m *Metrics) Counters() map[string]float64 {
+	if m == nil {
+		return nil
+	}
+	values := make(map[string]float64, len(m.counters))
+	for name, c := range m.counters {
+		values[name] = c.Value()
+	}
+	return values
+}
+
+// AuthRequestReceived increments the auth requests counter.
+func (m *Metrics) AuthRequestReceived() {
+	if m != nil {
+		m.authRequests.Inc()
+	}
+}
+
+// AuthDeferred increments the deferred auth counter.
+func (m *Metrics) AuthDeferred() {
+	if m != nil {
+		m.authDeferred.Inc()
+	}
+}
+
+// AuthSucceeded increments the successful auth counter.
+func (m *Metrics) AuthSucceeded() {
+	if m != nil {
+		m.authSucceeded.Inc()
+	}
+}
+
+// AuthFailed increments the failed auth counter.
+func (m *Metrics) AuthFailed() {
+	if m != nil {
+		m.authFailed.Inc()
+	}
+}
+
+// RoleValidationFailed increments the role validation failure counter.
+func (m *Metrics) RoleValidationFailed() {
+	if m != nil {
+		m.roleValidationFailed.Inc()
+	}
+}
+
+// TokenExchangeFailed increments the token exchange failure counter.
+func (m *Metrics) TokenExchangeFailed() {
+	if m != nil {
+		m.tokenExchangeFailed.Inc()
+	}
+}
+
+// AuthFinished records the end-to-end duration of an authentication, measured
+// from startedAt (the session's creation time) to now. outcome is one of the
+// Outcome* constants; method is the pending auth method sent to the client.
+func (m *Metrics) AuthFinished(outcome, method string, startedAt time.Time) {
+	if m == nil {
+		return
+	}
+	m.authDuration.Observe(outcome, methodLabel(method), m.now().Sub(startedAt).Seconds())
+}
+
+// methodLabel bounds the cardinality of the method label. The method comes
+// from the client's IV_SSO capabilities, so unknown values are grouped.
+func methodLabel(method string) string {
+	switch method {
+	case "webauth", "openurl":
+		return method
+	case "":
+		return "unknown"
+	default:
+		return "other"
+	}
+}
+
+// sessionGauges are the gauges derived from a session.Stats snapshot.
+var sessionGauges = []struct {
+	name  string
+	help  string
+	value func(session.Stats) float64
+}{
+	{"active_sessions", "Number of authentication sessions currently tracked.",
+		func(s session.Stats) float64 { return float64(s.Total) }},
+	{"pending_sessions", "Number of sessions waiting for the user to complete the browser flow.",
+		func(s session.Stats) float64 { return float64(s.Pending) }},
+	{"completed_sessions", "Number of tracked sessions whose result has been written.",
+		func(s session.Stats) float64 { return float64(s.Completed) }},
+	{"session_oldest_age_seconds", "Age of the oldest tracked session in seconds.",
+		func(s session.Stats) float64 { return s.OldestAge.Seconds() }},
+	{"session_average_age_seconds", "Average age of tracked sessions in seconds.",
+		func(s session.Stats) float64 { return s.AverageAge.Seconds() }},
+}
+
+// prometheusBackend registers metrics on a Prometheus registry.
+type prometheusBackend struct {
+	registry *prometheus.Registry
+}
+
+func (b *prometheusBackend) counter(name, help string) counter {
+	c := prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	})
+	b.registry.MustRegister(c)
+	return prometheusCounter{c}
+}
+
+func (b *prometheusBackend) histogram(name, help string, buckets []float64) histogram {
+	vec := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+		Buckets:   buckets,
+	}, []string{"outcome", "method"})
+	b.registry.MustRegister(vec)
+	return prometheusHistogram{vec}
+}
+
+func (b *prometheusBackend) sessionGauges(sessions SessionSource) {
+	b.registry.MustRegister(newSessionCollector(sessions))
+}
+
+func (b *prometheusBackend) handler() http.Handler {
+	return promhttp.HandlerFor(b.registry, promhttp.HandlerOpts{})
+}
+
+// prometheusCounter adapts a Counter to counter.
+type prometheusCounter struct {
+	prometheus.Counter
+}
+
+func (c prometheusCounter) Value() float64 {
+	var pb dto.Metric
+	if err := c.Write(&pb); err != nil {
+		return 0
+	}
+	return pb.GetCounter().GetValue()
+}
+
+// prometheusHistogram adapts a HistogramVec to histogram.
+type prometheusHistogram struct {
+	vec *prometheus.HistogramVec
+}
+
+func (h prometheusHistogram) Observe(outcome, method string, value float64) {
+	h.vec.WithLabelValues(outcome, method).Observe(value)
+}
+
+// sessionCollector reports session gauges from a single Stats() snapshot per
+// scrape, so all values are consistent with each other.
+type sessionCollector struct {
+	sessions SessionSource
+	descs    []*prometheus.Desc
+}
+
+func newSessionCollector(sessions SessionSource) *sessionCollector {
+	c := &sessionCollector{sessions: sessions}
+	for _, g := range sessionGauges {
+		c.descs = append(c.descs, prometheus.NewDesc(namespace+"_"+g.name, g.help, nil, nil))
+	}
+	return c
+}
+
+// Describe implements prometheus.Collector.
+func (c *sessionCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range c.descs {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *sessionCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.sessions.Stats()
+	for i, g := range sessionGauges {
+		ch <- prometheus.MustNewConstMetric(c.descs[i], prometheus.GaugeValue, g.value(stats))
+	}
+}
@@ -0,0 +1,393 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/session"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func gatherValues(t *testing.T, m *Metrics) map[string]float64 {
+	t.Helper()
+
+	families, err := m.Registry().Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+
+	values := make(map[string]float64, len(families))
+	for _, mf := range families {
+		for _, metric := range mf.GetMetric() {
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				values[mf.GetName()] = metric.GetCounter().GetValue()
+			case dto.MetricType_GAUGE:
+				values[mf.GetName()] = metric.GetGauge().GetValue()
+			}
+		}
+	}
+	return values
+}
+
+// fakeSessions is a SessionSource returning a fixed snapshot.
+type fakeSessions struct {
+	stats session.Stats
+}
+
+func (f *fakeSessions) Stats() session.Stats { return f.stats }
+
+func TestMetricsCounters(t *testing.T) {
+	sessions := &fakeSessions{stats: session.Stats{
+		Total:      3,
+		Pending:    2,
+		Completed:  1,
+		OldestAge:  90 * time.Second,
+		AverageAge: 30 * time.Second,
+	}}
+	m := New(sessions)
+
+	m.AuthRequestReceived()
+	m.AuthRequestReceived()
+	m.AuthDeferred()
+	m.AuthSucceeded()
+	m.AuthFailed()
+	m.AuthFailed()
+	m.RoleValidationFailed()
+	m.TokenExchangeFailed()
+
+	values := gatherValues(t, m)
+
+	want := map[string]float64{
+		"openvpn_keycloak_auth_auth_requests_total":            2,
+		"openvpn_keycloak_auth_auth_deferred_total":            1,
+		"openvpn_keycloak_auth_auth_succeeded_total":           1,
+		"openvpn_keycloak_auth_auth_failed_total":              2,
+		"openvpn_keycloak_auth_role_validation_failures_total": 1,
+		"openvpn_keycloak_auth_token_exchange_failures_total":  1,
+		"openvpn_keycloak_auth_active_sessions":                3,
+		"openvpn_keycloak_auth_pending_sessions":               2,
+		"openvpn_keycloak_auth_completed_sessions":             1,
+		"openvpn_keycloak_auth_session_oldest_age_seconds":     90,
+		"openvpn_keycloak_auth_session_average_age_seconds":    30,
+	}
+	for name, v := range want {
+		got, ok := values[name]
+		if !ok {
+			t.Errorf("metric %s not found", name)
+			continue
+		}
+		if got != v {
+			t.Errorf("%s = %v, want %v", name, got, v)
+		}
+	}
+
+	// Gauges are sampled at scrape time
+	sessions.stats.Total = 7
+	if got := gatherValues(t, m)["openvpn_keycloak_auth_active_sessions"]; got != 7 {
+		t.Errorf("active_sessions = %v, want 7", got)
+	}
+}
+
+func TestCountersSnapshot(t *testing.T) {
+	backends := []struct {
+		name string
+		new  func(SessionSource) *Metrics
+	}{
+		{"prometheus", New},
+		{"builtin", NewBuiltin},
+	}
+
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			m := b.new(nil)
+			m.AuthRequestReceived()
+			m.AuthRequestReceived()
+			m.AuthFailed()
+
+			got := m.Counters()
+			want := map[string]float64{
+				"openvpn_keycloak_auth_auth_requests_total":            2,
+				"openvpn_keycloak_auth_auth_deferred_total":            0,
+				"openvpn_keycloak_auth_auth_succeeded_total":           0,
+				"openvpn_keycloak_auth_auth_failed_total":              1,
+				"openvpn_keycloak_auth_role_validation_failures_total": 0,
+				"openvpn_keycloak_auth_token_exchange_failures_total":  0,
+			}
+			if len(got) != len(want) {
+				t.Errorf("Counters() has %d entries, want %d: %v", len(got), len(want), got)
+			}
+			for name, v := range want {
+				if got[name] != v {
+					t.Errorf("%s = %v, want %v", name, got[name], v)
+				}
+			}
+		})
+	}
+}
+
+func TestMetricsWithoutSessionGauge(t *testing.T) {
+	m := New(nil)
+
+	if _, ok := gatherValues(t, m)["openvpn_keycloak_auth_active_sessions"]; ok {
+		t.Error("expected no active_sessions gauge without a session counter")
+	}
+}
+
+func TestNilMetricsIsNoop(t *testing.T) {
+	var m *Metrics
+
+	// Must not panic
+	m.AuthRequestReceived()
+	m.AuthDeferred()
+	m.AuthSucceeded()
+	m.AuthFailed()
+	m.RoleValidationFailed()
+	m.TokenExchangeFailed()
+	m.AuthFinished(OutcomeSuccess, "webauth", time.Now())
+
+	if m.Registry() != nil {
+		t.Error("expected nil registry for nil metrics")
+	}
+	if m.Counters() != nil {
+		t.Error("expected nil counters for nil metrics")
+	}
+
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 from nil metrics handler, got %d", w.Code)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	m := New(&fakeSessions{})
+	m.AuthSucceeded()
+
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	body, _ := io.ReadAll(w.Result().Body)
+	if !strings.Contains(string(body), "openvpn_keycloak_auth_auth_succeeded_total 1") {
+		t.Errorf("expected succeeded counter in exposition output, got:\n%s", body)
+	}
+}
+
+// histogramFor returns the auth duration histogram for the given labels.
+func histogramFor(t *testing.T, m *Metrics, outcome, method string) *dto.Histogram {
+	t.Helper()
+
+	families, err := m.Registry().Gather()
+	if err != nil {
+		t.Fatalf("Gather failed: %v", err)
+	}
+
+	for _, mf := range families {
+		if mf.GetName() != "openvpn_keycloak_auth_auth_duration_seconds" {
+			continue
+		}
+		for _, metric := range mf.GetMetric() {
+			labels := map[string]string{}
+			for _, lp := range metric.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			if labels["outcome"] == outcome && labels["method"] == method {
+				return metric.GetHistogram()
+			}
+		}
+	}
+	t.Fatalf("no auth duration histogram for outcome=%q method=%q", outcome, method)
+	return nil
+}
+
+func TestAuthFinished(t *testing.T) {
+	m := New(nil)
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	m.now = func() time.Time { return now }
+
+	// 12s falls into the 15s bucket but not the 10s bucket
+	now = start.Add(12 * time.Second)
+	m.AuthFinished(OutcomeSuccess, "webauth", start)
+
+	h := histogramFor(t, m, OutcomeSuccess, "webauth")
+	if h.GetSampleCount() != 1 {
+		t.Fatalf("sample count = %d, want 1", h.GetSampleCount())
+	}
+	if h.GetSampleSum() != 12 {
+		t.Errorf("sample sum = %v, want 12", h.GetSampleSum())
+	}
+	for _, b := range h.GetBucket() {
+		want := uint64(0)
+		if b.GetUpperBound() >= 15 {
+			want = 1
+		}
+		if b.GetCumulativeCount() != want {
+			t.Errorf("bucket le=%v count = %d, want %d", b.GetUpperBound(), b.GetCumulativeCount(), want)
+		}
+	}
+
+	// Timeouts and unknown methods get their own series
+	now = start.Add(300 * time.Second)
+	m.AuthFinished(OutcomeTimeout, "custom-method", start)
+	if got := histogramFor(t, m, OutcomeTimeout, "other").GetSampleSum(); got != 300 {
+		t.Errorf("timeout sample sum = %v, want 300", got)
+	}
+
+	m.AuthFinished(OutcomeFailure, "", start)
+	if got := histogramFor(t, m, OutcomeFailure, "unknown").GetSampleCount(); got != 1 {
+		t.Errorf("failure sample count = %d, want 1", got)
+	}
+}
+
+// parseOpenMetrics parses OpenMetrics text into sample values keyed by the
+// series (name and label set as written) and checks the declared types.
+func parseOpenMetrics(t *testing.T, text string) (map[string]float64, map[string]string) {
+	t.Helper()
+
+	if !strings.HasSuffix(text, "# EOF\n") {
+		t.Fatalf("output does not end with # EOF:\n%s", text)
+	}
+
+	samples := make(map[string]float64)
+	types := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSuffix(text, "# EOF\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "# ") {
+			fields := strings.SplitN(line, " ", 4)
+			switch {
+			case len(fields) == 4 && fields[1] == "TYPE":
+				types[fields[2]] = fields[3]
+			case len(fields) >= 3 && fields[1] == "HELP":
+			default:
+				t.Fatalf("unexpected comment line %q", line)
+			}
+			continue
+		}
+
+		i := strings.LastIndexByte(line, ' ')
+		if i < 0 {
+			t.Fatalf("malformed sample line %q", line)
+		}
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("malformed value in %q: %v", line, err)
+		}
+		samples[line[:i]] = v
+	}
+	return samples, types
+}
+
+func TestBuiltinMetrics(t *testing.T) {
+	sessions := &fakeSessions{stats: session.Stats{
+		Total:     3,
+		Pending:   2,
+		Completed: 1,
+		OldestAge: 90 * time.Second,
+	}}
+	m := NewBuiltin(sessions)
+	if m.Registry() != nil {
+		t.Error("expected nil registry for builtin metrics")
+	}
+
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	now := start
+	m.now = func() time.Time { return now }
+
+	// Two flows succeed in the browser, one fails role validation
+	for i := 0; i < 3; i++ {
+		m.AuthRequestReceived()
+		m.AuthDeferred()
+	}
+	now = start.Add(12 * time.Second)
+	m.AuthSucceeded()
+	m.AuthFinished(OutcomeSuccess, "webauth", start)
+	now = start.Add(15 * time.Second)
+	m.AuthSucceeded()
+	m.AuthFinished(OutcomeSuccess, "webauth", start)
+	m.RoleValidationFailed()
+	m.AuthFailed()
+	m.AuthFinished(OutcomeFailure, "", start)
+
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text") {
+		t.Errorf("Content-Type = %q, want application/openmetrics-text", ct)
+	}
+
+	samples, types := parseOpenMetrics(t, w.Body.String())
+
+	wantTypes := map[string]string{
+		"openvpn_keycloak_auth_auth_requests":         "counter",
+		"openvpn_keycloak_auth_auth_failed":           "counter",
+		"openvpn_keycloak_auth_active_sessions":       "gauge",
+		"openvpn_keycloak_auth_auth_duration_seconds": "histogram",
+	}
+	for name, want := range wantTypes {
+		if got := types[name]; got != want {
+			t.Errorf("TYPE of %s = %q, want %q", name, got, want)
+		}
+	}
+
+	const duration = "openvpn_keycloak_auth_auth_duration_seconds"
+	success := `outcome="success",method="webauth"`
+	want := map[string]float64{
+		"openvpn_keycloak_auth_auth_requests_total":             3,
+		"openvpn_keycloak_auth_auth_deferred_total":             3,
+		"openvpn_keycloak_auth_auth_succeeded_total":            2,
+		"openvpn_keycloak_auth_auth_failed_total":               1,
+		"openvpn_keycloak_auth_role_validation_failures_total":  1,
+		"openvpn_keycloak_auth_token_exchange_failures_total":   0,
+		"openvpn_keycloak_auth_active_sessions":                 3,
+		"openvpn_keycloak_auth_pending_sessions":                2,
+		"openvpn_keycloak_auth_completed_sessions":              1,
+		"openvpn_keycloak_auth_session_oldest_age_seconds":      90,
+		"openvpn_keycloak_auth_session_average_age_seconds":     0,
+		duration + `_bucket{` + success + `,le="10.0"}`:         0,
+		duration + `_bucket{` + success + `,le="15.0"}`:         2,
+		duration + `_bucket{` + success + `,le="+Inf"}`:         2,
+		duration + `_sum{` + success + `}`:                      27,
+		duration + `_count{` + success + `}`:                    2,
+		duration + `_count{outcome="failure",method="unknown"}`: 1,
+	}
+	for series, v := range want {
+		got, ok := samples[series]
+		if !ok {
+			t.Errorf("series %s not found", series)
+			continue
+		}
+		if got != v {
+			t.Errorf("%s = %v, want %v", series, got, v)
+		}
+	}
+
+	// Gauges are sampled at scrape time
+	sessions.stats.Total = 7
+	w = httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if samples, _ := parseOpenMetrics(t, w.Body.String()); samples["openvpn_keycloak_auth_active_sessions"] != 7 {
+		t.Errorf("active_sessions = %v, want 7", samples["openvpn_keycloak_auth_active_sessions"])
+	}
+}
+
+func TestBuiltinMetricsWithoutSessionGauge(t *testing.T) {
+	m := NewBuiltin(nil)
+
+	w := httptest.NewRecorder()
+	m.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	samples, _ := parseOpenMetrics(t, w.Body.String())
+	if _, ok := samples["openvpn_keycloak_auth_active_sessions"]; ok {
+		t.Error("expected no active_sessions gauge without a session source")
+	}
+	if got := samples["openvpn_keycloak_auth_auth_requests_total"]; got != 0 {
+		t.Errorf("auth_requests_total = %v, want 0", got)
+	}
+}
@@ -0,0 +1,157 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// maxAdminResponseSize bounds admin API responses read into memory.
+const maxAdminResponseSize = 4 << 20 // 4 MiB
+
+// keycloakRole is the subset of Keycloak's RoleRepresentation we need.
+type keycloakRole struct {
+	Name string `json:"name"`
+}
+
+// keycloakClient is the subset of Keycloak's ClientRepresentation we need.
+type keycloakClient struct {
+	ID       string `json:"id"`
+	ClientID string `json:"clientId"`
+}
+
+// MissingRequiredRoles queries the Keycloak admin REST API and returns the
+// entries of required_roles that do not exist in the realm (for a
+// "realm_access.roles" role claim) or in the client (for a
+// "resource_access.<client>.roles" role claim). With role_claim_aggregate
+// (as set by role_claims), a role exists if it exists for role_claim or any
+// role_claim_fallbacks path. A wildcard entry is missing if
+// no existing role matches it.
+//
+// It authenticates with the admin_api service account using the client
+// credentials grant. This is a best-effort startup check for typos; callers
+// should log the result rather than refuse to start.
+func (p *Provider) MissingRequiredRoles(ctx context.Context) ([]string, error) {
+	if len(p.cfg.RequiredRoles) == 0 {
+		return nil, nil
+	}
+
+	adminURL, err := keycloakAdminURL(p.cfg.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	ccCfg := &clientcredentials.Config{
+		ClientID:     p.cfg.AdminAPI.ClientID,
+		ClientSecret: p.cfg.AdminAPI.ClientSecret,
+		TokenURL:     p.discovered().oidcProvider.Endpoint().TokenURL,
+	}
+	client := ccCfg.Client(ctx)
+
+	paths := []string{p.cfg.RoleClaim}
+	if p.cfg.RoleClaimAggregate {
+		paths = append(paths, p.cfg.RoleClaimFallbacks...)
+	}
+
+	var existing []string
+	for _, path := range paths {
+		roles, err := existingRoles(ctx, client, adminURL, path)
+		if err != nil {
+			return nil, err
+		}
+		existing = append(existing, roles...)
+	}
+
+	var missing []string
+	for _, role := range p.cfg.RequiredRoles {
+		if !containsRolePattern(existing, role, false) {
+			missing = append(missing, role)
+		}
+	}
+	return missing, nil
+}
+
+// existingRoles returns the names of the roles defined for the role claim
+// path: the realm roles for "realm_access.roles", the client's roles for
+// "resource_access.<client>.roles".
+func existingRoles(ctx context.Context, client *http.Client, adminURL, path string) ([]string, error) {
+	var rolesURL string
+	switch parts := strings.Split(path, "."); {
+	case path == "realm_access.roles":
+		rolesURL = adminURL + "/roles"
+	case len(parts) == 3 && parts[0] == "resource_access" && parts[2] == "roles":
+		id, err := lookupClientID(ctx, client, adminURL, parts[1])
+		if err != nil {
+			return nil, err
+		}
+		rolesURL = adminURL + "/clients/" + url.PathEscape(id) + "/roles"
+	default:
+		return nil, fmt.Errorf("cannot check roles for role_claim %q (supported: realm_access.roles, resource_access.<client>.roles)", path)
+	}
+
+	var roles []keycloakRole
+	if err := adminGet(ctx, client, rolesURL, &roles); err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(roles))
+	for _, r := range roles {
+		names = append(names, r.Name)
+	}
+	return names, nil
+}
+
+// keycloakAdminURL derives the admin API base URL of the realm from a
+// Keycloak issuer URL: https://host/realms/<realm> becomes
+// https://host/admin/realms/<realm>.
+func keycloakAdminURL(issuer string) (string, error) {
+	base, realm, found := strings.Cut(strings.TrimSuffix(issuer, "/"), "/realms/")
+	if !found || realm == "" || strings.Contains(realm, "/") {
+		return "", fmt.Errorf("issuer %q is not a Keycloak realm URL", issuer)
+	}
+	return base + "/admin/realms/" + realm, nil
+}
+
+// lookupClientID resolves a clientId to the client's internal ID.
+func lookupClientID(ctx context.Context, client *http.Client, adminURL, clientID string) (string, error) {
+	var clients []keycloakClient
+	if err := adminGet(ctx, client, adminURL+"/clients?clientId="+url.QueryEscape(clientID), &clients); err != nil {
+		return "", err
+	}
+	for _, c := range clients {
+		if c.ClientID == clientID {
+			return c.ID, nil
+		}
+	}
+	return "", fmt.Errorf("client %q not found in realm", clientID)
+}
+
+// adminGet performs a GET against the admin API and decodes the JSON body into v.
+func adminGet(ctx context.Context, client *http.Client, rawURL string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create admin API request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req) // #nosec G704 -- URL derived from configured issuer
+	if err != nil {
+		return fmt.Errorf("admin API request failed: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("admin API request failed: %s", resp.Status)
+	}
+
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxAdminResponseSize)).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode admin API response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package oidc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/oidc/oidctest"
+)
+
+// newTestAdminAPI starts a Keycloak-like server with discovery, a client
+// credentials token endpoint, and admin role listings.
+func newTestAdminAPI(t *testing.T) string {
+	t.Helper()
+
+	return oidctest.NewIssuer(t, func(w http.ResponseWriter, r *http.Request, _ string) bool {
+		if strings.HasPrefix(r.URL.Path, "/admin/") && r.Header.Get("Authorization") != "Bearer admin-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return true
+		}
+
+		switch r.URL.Path {
+		case oidctest.TokenPath:
+			if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "client_credentials" {
+				w.WriteHeader(http.StatusBadRequest)
+				return true
+			}
+			user, pass, ok := r.BasicAuth()
+			if !ok || user != "admin-client" || pass != "admin-secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return true
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token": "admin-token",
+				"token_type":   "Bearer",
+				"expires_in":   60,
+			})
+		case "/admin/realms/test/roles":
+			_ = json.NewEncoder(w).Encode([]map[string]string{
+				{"name": "vpn-user"},
+				{"name": "offline_access"},
+			})
+		case "/admin/realms/test/clients":
+			if r.URL.Query().Get("clientId") != "openvpn" {
+				_ = json.NewEncoder(w).Encode([]map[string]string{})
+				return true
+			}
+			_ = json.NewEncoder(w).Encode([]map[string]string{{"id": "c-123", "clientId": "openvpn"}})
+		case "/admin/realms/test/clients/c-123/roles":
+			_ = json.NewEncoder(w).Encode([]map[string]string{{"name": "vpn-admin"}})
+		default:
+			return false
+		}
+		return true
+	})
+}
+
+func TestMissingRequiredRoles(t *testing.T) {
+	issuer := newTestAdminAPI(t)
+
+	tests := []struct {
+		name            string
+		roleClaim       string
+		fallbacks       []string
+		requiredRoles   []string
+		adminSecret     string
+		want            []string
+		wantErrContains string
+	}{
+		{
+			name:          "all realm roles exist",
+			roleClaim:     "realm_access.roles",
+			requiredRoles: []string{"vpn-user"},
+		},
+		{
+			name:          "typo in realm role",
+			roleClaim:     "realm_access.roles",
+			requiredRoles: []string{"vpn-users", "vpn-user"},
+			want:          []string{"vpn-users"},
+		},
+		{
+			name:          "client roles",
+			roleClaim:     "resource_access.openvpn.roles",
+			requiredRoles: []string{"vpn-admin", "vpn-user"},
+			want:          []string{"vpn-user"},
+		},
+		{
+			name:          "roles across aggregated paths",
+			roleClaim:     "realm_access.roles",
+			fallbacks:     []string{"resource_access.openvpn.roles"},
+			requiredRoles: []string{"vpn-admin", "vpn-user", "vpn-users"},
+			want:          []string{"vpn-users"},
+		},
+		{
+			name:            "unsupported aggregated path",
+			roleClaim:       "realm_access.roles",
+			fallbacks:       []string{"roles"},
+			requiredRoles:   []string{"vpn-user"},
+			wantErrContains: "cannot check roles for role_claim \"roles\"",
+		},
+		{
+			name:          "wildcard roles",
+			roleClaim:     "realm_access.roles",
+			requiredRoles: []string{"vpn-*", "site-*"},
+			want:          []string{"site-*"},
+		},
+		{
+			name:            "unknown client",
+			roleClaim:       "resource_access.other.roles",
+			requiredRoles:   []string{"vpn-admin"},
+			wantErrContains: "client \"other\" not found",
+		},
+		{
+			name:            "unsupported role claim",
+			roleClaim:       "roles",
+			requiredRoles:   []string{"vpn-user"},
+			wantErrContains: "cannot check roles",
+		},
+		{
+			name:            "bad admin credentials",
+			roleClaim:       "realm_access.roles",
+			requiredRoles:   []string{"vpn-user"},
+			adminSecret:     "wrong",
+			wantErrContains: "admin API request failed",
+		},
+		{
+			name:      "no required roles",
+			roleClaim: "realm_access.roles",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			secret := tt.adminSecret
+			if secret == "" {
+				secret = "admin-secret"
+			}
+
+			p, err := NewProvider(context.Background(), &config.OIDCConfig{
+				Issuer:             issuer,
+				ClientID:           "openvpn",
+				RedirectURI:        "http://localhost/callback",
+				Scopes:             []string{"openid"},
+				RequiredRoles:      tt.requiredRoles,
+				RoleClaim:          tt.roleClaim,
+				RoleClaimFallbacks: tt.fallbacks,
+				RoleClaimAggregate: len(tt.fallbacks) > 0,
+				AdminAPI: config.AdminAPIConfig{
+					Enabled:      true,
+					ClientID:     "admin-client",
+					ClientSecret: secret,
+				},
+			})
+			if err != nil {
+				t.Fatalf("NewProvider failed: %v", err)
+			}
+
+			missing, err := p.MissingRequiredRoles(context.Background())
+			if tt.wantErrContains != "" {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				if !strings.Contains(err.Error(), tt.wantErrContains) {
+					t.Errorf("error = %v, want error containing %q", err, tt.wantErrContains)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(missing, tt.want) {
+				t.Errorf("missing = %v, want %v", missing, tt.want)
+			}
+		})
+	}
+}
+
+func TestKeycloakAdminURL(t *testing.T) {
+	tests := []struct {
+		issuer  string
+		want    string
+		wantErr bool
+	}{
+		{"https://kc.example.com/realms/corp", "https://kc.example.com/admin/realms/corp", false},
+		{"https://kc.example.com/auth/realms/corp/", "https://kc.example.com/auth/admin/realms/corp", false},
+		{"https://idp.example.com/oauth2", "", true},
+	}
+
+	for _, tt := range tests {
+		got, err := keycloakAdminURL(tt.issuer)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("keycloakAdminURL(%q) error = %v, wantErr %v", tt.issuer, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("keycloakAdminURL(%q) = %q, want %q", tt.issuer, got, tt.want)
+		}
+	}
+}
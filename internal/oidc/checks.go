@@ -0,0 +1,69 @@
+package oidc
+
+import "fmt"
+
+// CheckKind identifies one of the claim checks run on a callback.
+type CheckKind int
+
+const (
+	CheckAuthTime      CheckKind = iota // oidc.max_age
+	CheckACR                            // oidc.required_acr
+	CheckAuthorization                  // roles, groups, denied roles and instance roles
+	CheckUsername                       // username claim against the client's username
+	CheckCommonName                     // auth.cn_claim against the certificate common name
+)
+
+// CheckInput is the connection a token is checked against.
+type CheckInput struct {
+	Username          string // username the client sent
+	CommonName        string // client certificate common name
+	Instance          string // OpenVPN server instance, if any
+	AccessTokenOpaque bool   // see TokenData.AccessTokenOpaque
+}
+
+// Check is the outcome of one claim check.
+type Check struct {
+	Kind    CheckKind
+	Name    string // what was checked, for diagnostics
+	Err     error
+	Skipped string // reason the check did not run, if it did not
+}
+
+// Checks runs the claim checks of a callback and returns their outcomes in
+// the order the daemon applies them: auth time, authentication context,
+// roles and groups, instance roles, username and common name. The daemon
+// rejects a login at the first failure; test-auth and validate-token
+// report every check. The instance roles check is listed only for an
+// instance, and the common name check only with auth.require_cn_match.
+func (v *Validator) Checks(claims map[string]interface{}, in CheckInput) []Check {
+	authzErr := v.CheckRolesAvailable(claims, in.AccessTokenOpaque)
+	if authzErr == nil {
+		authzErr = v.ValidateAuthorization(claims)
+	}
+
+	checks := []Check{
+		{Kind: CheckAuthTime, Name: "auth time (oidc.max_age)", Err: v.ValidateAuthTime(claims)},
+		{Kind: CheckACR, Name: "authentication context (oidc.required_acr)", Err: v.ValidateACR(claims)},
+		{Kind: CheckAuthorization, Name: "roles and groups", Err: authzErr},
+	}
+	if in.Instance != "" {
+		checks = append(checks, Check{
+			Kind: CheckAuthorization,
+			Name: fmt.Sprintf("instance roles (%s)", in.Instance),
+			Err:  v.ValidateInstanceRoles(claims, in.Instance),
+		})
+	}
+	if v.authCfg.AllowUsernameMismatch {
+		checks = append(checks, Check{Kind: CheckUsername, Name: "username", Skipped: "auth.allow_username_mismatch is set"})
+	} else {
+		checks = append(checks, Check{Kind: CheckUsername, Name: "username", Err: v.ValidateUsername(claims, in.Username)})
+	}
+	if v.authCfg.RequireCNMatch {
+		checks = append(checks, Check{
+			Kind: CheckCommonName,
+			Name: "common name (auth.require_cn_match)",
+			Err:  v.ValidateCommonName(claims, in.CommonName),
+		})
+	}
+	return checks
+}
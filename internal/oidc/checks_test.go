@@ -0,0 +1,57 @@
+package oidc
+
+import (
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
+)
+
+func TestChecks(t *testing.T) {
+	claims := map[string]interface{}{
+		"preferred_username": "alice",
+		"realm_access":       map[string]interface{}{"roles": []interface{}{"vpn-user"}},
+	}
+
+	validator := NewValidator(&config.OIDCConfig{
+		RoleClaim:             "realm_access.roles",
+		RequiredRoles:         []string{"vpn-user"},
+		RequiredACR:           []string{"gold"},
+		InstanceRequiredRoles: map[string][]string{"admin": {"vpn-admin"}},
+	}, &config.AuthConfig{UsernameClaim: "preferred_username", RequireCNMatch: true})
+
+	checks := validator.Checks(claims, CheckInput{Username: "alice", CommonName: "alice", Instance: "admin"})
+
+	var kinds []CheckKind
+	var failed []string
+	for _, c := range checks {
+		kinds = append(kinds, c.Kind)
+		if c.Err != nil {
+			failed = append(failed, c.Name)
+		}
+	}
+	wantKinds := []CheckKind{CheckAuthTime, CheckACR, CheckAuthorization, CheckAuthorization, CheckUsername, CheckCommonName}
+	if !slices.Equal(kinds, wantKinds) {
+		t.Errorf("kinds = %v, want %v", kinds, wantKinds)
+	}
+	wantFailed := []string{"authentication context (oidc.required_acr)", "instance roles (admin)"}
+	if !slices.Equal(failed, wantFailed) {
+		t.Errorf("failed = %v, want %v", failed, wantFailed)
+	}
+	if !errors.Is(checks[1].Err, ErrACRNotMet) {
+		t.Errorf("ACR check error = %v, want %v", checks[1].Err, ErrACRNotMet)
+	}
+
+	// Without an instance or required common name those checks are not
+	// listed; an allowed username mismatch is skipped
+	validator = NewValidator(&config.OIDCConfig{RoleClaim: "realm_access.roles"},
+		&config.AuthConfig{UsernameClaim: "preferred_username", AllowUsernameMismatch: true})
+	checks = validator.Checks(claims, CheckInput{Username: "bob"})
+	if len(checks) != 4 {
+		t.Fatalf("got %d checks, want 4", len(checks))
+	}
+	if last := checks[3]; last.Kind != CheckUsername || last.Skipped == "" || last.Err != nil {
+		t.Errorf("username check = %+v, want skipped", last)
+	}
+}
@@ -0,0 +1,130 @@
+package oidc
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
+)
+
+// ClaimPath is a configured dot-notation claim path and the config key it
+// came from.
+type ClaimPath struct {
+	Key  string // Config key, e.g. "oidc.role_claim"
+	Path string // Dot-notation path, e.g. "realm_access.roles"
+}
+
+// ConfiguredClaimPaths returns every claim path the validator reads from
+// tokens, in the order they are listed in the config file.
+func ConfiguredClaimPaths(cfg *config.Config) []ClaimPath {
+	paths := []ClaimPath{
+		{Key: "auth.username_claim", Path: cfg.Auth.UsernameClaim},
+	}
+	// role_claims was folded into role_claim and role_claim_fallbacks on
+	// load; name the setting the paths came from
+	if len(cfg.OIDC.RoleClaims) > 0 {
+		for i, p := range cfg.OIDC.RoleClaims {
+			paths = append(paths, ClaimPath{Key: fmt.Sprintf("oidc.role_claims[%d]", i), Path: p})
+		}
+	} else {
+		paths = append(paths, ClaimPath{Key: "oidc.role_claim", Path: cfg.OIDC.RoleClaim})
+		for i, p := range cfg.OIDC.RoleClaimFallbacks {
+			paths = append(paths, ClaimPath{Key: fmt.Sprintf("oidc.role_claim_fallbacks[%d]", i), Path: p})
+		}
+	}
+	if cfg.OIDC.GroupClaim != "" {
+		paths = append(paths, ClaimPath{Key: "oidc.group_claim", Path: cfg.OIDC.GroupClaim})
+	}
+	if cfg.Auth.CNClaim != "" {
+		paths = append(paths, ClaimPath{Key: "auth.cn_claim", Path: cfg.Auth.CNClaim})
+	}
+	for i, p := range cfg.Auth.ContextClaims {
+		paths = append(paths, ClaimPath{Key: fmt.Sprintf("auth.context_claims[%d]", i), Path: p})
+	}
+	for _, p := range cfg.OIDC.Providers {
+		if p.RoleClaim != "" {
+			paths = append(paths, ClaimPath{Key: fmt.Sprintf("oidc.providers[%s].role_claim", p.Name), Path: p.RoleClaim})
+		}
+	}
+	return paths
+}
+
+// ValidateClaimPath checks that path is well-formed dot notation: non-empty,
+// no empty segments (leading, trailing or doubled dots) and no whitespace.
+func ValidateClaimPath(path string) error {
+	if path == "" {
+		return fmt.Errorf("claim path is empty")
+	}
+	for i, part := range strings.Split(path, ".") {
+		if part == "" {
+			return fmt.Errorf("claim path '%s' has an empty segment at position %d", path, i)
+		}
+		if strings.IndexFunc(part, unicode.IsSpace) >= 0 {
+			return fmt.Errorf("claim path '%s' contains whitespace in segment '%s'", path, part)
+		}
+	}
+	return nil
+}
+
+// ResolveClaim returns the value at a dot-notation path in claims.
+func ResolveClaim(claims map[string]interface{}, path string) (interface{}, error) {
+	return getNestedClaim(claims, path)
+}
+
+// ContextClaims returns the values of the given claim paths as strings, keyed
+// by path. Absent claims are omitted; list values are joined with commas.
+// Values come straight from the token and must be sanitized before logging.
+func ContextClaims(claims map[string]interface{}, paths []string) map[string]string {
+	values := make(map[string]string, len(paths))
+	for _, path := range paths {
+		value, err := getNestedClaim(claims, path)
+		if err != nil || value == nil {
+			continue
+		}
+		switch v := value.(type) {
+		case string:
+			values[path] = v
+		case []interface{}:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[path] = strings.Join(items, ",")
+		default:
+			values[path] = fmt.Sprint(v)
+		}
+	}
+	return values
+}
+
+// ParseSampleClaims decodes the claims of a sample token for offline
+// inspection. data may be a JWT (the payload is decoded, the signature is NOT
+// verified) or a JSON object of claims.
+func ParseSampleClaims(data []byte) (map[string]interface{}, error) {
+	raw := strings.TrimSpace(string(data))
+	if raw == "" {
+		return nil, fmt.Errorf("sample token is empty")
+	}
+
+	payload := []byte(raw)
+	if !strings.HasPrefix(raw, "{") {
+		parts := strings.Split(raw, ".")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("sample token is neither a JSON object nor a JWT (expected 3 parts, got %d)", len(parts))
+		}
+		decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode JWT payload: %w", err)
+		}
+		payload = decoded
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, fmt.Errorf("failed to parse token claims: %w", err)
+	}
+	return claims, nil
+}
@@ -0,0 +1,144 @@
+package oidc
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
+)
+
+func TestValidateClaimPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		path    string
+		wantErr string
+	}{
+		{name: "simple claim", path: "preferred_username"},
+		{name: "nested claim", path: "realm_access.roles"},
+		{name: "client roles", path: "resource_access.openvpn.roles"},
+		{name: "empty", path: "", wantErr: "empty"},
+		{name: "leading dot", path: ".roles", wantErr: "empty segment at position 0"},
+		{name: "trailing dot", path: "realm_access.", wantErr: "empty segment at position 1"},
+		{name: "double dot", path: "resource_access..roles", wantErr: "empty segment at position 1"},
+		{name: "whitespace", path: "realm_access. roles", wantErr: "whitespace"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateClaimPath(tt.path)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfiguredClaimPaths(t *testing.T) {
+	cfg := &config.Config{
+		OIDC: config.OIDCConfig{
+			RoleClaim:          "realm_access.roles",
+			RoleClaimFallbacks: []string{"roles"},
+			GroupClaim:         "groups",
+			Providers: []config.OIDCProviderConfig{
+				{Name: "partners", RoleClaim: "resource_access.partners.roles"},
+				{Name: "staff"},
+			},
+		},
+		Auth: config.AuthConfig{
+			UsernameClaim: "preferred_username",
+			CNClaim:       "login",
+			ContextClaims: []string{"department"},
+		},
+	}
+
+	want := []ClaimPath{
+		{Key: "auth.username_claim", Path: "preferred_username"},
+		{Key: "oidc.role_claim", Path: "realm_access.roles"},
+		{Key: "oidc.role_claim_fallbacks[0]", Path: "roles"},
+		{Key: "oidc.group_claim", Path: "groups"},
+		{Key: "auth.cn_claim", Path: "login"},
+		{Key: "auth.context_claims[0]", Path: "department"},
+		{Key: "oidc.providers[partners].role_claim", Path: "resource_access.partners.roles"},
+	}
+	if got := ConfiguredClaimPaths(cfg); !reflect.DeepEqual(got, want) {
+		t.Errorf("ConfiguredClaimPaths() = %v, want %v", got, want)
+	}
+}
+
+func TestContextClaims(t *testing.T) {
+	claims := map[string]interface{}{
+		"department": "Engineering",
+		"office":     map[string]interface{}{"city": "Berlin"},
+		"teams":      []interface{}{"vpn", "infra"},
+		"employee":   float64(4711),
+	}
+
+	got := ContextClaims(claims, []string{"department", "office.city", "teams", "employee", "title", "office.floor"})
+	want := map[string]string{
+		"department":  "Engineering",
+		"office.city": "Berlin",
+		"teams":       "vpn,infra",
+		"employee":    "4711",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ContextClaims() = %v, want %v", got, want)
+	}
+
+	if got := ContextClaims(claims, nil); len(got) != 0 {
+		t.Errorf("ContextClaims(nil) = %v, want empty", got)
+	}
+}
+
+func TestParseSampleClaims(t *testing.T) {
+	payload := `{"preferred_username":"john","realm_access":{"roles":["vpn-user"]}}`
+	jwt := "eyJhbGciOiJSUzI1NiJ9." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".c2ln"
+
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{name: "JWT", data: jwt},
+		{name: "JWT with trailing newline", data: jwt + "\n"},
+		{name: "JSON claims", data: payload},
+		{name: "empty", data: "  \n", wantErr: "empty"},
+		{name: "not a JWT", data: "abc.def", wantErr: "expected 3 parts"},
+		{name: "bad payload encoding", data: "a.!!!.c", wantErr: "decode JWT payload"},
+		{name: "invalid JSON", data: "{not json", wantErr: "parse token claims"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := ParseSampleClaims([]byte(tt.data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			username, err := ResolveClaim(claims, "preferred_username")
+			if err != nil || username != "john" {
+				t.Errorf("preferred_username = %v (err %v), want john", username, err)
+			}
+			roles, err := ResolveClaim(claims, "realm_access.roles")
+			if err != nil || !reflect.DeepEqual(roles, []interface{}{"vpn-user"}) {
+				t.Errorf("realm_access.roles = %v (err %v), want [vpn-user]", roles, err)
+			}
+			if _, err := ResolveClaim(claims, "resource_access.openvpn.roles"); err == nil {
+				t.Error("expected error resolving missing claim path")
+			}
+		})
+	}
+}
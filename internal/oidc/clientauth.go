@@ -0,0 +1,136 @@
+package oidc
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"golang.org/x/oauth2"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
+)
+
+const (
+	// clientAssertionType is the client_assertion_type of a JWT client
+	// assertion (RFC 7523, section 2.2).
+	clientAssertionType = "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"
+
+	// clientAssertionLifetime is how long a client assertion is valid.
+	// It is only used for the token request it is created for.
+	clientAssertionLifetime = time.Minute
+)
+
+// clientAssertion signs the JWT that authenticates the client at the token
+// endpoint for client_secret_jwt and private_key_jwt.
+type clientAssertion struct {
+	clientID string
+	signer   jose.Signer
+}
+
+// newClientAssertion returns the assertion signer for cfg's
+// client_auth_method, or nil if the method does not use an assertion.
+// For private_key_jwt it loads client_assertion_key_file.
+func newClientAssertion(cfg *config.OIDCConfig) (*clientAssertion, error) {
+	var key jose.SigningKey
+	switch cfg.ClientAuthMethod {
+	case config.ClientAuthMethodSecretJWT:
+		key = jose.SigningKey{Algorithm: jose.HS256, Key: []byte(cfg.ClientSecret)}
+	case config.ClientAuthMethodPrivateKeyJWT:
+		k, alg, err := loadAssertionKey(cfg.ClientAssertionKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load oidc.client_assertion_key_file: %w", err)
+		}
+		key = jose.SigningKey{Algorithm: alg, Key: k}
+	default:
+		return nil, nil
+	}
+
+	opts := (&jose.SignerOptions{}).WithType("JWT")
+	if cfg.ClientAssertionKeyID != "" {
+		opts = opts.WithHeader(jose.HeaderKey("kid"), cfg.ClientAssertionKeyID)
+	}
+	signer, err := jose.NewSigner(key, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client assertion signer: %w", err)
+	}
+	return &clientAssertion{clientID: cfg.ClientID, signer: signer}, nil
+}
+
+// options returns the token request parameters carrying a new assertion for
+// the token endpoint at audience.
+func (a *clientAssertion) options(audience string) ([]oauth2.AuthCodeOption, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return nil, fmt.Errorf("failed to generate client assertion ID: %w", err)
+	}
+
+	now := time.Now()
+	assertion, err := jwt.Signed(a.signer).Claims(jwt.Claims{
+		Issuer:   a.clientID,
+		Subject:  a.clientID,
+		Audience: jwt.Audience{audience},
+		ID:       base64.RawURLEncoding.EncodeToString(jti),
+		IssuedAt: jwt.NewNumericDate(now),
+		Expiry:   jwt.NewNumericDate(now.Add(clientAssertionLifetime)),
+	}).Serialize()
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign client assertion: %w", err)
+	}
+
+	return []oauth2.AuthCodeOption{
+		oauth2.SetAuthURLParam("client_assertion_type", clientAssertionType),
+		oauth2.SetAuthURLParam("client_assertion", assertion),
+	}, nil
+}
+
+// loadAssertionKey reads a PEM private key (PKCS#1, PKCS#8 or SEC 1) and
+// returns it with the signing algorithm matching its type: RS256 for RSA,
+// ES256/ES384/ES512 for EC keys by curve.
+func loadAssertionKey(path string) (interface{}, jose.SignatureAlgorithm, error) {
+	data, err := os.ReadFile(filepath.Clean(path)) // #nosec G304 -- path from trusted config file
+	if err != nil {
+		return nil, "", err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, "", fmt.Errorf("%s contains no PEM data", path)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, jose.RS256, nil
+	case *ecdsa.PrivateKey:
+		switch k.Curve.Params().BitSize {
+		case 256:
+			return k, jose.ES256, nil
+		case 384:
+			return k, jose.ES384, nil
+		case 521:
+			return k, jose.ES512, nil
+		}
+		return nil, "", fmt.Errorf("unsupported EC curve %s in %s", k.Curve.Params().Name, path)
+	}
+	return nil, "", fmt.Errorf("unsupported key type %T in %s (need RSA or EC)", key, path)
+}
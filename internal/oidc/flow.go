@@ -4,14 +4,22 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	mrand "math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	gooidc "github.com/coreos/go-oidc/v3/oidc"
 	"golang.org/x/oauth2"
 )
 
@@ -23,6 +31,10 @@ type AuthFlowData struct {
 	// CodeVerifier is the PKCE code verifier (must be stored for token exchange)
 	CodeVerifier string
 
+	// Nonce is sent in the authorization request and must come back in the
+	// ID token (must be stored for token exchange)
+	Nonce string
+
 	// AuthURL is the complete authorization URL to redirect the user to
 	AuthURL string
 }
@@ -44,10 +56,33 @@ type TokenData struct {
 
 	// Expiry is when the access token expires
 	Expiry time.Time
+
+	// AccessTokenOpaque is set when the access token is not a JWT, so no
+	// claims could be merged from it. It is never set when merging is
+	// disabled.
+	AccessTokenOpaque bool
 }
 
+// ErrNonceMismatch is returned by ExchangeCode when the ID token's nonce
+// claim is not the one sent in the authorization request, e.g. because a
+// token issued for another login was replayed.
+var ErrNonceMismatch = errors.New("ID token nonce does not match")
+
+// ErrTokenVerification is wrapped by ExchangeCode errors for an ID token that
+// fails verification (signature, issuer, audience, expiry or issue time).
+var ErrTokenVerification = errors.New("failed to verify ID token")
+
+// ErrCodeExpired is wrapped by ExchangeCode errors when the token endpoint
+// rejects the authorization code with invalid_grant, typically because the
+// user took longer than the code lifetime to finish the login.
+var ErrCodeExpired = errors.New("authorization code is invalid or expired")
+
+// ErrTokenExchangeTimeout is wrapped by ExchangeCode errors when the exchange
+// and verification did not finish within oidc.token_exchange_timeout.
+var ErrTokenExchangeTimeout = errors.New("token exchange timed out")
+
 // StartAuthFlow initiates an OIDC authorization flow with PKCE.
-// It generates the PKCE verifier/challenge and state parameter,
+// It generates the PKCE verifier/challenge, state and nonce parameters,
 // constructs the authorization URL, and returns the flow data.
 func (p *Provider) StartAuthFlow(ctx context.Context) (*AuthFlowData, error) {
 	// Generate PKCE verifier and challenge
@@ -59,33 +94,81 @@ func (p *Provider) StartAuthFlow(ctx context.Context) (*AuthFlowData, error) {
 	challenge := generateCodeChallenge(verifier)
 
 	// Generate state for CSRF protection
-	state, err := generateState()
+	state, err := generateState(p.cfg.StateInstanceID(), p.cfg.StateSecret)
 	if err != nil {
 		return nil, fmt.Errorf("failed to generate state: %w", err)
 	}
 
+	// Generate nonce to bind the ID token to this flow
+	nonce, err := generateNonce()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
 	// Construct authorization URL with PKCE parameters
-	authURL := p.oauth2Config.AuthCodeURL(state,
+	opts := []oauth2.AuthCodeOption{
 		oauth2.SetAuthURLParam("code_challenge", challenge),
 		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
-	)
+		oauth2.SetAuthURLParam("nonce", nonce),
+	}
+	if p.cfg.MaxAge > 0 {
+		opts = append(opts, oauth2.SetAuthURLParam("max_age", strconv.Itoa(p.cfg.MaxAge)))
+	}
+	if len(p.cfg.ACRValues) > 0 {
+		opts = append(opts, oauth2.SetAuthURLParam("acr_values", strings.Join(p.cfg.ACRValues, " ")))
+	}
+	authURL := p.discovered().oauth2Config.AuthCodeURL(state, opts...)
 
 	return &AuthFlowData{
 		State:        state,
 		CodeVerifier: verifier,
+		Nonce:        nonce,
 		AuthURL:      authURL,
 	}, nil
 }
 
 // ExchangeCode exchanges an authorization code for tokens.
 // It uses the PKCE code verifier to complete the flow.
-// The ID token is verified (signature, issuer, audience, expiry) before returning.
-func (p *Provider) ExchangeCode(ctx context.Context, code, codeVerifier string) (*TokenData, error) {
+// The ID token is verified (signature, issuer, audience, expiry) before
+// returning, and its nonce claim must equal nonce (ErrNonceMismatch). An
+// empty nonce skips the nonce check, for sessions started before nonces
+// were stored.
+// The whole exchange, including ID token verification and the UserInfo
+// request, is bounded by oidc.token_exchange_timeout
+// (ErrTokenExchangeTimeout).
+func (p *Provider) ExchangeCode(ctx context.Context, code, codeVerifier, nonce string) (*TokenData, error) {
+	timeout := time.Duration(p.cfg.TokenExchangeTimeout) * time.Second
+	if timeout <= 0 {
+		return p.exchangeCode(ctx, code, codeVerifier, nonce)
+	}
+
+	ctx, cancel := context.WithTimeoutCause(ctx, timeout, ErrTokenExchangeTimeout)
+	defer cancel()
+	tokenData, err := p.exchangeCode(ctx, code, codeVerifier, nonce)
+	if err != nil && errors.Is(context.Cause(ctx), ErrTokenExchangeTimeout) {
+		return nil, fmt.Errorf("%w after %s (oidc.token_exchange_timeout): %w", ErrTokenExchangeTimeout, timeout, err)
+	}
+	return tokenData, err
+}
+
+// exchangeCode implements ExchangeCode without the timeout.
+func (p *Provider) exchangeCode(ctx context.Context, code, codeVerifier, nonce string) (*TokenData, error) {
+	// One snapshot for the whole exchange, in case discovery is refreshed
+	d := p.discovered()
+
 	// Exchange authorization code for tokens
-	token, err := p.oauth2Config.Exchange(ctx, code,
-		oauth2.SetAuthURLParam("code_verifier", codeVerifier),
-	)
+	token, err := p.exchangeWithRetry(ctx, d, code, codeVerifier)
 	if err != nil {
+		var retrieveErr *oauth2.RetrieveError
+		if errors.As(err, &retrieveErr) &&
+			(retrieveErr.ErrorCode == "invalid_client" || retrieveErr.ErrorCode == "unauthorized_client") {
+			return nil, fmt.Errorf("failed to exchange code (daemon is configured as %s; "+
+				"check that the Keycloak client's Client authentication settings match client_secret and client_auth_method): %w",
+				p.cfg.ClientMode(), err)
+		}
+		if errors.As(err, &retrieveErr) && retrieveErr.ErrorCode == "invalid_grant" {
+			return nil, fmt.Errorf("failed to exchange code: %w: %w", ErrCodeExpired, err)
+		}
 		return nil, fmt.Errorf("failed to exchange code: %w", err)
 	}
 
@@ -96,9 +179,19 @@ func (p *Provider) ExchangeCode(ctx context.Context, code, codeVerifier string)
 	}
 
 	// Verify ID token (signature, issuer, audience, expiry)
-	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	idToken, err := d.verifier.Verify(ctx, rawIDToken)
 	if err != nil {
-		return nil, fmt.Errorf("failed to verify ID token: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrTokenVerification, err)
+	}
+	// go-oidc does not check iat; a token from the future means the clocks
+	// are further apart than oidc.clock_skew allows
+	skew := time.Duration(p.cfg.ClockSkew) * time.Second
+	if !idToken.IssuedAt.IsZero() && idToken.IssuedAt.After(time.Now().Add(skew)) {
+		return nil, fmt.Errorf("%w: issued at %s, in the future beyond oidc.clock_skew (%s)",
+			ErrTokenVerification, idToken.IssuedAt.UTC().Format(time.RFC3339), skew)
+	}
+	if nonce != "" && subtle.ConstantTimeCompare([]byte(idToken.Nonce), []byte(nonce)) != 1 {
+		return nil, ErrNonceMismatch
 	}
 
 	// Parse claims from ID token
@@ -110,8 +203,19 @@ func (p *Provider) ExchangeCode(ctx context.Context, code, codeVerifier string)
 	// Merge access token claims into the claims map.
 	// Keycloak puts resource_access (client-specific roles) and realm_access
 	// in the access token, not the ID token. We decode the access token JWT
-	// payload and merge selected claims so the validator can find them.
-	mergeAccessTokenClaims(token.AccessToken, claims)
+	// payload and merge selected claims so the validator can find them,
+	// unless oidc.merge_access_token_claims is off.
+	opaque := false
+	if keys := p.cfg.AccessTokenMergeClaims(); len(keys) > 0 {
+		opaque = !mergeAccessTokenClaims(token.AccessToken, keys, claims)
+	}
+
+	// Claims the tokens lack may still be available from UserInfo
+	if p.cfg.FetchUserInfo {
+		if err := mergeUserInfoClaims(ctx, d.oidcProvider, token, idToken.Subject, claims); err != nil {
+			return nil, err
+		}
+	}
 
 	return &TokenData{
 		AccessToken:  token.AccessToken,
@@ -119,29 +223,98 @@ func (p *Provider) ExchangeCode(ctx context.Context, code, codeVerifier string)
 		IDToken:      rawIDToken,
 		Claims:       claims,
 		Expiry:       token.Expiry,
+
+		AccessTokenOpaque: opaque,
 	}, nil
 }
 
+// exchangeWithRetry posts the code to the token endpoint, retrying up to
+// oidc.token_exchange_retries times while it fails with a retryable error
+// (see retryableExchangeError). The wait starts at tokenExchangeBackoff,
+// doubles after each attempt and is jittered by up to half its length.
+// Every attempt gets a new client assertion, whose ID must not be reused.
+func (p *Provider) exchangeWithRetry(ctx context.Context, d *discovery, code, codeVerifier string) (*oauth2.Token, error) {
+	delay := tokenExchangeBackoff
+	for attempt := 0; ; attempt++ {
+		opts := []oauth2.AuthCodeOption{oauth2.SetAuthURLParam("code_verifier", codeVerifier)}
+		if p.assertion != nil {
+			assertionOpts, err := p.assertion.options(d.oauth2Config.Endpoint.TokenURL)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, assertionOpts...)
+		}
+
+		token, err := d.oauth2Config.Exchange(ctx, code, opts...)
+		if err == nil || attempt >= p.cfg.TokenExchangeRetries || !retryableExchangeError(err) {
+			return token, err
+		}
+
+		wait := delay/2 + mrand.N(delay/2+1)
+		slog.Warn("token exchange failed, retrying",
+			"attempt", attempt+1,
+			"retries", p.cfg.TokenExchangeRetries,
+			"retry_in", wait.String(),
+			"error", err,
+		)
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
+
+// tokenExchangeBackoff is the wait before the first token exchange retry.
+var tokenExchangeBackoff = 500 * time.Millisecond
+
+// retryableExchangeError reports whether a failed token request may succeed
+// when repeated: a 502, 503 or 504 from a proxy or a restarting Keycloak, or
+// a connection that could not be established. Error responses such as 400
+// invalid_grant are terminal, and so are timeouts and resets once the
+// request was sent, since Keycloak may already have redeemed the code.
+func retryableExchangeError(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) {
+		if retrieveErr.Response == nil {
+			return false
+		}
+		switch retrieveErr.Response.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
 // mergeAccessTokenClaims decodes a JWT access token's payload and merges
-// role-related claims into the destination claims map.
+// the claims named in keys into the destination claims map.
 // Only claims not already present in dst are merged (ID token takes precedence).
 // This is best-effort: errors are logged but do not fail the auth flow,
-// since not all access tokens are JWTs (e.g., opaque tokens).
-func mergeAccessTokenClaims(accessToken string, dst map[string]interface{}) {
+// since not all access tokens are JWTs (e.g., opaque tokens). It reports
+// whether the access token could be decoded.
+func mergeAccessTokenClaims(accessToken string, keys []string, dst map[string]interface{}) bool {
 	if accessToken == "" {
-		return
+		return false
 	}
 
 	atClaims, err := decodeJWTPayload(accessToken)
 	if err != nil {
 		slog.Debug("could not decode access token as JWT (may be opaque)", "error", err)
-		return
+		return false
 	}
 
 	// Claims to merge from access token if not present in ID token
-	mergeKeys := []string{"resource_access", "realm_access", "groups"}
-
-	for _, key := range mergeKeys {
+	for _, key := range keys {
 		if _, exists := dst[key]; !exists {
 			if val, ok := atClaims[key]; ok {
 				dst[key] = val
@@ -149,6 +322,33 @@ func mergeAccessTokenClaims(accessToken string, dst map[string]interface{}) {
 			}
 		}
 	}
+	return true
+}
+
+// mergeUserInfoClaims fetches the UserInfo claims with the access token and
+// merges those not already present in dst, so claims from the tokens take
+// precedence. The UserInfo subject must match the ID token's, as OIDC Core
+// requires, so claims of another user are never mixed in.
+func mergeUserInfoClaims(ctx context.Context, provider *gooidc.Provider, token *oauth2.Token, subject string, dst map[string]interface{}) error {
+	userInfo, err := provider.UserInfo(ctx, oauth2.StaticTokenSource(token))
+	if err != nil {
+		return fmt.Errorf("failed to fetch userinfo: %w", err)
+	}
+	if userInfo.Subject != subject {
+		return fmt.Errorf("userinfo subject %q does not match ID token subject %q", userInfo.Subject, subject)
+	}
+
+	var uiClaims map[string]interface{}
+	if err := userInfo.Claims(&uiClaims); err != nil {
+		return fmt.Errorf("failed to parse userinfo claims: %w", err)
+	}
+	for key, val := range uiClaims {
+		if _, exists := dst[key]; !exists {
+			dst[key] = val
+			slog.Debug("merged claim from userinfo", "claim", key)
+		}
+	}
+	return nil
 }
 
 // decodeJWTPayload extracts and decodes the payload (second segment) of a JWT.
@@ -175,6 +375,12 @@ func decodeJWTPayload(token string) (map[string]interface{}, error) {
 	return claims, nil
 }
 
+// DecodeJWTClaims returns the claims of a JWT without verifying its
+// signature or expiry, for inspecting a token offline.
+func DecodeJWTClaims(token string) (map[string]interface{}, error) {
+	return decodeJWTPayload(strings.TrimSpace(token))
+}
+
 // generateCodeVerifier creates a cryptographically random PKCE code verifier.
 // The verifier is 32 random bytes encoded as base64url (43 characters).
 // Per RFC 7636, the verifier must be 43-128 characters.
@@ -186,6 +392,16 @@ func generateCodeVerifier() (string, error) {
 	return base64.RawURLEncoding.EncodeToString(b), nil
 }
 
+// generateNonce creates a random OIDC nonce: 32 random bytes encoded as
+// base64url (43 characters).
+func generateNonce() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
 // generateCodeChallenge creates a PKCE code challenge from the verifier.
 // It uses the S256 method: BASE64URL(SHA256(ASCII(verifier)))
 func generateCodeChallenge(verifier string) string {
@@ -195,11 +411,17 @@ func generateCodeChallenge(verifier string) string {
 }
 
 // generateState creates a random state parameter for CSRF protection.
-// The state is 16 random bytes encoded as hex (32 characters).
-func generateState() (string, error) {
+// The nonce is 16 random bytes encoded as hex (32 characters). With a
+// secret the state is signed as "<instanceID>.<nonce>.<hmac>" (see
+// VerifyState); otherwise the nonce alone is the state.
+func generateState(instanceID, secret string) (string, error) {
 	b := make([]byte, 16)
 	if _, err := rand.Read(b); err != nil {
 		return "", err
 	}
-	return hex.EncodeToString(b), nil
+	nonce := hex.EncodeToString(b)
+	if secret == "" {
+		return nonce, nil
+	}
+	return signState(instanceID, nonce, secret), nil
 }
@@ -5,6 +5,8 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"testing"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
 )
 
 func TestGenerateCodeVerifier(t *testing.T) {
@@ -88,7 +90,7 @@ func TestGenerateState(t *testing.T) {
 	seen := make(map[string]bool)
 
 	for i := 0; i < 100; i++ {
-		state, err := generateState()
+		state, err := generateState("vpn1", "")
 		if err != nil {
 			t.Fatalf("generateState failed: %v", err)
 		}
@@ -222,7 +224,9 @@ func TestMergeAccessTokenClaims(t *testing.T) {
 			"preferred_username": "testuser",
 		}
 
-		mergeAccessTokenClaims(accessToken, dst)
+		if !mergeAccessTokenClaims(accessToken, config.DefaultMergeClaims, dst) {
+			t.Fatal("expected JWT access token to be decoded")
+		}
 
 		// resource_access should be merged
 		ra, ok := dst["resource_access"]
@@ -270,7 +274,7 @@ func TestMergeAccessTokenClaims(t *testing.T) {
 			},
 		}
 
-		mergeAccessTokenClaims(accessToken, dst)
+		mergeAccessTokenClaims(accessToken, config.DefaultMergeClaims, dst)
 
 		// Should keep ID token's realm_access, not overwrite
 		ra := dst["realm_access"].(map[string]interface{})
@@ -280,9 +284,32 @@ func TestMergeAccessTokenClaims(t *testing.T) {
 		}
 	})
 
+	t.Run("merges only the given claims", func(t *testing.T) {
+		accessToken := makeTestJWT(t, map[string]interface{}{
+			"realm_access": map[string]interface{}{"roles": []interface{}{"vpn-user"}},
+			"groups":       []interface{}{"/vpn"},
+			"department":   "ops",
+		})
+
+		dst := map[string]interface{}{"sub": "user"}
+		mergeAccessTokenClaims(accessToken, []string{"groups", "department"}, dst)
+
+		if _, ok := dst["realm_access"]; ok {
+			t.Error("realm_access must not be merged when not listed")
+		}
+		if dst["department"] != "ops" {
+			t.Errorf("department = %v, want ops", dst["department"])
+		}
+		if _, ok := dst["groups"]; !ok {
+			t.Error("expected groups to be merged")
+		}
+	})
+
 	t.Run("handles empty access token", func(t *testing.T) {
 		dst := map[string]interface{}{"sub": "user"}
-		mergeAccessTokenClaims("", dst)
+		if mergeAccessTokenClaims("", config.DefaultMergeClaims, dst) {
+			t.Error("expected empty token to report no claims")
+		}
 		// Should not panic or modify dst
 		if len(dst) != 1 {
 			t.Error("dst should not be modified for empty token")
@@ -291,7 +318,9 @@ func TestMergeAccessTokenClaims(t *testing.T) {
 
 	t.Run("handles opaque access token gracefully", func(t *testing.T) {
 		dst := map[string]interface{}{"sub": "user"}
-		mergeAccessTokenClaims("opaque-token-no-dots", dst)
+		if mergeAccessTokenClaims("opaque-token-no-dots", config.DefaultMergeClaims, dst) {
+			t.Error("expected opaque token to report no claims")
+		}
 		// Should not panic or modify dst
 		if len(dst) != 1 {
 			t.Error("dst should not be modified for opaque token")
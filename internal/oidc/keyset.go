@@ -0,0 +1,71 @@
+package oidc
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+// cachingKeySet is an oidc.KeySet that bounds how long fetched JWKS keys are
+// trusted.
+//
+// go-oidc's RemoteKeySet caches keys for the lifetime of the process and only
+// refetches when it sees an unknown key ID, so a key removed from Keycloak
+// (e.g. after a compromise) would keep being accepted. cachingKeySet replaces
+// the underlying RemoteKeySet once it is older than ttl, which forces a fresh
+// fetch on the next verification.
+type cachingKeySet struct {
+	ctx     context.Context
+	jwksURL string
+	ttl     time.Duration
+	now     func() time.Time
+
+	mu        sync.Mutex
+	keySet    *oidc.RemoteKeySet
+	createdAt time.Time
+}
+
+// newCachingKeySet creates a key set for jwksURL. ctx is only used to carry
+// the HTTP client (see oidc.ClientContext). A ttl <= 0 keeps keys until an
+// unknown key ID is seen, which is go-oidc's default behavior.
+func newCachingKeySet(ctx context.Context, jwksURL string, ttl time.Duration) *cachingKeySet {
+	ks := &cachingKeySet{
+		ctx:     context.WithoutCancel(ctx),
+		jwksURL: jwksURL,
+		ttl:     ttl,
+		now:     time.Now,
+	}
+	ks.keySet = oidc.NewRemoteKeySet(ks.ctx, jwksURL)
+	ks.createdAt = ks.now()
+	return ks
+}
+
+// VerifySignature implements oidc.KeySet.
+func (ks *cachingKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	return ks.current().VerifySignature(ctx, jwt)
+}
+
+// current returns the active RemoteKeySet, replacing it if it has expired.
+func (ks *cachingKeySet) current() *oidc.RemoteKeySet {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if ks.ttl > 0 && ks.now().Sub(ks.createdAt) >= ks.ttl {
+		ks.keySet = oidc.NewRemoteKeySet(ks.ctx, ks.jwksURL)
+		ks.createdAt = ks.now()
+	}
+	return ks.keySet
+}
+
+// httpClient returns the HTTP client carried by ks.ctx (see
+// oidc.ClientContext), which the JWKS is fetched with.
+func (ks *cachingKeySet) httpClient() *http.Client {
+	if client, ok := ks.ctx.Value(oauth2.HTTPClient).(*http.Client); ok {
+		return client
+	}
+	return http.DefaultClient
+}
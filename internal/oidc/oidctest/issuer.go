@@ -0,0 +1,56 @@
+// Package oidctest provides a minimal OIDC issuer for tests.
+package oidctest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Paths served below the issuer started by NewIssuer.
+const (
+	DiscoveryPath = "/realms/test/.well-known/openid-configuration"
+	TokenPath     = "/realms/test/token"
+	KeysPath      = "/realms/test/keys"
+)
+
+// Hook handles a request to the issuer before the default handling and
+// reports whether it wrote a response. issuer is the issuer URL.
+type Hook func(w http.ResponseWriter, r *http.Request, issuer string) bool
+
+// NewIssuer starts an issuer that is stopped when the test ends and
+// returns its URL. Requests are offered to hook first, if it is not nil;
+// otherwise DiscoveryPath serves Discovery(issuer) and every other path is
+// not found.
+func NewIssuer(t testing.TB, hook Hook) string {
+	t.Helper()
+
+	var issuer string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if hook != nil && hook(w, r, issuer) {
+			return
+		}
+		if r.URL.Path != DiscoveryPath {
+			http.NotFound(w, r)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(Discovery(issuer))
+	}))
+	issuer = ts.URL + "/realms/test"
+	t.Cleanup(ts.Close)
+
+	return issuer
+}
+
+// Discovery returns the discovery document of issuer, which hooks can
+// extend and serve instead.
+func Discovery(issuer string) map[string]interface{} {
+	return map[string]interface{}{
+		"issuer":                 issuer,
+		"authorization_endpoint": issuer + "/auth",
+		"token_endpoint":         issuer + "/token",
+		"jwks_uri":               issuer + "/keys",
+	}
+}
@@ -4,6 +4,11 @@ package oidc
 import (
 	"context"
 	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
 	"golang.org/x/oauth2"
@@ -14,39 +19,204 @@ import (
 // Provider wraps the OIDC provider and OAuth2 configuration.
 // It handles provider discovery, token exchange, and ID token verification.
 type Provider struct {
+	cfg config.OIDCConfig
+
+	// assertion signs the client assertion for client_secret_jwt and
+	// private_key_jwt; nil for the other client auth methods
+	assertion *clientAssertion
+
+	// disc is shared with the copies made by withConfig, so Refresh
+	// reaches every copy
+	disc *discoveryHolder
+}
+
+// discovery is the state built from an issuer's discovery document. Refresh
+// replaces it as a whole, so a flow that took one snapshot uses consistent
+// endpoints and keys even if a refresh happens meanwhile.
+type discovery struct {
 	oidcProvider *oidc.Provider
 	oauth2Config *oauth2.Config
 	verifier     *oidc.IDTokenVerifier
+	keySet       *cachingKeySet
+
+	// Advertised by the discovery document; empty if not advertised.
+	authMethods      []string
+	challengeMethods []string
+}
+
+// discoveryHolder guards the current discovery of a provider.
+type discoveryHolder struct {
+	mu  sync.RWMutex
+	cur *discovery
 }
 
 // NewProvider creates a new OIDC provider using the specified configuration.
 // It performs OIDC discovery via /.well-known/openid-configuration
 // and sets up the OAuth2 configuration and ID token verifier.
 func NewProvider(ctx context.Context, cfg *config.OIDCConfig) (*Provider, error) {
+	assertion, err := newClientAssertion(cfg)
+	if err != nil {
+		return nil, err
+	}
+	d, err := discover(ctx, cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Provider{cfg: *cfg, assertion: assertion, disc: &discoveryHolder{cur: d}}, nil
+}
+
+// discover fetches the discovery document of cfg.Issuer and builds the
+// OAuth2 configuration and ID token verifier from it. The key set of prev,
+// if any, is kept while the JWKS URL is unchanged, so a refresh does not
+// drop cached keys.
+func discover(ctx context.Context, cfg *config.OIDCConfig, prev *discovery) (*discovery, error) {
 	// Discover OIDC configuration from issuer
 	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create OIDC provider: %w", err)
 	}
 
-	// Create OAuth2 config
+	// Create OAuth2 config. Without a client_auth_method, oauth2 tries
+	// client_secret_basic and falls back to client_secret_post.
+	endpoint := provider.Endpoint()
+	clientSecret := cfg.ClientSecret
+	switch cfg.ClientAuthMethod {
+	case config.ClientAuthMethodSecretBasic:
+		endpoint.AuthStyle = oauth2.AuthStyleInHeader
+	case config.ClientAuthMethodSecretPost:
+		endpoint.AuthStyle = oauth2.AuthStyleInParams
+	case config.ClientAuthMethodSecretJWT, config.ClientAuthMethodPrivateKeyJWT:
+		// The client assertion authenticates the client, see ExchangeCode
+		endpoint.AuthStyle = oauth2.AuthStyleInParams
+		clientSecret = ""
+	}
 	oauth2Config := &oauth2.Config{
 		ClientID:     cfg.ClientID,
-		ClientSecret: cfg.ClientSecret,
+		ClientSecret: clientSecret,
 		RedirectURL:  cfg.RedirectURI,
-		Endpoint:     provider.Endpoint(),
+		Endpoint:     endpoint,
 		Scopes:       cfg.Scopes,
 	}
 
+	// Discover the JWKS endpoint and signing algorithms so the verifier can
+	// use our own key set, which honors jwks_cache_duration.
+	var claims struct {
+		JWKSURL          string   `json:"jwks_uri"`
+		Algorithms       []string `json:"id_token_signing_alg_values_supported"`
+		AuthMethods      []string `json:"token_endpoint_auth_methods_supported"`
+		ChallengeMethods []string `json:"code_challenge_methods_supported"`
+	}
+	if err := provider.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("failed to parse OIDC discovery document: %w", err)
+	}
+	if claims.JWKSURL == "" {
+		return nil, fmt.Errorf("OIDC discovery document has no jwks_uri")
+	}
+	if cfg.FetchUserInfo && provider.UserInfoEndpoint() == "" {
+		return nil, fmt.Errorf("oidc.fetch_userinfo is set but OIDC discovery document has no userinfo_endpoint")
+	}
+
+	var keySet *cachingKeySet
+	if prev != nil && prev.keySet.jwksURL == claims.JWKSURL {
+		keySet = prev.keySet
+	} else {
+		keySet = newCachingKeySet(ctx, claims.JWKSURL, time.Duration(cfg.JWKSCacheDuration)*time.Second)
+	}
+
 	// Create ID token verifier
-	// This will verify the token signature, issuer, audience, and expiry
-	verifier := provider.Verifier(&oidc.Config{
-		ClientID: cfg.ClientID,
+	// This will verify the token signature, issuer, audience, and expiry.
+	// Checking expiry against a clock set back by clock_skew accepts tokens
+	// up to that long after they expired; iat is checked in ExchangeCode.
+	skew := time.Duration(cfg.ClockSkew) * time.Second
+	verifier := oidc.NewVerifier(cfg.Issuer, keySet, &oidc.Config{
+		ClientID:             cfg.ClientID,
+		SupportedSigningAlgs: claims.Algorithms,
+		Now:                  func() time.Time { return time.Now().Add(-skew) },
 	})
 
-	return &Provider{
+	return &discovery{
 		oidcProvider: provider,
 		oauth2Config: oauth2Config,
 		verifier:     verifier,
+		keySet:       keySet,
+
+		authMethods:      claims.AuthMethods,
+		challengeMethods: claims.ChallengeMethods,
 	}, nil
 }
+
+// discovered returns the current discovery snapshot.
+func (p *Provider) discovered() *discovery {
+	p.disc.mu.RLock()
+	defer p.disc.mu.RUnlock()
+	return p.disc.cur
+}
+
+// Refresh fetches the discovery document again and switches to the new
+// endpoints and signing algorithms. Flows already in progress finish with
+// the snapshot they started with. On error the current discovery is kept.
+func (p *Provider) Refresh(ctx context.Context) error {
+	prev := p.discovered()
+	d, err := discover(ctx, &p.cfg, prev)
+	if err != nil {
+		return err
+	}
+
+	p.disc.mu.Lock()
+	p.disc.cur = d
+	p.disc.mu.Unlock()
+
+	if d.oauth2Config.Endpoint != prev.oauth2Config.Endpoint || d.keySet != prev.keySet {
+		slog.Info("OIDC discovery changed, using new endpoints",
+			"issuer", p.cfg.Issuer,
+			"authorization_endpoint", d.oauth2Config.Endpoint.AuthURL,
+			"token_endpoint", d.oauth2Config.Endpoint.TokenURL,
+			"jwks_uri", d.keySet.jwksURL,
+		)
+	}
+	return nil
+}
+
+// ClientModeWarnings returns warnings where the configured client mode (see
+// config.OIDCConfig.ClientMode) conflicts with what the issuer advertises
+// in its discovery document. Keycloak does not publish per-client settings,
+// so a public/confidential mismatch on the Keycloak client itself only shows
+// up at token exchange.
+func (p *Provider) ClientModeWarnings() []string {
+	var warnings []string
+	d := p.discovered()
+	switch method := p.cfg.ClientAuthMethod; {
+	case len(d.authMethods) == 0:
+	case method != "":
+		if !slices.Contains(d.authMethods, method) {
+			warnings = append(warnings, fmt.Sprintf(
+				"client_auth_method is %s but issuer %s does not support it (advertised: %s)",
+				method, p.cfg.Issuer, strings.Join(d.authMethods, ", ")))
+		}
+	case p.cfg.ClientSecret != "" &&
+		!slices.Contains(d.authMethods, "client_secret_basic") && !slices.Contains(d.authMethods, "client_secret_post"):
+		warnings = append(warnings, fmt.Sprintf(
+			"client_secret is set but issuer %s supports neither client_secret_basic nor client_secret_post (advertised: %s)",
+			p.cfg.Issuer, strings.Join(d.authMethods, ", ")))
+	}
+	if len(d.challengeMethods) > 0 && !slices.Contains(d.challengeMethods, "S256") {
+		warnings = append(warnings, fmt.Sprintf(
+			"issuer %s does not advertise PKCE S256 (advertised: %s); token exchange will fail",
+			p.cfg.Issuer, strings.Join(d.challengeMethods, ", ")))
+	}
+	return warnings
+}
+
+// Config returns the OIDC settings this provider was created with.
+func (p *Provider) Config() *config.OIDCConfig {
+	return &p.cfg
+}
+
+// withConfig returns a copy of p that shares its discovery, OAuth2 and
+// verifier state but reports cfg from Config. cfg must have the same
+// connection settings as p (see sameConnection).
+func (p *Provider) withConfig(cfg *config.OIDCConfig) *Provider {
+	clone := *p
+	clone.cfg = *cfg
+	return &clone
+}
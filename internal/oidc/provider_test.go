@@ -2,44 +2,182 @@ package oidc
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+	"golang.org/x/oauth2"
 
 	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/oidc/oidctest"
 )
 
-func newTestIssuer(t *testing.T) string {
-	t.Helper()
+// extendedDiscovery serves a discovery document that includes extra.
+func extendedDiscovery(extra map[string]interface{}) oidctest.Hook {
+	return func(w http.ResponseWriter, r *http.Request, issuer string) bool {
+		if r.URL.Path != oidctest.DiscoveryPath {
+			return false
+		}
+		doc := oidctest.Discovery(issuer)
+		for k, v := range extra {
+			doc[k] = v
+		}
+		_ = json.NewEncoder(w).Encode(doc)
+		return true
+	}
+}
 
-	var baseURL string
-	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		issuer := baseURL + "/realms/test"
+// rejectClient rejects every token request with invalid_client.
+func rejectClient(w http.ResponseWriter, r *http.Request, _ string) bool {
+	if r.URL.Path != oidctest.TokenPath {
+		return false
+	}
+	w.WriteHeader(http.StatusUnauthorized)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"error":             "invalid_client",
+		"error_description": "Invalid client or Invalid client credentials",
+	})
+	return true
+}
 
-		if r.URL.Path != "/realms/test/.well-known/openid-configuration" {
-			http.NotFound(w, r)
-			return
-		}
+func TestClientModeWarnings(t *testing.T) {
+	tests := []struct {
+		name      string
+		secret    string
+		method    string
+		discovery map[string]interface{}
+		want      []string
+	}{
+		{
+			name:   "confidential client, secret methods supported",
+			secret: "s3cret",
+			discovery: map[string]interface{}{
+				"token_endpoint_auth_methods_supported": []string{"private_key_jwt", "client_secret_basic"},
+				"code_challenge_methods_supported":      []string{"plain", "S256"},
+			},
+		},
+		{
+			name:   "public client, nothing advertised",
+			secret: "",
+		},
+		{
+			name:   "secret set but not supported by issuer",
+			secret: "s3cret",
+			discovery: map[string]interface{}{
+				"token_endpoint_auth_methods_supported": []string{"private_key_jwt"},
+			},
+			want: []string{"supports neither client_secret_basic nor client_secret_post"},
+		},
+		{
+			name:   "public client ignores auth methods",
+			secret: "",
+			discovery: map[string]interface{}{
+				"token_endpoint_auth_methods_supported": []string{"private_key_jwt"},
+			},
+		},
+		{
+			name:   "client auth method supported",
+			secret: "0123456789abcdef0123456789abcdef",
+			method: config.ClientAuthMethodSecretJWT,
+			discovery: map[string]interface{}{
+				"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_jwt"},
+			},
+		},
+		{
+			name:   "client auth method not supported",
+			secret: "0123456789abcdef0123456789abcdef",
+			method: config.ClientAuthMethodSecretJWT,
+			discovery: map[string]interface{}{
+				"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+			},
+			want: []string{"client_auth_method is client_secret_jwt but issuer"},
+		},
+		{
+			name:   "no S256",
+			secret: "",
+			discovery: map[string]interface{}{
+				"code_challenge_methods_supported": []string{"plain"},
+			},
+			want: []string{"does not advertise PKCE S256"},
+		},
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(map[string]string{
-			"issuer":                 issuer,
-			"authorization_endpoint": issuer + "/auth",
-			"token_endpoint":         issuer + "/token",
-			"jwks_uri":               issuer + "/keys",
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewProvider(context.Background(), &config.OIDCConfig{
+				Issuer:           oidctest.NewIssuer(t, extendedDiscovery(tt.discovery)),
+				ClientID:         "test-client",
+				ClientSecret:     tt.secret,
+				ClientAuthMethod: tt.method,
+				RedirectURI:      "http://localhost/callback",
+				Scopes:           []string{"openid"},
+			})
+			if err != nil {
+				t.Fatalf("NewProvider failed: %v", err)
+			}
+
+			warnings := p.ClientModeWarnings()
+			if len(warnings) != len(tt.want) {
+				t.Fatalf("warnings = %v, want %d", warnings, len(tt.want))
+			}
+			for i, w := range tt.want {
+				if !strings.Contains(warnings[i], w) {
+					t.Errorf("warning %d = %q, want it to contain %q", i, warnings[i], w)
+				}
+			}
 		})
-	}))
-	baseURL = ts.URL
-	t.Cleanup(ts.Close)
+	}
+}
 
-	return baseURL + "/realms/test"
+func TestExchangeCode_InvalidClientHint(t *testing.T) {
+	for _, secret := range []string{"", "s3cret"} {
+		cfg := &config.OIDCConfig{
+			Issuer:       oidctest.NewIssuer(t, rejectClient),
+			ClientID:     "test-client",
+			ClientSecret: secret,
+			RedirectURI:  "http://localhost/callback",
+			Scopes:       []string{"openid"},
+		}
+		p, err := NewProvider(context.Background(), cfg)
+		if err != nil {
+			t.Fatalf("NewProvider failed: %v", err)
+		}
+
+		_, err = p.ExchangeCode(context.Background(), "code", "verifier", "nonce")
+		if err == nil {
+			t.Fatal("expected token exchange to fail")
+		}
+		if !strings.Contains(err.Error(), cfg.ClientMode()) || !strings.Contains(err.Error(), "Client authentication") {
+			t.Errorf("error = %v, want client mode hint %q", err, cfg.ClientMode())
+		}
+	}
 }
 
 func TestNewProviderAndStartAuthFlow(t *testing.T) {
-	issuer := newTestIssuer(t)
+	issuer := oidctest.NewIssuer(t, nil)
 
 	p, err := NewProvider(context.Background(), &config.OIDCConfig{
 		Issuer:      issuer,
@@ -95,6 +233,281 @@ func TestNewProviderAndStartAuthFlow(t *testing.T) {
 	if q.Get("code_challenge_method") != "S256" {
 		t.Fatalf("code_challenge_method = %q, want %q", q.Get("code_challenge_method"), "S256")
 	}
+	if flow.Nonce == "" || q.Get("nonce") != flow.Nonce {
+		t.Fatalf("nonce = %q, want %q", q.Get("nonce"), flow.Nonce)
+	}
+	if q.Has("max_age") {
+		t.Fatalf("max_age = %q, want it unset without oidc.max_age", q.Get("max_age"))
+	}
+	if q.Has("acr_values") {
+		t.Fatalf("acr_values = %q, want it unset without oidc.acr_values", q.Get("acr_values"))
+	}
+
+	p.cfg.MaxAge = 900
+	p.cfg.ACRValues = []string{"gold", "silver"}
+	flow, err = p.StartAuthFlow(context.Background())
+	if err != nil {
+		t.Fatalf("StartAuthFlow failed: %v", err)
+	}
+	u, err = url.Parse(flow.AuthURL)
+	if err != nil {
+		t.Fatalf("failed to parse auth URL: %v", err)
+	}
+	if got := u.Query().Get("max_age"); got != "900" {
+		t.Fatalf("max_age = %q, want %q", got, "900")
+	}
+	if got := u.Query().Get("acr_values"); got != "gold silver" {
+		t.Fatalf("acr_values = %q, want %q", got, "gold silver")
+	}
+}
+
+func TestExchangeCode_Timeout(t *testing.T) {
+	// The token endpoint never answers before the client gives up
+	release := make(chan struct{})
+	issuer := oidctest.NewIssuer(t, func(w http.ResponseWriter, r *http.Request, _ string) bool {
+		if r.URL.Path != oidctest.TokenPath {
+			return false
+		}
+		select {
+		case <-r.Context().Done():
+		case <-release:
+		}
+		return true
+	})
+	t.Cleanup(func() { close(release) })
+
+	p, err := NewProvider(context.Background(), &config.OIDCConfig{
+		Issuer:               issuer,
+		ClientID:             "test-client",
+		RedirectURI:          "http://localhost/callback",
+		Scopes:               []string{"openid"},
+		TokenExchangeTimeout: 1,
+	})
+	if err != nil {
+		t.Fatalf("NewProvider failed: %v", err)
+	}
+
+	start := time.Now()
+	_, err = p.ExchangeCode(context.Background(), "code", "verifier", "nonce")
+	if !errors.Is(err, ErrTokenExchangeTimeout) {
+		t.Fatalf("ExchangeCode error = %v, want ErrTokenExchangeTimeout", err)
+	}
+	if !strings.Contains(err.Error(), "oidc.token_exchange_timeout") {
+		t.Errorf("error = %v, want it to name oidc.token_exchange_timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("ExchangeCode returned after %s, want about 1s", elapsed)
+	}
+
+	// A cancelled request is not reported as a timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.ExchangeCode(ctx, "code", "verifier", "nonce"); err == nil || errors.Is(err, ErrTokenExchangeTimeout) {
+		t.Errorf("ExchangeCode with cancelled context error = %v, want a non-timeout error", err)
+	}
+}
+
+func TestExchangeCode_Retries(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	defer func(b time.Duration) { tokenExchangeBackoff = b }(tokenExchangeBackoff)
+	tokenExchangeBackoff = time.Millisecond
+
+	tests := []struct {
+		name         string
+		retries      int
+		failures     []int // statuses of the first token requests
+		wantErr      bool
+		wantRequests int32
+	}{
+		{name: "fails twice then succeeds", retries: 2,
+			failures: []int{http.StatusBadGateway, http.StatusServiceUnavailable}, wantRequests: 3},
+		{name: "gateway timeout retried", retries: 2,
+			failures: []int{http.StatusGatewayTimeout}, wantRequests: 2},
+		{name: "retries exhausted", retries: 1,
+			failures: []int{http.StatusBadGateway, http.StatusBadGateway}, wantErr: true, wantRequests: 2},
+		{name: "retries disabled", retries: 0,
+			failures: []int{http.StatusBadGateway}, wantErr: true, wantRequests: 1},
+		{name: "invalid code not retried", retries: 2,
+			failures: []int{http.StatusBadRequest}, wantErr: true, wantRequests: 1},
+		{name: "unauthorized not retried", retries: 2,
+			failures: []int{http.StatusUnauthorized}, wantErr: true, wantRequests: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests, fetches atomic.Int32
+			issuer := newTestJWKSIssuer(t, key, &fetches, &testIssuerTokens{
+				failTokenRequest: func() int {
+					n := int(requests.Add(1))
+					if n <= len(tt.failures) {
+						return tt.failures[n-1]
+					}
+					return 0
+				},
+			})
+
+			// A fixed client auth method keeps oauth2 from repeating failed
+			// requests to detect the auth style
+			p, err := NewProvider(context.Background(), &config.OIDCConfig{
+				Issuer:               issuer,
+				ClientID:             "test-client",
+				ClientSecret:         "s3cret",
+				ClientAuthMethod:     config.ClientAuthMethodSecretPost,
+				RedirectURI:          "http://localhost/callback",
+				Scopes:               []string{"openid"},
+				TokenExchangeRetries: tt.retries,
+			})
+			if err != nil {
+				t.Fatalf("NewProvider failed: %v", err)
+			}
+
+			_, err = p.ExchangeCode(context.Background(), "code", "verifier", "")
+			if tt.wantErr && err == nil {
+				t.Error("ExchangeCode succeeded, want an error")
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("ExchangeCode failed: %v", err)
+			}
+			if got := requests.Load(); got != tt.wantRequests {
+				t.Errorf("token requests = %d, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestExchangeCode_InvalidGrant(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	tests := []struct {
+		tokenError  string
+		wantExpired bool
+	}{
+		{tokenError: "invalid_grant", wantExpired: true},
+		{tokenError: "invalid_request"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.tokenError, func(t *testing.T) {
+			var fetches atomic.Int32
+			issuer := newTestJWKSIssuer(t, key, &fetches, &testIssuerTokens{tokenError: tt.tokenError})
+
+			p, err := NewProvider(context.Background(), &config.OIDCConfig{
+				Issuer:           issuer,
+				ClientID:         "test-client",
+				ClientSecret:     "s3cret",
+				ClientAuthMethod: config.ClientAuthMethodSecretPost,
+				RedirectURI:      "http://localhost/callback",
+				Scopes:           []string{"openid"},
+			})
+			if err != nil {
+				t.Fatalf("NewProvider failed: %v", err)
+			}
+
+			_, err = p.ExchangeCode(context.Background(), "expired-code", "verifier", "")
+			if err == nil {
+				t.Fatal("ExchangeCode succeeded, want an error")
+			}
+			if got := errors.Is(err, ErrCodeExpired); got != tt.wantExpired {
+				t.Errorf("errors.Is(%v, ErrCodeExpired) = %v, want %v", err, got, tt.wantExpired)
+			}
+		})
+	}
+}
+
+func TestRetryableExchangeError(t *testing.T) {
+	retrieveErr := func(status int) error {
+		return &oauth2.RetrieveError{Response: &http.Response{StatusCode: status}}
+	}
+
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "bad gateway", err: retrieveErr(http.StatusBadGateway), want: true},
+		{name: "service unavailable", err: retrieveErr(http.StatusServiceUnavailable), want: true},
+		{name: "gateway timeout", err: retrieveErr(http.StatusGatewayTimeout), want: true},
+		{name: "bad request", err: retrieveErr(http.StatusBadRequest)},
+		{name: "unauthorized", err: retrieveErr(http.StatusUnauthorized)},
+		{name: "internal server error", err: retrieveErr(http.StatusInternalServerError)},
+		{name: "dial error", err: &url.Error{Op: "Post", URL: "https://idp/token",
+			Err: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "idp"}}}, want: true},
+		{name: "connection refused", err: &url.Error{Op: "Post", URL: "https://idp/token", Err: syscall.ECONNREFUSED}, want: true},
+		{name: "reset after request sent", err: &url.Error{Op: "Post", URL: "https://idp/token",
+			Err: &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}}},
+		{name: "read timeout", err: &url.Error{Op: "Post", URL: "https://idp/token",
+			Err: &net.OpError{Op: "read", Net: "tcp", Err: os.ErrDeadlineExceeded}}},
+		{name: "cancelled", err: &url.Error{Op: "Post", URL: "https://idp/token", Err: context.Canceled}},
+		{name: "other error", err: errors.New("oauth2: server response missing access_token")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryableExchangeError(tt.err); got != tt.want {
+				t.Errorf("retryableExchangeError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExchangeCode_Nonce(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		tokenNonce interface{} // nil omits the claim
+		nonce      string
+		wantErr    bool
+	}{
+		{name: "matching nonce", tokenNonce: "expected-nonce", nonce: "expected-nonce"},
+		{name: "wrong nonce", tokenNonce: "other-nonce", nonce: "expected-nonce", wantErr: true},
+		{name: "missing nonce", nonce: "expected-nonce", wantErr: true},
+		{name: "session without nonce", tokenNonce: "other-nonce", nonce: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := map[string]interface{}{}
+			if tt.tokenNonce != nil {
+				claims["nonce"] = tt.tokenNonce
+			}
+			var fetches atomic.Int32
+			issuer := newTestJWKSIssuer(t, key, &fetches, &testIssuerTokens{idTokenClaims: claims})
+
+			p, err := NewProvider(context.Background(), &config.OIDCConfig{
+				Issuer:      issuer,
+				ClientID:    "test-client",
+				RedirectURI: "http://localhost/callback",
+				Scopes:      []string{"openid"},
+			})
+			if err != nil {
+				t.Fatalf("NewProvider failed: %v", err)
+			}
+
+			tokenData, err := p.ExchangeCode(context.Background(), "code", "verifier", tt.nonce)
+			if tt.wantErr {
+				if !errors.Is(err, ErrNonceMismatch) {
+					t.Fatalf("ExchangeCode error = %v, want ErrNonceMismatch", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ExchangeCode failed: %v", err)
+			}
+			if tokenData.Claims["sub"] != "user-1" {
+				t.Errorf("sub = %v, want user-1", tokenData.Claims["sub"])
+			}
+		})
+	}
 }
 
 func TestNewProvider_DiscoveryFailure(t *testing.T) {
@@ -112,3 +525,814 @@ func TestNewProvider_DiscoveryFailure(t *testing.T) {
 		t.Fatal("expected error, got nil")
 	}
 }
+
+func TestProviderRefresh(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	var fetches atomic.Int32
+	var moved atomic.Bool
+	issuer := newTestJWKSIssuer(t, key, &fetches, &testIssuerTokens{
+		idTokenClaims: map[string]interface{}{"preferred_username": "alice"},
+		moved:         &moved,
+	})
+
+	p, err := NewProvider(context.Background(), &config.OIDCConfig{
+		Issuer:      issuer,
+		ClientID:    "test-client",
+		RedirectURI: "http://localhost/callback",
+		Scopes:      []string{"openid"},
+	})
+	if err != nil {
+		t.Fatalf("NewProvider failed: %v", err)
+	}
+	// A copy made on reload shares the discovery with the original
+	reloaded := p.withConfig(p.Config())
+
+	if _, err := p.ExchangeCode(context.Background(), "code", "verifier", ""); err != nil {
+		t.Fatalf("ExchangeCode before move failed: %v", err)
+	}
+	old := p.discovered()
+
+	// Until refreshed, the provider still uses the old endpoints
+	moved.Store(true)
+	if _, err := p.ExchangeCode(context.Background(), "code", "verifier", ""); err == nil {
+		t.Fatal("ExchangeCode against moved endpoints succeeded before refresh")
+	}
+
+	if err := p.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh failed: %v", err)
+	}
+	for _, provider := range []*Provider{p, reloaded} {
+		d := provider.discovered()
+		if got, want := d.oauth2Config.Endpoint.TokenURL, issuer+"/v2/token"; got != want {
+			t.Errorf("token URL = %q, want %q", got, want)
+		}
+		if got, want := d.keySet.jwksURL, issuer+"/v2/keys"; got != want {
+			t.Errorf("JWKS URL = %q, want %q", got, want)
+		}
+		flow, err := provider.StartAuthFlow(context.Background())
+		if err != nil {
+			t.Fatalf("StartAuthFlow failed: %v", err)
+		}
+		if !strings.HasPrefix(flow.AuthURL, issuer+"/v2/auth?") {
+			t.Errorf("auth URL = %q, want the moved authorization endpoint", flow.AuthURL)
+		}
+	}
+	if _, err := p.ExchangeCode(context.Background(), "code", "verifier", ""); err != nil {
+		t.Fatalf("ExchangeCode after refresh failed: %v", err)
+	}
+	// A snapshot taken before the refresh is left untouched
+	if got := old.oauth2Config.Endpoint.TokenURL; got != issuer+"/token" {
+		t.Errorf("old snapshot token URL = %q, want unchanged", got)
+	}
+
+	// A failed refresh keeps the current discovery
+	current := p.discovered()
+	if err := p.withConfig(&config.OIDCConfig{Issuer: issuer + "-gone"}).Refresh(context.Background()); err == nil {
+		t.Fatal("Refresh of unreachable issuer succeeded")
+	}
+	if p.discovered() != current {
+		t.Error("failed refresh replaced the discovery")
+	}
+}
+
+func TestExchangeCode_ClientAuthMethod(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate EC key: %v", err)
+	}
+
+	dir := t.TempDir()
+	rsaKeyFile := filepath.Join(dir, "rsa.pem")
+	if err := os.WriteFile(rsaKeyFile, pem.EncodeToMemory(&pem.Block{
+		Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	ecDER, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKeyFile := filepath.Join(dir, "ec.pem")
+	if err := os.WriteFile(ecKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: ecDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	const secret = "0123456789abcdef0123456789abcdef"
+
+	tests := []struct {
+		name    string
+		method  string
+		secret  string
+		keyID   string
+		keyFile string
+		// wantBasic expects the secret in the Authorization header,
+		// wantPost in the form
+		wantBasic bool
+		wantPost  bool
+		// verifyKey checks the client assertion; nil expects none
+		verifyKey interface{}
+		wantAlg   jose.SignatureAlgorithm
+	}{
+		{name: "client_secret_basic", method: config.ClientAuthMethodSecretBasic, secret: secret, wantBasic: true},
+		{name: "client_secret_post", method: config.ClientAuthMethodSecretPost, secret: secret, wantPost: true},
+		{
+			name:      "client_secret_jwt",
+			method:    config.ClientAuthMethodSecretJWT,
+			secret:    secret,
+			verifyKey: []byte(secret),
+			wantAlg:   jose.HS256,
+		},
+		{
+			name:      "private_key_jwt with RSA key",
+			method:    config.ClientAuthMethodPrivateKeyJWT,
+			keyFile:   rsaKeyFile,
+			keyID:     "vpn-1",
+			verifyKey: &key.PublicKey,
+			wantAlg:   jose.RS256,
+		},
+		{
+			name:      "private_key_jwt with EC key",
+			method:    config.ClientAuthMethodPrivateKeyJWT,
+			keyFile:   ecKeyFile,
+			verifyKey: &ecKey.PublicKey,
+			wantAlg:   jose.ES384,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var form url.Values
+			var basicUser, basicPassword string
+			var basic bool
+			var fetches atomic.Int32
+			issuer := newTestJWKSIssuer(t, key, &fetches, &testIssuerTokens{
+				onTokenRequest: func(r *http.Request) {
+					if err := r.ParseForm(); err != nil {
+						t.Errorf("failed to parse token request: %v", err)
+					}
+					form = r.PostForm
+					basicUser, basicPassword, basic = r.BasicAuth()
+				},
+			})
+
+			p, err := NewProvider(context.Background(), &config.OIDCConfig{
+				Issuer:                 issuer,
+				ClientID:               "test-client",
+				ClientSecret:           tt.secret,
+				ClientAuthMethod:       tt.method,
+				ClientAssertionKeyFile: tt.keyFile,
+				ClientAssertionKeyID:   tt.keyID,
+				RedirectURI:            "http://localhost/callback",
+				Scopes:                 []string{"openid"},
+			})
+			if err != nil {
+				t.Fatalf("NewProvider failed: %v", err)
+			}
+			if _, err := p.ExchangeCode(context.Background(), "code", "verifier", ""); err != nil {
+				t.Fatalf("ExchangeCode failed: %v", err)
+			}
+
+			if basic != tt.wantBasic {
+				t.Errorf("Authorization header sent = %v, want %v", basic, tt.wantBasic)
+			}
+			if tt.wantBasic && (basicUser != "test-client" || basicPassword != secret) {
+				t.Errorf("basic auth = %q:%q, want test-client and the secret", basicUser, basicPassword)
+			}
+			if got := form.Get("client_secret"); (got != "") != tt.wantPost {
+				t.Errorf("client_secret in form = %q, want sent = %v", got, tt.wantPost)
+			}
+
+			raw := form.Get("client_assertion")
+			if tt.verifyKey == nil {
+				if raw != "" || form.Has("client_assertion_type") {
+					t.Errorf("unexpected client assertion in form: %v", form)
+				}
+				return
+			}
+			if got := form.Get("client_assertion_type"); got != clientAssertionType {
+				t.Errorf("client_assertion_type = %q, want %q", got, clientAssertionType)
+			}
+			if got := form.Get("client_id"); got != "test-client" {
+				t.Errorf("client_id = %q, want test-client", got)
+			}
+
+			assertion, err := jwt.ParseSigned(raw, []jose.SignatureAlgorithm{tt.wantAlg})
+			if err != nil {
+				t.Fatalf("failed to parse client assertion: %v", err)
+			}
+			if got := assertion.Headers[0].KeyID; got != tt.keyID {
+				t.Errorf("kid = %q, want %q", got, tt.keyID)
+			}
+			var claims jwt.Claims
+			if err := assertion.Claims(tt.verifyKey, &claims); err != nil {
+				t.Fatalf("client assertion signature invalid: %v", err)
+			}
+			if err := claims.Validate(jwt.Expected{
+				Issuer:      "test-client",
+				Subject:     "test-client",
+				AnyAudience: jwt.Audience{issuer + "/token"},
+			}); err != nil {
+				t.Errorf("client assertion claims invalid: %v", err)
+			}
+			if claims.ID == "" {
+				t.Error("client assertion has no jti")
+			}
+		})
+	}
+}
+
+func TestNewProvider_ClientAssertionKeyFile(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "client.pem")
+	if err := os.WriteFile(keyFile, []byte("not a key"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := NewProvider(context.Background(), &config.OIDCConfig{
+		Issuer:                 oidctest.NewIssuer(t, nil),
+		ClientID:               "test-client",
+		ClientAuthMethod:       config.ClientAuthMethodPrivateKeyJWT,
+		ClientAssertionKeyFile: keyFile,
+		RedirectURI:            "http://localhost/callback",
+		Scopes:                 []string{"openid"},
+	})
+	if err == nil || !strings.Contains(err.Error(), "oidc.client_assertion_key_file") {
+		t.Fatalf("NewProvider error = %v, want client_assertion_key_file error", err)
+	}
+}
+
+func TestExchangeCode_UserInfo(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		fetch     bool
+		userInfo  map[string]interface{}
+		wantRoles interface{}
+		wantEmail interface{}
+		wantErr   string
+	}{
+		{
+			name:  "roles merged from userinfo",
+			fetch: true,
+			userInfo: map[string]interface{}{
+				"sub":          "user-1",
+				"email":        "userinfo@example.com",
+				"realm_access": map[string]interface{}{"roles": []interface{}{"vpn-user"}},
+			},
+			wantRoles: []interface{}{"vpn-user"},
+			// The ID token's claim wins over UserInfo
+			wantEmail: "idtoken@example.com",
+		},
+		{
+			name:      "not fetched without fetch_userinfo",
+			userInfo:  map[string]interface{}{"sub": "user-1", "realm_access": map[string]interface{}{"roles": []interface{}{"vpn-user"}}},
+			wantEmail: "idtoken@example.com",
+		},
+		{
+			name:     "subject mismatch",
+			fetch:    true,
+			userInfo: map[string]interface{}{"sub": "user-2", "realm_access": map[string]interface{}{"roles": []interface{}{"vpn-admin"}}},
+			wantErr:  "does not match ID token subject",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fetches atomic.Int32
+			issuer := newTestJWKSIssuer(t, key, &fetches, &testIssuerTokens{
+				idTokenClaims: map[string]interface{}{"email": "idtoken@example.com"},
+				userInfo:      tt.userInfo,
+			})
+
+			p, err := NewProvider(context.Background(), &config.OIDCConfig{
+				Issuer:        issuer,
+				ClientID:      "test-client",
+				RedirectURI:   "http://localhost/callback",
+				Scopes:        []string{"openid"},
+				FetchUserInfo: tt.fetch,
+			})
+			if err != nil {
+				t.Fatalf("NewProvider failed: %v", err)
+			}
+
+			tokenData, err := p.ExchangeCode(context.Background(), "code", "verifier", "")
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("ExchangeCode error = %v, want error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ExchangeCode failed: %v", err)
+			}
+
+			var roles interface{}
+			if realmAccess, ok := tokenData.Claims["realm_access"].(map[string]interface{}); ok {
+				roles = realmAccess["roles"]
+			}
+			if !reflect.DeepEqual(roles, tt.wantRoles) {
+				t.Errorf("realm_access.roles = %v, want %v", roles, tt.wantRoles)
+			}
+			if got := tokenData.Claims["email"]; got != tt.wantEmail {
+				t.Errorf("email = %v, want %v", got, tt.wantEmail)
+			}
+		})
+	}
+}
+
+func TestExchangeCode_MergeAccessTokenClaims(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	accessTokenClaims := map[string]interface{}{
+		"realm_access": map[string]interface{}{"roles": []interface{}{"vpn-user"}},
+		"groups":       []interface{}{"/vpn"},
+		"department":   "ops",
+	}
+	disabled := false
+
+	tests := []struct {
+		name              string
+		accessTokenClaims map[string]interface{} // nil for an opaque token
+		merge             *bool
+		mergeClaims       []string
+		wantClaims        []string
+		wantAbsent        []string
+		wantOpaque        bool
+	}{
+		{
+			name:              "default claims",
+			accessTokenClaims: accessTokenClaims,
+			wantClaims:        []string{"realm_access", "groups"},
+			wantAbsent:        []string{"department"},
+		},
+		{
+			name:              "disabled",
+			accessTokenClaims: accessTokenClaims,
+			merge:             &disabled,
+			wantAbsent:        []string{"realm_access", "groups", "department"},
+		},
+		{
+			name:              "custom claims",
+			accessTokenClaims: accessTokenClaims,
+			mergeClaims:       []string{"department"},
+			wantClaims:        []string{"department"},
+			wantAbsent:        []string{"realm_access", "groups"},
+		},
+		{
+			name:       "opaque access token",
+			wantOpaque: true,
+		},
+		{
+			name:  "opaque access token, disabled",
+			merge: &disabled,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fetches atomic.Int32
+			issuer := newTestJWKSIssuer(t, key, &fetches, &testIssuerTokens{accessTokenClaims: tt.accessTokenClaims})
+
+			p, err := NewProvider(context.Background(), &config.OIDCConfig{
+				Issuer:                 issuer,
+				ClientID:               "test-client",
+				RedirectURI:            "http://localhost/callback",
+				Scopes:                 []string{"openid"},
+				MergeAccessTokenClaims: tt.merge,
+				MergeClaims:            tt.mergeClaims,
+			})
+			if err != nil {
+				t.Fatalf("NewProvider failed: %v", err)
+			}
+
+			tokenData, err := p.ExchangeCode(context.Background(), "code", "verifier", "")
+			if err != nil {
+				t.Fatalf("ExchangeCode failed: %v", err)
+			}
+			for _, claim := range tt.wantClaims {
+				if _, ok := tokenData.Claims[claim]; !ok {
+					t.Errorf("expected %s to be merged from the access token", claim)
+				}
+			}
+			for _, claim := range tt.wantAbsent {
+				if _, ok := tokenData.Claims[claim]; ok {
+					t.Errorf("%s must not be merged from the access token", claim)
+				}
+			}
+			if tokenData.AccessTokenOpaque != tt.wantOpaque {
+				t.Errorf("AccessTokenOpaque = %v, want %v", tokenData.AccessTokenOpaque, tt.wantOpaque)
+			}
+		})
+	}
+}
+
+func TestExchangeCode_ClockSkew(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	now := time.Now()
+	tests := []struct {
+		name    string
+		skew    int
+		claims  map[string]interface{}
+		wantErr string
+	}{
+		{name: "iat slightly in the future within tolerance", skew: 30,
+			claims: map[string]interface{}{"iat": now.Add(20 * time.Second).Unix()}},
+		{name: "iat beyond tolerance", skew: 30,
+			claims: map[string]interface{}{"iat": now.Add(time.Minute).Unix()}, wantErr: "in the future beyond oidc.clock_skew"},
+		{name: "iat in the future without tolerance", skew: 0,
+			claims: map[string]interface{}{"iat": now.Add(20 * time.Second).Unix()}, wantErr: "in the future beyond oidc.clock_skew"},
+		{name: "exp just passed within tolerance", skew: 30,
+			claims: map[string]interface{}{"iat": now.Add(-time.Hour).Unix(), "exp": now.Add(-10 * time.Second).Unix()}},
+		{name: "exp passed beyond tolerance", skew: 30,
+			claims: map[string]interface{}{"iat": now.Add(-time.Hour).Unix(), "exp": now.Add(-time.Minute).Unix()}, wantErr: "token is expired"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fetches atomic.Int32
+			issuer := newTestJWKSIssuer(t, key, &fetches, &testIssuerTokens{idTokenClaims: tt.claims})
+
+			p, err := NewProvider(context.Background(), &config.OIDCConfig{
+				Issuer:      issuer,
+				ClientID:    "test-client",
+				RedirectURI: "http://localhost/callback",
+				Scopes:      []string{"openid"},
+				ClockSkew:   tt.skew,
+			})
+			if err != nil {
+				t.Fatalf("NewProvider failed: %v", err)
+			}
+
+			_, err = p.ExchangeCode(context.Background(), "code", "verifier", "")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("ExchangeCode failed: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("ExchangeCode error = %v, want error containing %q", err, tt.wantErr)
+			}
+			if !errors.Is(err, ErrTokenVerification) {
+				t.Errorf("ExchangeCode error = %v, want ErrTokenVerification", err)
+			}
+		})
+	}
+}
+
+func TestNewProvider_FetchUserInfoWithoutEndpoint(t *testing.T) {
+	_, err := NewProvider(context.Background(), &config.OIDCConfig{
+		Issuer:        oidctest.NewIssuer(t, nil),
+		ClientID:      "test-client",
+		RedirectURI:   "http://localhost/callback",
+		Scopes:        []string{"openid"},
+		FetchUserInfo: true,
+	})
+	if err == nil || !strings.Contains(err.Error(), "userinfo_endpoint") {
+		t.Fatalf("NewProvider error = %v, want missing userinfo_endpoint", err)
+	}
+}
+
+// testIssuerTokens configures the token and UserInfo endpoints of
+// newTestJWKSIssuer.
+type testIssuerTokens struct {
+	// idTokenClaims are added to the ID token the token endpoint returns
+	// for every code
+	idTokenClaims map[string]interface{}
+	// userInfo is returned by the UserInfo endpoint; nil leaves the
+	// endpoint out of the discovery document
+	userInfo map[string]interface{}
+	// moved, once set, advertises all endpoints under /v2 in the discovery
+	// document, and only those answer
+	moved *atomic.Bool
+	// onTokenRequest, if set, sees every token request before it is
+	// answered
+	onTokenRequest func(r *http.Request)
+	// failTokenRequest, if set, is called for every token request; a
+	// non-zero status is returned instead of the tokens
+	failTokenRequest func() int
+	// tokenError, if set, is the OAuth error code of a 400 response to
+	// every token request
+	tokenError string
+	// accessTokenClaims, if set, make the access token a JWT with these
+	// claims instead of an opaque token
+	accessTokenClaims map[string]interface{}
+}
+
+// newTestJWKSIssuer starts an issuer that serves a JWKS for key and counts
+// how often the JWKS endpoint is fetched. With non-nil tokens it also
+// serves a token endpoint that answers every code with an ID token signed
+// by key, and optionally a UserInfo endpoint.
+func newTestJWKSIssuer(t *testing.T, key *rsa.PrivateKey, fetches *atomic.Int32, tokens *testIssuerTokens) string {
+	t.Helper()
+
+	var baseURL string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		issuer := baseURL + "/realms/test"
+		endpoints := issuer
+		path := r.URL.Path
+		if tokens != nil && tokens.moved != nil && tokens.moved.Load() {
+			endpoints = issuer + "/v2"
+			if moved, ok := strings.CutPrefix(path, "/realms/test/v2/"); ok {
+				path = "/realms/test/" + moved
+			} else if !strings.HasSuffix(path, "/.well-known/openid-configuration") {
+				path = ""
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		switch path {
+		case "/realms/test/.well-known/openid-configuration":
+			discovery := map[string]interface{}{
+				"issuer":                                issuer,
+				"authorization_endpoint":                endpoints + "/auth",
+				"token_endpoint":                        endpoints + "/token",
+				"jwks_uri":                              endpoints + "/keys",
+				"id_token_signing_alg_values_supported": []string{"RS256"},
+			}
+			if tokens != nil && tokens.userInfo != nil {
+				discovery["userinfo_endpoint"] = endpoints + "/userinfo"
+			}
+			_ = json.NewEncoder(w).Encode(discovery)
+		case "/realms/test/token":
+			if tokens == nil {
+				http.NotFound(w, r)
+				return
+			}
+			if tokens.onTokenRequest != nil {
+				tokens.onTokenRequest(r)
+			}
+			if tokens.tokenError != "" {
+				w.WriteHeader(http.StatusBadRequest)
+				_ = json.NewEncoder(w).Encode(map[string]string{
+					"error":             tokens.tokenError,
+					"error_description": "Code not valid",
+				})
+				return
+			}
+			if tokens.failTokenRequest != nil {
+				if status := tokens.failTokenRequest(); status != 0 {
+					w.WriteHeader(status)
+					_ = json.NewEncoder(w).Encode(map[string]string{"error": http.StatusText(status)})
+					return
+				}
+			}
+			accessToken := "opaque-access-token"
+			if tokens.accessTokenClaims != nil {
+				accessToken = makeTestJWT(t, tokens.accessTokenClaims)
+			}
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"access_token": accessToken,
+				"token_type":   "Bearer",
+				"expires_in":   300,
+				"id_token":     signTestIDToken(t, key, issuer, "test-client", tokens.idTokenClaims),
+			})
+		case "/realms/test/userinfo":
+			if tokens == nil || tokens.userInfo == nil ||
+				r.Header.Get("Authorization") != "Bearer opaque-access-token" {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(tokens.userInfo)
+		case "/realms/test/keys":
+			fetches.Add(1)
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"keys": []map[string]string{{
+					"kty": "RSA",
+					"kid": "test-key",
+					"use": "sig",
+					"alg": "RS256",
+					"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+				}},
+			})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	baseURL = ts.URL
+	t.Cleanup(ts.Close)
+
+	return baseURL + "/realms/test"
+}
+
+// signTestIDToken creates an RS256-signed ID token for issuer and clientID,
+// with the extra claims added.
+func signTestIDToken(t *testing.T, key *rsa.PrivateKey, issuer, clientID string, extra map[string]interface{}) string {
+	t.Helper()
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test-key", "typ": "JWT"})
+	claims := map[string]interface{}{
+		"iss": issuer,
+		"aud": clientID,
+		"sub": "user-1",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range extra {
+		claims[k] = v
+	}
+	payload, _ := json.Marshal(claims)
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("failed to sign token: %v", err)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestProvider_JWKSCacheDuration(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	var fetches atomic.Int32
+	issuer := newTestJWKSIssuer(t, key, &fetches, nil)
+
+	p, err := NewProvider(context.Background(), &config.OIDCConfig{
+		Issuer:            issuer,
+		ClientID:          "test-client",
+		RedirectURI:       "http://localhost/callback",
+		Scopes:            []string{"openid"},
+		JWKSCacheDuration: 60,
+	})
+	if err != nil {
+		t.Fatalf("NewProvider failed: %v", err)
+	}
+
+	now := time.Now()
+	p.discovered().keySet.now = func() time.Time { return now }
+
+	token := signTestIDToken(t, key, issuer, "test-client", nil)
+	verify := func() {
+		t.Helper()
+		if _, err := p.discovered().verifier.Verify(context.Background(), token); err != nil {
+			t.Fatalf("Verify failed: %v", err)
+		}
+	}
+
+	verify()
+	verify()
+	if got := fetches.Load(); got != 1 {
+		t.Fatalf("JWKS fetches within cache duration = %d, want 1", got)
+	}
+
+	now = now.Add(59 * time.Second)
+	verify()
+	if got := fetches.Load(); got != 1 {
+		t.Fatalf("JWKS fetches before expiry = %d, want 1", got)
+	}
+
+	now = now.Add(2 * time.Second)
+	verify()
+	if got := fetches.Load(); got != 2 {
+		t.Fatalf("JWKS fetches after expiry = %d, want 2", got)
+	}
+
+	verify()
+	if got := fetches.Load(); got != 2 {
+		t.Fatalf("JWKS fetches after refetch = %d, want 2", got)
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	employees := oidctest.NewIssuer(t, nil)
+	contractors := oidctest.NewIssuer(t, nil)
+
+	r, err := NewRegistry(context.Background(), &config.OIDCConfig{
+		Issuer:      employees,
+		ClientID:    "test-client",
+		RedirectURI: "http://localhost/callback",
+		Scopes:      []string{"openid"},
+		Providers: []config.OIDCProviderConfig{
+			{Name: "contractors", UsernamePrefix: "ext-", Issuer: contractors, ClientID: "contractor-client"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewRegistry failed: %v", err)
+	}
+
+	name, p := r.Select("ext-alice", "")
+	if name != "contractors" {
+		t.Fatalf("Select name = %q, want %q", name, "contractors")
+	}
+	if p.Config().Issuer != contractors || p.Config().ClientID != "contractor-client" {
+		t.Errorf("selected provider config = %+v, want contractors issuer and client", p.Config())
+	}
+
+	name, p = r.Select("alice", "")
+	if name != config.DefaultOIDCProvider {
+		t.Fatalf("Select name = %q, want %q", name, config.DefaultOIDCProvider)
+	}
+	if p.Config().Issuer != employees {
+		t.Errorf("default provider issuer = %q, want %q", p.Config().Issuer, employees)
+	}
+
+	if got, ok := r.Get(""); !ok || got != p {
+		t.Error("Get(\"\") should return the default provider")
+	}
+	if _, ok := r.Get("missing"); ok {
+		t.Error("Get should fail for an unknown provider")
+	}
+
+	var nilRegistry *Registry
+	if _, ok := nilRegistry.Get("contractors"); ok {
+		t.Error("Get on nil registry should fail")
+	}
+}
+
+func TestReloadRegistry(t *testing.T) {
+	issuer := oidctest.NewIssuer(t, nil)
+	base := config.OIDCConfig{
+		Issuer:        issuer,
+		ClientID:      "test-client",
+		RedirectURI:   "http://localhost/callback",
+		Scopes:        []string{"openid"},
+		RequiredRoles: []string{"vpn-user"},
+	}
+
+	old, err := NewRegistry(context.Background(), &base)
+	if err != nil {
+		t.Fatalf("NewRegistry failed: %v", err)
+	}
+	oldDefault, _ := old.Get("")
+
+	tests := []struct {
+		name       string
+		modify     func(cfg *config.OIDCConfig)
+		wantReused bool
+	}{
+		{
+			name:       "authorization change reuses provider",
+			modify:     func(cfg *config.OIDCConfig) { cfg.RequiredRoles = []string{"vpn-admin"} },
+			wantReused: true,
+		},
+		{
+			name: "token exchange change reuses provider",
+			modify: func(cfg *config.OIDCConfig) {
+				cfg.TokenExchangeTimeout = 30
+				cfg.TokenExchangeRetries = 5
+			},
+			wantReused: true,
+		},
+		{
+			name:       "client change rediscovers provider",
+			modify:     func(cfg *config.OIDCConfig) { cfg.ClientID = "other-client" },
+			wantReused: false,
+		},
+		{
+			name:       "scope change rediscovers provider",
+			modify:     func(cfg *config.OIDCConfig) { cfg.Scopes = []string{"openid", "email"} },
+			wantReused: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := base
+			tt.modify(&cfg)
+
+			r, err := ReloadRegistry(context.Background(), old, &cfg)
+			if err != nil {
+				t.Fatalf("ReloadRegistry failed: %v", err)
+			}
+			p, ok := r.Get("")
+			if !ok {
+				t.Fatal("reloaded registry has no default provider")
+			}
+
+			if reused := p.discovered() == oldDefault.discovered(); reused != tt.wantReused {
+				t.Errorf("provider reused = %v, want %v", reused, tt.wantReused)
+			}
+			if !reflect.DeepEqual(*p.Config(), cfg) {
+				t.Errorf("reloaded provider config = %+v, want %+v", p.Config(), cfg)
+			}
+			if !reflect.DeepEqual(oldDefault.Config().RequiredRoles, []string{"vpn-user"}) {
+				t.Errorf("old provider config was modified: %v", oldDefault.Config().RequiredRoles)
+			}
+		})
+	}
+}
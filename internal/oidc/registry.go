@@ -0,0 +1,148 @@
+package oidc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
+)
+
+// Registry holds the OIDC providers of a daemon, keyed by name.
+// The provider built from the top-level oidc settings is registered as
+// config.DefaultOIDCProvider and is used when no other provider matches.
+type Registry struct {
+	providers map[string]*Provider
+	rules     []config.OIDCProviderConfig
+}
+
+// NewRegistry discovers the default provider and every entry of
+// cfg.Providers. It fails if any issuer cannot be discovered.
+func NewRegistry(ctx context.Context, cfg *config.OIDCConfig) (*Registry, error) {
+	r := &Registry{
+		providers: make(map[string]*Provider, len(cfg.Providers)+1),
+		rules:     cfg.Providers,
+	}
+
+	defaultCfg := cfg.ForProvider(config.OIDCProviderConfig{})
+	p, err := NewProvider(ctx, &defaultCfg)
+	if err != nil {
+		return nil, err
+	}
+	r.providers[config.DefaultOIDCProvider] = p
+
+	for _, rule := range cfg.Providers {
+		providerCfg := cfg.ForProvider(rule)
+		p, err := NewProvider(ctx, &providerCfg)
+		if err != nil {
+			return nil, fmt.Errorf("provider %q: %w", rule.Name, err)
+		}
+		r.providers[rule.Name] = p
+	}
+
+	return r, nil
+}
+
+// ReloadRegistry builds a registry for cfg, reusing the providers of old
+// whose connection settings (see sameConnection) are unchanged, so only new
+// or changed issuers are discovered again. Reused providers pick up all
+// other new settings, such as required roles, groups, claims and the token
+// exchange timeout and retries, which are read on every login. old may be
+// nil.
+func ReloadRegistry(ctx context.Context, old *Registry, cfg *config.OIDCConfig) (*Registry, error) {
+	r := &Registry{
+		providers: make(map[string]*Provider, len(cfg.Providers)+1),
+		rules:     cfg.Providers,
+	}
+
+	load := func(name string, providerCfg *config.OIDCConfig) (*Provider, error) {
+		if prev, ok := old.Get(name); ok && sameConnection(&prev.cfg, providerCfg) {
+			return prev.withConfig(providerCfg), nil
+		}
+		return NewProvider(ctx, providerCfg)
+	}
+
+	defaultCfg := cfg.ForProvider(config.OIDCProviderConfig{})
+	p, err := load(config.DefaultOIDCProvider, &defaultCfg)
+	if err != nil {
+		return nil, err
+	}
+	r.providers[config.DefaultOIDCProvider] = p
+
+	for _, rule := range cfg.Providers {
+		providerCfg := cfg.ForProvider(rule)
+		p, err := load(rule.Name, &providerCfg)
+		if err != nil {
+			return nil, fmt.Errorf("provider %q: %w", rule.Name, err)
+		}
+		r.providers[rule.Name] = p
+	}
+
+	return r, nil
+}
+
+// sameConnection reports whether a and b would produce identical OIDC
+// discovery, OAuth2 and verifier setups: the same issuer, client
+// credentials and authentication method, redirect URI, scopes, JWKS cache
+// duration and clock skew.
+func sameConnection(a, b *config.OIDCConfig) bool {
+	return a.Issuer == b.Issuer &&
+		a.ClientID == b.ClientID &&
+		a.ClientSecret == b.ClientSecret &&
+		a.ClientAuthMethod == b.ClientAuthMethod &&
+		a.ClientAssertionKeyFile == b.ClientAssertionKeyFile &&
+		a.ClientAssertionKeyID == b.ClientAssertionKeyID &&
+		a.RedirectURI == b.RedirectURI &&
+		slices.Equal(a.Scopes, b.Scopes) &&
+		a.JWKSCacheDuration == b.JWKSCacheDuration &&
+		a.ClockSkew == b.ClockSkew
+}
+
+// Select returns the name and provider for a connection. Providers are
+// matched in configuration order; the default provider is returned if none
+// match.
+func (r *Registry) Select(username, commonName string) (string, *Provider) {
+	for i := range r.rules {
+		if r.rules[i].Matches(username, commonName) {
+			return r.rules[i].Name, r.providers[r.rules[i].Name]
+		}
+	}
+	return config.DefaultOIDCProvider, r.providers[config.DefaultOIDCProvider]
+}
+
+// Get returns the provider with the given name. An empty name refers to the
+// default provider. It is safe to call on a nil *Registry.
+func (r *Registry) Get(name string) (*Provider, bool) {
+	if r == nil {
+		return nil, false
+	}
+	if name == "" {
+		name = config.DefaultOIDCProvider
+	}
+	p, ok := r.providers[name]
+	return p, ok
+}
+
+// Issuer returns the issuer URL of the named provider, or "" if there is no
+// such provider. It is safe to call on a nil *Registry.
+func (r *Registry) Issuer(name string) string {
+	p, ok := r.Get(name)
+	if !ok {
+		return ""
+	}
+	return p.Config().Issuer
+}
+
+// Refresh re-runs discovery for every provider, see Provider.Refresh. It
+// tries all providers and returns their errors joined.
+func (r *Registry) Refresh(ctx context.Context) error {
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(r.providers)) {
+		if err := r.providers[name].Refresh(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("provider %q: %w", name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
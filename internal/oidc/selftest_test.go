@@ -0,0 +1,98 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/oidc/oidctest"
+)
+
+func TestSelfTest(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	var fetches atomic.Int32
+
+	tests := []struct {
+		name    string
+		issuer  string
+		wantErr string
+	}{
+		{name: "healthy issuer", issuer: newTestJWKSIssuer(t, key, &fetches, nil)},
+		{name: "JWKS missing", issuer: oidctest.NewIssuer(t, nil), wantErr: "JWKS"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewRegistry(context.Background(), &config.OIDCConfig{
+				Issuer:      tt.issuer,
+				ClientID:    "test-client",
+				RedirectURI: "http://localhost/callback",
+				Scopes:      []string{"openid"},
+			})
+			if err != nil {
+				t.Fatalf("NewRegistry failed: %v", err)
+			}
+
+			err = r.SelfTest(context.Background())
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("SelfTest failed: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("SelfTest error = %v, want error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// countingTransport counts the requests it passes to http.DefaultTransport.
+type countingTransport struct {
+	requests atomic.Int32
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.requests.Add(1)
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestSelfTest_UsesProviderClient(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	var fetches atomic.Int32
+	issuer := newTestJWKSIssuer(t, key, &fetches, nil)
+
+	transport := &countingTransport{}
+	ctx := oidc.ClientContext(context.Background(), &http.Client{Transport: transport})
+	p, err := NewProvider(ctx, &config.OIDCConfig{
+		Issuer:      issuer,
+		ClientID:    "test-client",
+		RedirectURI: "http://localhost/callback",
+		Scopes:      []string{"openid"},
+	})
+	if err != nil {
+		t.Fatalf("NewProvider failed: %v", err)
+	}
+
+	before := transport.requests.Load()
+	if err := p.SelfTest(context.Background()); err != nil {
+		t.Fatalf("SelfTest failed: %v", err)
+	}
+	// Discovery document and JWKS
+	if got := transport.requests.Load() - before; got != 2 {
+		t.Errorf("SelfTest sent %d requests through the provider's client, want 2", got)
+	}
+}
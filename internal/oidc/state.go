@@ -0,0 +1,41 @@
+package oidc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+// ErrInvalidState is returned by VerifyState for states that are malformed
+// or whose signature does not match oidc.state_secret.
+var ErrInvalidState = errors.New("invalid state signature")
+
+// signState returns the signed state "<instanceID>.<nonce>.<hmac>", where
+// hmac is the base64url HMAC-SHA256 of "<instanceID>.<nonce>" under secret.
+func signState(instanceID, nonce, secret string) string {
+	payload := instanceID + "." + nonce
+	return payload + "." + stateMAC(payload, secret)
+}
+
+// stateMAC computes the signature part of a signed state.
+func stateMAC(payload, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyState checks the signature of a state produced with
+// oidc.state_secret and returns the ID of the instance that issued it.
+func VerifyState(state, secret string) (string, error) {
+	parts := strings.Split(state, ".")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		return "", ErrInvalidState
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(stateMAC(payload, secret))) {
+		return "", ErrInvalidState
+	}
+	return parts[0], nil
+}
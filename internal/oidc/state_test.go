@@ -0,0 +1,60 @@
+package oidc
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const testStateSecret = "0123456789abcdef0123456789abcdef"
+
+func TestGenerateSignedState(t *testing.T) {
+	state, err := generateState("vpn1", testStateSecret)
+	if err != nil {
+		t.Fatalf("generateState failed: %v", err)
+	}
+
+	parts := strings.Split(state, ".")
+	if len(parts) != 3 || parts[0] != "vpn1" || len(parts[1]) != 32 {
+		t.Fatalf("state = %q, want vpn1.<32 hex>.<hmac>", state)
+	}
+	// instance ID + nonce + base64url HMAC-SHA256 with two separators
+	if want := 4 + 32 + 43 + 2; len(state) != want {
+		t.Errorf("state length = %d, want %d", len(state), want)
+	}
+
+	instanceID, err := VerifyState(state, testStateSecret)
+	if err != nil {
+		t.Fatalf("VerifyState failed: %v", err)
+	}
+	if instanceID != "vpn1" {
+		t.Errorf("instance ID = %q, want vpn1", instanceID)
+	}
+}
+
+func TestVerifyState(t *testing.T) {
+	valid := signState("vpn1", "00112233445566778899aabbccddeeff", testStateSecret)
+	parts := strings.Split(valid, ".")
+
+	tests := []struct {
+		name   string
+		state  string
+		secret string
+	}{
+		{name: "other instance", state: "vpn2." + parts[1] + "." + parts[2], secret: testStateSecret},
+		{name: "other nonce", state: parts[0] + ".ffeeddccbbaa99887766554433221100." + parts[2], secret: testStateSecret},
+		{name: "other signature", state: parts[0] + "." + parts[1] + ".AAAA", secret: testStateSecret},
+		{name: "wrong secret", state: valid, secret: "fedcba9876543210fedcba9876543210"},
+		{name: "unsigned", state: "00112233445566778899aabbccddeeff", secret: testStateSecret},
+		{name: "empty instance", state: "." + parts[1] + "." + parts[2], secret: testStateSecret},
+		{name: "too many parts", state: valid + ".x", secret: testStateSecret},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := VerifyState(tt.state, tt.secret); !errors.Is(err, ErrInvalidState) {
+				t.Errorf("VerifyState(%q) error = %v, want ErrInvalidState", tt.state, err)
+			}
+		})
+	}
+}
@@ -1,8 +1,11 @@
 package oidc
 
 import (
+	"errors"
 	"fmt"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
 )
@@ -12,13 +15,47 @@ import (
 type Validator struct {
 	oidcCfg *config.OIDCConfig
 	authCfg *config.AuthConfig
+	now     func() time.Time
 }
 
+// ErrAuthTooOld is returned by ValidateAuthTime when the user last
+// authenticated to the identity provider more than oidc.max_age ago.
+var ErrAuthTooOld = errors.New("authentication is older than oidc.max_age")
+
+// ErrACRNotMet is returned by ValidateACR when the token's authentication
+// context is not one of oidc.required_acr.
+var ErrACRNotMet = errors.New("authentication context does not meet oidc.required_acr")
+
+// ErrDeniedRole is returned by ValidateAuthorization when the user has one
+// of oidc.denied_roles.
+var ErrDeniedRole = errors.New("user has a denied role")
+
+// ErrMissingRole is returned by the role checks when the user has none of
+// the required roles.
+var ErrMissingRole = errors.New("user does not have required roles")
+
+// ErrMissingGroup is returned by ValidateAuthorization when the user is in
+// none of oidc.required_groups.
+var ErrMissingGroup = errors.New("user is not in required groups")
+
+// ErrUsernameMismatch is returned by ValidateUsername when the username
+// claim differs from the username the client sent.
+var ErrUsernameMismatch = errors.New("username mismatch")
+
+// ErrCNMismatch is returned by ValidateCommonName when the client
+// certificate common name differs from the auth.cn_claim value.
+var ErrCNMismatch = errors.New("common name mismatch")
+
+// ErrClaimNotFound is wrapped by the errors for a claim, such as the
+// username or role claim, that is missing from the token.
+var ErrClaimNotFound = errors.New("claim not found")
+
 // NewValidator creates a new token validator.
 func NewValidator(oidcCfg *config.OIDCConfig, authCfg *config.AuthConfig) *Validator {
 	return &Validator{
 		oidcCfg: oidcCfg,
 		authCfg: authCfg,
+		now:     time.Now,
 	}
 }
 
@@ -34,36 +71,224 @@ func NewValidator(oidcCfg *config.OIDCConfig, authCfg *config.AuthConfig) *Valid
 // - Role/group enforcement
 func (v *Validator) ValidateToken(claims map[string]interface{}, expectedUsername string) error {
 	// 1. Validate username claim
-	if err := v.validateUsername(claims, expectedUsername); err != nil {
+	if err := v.ValidateUsername(claims, expectedUsername); err != nil {
 		return err
 	}
 
-	// 2. Validate required roles (if configured)
-	if len(v.oidcCfg.RequiredRoles) > 0 {
-		if err := v.validateRoles(claims); err != nil {
-			return err
-		}
-	}
-
-	return nil
+	// 2. Validate required roles/groups (if configured)
+	return v.ValidateAuthorization(claims)
 }
 
-// validateUsername extracts and validates the username claim.
-func (v *Validator) validateUsername(claims map[string]interface{}, expectedUsername string) error {
+// ValidateUsername extracts the username claim and checks that it matches
+// expectedUsername, after auth.username_transform.
+func (v *Validator) ValidateUsername(claims map[string]interface{}, expectedUsername string) error {
 	// Extract username from configured claim
 	username, err := getClaimString(claims, v.authCfg.UsernameClaim)
 	if err != nil {
 		return fmt.Errorf("username claim '%s' not found: %w", v.authCfg.UsernameClaim, err)
 	}
 
+	// Apply the configured rewrite (e.g. strip "@corp") before comparing
+	username, expectedUsername, err = v.transformUsernames(username, expectedUsername)
+	if err != nil {
+		return err
+	}
+
 	// Check if it matches expected username
-	if username != expectedUsername {
-		return fmt.Errorf("username mismatch: expected '%s', got '%s'", expectedUsername, username)
+	if username != expectedUsername && !(v.authCfg.CaseInsensitive && strings.EqualFold(username, expectedUsername)) {
+		return fmt.Errorf("%w: expected '%s', got '%s'", ErrUsernameMismatch, expectedUsername, username)
+	}
+
+	return nil
+}
+
+// ValidateCommonName checks that the auth.cn_claim value (auth.username_claim
+// if unset) equals commonName, the client certificate common name, for
+// auth.require_cn_match. A client without a common name never matches.
+func (v *Validator) ValidateCommonName(claims map[string]interface{}, commonName string) error {
+	claim := v.authCfg.CNClaim
+	if claim == "" {
+		claim = v.authCfg.UsernameClaim
+	}
+
+	value, err := getClaimString(claims, claim)
+	if err != nil {
+		return fmt.Errorf("common name claim '%s' not found: %w", claim, err)
+	}
+
+	if commonName == "" {
+		return fmt.Errorf("%w: client has no certificate common name, token has '%s'", ErrCNMismatch, value)
+	}
+	if value != commonName {
+		return fmt.Errorf("%w: certificate has '%s', token has '%s'", ErrCNMismatch, commonName, value)
+	}
+
+	return nil
+}
+
+// transformUsernames applies auth.username_transform to the claim value,
+// the expected username, or both, depending on apply_to. Values the regex
+// does not match are returned unchanged.
+func (v *Validator) transformUsernames(claimUsername, expectedUsername string) (string, string, error) {
+	t := v.authCfg.UsernameTransform
+	if t.Match == "" {
+		return claimUsername, expectedUsername, nil
+	}
+
+	re, err := regexp.Compile(t.Match)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid username_transform.match: %w", err)
+	}
+
+	switch t.ApplyTo {
+	case config.UsernameTransformExpected:
+		expectedUsername = re.ReplaceAllString(expectedUsername, t.Replace)
+	case config.UsernameTransformBoth:
+		claimUsername = re.ReplaceAllString(claimUsername, t.Replace)
+		expectedUsername = re.ReplaceAllString(expectedUsername, t.Replace)
+	default:
+		claimUsername = re.ReplaceAllString(claimUsername, t.Replace)
+	}
+
+	return claimUsername, expectedUsername, nil
+}
+
+// ValidateAuthTime enforces oidc.max_age: the auth_time claim must be at
+// most max_age seconds old (ErrAuthTooOld). A token without auth_time is
+// rejected in the strict oidc.auth_time_mode and accepted in lenient mode.
+// It is a no-op when max_age is not set.
+func (v *Validator) ValidateAuthTime(claims map[string]interface{}) error {
+	if v.oidcCfg.MaxAge <= 0 {
+		return nil
 	}
 
+	value, ok := claims["auth_time"]
+	if !ok {
+		if v.oidcCfg.AuthTimeMode == config.AuthTimeModeLenient {
+			return nil
+		}
+		return fmt.Errorf("auth_time %w (required by oidc.max_age)", ErrClaimNotFound)
+	}
+	// JSON numbers decode as float64
+	authTime, ok := value.(float64)
+	if !ok {
+		return fmt.Errorf("auth_time claim is not a number")
+	}
+
+	age := v.now().Sub(time.Unix(int64(authTime), 0))
+	if age > time.Duration(v.oidcCfg.MaxAge)*time.Second {
+		return fmt.Errorf("%w (authenticated %s ago, max_age is %ds)", ErrAuthTooOld, age.Truncate(time.Second), v.oidcCfg.MaxAge)
+	}
 	return nil
 }
 
+// ValidateACR checks that the acr claim is one of oidc.required_acr
+// (ErrACRNotMet). acr may be a string or, from some providers, an array of
+// strings. A token whose amr claim (the array of authentication methods,
+// e.g. ["pwd", "otp"]) lists a required value is accepted too. It is a
+// no-op when required_acr is not set.
+func (v *Validator) ValidateACR(claims map[string]interface{}) error {
+	if len(v.oidcCfg.RequiredACR) == 0 {
+		return nil
+	}
+
+	var got []string
+	if acr, err := getClaimString(claims, "acr"); err == nil {
+		got = append(got, acr)
+	} else if acrs, err := getRolesFromClaim(claims, "acr"); err == nil {
+		got = append(got, acrs...)
+	}
+	if amr, err := getRolesFromClaim(claims, "amr"); err == nil {
+		got = append(got, amr...)
+	}
+
+	for _, required := range v.oidcCfg.RequiredACR {
+		if containsRole(got, required) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: required one of %v, token has acr/amr %v", ErrACRNotMet, v.oidcCfg.RequiredACR, got)
+}
+
+// RolesUnavailableError is returned by CheckRolesAvailable when roles or
+// groups are required but the claims carry none of the configured claim
+// paths and the access token was opaque, so its claims could not be used.
+type RolesUnavailableError struct {
+	Paths []string // the role and group claim paths that were looked up
+}
+
+func (e *RolesUnavailableError) Error() string {
+	return fmt.Sprintf("no role or group claims (%s) in the ID token and the access token is opaque; "+
+		"add the role/group mappers to the ID token or enable oidc.fetch_userinfo", strings.Join(e.Paths, ", "))
+}
+
+// CheckRolesAvailable tells a missing role claim apart from a user without
+// the required roles: when roles or groups are required, accessTokenOpaque
+// is set and none of the claim paths resolve, it returns a
+// *RolesUnavailableError. Otherwise it returns nil and the regular role
+// checks report the outcome.
+func (v *Validator) CheckRolesAvailable(claims map[string]interface{}, accessTokenOpaque bool) error {
+	if !accessTokenOpaque {
+		return nil
+	}
+
+	var paths []string
+	if len(v.oidcCfg.RequiredRoles) > 0 || len(v.oidcCfg.InstanceRequiredRoles) > 0 {
+		paths = append(paths, v.rolePaths()...)
+	}
+	if len(v.oidcCfg.RequiredGroups) > 0 {
+		paths = append(paths, v.oidcCfg.GroupClaim)
+	}
+	if len(paths) == 0 {
+		return nil
+	}
+
+	for _, path := range paths {
+		if _, err := getNestedClaim(claims, path); err == nil {
+			return nil
+		}
+	}
+	return &RolesUnavailableError{Paths: paths}
+}
+
+// ValidateAuthorization validates required roles and required groups.
+// When both are configured they are combined according to auth.authz_mode:
+// "and" (default) requires both to pass, "or" requires either. Unconfigured
+// requirements are skipped. Denied roles are checked first and always
+// reject.
+func (v *Validator) ValidateAuthorization(claims map[string]interface{}) error {
+	// Denied roles win over any required role or group
+	if len(v.oidcCfg.DeniedRoles) > 0 {
+		if err := v.validateDeniedRoles(claims); err != nil {
+			return err
+		}
+	}
+
+	checkRoles := len(v.oidcCfg.RequiredRoles) > 0
+	checkGroups := len(v.oidcCfg.RequiredGroups) > 0
+
+	var roleErr, groupErr error
+	if checkRoles {
+		roleErr = v.validateRoles(claims)
+	}
+	if checkGroups {
+		groupErr = v.validateGroups(claims)
+	}
+
+	if checkRoles && checkGroups && v.authCfg.AuthzMode == config.AuthzModeOr {
+		if roleErr == nil || groupErr == nil {
+			return nil
+		}
+		return fmt.Errorf("%w; %w", roleErr, groupErr)
+	}
+
+	if roleErr != nil {
+		return roleErr
+	}
+	return groupErr
+}
+
 // ValidateRoles validates that the user has at least one of the required roles.
 // It is a no-op when no roles are configured.
 func (v *Validator) ValidateRoles(claims map[string]interface{}) error {
@@ -73,22 +298,178 @@ func (v *Validator) ValidateRoles(claims map[string]interface{}) error {
 	return v.validateRoles(claims)
 }
 
-// validateRoles validates that the user has at least one of the required roles.
+// ValidateInstanceRoles validates that the user has at least one of the roles
+// oidc.instance_required_roles requires for the given OpenVPN server
+// instance. It is a no-op for instances without an entry.
+func (v *Validator) ValidateInstanceRoles(claims map[string]interface{}, instance string) error {
+	required := v.oidcCfg.InstanceRequiredRoles[instance]
+	if len(required) == 0 {
+		return nil
+	}
+
+	roles, err := v.extractRoles(claims)
+	if err != nil {
+		return fmt.Errorf("failed to extract roles: %w", err)
+	}
+
+	for _, requiredRole := range required {
+		if containsRolePattern(roles, requiredRole, v.authCfg.CaseInsensitive) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w for server %s: %v (user roles: %v)", ErrMissingRole, instance, required, roles)
+}
+
+// validateRoles validates that the user has at least one of the required
+// roles, which may be wildcard patterns (see matchRole).
 func (v *Validator) validateRoles(claims map[string]interface{}) error {
-	// Extract roles from configured claim path (e.g., "realm_access.roles")
-	roles, err := getRolesFromClaim(claims, v.oidcCfg.RoleClaim)
+	// Extract roles from configured claim path(s) (e.g., "realm_access.roles")
+	roles, err := v.extractRoles(claims)
 	if err != nil {
 		return fmt.Errorf("failed to extract roles: %w", err)
 	}
 
 	// Check if user has at least one of the required roles
 	for _, requiredRole := range v.oidcCfg.RequiredRoles {
-		if containsRole(roles, requiredRole) {
+		if containsRolePattern(roles, requiredRole, v.authCfg.CaseInsensitive) {
 			return nil // User has required role
 		}
 	}
 
-	return fmt.Errorf("user does not have required roles: %v (user roles: %v)", v.oidcCfg.RequiredRoles, roles)
+	return fmt.Errorf("%w: %v (user roles: %v)", ErrMissingRole, v.oidcCfg.RequiredRoles, roles)
+}
+
+// validateDeniedRoles rejects users carrying any of the denied roles, which
+// are matched like required roles: as wildcard patterns (see matchRole),
+// ignoring case with auth.case_insensitive. Roles are read from RoleClaim and every RoleClaimFallbacks path, regardless
+// of RoleClaimAggregate, so a denied role cannot hide behind a path that the
+// required-role check would skip. A user without any role claim has no
+// denied roles.
+func (v *Validator) validateDeniedRoles(claims map[string]interface{}) error {
+	for _, path := range v.rolePaths() {
+		roles, err := getRolesFromClaim(claims, path)
+		if err != nil {
+			continue
+		}
+		for _, deniedRole := range v.oidcCfg.DeniedRoles {
+			if containsRolePattern(roles, deniedRole, v.authCfg.CaseInsensitive) {
+				return fmt.Errorf("%w: %s", ErrDeniedRole, deniedRole)
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateGroups validates that the user is in at least one of the required
+// groups. Keycloak reports groups as full paths (e.g. "/vpn/admins") when
+// "Full group path" is enabled on the mapper. With oidc.match_subgroups,
+// membership of a subgroup also satisfies a required parent group, so
+// "/vpn" matches "/vpn/admins".
+func (v *Validator) validateGroups(claims map[string]interface{}) error {
+	groups, err := getRolesFromClaim(claims, v.oidcCfg.GroupClaim)
+	if err != nil {
+		return fmt.Errorf("failed to extract groups: %w", err)
+	}
+
+	for _, requiredGroup := range v.oidcCfg.RequiredGroups {
+		for _, group := range groups {
+			if groupMatches(group, requiredGroup, v.oidcCfg.MatchSubgroups) {
+				return nil // User is in required group
+			}
+		}
+	}
+
+	return fmt.Errorf("%w: %v (user groups: %v)", ErrMissingGroup, v.oidcCfg.RequiredGroups, groups)
+}
+
+// groupMatches reports whether group is required or, with subgroups, one
+// of its subgroups. Leading and trailing slashes are ignored, so
+// "/vpn/admins" and "vpn/admins" are equivalent.
+func groupMatches(group, required string, subgroups bool) bool {
+	group = strings.Trim(group, "/")
+	required = strings.Trim(required, "/")
+	if required == "" {
+		return false
+	}
+	if group == required {
+		return true
+	}
+	return subgroups && strings.HasPrefix(group, required+"/")
+}
+
+// rolePaths returns RoleClaim followed by the RoleClaimFallbacks paths, in
+// the order they are tried. oidc.role_claims is folded into these settings
+// when the config is loaded.
+func (v *Validator) rolePaths() []string {
+	return append([]string{v.oidcCfg.RoleClaim}, v.oidcCfg.RoleClaimFallbacks...)
+}
+
+// extractRoles resolves roles from RoleClaim and, if configured, the
+// RoleClaimFallbacks paths. Paths are tried in order; by default the first
+// path that resolves to an array wins. With RoleClaimAggregate, roles from
+// every resolvable path are combined.
+func (v *Validator) extractRoles(claims map[string]interface{}) ([]string, error) {
+	paths := v.ResolveRolePaths(claims)
+	if len(paths) == 1 {
+		return paths[0].Roles, paths[0].Err
+	}
+
+	var roles []string
+	var firstErr error
+	resolved := false
+
+	for _, rp := range paths {
+		if rp.Err != nil && firstErr == nil {
+			firstErr = rp.Err
+		}
+		if !rp.Used {
+			continue
+		}
+
+		resolved = true
+		for _, role := range rp.Roles {
+			if !containsRole(roles, role) {
+				roles = append(roles, role)
+			}
+		}
+	}
+
+	if !resolved {
+		return nil, fmt.Errorf("no role claim found in paths %v: %w", v.rolePaths(), firstErr)
+	}
+
+	return roles, nil
+}
+
+// RolePath is a role claim path and what it resolves to in a token.
+type RolePath struct {
+	Path  string
+	Roles []string
+	Err   error // why the path does not resolve to a string array
+	Used  bool  // whether the required roles check uses these roles
+}
+
+// ResolveRolePaths reports what RoleClaim and each RoleClaimFallbacks path
+// resolve to in claims, and which of them the role checks use. extractRoles
+// combines the roles of the used paths, so diagnostics built on it show
+// exactly what the checks see.
+func (v *Validator) ResolveRolePaths(claims map[string]interface{}) []RolePath {
+	paths := v.rolePaths()
+
+	resolved := make([]RolePath, 0, len(paths))
+	used := false
+	for _, path := range paths {
+		roles, err := getRolesFromClaim(claims, path)
+		rp := RolePath{Path: path, Roles: roles, Err: err}
+		if err == nil && (!used || v.oidcCfg.RoleClaimAggregate) {
+			rp.Used = true
+			used = true
+		}
+		resolved = append(resolved, rp)
+	}
+	return resolved
 }
 
 // getClaimString extracts a string claim, supporting dot notation for nested claims.
@@ -141,12 +522,12 @@ func getNestedClaim(claims map[string]interface{}, path string) (interface{}, er
 	for i, part := range parts {
 		m, ok := current.(map[string]interface{})
 		if !ok {
-			return nil, fmt.Errorf("claim path '%s' not found at level %d (%s)", path, i, part)
+			return nil, fmt.Errorf("%w: path '%s' has no object at level %d (%s)", ErrClaimNotFound, path, i, part)
 		}
 
 		current, ok = m[part]
 		if !ok {
-			return nil, fmt.Errorf("claim '%s' not found in path '%s'", part, path)
+			return nil, fmt.Errorf("%w: '%s' in path '%s'", ErrClaimNotFound, part, path)
 		}
 	}
 
@@ -162,3 +543,65 @@ func containsRole(roles []string, role string) bool {
 	}
 	return false
 }
+
+// containsRolePattern checks if any role in the roles slice matches the
+// required role pattern (see matchRole), ignoring case if fold is set.
+func containsRolePattern(roles []string, pattern string, fold bool) bool {
+	if fold {
+		pattern = strings.ToLower(pattern)
+	}
+	for _, r := range roles {
+		if fold {
+			r = strings.ToLower(r)
+		}
+		if matchRole(pattern, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchRole reports whether role matches a required role pattern. A "*"
+// in the pattern matches any sequence of characters, so "vpn-site-*"
+// matches "vpn-site-berlin"; "\*" matches a literal asterisk. A pattern
+// without wildcards must equal role.
+func matchRole(pattern, role string) bool {
+	if !strings.Contains(pattern, "*") {
+		return pattern == role
+	}
+
+	// Split at the unescaped wildcards
+	var parts []string
+	var part strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case pattern[i] == '\\' && i+1 < len(pattern) && pattern[i+1] == '*':
+			part.WriteByte('*')
+			i++
+		case pattern[i] == '*':
+			parts = append(parts, part.String())
+			part.Reset()
+		default:
+			part.WriteByte(pattern[i])
+		}
+	}
+	parts = append(parts, part.String())
+	if len(parts) == 1 {
+		return parts[0] == role
+	}
+
+	// The first part is a prefix, the last a suffix, and the parts in
+	// between must appear in order
+	if !strings.HasPrefix(role, parts[0]) {
+		return false
+	}
+	rest := role[len(parts[0]):]
+	for _, p := range parts[1 : len(parts)-1] {
+		i := strings.Index(rest, p)
+		if i < 0 {
+			return false
+		}
+		rest = rest[i+len(p):]
+	}
+	return strings.HasSuffix(rest, parts[len(parts)-1])
+}
@@ -1,8 +1,11 @@
 package oidc
 
 import (
+	"errors"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/al-bashkir/openvpn-keycloak-auth/internal/config"
 )
@@ -21,6 +24,7 @@ func TestValidateToken_UsernameOnly(t *testing.T) {
 		expectedUser    string
 		wantErr         bool
 		wantErrContains string
+		wantErrIs       error
 	}{
 		{
 			name: "valid username",
@@ -35,16 +39,16 @@ func TestValidateToken_UsernameOnly(t *testing.T) {
 			claims: map[string]interface{}{
 				"preferred_username": "wronguser",
 			},
-			expectedUser:    "testuser",
-			wantErr:         true,
-			wantErrContains: "username mismatch",
+			expectedUser: "testuser",
+			wantErr:      true,
+			wantErrIs:    ErrUsernameMismatch,
 		},
 		{
-			name:            "username claim missing",
-			claims:          map[string]interface{}{},
-			expectedUser:    "testuser",
-			wantErr:         true,
-			wantErrContains: "not found",
+			name:         "username claim missing",
+			claims:       map[string]interface{}{},
+			expectedUser: "testuser",
+			wantErr:      true,
+			wantErrIs:    ErrClaimNotFound,
 		},
 		{
 			name: "username claim wrong type",
@@ -66,6 +70,8 @@ func TestValidateToken_UsernameOnly(t *testing.T) {
 					t.Error("expected error, got nil")
 				} else if !strings.Contains(err.Error(), tt.wantErrContains) {
 					t.Errorf("error = %v, want error containing %q", err, tt.wantErrContains)
+				} else if tt.wantErrIs != nil && !errors.Is(err, tt.wantErrIs) {
+					t.Errorf("error = %v, want %v", err, tt.wantErrIs)
 				}
 				return
 			}
@@ -94,6 +100,7 @@ func TestValidateToken_WithRoles(t *testing.T) {
 		expectedUser    string
 		wantErr         bool
 		wantErrContains string
+		wantErrIs       error
 	}{
 		{
 			name: "valid user with required role",
@@ -125,18 +132,18 @@ func TestValidateToken_WithRoles(t *testing.T) {
 					"roles": []string{"other-role"},
 				},
 			},
-			expectedUser:    "testuser",
-			wantErr:         true,
-			wantErrContains: "does not have required roles",
+			expectedUser: "testuser",
+			wantErr:      true,
+			wantErrIs:    ErrMissingRole,
 		},
 		{
 			name: "realm_access missing",
 			claims: map[string]interface{}{
 				"preferred_username": "testuser",
 			},
-			expectedUser:    "testuser",
-			wantErr:         true,
-			wantErrContains: "not found",
+			expectedUser: "testuser",
+			wantErr:      true,
+			wantErrIs:    ErrClaimNotFound,
 		},
 		{
 			name: "roles missing in realm_access",
@@ -144,9 +151,9 @@ func TestValidateToken_WithRoles(t *testing.T) {
 				"preferred_username": "testuser",
 				"realm_access":       map[string]interface{}{},
 			},
-			expectedUser:    "testuser",
-			wantErr:         true,
-			wantErrContains: "not found",
+			expectedUser: "testuser",
+			wantErr:      true,
+			wantErrIs:    ErrClaimNotFound,
 		},
 	}
 
@@ -159,6 +166,8 @@ func TestValidateToken_WithRoles(t *testing.T) {
 					t.Error("expected error, got nil")
 				} else if !strings.Contains(err.Error(), tt.wantErrContains) {
 					t.Errorf("error = %v, want error containing %q", err, tt.wantErrContains)
+				} else if tt.wantErrIs != nil && !errors.Is(err, tt.wantErrIs) {
+					t.Errorf("error = %v, want %v", err, tt.wantErrIs)
 				}
 				return
 			}
@@ -224,8 +233,8 @@ func TestGetNestedClaim(t *testing.T) {
 			value, err := getNestedClaim(claims, tt.path)
 
 			if tt.wantErr {
-				if err == nil {
-					t.Error("expected error, got nil")
+				if !errors.Is(err, ErrClaimNotFound) {
+					t.Errorf("error = %v, want ErrClaimNotFound", err)
 				}
 				return
 			}
@@ -372,6 +381,69 @@ func TestContainsRole(t *testing.T) {
 	}
 }
 
+func TestMatchRole(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		role    string
+		want    bool
+	}{
+		{"exact", "vpn-user", "vpn-user", true},
+		{"exact mismatch", "vpn-user", "vpn-users", false},
+		{"prefix", "vpn-site-*", "vpn-site-berlin", true},
+		{"prefix matches empty rest", "vpn-site-*", "vpn-site-", true},
+		{"prefix mismatch", "vpn-site-*", "vpn-user", false},
+		{"suffix", "*-vpn", "berlin-vpn", true},
+		{"suffix mismatch", "*-vpn", "berlin-vpn-admin", false},
+		{"infix", "vpn-*-admin", "vpn-berlin-admin", true},
+		{"infix mismatch", "vpn-*-admin", "vpn-berlin-user", false},
+		{"prefix and suffix must not overlap", "ab*ba", "aba", false},
+		{"several wildcards", "vpn-*-*-admin", "vpn-de-berlin-admin", true},
+		{"several wildcards in order", "*a*b*", "xbxa", false},
+		{"wildcard only", "*", "anything", true},
+		{"literal asterisk", `vpn\*`, "vpn*", true},
+		{"literal asterisk is not a wildcard", `vpn\*`, "vpn-user", false},
+		{"literal asterisk then wildcard", `vpn\**`, "vpn*-admin", true},
+		{"wildcard also matches an asterisk", "vpn*", "vpn*", true},
+		{"no pattern for other roles", "vpn-site-*", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchRole(tt.pattern, tt.role); got != tt.want {
+				t.Errorf("matchRole(%q, %q) = %v, want %v", tt.pattern, tt.role, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateRoles_Patterns(t *testing.T) {
+	validator := NewValidator(&config.OIDCConfig{
+		RequiredRoles:         []string{"vpn-site-*"},
+		RoleClaim:             "realm_access.roles",
+		InstanceRequiredRoles: map[string][]string{"admin": {"*-admin"}},
+	}, &config.AuthConfig{UsernameClaim: "preferred_username"})
+
+	claimsWithRoles := func(roles ...interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"realm_access": map[string]interface{}{"roles": roles},
+		}
+	}
+
+	if err := validator.ValidateRoles(claimsWithRoles("vpn-site-munich")); err != nil {
+		t.Errorf("unexpected error for matching role: %v", err)
+	}
+	if err := validator.ValidateRoles(claimsWithRoles("vpn-user", "vpn-site")); !errors.Is(err, ErrMissingRole) {
+		t.Errorf("error = %v, want %v", err, ErrMissingRole)
+	}
+	if err := validator.ValidateInstanceRoles(claimsWithRoles("vpn-site-munich", "site-admin"), "admin"); err != nil {
+		t.Errorf("unexpected error for matching instance role: %v", err)
+	}
+	if err := validator.ValidateInstanceRoles(claimsWithRoles("vpn-site-munich"), "admin"); !errors.Is(err, ErrMissingRole) {
+		t.Errorf("error = %v, want %v", err, ErrMissingRole)
+	}
+}
+
 func TestValidateToken_MultipleRequiredRoles(t *testing.T) {
 	oidcCfg := &config.OIDCConfig{
 		RequiredRoles: []string{"vpn-user", "vpn-admin"},
@@ -418,3 +490,908 @@ func TestValidateToken_NoRequiredRoles(t *testing.T) {
 		t.Errorf("expected no error when no roles required, got: %v", err)
 	}
 }
+
+func TestValidateRoles_ClaimFallbacks(t *testing.T) {
+	clientRoles := map[string]interface{}{
+		"preferred_username": "testuser",
+		"resource_access": map[string]interface{}{
+			"openvpn": map[string]interface{}{
+				"roles": []interface{}{"vpn-user"},
+			},
+		},
+	}
+	bothPaths := map[string]interface{}{
+		"preferred_username": "testuser",
+		"realm_access": map[string]interface{}{
+			"roles": []interface{}{"offline_access"},
+		},
+		"resource_access": map[string]interface{}{
+			"openvpn": map[string]interface{}{
+				"roles": []interface{}{"vpn-user"},
+			},
+		},
+	}
+
+	tests := []struct {
+		name            string
+		fallbacks       []string
+		aggregate       bool
+		claims          map[string]interface{}
+		wantErr         bool
+		wantErrContains string
+		wantErrIs       error
+	}{
+		{
+			name:    "no fallback configured and primary absent",
+			claims:  clientRoles,
+			wantErr: true,
+			// original error from the single path is preserved
+			wantErrIs: ErrClaimNotFound,
+		},
+		{
+			name:      "only fallback path has roles",
+			fallbacks: []string{"resource_access.openvpn.roles"},
+			claims:    clientRoles,
+		},
+		{
+			name:      "second fallback used when first is absent",
+			fallbacks: []string{"groups", "resource_access.openvpn.roles"},
+			claims:    clientRoles,
+		},
+		{
+			name:      "first match stops at primary without required role",
+			fallbacks: []string{"resource_access.openvpn.roles"},
+			claims:    bothPaths,
+			wantErr:   true,
+			wantErrIs: ErrMissingRole,
+		},
+		{
+			name:      "aggregate unions primary and fallback",
+			fallbacks: []string{"resource_access.openvpn.roles"},
+			aggregate: true,
+			claims:    bothPaths,
+		},
+		{
+			name:            "no path resolves",
+			fallbacks:       []string{"resource_access.other.roles"},
+			claims:          map[string]interface{}{"preferred_username": "testuser"},
+			wantErr:         true,
+			wantErrContains: "no role claim found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validator := NewValidator(&config.OIDCConfig{
+				RequiredRoles:      []string{"vpn-user"},
+				RoleClaim:          "realm_access.roles",
+				RoleClaimFallbacks: tt.fallbacks,
+				RoleClaimAggregate: tt.aggregate,
+			}, &config.AuthConfig{UsernameClaim: "preferred_username"})
+
+			err := validator.ValidateRoles(tt.claims)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				if !strings.Contains(err.Error(), tt.wantErrContains) {
+					t.Errorf("error = %v, want error containing %q", err, tt.wantErrContains)
+				}
+				if tt.wantErrIs != nil && !errors.Is(err, tt.wantErrIs) {
+					t.Errorf("error = %v, want %v", err, tt.wantErrIs)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateRoles_Aggregate(t *testing.T) {
+	claims := func(realmRoles, clientRoles []interface{}) map[string]interface{} {
+		c := map[string]interface{}{"preferred_username": "testuser"}
+		if realmRoles != nil {
+			c["realm_access"] = map[string]interface{}{"roles": realmRoles}
+		}
+		if clientRoles != nil {
+			c["resource_access"] = map[string]interface{}{
+				"openvpn": map[string]interface{}{"roles": clientRoles},
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name            string
+		claims          map[string]interface{}
+		deniedRoles     []string
+		wantErrContains string
+		wantErrIs       error
+	}{
+		{name: "required role in first path",
+			claims: claims([]interface{}{"vpn-user"}, []interface{}{"viewer"})},
+		{name: "required role in second path",
+			claims: claims([]interface{}{"offline_access"}, []interface{}{"vpn-user"})},
+		{name: "only second path present",
+			claims: claims(nil, []interface{}{"vpn-user"})},
+		{name: "required role in no path",
+			claims:          claims([]interface{}{"offline_access"}, []interface{}{"viewer"}),
+			wantErrContains: "user roles: [offline_access viewer]", wantErrIs: ErrMissingRole},
+		{name: "no path present",
+			claims:          claims(nil, nil),
+			wantErrContains: "no role claim found", wantErrIs: ErrClaimNotFound},
+		{name: "denied role in second path",
+			claims:      claims([]interface{}{"vpn-user"}, []interface{}{"suspended"}),
+			deniedRoles: []string{"suspended"}, wantErrIs: ErrDeniedRole},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validator := NewValidator(&config.OIDCConfig{
+				RequiredRoles:      []string{"vpn-user"},
+				DeniedRoles:        tt.deniedRoles,
+				RoleClaim:          "realm_access.roles",
+				RoleClaimFallbacks: []string{"resource_access.openvpn.roles"},
+				RoleClaimAggregate: true,
+			}, &config.AuthConfig{UsernameClaim: "preferred_username"})
+
+			err := validator.ValidateAuthorization(tt.claims)
+			if tt.wantErrContains == "" && tt.wantErrIs == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErrContains) {
+				t.Fatalf("error = %v, want error containing %q", err, tt.wantErrContains)
+			}
+			if tt.wantErrIs != nil && !errors.Is(err, tt.wantErrIs) {
+				t.Errorf("error = %v, want %v", err, tt.wantErrIs)
+			}
+		})
+	}
+}
+
+func TestResolveRolePaths(t *testing.T) {
+	claims := map[string]interface{}{
+		"realm_access": map[string]interface{}{
+			"roles": []interface{}{"offline_access"},
+		},
+		"resource_access": map[string]interface{}{
+			"openvpn": map[string]interface{}{
+				"roles": []interface{}{"vpn-user"},
+			},
+		},
+		"groups": "not-a-list",
+	}
+
+	tests := []struct {
+		name      string
+		aggregate bool
+		wantUsed  []bool
+	}{
+		{name: "first resolving path used", wantUsed: []bool{true, false, false, false}},
+		{name: "aggregate uses every resolving path", aggregate: true, wantUsed: []bool{true, false, false, true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validator := NewValidator(&config.OIDCConfig{
+				RoleClaim:          "realm_access.roles",
+				RoleClaimFallbacks: []string{"resource_access.other.roles", "groups", "resource_access.openvpn.roles"},
+				RoleClaimAggregate: tt.aggregate,
+			}, &config.AuthConfig{UsernameClaim: "preferred_username"})
+
+			paths := validator.ResolveRolePaths(claims)
+			if len(paths) != len(tt.wantUsed) {
+				t.Fatalf("got %d paths, want %d", len(paths), len(tt.wantUsed))
+			}
+			for i, p := range paths {
+				if p.Used != tt.wantUsed[i] {
+					t.Errorf("%s: Used = %v, want %v", p.Path, p.Used, tt.wantUsed[i])
+				}
+			}
+			if !reflect.DeepEqual(paths[3].Roles, []string{"vpn-user"}) {
+				t.Errorf("%s: Roles = %v, want [vpn-user]", paths[3].Path, paths[3].Roles)
+			}
+			if paths[1].Err == nil || !strings.Contains(paths[1].Err.Error(), "not found") {
+				t.Errorf("%s: Err = %v, want not found", paths[1].Path, paths[1].Err)
+			}
+			if paths[2].Err == nil || !strings.Contains(paths[2].Err.Error(), "not a string array") {
+				t.Errorf("%s: Err = %v, want not a string array", paths[2].Path, paths[2].Err)
+			}
+		})
+	}
+}
+
+func TestValidateAuthorization_Groups(t *testing.T) {
+	tests := []struct {
+		name            string
+		requiredRoles   []string
+		requiredGroups  []string
+		matchSubgroups  bool
+		authzMode       string
+		claims          map[string]interface{}
+		wantErr         bool
+		wantErrContains string
+		wantErrIs       error
+	}{
+		{
+			name:           "exact full group path",
+			requiredGroups: []string{"/vpn/users"},
+			claims:         map[string]interface{}{"groups": []interface{}{"/staff", "/vpn/users"}},
+		},
+		{
+			name:           "subgroup does not satisfy parent by default",
+			requiredGroups: []string{"/vpn"},
+			claims:         map[string]interface{}{"groups": []interface{}{"/vpn/admins"}},
+			wantErr:        true,
+			wantErrIs:      ErrMissingGroup,
+		},
+		{
+			name:           "nested subgroup satisfies parent with match_subgroups",
+			requiredGroups: []string{"/vpn"},
+			matchSubgroups: true,
+			claims:         map[string]interface{}{"groups": []interface{}{"/vpn/admins/oncall"}},
+		},
+		{
+			name:           "required group without leading slash",
+			requiredGroups: []string{"vpn/admins"},
+			claims:         map[string]interface{}{"groups": []string{"/vpn/admins"}},
+		},
+		{
+			name:           "group name prefix is not a parent",
+			requiredGroups: []string{"/vpn"},
+			matchSubgroups: true,
+			claims:         map[string]interface{}{"groups": []string{"/vpn-legacy"}},
+			wantErr:        true,
+			// "/vpn-legacy" is a sibling, not a subgroup
+			wantErrIs: ErrMissingGroup,
+		},
+		{
+			name:           "parent does not satisfy subgroup",
+			requiredGroups: []string{"/vpn/admins"},
+			matchSubgroups: true,
+			claims:         map[string]interface{}{"groups": []interface{}{"/vpn"}},
+			wantErr:        true,
+			// membership of "/vpn" alone is not enough
+			wantErrIs: ErrMissingGroup,
+		},
+		{
+			name:            "missing groups claim",
+			requiredGroups:  []string{"/vpn"},
+			claims:          map[string]interface{}{},
+			wantErr:         true,
+			wantErrContains: "failed to extract groups",
+		},
+		{
+			name:           "and mode requires roles and groups",
+			requiredRoles:  []string{"vpn-user"},
+			requiredGroups: []string{"/vpn"},
+			authzMode:      config.AuthzModeAnd,
+			claims: map[string]interface{}{
+				"realm_access": map[string]interface{}{"roles": []interface{}{"vpn-user"}},
+				"groups":       []interface{}{"/staff"},
+			},
+			wantErr:   true,
+			wantErrIs: ErrMissingGroup,
+		},
+		{
+			name:           "empty mode defaults to and",
+			requiredRoles:  []string{"vpn-user"},
+			requiredGroups: []string{"/vpn"},
+			claims: map[string]interface{}{
+				"realm_access": map[string]interface{}{"roles": []interface{}{"offline_access"}},
+				"groups":       []interface{}{"/vpn"},
+			},
+			wantErr:   true,
+			wantErrIs: ErrMissingRole,
+		},
+		{
+			name:           "or mode passes with groups only",
+			requiredRoles:  []string{"vpn-user"},
+			requiredGroups: []string{"/vpn"},
+			authzMode:      config.AuthzModeOr,
+			claims: map[string]interface{}{
+				"realm_access": map[string]interface{}{"roles": []interface{}{"offline_access"}},
+				"groups":       []interface{}{"/vpn"},
+			},
+		},
+		{
+			name:           "or mode fails when neither passes",
+			requiredRoles:  []string{"vpn-user"},
+			requiredGroups: []string{"/vpn"},
+			authzMode:      config.AuthzModeOr,
+			claims: map[string]interface{}{
+				"realm_access": map[string]interface{}{"roles": []interface{}{"offline_access"}},
+				"groups":       []interface{}{"/staff"},
+			},
+			wantErr:   true,
+			wantErrIs: ErrMissingGroup,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validator := NewValidator(&config.OIDCConfig{
+				RequiredRoles:  tt.requiredRoles,
+				RoleClaim:      "realm_access.roles",
+				RequiredGroups: tt.requiredGroups,
+				GroupClaim:     "groups",
+				MatchSubgroups: tt.matchSubgroups,
+			}, &config.AuthConfig{
+				UsernameClaim: "preferred_username",
+				AuthzMode:     tt.authzMode,
+			})
+
+			err := validator.ValidateAuthorization(tt.claims)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				if !strings.Contains(err.Error(), tt.wantErrContains) {
+					t.Errorf("error = %v, want error containing %q", err, tt.wantErrContains)
+				}
+				if tt.wantErrIs != nil && !errors.Is(err, tt.wantErrIs) {
+					t.Errorf("error = %v, want %v", err, tt.wantErrIs)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateAuthorization_DeniedRoles(t *testing.T) {
+	tests := []struct {
+		name            string
+		roleClaim       string
+		fallbacks       []string
+		requiredRoles   []string
+		claims          map[string]interface{}
+		wantErr         bool
+		wantErrContains string
+		wantErrIs       error
+	}{
+		{
+			name:          "denied realm role rejects despite required role",
+			roleClaim:     "realm_access.roles",
+			requiredRoles: []string{"vpn-user"},
+			claims: map[string]interface{}{
+				"realm_access": map[string]interface{}{"roles": []interface{}{"vpn-user", "suspended"}},
+			},
+			wantErr:         true,
+			wantErrContains: "user has a denied role: suspended",
+			wantErrIs:       ErrDeniedRole,
+		},
+		{
+			name:      "denied client role",
+			roleClaim: "resource_access.openvpn.roles",
+			claims: map[string]interface{}{
+				"resource_access": map[string]interface{}{
+					"openvpn": map[string]interface{}{"roles": []string{"vpn-blocked"}},
+				},
+			},
+			wantErr:         true,
+			wantErrContains: "user has a denied role: vpn-blocked",
+			wantErrIs:       ErrDeniedRole,
+		},
+		{
+			name:      "denied role in fallback path",
+			roleClaim: "realm_access.roles",
+			fallbacks: []string{"resource_access.openvpn.roles"},
+			claims: map[string]interface{}{
+				"realm_access": map[string]interface{}{"roles": []interface{}{"vpn-user"}},
+				"resource_access": map[string]interface{}{
+					"openvpn": map[string]interface{}{"roles": []interface{}{"vpn-blocked"}},
+				},
+			},
+			wantErr:   true,
+			wantErrIs: ErrDeniedRole,
+		},
+		{
+			name:      "denied role pattern",
+			roleClaim: "realm_access.roles",
+			claims: map[string]interface{}{
+				"realm_access": map[string]interface{}{"roles": []interface{}{"vpn-user", "locked-by-hr"}},
+			},
+			wantErr:         true,
+			wantErrContains: "user has a denied role: locked-*",
+			wantErrIs:       ErrDeniedRole,
+		},
+		{
+			name:          "no denied role passes",
+			roleClaim:     "realm_access.roles",
+			requiredRoles: []string{"vpn-user"},
+			claims: map[string]interface{}{
+				"realm_access": map[string]interface{}{"roles": []interface{}{"vpn-user"}},
+			},
+		},
+		{
+			name:      "no role claim passes deny check",
+			roleClaim: "realm_access.roles",
+			claims:    map[string]interface{}{},
+		},
+		{
+			name:          "denied role checked before required role",
+			roleClaim:     "realm_access.roles",
+			requiredRoles: []string{"vpn-admin"},
+			claims: map[string]interface{}{
+				"realm_access": map[string]interface{}{"roles": []interface{}{"suspended"}},
+			},
+			wantErr:   true,
+			wantErrIs: ErrDeniedRole,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validator := NewValidator(&config.OIDCConfig{
+				RequiredRoles:      tt.requiredRoles,
+				DeniedRoles:        []string{"suspended", "vpn-blocked", "locked-*"},
+				RoleClaim:          tt.roleClaim,
+				RoleClaimFallbacks: tt.fallbacks,
+			}, &config.AuthConfig{UsernameClaim: "preferred_username"})
+
+			err := validator.ValidateAuthorization(tt.claims)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				if !strings.Contains(err.Error(), tt.wantErrContains) {
+					t.Errorf("error = %v, want error containing %q", err, tt.wantErrContains)
+				}
+				if tt.wantErrIs != nil && !errors.Is(err, tt.wantErrIs) {
+					t.Errorf("error = %v, want %v", err, tt.wantErrIs)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateToken_UsernameTransform(t *testing.T) {
+	tests := []struct {
+		name            string
+		transform       config.UsernameTransformConfig
+		claimUsername   string
+		expected        string
+		wantErr         bool
+		wantErrContains string
+		wantErrIs       error
+	}{
+		{
+			name:          "strip domain from claim",
+			transform:     config.UsernameTransformConfig{Match: `^(.+)@corp$`, Replace: "$1"},
+			claimUsername: "alice@corp",
+			expected:      "alice",
+		},
+		{
+			name:          "claim without domain is unchanged",
+			transform:     config.UsernameTransformConfig{Match: `^(.+)@corp$`, Replace: "$1"},
+			claimUsername: "alice",
+			expected:      "alice",
+		},
+		{
+			name: "email in OpenVPN mapped to claim format",
+			transform: config.UsernameTransformConfig{
+				Match:   `^([^@]+)@corp\.example\.com$`,
+				Replace: "${1}@corp",
+				ApplyTo: config.UsernameTransformExpected,
+			},
+			claimUsername: "alice@corp",
+			expected:      "alice@corp.example.com",
+		},
+		{
+			name: "domain stripped on both sides",
+			transform: config.UsernameTransformConfig{
+				Match:   `@.*$`,
+				Replace: "",
+				ApplyTo: config.UsernameTransformBoth,
+			},
+			claimUsername: "alice@corp",
+			expected:      "alice@corp.example.com",
+		},
+		{
+			name:          "transform does not hide a different user",
+			transform:     config.UsernameTransformConfig{Match: `^(.+)@corp$`, Replace: "$1"},
+			claimUsername: "mallory@corp",
+			expected:      "alice",
+			wantErr:       true,
+			wantErrIs:     ErrUsernameMismatch,
+		},
+		{
+			name:          "no transform keeps exact match",
+			claimUsername: "alice@corp",
+			expected:      "alice",
+			wantErr:       true,
+			wantErrIs:     ErrUsernameMismatch,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validator := NewValidator(&config.OIDCConfig{}, &config.AuthConfig{
+				UsernameClaim:     "preferred_username",
+				UsernameTransform: tt.transform,
+			})
+
+			err := validator.ValidateToken(map[string]interface{}{
+				"preferred_username": tt.claimUsername,
+			}, tt.expected)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected error, got nil")
+				}
+				if !strings.Contains(err.Error(), tt.wantErrContains) {
+					t.Errorf("error = %v, want error containing %q", err, tt.wantErrContains)
+				}
+				if tt.wantErrIs != nil && !errors.Is(err, tt.wantErrIs) {
+					t.Errorf("error = %v, want %v", err, tt.wantErrIs)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestValidateToken_CaseInsensitive(t *testing.T) {
+	oidcCfg := &config.OIDCConfig{
+		RequiredRoles: []string{"VPN-User"},
+		DeniedRoles:   []string{"Suspended"},
+		RoleClaim:     "realm_access.roles",
+	}
+	claims := func(username string, roles ...interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"preferred_username": username,
+			"realm_access":       map[string]interface{}{"roles": roles},
+		}
+	}
+
+	tests := []struct {
+		name            string
+		caseInsensitive bool
+		claims          map[string]interface{}
+		expected        string
+		wantErrIs       error
+	}{
+		{name: "username differs in case", caseInsensitive: true,
+			claims: claims("bob", "vpn-user"), expected: "Bob"},
+		{name: "role differs in case", caseInsensitive: true,
+			claims: claims("bob", "vpn-user"), expected: "bob"},
+		{name: "denied role differs in case", caseInsensitive: true,
+			claims: claims("bob", "vpn-user", "suspended"), expected: "bob", wantErrIs: ErrDeniedRole},
+		{name: "different username", caseInsensitive: true,
+			claims: claims("alice", "vpn-user"), expected: "bob", wantErrIs: ErrUsernameMismatch},
+		{name: "username case-sensitive by default",
+			claims: claims("bob", "VPN-User"), expected: "Bob", wantErrIs: ErrUsernameMismatch},
+		{name: "role case-sensitive by default",
+			claims: claims("bob", "vpn-user"), expected: "bob", wantErrIs: ErrMissingRole},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validator := NewValidator(oidcCfg, &config.AuthConfig{
+				UsernameClaim:   "preferred_username",
+				CaseInsensitive: tt.caseInsensitive,
+			})
+
+			err := validator.ValidateToken(tt.claims, tt.expected)
+			if tt.wantErrIs == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErrIs) {
+				t.Errorf("error = %v, want %v", err, tt.wantErrIs)
+			}
+		})
+	}
+}
+
+func TestValidateCommonName(t *testing.T) {
+	claims := map[string]interface{}{
+		"preferred_username": "alice",
+		"email":              "alice@example.com",
+	}
+
+	tests := []struct {
+		name            string
+		cnClaim         string
+		commonName      string
+		wantErrContains string
+		wantErrIs       error
+	}{
+		{name: "matches username claim by default", commonName: "alice"},
+		{name: "matches cn_claim", cnClaim: "email", commonName: "alice@example.com"},
+		{name: "mismatch", commonName: "bob",
+			wantErrContains: "certificate has 'bob', token has 'alice'", wantErrIs: ErrCNMismatch},
+		{name: "cn_claim replaces username claim", cnClaim: "email", commonName: "alice",
+			wantErrContains: "token has 'alice@example.com'", wantErrIs: ErrCNMismatch},
+		{name: "no common name", commonName: "",
+			wantErrContains: "no certificate common name", wantErrIs: ErrCNMismatch},
+		{name: "claim missing", cnClaim: "login", commonName: "alice",
+			wantErrContains: "common name claim 'login' not found", wantErrIs: ErrClaimNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validator := NewValidator(&config.OIDCConfig{}, &config.AuthConfig{
+				UsernameClaim:  "preferred_username",
+				RequireCNMatch: true,
+				CNClaim:        tt.cnClaim,
+			})
+
+			err := validator.ValidateCommonName(claims, tt.commonName)
+			if tt.wantErrContains == "" && tt.wantErrIs == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErrContains) {
+				t.Fatalf("error = %v, want error containing %q", err, tt.wantErrContains)
+			}
+			if tt.wantErrIs != nil && !errors.Is(err, tt.wantErrIs) {
+				t.Errorf("error = %v, want %v", err, tt.wantErrIs)
+			}
+		})
+	}
+}
+
+func TestValidateInstanceRoles(t *testing.T) {
+	validator := NewValidator(&config.OIDCConfig{
+		RequiredRoles: []string{"vpn-user"},
+		RoleClaim:     "realm_access.roles",
+		InstanceRequiredRoles: map[string][]string{
+			"server-a": {"vpn-a"},
+			"server-b": {"vpn-b", "vpn-admin"},
+		},
+	}, &config.AuthConfig{UsernameClaim: "preferred_username"})
+
+	claimsWithRoles := func(roles ...interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"realm_access": map[string]interface{}{"roles": roles},
+		}
+	}
+
+	tests := []struct {
+		name            string
+		instance        string
+		claims          map[string]interface{}
+		wantErrContains string
+		wantErrIs       error
+	}{
+		{name: "instance role present", instance: "server-a", claims: claimsWithRoles("vpn-user", "vpn-a")},
+		{name: "instance role missing", instance: "server-a", claims: claimsWithRoles("vpn-user", "vpn-b"),
+			wantErrContains: "required roles for server server-a", wantErrIs: ErrMissingRole},
+		{name: "any of several instance roles", instance: "server-b", claims: claimsWithRoles("vpn-admin")},
+		{name: "unmapped instance", instance: "server-c", claims: claimsWithRoles("vpn-user")},
+		{name: "no instance", instance: "", claims: claimsWithRoles("vpn-user")},
+		{name: "no role claim", instance: "server-b", claims: map[string]interface{}{},
+			wantErrContains: "failed to extract roles", wantErrIs: ErrClaimNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validator.ValidateInstanceRoles(tt.claims, tt.instance)
+			if tt.wantErrContains == "" && tt.wantErrIs == nil {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErrContains) {
+				t.Fatalf("error = %v, want error containing %q", err, tt.wantErrContains)
+			}
+			if tt.wantErrIs != nil && !errors.Is(err, tt.wantErrIs) {
+				t.Errorf("error = %v, want %v", err, tt.wantErrIs)
+			}
+		})
+	}
+}
+
+func TestValidateAuthTime(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	authTime := func(age time.Duration) map[string]interface{} {
+		// Claims decoded from JSON carry numbers as float64
+		return map[string]interface{}{"auth_time": float64(now.Add(-age).Unix())}
+	}
+
+	tests := []struct {
+		name            string
+		maxAge          int
+		mode            string
+		claims          map[string]interface{}
+		wantErrContains string
+		wantErrIs       error
+		wantTooOld      bool
+	}{
+		{name: "max_age disabled", claims: authTime(24 * time.Hour)},
+		{name: "fresh login", maxAge: 900, mode: config.AuthTimeModeStrict, claims: authTime(5 * time.Minute)},
+		{name: "exactly max_age", maxAge: 900, mode: config.AuthTimeModeStrict, claims: authTime(15 * time.Minute)},
+		{name: "login too old", maxAge: 900, mode: config.AuthTimeModeStrict, claims: authTime(16 * time.Minute),
+			wantErrContains: "authenticated 16m0s ago", wantTooOld: true},
+		{name: "lenient still rejects old login", maxAge: 900, mode: config.AuthTimeModeLenient, claims: authTime(time.Hour),
+			wantTooOld: true},
+		{name: "missing auth_time strict", maxAge: 900, mode: config.AuthTimeModeStrict, claims: map[string]interface{}{},
+			wantErrIs: ErrClaimNotFound},
+		{name: "missing auth_time default mode", maxAge: 900, claims: map[string]interface{}{},
+			wantErrIs: ErrClaimNotFound},
+		{name: "missing auth_time lenient", maxAge: 900, mode: config.AuthTimeModeLenient, claims: map[string]interface{}{}},
+		{name: "auth_time not a number", maxAge: 900, mode: config.AuthTimeModeLenient,
+			claims: map[string]interface{}{"auth_time": "yesterday"}, wantErrContains: "auth_time claim is not a number"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validator := NewValidator(&config.OIDCConfig{MaxAge: tt.maxAge, AuthTimeMode: tt.mode},
+				&config.AuthConfig{UsernameClaim: "preferred_username"})
+			validator.now = func() time.Time { return now }
+
+			err := validator.ValidateAuthTime(tt.claims)
+			if tt.wantErrContains == "" && tt.wantErrIs == nil && !tt.wantTooOld {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("expected error, got nil")
+			}
+			if tt.wantTooOld != errors.Is(err, ErrAuthTooOld) {
+				t.Errorf("errors.Is(err, ErrAuthTooOld) = %v, want %v (err: %v)", !tt.wantTooOld, tt.wantTooOld, err)
+			}
+			if !strings.Contains(err.Error(), tt.wantErrContains) {
+				t.Errorf("error = %v, want error containing %q", err, tt.wantErrContains)
+			}
+			if tt.wantErrIs != nil && !errors.Is(err, tt.wantErrIs) {
+				t.Errorf("error = %v, want %v", err, tt.wantErrIs)
+			}
+		})
+	}
+}
+
+func TestValidateACR(t *testing.T) {
+	tests := []struct {
+		name     string
+		required []string
+		claims   map[string]interface{}
+		wantErr  bool
+	}{
+		{name: "not required", claims: map[string]interface{}{}},
+		{name: "matching acr", required: []string{"gold"}, claims: map[string]interface{}{"acr": "gold"}},
+		{name: "one of several", required: []string{"silver", "gold"}, claims: map[string]interface{}{"acr": "gold"}},
+		{name: "non-matching acr", required: []string{"gold"}, claims: map[string]interface{}{"acr": "1"}, wantErr: true},
+		{name: "missing acr", required: []string{"gold"}, claims: map[string]interface{}{}, wantErr: true},
+		{name: "acr array form", required: []string{"gold"},
+			claims: map[string]interface{}{"acr": []interface{}{"silver", "gold"}}},
+		{name: "amr lists required method", required: []string{"otp"},
+			claims: map[string]interface{}{"acr": "1", "amr": []interface{}{"pwd", "otp"}}},
+		{name: "amr without required method", required: []string{"otp"},
+			claims: map[string]interface{}{"amr": []interface{}{"pwd"}}, wantErr: true},
+		{name: "acr is case-sensitive", required: []string{"gold"}, claims: map[string]interface{}{"acr": "GOLD"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validator := NewValidator(&config.OIDCConfig{RequiredACR: tt.required},
+				&config.AuthConfig{UsernameClaim: "preferred_username"})
+
+			err := validator.ValidateACR(tt.claims)
+			if !tt.wantErr {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrACRNotMet) {
+				t.Fatalf("error = %v, want ErrACRNotMet", err)
+			}
+		})
+	}
+}
+
+func TestCheckRolesAvailable(t *testing.T) {
+	rolesCfg := &config.OIDCConfig{
+		RequiredRoles:      []string{"vpn-user"},
+		RoleClaim:          "realm_access.roles",
+		RoleClaimFallbacks: []string{"resource_access.openvpn.roles"},
+	}
+	tests := []struct {
+		name        string
+		cfg         *config.OIDCConfig
+		claims      map[string]interface{}
+		opaque      bool
+		wantErr     bool
+		wantPaths   []string
+		wantRoleErr error // error from ValidateAuthorization when available
+	}{
+		{
+			name:      "opaque token without roles",
+			cfg:       rolesCfg,
+			claims:    map[string]interface{}{"sub": "user-1"},
+			opaque:    true,
+			wantErr:   true,
+			wantPaths: []string{"realm_access.roles", "resource_access.openvpn.roles"},
+		},
+		{
+			name:   "opaque token with roles in ID token",
+			cfg:    rolesCfg,
+			claims: map[string]interface{}{"realm_access": map[string]interface{}{"roles": []interface{}{"other"}}},
+			opaque: true,
+			// Roles are available, so the regular check reports the missing role
+			wantRoleErr: ErrMissingRole,
+		},
+		{
+			name:        "JWT access token without roles",
+			cfg:         rolesCfg,
+			claims:      map[string]interface{}{"sub": "user-1"},
+			wantRoleErr: ErrClaimNotFound,
+		},
+		{
+			name:      "groups required",
+			cfg:       &config.OIDCConfig{RequiredGroups: []string{"/vpn"}, GroupClaim: "groups"},
+			claims:    map[string]interface{}{},
+			opaque:    true,
+			wantErr:   true,
+			wantPaths: []string{"groups"},
+		},
+		{
+			name:      "instance roles required",
+			cfg:       &config.OIDCConfig{RoleClaim: "realm_access.roles", InstanceRequiredRoles: map[string][]string{"server-a": {"vpn-a"}}},
+			claims:    map[string]interface{}{},
+			opaque:    true,
+			wantErr:   true,
+			wantPaths: []string{"realm_access.roles"},
+		},
+		{
+			name:   "nothing required",
+			cfg:    &config.OIDCConfig{RoleClaim: "realm_access.roles"},
+			claims: map[string]interface{}{},
+			opaque: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			validator := NewValidator(tt.cfg, &config.AuthConfig{UsernameClaim: "preferred_username"})
+
+			err := validator.CheckRolesAvailable(tt.claims, tt.opaque)
+			if tt.wantErr {
+				var rolesErr *RolesUnavailableError
+				if !errors.As(err, &rolesErr) {
+					t.Fatalf("error = %v, want *RolesUnavailableError", err)
+				}
+				if !reflect.DeepEqual(rolesErr.Paths, tt.wantPaths) {
+					t.Errorf("Paths = %v, want %v", rolesErr.Paths, tt.wantPaths)
+				}
+				if !strings.Contains(err.Error(), "oidc.fetch_userinfo") {
+					t.Errorf("error %q does not mention oidc.fetch_userinfo", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if tt.wantRoleErr != nil {
+				err := validator.ValidateAuthorization(tt.claims)
+				if !errors.Is(err, tt.wantRoleErr) {
+					t.Errorf("ValidateAuthorization error = %v, want %v", err, tt.wantRoleErr)
+				}
+			}
+		})
+	}
+}
@@ -2,32 +2,194 @@
 package openvpn
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
 )
 
+// ErrResultExists is returned when auth_control_file already holds a terminal
+// result ("0" or "1") and preserving existing results is enabled.
+var ErrResultExists = errors.New("auth_control_file already contains a result")
+
+// ErrLineTooLong is returned when a line of the auth_pending_file would
+// exceed OptionLineSize.
+var ErrLineTooLong = errors.New("line exceeds OpenVPN's OPTION_LINE_SIZE limit")
+
+// ErrNotWritable is returned when a file cannot be written because its
+// directory is missing or not writable, e.g. a misconfigured OpenVPN tmp-dir.
+var ErrNotWritable = errors.New("directory is missing or not writable")
+
+// OptionLineSize is OpenVPN's OPTION_LINE_SIZE: the maximum length of a
+// single line, including its trailing newline, that OpenVPN reads from the
+// auth_pending_file. Longer lines are truncated.
+const OptionLineSize = 256
+
+// Writer writes the control files OpenVPN passes to the auth script for
+// deferred authentication. The daemon, the HTTP server and the session
+// manager are given one, so tests can observe results without files.
+type Writer interface {
+	WriteAuthPending(filePath string, timeoutSeconds int, method string, authURL string) error
+	WriteAuthSuccess(filePath string) error
+	WriteAuthFailure(authControlFile, authFailedReasonFile, reason string) error
+	CheckWritable(filePath string) error
+}
+
+// FileWriter is the Writer that writes the files. The zero value always
+// overwrites existing content.
+type FileWriter struct {
+	// PreserveExistingResult makes WriteAuthSuccess and WriteAuthFailure
+	// read auth_control_file first and return ErrResultExists instead of
+	// overwriting a "0" or "1" written by another process (e.g. an earlier
+	// script in a chain).
+	PreserveExistingResult bool
+
+	// DryRun makes the writers validate their arguments and log the
+	// content they would write, but leave the filesystem untouched, so
+	// OpenVPN never receives a result.
+	DryRun bool
+}
+
+// rename replaces a file; a variable so tests can observe the files the
+// writers are about to publish.
+var rename = os.Rename
+
+// writeFileAtomic writes data to a temporary file with mode 0600 in the
+// directory of path and renames it to path, so OpenVPN never reads a
+// partially written file, even if the daemon is killed mid-write.
+func writeFileAtomic(path string, data []byte) error {
+	// os.CreateTemp creates the file with mode 0600
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return notWritable(path, err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := rename(tmp.Name(), path); err != nil {
+		return notWritable(path, err)
+	}
+	return nil
+}
+
+// notWritable wraps err in ErrNotWritable if it means the directory of path
+// is missing or does not allow writing.
+func notWritable(path string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) || errors.Is(err, fs.ErrPermission) || errors.Is(err, syscall.EROFS) {
+		return fmt.Errorf("%w: %s: %w", ErrNotWritable, filepath.Dir(path), err)
+	}
+	return err
+}
+
+// CheckWritable returns an error wrapping ErrNotWritable if the writers
+// cannot replace filePath because its directory is missing or not writable.
+// It creates and removes a temporary file next to filePath, and does nothing
+// in dry-run mode.
+func (w FileWriter) CheckWritable(filePath string) error {
+	if filePath == "" {
+		return fmt.Errorf("file path is empty")
+	}
+
+	if w.DryRun {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".tmp-*")
+	if err != nil {
+		return notWritable(filePath, err)
+	}
+	_ = tmp.Close()
+	return os.Remove(tmp.Name())
+}
+
+// checkExistingResult returns ErrResultExists if the guard is enabled and the
+// control file already contains a terminal result. A missing or unreadable
+// file is treated as having no result.
+func (w FileWriter) checkExistingResult(filePath string) error {
+	if !w.PreserveExistingResult {
+		return nil
+	}
+
+	data, err := os.ReadFile(filePath) // #nosec G304 -- path provided by OpenVPN
+	if err != nil {
+		return nil
+	}
+
+	existing := strings.TrimSpace(string(data))
+	if existing == "0" || existing == "1" {
+		slog.Warn("auth_control_file already contains a result, not overwriting",
+			"path", filePath,
+			"existing", existing,
+		)
+		return fmt.Errorf("%w: %q", ErrResultExists, existing)
+	}
+
+	return nil
+}
+
 const (
 	// authPendingFormat is the exact 3-line format required by OpenVPN.
 	// Line 1: timeout in seconds
 	// Line 2: pending auth method (must match one of the client's IV_SSO values)
-	// Line 3: "WEB_AUTH::" prefix followed by the authorization URL
-	authPendingFormat = "%d\n%s\nWEB_AUTH::%s\n"
+	// Line 3: method-specific prefix followed by the authorization URL
+	authPendingFormat = "%d\n%s\n%s%s\n"
+
+	// WebAuthPrefix is the URL line prefix for the "webauth" method.
+	WebAuthPrefix = "WEB_AUTH::"
+	// OpenURLPrefix is the URL line prefix for the "openurl" method.
+	OpenURLPrefix = "OPEN_URL::"
+	// CRTextPrefix is the challenge line prefix for the "crtext" method.
+	// The "E" flag asks the client to echo the user's input.
+	CRTextPrefix = "CR_TEXT:E:"
 )
 
+// AuthPendingPrefix returns the prefix OpenVPN expects on the URL line of the
+// auth_pending_file for the given pending auth method.
+func AuthPendingPrefix(method string) string {
+	switch method {
+	case "openurl":
+		return OpenURLPrefix
+	case "crtext":
+		return CRTextPrefix
+	default:
+		return WebAuthPrefix
+	}
+}
+
 // WriteAuthPending writes the auth_pending_file to trigger browser opening.
 // The file must be exactly 3 lines in the format:
 //
 //	<timeout_seconds>
 //	<method>           (e.g. "webauth" or "openurl")
-//	WEB_AUTH::<auth_url>
+//	WEB_AUTH::<auth_url>  (or OPEN_URL::<auth_url> for the "openurl" method)
+//
+// For the "crtext" method, authURL is the challenge text shown to the user
+// and the third line is CR_TEXT:E:<challenge>.
 //
 // The method must match one of the client's IV_SSO capabilities.
 // Common values: "webauth" (Tunnelblick, OpenVPN Connect), "openurl" (newer clients).
 //
+// Each line, including its newline, must fit in OptionLineSize; otherwise
+// an error wrapping ErrLineTooLong names the offending line and nothing is
+// written.
+//
 // This triggers OpenVPN 2.6+ to send an INFO_PRE message to the client,
 // which opens a browser to the authorization URL.
-func WriteAuthPending(filePath string, timeoutSeconds int, method string, authURL string) error {
+func (w FileWriter) WriteAuthPending(filePath string, timeoutSeconds int, method string, authURL string) error {
 	if filePath == "" {
 		return fmt.Errorf("auth_pending_file path is empty")
 	}
@@ -44,10 +206,31 @@ func WriteAuthPending(filePath string, timeoutSeconds int, method string, authUR
 		return fmt.Errorf("timeout must be positive, got %d", timeoutSeconds)
 	}
 
-	content := fmt.Sprintf(authPendingFormat, timeoutSeconds, method, authURL)
+	if strings.ContainsAny(method, "\r\n") {
+		return fmt.Errorf("pending auth method must not contain line breaks")
+	}
+
+	if strings.ContainsAny(authURL, "\r\n") {
+		return fmt.Errorf("auth URL must not contain line breaks")
+	}
 
-	// Write atomically with 0600 permissions
-	if err := os.WriteFile(filePath, []byte(content), 0600); err != nil {
+	// Every line must fit in OPTION_LINE_SIZE or OpenVPN truncates it
+	prefix := AuthPendingPrefix(method)
+	if err := checkLineLength(2, "method", method); err != nil {
+		return err
+	}
+	if err := checkLineLength(3, prefix, prefix+authURL); err != nil {
+		return err
+	}
+
+	content := fmt.Sprintf(authPendingFormat, timeoutSeconds, method, prefix, authURL)
+
+	if w.DryRun {
+		slog.Info("dry run: not writing auth_pending_file", "path", filePath, "content", content)
+		return nil
+	}
+
+	if err := writeFileAtomic(filePath, []byte(content)); err != nil {
 		return fmt.Errorf("failed to write auth_pending_file: %w", err)
 	}
 
@@ -55,14 +238,35 @@ func WriteAuthPending(filePath string, timeoutSeconds int, method string, authUR
 	return nil
 }
 
+// checkLineLength returns an ErrLineTooLong error if line n of the
+// auth_pending_file, with its trailing newline, is longer than
+// OptionLineSize. name identifies the line in the error.
+func checkLineLength(n int, name, line string) error {
+	size := len(line) + 1 // +1 for trailing newline
+	if size > OptionLineSize {
+		return fmt.Errorf("%w: auth_pending_file line %d (%s) would be %d bytes, limit is %d",
+			ErrLineTooLong, n, name, size, OptionLineSize)
+	}
+	return nil
+}
+
 // WriteAuthSuccess writes "1" to auth_control_file to indicate successful authentication.
 // OpenVPN will then allow the client to connect.
-func WriteAuthSuccess(filePath string) error {
+func (w FileWriter) WriteAuthSuccess(filePath string) error {
 	if filePath == "" {
 		return fmt.Errorf("auth_control_file path is empty")
 	}
 
-	if err := os.WriteFile(filePath, []byte("1"), 0600); err != nil {
+	if err := w.checkExistingResult(filePath); err != nil {
+		return err
+	}
+
+	if w.DryRun {
+		slog.Info("dry run: not writing auth_control_file", "path", filePath, "content", "1")
+		return nil
+	}
+
+	if err := writeFileAtomic(filePath, []byte("1")); err != nil {
 		return fmt.Errorf("failed to write auth_control_file (success): %w", err)
 	}
 
@@ -77,14 +281,29 @@ func WriteAuthSuccess(filePath string) error {
 // This is because OpenVPN reads the reason file when it sees "0" in the control file.
 //
 // OpenVPN will reject the connection and show the reason to the user.
-func WriteAuthFailure(authControlFile, authFailedReasonFile, reason string) error {
+func (w FileWriter) WriteAuthFailure(authControlFile, authFailedReasonFile, reason string) error {
 	if authControlFile == "" {
 		return fmt.Errorf("auth_control_file path is empty")
 	}
 
+	// Leave both files untouched if another writer already decided
+	if err := w.checkExistingResult(authControlFile); err != nil {
+		return err
+	}
+
+	if w.DryRun {
+		slog.Info("dry run: not writing auth_control_file",
+			"path", authControlFile,
+			"content", "0",
+			"reason_path", authFailedReasonFile,
+			"reason", reason,
+		)
+		return nil
+	}
+
 	// 1. Write error reason FIRST (if path provided)
 	if authFailedReasonFile != "" && reason != "" {
-		if err := os.WriteFile(authFailedReasonFile, []byte(reason), 0600); err != nil {
+		if err := writeFileAtomic(authFailedReasonFile, []byte(reason)); err != nil {
 			// Log but don't fail - auth_control_file is more critical
 			slog.Warn("failed to write auth_failed_reason_file",
 				"path", authFailedReasonFile,
@@ -99,7 +318,7 @@ func WriteAuthFailure(authControlFile, authFailedReasonFile, reason string) erro
 	}
 
 	// 2. Write failure to auth_control_file
-	if err := os.WriteFile(authControlFile, []byte("0"), 0600); err != nil {
+	if err := writeFileAtomic(authControlFile, []byte("0")); err != nil {
 		return fmt.Errorf("failed to write auth_control_file (failure): %w", err)
 	}
 
@@ -1,12 +1,37 @@
 package openvpn
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 	"testing"
 )
 
+func TestAuthPendingPrefix(t *testing.T) {
+	tests := []struct {
+		method string
+		want   string
+	}{
+		{method: "webauth", want: "WEB_AUTH::"},
+		{method: "openurl", want: "OPEN_URL::"},
+		{method: "crtext", want: "CR_TEXT:E:"},
+		{method: "unknown", want: "WEB_AUTH::"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			if got := AuthPendingPrefix(tt.method); got != tt.want {
+				t.Errorf("AuthPendingPrefix(%q) = %q, want %q", tt.method, got, tt.want)
+			}
+		})
+	}
+}
+
 func TestWriteAuthPending(t *testing.T) {
 	tmpDir := t.TempDir()
 	pendingFile := filepath.Join(tmpDir, "auth_pending")
@@ -17,6 +42,7 @@ func TestWriteAuthPending(t *testing.T) {
 		timeoutSeconds  int
 		method          string
 		authURL         string
+		wantPrefix      string
 		wantErr         bool
 		wantErrContains string
 	}{
@@ -26,6 +52,7 @@ func TestWriteAuthPending(t *testing.T) {
 			timeoutSeconds: 300,
 			method:         "webauth",
 			authURL:        "https://keycloak.example.com/auth?client_id=test",
+			wantPrefix:     "WEB_AUTH::",
 			wantErr:        false,
 		},
 		{
@@ -34,6 +61,7 @@ func TestWriteAuthPending(t *testing.T) {
 			timeoutSeconds: 300,
 			method:         "openurl",
 			authURL:        "https://keycloak.example.com/auth?client_id=test",
+			wantPrefix:     "OPEN_URL::",
 			wantErr:        false,
 		},
 		{
@@ -63,6 +91,15 @@ func TestWriteAuthPending(t *testing.T) {
 			wantErr:         true,
 			wantErrContains: "method is empty",
 		},
+		{
+			name:            "line break in auth URL",
+			filePath:        pendingFile,
+			timeoutSeconds:  300,
+			method:          "webauth",
+			authURL:         "https://example.com\n1",
+			wantErr:         true,
+			wantErrContains: "must not contain line breaks",
+		},
 		{
 			name:            "zero timeout",
 			filePath:        pendingFile,
@@ -88,7 +125,7 @@ func TestWriteAuthPending(t *testing.T) {
 			// Clean up file before each test
 			_ = os.Remove(tt.filePath)
 
-			err := WriteAuthPending(tt.filePath, tt.timeoutSeconds, tt.method, tt.authURL)
+			err := (FileWriter{}).WriteAuthPending(tt.filePath, tt.timeoutSeconds, tt.method, tt.authURL)
 
 			if tt.wantErr {
 				if err == nil {
@@ -124,12 +161,12 @@ func TestWriteAuthPending(t *testing.T) {
 				t.Errorf("line 2 = %q, want %q", lines[1], tt.method)
 			}
 
-			// Verify line 3: WEB_AUTH:: prefix
-			if !strings.HasPrefix(lines[2], "WEB_AUTH::") {
-				t.Errorf("line 3 does not start with WEB_AUTH::, got %q", lines[2])
+			// Verify line 3: method-specific prefix
+			if !strings.HasPrefix(lines[2], tt.wantPrefix) {
+				t.Errorf("line 3 does not start with %s, got %q", tt.wantPrefix, lines[2])
 			}
 
-			expectedLine3 := "WEB_AUTH::" + tt.authURL
+			expectedLine3 := tt.wantPrefix + tt.authURL
 			if lines[2] != expectedLine3 {
 				t.Errorf("line 3 = %q, want %q", lines[2], expectedLine3)
 			}
@@ -148,6 +185,65 @@ func TestWriteAuthPending(t *testing.T) {
 	}
 }
 
+func TestWriteAuthPendingLineTooLong(t *testing.T) {
+	pendingFile := filepath.Join(t.TempDir(), "auth_pending")
+
+	tests := []struct {
+		name            string
+		method          string
+		authURL         string
+		wantErrContains string
+	}{
+		{
+			name:            "webauth URL line",
+			method:          "webauth",
+			authURL:         "https://example.com/" + strings.Repeat("a", 226),
+			wantErrContains: "line 3 (WEB_AUTH::) would be 257 bytes",
+		},
+		{
+			name:            "openurl URL line",
+			method:          "openurl",
+			authURL:         "https://example.com/" + strings.Repeat("a", 300),
+			wantErrContains: "line 3 (OPEN_URL::) would be 331 bytes",
+		},
+		{
+			name:            "crtext challenge line",
+			method:          "crtext",
+			authURL:         "Open https://example.com/code and enter code " + strings.Repeat("A", 201),
+			wantErrContains: "line 3 (CR_TEXT:E:) would be 257 bytes",
+		},
+		{
+			name:            "method line",
+			method:          strings.Repeat("m", 256),
+			authURL:         "https://example.com",
+			wantErrContains: "line 2 (method) would be 257 bytes",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_ = os.Remove(pendingFile)
+
+			err := (FileWriter{}).WriteAuthPending(pendingFile, 300, tt.method, tt.authURL)
+			if !errors.Is(err, ErrLineTooLong) {
+				t.Fatalf("error = %v, want ErrLineTooLong", err)
+			}
+			if !strings.Contains(err.Error(), tt.wantErrContains) {
+				t.Errorf("error = %v, want error containing %q", err, tt.wantErrContains)
+			}
+			if _, err := os.Stat(pendingFile); !os.IsNotExist(err) {
+				t.Error("auth_pending_file written despite the error")
+			}
+		})
+	}
+
+	// A line of exactly OptionLineSize bytes, newline included, fits
+	authURL := "https://example.com/" + strings.Repeat("a", 225)
+	if err := (FileWriter{}).WriteAuthPending(pendingFile, 300, "webauth", authURL); err != nil {
+		t.Errorf("256-byte line rejected: %v", err)
+	}
+}
+
 func TestWriteAuthSuccess(t *testing.T) {
 	tmpDir := t.TempDir()
 	controlFile := filepath.Join(tmpDir, "auth_control")
@@ -175,7 +271,7 @@ func TestWriteAuthSuccess(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			_ = os.Remove(tt.filePath)
 
-			err := WriteAuthSuccess(tt.filePath)
+			err := (FileWriter{}).WriteAuthSuccess(tt.filePath)
 
 			if tt.wantErr {
 				if err == nil {
@@ -263,7 +359,7 @@ func TestWriteAuthFailure(t *testing.T) {
 			_ = os.Remove(tt.authControlFile)
 			_ = os.Remove(tt.authFailedReasonFile)
 
-			err := WriteAuthFailure(tt.authControlFile, tt.authFailedReasonFile, tt.reason)
+			err := (FileWriter{}).WriteAuthFailure(tt.authControlFile, tt.authFailedReasonFile, tt.reason)
 
 			if tt.wantErr {
 				if err == nil {
@@ -315,25 +411,25 @@ func TestWriteAuthFailure(t *testing.T) {
 }
 
 func TestWriteOrder(t *testing.T) {
-	// This test verifies that auth_failed_reason_file is written BEFORE auth_control_file
-	// We can't easily test timing, but we can verify both files exist after WriteAuthFailure
-
+	// auth_failed_reason_file must be in place before auth_control_file
 	tmpDir := t.TempDir()
 	controlFile := filepath.Join(tmpDir, "auth_control")
 	reasonFile := filepath.Join(tmpDir, "auth_failed_reason")
 
-	err := WriteAuthFailure(controlFile, reasonFile, "Test error")
-	if err != nil {
-		t.Fatalf("WriteAuthFailure failed: %v", err)
+	var written []string
+	rename = func(oldpath, newpath string) error {
+		written = append(written, newpath)
+		return os.Rename(oldpath, newpath)
 	}
+	t.Cleanup(func() { rename = os.Rename })
 
-	// Both files should exist
-	if _, err := os.Stat(controlFile); err != nil {
-		t.Errorf("control file does not exist: %v", err)
+	err := (FileWriter{}).WriteAuthFailure(controlFile, reasonFile, "Test error")
+	if err != nil {
+		t.Fatalf("WriteAuthFailure failed: %v", err)
 	}
 
-	if _, err := os.Stat(reasonFile); err != nil {
-		t.Errorf("reason file does not exist: %v", err)
+	if want := []string{reasonFile, controlFile}; !slices.Equal(written, want) {
+		t.Errorf("files written in order %v, want %v", written, want)
 	}
 
 	// Verify contents
@@ -348,3 +444,358 @@ func TestWriteOrder(t *testing.T) {
 		t.Errorf("reason file = %q, want %q", reasonContent, "Test error")
 	}
 }
+
+func TestWriteFileAtomic(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(path string) error
+		want  string
+	}{
+		{
+			name: "pending",
+			write: func(path string) error {
+				return (FileWriter{}).WriteAuthPending(path, 300, "webauth", "https://vpn.example.com/auth/x")
+			},
+			want: "300\nwebauth\nWEB_AUTH::https://vpn.example.com/auth/x\n",
+		},
+		{
+			name:  "success",
+			write: (FileWriter{}).WriteAuthSuccess,
+			want:  "1",
+		},
+		{
+			name:  "failure",
+			write: func(path string) error { return (FileWriter{}).WriteAuthFailure(path, "", "") },
+			want:  "0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir := t.TempDir()
+			path := filepath.Join(tmpDir, "auth_file")
+			// OpenVPN creates the file empty; an existing mode is not kept
+			if err := os.WriteFile(path, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			// Until the rename, path must still be empty and the temp file
+			// complete
+			renamed := false
+			rename = func(oldpath, newpath string) error {
+				renamed = true
+				if newpath != path {
+					t.Errorf("renamed to %s, want %s", newpath, path)
+				}
+				if filepath.Dir(oldpath) != tmpDir {
+					t.Errorf("temp file %s not in %s", oldpath, tmpDir)
+				}
+				if content, err := os.ReadFile(path); err != nil || len(content) != 0 {
+					t.Errorf("target before rename = %q (%v), want empty", content, err)
+				}
+				if content, err := os.ReadFile(oldpath); err != nil || string(content) != tt.want {
+					t.Errorf("temp file before rename = %q (%v), want %q", content, err, tt.want)
+				}
+				return os.Rename(oldpath, newpath)
+			}
+			t.Cleanup(func() { rename = os.Rename })
+
+			if err := tt.write(path); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !renamed {
+				t.Fatal("file was not written via rename")
+			}
+
+			content, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("failed to read file: %v", err)
+			}
+			if string(content) != tt.want {
+				t.Errorf("content = %q, want %q", content, tt.want)
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatalf("failed to stat file: %v", err)
+			}
+			if perm := info.Mode().Perm(); perm != 0600 {
+				t.Errorf("file permissions = %o, want 0600", perm)
+			}
+
+			entries, err := os.ReadDir(tmpDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Errorf("directory has %d entries, want only the written file", len(entries))
+			}
+		})
+	}
+}
+
+func TestWriteFileAtomicRenameFailure(t *testing.T) {
+	tmpDir := t.TempDir()
+	controlFile := filepath.Join(tmpDir, "auth_control")
+	if err := os.WriteFile(controlFile, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	rename = func(string, string) error { return errors.New("rename failed") }
+	t.Cleanup(func() { rename = os.Rename })
+
+	err := (FileWriter{}).WriteAuthSuccess(controlFile)
+	if err == nil || !strings.Contains(err.Error(), "rename failed") {
+		t.Fatalf("error = %v, want rename failure", err)
+	}
+
+	content, err := os.ReadFile(controlFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content) != 0 {
+		t.Errorf("control file = %q, want it untouched", content)
+	}
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("directory has %d entries, want the temp file removed", len(entries))
+	}
+}
+
+func TestNotWritable(t *testing.T) {
+	writers := []struct {
+		name  string
+		write func(path string) error
+	}{
+		{"check", (FileWriter{}).CheckWritable},
+		{"pending", func(path string) error {
+			return (FileWriter{}).WriteAuthPending(path, 300, "webauth", "https://vpn.example.com/auth/x")
+		}},
+		{"success", (FileWriter{}).WriteAuthSuccess},
+		{"failure", func(path string) error { return (FileWriter{}).WriteAuthFailure(path, "", "") }},
+	}
+
+	run := func(t *testing.T, dir string) {
+		for _, w := range writers {
+			t.Run(w.name, func(t *testing.T) {
+				err := w.write(filepath.Join(dir, "auth_control"))
+				if !errors.Is(err, ErrNotWritable) {
+					t.Errorf("error = %v, want ErrNotWritable", err)
+				}
+			})
+		}
+	}
+
+	t.Run("missing directory", func(t *testing.T) {
+		run(t, filepath.Join(t.TempDir(), "missing"))
+	})
+
+	t.Run("read-only directory", func(t *testing.T) {
+		if os.Geteuid() == 0 {
+			t.Skip("root bypasses directory permissions")
+		}
+		readOnly := filepath.Join(t.TempDir(), "ro")
+		if err := os.Mkdir(readOnly, 0500); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = os.Chmod(readOnly, 0700) })
+
+		run(t, readOnly)
+	})
+}
+
+func TestCheckWritable(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	if err := (FileWriter{}).CheckWritable(filepath.Join(tmpDir, "auth_control")); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("directory has %d entries, want none", len(entries))
+	}
+
+	if err := (FileWriter{}).CheckWritable(""); err == nil {
+		t.Error("expected error for empty path, got nil")
+	}
+}
+
+func TestPreserveExistingResult(t *testing.T) {
+	tests := []struct {
+		name        string
+		preserve    bool
+		existing    string
+		write       func(w FileWriter, control, reason string) error
+		wantControl string
+		wantReason  string
+		wantErr     bool
+	}{
+		{
+			name:        "skip success over existing failure",
+			preserve:    true,
+			existing:    "0",
+			write:       func(w FileWriter, control, _ string) error { return w.WriteAuthSuccess(control) },
+			wantControl: "0",
+			wantErr:     true,
+		},
+		{
+			name:        "skip failure over existing success",
+			preserve:    true,
+			existing:    "1\n",
+			write:       func(w FileWriter, control, reason string) error { return w.WriteAuthFailure(control, reason, "denied") },
+			wantControl: "1\n",
+			wantErr:     true,
+		},
+		{
+			name:        "write when existing content is not a result",
+			preserve:    true,
+			existing:    "",
+			write:       func(w FileWriter, control, _ string) error { return w.WriteAuthSuccess(control) },
+			wantControl: "1",
+		},
+		{
+			name:        "force overwrite of existing success",
+			preserve:    false,
+			existing:    "1",
+			write:       func(w FileWriter, control, reason string) error { return w.WriteAuthFailure(control, reason, "denied") },
+			wantControl: "0",
+			wantReason:  "denied",
+		},
+		{
+			name:        "force overwrite of existing failure",
+			preserve:    false,
+			existing:    "0",
+			write:       func(w FileWriter, control, _ string) error { return w.WriteAuthSuccess(control) },
+			wantControl: "1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := FileWriter{PreserveExistingResult: tt.preserve}
+			tmpDir := t.TempDir()
+			controlFile := filepath.Join(tmpDir, "auth_control")
+			reasonFile := filepath.Join(tmpDir, "auth_failed_reason")
+
+			if err := os.WriteFile(controlFile, []byte(tt.existing), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			err := tt.write(w, controlFile, reasonFile)
+			if tt.wantErr {
+				if !errors.Is(err, ErrResultExists) {
+					t.Fatalf("expected ErrResultExists, got %v", err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			content, err := os.ReadFile(controlFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != tt.wantControl {
+				t.Errorf("control file = %q, want %q", content, tt.wantControl)
+			}
+
+			reason, err := os.ReadFile(reasonFile)
+			if tt.wantReason == "" {
+				if !os.IsNotExist(err) {
+					t.Errorf("expected reason file to be untouched, got %q (err=%v)", reason, err)
+				}
+			} else if string(reason) != tt.wantReason {
+				t.Errorf("reason file = %q, want %q", reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestPreserveExistingResultMissingFile(t *testing.T) {
+	w := FileWriter{PreserveExistingResult: true}
+
+	controlFile := filepath.Join(t.TempDir(), "auth_control")
+
+	if err := w.WriteAuthSuccess(controlFile); err != nil {
+		t.Fatalf("WriteAuthSuccess failed: %v", err)
+	}
+
+	content, err := os.ReadFile(controlFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "1" {
+		t.Errorf("control file = %q, want %q", content, "1")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	w := FileWriter{DryRun: true}
+
+	var buf bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(old) })
+
+	tmpDir := t.TempDir()
+	pendingFile := filepath.Join(tmpDir, "auth_pending")
+	controlFile := filepath.Join(tmpDir, "auth_control")
+	reasonFile := filepath.Join(tmpDir, "auth_failed_reason")
+
+	if err := w.WriteAuthPending(pendingFile, 300, "webauth", "https://vpn.example.com/auth/abc"); err != nil {
+		t.Fatalf("WriteAuthPending failed: %v", err)
+	}
+	if err := w.WriteAuthSuccess(controlFile); err != nil {
+		t.Fatalf("WriteAuthSuccess failed: %v", err)
+	}
+	if err := w.WriteAuthFailure(controlFile, reasonFile, "Access denied"); err != nil {
+		t.Fatalf("WriteAuthFailure failed: %v", err)
+	}
+
+	// Arguments are still validated
+	if err := w.WriteAuthPending(pendingFile, 0, "webauth", "https://vpn.example.com/auth/abc"); err == nil {
+		t.Error("expected error for invalid timeout in dry run")
+	}
+
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected no files written in dry run, found %d", len(entries))
+	}
+
+	var logged []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("failed to parse log line %q: %v", line, err)
+		}
+		logged = append(logged, entry)
+	}
+
+	want := []struct {
+		msg     string
+		path    string
+		content string
+	}{
+		{"dry run: not writing auth_pending_file", pendingFile, "300\nwebauth\nWEB_AUTH::https://vpn.example.com/auth/abc\n"},
+		{"dry run: not writing auth_control_file", controlFile, "1"},
+		{"dry run: not writing auth_control_file", controlFile, "0"},
+	}
+	if len(logged) != len(want) {
+		t.Fatalf("logged %d entries, want %d:\n%s", len(logged), len(want), buf.String())
+	}
+	for i, w := range want {
+		if logged[i]["msg"] != w.msg || logged[i]["path"] != w.path || logged[i]["content"] != w.content {
+			t.Errorf("log entry %d = %v, want msg %q path %q content %q", i, logged[i], w.msg, w.path, w.content)
+		}
+	}
+	if logged[2]["reason"] != "Access denied" {
+		t.Errorf("failure log reason = %v, want %q", logged[2]["reason"], "Access denied")
+	}
+}
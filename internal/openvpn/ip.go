@@ -0,0 +1,29 @@
+package openvpn
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// NormalizeIP canonicalizes a client address reported by OpenVPN
+// (untrusted_ip / untrusted_ip6) so the same client always produces the same
+// string in logs, metrics and rate-limiter keys: IPv6 is lower-cased and
+// zero-compressed, IPv4-mapped IPv6 is unmapped to IPv4, and surrounding
+// brackets and whitespace are removed.
+//
+// An empty value is returned unchanged. An unparseable value is returned as
+// an error; callers decide whether to reject it or keep the raw value.
+func NormalizeIP(raw string) (string, error) {
+	s := strings.TrimSpace(raw)
+	if s == "" {
+		return "", nil
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid IP address %q", raw)
+	}
+	return addr.Unmap().String(), nil
+}
@@ -0,0 +1,44 @@
+package openvpn
+
+import "testing"
+
+func TestNormalizeIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{name: "empty", raw: "", want: ""},
+		{name: "IPv4", raw: "192.0.2.1", want: "192.0.2.1"},
+		{name: "IPv4 with whitespace", raw: " 192.0.2.1\n", want: "192.0.2.1"},
+		{name: "IPv6 compressed", raw: "2001:db8::1", want: "2001:db8::1"},
+		{name: "IPv6 expanded", raw: "2001:0DB8:0000:0000:0000:0000:0000:0001", want: "2001:db8::1"},
+		{name: "IPv6 upper case", raw: "2001:DB8::A", want: "2001:db8::a"},
+		{name: "IPv6 bracketed", raw: "[2001:db8::1]", want: "2001:db8::1"},
+		{name: "IPv6 loopback", raw: "0:0:0:0:0:0:0:1", want: "::1"},
+		{name: "IPv4-mapped IPv6", raw: "::ffff:192.0.2.1", want: "192.0.2.1"},
+		{name: "hostname", raw: "vpn.example.com", wantErr: true},
+		{name: "IPv4 with port", raw: "192.0.2.1:1194", wantErr: true},
+		{name: "out of range", raw: "256.0.0.1", wantErr: true},
+		{name: "control characters", raw: "192.0.2.1\nfake log line", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizeIP(tt.raw)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("NormalizeIP(%q) = %q, want error", tt.raw, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NormalizeIP(%q) failed: %v", tt.raw, err)
+			}
+			if got != tt.want {
+				t.Errorf("NormalizeIP(%q) = %q, want %q", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
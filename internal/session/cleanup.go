@@ -3,17 +3,21 @@ package session
 import (
 	"log/slog"
 	"time"
-
-	"github.com/al-bashkir/openvpn-keycloak-auth/internal/openvpn"
 )
 
+// TimeoutReason is the failure reason written for sessions that expire
+// without a result.
+const TimeoutReason = "Authentication timeout - session expired"
+
 // cleanupLoop runs in a background goroutine and periodically cleans up expired sessions.
-// It runs every minute (configured by cleanupTicker) and stops when the stopCleanup channel is closed.
+// It runs every session.cleanup_interval, by default DefaultCleanupInterval of the session
+// timeout (half of it, at most a minute), and stops when the stopCleanup channel is closed.
 func (m *Manager) cleanupLoop() {
 	for {
 		select {
 		case <-m.cleanupTicker.C:
 			m.cleanup()
+			m.logStats()
 		case <-m.stopCleanup:
 			return
 		}
@@ -25,44 +29,107 @@ func (m *Manager) cleanupLoop() {
 // it writes an auth failure to the OpenVPN control file.
 // This method is called periodically by cleanupLoop.
 func (m *Manager) cleanup() {
+	m.writeFailures(m.removeExpired(), TimeoutReason)
+}
+
+// writeFailures claims the results of sessions, which were removed without
+// a result, writes reason as their auth failure and calls the OnFailure
+// callback. A session whose result another instance claimed first is
+// skipped and its remembered failure dropped. The claims and files
+// are written without holding m.mu, so a slow store or filesystem does not
+// stall other session operations. The sessions are already removed with
+// ResultWritten set, so nothing else on this instance writes them.
+func (m *Manager) writeFailures(sessions []Session, reason string) {
+	if len(sessions) == 0 {
+		return
+	}
+
+	m.mu.RLock()
+	shared, writer, onFailure := m.shared, m.writer, m.onFailure
+	m.mu.RUnlock()
+
+	for i := range sessions {
+		session := &sessions[i]
+		if !claimResult(shared, session) {
+			m.mu.Lock()
+			delete(m.finished, session.ID)
+			m.mu.Unlock()
+			continue
+		}
+		err := writer.WriteAuthFailure(
+			session.AuthControlFile,
+			session.AuthFailedReasonFile,
+			reason,
+		)
+		if err != nil {
+			slog.Error("failed to write auth failure",
+				"session_id", session.ID,
+				"reason", reason,
+				"error", err,
+			)
+		}
+		if onFailure != nil {
+			onFailure(session, reason)
+		}
+	}
+}
+
+// removeExpired removes all expired sessions and prunes expired remembered
+// results. It returns copies of the removed sessions that had no result yet,
+// whose timeout failure the caller must write with writeFailures.
+func (m *Manager) removeExpired() []Session {
+	defer m.flushStore()
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	now := time.Now()
 	expiredCount := 0
+	var timedOut []Session
 
-	for sessionID, session := range m.sessions {
+	for _, session := range m.sessions {
 		if now.After(session.ExpiresAt) {
-			// Write failure for expired sessions that haven't completed
+			// Expired sessions that haven't completed get a failure
 			if !session.ResultWritten {
 				slog.Warn("session expired, writing auth failure",
-					"session_id", sessionID,
+					"session_id", session.ID,
+					"correlation_id", session.CorrelationID,
 					"username", session.Username,
 					"ip", session.UntrustedIP,
 				)
-				err := openvpn.WriteAuthFailure(
-					session.AuthControlFile,
-					session.AuthFailedReasonFile,
-					"Authentication timeout - session expired",
-				)
-				if err != nil {
-					slog.Error("failed to write auth failure for expired session",
-						"session_id", sessionID,
-						"error", err,
-					)
-				}
+				session.ResultWritten = true
+				timedOut = append(timedOut, *session)
+				m.rememberResult(session, StatusFailure)
+			} else {
+				m.rememberResult(session, session.Result)
 			}
 
 			// Remove expired session
-			delete(m.sessions, sessionID)
-			if session.State != "" {
-				delete(m.stateIndex, session.State)
-			}
+			m.remove(session)
 			expiredCount++
 		}
 	}
 
+	for sessionID, f := range m.finished {
+		if now.After(f.expiresAt) {
+			delete(m.finished, sessionID)
+		}
+	}
+
 	if expiredCount > 0 {
 		slog.Info("cleaned up expired sessions", "count", expiredCount)
 	}
+	return timedOut
+}
+
+// logStats logs a summary of the remaining sessions after a cleanup cycle.
+func (m *Manager) logStats() {
+	stats := m.Stats()
+	slog.Debug("session stats",
+		"total", stats.Total,
+		"pending", stats.Pending,
+		"completed", stats.Completed,
+		"oldest_age", stats.OldestAge,
+		"average_age", stats.AverageAge,
+	)
 }
@@ -3,30 +3,87 @@ package session
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
 	"sync"
 	"time"
+	"unicode"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/openvpn"
 )
 
+// ErrTooManySessions is returned by Create when the user already has the
+// maximum number of concurrent sessions (see SetMaxSessionsPerUser).
+var ErrTooManySessions = errors.New("too many concurrent sessions for user")
+
+// ErrOtherIPSession is returned by Create when the user has a pending
+// session from a different IP address (see SetSingleIPPerUser).
+var ErrOtherIPSession = errors.New("user has a pending session from a different IP")
+
+// SupersededReason is the failure reason written for a session replaced by
+// a login from another IP after the single-IP grace period.
+const SupersededReason = "Login superseded by a newer login from another address"
+
 // Manager manages authentication sessions in-memory with TTL-based cleanup.
 // It is thread-safe and supports concurrent access.
 type Manager struct {
 	mu             sync.RWMutex
-	sessions       map[string]*Session // sessionID -> Session
-	stateIndex     map[string]*Session // state -> Session
+	sessions       map[string]*Session   // sessionID -> Session
+	stateIndex     map[string]*Session   // state -> Session
+	codeIndex      map[string]*Session   // user code -> Session
+	userIndex      map[string][]*Session // username -> Sessions
+	finished       map[string]finished   // sessionID -> result of a removed session
 	sessionTimeout time.Duration
+	maxPerUser     int // 0 means unlimited
+	singleIP       bool
+	singleIPGrace  time.Duration // 0 means never supersede
 	cleanupTicker  *time.Ticker
+	cleanupAuto    bool // cleanup interval follows the session timeout
 	stopCleanup    chan struct{}
+	onFailure      func(*Session, string)
+	writer         openvpn.Writer // writes the failures the manager decides
+	store          SessionStore   // nil keeps sessions in memory only
+	shared         SharedStore    // store, if it is shared between instances
+	storeQueue     []storeOp      // store changes not yet applied
+	storeMu        sync.Mutex     // serializes flushStore; never held with mu
+}
+
+// storeOp is a change to the session store queued under Manager.mu and
+// applied by flushStore after the lock is released.
+type storeOp struct {
+	session Session // copy taken when the change was queued
+	delete  bool
+}
+
+// finished is the result of a session that has been removed, kept for one
+// session timeout so status queries can still report it.
+type finished struct {
+	result    string
+	expiresAt time.Time
 }
 
 // NewManager creates a new session manager with the specified timeout.
-// It automatically starts a background cleanup goroutine that runs every minute.
-func NewManager(sessionTimeout time.Duration) *Manager {
+// It automatically starts a background cleanup goroutine that removes
+// expired sessions every cleanupInterval; 0 uses DefaultCleanupInterval.
+func NewManager(sessionTimeout, cleanupInterval time.Duration) *Manager {
+	cleanupAuto := cleanupInterval <= 0
+	if cleanupAuto {
+		cleanupInterval = DefaultCleanupInterval(sessionTimeout)
+	}
 	m := &Manager{
 		sessions:       make(map[string]*Session),
 		stateIndex:     make(map[string]*Session),
+		codeIndex:      make(map[string]*Session),
+		userIndex:      make(map[string][]*Session),
+		finished:       make(map[string]finished),
 		sessionTimeout: sessionTimeout,
-		cleanupTicker:  time.NewTicker(1 * time.Minute),
+		writer:         openvpn.FileWriter{},
+		cleanupTicker:  time.NewTicker(cleanupInterval),
+		cleanupAuto:    cleanupAuto,
 		stopCleanup:    make(chan struct{}),
 	}
 
@@ -36,16 +93,33 @@ func NewManager(sessionTimeout time.Duration) *Manager {
 	return m
 }
 
+// DefaultCleanupInterval returns how often expired sessions are cleaned up
+// unless configured: half the session timeout, at most a minute, so the
+// timeout failure reaches OpenVPN soon after the session expires.
+func DefaultCleanupInterval(sessionTimeout time.Duration) time.Duration {
+	if interval := min(sessionTimeout/2, time.Minute); interval > 0 {
+		return interval
+	}
+	return time.Minute
+}
+
 // Stop stops the session manager's cleanup goroutine.
 // Call this when shutting down the daemon.
 func (m *Manager) Stop() {
 	m.cleanupTicker.Stop()
 	close(m.stopCleanup)
+
+	if closer, ok := m.store.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			slog.Warn("failed to close session store", "error", err)
+		}
+	}
 }
 
 // Create creates a new session with the given parameters.
 // The session ID is generated using crypto/rand (64 hex characters).
-// Returns the new session or an error.
+// Returns the new session or an error; the error wraps ErrTooManySessions
+// when the user is at the concurrent session limit.
 func (m *Manager) Create(username, commonName, untrustedIP, untrustedPort string,
 	authControlFile, authPendingFile, authFailedReasonFile string) (*Session, error) {
 
@@ -55,7 +129,6 @@ func (m *Manager) Create(username, commonName, untrustedIP, untrustedPort string
 		return nil, fmt.Errorf("failed to generate session ID: %w", err)
 	}
 
-	// Create session
 	session := &Session{
 		ID:                   sessionID,
 		Username:             username,
@@ -65,22 +138,284 @@ func (m *Manager) Create(username, commonName, untrustedIP, untrustedPort string
 		AuthControlFile:      authControlFile,
 		AuthPendingFile:      authPendingFile,
 		AuthFailedReasonFile: authFailedReasonFile,
-		CreatedAt:            time.Now(),
-		ExpiresAt:            time.Now().Add(m.sessionTimeout),
 	}
 
+	// Sessions superseded by this one get their failure once the lock is
+	// released
+	var superseded []Session
+	defer func() { m.writeFailures(superseded, SupersededReason) }()
+	defer m.flushStore()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	superseded, err = m.create(session)
+	if err != nil {
+		return nil, err
+	}
+	return session, nil
+}
+
+// CreateOrReuse returns the pending session of the connection attempt
+// sending an auth request, so a retried or repeated request does not start
+// a second login. The attempt is identified by template's username, common
+// name, IP, port and auth_control_file; a reconnecting client uses a new
+// port and files and gets a new session (see Cancel). A reused session's
+// expiry is extended by the session timeout, and reused is true; the
+// extended session is a copy that replaces the original in the manager, so
+// callers still holding the original can read it without m.mu. Without
+// such a session, a new one is created from template like Create, with
+// template's OIDC flow, provider and other fields already set. Lookup and
+// creation happen under one lock, so concurrent requests of the same
+// attempt end up with one session.
+func (m *Manager) CreateOrReuse(template *Session) (session *Session, reused bool, err error) {
+	sessionID, err := generateSessionID()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to generate session ID: %w", err)
+	}
+
+	var superseded []Session
+	defer func() { m.writeFailures(superseded, SupersededReason) }()
+	defer m.flushStore()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for i, s := range m.userIndex[template.Username] {
+		if s.ResultWritten || now.After(s.ExpiresAt) || s.State == "" ||
+			s.CommonName != template.CommonName || s.UntrustedIP != template.UntrustedIP ||
+			!s.sameAttempt(template.UntrustedPort, template.AuthControlFile) {
+			continue
+		}
+		extended := new(Session)
+		*extended = *s
+		extended.ExpiresAt = now.Add(m.sessionTimeout)
+		m.sessions[extended.ID] = extended
+		m.stateIndex[extended.State] = extended
+		if extended.UserCode != "" {
+			m.codeIndex[extended.UserCode] = extended
+		}
+		m.userIndex[template.Username][i] = extended
+		m.persist(extended)
+		return extended, true, nil
+	}
+
+	session = new(Session)
+	*session = *template
+	session.ID = sessionID
+	superseded, err = m.create(session)
+	if err != nil {
+		return nil, false, err
+	}
+	if session.State != "" {
+		m.stateIndex[session.State] = session
+	}
+	return session, false, nil
+}
+
+// create sets the timestamps of session and adds it, unless the per-user
+// limits reject it. It returns copies of the sessions it superseded, whose
+// failure the caller must write with writeFailures after releasing m.mu.
+// Must be called with m.mu held.
+func (m *Manager) create(session *Session) ([]Session, error) {
+	now := time.Now()
+	username, untrustedIP := session.Username, session.UntrustedIP
+
+	// Expired sessions are only removed by the next cleanup; don't count them
+	if m.maxPerUser > 0 {
+		active := 0
+		for _, s := range m.userIndex[username] {
+			if !now.After(s.ExpiresAt) {
+				active++
+			}
+		}
+		if active >= m.maxPerUser {
+			return nil, fmt.Errorf("%w (%d pending, limit %d)", ErrTooManySessions, active, m.maxPerUser)
+		}
+	}
+
+	var superseded []*Session
+	if m.singleIP {
+		for _, s := range m.userIndex[username] {
+			if now.After(s.ExpiresAt) || s.ResultWritten || s.UntrustedIP == untrustedIP {
+				continue
+			}
+			// A login pending longer than the grace period is most likely
+			// abandoned, e.g. the client roamed to another network
+			if m.singleIPGrace > 0 && now.Sub(s.CreatedAt) >= m.singleIPGrace {
+				superseded = append(superseded, s)
+				continue
+			}
+			return nil, fmt.Errorf("%w (%s)", ErrOtherIPSession, s.UntrustedIP)
+		}
+	}
+	removed := make([]Session, 0, len(superseded))
+	for _, s := range superseded {
+		removed = append(removed, m.supersede(s))
+	}
+
+	session.CreatedAt = now
+	session.ExpiresAt = now.Add(m.sessionTimeout)
+
 	// Store session
+	m.sessions[session.ID] = session
+	m.userIndex[username] = append(m.userIndex[username], session)
+	m.persist(session)
+
+	return removed, nil
+}
+
+// SetStore attaches a persistent session store. Unexpired sessions saved by
+// a previous run are loaded, so their callbacks still succeed after a
+// restart, and every later change is saved to the store. With a SharedStore
+// the manager also finds sessions created by other daemon instances and
+// claims results through the store. It returns the number of sessions
+// loaded. Call it before the first session is created.
+func (m *Manager) SetStore(store SessionStore) (int, error) {
+	sessions, err := store.Load()
+	if err != nil {
+		return 0, err
+	}
+
+	defer m.flushStore()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.store = store
+	m.shared, _ = store.(SharedStore)
+
+	now := time.Now()
+	for _, session := range sessions {
+		if !now.Before(session.ExpiresAt) {
+			// Drop expired sessions from the store right away
+			m.unpersist(session)
+			continue
+		}
+		m.add(session)
+	}
+	return len(m.sessions), nil
+}
+
+// add inserts session into the session map and all indexes. Must be called
+// with m.mu held.
+func (m *Manager) add(session *Session) {
+	m.sessions[session.ID] = session
+	if session.State != "" {
+		m.stateIndex[session.State] = session
+	}
+	if session.UserCode != "" {
+		m.codeIndex[session.UserCode] = session
+	}
+	m.userIndex[session.Username] = append(m.userIndex[session.Username], session)
+}
+
+// persist queues saving a copy of session to the store, if any. Must be
+// called with m.mu held; flushStore saves it once the lock is released.
+func (m *Manager) persist(session *Session) {
+	if m.store == nil {
+		return
+	}
+	m.storeQueue = append(m.storeQueue, storeOp{session: *session})
+}
+
+// unpersist queues removing session from the store, if any. Must be called
+// with m.mu held; flushStore removes it once the lock is released.
+func (m *Manager) unpersist(session *Session) {
+	if m.store == nil {
+		return
+	}
+	m.storeQueue = append(m.storeQueue, storeOp{session: *session, delete: true})
+}
+
+// flushStore applies the queued store changes in order. Methods that change
+// sessions defer it before locking m.mu, so a slow store such as Redis never
+// blocks other session operations, while storeMu keeps concurrent flushes
+// from reordering changes. Failures are logged: the in-memory state stays
+// authoritative. Must be called without m.mu held.
+func (m *Manager) flushStore() {
+	m.storeMu.Lock()
+	defer m.storeMu.Unlock()
+
 	m.mu.Lock()
-	m.sessions[sessionID] = session
+	ops, store := m.storeQueue, m.store
+	m.storeQueue = nil
 	m.mu.Unlock()
 
-	return session, nil
+	for i := range ops {
+		session := &ops[i].session
+		if ops[i].delete {
+			if err := store.Delete(session); err != nil {
+				slog.Error("failed to remove persisted session", "session_id", session.ID, "error", err)
+			}
+			continue
+		}
+		if err := store.Save(session); err != nil {
+			slog.Error("failed to persist session", "session_id", session.ID, "error", err)
+		}
+	}
+}
+
+// SetWriter sets the writer of the auth failures the manager writes itself:
+// for expired, superseded and killed sessions. The default writes the files
+// and overwrites existing results. It can be called at any time, e.g. on a
+// configuration reload.
+func (m *Manager) SetWriter(w openvpn.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writer = w
 }
 
-// UpdateOIDCFlow updates a session with OIDC flow data (state, code verifier, auth URL).
-// This is called after starting the OIDC authorization flow.
+// SetMaxSessionsPerUser limits the number of concurrent unexpired sessions
+// per username; Create rejects sessions beyond the limit. 0 disables the
+// limit.
+func (m *Manager) SetMaxSessionsPerUser(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxPerUser = n
+}
+
+// SetSingleIPPerUser makes Create reject a session for a username that has
+// a pending session from a different IP. A pending session older than grace
+// is superseded instead: its auth failure is written and it is removed, so a
+// client that roamed to another network can log in again. A grace of 0
+// never supersedes.
+func (m *Manager) SetSingleIPPerUser(enabled bool, grace time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.singleIP = enabled
+	m.singleIPGrace = grace
+}
+
+// supersede removes session, which has no result yet, and returns a copy
+// of it for writeFailures. Must be called with m.mu held.
+func (m *Manager) supersede(session *Session) Session {
+	slog.Warn("superseding pending session from another IP",
+		"session_id", session.ID,
+		"username", session.Username,
+		"ip", session.UntrustedIP,
+	)
+	session.ResultWritten = true
+	m.rememberResult(session, StatusFailure)
+	m.remove(session)
+	return *session
+}
+
+// SetTimeout changes the timeout applied to sessions created from now on.
+// Existing sessions keep their expiry. Unless NewManager was given a
+// cleanup interval, the cleanup interval is re-derived from the new timeout.
+func (m *Manager) SetTimeout(sessionTimeout time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sessionTimeout = sessionTimeout
+	if m.cleanupAuto {
+		m.cleanupTicker.Reset(DefaultCleanupInterval(sessionTimeout))
+	}
+}
+
+// UpdateOIDCFlow updates a session with OIDC flow data (state, code verifier,
+// nonce, auth URL). This is called after starting the OIDC authorization flow.
 // The state is indexed for fast lookup during the callback.
-func (m *Manager) UpdateOIDCFlow(sessionID, state, codeVerifier, authURL string) error {
+func (m *Manager) UpdateOIDCFlow(sessionID, state, codeVerifier, nonce, authURL string) error {
+	defer m.flushStore()
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -91,21 +426,169 @@ func (m *Manager) UpdateOIDCFlow(sessionID, state, codeVerifier, authURL string)
 
 	session.State = state
 	session.CodeVerifier = codeVerifier
+	session.Nonce = nonce
 	session.AuthURL = authURL
 
 	// Add to state index for callback lookup
 	m.stateIndex[state] = session
+	m.persist(session)
+
+	return nil
+}
+
+// SetPendingAuthMethod records the pending auth method sent to the client.
+func (m *Manager) SetPendingAuthMethod(sessionID, method string) error {
+	defer m.flushStore()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return fmt.Errorf("session not found: %s", sessionID)
+	}
+
+	session.PendingAuthMethod = method
+	m.persist(session)
+	return nil
+}
+
+// SetProvider records the name of the OIDC provider handling the session.
+func (m *Manager) SetProvider(sessionID, provider string) error {
+	defer m.flushStore()
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return fmt.Errorf("session not found: %s", sessionID)
+	}
+
+	session.Provider = provider
+	m.persist(session)
 	return nil
 }
 
+// SetInstance records the OpenVPN server instance the session belongs to.
+func (m *Manager) SetInstance(sessionID, instance string) error {
+	defer m.flushStore()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return fmt.Errorf("session not found: %s", sessionID)
+	}
+
+	session.Instance = instance
+	m.persist(session)
+	return nil
+}
+
+// AssignUserCode generates a unique one-time user code for a crtext session
+// and indexes it for RedeemUserCode. The code is returned formatted for
+// display (XXXX-XXXX).
+func (m *Manager) AssignUserCode(sessionID string) (string, error) {
+	defer m.flushStore()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return "", fmt.Errorf("session not found: %s", sessionID)
+	}
+
+	for {
+		code, err := generateUserCode()
+		if err != nil {
+			return "", fmt.Errorf("failed to generate user code: %w", err)
+		}
+		if _, taken := m.codeIndex[code]; taken {
+			continue
+		}
+
+		if session.UserCode != "" {
+			delete(m.codeIndex, session.UserCode)
+		}
+		session.UserCode = code
+		m.codeIndex[code] = session
+		m.persist(session)
+		return FormatUserCode(code), nil
+	}
+}
+
+// AssignCorrelationCode generates a short correlation code for a session,
+// shown both by the VPN client and on the browser pages so the user can tell
+// which login a browser tab belongs to. Unlike user codes it grants nothing
+// and need not be unique.
+func (m *Manager) AssignCorrelationCode(sessionID string) (string, error) {
+	code, err := NewCorrelationCode()
+	if err != nil {
+		return "", err
+	}
+
+	defer m.flushStore()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		return "", fmt.Errorf("session not found: %s", sessionID)
+	}
+
+	session.CorrelationCode = code
+	m.persist(session)
+	return code, nil
+}
+
+// RedeemUserCode looks up a session by its user code and invalidates the
+// code, so each code can be used only once. Dashes, spaces and case in the
+// entered code are ignored.
+// Returns an error if the code is unknown or the session has expired.
+func (m *Manager) RedeemUserCode(code string) (*Session, error) {
+	code = NormalizeUserCode(code)
+
+	defer m.flushStore()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session, ok := m.codeIndex[code]
+	if !ok {
+		return nil, fmt.Errorf("session not found for code")
+	}
+
+	if time.Now().After(session.ExpiresAt) {
+		return nil, fmt.Errorf("session expired")
+	}
+
+	delete(m.codeIndex, code)
+	session.UserCode = ""
+	m.persist(session)
+	return session, nil
+}
+
+// OnFailure registers fn to be called for each session the manager fails by
+// itself: sessions that expire without a result (reason TimeoutReason) and
+// sessions superseded by a login from another IP (reason SupersededReason).
+// It is called after the failure has been written, with a copy of the
+// removed session and without the manager lock held. Call it before the
+// first session is created.
+func (m *Manager) OnFailure(fn func(session *Session, reason string)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onFailure = fn
+}
+
 // Get retrieves a session by its ID.
 // Returns an error if the session is not found or has expired.
 func (m *Manager) Get(sessionID string) (*Session, error) {
 	m.mu.RLock()
-	defer m.mu.RUnlock()
-
 	session, ok := m.sessions[sessionID]
+	shared := m.shared
+	m.mu.RUnlock()
+
+	if !ok && shared != nil {
+		session, ok = m.adopt(shared.Get(sessionID))
+	}
 	if !ok {
 		return nil, fmt.Errorf("session not found")
 	}
@@ -123,9 +606,13 @@ func (m *Manager) Get(sessionID string) (*Session, error) {
 // Returns an error if the session is not found or has expired.
 func (m *Manager) GetByState(state string) (*Session, error) {
 	m.mu.RLock()
-	defer m.mu.RUnlock()
-
 	session, ok := m.stateIndex[state]
+	shared := m.shared
+	m.mu.RUnlock()
+
+	if !ok && shared != nil {
+		session, ok = m.adopt(shared.GetByState(state))
+	}
 	if !ok {
 		return nil, fmt.Errorf("session not found for state")
 	}
@@ -138,6 +625,65 @@ func (m *Manager) GetByState(state string) (*Session, error) {
 	return session, nil
 }
 
+// LocalIDByState returns the ID of the unexpired session with the given
+// OAuth2 state held by this instance, without consulting the shared store.
+// It is meant for hot paths such as rate limiting that must not do I/O.
+func (m *Manager) LocalIDByState(state string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	session, ok := m.stateIndex[state]
+	if !ok || time.Now().After(session.ExpiresAt) {
+		return "", false
+	}
+	return session.ID, true
+}
+
+// adopt takes over a session found in the shared store, typically one
+// created by another instance whose callback reached this one. It returns
+// the adopted session, or false if the lookup failed or found nothing.
+func (m *Manager) adopt(session *Session, err error) (*Session, bool) {
+	if err != nil {
+		slog.Error("failed to look up session in shared store", "error", err)
+		return nil, false
+	}
+	if session == nil {
+		return nil, false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Another goroutine may have adopted it while the lock was released
+	if existing, ok := m.sessions[session.ID]; ok {
+		return existing, true
+	}
+	m.add(session)
+	return session, true
+}
+
+// claimResult claims the result of session in shared, if any, so only one
+// instance writes its auth_control_file. It returns false if another
+// instance already did. Store errors are logged and the claim is granted:
+// blocking the result on an unreachable store would leave the client
+// hanging until the session times out. Callers set session.ResultWritten
+// under m.mu first, so no other goroutine of this instance claims the same
+// result, and then call it without m.mu held.
+func claimResult(shared SharedStore, session *Session) bool {
+	if shared == nil {
+		return true
+	}
+	claimed, err := shared.MarkResultWritten(session)
+	if err != nil {
+		slog.Error("failed to claim session result in shared store",
+			"session_id", session.ID,
+			"error", err,
+		)
+		return true
+	}
+	return claimed
+}
+
 // ResultWritten returns whether a session has written an auth result.
 // The second return value is false if the session does not exist (deleted/expired).
 func (m *Manager) ResultWritten(sessionID string) (bool, bool) {
@@ -155,21 +701,87 @@ func (m *Manager) ResultWritten(sessionID string) (bool, bool) {
 // MarkResultWritten atomically sets ResultWritten on a session.
 // Returns false if the session was not found or was already marked.
 func (m *Manager) MarkResultWritten(sessionID string) bool {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	return m.setResult(sessionID, "")
+}
+
+// SetResult is like MarkResultWritten but also records whether the decision
+// was a success, which Status reports even after the session is deleted.
+func (m *Manager) SetResult(sessionID string, success bool) bool {
+	result := StatusFailure
+	if success {
+		result = StatusSuccess
+	}
+	return m.setResult(sessionID, result)
+}
 
+// setResult marks the session's result as written, claims it in the shared
+// store, if any, and records result unless it is "".
+func (m *Manager) setResult(sessionID, result string) bool {
+	defer m.flushStore()
+
+	m.mu.Lock()
 	session, ok := m.sessions[sessionID]
 	if !ok || session.ResultWritten {
+		m.mu.Unlock()
 		return false
 	}
-
 	session.ResultWritten = true
+	shared := m.shared
+	m.mu.Unlock()
+
+	if !claimResult(shared, session) {
+		return false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session.Result = result
+	if _, ok := m.sessions[session.ID]; !ok {
+		// Removed while the claim was in flight, e.g. by cleanup
+		m.rememberResult(session, result)
+		return true
+	}
+	m.persist(session)
 	return true
 }
 
+// Status returns the status of a session: StatusPending while it awaits a
+// result, or StatusSuccess/StatusFailure once decided. Results of removed
+// sessions are remembered for one session timeout. Returns an error for
+// unknown sessions.
+func (m *Manager) Status(sessionID string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if session, ok := m.sessions[sessionID]; ok {
+		if session.Result != "" {
+			return session.Result, nil
+		}
+		return StatusPending, nil
+	}
+	if f, ok := m.finished[sessionID]; ok && time.Now().Before(f.expiresAt) {
+		return f.result, nil
+	}
+	return "", fmt.Errorf("session not found")
+}
+
+// rememberResult keeps the result of a session being removed. Must be called
+// with m.mu held.
+func (m *Manager) rememberResult(session *Session, result string) {
+	if result == "" {
+		return
+	}
+	m.finished[session.ID] = finished{
+		result:    result,
+		expiresAt: time.Now().Add(m.sessionTimeout),
+	}
+}
+
 // Delete removes a session from the manager.
 // This should be called after the authentication completes (success or failure).
 func (m *Manager) Delete(sessionID string) {
+	defer m.flushStore()
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -178,11 +790,153 @@ func (m *Manager) Delete(sessionID string) {
 		return
 	}
 
-	// Remove from both indexes
-	delete(m.sessions, sessionID)
+	m.rememberResult(session, session.Result)
+
+	m.remove(session)
+}
+
+// SelfTest checks that a session can be generated, added, looked up and
+// removed, for the daemon's watchdog. The probe session only exists while
+// m.mu is held: it is never saved to the store, counted against a user's
+// limits or seen by other callers, and leaves no remembered result.
+func (m *Manager) SelfTest() error {
+	sessionID, err := generateSessionID()
+	if err != nil {
+		return fmt.Errorf("failed to generate session ID: %w", err)
+	}
+	probe := &Session{ID: sessionID, Username: selfTestUsername}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.add(probe)
+	found := m.sessions[sessionID] == probe
+	m.forget(probe)
+	if !found {
+		return fmt.Errorf("probe session not found after adding it")
+	}
+	if _, ok := m.sessions[sessionID]; ok {
+		return fmt.Errorf("probe session still present after removing it")
+	}
+	return nil
+}
+
+// selfTestUsername is the username of the probe session of SelfTest.
+// OpenVPN usernames cannot contain NUL, so it never collides with a real user.
+const selfTestUsername = "\x00watchdog-selftest"
+
+// remove deletes session from the session map, all indexes and the store.
+// Must be called with m.mu held.
+func (m *Manager) remove(session *Session) {
+	m.unpersist(session)
+	m.forget(session)
+}
+
+// forget deletes session from the session map and all indexes. Must be
+// called with m.mu held.
+func (m *Manager) forget(session *Session) {
+	delete(m.sessions, session.ID)
 	if session.State != "" {
 		delete(m.stateIndex, session.State)
 	}
+	if session.UserCode != "" {
+		delete(m.codeIndex, session.UserCode)
+	}
+
+	userSessions := slices.DeleteFunc(m.userIndex[session.Username], func(s *Session) bool {
+		return s == session
+	})
+	if len(userSessions) == 0 {
+		delete(m.userIndex, session.Username)
+	} else {
+		m.userIndex[session.Username] = userSessions
+	}
+}
+
+// List returns copies of all sessions, oldest first.
+func (m *Manager) List() []Session {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	sessions := make([]Session, 0, len(m.sessions))
+	for _, session := range m.sessions {
+		sessions = append(sessions, *session)
+	}
+	slices.SortFunc(sessions, func(a, b Session) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return sessions
+}
+
+// Kill ends a session on an operator's request: unless a result has
+// already been written, an auth failure with reason is written to its
+// auth_control_file. The session is then deleted and returned; failed
+// reports whether this call wrote the failure. Returns an error if the
+// session does not exist.
+func (m *Manager) Kill(sessionID, reason string) (session *Session, failed bool, err error) {
+	defer m.flushStore()
+
+	m.mu.Lock()
+	session, ok := m.sessions[sessionID]
+	if !ok {
+		m.mu.Unlock()
+		return nil, false, fmt.Errorf("session not found")
+	}
+	claim := !session.ResultWritten
+	session.ResultWritten = true
+	shared, writer := m.shared, m.writer
+	m.mu.Unlock()
+
+	// The claim and the file are written without holding the lock
+	if claim && claimResult(shared, session) {
+		if err := writer.WriteAuthFailure(
+			session.AuthControlFile,
+			session.AuthFailedReasonFile,
+			reason,
+		); err != nil {
+			m.mu.Lock()
+			session.ResultWritten = false
+			m.mu.Unlock()
+			return nil, false, fmt.Errorf("failed to write auth failure: %w", err)
+		}
+		failed = true
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if failed {
+		session.Result = StatusFailure
+	}
+	m.rememberResult(session, session.Result)
+	if _, ok := m.sessions[session.ID]; ok {
+		m.remove(session)
+	}
+	return session, failed, nil
+}
+
+// Cancel deletes the pending sessions of the client identified by username,
+// commonName and untrustedIP without writing a result, e.g. because the
+// client reconnected and OpenVPN has given up on the old connection
+// attempt. The session of the attempt identified by untrustedPort and
+// authControlFile, if any, is kept; empty values cancel all of them. A
+// later callback or timeout for the cancelled sessions finds no session and
+// writes nothing. Returns the deleted sessions.
+func (m *Manager) Cancel(username, commonName, untrustedIP, untrustedPort, authControlFile string) []*Session {
+	defer m.flushStore()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var cancelled []*Session
+	for _, session := range slices.Clone(m.userIndex[username]) {
+		if session.ResultWritten || session.CommonName != commonName || session.UntrustedIP != untrustedIP ||
+			session.sameAttempt(untrustedPort, authControlFile) {
+			continue
+		}
+		m.remove(session)
+		cancelled = append(cancelled, session)
+	}
+	return cancelled
 }
 
 // Count returns the current number of active sessions.
@@ -193,6 +947,127 @@ func (m *Manager) Count() int {
 	return len(m.sessions)
 }
 
+// Stats is a point-in-time summary of the sessions tracked by a Manager.
+type Stats struct {
+	// Total is the number of sessions currently tracked
+	Total int
+
+	// Pending is the number of sessions still waiting for a result
+	Pending int
+
+	// Completed is the number of sessions whose result has been written
+	Completed int
+
+	// OldestAge is the age of the oldest session (zero when there are none)
+	OldestAge time.Duration
+
+	// AverageAge is the mean age across all sessions (zero when there are none)
+	AverageAge time.Duration
+}
+
+// Stats returns a summary of the current sessions.
+// It is safe to call concurrently with other Manager methods.
+func (m *Manager) Stats() Stats {
+	return m.statsAt(time.Now())
+}
+
+// statsAt computes session statistics relative to the given time.
+func (m *Manager) statsAt(now time.Time) Stats {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var stats Stats
+	var totalAge time.Duration
+
+	for _, session := range m.sessions {
+		stats.Total++
+		if session.ResultWritten {
+			stats.Completed++
+		} else {
+			stats.Pending++
+		}
+
+		age := now.Sub(session.CreatedAt)
+		if age < 0 {
+			age = 0
+		}
+		totalAge += age
+		if age > stats.OldestAge {
+			stats.OldestAge = age
+		}
+	}
+
+	if stats.Total > 0 {
+		stats.AverageAge = totalAge / time.Duration(stats.Total)
+	}
+
+	return stats
+}
+
+// userCodeAlphabet omits characters that are easily confused when read
+// from a terminal (0/O, 1/I/L).
+const userCodeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+// userCodeLength is the number of characters in a user code (~39 bits).
+const userCodeLength = 8
+
+// correlationCodeAlphabet is userCodeAlphabet without digits, so the code
+// reads as a short word.
+const correlationCodeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ"
+
+// correlationCodeLength is the number of letters in a correlation code.
+const correlationCodeLength = 4
+
+// NewCorrelationCode generates a correlation code (see
+// AssignCorrelationCode), e.g. to set it on the template passed to
+// CreateOrReuse.
+func NewCorrelationCode() (string, error) {
+	code, err := generateCode(correlationCodeAlphabet, correlationCodeLength)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate correlation code: %w", err)
+	}
+	return code, nil
+}
+
+// generateUserCode generates a random user code from userCodeAlphabet.
+func generateUserCode() (string, error) {
+	return generateCode(userCodeAlphabet, userCodeLength)
+}
+
+// generateCode generates a random code of length characters from alphabet.
+func generateCode(alphabet string, length int) (string, error) {
+	b := make([]byte, length)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	code := make([]byte, length)
+	for i := range b {
+		// 256 is not a multiple of the alphabet size; the slight bias is
+		// irrelevant for a short-lived code
+		code[i] = alphabet[int(b[i])%len(alphabet)]
+	}
+	return string(code), nil
+}
+
+// FormatUserCode formats a user code for display, e.g. "ABCD-EFGH".
+func FormatUserCode(code string) string {
+	if len(code) != userCodeLength {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+// NormalizeUserCode converts a user-entered code to its canonical form by
+// upper-casing it and dropping dashes and whitespace.
+func NormalizeUserCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || unicode.IsSpace(r) {
+			return -1
+		}
+		return unicode.ToUpper(r)
+	}, code)
+}
+
 // generateSessionID generates a cryptographically secure random session ID.
 // The ID is 64 hex characters (32 random bytes).
 func generateSessionID() (string, error) {
@@ -0,0 +1,142 @@
+package session
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisKeyPrefix namespaces all keys written by RedisStore.
+const redisKeyPrefix = "openvpn-keycloak-auth:"
+
+// redisTimeout bounds each Redis round trip made by RedisStore.
+const redisTimeout = 2 * time.Second
+
+// RedisStore is a SharedStore backed by Redis, for several daemon instances
+// behind a load balancer. Sessions are stored as JSON under their ID, with a
+// second key mapping the OIDC state to the ID so that any instance can serve
+// the callback. The keys of a session expire with it, so sessions created or
+// extended after a change of auth.session_timeout get the new timeout.
+type RedisStore struct {
+	client *redis.Client
+}
+
+// NewRedisStore creates a RedisStore using client.
+func NewRedisStore(client *redis.Client) *RedisStore {
+	return &RedisStore{client: client}
+}
+
+func redisSessionKey(sessionID string) string { return redisKeyPrefix + "session:" + sessionID }
+func redisStateKey(state string) string       { return redisKeyPrefix + "state:" + state }
+func redisResultKey(sessionID string) string  { return redisKeyPrefix + "result:" + sessionID }
+
+// Load implements SessionStore. Sessions in Redis are looked up on demand
+// via Get and GetByState, so nothing is loaded up front.
+func (s *RedisStore) Load() ([]*Session, error) {
+	return nil, nil
+}
+
+// Save implements SessionStore. A session that has already expired is
+// deleted instead.
+func (s *RedisStore) Save(session *Session) error {
+	ttl := time.Until(session.ExpiresAt)
+	if ttl <= 0 {
+		return s.Delete(session)
+	}
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to encode session: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	_, err = s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, redisSessionKey(session.ID), data, ttl)
+		if session.State != "" {
+			pipe.Set(ctx, redisStateKey(session.State), session.ID, ttl)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save session to redis: %w", err)
+	}
+	return nil
+}
+
+// Delete implements SessionStore. The result claim is kept until it
+// expires, so a late MarkResultWritten from another instance still fails.
+func (s *RedisStore) Delete(session *Session) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	keys := []string{redisSessionKey(session.ID)}
+	if session.State != "" {
+		keys = append(keys, redisStateKey(session.State))
+	}
+	if err := s.client.Del(ctx, keys...).Err(); err != nil {
+		return fmt.Errorf("failed to delete session from redis: %w", err)
+	}
+	return nil
+}
+
+// Get implements SharedStore.
+func (s *RedisStore) Get(sessionID string) (*Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	data, err := s.client.Get(ctx, redisSessionKey(sessionID)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session from redis: %w", err)
+	}
+
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("failed to decode session from redis: %w", err)
+	}
+	return &session, nil
+}
+
+// GetByState implements SharedStore.
+func (s *RedisStore) GetByState(state string) (*Session, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	sessionID, err := s.client.Get(ctx, redisStateKey(state)).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session state from redis: %w", err)
+	}
+	return s.Get(sessionID)
+}
+
+// MarkResultWritten implements SharedStore using SET NX, so exactly one
+// instance claims each session's result. The claim is kept for the
+// session's lifetime past its expiry, so an instance that cleans up its copy
+// of the expired session late still finds it.
+func (s *RedisStore) MarkResultWritten(session *Session) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	ttl := max(time.Until(session.ExpiresAt)+session.ExpiresAt.Sub(session.CreatedAt), time.Second)
+	claimed, err := s.client.SetNX(ctx, redisResultKey(session.ID), "1", ttl).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to claim session result in redis: %w", err)
+	}
+	return claimed, nil
+}
+
+// Close closes the Redis client.
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
@@ -18,6 +18,10 @@ type Session struct {
 	// CodeVerifier is the PKCE code verifier (stored to verify the code later)
 	CodeVerifier string
 
+	// Nonce is the OIDC nonce the ID token must carry (stored to verify the
+	// token later)
+	Nonce string
+
 	// Username is the username from the OpenVPN auth request
 	Username string
 
@@ -42,9 +46,33 @@ type Session struct {
 	// Write error message before writing "0" to auth_control_file
 	AuthFailedReasonFile string
 
+	// PendingAuthMethod is the method written to auth_pending_file
+	// (e.g. "webauth" or "openurl")
+	PendingAuthMethod string
+
+	// Provider is the name of the OIDC provider handling this session
+	// (the callback exchanges the code against the same issuer)
+	Provider string
+
+	// Instance is the OpenVPN server instance the client connected to,
+	// for per-instance required roles (oidc.instance_required_roles)
+	Instance string
+
 	// AuthURL is the OIDC authorization URL (for reference)
 	AuthURL string
 
+	// UserCode is the one-time code shown to crtext clients; the user
+	// enters it at /code to continue to AuthURL. Cleared once redeemed.
+	UserCode string
+
+	// CorrelationCode is a short code shown both by the VPN client and on
+	// the browser pages so the user can match them up (auth.correlation_code)
+	CorrelationCode string
+
+	// CorrelationID is the ID of the auth request that created the session,
+	// logged with every message about it (see ipc.AuthRequest)
+	CorrelationID string
+
 	// CreatedAt is when this session was created
 	CreatedAt time.Time
 
@@ -55,4 +83,24 @@ type Session struct {
 	// This is used to ensure we don't write multiple results for the same session
 	// and to identify expired sessions that need failure results written
 	ResultWritten bool
+
+	// Result is the decision written to auth_control_file (StatusSuccess or
+	// StatusFailure), or empty if unknown
+	Result string
+}
+
+// sameAttempt reports whether the session belongs to the connection attempt
+// with untrustedPort and authControlFile. OpenVPN uses a new port and new
+// files for every connection, so a repeated request of one attempt matches
+// but a reconnect does not. Empty values match no session.
+func (s *Session) sameAttempt(untrustedPort, authControlFile string) bool {
+	return authControlFile != "" &&
+		s.UntrustedPort == untrustedPort && s.AuthControlFile == authControlFile
 }
+
+// Session statuses reported by Manager.Status.
+const (
+	StatusPending = "pending"
+	StatusSuccess = "success"
+	StatusFailure = "failure"
+)
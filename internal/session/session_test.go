@@ -1,12 +1,24 @@
 package session
 
 import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/al-bashkir/openvpn-keycloak-auth/internal/openvpn"
 )
 
 func TestNewManager(t *testing.T) {
-	mgr := NewManager(5 * time.Minute)
+	mgr := NewManager(5*time.Minute, 0)
 	defer mgr.Stop()
 
 	if mgr == nil {
@@ -19,7 +31,7 @@ func TestNewManager(t *testing.T) {
 }
 
 func TestCreateSession(t *testing.T) {
-	mgr := NewManager(5 * time.Minute)
+	mgr := NewManager(5*time.Minute, 0)
 	defer mgr.Stop()
 
 	session, err := mgr.Create(
@@ -57,8 +69,32 @@ func TestCreateSession(t *testing.T) {
 	}
 }
 
+func TestSetTimeout(t *testing.T) {
+	mgr := NewManager(5*time.Minute, 0)
+	defer mgr.Stop()
+
+	before, err := mgr.Create("user1", "", "192.0.2.1", "1", "/tmp/acf", "/tmp/apf", "/tmp/arf")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	mgr.SetTimeout(1 * time.Minute)
+
+	after, err := mgr.Create("user2", "", "192.0.2.2", "2", "/tmp/acf", "/tmp/apf", "/tmp/arf")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	if got := before.ExpiresAt.Sub(before.CreatedAt); got != 5*time.Minute {
+		t.Errorf("existing session timeout = %v, want 5m", got)
+	}
+	if got := after.ExpiresAt.Sub(after.CreatedAt); got != 1*time.Minute {
+		t.Errorf("new session timeout = %v, want 1m", got)
+	}
+}
+
 func TestGetSession(t *testing.T) {
-	mgr := NewManager(5 * time.Minute)
+	mgr := NewManager(5*time.Minute, 0)
 	defer mgr.Stop()
 
 	created, err := mgr.Create("testuser", "cn", "192.0.2.1", "12345", "/tmp/acf", "/tmp/apf", "/tmp/arf")
@@ -84,7 +120,7 @@ func TestGetSession(t *testing.T) {
 }
 
 func TestUpdateOIDCFlow(t *testing.T) {
-	mgr := NewManager(5 * time.Minute)
+	mgr := NewManager(5*time.Minute, 0)
 	defer mgr.Stop()
 
 	session, err := mgr.Create("testuser", "cn", "192.0.2.1", "12345", "/tmp/acf", "/tmp/apf", "/tmp/arf")
@@ -93,7 +129,7 @@ func TestUpdateOIDCFlow(t *testing.T) {
 	}
 
 	// Update with OIDC flow data
-	err = mgr.UpdateOIDCFlow(session.ID, "state123", "verifier456", "https://example.com/auth")
+	err = mgr.UpdateOIDCFlow(session.ID, "state123", "verifier456", "nonce", "https://example.com/auth")
 	if err != nil {
 		t.Fatalf("UpdateOIDCFlow failed: %v", err)
 	}
@@ -112,13 +148,17 @@ func TestUpdateOIDCFlow(t *testing.T) {
 		t.Errorf("CodeVerifier = %s, want verifier456", retrieved.CodeVerifier)
 	}
 
+	if retrieved.Nonce != "nonce" {
+		t.Errorf("Nonce = %s, want nonce", retrieved.Nonce)
+	}
+
 	if retrieved.AuthURL != "https://example.com/auth" {
 		t.Errorf("AuthURL = %s, want https://example.com/auth", retrieved.AuthURL)
 	}
 }
 
 func TestGetByState(t *testing.T) {
-	mgr := NewManager(5 * time.Minute)
+	mgr := NewManager(5*time.Minute, 0)
 	defer mgr.Stop()
 
 	session, err := mgr.Create("testuser", "cn", "192.0.2.1", "12345", "/tmp/acf", "/tmp/apf", "/tmp/arf")
@@ -126,7 +166,7 @@ func TestGetByState(t *testing.T) {
 		t.Fatalf("Create failed: %v", err)
 	}
 
-	err = mgr.UpdateOIDCFlow(session.ID, "state123", "verifier456", "https://example.com/auth")
+	err = mgr.UpdateOIDCFlow(session.ID, "state123", "verifier456", "nonce", "https://example.com/auth")
 	if err != nil {
 		t.Fatalf("UpdateOIDCFlow failed: %v", err)
 	}
@@ -146,10 +186,114 @@ func TestGetByState(t *testing.T) {
 	if err == nil {
 		t.Error("GetByState should fail for non-existent state")
 	}
+
+	if id, ok := mgr.LocalIDByState("state123"); !ok || id != session.ID {
+		t.Errorf("LocalIDByState = (%q, %v), want (%q, true)", id, ok, session.ID)
+	}
+	if _, ok := mgr.LocalIDByState("nonexistent"); ok {
+		t.Error("LocalIDByState should fail for non-existent state")
+	}
+}
+
+func TestRedeemUserCode(t *testing.T) {
+	mgr := NewManager(5*time.Minute, 0)
+	defer mgr.Stop()
+
+	session, err := mgr.Create("testuser", "cn", "192.0.2.1", "12345", "/tmp/acf", "/tmp/apf", "/tmp/arf")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	code, err := mgr.AssignUserCode(session.ID)
+	if err != nil {
+		t.Fatalf("AssignUserCode failed: %v", err)
+	}
+	if len(code) != 9 || code[4] != '-' {
+		t.Fatalf("code = %q, want XXXX-XXXX", code)
+	}
+
+	// Entered codes are normalized
+	retrieved, err := mgr.RedeemUserCode(" " + strings.ToLower(code) + " ")
+	if err != nil {
+		t.Fatalf("RedeemUserCode failed: %v", err)
+	}
+	if retrieved.ID != session.ID {
+		t.Errorf("retrieved session ID = %s, want %s", retrieved.ID, session.ID)
+	}
+
+	// Codes are single use
+	if _, err := mgr.RedeemUserCode(code); err == nil {
+		t.Error("RedeemUserCode should fail for an already redeemed code")
+	}
+
+	if _, err := mgr.AssignUserCode("nonexistent"); err == nil {
+		t.Error("AssignUserCode should fail for non-existent session")
+	}
+
+	// Deleting the session invalidates its code
+	code, err = mgr.AssignUserCode(session.ID)
+	if err != nil {
+		t.Fatalf("AssignUserCode failed: %v", err)
+	}
+	mgr.Delete(session.ID)
+	if _, err := mgr.RedeemUserCode(code); err == nil {
+		t.Error("RedeemUserCode should fail after delete")
+	}
+}
+
+func TestAssignCorrelationCode(t *testing.T) {
+	mgr := NewManager(5*time.Minute, 0)
+	defer mgr.Stop()
+
+	session, err := mgr.Create("testuser", "cn", "192.0.2.1", "12345", "/tmp/acf", "/tmp/apf", "/tmp/arf")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	code, err := mgr.AssignCorrelationCode(session.ID)
+	if err != nil {
+		t.Fatalf("AssignCorrelationCode failed: %v", err)
+	}
+	if len(code) != correlationCodeLength {
+		t.Errorf("code = %q, want %d letters", code, correlationCodeLength)
+	}
+	for _, c := range code {
+		if !strings.ContainsRune(correlationCodeAlphabet, c) {
+			t.Errorf("code %q contains %q, not in alphabet", code, c)
+		}
+	}
+
+	retrieved, err := mgr.Get(session.ID)
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if retrieved.CorrelationCode != code {
+		t.Errorf("stored CorrelationCode = %q, want %q", retrieved.CorrelationCode, code)
+	}
+
+	if _, err := mgr.AssignCorrelationCode("nonexistent"); err == nil {
+		t.Error("AssignCorrelationCode should fail for non-existent session")
+	}
+}
+
+func TestNormalizeUserCode(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{in: "ABCD-EFGH", want: "ABCDEFGH"},
+		{in: "abcd efgh", want: "ABCDEFGH"},
+		{in: " abcdefgh\n", want: "ABCDEFGH"},
+	}
+	for _, tt := range tests {
+		if got := NormalizeUserCode(tt.in); got != tt.want {
+			t.Errorf("NormalizeUserCode(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
 }
 
 func TestDeleteSession(t *testing.T) {
-	mgr := NewManager(5 * time.Minute)
+	mgr := NewManager(5*time.Minute, 0)
 	defer mgr.Stop()
 
 	session, err := mgr.Create("testuser", "cn", "192.0.2.1", "12345", "/tmp/acf", "/tmp/apf", "/tmp/arf")
@@ -157,7 +301,7 @@ func TestDeleteSession(t *testing.T) {
 		t.Fatalf("Create failed: %v", err)
 	}
 
-	err = mgr.UpdateOIDCFlow(session.ID, "state123", "verifier456", "https://example.com/auth")
+	err = mgr.UpdateOIDCFlow(session.ID, "state123", "verifier456", "nonce", "https://example.com/auth")
 	if err != nil {
 		t.Fatalf("UpdateOIDCFlow failed: %v", err)
 	}
@@ -189,8 +333,465 @@ func TestDeleteSession(t *testing.T) {
 	mgr.Delete("nonexistent")
 }
 
+func TestListAndKill(t *testing.T) {
+	mgr := NewManager(5*time.Minute, 0)
+	defer mgr.Stop()
+
+	dir := t.TempDir()
+	create := func(username, name string) *Session {
+		session, err := mgr.Create(username, "cn", "192.0.2.1", "12345", filepath.Join(dir, name+"_acf"),
+			filepath.Join(dir, name+"_apf"), filepath.Join(dir, name+"_arf"))
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		return session
+	}
+
+	first := create("alice", "first")
+	second := create("bob", "second")
+
+	sessions := mgr.List()
+	if len(sessions) != 2 || sessions[0].ID != first.ID || sessions[1].ID != second.ID {
+		t.Fatalf("List() = %v, want sessions oldest first", sessions)
+	}
+
+	killed, failed, err := mgr.Kill(first.ID, "Login cancelled")
+	if err != nil {
+		t.Fatalf("Kill failed: %v", err)
+	}
+	if !failed || killed.Result != StatusFailure {
+		t.Errorf("Kill() failed = %v, result = %q, want true, %q", failed, killed.Result, StatusFailure)
+	}
+	if data, _ := os.ReadFile(first.AuthControlFile); string(data) != "0" {
+		t.Errorf("auth_control_file = %q, want \"0\"", data)
+	}
+	if data, _ := os.ReadFile(first.AuthFailedReasonFile); string(data) != "Login cancelled" {
+		t.Errorf("auth_failed_reason_file = %q, want \"Login cancelled\"", data)
+	}
+	if mgr.Count() != 1 {
+		t.Errorf("expected 1 session after kill, got %d", mgr.Count())
+	}
+
+	// A session whose result was already written is removed without
+	// overwriting the result
+	mgr.SetResult(second.ID, true)
+	if _, failed, err := mgr.Kill(second.ID, "Login cancelled"); err != nil || failed {
+		t.Errorf("Kill() of completed session = %v, %v, want false, nil", failed, err)
+	}
+	if data, _ := os.ReadFile(second.AuthControlFile); len(data) != 0 {
+		t.Errorf("auth_control_file = %q, want untouched", data)
+	}
+
+	if _, _, err := mgr.Kill("nonexistent", "Login cancelled"); err == nil {
+		t.Error("Kill should fail for unknown session")
+	}
+	if sessions := mgr.List(); len(sessions) != 0 {
+		t.Errorf("List() = %v, want empty", sessions)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	mgr := NewManager(100*time.Millisecond, time.Minute)
+	defer mgr.Stop()
+
+	var timedOut []string
+	mgr.OnFailure(func(sess *Session, _ string) {
+		timedOut = append(timedOut, sess.ID)
+	})
+
+	dir := t.TempDir()
+	create := func(username, commonName, ip, name string) *Session {
+		session, err := mgr.Create(username, commonName, ip, "12345", filepath.Join(dir, name+"_acf"),
+			filepath.Join(dir, name+"_apf"), filepath.Join(dir, name+"_arf"))
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+		return session
+	}
+
+	stale := create("alice", "laptop", "192.0.2.1", "stale")
+	done := create("alice", "laptop", "192.0.2.1", "done")
+	mgr.MarkResultWritten(done.ID)
+	otherDevice := create("alice", "phone", "192.0.2.1", "phone")
+	otherIP := create("alice", "laptop", "198.51.100.7", "roamed")
+	otherUser := create("bob", "laptop", "192.0.2.1", "bob")
+
+	// The session of the requesting attempt itself is kept
+	current := create("alice", "laptop", "192.0.2.1", "current")
+	cancelled := mgr.Cancel("alice", "laptop", "192.0.2.1", current.UntrustedPort, current.AuthControlFile)
+	if len(cancelled) != 1 || cancelled[0].ID != stale.ID {
+		t.Fatalf("Cancel() = %v, want only the pending session of the client", cancelled)
+	}
+	if _, err := mgr.Get(stale.ID); err == nil {
+		t.Error("cancelled session should be deleted")
+	}
+	for _, s := range []*Session{current, done, otherDevice, otherIP, otherUser} {
+		if _, err := mgr.Get(s.ID); err != nil {
+			t.Errorf("session %s of another client deleted: %v", s.ID, err)
+		}
+	}
+	if cancelled := mgr.Cancel("alice", "laptop", "192.0.2.1", current.UntrustedPort, current.AuthControlFile); len(cancelled) != 0 {
+		t.Errorf("second Cancel() = %v, want none", cancelled)
+	}
+	if cancelled := mgr.Cancel("alice", "laptop", "192.0.2.1", "", ""); len(cancelled) != 1 || cancelled[0].ID != current.ID {
+		t.Errorf("Cancel() without an attempt = %v, want the remaining session", cancelled)
+	}
+
+	// A cancelled session is neither written nor timed out later
+	if ok := mgr.MarkResultWritten(stale.ID); ok {
+		t.Error("MarkResultWritten should fail for a cancelled session")
+	}
+	time.Sleep(150 * time.Millisecond)
+	mgr.cleanup()
+	if slices.Contains(timedOut, stale.ID) {
+		t.Error("cancelled session must not time out")
+	}
+	if _, err := os.Stat(stale.AuthControlFile); !os.IsNotExist(err) {
+		t.Errorf("auth_control_file of cancelled session written (stat error %v)", err)
+	}
+}
+
+func TestCreateOrReuse(t *testing.T) {
+	mgr := NewManager(5*time.Minute, 0)
+	defer mgr.Stop()
+
+	template := func(commonName, port, state string) *Session {
+		return &Session{
+			Username:        "alice",
+			CommonName:      commonName,
+			UntrustedIP:     "192.0.2.1",
+			UntrustedPort:   port,
+			AuthControlFile: "/tmp/acf-" + port,
+			Provider:        "default",
+			State:           state,
+			AuthURL:         "https://idp/auth?state=" + state,
+		}
+	}
+
+	first, reused, err := mgr.CreateOrReuse(template("laptop", "1000", "state-1"))
+	if err != nil || reused {
+		t.Fatalf("CreateOrReuse() = %v, %v, want a new session", reused, err)
+	}
+	if first.ID == "" || first.ExpiresAt.IsZero() || first.Provider != "default" {
+		t.Errorf("new session = %+v, want ID, expiry and template fields set", first)
+	}
+	if got, err := mgr.GetByState("state-1"); err != nil || got.ID != first.ID {
+		t.Errorf("GetByState() = %v, %v, want the new session", got, err)
+	}
+
+	// A repeated request of the same attempt gets the pending session back,
+	// with its expiry extended
+	expiresAt := first.ExpiresAt
+	time.Sleep(10 * time.Millisecond)
+	again, reused, err := mgr.CreateOrReuse(template("laptop", "1000", "state-2"))
+	if err != nil || !reused || again.ID != first.ID {
+		t.Fatalf("CreateOrReuse() = %v, %v, %v, want the pending session reused", again, reused, err)
+	}
+	if again.State != "state-1" || !again.ExpiresAt.After(expiresAt) {
+		t.Errorf("reused session = %+v, want the original state and a later expiry than %v", again, expiresAt)
+	}
+	if _, err := mgr.GetByState("state-2"); err == nil {
+		t.Error("the discarded flow's state must not be indexed")
+	}
+
+	// A reconnect (new port and files), other devices and finished sessions
+	// are not reused
+	reconnect, reused, err := mgr.CreateOrReuse(template("laptop", "2000", "state-3"))
+	if err != nil || reused || reconnect.ID == first.ID {
+		t.Errorf("CreateOrReuse() for a reconnect = %v, %v, want a new session", reused, err)
+	}
+	other, reused, err := mgr.CreateOrReuse(template("phone", "3000", "state-4"))
+	if err != nil || reused || other.ID == first.ID {
+		t.Errorf("CreateOrReuse() for another device = %v, %v, want a new session", reused, err)
+	}
+	mgr.MarkResultWritten(first.ID)
+	if next, reused, err := mgr.CreateOrReuse(template("laptop", "1000", "state-5")); err != nil || reused || next.ID == first.ID {
+		t.Errorf("CreateOrReuse() after a result = %v, %v, want a new session", reused, err)
+	}
+	if mgr.Count() != 4 {
+		t.Errorf("expected 4 sessions, got %d", mgr.Count())
+	}
+}
+
+// TestCreateOrReuseConcurrentReads reuses a session while other goroutines
+// read the one they looked up; run with -race.
+func TestCreateOrReuseConcurrentReads(t *testing.T) {
+	mgr := NewManager(5*time.Minute, 0)
+	defer mgr.Stop()
+
+	template := &Session{
+		Username:        "alice",
+		CommonName:      "laptop",
+		UntrustedIP:     "192.0.2.1",
+		UntrustedPort:   "1000",
+		AuthControlFile: "/tmp/acf-1000",
+		State:           "state-1",
+	}
+	first, _, err := mgr.CreateOrReuse(template)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reuse the session until the readers are done
+	done := make(chan struct{})
+	reuseErr := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-done:
+				reuseErr <- nil
+				return
+			default:
+			}
+			if s, reused, err := mgr.CreateOrReuse(template); err != nil || !reused || s.ID != first.ID {
+				reuseErr <- fmt.Errorf("CreateOrReuse() = %v, %v, %v, want the pending session reused", s, reused, err)
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 10000 {
+				if s, err := mgr.GetByState("state-1"); err != nil || s.ExpiresAt.IsZero() {
+					t.Errorf("GetByState() = %v, %v", s, err)
+					return
+				}
+				if s, err := mgr.Get(first.ID); err != nil || s.ExpiresAt.IsZero() {
+					t.Errorf("Get() = %v, %v", s, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	if err := <-reuseErr; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMaxSessionsPerUser(t *testing.T) {
+	mgr := NewManager(100*time.Millisecond, time.Minute)
+	defer mgr.Stop()
+	mgr.SetMaxSessionsPerUser(2)
+
+	dir := t.TempDir()
+	create := func(username string) (*Session, error) {
+		return mgr.Create(username, "cn", "192.0.2.1", "12345",
+			filepath.Join(dir, "acf"), filepath.Join(dir, "apf"), filepath.Join(dir, "arf"))
+	}
+
+	first, err := create("testuser")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if _, err := create("testuser"); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	// Over the cap
+	if _, err := create("testuser"); !errors.Is(err, ErrTooManySessions) {
+		t.Fatalf("Create over limit error = %v, want ErrTooManySessions", err)
+	}
+	if mgr.Count() != 2 {
+		t.Errorf("expected 2 sessions, got %d", mgr.Count())
+	}
+
+	// Other users are not affected
+	if _, err := create("otheruser"); err != nil {
+		t.Fatalf("Create for other user failed: %v", err)
+	}
+
+	// Delete frees a slot and removes the session from the user index
+	mgr.Delete(first.ID)
+	if n := len(mgr.userIndex["testuser"]); n != 1 {
+		t.Errorf("userIndex[testuser] has %d sessions after Delete, want 1", n)
+	}
+	if _, err := create("testuser"); err != nil {
+		t.Fatalf("Create after Delete failed: %v", err)
+	}
+
+	// Expired sessions don't count, even before cleanup removes them
+	time.Sleep(150 * time.Millisecond)
+	if _, err := create("testuser"); err != nil {
+		t.Fatalf("Create after expiry failed: %v", err)
+	}
+
+	mgr.cleanup()
+	if _, ok := mgr.userIndex["otheruser"]; ok {
+		t.Error("userIndex[otheruser] should be removed by cleanup")
+	}
+	if n := len(mgr.userIndex["testuser"]); n != 1 {
+		t.Errorf("userIndex[testuser] has %d sessions after cleanup, want 1", n)
+	}
+
+	// 0 disables the limit
+	mgr.SetMaxSessionsPerUser(0)
+	for i := 0; i < 5; i++ {
+		if _, err := create("testuser"); err != nil {
+			t.Fatalf("Create without limit failed: %v", err)
+		}
+	}
+}
+
+func TestSingleIPPerUser(t *testing.T) {
+	mgr := NewManager(5*time.Minute, 0)
+	defer mgr.Stop()
+	mgr.SetSingleIPPerUser(true, 0)
+
+	dir := t.TempDir()
+	create := func(username, ip, name string) (*Session, error) {
+		return mgr.Create(username, "cn", ip, "12345", filepath.Join(dir, name+"_acf"),
+			filepath.Join(dir, name+"_apf"), filepath.Join(dir, name+"_arf"))
+	}
+
+	first, err := create("testuser", "192.0.2.1", "first")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	// Same IP is allowed
+	if _, err := create("testuser", "192.0.2.1", "same"); err != nil {
+		t.Fatalf("Create from same IP failed: %v", err)
+	}
+
+	// Different IP is denied
+	if _, err := create("testuser", "198.51.100.7", "other"); !errors.Is(err, ErrOtherIPSession) {
+		t.Fatalf("Create from other IP error = %v, want ErrOtherIPSession", err)
+	}
+
+	// Other users are not affected
+	if _, err := create("otheruser", "198.51.100.7", "otheruser"); err != nil {
+		t.Fatalf("Create for other user failed: %v", err)
+	}
+
+	// Completed sessions don't block
+	mgr.SetResult(first.ID, true)
+	mgr.Delete(first.ID)
+	mgr.SetSingleIPPerUser(false, 0)
+	if _, err := create("testuser", "198.51.100.7", "disabled"); err != nil {
+		t.Fatalf("Create with policy disabled failed: %v", err)
+	}
+}
+
+func TestSingleIPPerUserGracePeriod(t *testing.T) {
+	mgr := NewManager(5*time.Minute, 0)
+	defer mgr.Stop()
+	mgr.SetSingleIPPerUser(true, 50*time.Millisecond)
+
+	var failures []string
+	mgr.OnFailure(func(sess *Session, reason string) {
+		failures = append(failures, sess.ID+": "+reason)
+	})
+
+	dir := t.TempDir()
+	old, err := mgr.Create("testuser", "cn", "192.0.2.1", "12345", filepath.Join(dir, "acf"),
+		filepath.Join(dir, "apf"), filepath.Join(dir, "arf"))
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	// Within the grace period the pending login still blocks
+	if _, err := mgr.Create("testuser", "cn", "198.51.100.7", "12345", "", "", ""); !errors.Is(err, ErrOtherIPSession) {
+		t.Fatalf("Create within grace period error = %v, want ErrOtherIPSession", err)
+	}
+
+	// After it, the roaming client's new login supersedes the old one
+	time.Sleep(60 * time.Millisecond)
+	roamed, err := mgr.Create("testuser", "cn", "198.51.100.7", "12345", "", "", "")
+	if err != nil {
+		t.Fatalf("Create after grace period failed: %v", err)
+	}
+	if _, err := mgr.Get(old.ID); err == nil {
+		t.Error("superseded session should be removed")
+	}
+	if _, err := mgr.Get(roamed.ID); err != nil {
+		t.Errorf("new session not found: %v", err)
+	}
+	if status, _ := mgr.Status(old.ID); status != StatusFailure {
+		t.Errorf("superseded session status = %q, want %q", status, StatusFailure)
+	}
+	if want := []string{old.ID + ": " + SupersededReason}; !slices.Equal(failures, want) {
+		t.Errorf("OnFailure calls = %q, want %q", failures, want)
+	}
+
+	control, err := os.ReadFile(old.AuthControlFile)
+	if err != nil || string(control) != "0" {
+		t.Errorf("auth_control_file = %q (err %v), want \"0\"", control, err)
+	}
+	reason, err := os.ReadFile(old.AuthFailedReasonFile)
+	if err != nil || string(reason) != SupersededReason {
+		t.Errorf("auth_failed_reason_file = %q (err %v), want %q", reason, err, SupersededReason)
+	}
+}
+
+// failureWriter is an openvpn.Writer whose auth failures are written by
+// write; the other files are written as usual.
+type failureWriter struct {
+	openvpn.FileWriter
+	write func(authControlFile, authFailedReasonFile, reason string) error
+}
+
+func (w failureWriter) WriteAuthFailure(authControlFile, authFailedReasonFile, reason string) error {
+	return w.write(authControlFile, authFailedReasonFile, reason)
+}
+
+func TestSupersedeSlowWriteDoesNotBlock(t *testing.T) {
+	mgr := NewManager(5*time.Minute, 0)
+	defer mgr.Stop()
+	mgr.SetSingleIPPerUser(true, time.Nanosecond)
+
+	// The superseded session's failure write blocks until released
+	writing := make(chan struct{})
+	release := make(chan struct{})
+	mgr.SetWriter(failureWriter{write: func(authControlFile, authFailedReasonFile, reason string) error {
+		if reason != SupersededReason {
+			t.Errorf("reason = %q, want %q", reason, SupersededReason)
+		}
+		close(writing)
+		<-release
+		return nil
+	}})
+
+	old, err := mgr.Create("testuser", "cn", "192.0.2.1", "12345", "/tmp/acf", "/tmp/apf", "/tmp/arf")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+
+	roamed := make(chan error, 1)
+	go func() {
+		_, err := mgr.Create("testuser", "cn", "198.51.100.7", "12345", "", "", "")
+		roamed <- err
+	}()
+	<-writing
+
+	counted := make(chan int, 1)
+	go func() { counted <- mgr.Count() }()
+	select {
+	case n := <-counted:
+		if n != 1 {
+			t.Errorf("Count() = %d, want 1", n)
+		}
+	case <-time.After(time.Second):
+		t.Error("Count blocked by a slow supersede write")
+	}
+	if mgr.MarkResultWritten(old.ID) {
+		t.Error("MarkResultWritten succeeded for a superseded session")
+	}
+
+	close(release)
+	if err := <-roamed; err != nil {
+		t.Errorf("Create after grace period failed: %v", err)
+	}
+}
+
 func TestMarkResultWritten(t *testing.T) {
-	mgr := NewManager(5 * time.Minute)
+	mgr := NewManager(5*time.Minute, 0)
 	defer mgr.Stop()
 
 	sess, err := mgr.Create("testuser", "cn", "192.0.2.1", "12345", "/tmp/acf", "/tmp/apf", "/tmp/arf")
@@ -221,8 +822,64 @@ func TestMarkResultWritten(t *testing.T) {
 	}
 }
 
+func TestStatus(t *testing.T) {
+	mgr := NewManager(5*time.Minute, 0)
+	defer mgr.Stop()
+
+	wantStatus := func(sessionID, want string) {
+		t.Helper()
+		got, err := mgr.Status(sessionID)
+		if err != nil {
+			t.Fatalf("Status(%s) failed: %v", sessionID, err)
+		}
+		if got != want {
+			t.Errorf("Status(%s) = %q, want %q", sessionID, got, want)
+		}
+	}
+
+	ok, err := mgr.Create("alice", "cn", "192.0.2.1", "12345", "/tmp/acf", "/tmp/apf", "/tmp/arf")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	denied, err := mgr.Create("bob", "cn", "192.0.2.2", "12345", "/tmp/acf", "/tmp/apf", "/tmp/arf")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	wantStatus(ok.ID, StatusPending)
+
+	if !mgr.SetResult(ok.ID, true) {
+		t.Fatal("expected SetResult to return true")
+	}
+	if mgr.SetResult(ok.ID, false) {
+		t.Fatal("expected SetResult to return false once a result is written")
+	}
+	mgr.SetResult(denied.ID, false)
+	wantStatus(ok.ID, StatusSuccess)
+
+	// Results outlive the deleted sessions
+	mgr.Delete(ok.ID)
+	mgr.Delete(denied.ID)
+	wantStatus(ok.ID, StatusSuccess)
+	wantStatus(denied.ID, StatusFailure)
+
+	if _, err := mgr.Status("nonexistent"); err == nil {
+		t.Error("expected error for unknown session")
+	}
+
+	// A session deleted without a result is forgotten
+	abandoned, err := mgr.Create("carol", "cn", "192.0.2.3", "12345", "/tmp/acf", "/tmp/apf", "/tmp/arf")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	mgr.Delete(abandoned.ID)
+	if _, err := mgr.Status(abandoned.ID); err == nil {
+		t.Error("expected error for session deleted without a result")
+	}
+}
+
 func TestResultWritten(t *testing.T) {
-	mgr := NewManager(5 * time.Minute)
+	mgr := NewManager(5*time.Minute, 0)
 	defer mgr.Stop()
 
 	sess, err := mgr.Create("testuser", "cn", "192.0.2.1", "12345", "/tmp/acf", "/tmp/apf", "/tmp/arf")
@@ -249,7 +906,7 @@ func TestResultWritten(t *testing.T) {
 }
 
 func TestSessionExpiry(t *testing.T) {
-	mgr := NewManager(100 * time.Millisecond)
+	mgr := NewManager(100*time.Millisecond, time.Minute)
 	defer mgr.Stop()
 
 	session, err := mgr.Create("testuser", "cn", "192.0.2.1", "12345", "/tmp/acf", "/tmp/apf", "/tmp/arf")
@@ -274,7 +931,7 @@ func TestSessionExpiry(t *testing.T) {
 }
 
 func TestCleanup(t *testing.T) {
-	mgr := NewManager(100 * time.Millisecond)
+	mgr := NewManager(100*time.Millisecond, time.Minute)
 	defer mgr.Stop()
 
 	// Create multiple sessions
@@ -300,8 +957,304 @@ func TestCleanup(t *testing.T) {
 	}
 }
 
+func TestCleanupOnTimeout(t *testing.T) {
+	mgr := NewManager(100*time.Millisecond, time.Minute)
+	defer mgr.Stop()
+
+	var timedOut []string
+	mgr.OnFailure(func(sess *Session, reason string) {
+		if reason != TimeoutReason {
+			t.Errorf("reason = %q, want %q", reason, TimeoutReason)
+		}
+		timedOut = append(timedOut, sess.PendingAuthMethod)
+	})
+
+	dir := t.TempDir()
+	pending, err := mgr.Create("testuser", "cn", "192.0.2.1", "12345",
+		filepath.Join(dir, "acf1"), filepath.Join(dir, "apf1"), filepath.Join(dir, "arf1"))
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if err := mgr.SetPendingAuthMethod(pending.ID, "webauth"); err != nil {
+		t.Fatalf("SetPendingAuthMethod failed: %v", err)
+	}
+
+	done, err := mgr.Create("testuser", "cn", "192.0.2.1", "12345",
+		filepath.Join(dir, "acf2"), filepath.Join(dir, "apf2"), filepath.Join(dir, "arf2"))
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	mgr.MarkResultWritten(done.ID)
+
+	time.Sleep(150 * time.Millisecond)
+	mgr.cleanup()
+
+	// Only the session without a result counts as a timeout
+	if len(timedOut) != 1 || timedOut[0] != "webauth" {
+		t.Errorf("timed out sessions = %v, want [webauth]", timedOut)
+	}
+
+	if status, err := mgr.Status(pending.ID); err != nil || status != StatusFailure {
+		t.Errorf("Status of timed out session = %q (err %v), want %q", status, err, StatusFailure)
+	}
+
+	// Remembered results are pruned once they expire
+	time.Sleep(150 * time.Millisecond)
+	mgr.cleanup()
+	if _, err := mgr.Status(pending.ID); err == nil {
+		t.Error("expected expired result to be pruned")
+	}
+}
+
+func TestCleanupSlowWriteDoesNotBlock(t *testing.T) {
+	mgr := NewManager(100*time.Millisecond, time.Minute)
+	defer mgr.Stop()
+
+	// The timeout failure write blocks until released
+	writing := make(chan struct{})
+	release := make(chan struct{})
+	mgr.SetWriter(failureWriter{write: func(authControlFile, authFailedReasonFile, reason string) error {
+		close(writing)
+		<-release
+		return nil
+	}})
+
+	dir := t.TempDir()
+	expired, err := mgr.Create("testuser", "cn", "192.0.2.1", "12345",
+		filepath.Join(dir, "acf1"), filepath.Join(dir, "apf1"), filepath.Join(dir, "arf1"))
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	time.Sleep(150 * time.Millisecond)
+
+	cleaned := make(chan struct{})
+	go func() {
+		mgr.cleanup()
+		close(cleaned)
+	}()
+	<-writing
+
+	created := make(chan error, 1)
+	go func() {
+		_, err := mgr.Create("otheruser", "cn", "192.0.2.2", "12345",
+			filepath.Join(dir, "acf2"), filepath.Join(dir, "apf2"), filepath.Join(dir, "arf2"))
+		created <- err
+	}()
+	select {
+	case err := <-created:
+		if err != nil {
+			t.Errorf("Create failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Create blocked by a slow cleanup write")
+	}
+
+	// The session is gone and its result claimed, so it is not written twice
+	if mgr.MarkResultWritten(expired.ID) {
+		t.Error("MarkResultWritten succeeded for a session cleanup is writing")
+	}
+
+	close(release)
+	<-cleaned
+	if status, err := mgr.Status(expired.ID); err != nil || status != StatusFailure {
+		t.Errorf("Status of timed out session = %q (err %v), want %q", status, err, StatusFailure)
+	}
+}
+
+// blockingStore is a SharedStore whose Save and MarkResultWritten report
+// their call on calls and then block until release is closed.
+type blockingStore struct {
+	calls   chan string
+	release chan struct{}
+}
+
+func (s *blockingStore) Load() ([]*Session, error)           { return nil, nil }
+func (s *blockingStore) Delete(*Session) error               { return nil }
+func (s *blockingStore) Get(string) (*Session, error)        { return nil, nil }
+func (s *blockingStore) GetByState(string) (*Session, error) { return nil, nil }
+
+func (s *blockingStore) Save(*Session) error {
+	s.calls <- "save"
+	<-s.release
+	return nil
+}
+
+func (s *blockingStore) MarkResultWritten(*Session) (bool, error) {
+	s.calls <- "claim"
+	<-s.release
+	return true, nil
+}
+
+func TestSelfTestSkipsStore(t *testing.T) {
+	mgr := NewManager(5*time.Minute, 0)
+	defer mgr.Stop()
+	mgr.SetMaxSessionsPerUser(1)
+	store := &blockingStore{calls: make(chan string, 10), release: make(chan struct{})}
+	if _, err := mgr.SetStore(store); err != nil {
+		t.Fatalf("SetStore failed: %v", err)
+	}
+
+	// Save would block until release is closed
+	if err := mgr.SelfTest(); err != nil {
+		t.Fatalf("SelfTest failed: %v", err)
+	}
+	select {
+	case call := <-store.calls:
+		t.Errorf("SelfTest called the store (%s)", call)
+	default:
+	}
+	if got := mgr.Count(); got != 0 {
+		t.Errorf("Count after SelfTest = %d, want 0", got)
+	}
+}
+
+func TestSlowStoreDoesNotBlock(t *testing.T) {
+	mgr := NewManager(5*time.Minute, 0)
+	defer mgr.Stop()
+	store := &blockingStore{calls: make(chan string, 10), release: make(chan struct{})}
+	if _, err := mgr.SetStore(store); err != nil {
+		t.Fatalf("SetStore failed: %v", err)
+	}
+
+	created := make(chan *Session, 1)
+	go func() {
+		sess, err := mgr.Create("testuser", "cn", "192.0.2.1", "12345", "/tmp/acf", "/tmp/apf", "/tmp/arf")
+		if err != nil {
+			t.Errorf("Create failed: %v", err)
+		}
+		created <- sess
+	}()
+	if call := <-store.calls; call != "save" {
+		t.Fatalf("store call = %q, want save", call)
+	}
+
+	// The session is usable while the store is still saving it
+	counted := make(chan int, 1)
+	go func() { counted <- mgr.Count() }()
+	select {
+	case n := <-counted:
+		if n != 1 {
+			t.Errorf("Count() = %d, want 1", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Count blocked by a slow store save")
+	}
+
+	id := mgr.List()[0].ID
+	marked := make(chan bool, 1)
+	go func() { marked <- mgr.MarkResultWritten(id) }()
+	if call := <-store.calls; call != "claim" {
+		t.Fatalf("store call = %q, want claim", call)
+	}
+	statused := make(chan string, 1)
+	go func() {
+		status, _ := mgr.Status(id)
+		statused <- status
+	}()
+	select {
+	case status := <-statused:
+		if status != StatusPending {
+			t.Errorf("Status() = %q, want %q", status, StatusPending)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Status blocked by a slow result claim")
+	}
+
+	close(store.release)
+	<-created
+	if !<-marked {
+		t.Error("MarkResultWritten failed")
+	}
+}
+
+func TestCleanupInterval(t *testing.T) {
+	mgr := NewManager(100*time.Millisecond, 20*time.Millisecond)
+
+	dir := t.TempDir()
+	session, err := mgr.Create("testuser", "cn", "192.0.2.1", "12345",
+		filepath.Join(dir, "acf"), filepath.Join(dir, "apf"), filepath.Join(dir, "arf"))
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	// The cleanup goroutine writes the timeout failure shortly after the
+	// session expires, well before the default minute
+	deadline := time.Now().Add(time.Second)
+	for {
+		if data, _ := os.ReadFile(session.AuthControlFile); string(data) == "0" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout failure not written within 1s of a 100ms session timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Stop ends the cleanup goroutine without waiting for the next tick
+	stopped := make(chan struct{})
+	go func() {
+		mgr.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("Stop did not return")
+	}
+}
+
+func TestSetTimeoutCleanupInterval(t *testing.T) {
+	// Derived from the timeout: a minute for 5m, then 50ms for 100ms
+	mgr := NewManager(5*time.Minute, 0)
+	defer mgr.Stop()
+	mgr.SetTimeout(100 * time.Millisecond)
+
+	dir := t.TempDir()
+	session, err := mgr.Create("testuser", "cn", "192.0.2.1", "12345",
+		filepath.Join(dir, "acf"), filepath.Join(dir, "apf"), filepath.Join(dir, "arf"))
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		if data, _ := os.ReadFile(session.AuthControlFile); string(data) == "0" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timeout failure not written within 1s after lowering the session timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A configured interval is kept
+	fixed := NewManager(5*time.Minute, time.Hour)
+	defer fixed.Stop()
+	if fixed.cleanupAuto {
+		t.Error("configured cleanup interval would be re-derived by SetTimeout")
+	}
+}
+
+func TestDefaultCleanupInterval(t *testing.T) {
+	tests := []struct {
+		timeout time.Duration
+		want    time.Duration
+	}{
+		{timeout: 30 * time.Second, want: 15 * time.Second},
+		{timeout: 5 * time.Minute, want: time.Minute},
+		{timeout: 2 * time.Minute, want: time.Minute},
+		{timeout: 0, want: time.Minute},
+	}
+
+	for _, tt := range tests {
+		if got := DefaultCleanupInterval(tt.timeout); got != tt.want {
+			t.Errorf("DefaultCleanupInterval(%s) = %s, want %s", tt.timeout, got, tt.want)
+		}
+	}
+}
+
 func TestConcurrentAccess(t *testing.T) {
-	mgr := NewManager(5 * time.Minute)
+	mgr := NewManager(5*time.Minute, 0)
 	defer mgr.Stop()
 
 	// Create sessions concurrently
@@ -347,3 +1300,305 @@ func TestGenerateSessionID(t *testing.T) {
 		seen[id] = true
 	}
 }
+
+func TestStats(t *testing.T) {
+	mgr := NewManager(5*time.Minute, 0)
+	defer mgr.Stop()
+
+	// Empty manager
+	if stats := mgr.Stats(); stats != (Stats{}) {
+		t.Errorf("expected zero stats for empty manager, got %+v", stats)
+	}
+
+	now := time.Now()
+	ages := []time.Duration{10 * time.Second, 30 * time.Second, 80 * time.Second}
+
+	for i, age := range ages {
+		sess, err := mgr.Create("testuser", "cn", "192.0.2.1", "12345", "/tmp/acf", "/tmp/apf", "/tmp/arf")
+		if err != nil {
+			t.Fatalf("Create failed: %v", err)
+		}
+
+		// Stagger creation timestamps
+		mgr.mu.Lock()
+		sess.CreatedAt = now.Add(-age)
+		mgr.mu.Unlock()
+
+		if i == 0 {
+			mgr.MarkResultWritten(sess.ID)
+		}
+	}
+
+	stats := mgr.statsAt(now)
+
+	if stats.Total != 3 {
+		t.Errorf("Total = %d, want 3", stats.Total)
+	}
+	if stats.Pending != 2 {
+		t.Errorf("Pending = %d, want 2", stats.Pending)
+	}
+	if stats.Completed != 1 {
+		t.Errorf("Completed = %d, want 1", stats.Completed)
+	}
+	if stats.OldestAge != 80*time.Second {
+		t.Errorf("OldestAge = %v, want 80s", stats.OldestAge)
+	}
+	if stats.AverageAge != 40*time.Second {
+		t.Errorf("AverageAge = %v, want 40s", stats.AverageAge)
+	}
+}
+
+func TestStatsConcurrent(t *testing.T) {
+	mgr := NewManager(5*time.Minute, 0)
+	defer mgr.Stop()
+
+	done := make(chan bool)
+	for i := 0; i < 10; i++ {
+		go func() {
+			if _, err := mgr.Create("testuser", "cn", "192.0.2.1", "12345", "/tmp/acf", "/tmp/apf", "/tmp/arf"); err != nil {
+				t.Errorf("Create failed: %v", err)
+			}
+			_ = mgr.Stats()
+			done <- true
+		}()
+	}
+
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+
+	if stats := mgr.Stats(); stats.Total != 10 {
+		t.Errorf("Total = %d, want 10", stats.Total)
+	}
+}
+
+func TestFileStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	store := NewFileStore(path)
+
+	// A store that was never saved is empty
+	sessions, err := store.Load()
+	if err != nil || len(sessions) != 0 {
+		t.Fatalf("Load of missing file = (%v, %v), want empty", sessions, err)
+	}
+
+	now := time.Now().Truncate(time.Second)
+	want := []*Session{{
+		ID:           "session-1",
+		State:        "state-1",
+		CodeVerifier: "verifier-1",
+		Username:     "testuser",
+		UserCode:     "ABCDEFGH",
+		CreatedAt:    now,
+		ExpiresAt:    now.Add(5 * time.Minute),
+	}}
+	if err := store.Save(want[0]); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("session file mode = %o, want 600", perm)
+	}
+
+	got, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(got) != 1 || got[0].ID != "session-1" || got[0].CodeVerifier != "verifier-1" ||
+		got[0].UserCode != "ABCDEFGH" || !got[0].ExpiresAt.Equal(want[0].ExpiresAt) {
+		t.Errorf("Load() = %+v, want %+v", got, want)
+	}
+
+	if err := os.WriteFile(path, []byte("{not json"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Load(); err == nil {
+		t.Error("expected error loading corrupt session file")
+	}
+}
+
+func TestManagerSetStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	dir := t.TempDir()
+
+	first := NewManager(5*time.Minute, 0)
+	if _, err := first.SetStore(NewFileStore(path)); err != nil {
+		t.Fatalf("SetStore failed: %v", err)
+	}
+	pending, err := first.Create("testuser", "cn", "192.0.2.1", "12345",
+		filepath.Join(dir, "acf"), filepath.Join(dir, "apf"), filepath.Join(dir, "arf"))
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if err := first.UpdateOIDCFlow(pending.ID, "state-1", "verifier-1", "nonce", "https://example.com/auth"); err != nil {
+		t.Fatalf("UpdateOIDCFlow failed: %v", err)
+	}
+	deleted, err := first.Create("otheruser", "cn", "192.0.2.2", "12345", "", "", "")
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	first.Delete(deleted.ID)
+	first.Stop()
+
+	// Add an already expired session to the file behind the manager's back
+	store := NewFileStore(path)
+	if _, err := store.Load(); err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	expired := &Session{ID: "expired", State: "state-expired", Username: "testuser",
+		CreatedAt: time.Now().Add(-10 * time.Minute), ExpiresAt: time.Now().Add(-5 * time.Minute)}
+	if err := store.Save(expired); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	// A restarted manager picks up the pending session only
+	second := NewManager(5*time.Minute, 0)
+	defer second.Stop()
+	loaded, err := second.SetStore(NewFileStore(path))
+	if err != nil {
+		t.Fatalf("SetStore failed: %v", err)
+	}
+	if loaded != 1 {
+		t.Fatalf("loaded %d sessions, want 1", loaded)
+	}
+
+	got, err := second.GetByState("state-1")
+	if err != nil {
+		t.Fatalf("GetByState after restart failed: %v", err)
+	}
+	if got.ID != pending.ID || got.CodeVerifier != "verifier-1" || got.AuthControlFile != pending.AuthControlFile {
+		t.Errorf("restored session = %+v, want %+v", got, pending)
+	}
+	if _, err := second.GetByState("state-expired"); err == nil {
+		t.Error("expired session should not be loaded")
+	}
+	if _, err := second.Get(deleted.ID); err == nil {
+		t.Error("deleted session should not be loaded")
+	}
+	if n := len(second.userIndex["testuser"]); n != 1 {
+		t.Errorf("userIndex[testuser] has %d sessions, want 1", n)
+	}
+
+	// Expired sessions are dropped from the file on load
+	sessions, err := store.Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(sessions) != 1 {
+		t.Errorf("session file has %d sessions after load, want 1", len(sessions))
+	}
+
+	// Delete is persisted
+	second.Delete(pending.ID)
+	sessions, err = store.Load()
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if len(sessions) != 0 {
+		t.Errorf("session file has %d sessions after delete, want 0", len(sessions))
+	}
+}
+
+func TestRedisStoreSharedManagers(t *testing.T) {
+	srv := miniredis.RunT(t)
+	newStore := func() *RedisStore {
+		return NewRedisStore(redis.NewClient(&redis.Options{Addr: srv.Addr()}))
+	}
+	dir := t.TempDir()
+
+	// Two instances behind a load balancer share one Redis
+	first := NewManager(5*time.Minute, 0)
+	defer first.Stop()
+	if _, err := first.SetStore(newStore()); err != nil {
+		t.Fatalf("SetStore failed: %v", err)
+	}
+	second := NewManager(5*time.Minute, 0)
+	defer second.Stop()
+	if _, err := second.SetStore(newStore()); err != nil {
+		t.Fatalf("SetStore failed: %v", err)
+	}
+
+	created, err := first.Create("testuser", "cn", "192.0.2.1", "12345",
+		filepath.Join(dir, "acf"), filepath.Join(dir, "apf"), filepath.Join(dir, "arf"))
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if err := first.UpdateOIDCFlow(created.ID, "state-1", "verifier-1", "nonce", "https://example.com/auth"); err != nil {
+		t.Fatalf("UpdateOIDCFlow failed: %v", err)
+	}
+
+	// Local lookups never consult the shared store
+	if id, ok := second.LocalIDByState("state-1"); ok {
+		t.Errorf("LocalIDByState on second instance = %q, want not found", id)
+	}
+
+	// The callback reaches the other instance
+	got, err := second.GetByState("state-1")
+	if err != nil {
+		t.Fatalf("GetByState on second instance failed: %v", err)
+	}
+	if got.ID != created.ID || got.CodeVerifier != "verifier-1" || got.AuthControlFile != created.AuthControlFile {
+		t.Errorf("shared session = %+v, want %+v", got, created)
+	}
+	if _, err := second.Get(created.ID); err != nil {
+		t.Errorf("Get on second instance failed: %v", err)
+	}
+	if _, err := second.GetByState("unknown"); err == nil {
+		t.Error("expected error for unknown state")
+	}
+
+	// Only one instance may write the result
+	if !second.SetResult(created.ID, true) {
+		t.Fatal("SetResult on second instance should claim the result")
+	}
+	if first.MarkResultWritten(created.ID) {
+		t.Error("MarkResultWritten on first instance should fail after second claimed the result")
+	}
+	if written, _ := first.ResultWritten(created.ID); !written {
+		t.Error("first instance should see the result as written")
+	}
+
+	// Delete removes the session from Redis
+	second.Delete(created.ID)
+	first.Delete(created.ID)
+	if srv.Exists(redisSessionKey(created.ID)) || srv.Exists(redisStateKey("state-1")) {
+		t.Error("session keys should be deleted from redis")
+	}
+
+	// Keys expire with the session, also after the timeout changes
+	first.SetTimeout(time.Minute)
+	short, err := first.Create("otheruser", "cn", "192.0.2.2", "12345",
+		filepath.Join(dir, "acf2"), filepath.Join(dir, "apf2"), filepath.Join(dir, "arf2"))
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if ttl := srv.TTL(redisSessionKey(short.ID)); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("session key TTL = %v, want at most the new timeout of 1m", ttl)
+	}
+	if ttl := srv.TTL(redisResultKey(created.ID)); ttl <= 0 {
+		t.Errorf("result key TTL = %v, want positive", ttl)
+	}
+}
+
+func TestRedisStoreErrors(t *testing.T) {
+	srv := miniredis.RunT(t)
+	store := NewRedisStore(redis.NewClient(&redis.Options{Addr: srv.Addr()}))
+	defer func() { _ = store.Close() }()
+
+	session, err := store.GetByState("missing")
+	if err != nil || session != nil {
+		t.Errorf("GetByState(missing) = (%v, %v), want (nil, nil)", session, err)
+	}
+
+	srv.Close()
+	if _, err := store.Get("session-1"); err == nil {
+		t.Error("expected error when redis is unreachable")
+	}
+	if _, err := store.MarkResultWritten(&Session{ID: "session-1"}); err == nil {
+		t.Error("expected error when redis is unreachable")
+	}
+}
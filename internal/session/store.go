@@ -0,0 +1,163 @@
+package session
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// SessionStore persists sessions so pending authentications survive a
+// daemon restart. The Manager loads the stored sessions once when the store
+// is attached (see Manager.SetStore) and saves every later change.
+type SessionStore interface {
+	// Load returns the persisted sessions. A store that has never been
+	// saved returns no sessions and no error.
+	Load() ([]*Session, error)
+
+	// Save creates or replaces session in the store.
+	Save(session *Session) error
+
+	// Delete removes session from the store.
+	Delete(session *Session) error
+}
+
+// SharedStore is a SessionStore shared by several daemon instances, e.g.
+// behind a VIP where the callback may reach another instance than the one
+// that created the session. The Manager falls back to it for sessions it
+// does not know and claims results through it, so only one instance writes
+// each session's auth_control_file.
+type SharedStore interface {
+	SessionStore
+
+	// Get returns the session with the given ID, or nil if there is none.
+	Get(sessionID string) (*Session, error)
+
+	// GetByState returns the session with the given OIDC state, or nil if
+	// there is none.
+	GetByState(state string) (*Session, error)
+
+	// MarkResultWritten atomically claims the session's result across all
+	// instances. It returns false if the result was already claimed.
+	MarkResultWritten(session *Session) (bool, error)
+}
+
+// fileStoreVersion is the format version written to the session file.
+const fileStoreVersion = 1
+
+// fileStoreData is the on-disk layout of a FileStore.
+type fileStoreData struct {
+	Version  int        `json:"version"`
+	Sessions []*Session `json:"sessions"`
+}
+
+// FileStore is a SessionStore backed by a JSON file. The file contains PKCE
+// code verifiers, so it is written with mode 0600. Every change rewrites the
+// whole file atomically via a temporary file in the same directory.
+type FileStore struct {
+	path string
+
+	mu       sync.Mutex
+	sessions map[string]*Session
+}
+
+// NewFileStore creates a FileStore for path. The file is created on the
+// first Save; its directory must exist.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{path: path, sessions: make(map[string]*Session)}
+}
+
+// Load implements SessionStore.
+func (s *FileStore) Load() ([]*Session, error) {
+	data, err := os.ReadFile(s.path) // #nosec G304 -- path from trusted config
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read session file: %w", err)
+	}
+
+	var stored fileStoreData
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("failed to parse session file %s: %w", s.path, err)
+	}
+	if stored.Version != fileStoreVersion {
+		return nil, fmt.Errorf("session file %s has unsupported version %d", s.path, stored.Version)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions = make(map[string]*Session, len(stored.Sessions))
+	sessions := make([]*Session, 0, len(stored.Sessions))
+	for _, session := range stored.Sessions {
+		if session == nil {
+			continue
+		}
+		s.sessions[session.ID] = session
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// Save implements SessionStore.
+func (s *FileStore) Save(session *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[session.ID] = session
+	return s.write()
+}
+
+// Delete implements SessionStore.
+func (s *FileStore) Delete(session *Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.sessions[session.ID]; !ok {
+		return nil
+	}
+	delete(s.sessions, session.ID)
+	return s.write()
+}
+
+// write replaces the file with the current sessions, oldest first. Must be
+// called with s.mu held.
+func (s *FileStore) write() error {
+	sessions := make([]*Session, 0, len(s.sessions))
+	for _, session := range s.sessions {
+		sessions = append(sessions, session)
+	}
+	slices.SortFunc(sessions, func(a, b *Session) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+
+	data, err := json.Marshal(fileStoreData{Version: fileStoreVersion, Sessions: sessions})
+	if err != nil {
+		return fmt.Errorf("failed to encode sessions: %w", err)
+	}
+
+	// os.CreateTemp creates the file with mode 0600
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create session file: %w", err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write session file: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to sync session file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write session file: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to replace session file: %w", err)
+	}
+	return nil
+}
@@ -4,7 +4,7 @@ set -euo pipefail
 #
 # OpenVPN Keycloak SSO Authentication Script
 #
-# Called by OpenVPN via --auth-user-pass-verify <script> via-file
+# Called by OpenVPN via --auth-user-pass-verify <script> via-file (or via-env)
 # Thin wrapper that execs the Go binary in auth mode.
 #
 # Exit codes:
@@ -29,4 +29,6 @@ if [ -n "${_nproc_limit}" ] && [ "${_nproc_limit}" != "unlimited" ] && [ "${_npr
   ulimit -u unlimited 2>/dev/null || ulimit -u 256 2>/dev/null || true
 fi
 
-exec "$BINARY" --config "$CONFIG" auth "$1"
+# Add --json-output after "auth" to also log the decision to stdout as JSON.
+# With via-env there is no credentials file argument.
+exec "$BINARY" --config "$CONFIG" auth "$@"